@@ -2,16 +2,16 @@ package main
 
 import (
 	"log/slog"
-	_ "net/http/pprof"
 	"os"
 
 	"github.com/acorn-io/cmd"
 	"github.com/thedadams/clicky-serves/pkg/cli"
+	"github.com/thedadams/clicky-serves/pkg/log"
 )
 
 func main() {
 	if os.Getenv("CLICKY_SERVES_DEBUG") != "" {
-		slog.SetLogLoggerLevel(slog.LevelDebug)
+		log.SetLevel(slog.LevelDebug)
 	}
-	cmd.Main(cmd.Command(new(cli.Server)))
+	cmd.Main(cmd.Command(new(cli.Server), new(cli.Run), new(cli.Parse), new(cli.Watch), new(cli.Monitor)))
 }
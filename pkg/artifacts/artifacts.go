@@ -0,0 +1,40 @@
+// Package artifacts keeps the files that runs write to their workspaces, so that they can be downloaded once the run has ended and
+// its workspace is gone.
+//
+// The artifacts of a run are kept by the ID of the run. Artifacts don't know the tenant of their run, so the tenant must be checked
+// against the run history before the artifacts of a run are served.
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Artifact is a file that a run wrote to its workspace.
+type Artifact struct {
+	// Name is the path of the file in the workspace, separated by slashes.
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Store is where artifacts are kept.
+type Store interface {
+	// Put saves the artifact of the run, whose content is read from r, replacing the artifact of the run with the same name.
+	Put(ctx context.Context, runID string, artifact Artifact, r io.Reader) error
+	// Open returns the artifact of the run with its content, which must be closed.
+	Open(ctx context.Context, runID, name string) (io.ReadCloser, Artifact, error)
+	// List returns the artifacts of the run, sorted by name.
+	List(ctx context.Context, runID string) ([]Artifact, error)
+}
+
+// ValidName returns whether the name can be the name of an artifact: a path that is separated by slashes, and that stays in the
+// workspace.
+func ValidName(name string) bool {
+	return name != "." && fs.ValidPath(name)
+}
@@ -0,0 +1,62 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/thedadams/clicky-serves/pkg/objects"
+)
+
+// Bucket is a Store that keeps the artifacts of each run in object storage, under a prefix that is the ID of the run.
+type Bucket struct {
+	objects objects.Store
+}
+
+// NewBucket returns a Store that keeps artifacts in the object store.
+func NewBucket(store objects.Store) *Bucket {
+	return &Bucket{objects: store}
+}
+
+func (b *Bucket) Put(ctx context.Context, runID string, artifact Artifact, r io.Reader) error {
+	if !ValidName(artifact.Name) {
+		return fmt.Errorf("invalid artifact %q of run %q", artifact.Name, runID)
+	}
+	return b.objects.Put(ctx, objects.Object{Key: key(runID, artifact.Name), Size: artifact.Size, ModTime: artifact.ModTime}, r)
+}
+
+func (b *Bucket) Open(ctx context.Context, runID, name string) (io.ReadCloser, Artifact, error) {
+	if !ValidName(name) {
+		return nil, Artifact{}, ErrNotFound
+	}
+
+	rc, object, err := b.objects.Open(ctx, key(runID, name))
+	if errors.Is(err, objects.ErrNotFound) {
+		return nil, Artifact{}, ErrNotFound
+	} else if err != nil {
+		return nil, Artifact{}, err
+	}
+	return rc, Artifact{Name: name, Size: object.Size, ModTime: object.ModTime}, nil
+}
+
+// List returns the artifacts of the run. Their modification times are when they were put in the bucket.
+func (b *Bucket) List(ctx context.Context, runID string) ([]Artifact, error) {
+	prefix := key(runID, "")
+	list, err := b.objects.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts := make([]Artifact, 0, len(list))
+	for _, o := range list {
+		artifacts = append(artifacts, Artifact{Name: strings.TrimPrefix(o.Key, prefix), Size: o.Size, ModTime: o.ModTime})
+	}
+	return artifacts, nil
+}
+
+// key returns the key of the artifact of the run, or the prefix of the keys of the artifacts of the run if the name is empty.
+func key(runID, name string) string {
+	return runID + "/" + name
+}
@@ -0,0 +1,135 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tempPrefix is the prefix of the names of the artifacts that are still being written.
+const tempPrefix = ".artifact-"
+
+// Dir is a Store that keeps the artifacts of each run in a directory named by the ID of the run.
+type Dir struct {
+	dir string
+}
+
+// NewDir returns a Store that keeps artifacts in the directory, which is created if it doesn't exist.
+func NewDir(dir string) (*Dir, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Dir{dir: dir}, nil
+}
+
+func (d *Dir) Put(_ context.Context, runID string, artifact Artifact, r io.Reader) error {
+	p, err := d.path(runID, artifact.Name)
+	if err != nil || !ValidName(artifact.Name) {
+		return fmt.Errorf("invalid artifact %q of run %q", artifact.Name, runID)
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+
+	// The artifact is written to a temporary name first, so that a partial artifact is never served.
+	f, err := os.CreateTemp(filepath.Dir(p), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if !artifact.ModTime.IsZero() {
+		if err = os.Chtimes(f.Name(), artifact.ModTime, artifact.ModTime); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+func (d *Dir) Open(_ context.Context, runID, name string) (io.ReadCloser, Artifact, error) {
+	p, err := d.path(runID, name)
+	if err != nil {
+		return nil, Artifact{}, err
+	}
+
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, Artifact{}, ErrNotFound
+	} else if err != nil {
+		return nil, Artifact{}, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, Artifact{}, err
+	}
+	if !info.Mode().IsRegular() {
+		_ = f.Close()
+		return nil, Artifact{}, ErrNotFound
+	}
+
+	return f, Artifact{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (d *Dir) List(_ context.Context, runID string) ([]Artifact, error) {
+	root, err := d.path(runID, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Artifact
+	err = filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == root {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), tempPrefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		list = append(list, Artifact{Name: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// path returns the path of the artifact of the run, which must be in the directory of the run. Backslashes aren't allowed, so that
+// names can't leave the directory on Windows either.
+func (d *Dir) path(runID, name string) (string, error) {
+	if !ValidName(runID) || strings.ContainsAny(runID, `/\`) || !fs.ValidPath(name) || strings.ContainsRune(name, '\\') {
+		return "", ErrNotFound
+	}
+	return filepath.Join(d.dir, runID, filepath.FromSlash(name)), nil
+}
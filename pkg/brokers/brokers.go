@@ -0,0 +1,115 @@
+// Package brokers publishes messages to message brokers, like NATS, Kafka, and Redis Streams, so that other systems can consume
+// what happens on a server without being connected to it.
+package brokers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// The types of brokers.
+const (
+	TypeNATS  = "nats"
+	TypeKafka = "kafka"
+	TypeRedis = "redis"
+)
+
+// Message is a message that is published to a topic, which is the subject of NATS, the topic of Kafka, or the stream of Redis.
+type Message struct {
+	Topic string
+	// Key is the key of the message in Kafka, which the partition of the message is chosen by, and a field of the entry in Redis.
+	// NATS has no keys, so it is dropped.
+	Key   string
+	Value []byte
+}
+
+// Publisher publishes messages to a broker. A publisher reconnects to its broker when it is disconnected, so publishing can fail
+// while the broker is unavailable, and succeed again once it is back.
+type Publisher interface {
+	// Publish publishes the messages in order. It must not be called concurrently.
+	Publish(ctx context.Context, messages ...Message) error
+	Close() error
+}
+
+// Config configures the broker that messages are published to.
+type Config struct {
+	// Type is nats, kafka, or redis, for Redis Streams.
+	Type string
+	// URL is the URL of the broker:
+	//   - nats://[user:password@]host[:port], or tls://... for TLS. A user without a password is a token.
+	//   - kafka://[user:password@]host[:port][,host[:port]...][?tls=true], authenticating with SASL/PLAIN if there is a user.
+	//   - redis://[[user]:password@]host[:port][/db][?maxLen=n], or rediss://... for TLS. Streams are trimmed to about maxLen
+	//     entries if it is set.
+	URL string
+}
+
+func (c Config) Validate() error {
+	_, err := c.parse()
+	return err
+}
+
+// parse returns the URL of the config, with the default port of the broker if it has none.
+func (c Config) parse() (*url.URL, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+
+	var schemes []string
+	var port string
+	switch c.Type {
+	case TypeNATS:
+		schemes, port = []string{"nats", "tls"}, "4222"
+	case TypeKafka:
+		schemes, port = []string{"kafka"}, "9092"
+	case TypeRedis:
+		schemes, port = []string{"redis", "rediss"}, "6379"
+	default:
+		return nil, fmt.Errorf("invalid type %q, must be %s, %s, or %s", c.Type, TypeNATS, TypeKafka, TypeRedis)
+	}
+
+	var ok bool
+	for _, s := range schemes {
+		ok = ok || u.Scheme == s
+	}
+	if !ok {
+		return nil, fmt.Errorf("the URL of a %s broker must start with %s://", c.Type, strings.Join(schemes, ":// or "))
+	}
+	if u.Host == "" {
+		return nil, errors.New("the URL must have a host")
+	}
+
+	// Kafka has a list of bootstrap brokers, which each get the default port.
+	hosts := strings.Split(u.Host, ",")
+	for i, h := range hosts {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			hosts[i] = net.JoinHostPort(strings.Trim(h, "[]"), port)
+		}
+	}
+	if len(hosts) > 1 && c.Type != TypeKafka {
+		return nil, fmt.Errorf("a %s broker has only one host", c.Type)
+	}
+	u.Host = strings.Join(hosts, ",")
+	return u, nil
+}
+
+// New returns the publisher of the broker of the config. NATS and Redis are connected to when the first messages are published.
+func New(config Config) (Publisher, error) {
+	u, err := config.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Type {
+	case TypeNATS:
+		return newNATS(u), nil
+	case TypeKafka:
+		return newKafka(u)
+	default:
+		return newRedis(u)
+	}
+}
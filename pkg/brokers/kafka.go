@@ -0,0 +1,64 @@
+package brokers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+const (
+	// kafkaBatchTimeout is how long messages are held to be batched with the next ones. The messages of a publish are batched
+	// together, so it is short.
+	kafkaBatchTimeout = 10 * time.Millisecond
+	kafkaTimeout      = 10 * time.Second
+)
+
+// kafkaPublisher produces messages to the topics of a Kafka cluster. Messages with the same key go to the same partition, so that
+// they are consumed in order.
+type kafkaPublisher struct {
+	w *kafka.Writer
+}
+
+func newKafka(u *url.URL) (*kafkaPublisher, error) {
+	transport := &kafka.Transport{DialTimeout: kafkaTimeout}
+	if v := u.Query().Get("tls"); v != "" {
+		useTLS, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls %q, must be true or false", v)
+		}
+		if useTLS {
+			transport.TLS = &tls.Config{}
+		}
+	}
+	if password, ok := u.User.Password(); ok {
+		transport.SASL = plain.Mechanism{Username: u.User.Username(), Password: password}
+	}
+
+	return &kafkaPublisher{w: &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(u.Host, ",")...),
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: kafkaBatchTimeout,
+		WriteTimeout: kafkaTimeout,
+		RequiredAcks: kafka.RequireOne,
+		Transport:    transport,
+	}}, nil
+}
+
+func (k *kafkaPublisher) Publish(ctx context.Context, messages ...Message) error {
+	msgs := make([]kafka.Message, 0, len(messages))
+	for _, m := range messages {
+		msgs = append(msgs, kafka.Message{Topic: m.Topic, Key: []byte(m.Key), Value: m.Value})
+	}
+	return k.w.WriteMessages(ctx, msgs...)
+}
+
+func (k *kafkaPublisher) Close() error {
+	return k.w.Close()
+}
@@ -0,0 +1,59 @@
+package brokers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const natsDialTimeout = 10 * time.Second
+
+// natsPublisher publishes messages with the core protocol of NATS. Once it is connected, the connection reconnects in the
+// background, and the messages that are published while it is reconnecting are buffered until it is back. If the first connection
+// fails, then it is made again on the next publish.
+type natsPublisher struct {
+	url string
+
+	lock sync.Mutex
+	conn *nats.Conn
+}
+
+func newNATS(u *url.URL) *natsPublisher {
+	return &natsPublisher{url: u.String()}
+}
+
+func (n *natsPublisher) Publish(_ context.Context, messages ...Message) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.conn == nil || n.conn.IsClosed() {
+		conn, err := nats.Connect(n.url, nats.Name("clicky-serves"), nats.Timeout(natsDialTimeout), nats.MaxReconnects(-1))
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		n.conn = conn
+	}
+
+	for _, m := range messages {
+		if err := n.conn.Publish(m.Topic, m.Value); err != nil {
+			return fmt.Errorf("failed to publish to NATS subject %q: %w", m.Topic, err)
+		}
+	}
+	return nil
+}
+
+func (n *natsPublisher) Close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.conn != nil {
+		// Closing flushes the messages that haven't been written yet.
+		n.conn.Close()
+		n.conn = nil
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package brokers
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisTimeout = 10 * time.Second
+
+// redisPublisher adds messages to Redis Streams with XADD. The messages of a publish are pipelined.
+type redisPublisher struct {
+	c *redis.Client
+	// maxLen is the approximate length that streams are trimmed to, or 0 if they aren't trimmed.
+	maxLen int64
+}
+
+func newRedis(u *url.URL) (*redisPublisher, error) {
+	opts := &redis.Options{
+		Addr:         u.Host,
+		Username:     u.User.Username(),
+		DialTimeout:  redisTimeout,
+		ReadTimeout:  redisTimeout,
+		WriteTimeout: redisTimeout,
+		// A message that failed to be added might have been added anyway, so it isn't retried, which could add it twice.
+		MaxRetries: -1,
+	}
+	opts.Password, _ = u.User.Password()
+	if u.Scheme == "rediss" {
+		host, _, _ := net.SplitHostPort(u.Host)
+		opts.TLSConfig = &tls.Config{ServerName: host}
+	}
+
+	var (
+		p   = &redisPublisher{}
+		err error
+	)
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if opts.DB, err = strconv.Atoi(db); err != nil || opts.DB < 0 {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	if maxLen := u.Query().Get("maxLen"); maxLen != "" {
+		if p.maxLen, err = strconv.ParseInt(maxLen, 10, 64); err != nil || p.maxLen <= 0 {
+			return nil, fmt.Errorf("invalid maxLen %q, must be a positive number", maxLen)
+		}
+	}
+
+	p.c = redis.NewClient(opts)
+	return p, nil
+}
+
+func (p *redisPublisher) Publish(ctx context.Context, messages ...Message) error {
+	cmds, err := p.c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, m := range messages {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: m.Topic,
+				MaxLen: p.maxLen,
+				Approx: p.maxLen > 0,
+				Values: []any{"key", m.Key, "value", m.Value},
+			})
+		}
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+
+	// Every message that Redis rejected is reported, and not only the first.
+	var errs []error
+	for _, cmd := range cmds {
+		var redisErr redis.Error
+		if err := cmd.Err(); errors.As(err, &redisErr) {
+			errs = append(errs, err)
+		} else if err != nil {
+			return fmt.Errorf("failed to publish to Redis: %w", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *redisPublisher) Close() error {
+	return p.c.Close()
+}
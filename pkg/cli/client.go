@@ -0,0 +1,251 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+const (
+	ansiReset   = "\033[0m"
+	ansiBold    = "\033[1m"
+	ansiDim     = "\033[2m"
+	ansiReverse = "\033[7m"
+	ansiRed     = "\033[31m"
+	ansiGreen   = "\033[32m"
+	ansiYellow  = "\033[33m"
+	ansiCyan    = "\033[36m"
+)
+
+// Client is the connection to a server that the client subcommands make their requests to.
+type Client struct {
+	URL    string `usage:"URL of the server" default:"http://localhost:8080" env:"CLICKY_SERVES_URL"`
+	APIKey string `name:"api-key" usage:"API key that the requests are authenticated with" env:"CLICKY_SERVES_API_KEY"`
+}
+
+// Output is how the subcommands that stream the events of a run print them.
+type Output struct {
+	JSON  bool `name:"json" usage:"Print the events as newline-delimited JSON instead of rendering them" env:"CLICKY_SERVES_JSON"`
+	Quiet bool `short:"q" usage:"Only print the output of the run, without its progress" env:"CLICKY_SERVES_QUIET"`
+}
+
+// do makes a request to the server, and returns the response if it succeeded. Error responses are returned as errors with the
+// message and the code of the error.
+func (c *Client) do(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.URL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/x-ndjson, application/json")
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	var e struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if json.Unmarshal(b, &e) != nil || e.Error == "" {
+		e.Error = strings.TrimSpace(string(b))
+	}
+	if e.Code != "" {
+		return nil, fmt.Errorf("server responded with %d (%s): %s", resp.StatusCode, e.Code, e.Error)
+	}
+	return nil, fmt.Errorf("server responded with %d: %s", resp.StatusCode, e.Error)
+}
+
+// doJSON makes a request with the JSON of the body, and returns the body of the response.
+func (c *Client) doJSON(ctx context.Context, method, path string, body any) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	resp, err := c.do(ctx, method, path, "application/json", r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// stream renders the newline-delimited JSON events of the response until it ends, and returns the exit code of the run.
+func (o Output) stream(resp *http.Response) (int, error) {
+	defer resp.Body.Close()
+
+	r := newRenderer(o.JSON, o.Quiet)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			r.render(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 1, fmt.Errorf("failed to read events: %w", err)
+	}
+
+	return r.finish(), nil
+}
+
+// exitWith exits with the exit code of the run, so that scripts can tell its failures apart as if they had run it themselves.
+func exitWith(code int) error {
+	if code != 0 {
+		os.Exit(code)
+	}
+	return nil
+}
+
+// renderer prints the events of a run to the terminal. The output of the run goes to stdout, and its progress, like the calls
+// that it makes and its errors, goes to stderr, so that the output can be piped.
+type renderer struct {
+	stdout, stderr io.Writer
+	json, quiet    bool
+	color          bool
+
+	// depths are the depths of the calls of the run, by their ID, which their progress is indented by.
+	depths   map[string]int
+	tokens   int64
+	exitCode int
+	failed   bool
+	started  time.Time
+}
+
+func newRenderer(raw, quiet bool) *renderer {
+	return &renderer{
+		stdout:  os.Stdout,
+		stderr:  os.Stderr,
+		json:    raw,
+		quiet:   quiet,
+		color:   isTerminal(os.Stderr) && os.Getenv("NO_COLOR") == "",
+		depths:  make(map[string]int),
+		started: time.Now(),
+	}
+}
+
+// isTerminal reports whether the file is a terminal, which is the only place that colors are printed to.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (r *renderer) render(line []byte) {
+	var e events.Envelope
+	if err := json.Unmarshal(line, &e); err != nil {
+		fmt.Fprintf(r.stderr, "%s\n", line)
+		return
+	}
+
+	switch d := e.Data.(type) {
+	case events.Stdout:
+		// Runs that stream their output write it as it comes, so it is written as it is, without adding a newline.
+		if !r.json {
+			fmt.Fprint(r.stdout, d.Stdout)
+		}
+	case events.Error:
+		r.failed = true
+		r.exitCode = d.ExitCode
+		if !r.json {
+			fmt.Fprintln(r.stderr, r.paint(ansiRed, "✗ "+d.Err))
+		}
+	case events.Usage:
+		// Each usage event has the usage of the run so far.
+		r.tokens = d.Usage.TotalTokens
+	}
+
+	if r.json {
+		fmt.Fprintf(r.stdout, "%s\n", line)
+		return
+	}
+	if r.quiet {
+		return
+	}
+
+	switch d := e.Data.(type) {
+	case events.Stderr:
+		fmt.Fprint(r.stderr, r.paint(ansiDim, d.Stderr))
+	case events.QueuePosition:
+		fmt.Fprintln(r.stderr, r.paint(ansiDim, fmt.Sprintf("… queued at position %d", d.QueuePosition)))
+	case events.Retry:
+		fmt.Fprintln(r.stderr, r.paint(ansiDim, fmt.Sprintf("↻ retrying in %s (attempt %d of %d): %s", d.Retry.Delay,
+			d.Retry.Attempt, d.Retry.MaxAttempts, d.Retry.Error)))
+	case events.Call:
+		call := d.CallContext
+		if call == nil {
+			return
+		}
+
+		switch d.Type {
+		case events.TypeCallStart:
+			depth := 0
+			if parent, ok := r.depths[call.ParentID]; ok && call.ParentID != "" {
+				depth = parent + 1
+			}
+			r.depths[call.ID] = depth
+			fmt.Fprintln(r.stderr, strings.Repeat("  ", depth)+r.paint(ansiCyan, "▸ "+callName(call)))
+		case events.TypeCallFinish:
+			fmt.Fprintln(r.stderr, strings.Repeat("  ", r.depths[call.ID])+r.paint(ansiGreen, "✓ "+callName(call)))
+		}
+	}
+}
+
+// finish prints a summary of the run, and returns its exit code, which is 1 for runs that failed without one.
+func (r *renderer) finish() int {
+	if r.failed && r.exitCode == 0 {
+		r.exitCode = 1
+	}
+	if !r.json && !r.quiet {
+		outcome := "done"
+		if r.failed {
+			outcome = "failed"
+		}
+		summary := fmt.Sprintf("%s in %s", outcome, time.Since(r.started).Round(time.Millisecond))
+		if r.tokens > 0 {
+			summary += fmt.Sprintf(", %d tokens", r.tokens)
+		}
+		fmt.Fprintln(r.stderr, r.paint(ansiDim, summary))
+	}
+	return r.exitCode
+}
+
+func (r *renderer) paint(color, s string) string {
+	if !r.color || s == "" {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+// callName returns the name of the tool of a call, or its ID if the tool has no name, like the tool of a file without a name.
+func callName(call *events.CallContext) string {
+	if call.Tool != nil && call.Tool.Name != "" {
+		return call.Tool.Name
+	}
+	return "call " + call.ID
+}
@@ -0,0 +1,499 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/thedadams/clicky-serves/pkg/events"
+	"golang.org/x/term"
+)
+
+const (
+	keyUp    = "\x1b[A"
+	keyDown  = "\x1b[B"
+	keyEsc   = "\x1b"
+	keyEnter = "\r"
+	keyCtrlC = "\x03"
+
+	// monitorEventLines is how many events of a run are kept to be shown.
+	monitorEventLines = 1000
+)
+
+// Monitor is a terminal UI that lists the active runs of a server, and tails the events of a run and cancels it. Runs are listed with the admin API, so the API key must have the admin scope.
+type Monitor struct {
+	Client
+
+	Interval string `usage:"How often the list of runs is refreshed" default:"2s" env:"CLICKY_SERVES_MONITOR_INTERVAL"`
+}
+
+func (m *Monitor) Customize(cmd *cobra.Command) {
+	cmd.Use = "monitor [flags]"
+	cmd.Short = "Monitor the active runs of a server in a terminal UI"
+	cmd.Long = `Monitor the active runs of a server in a terminal UI, which lists the queued and running runs, and tails the events of a run.
+
+In the list of runs, use the arrow keys or j and k to select a run, enter to tail its events, and c to cancel it. While tailing a
+run, c cancels the run, and esc goes back to the list. q quits.
+The runs are listed with the admin API, so the API key must have the admin scope.`
+	cmd.Args = cobra.NoArgs
+}
+
+func (m *Monitor) Run(cmd *cobra.Command, _ []string) error {
+	interval, err := time.ParseDuration(m.Interval)
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("invalid interval %q", m.Interval)
+	}
+
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(in) || !term.IsTerminal(out) {
+		return errors.New("monitor must be run in a terminal")
+	}
+
+	// The runs are listed once before the terminal is taken over, so that errors like a missing admin scope are printed as usual.
+	runs, err := m.activeRuns(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return fmt.Errorf("failed to put the terminal in raw mode: %w", err)
+	}
+	defer func() {
+		_ = term.Restore(in, state)
+	}()
+
+	// The UI is drawn on the alternate screen without a cursor, so that the terminal is left as it was once it quits.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	ui := &monitorUI{
+		m:         m,
+		ctx:       cmd.Context(),
+		out:       out,
+		runs:      runs,
+		refreshed: time.Now(),
+		redraw:    make(chan struct{}, 1),
+	}
+	return ui.loop(interval)
+}
+
+// monitorRun is a run as it is listed by the admin API.
+type monitorRun struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	State     string    `json:"state"`
+	Client    string    `json:"client"`
+	StartTime time.Time `json:"startTime"`
+	Usage     *struct {
+		TotalTokens int64 `json:"totalTokens"`
+	} `json:"usage"`
+}
+
+// activeRuns returns the queued and running runs, oldest first.
+func (m *Monitor) activeRuns(ctx context.Context) ([]monitorRun, error) {
+	var runs []monitorRun
+	for _, state := range []string{"queued", "running"} {
+		out, err := m.doJSON(ctx, http.MethodGet, "/runs?status="+state, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s runs: %w", state, err)
+		}
+
+		var resp struct {
+			Runs []monitorRun `json:"runs"`
+		}
+		if err = json.Unmarshal(out, &resp); err != nil {
+			return nil, fmt.Errorf("failed to decode runs: %w", err)
+		}
+		runs = append(runs, resp.Runs...)
+	}
+
+	slices.SortFunc(runs, func(a, b monitorRun) int {
+		return a.StartTime.Compare(b.StartTime)
+	})
+	return runs, nil
+}
+
+// monitorLine is a line of the UI, which is painted once it has been cut to the width of the terminal.
+type monitorLine struct {
+	color string
+	text  string
+}
+
+// monitorUI is the state of the terminal UI. It is changed by the keys that are pressed and by the goroutines that refresh the
+// runs and tail the events of a run, which hold the lock while they change it and then ask for the UI to be drawn again.
+type monitorUI struct {
+	m   *Monitor
+	ctx context.Context
+	out int
+
+	lock      sync.Mutex
+	runs      []monitorRun
+	selected  int
+	refreshed time.Time
+	// tailing is the ID of the run whose events are shown, or empty while the runs are listed.
+	tailing  string
+	events   []monitorLine
+	stopTail context.CancelFunc
+	// prompt is a question that is answered with y or n, like whether to cancel a run, and onAnswer is called with the answer.
+	prompt   string
+	onAnswer func(bool)
+	status   monitorLine
+
+	redraw chan struct{}
+}
+
+func (ui *monitorUI) loop(interval time.Duration) error {
+	keys := make(chan string)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- string(buf[:n])
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ui.draw()
+
+		select {
+		case <-ui.ctx.Done():
+			return nil
+		case k, ok := <-keys:
+			if !ok || ui.key(k) {
+				ui.lock.Lock()
+				if ui.stopTail != nil {
+					ui.stopTail()
+				}
+				ui.lock.Unlock()
+				return nil
+			}
+		case <-ticker.C:
+			go ui.refresh()
+		case <-ui.redraw:
+		}
+	}
+}
+
+// update changes the state of the UI, and asks for it to be drawn again.
+func (ui *monitorUI) update(f func()) {
+	ui.lock.Lock()
+	f()
+	ui.lock.Unlock()
+
+	select {
+	case ui.redraw <- struct{}{}:
+	default:
+	}
+}
+
+func (ui *monitorUI) refresh() {
+	ctx, cancel := context.WithTimeout(ui.ctx, 10*time.Second)
+	defer cancel()
+
+	runs, err := ui.m.activeRuns(ctx)
+	ui.update(func() {
+		if err != nil {
+			ui.status = monitorLine{color: ansiRed, text: err.Error()}
+			return
+		}
+
+		// The selection follows the selected run, wherever it is in the new list.
+		var id string
+		if ui.selected < len(ui.runs) {
+			id = ui.runs[ui.selected].ID
+		}
+		ui.runs, ui.refreshed = runs, time.Now()
+		if i := slices.IndexFunc(runs, func(r monitorRun) bool { return r.ID == id }); i >= 0 {
+			ui.selected = i
+		}
+		ui.selected = max(0, min(ui.selected, len(ui.runs)-1))
+	})
+}
+
+// key handles a key that was pressed, and reports whether the UI should quit.
+func (ui *monitorUI) key(k string) bool {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	if ui.prompt != "" {
+		answer := ui.onAnswer
+		ui.prompt, ui.onAnswer = "", nil
+		answer(k == "y" || k == "Y")
+		return false
+	}
+
+	switch k {
+	case "q", keyCtrlC:
+		return true
+	case "r":
+		go ui.refresh()
+		return false
+	}
+
+	if ui.tailing == "" {
+		switch k {
+		case keyUp, "k":
+			ui.selected = max(0, ui.selected-1)
+		case keyDown, "j":
+			ui.selected = max(0, min(ui.selected+1, len(ui.runs)-1))
+		case keyEnter:
+			if ui.selected < len(ui.runs) {
+				ui.tail(ui.runs[ui.selected].ID)
+			}
+		case "c":
+			if ui.selected < len(ui.runs) {
+				ui.confirmCancel(ui.runs[ui.selected].ID)
+			}
+		}
+		return false
+	}
+
+	switch k {
+	case keyEsc, "b":
+		ui.stopTail()
+		ui.tailing, ui.events, ui.stopTail = "", nil, nil
+	case "c":
+		ui.confirmCancel(ui.tailing)
+	}
+	return false
+}
+
+// confirmCancel asks whether to cancel the run, and cancels it if the answer is yes.
+func (ui *monitorUI) confirmCancel(id string) {
+	ui.prompt = fmt.Sprintf("Cancel run %s? (y/n)", id)
+	ui.onAnswer = func(yes bool) {
+		if yes {
+			go ui.cancelRun(id)
+		}
+	}
+}
+
+func (ui *monitorUI) cancelRun(id string) {
+	_, err := ui.m.doJSON(ui.ctx, http.MethodDelete, "/runs/"+url.PathEscape(id), nil)
+	ui.update(func() {
+		if err != nil {
+			ui.status = monitorLine{color: ansiRed, text: fmt.Sprintf("Failed to cancel run %s: %v", id, err)}
+			return
+		}
+		ui.status = monitorLine{color: ansiGreen, text: fmt.Sprintf("Canceled run %s", id)}
+	})
+	ui.refresh()
+}
+
+// tail starts to stream the events of the run, from its first event, until the run ends or the UI goes back to the list of runs.
+// The lock must be held by the caller.
+func (ui *monitorUI) tail(id string) {
+	ctx, cancel := context.WithCancel(ui.ctx)
+	ui.tailing, ui.events, ui.stopTail, ui.status = id, nil, cancel, monitorLine{}
+
+	// The events of a run that is no longer tailed are dropped, which is known by its context having been canceled.
+	add := func(f func()) {
+		ui.update(func() {
+			if ctx.Err() == nil {
+				f()
+			}
+		})
+	}
+
+	go func() {
+		resp, err := ui.m.do(ctx, http.MethodGet, "/runs/"+url.PathEscape(id)+"/events?format=ndjson", "", nil)
+		if err != nil {
+			add(func() { ui.addEvent(monitorLine{color: ansiRed, text: err.Error()}) })
+			return
+		}
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+		for scanner.Scan() {
+			line := bytes.Clone(bytes.TrimSpace(scanner.Bytes()))
+			if len(line) > 0 {
+				add(func() { ui.handleEvent(line) })
+			}
+		}
+		add(func() { ui.addEvent(monitorLine{color: ansiDim, text: "— end of events —"}) })
+	}()
+}
+
+// handleEvent adds the event of the tailed run to the events that are shown.
+func (ui *monitorUI) handleEvent(line []byte) {
+	var e events.Envelope
+	if err := json.Unmarshal(line, &e); err != nil {
+		ui.addEvent(monitorLine{text: string(line)})
+		return
+	}
+
+	switch d := e.Data.(type) {
+	case events.Stdout:
+		ui.addText("", d.Stdout)
+	case events.Stderr:
+		ui.addText(ansiDim, d.Stderr)
+	case events.Error:
+		ui.addText(ansiRed, "✗ "+d.Err)
+	case events.Lifecycle:
+		ui.addEvent(monitorLine{color: ansiDim, text: "● " + string(d.Lifecycle)})
+	case events.QueuePosition:
+		ui.addEvent(monitorLine{color: ansiDim, text: fmt.Sprintf("… queued at position %d", d.QueuePosition)})
+	case events.Retry:
+		ui.addEvent(monitorLine{color: ansiDim, text: fmt.Sprintf("↻ retrying in %s (attempt %d of %d): %s", d.Retry.Delay,
+			d.Retry.Attempt, d.Retry.MaxAttempts, d.Retry.Error)})
+	case events.Usage:
+		ui.addEvent(monitorLine{color: ansiDim, text: fmt.Sprintf("+ %d tokens so far", d.Usage.TotalTokens)})
+	case events.Call:
+		ui.handleCall(d)
+	case events.Done:
+		ui.addEvent(monitorLine{color: ansiDim, text: "— done —"})
+	}
+}
+
+// handleCall adds the start and the finish of the calls of the tailed run to the events that are shown.
+func (ui *monitorUI) handleCall(e events.Call) {
+	call := e.CallContext
+	if call == nil {
+		return
+	}
+
+	switch e.Type {
+	case events.TypeCallStart:
+		ui.addEvent(monitorLine{color: ansiCyan, text: "▸ " + callName(call)})
+	case events.TypeCallFinish:
+		ui.addEvent(monitorLine{color: ansiGreen, text: "✓ " + callName(call)})
+	}
+}
+
+// addText adds each line of the text as an event line.
+func (ui *monitorUI) addText(color, text string) {
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		ui.addEvent(monitorLine{color: color, text: line})
+	}
+}
+
+func (ui *monitorUI) addEvent(line monitorLine) {
+	ui.events = append(ui.events, line)
+	if len(ui.events) > monitorEventLines {
+		ui.events = ui.events[len(ui.events)-monitorEventLines:]
+	}
+}
+
+// draw draws the UI again, cutting its lines to the size of the terminal.
+func (ui *monitorUI) draw() {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	width, height, err := term.GetSize(ui.out)
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	var (
+		lines  []monitorLine
+		footer []monitorLine
+	)
+	if ui.tailing == "" {
+		lines, footer = ui.listView(height)
+	} else {
+		lines, footer = ui.tailView(height)
+	}
+
+	if ui.prompt != "" {
+		footer = append([]monitorLine{{color: ansiYellow, text: ui.prompt}}, footer...)
+	} else if ui.status.text != "" {
+		footer = append([]monitorLine{ui.status}, footer...)
+	}
+
+	// The footer is at the bottom of the screen, and the lines above it are cut to fit.
+	if room := height - len(footer); len(lines) > room {
+		lines = lines[:max(0, room)]
+	}
+	for len(lines)+len(footer) < height {
+		lines = append(lines, monitorLine{})
+	}
+	lines = append(lines, footer...)
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H\x1b[2J")
+	for i, line := range lines {
+		if i > 0 {
+			sb.WriteString("\r\n")
+		}
+		text := []rune(line.text)
+		if len(text) > width {
+			text = text[:width]
+		}
+		if line.color != "" && len(text) > 0 {
+			sb.WriteString(line.color + string(text) + ansiReset)
+		} else {
+			sb.WriteString(string(text))
+		}
+	}
+	fmt.Print(sb.String())
+}
+
+func (ui *monitorUI) listView(height int) ([]monitorLine, []monitorLine) {
+	lines := []monitorLine{
+		{color: ansiBold, text: fmt.Sprintf("clicky-serves monitor  %s  %d active runs  refreshed %s", ui.m.URL, len(ui.runs),
+			ui.refreshed.Format(time.TimeOnly))},
+		{},
+		{color: ansiDim, text: fmt.Sprintf("  %-36s  %-8s  %-6s  %-16s  %-9s  %s", "RUN", "STATE", "TYPE", "CLIENT", "AGE", "TOKENS")},
+	}
+	if len(ui.runs) == 0 {
+		lines = append(lines, monitorLine{color: ansiDim, text: "  No active runs"})
+	}
+
+	// The list scrolls so that the selected run is always shown.
+	rows := max(1, height-len(lines)-2)
+	first := max(0, ui.selected-rows+1)
+	for i := first; i < len(ui.runs) && i < first+rows; i++ {
+		r := ui.runs[i]
+		var tokens int64
+		if r.Usage != nil {
+			tokens = r.Usage.TotalTokens
+		}
+
+		line := monitorLine{text: fmt.Sprintf("  %-36s  %-8s  %-6s  %-16s  %-9s  %d", r.ID, r.State, r.Type, r.Client,
+			time.Since(r.StartTime).Round(time.Second), tokens)}
+		if i == ui.selected {
+			line.color = ansiReverse
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, []monitorLine{{color: ansiDim, text: "↑/↓ select  enter tail  c cancel  r refresh  q quit"}}
+}
+
+func (ui *monitorUI) tailView(height int) ([]monitorLine, []monitorLine) {
+	state := "ended"
+	if i := slices.IndexFunc(ui.runs, func(r monitorRun) bool { return r.ID == ui.tailing }); i >= 0 {
+		state = ui.runs[i].State
+	}
+
+	lines := []monitorLine{{color: ansiBold, text: fmt.Sprintf("run %s  %s", ui.tailing, state)}, {}}
+
+	// The latest events are shown, like the end of a log that is followed.
+	events := ui.events
+	if room := max(0, height-len(lines)-2); len(events) > room {
+		events = events[len(events)-room:]
+	}
+	lines = append(lines, events...)
+
+	return lines, []monitorLine{{color: ansiDim, text: "esc back  c cancel  r refresh  q quit"}}
+}
@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gptscript-ai/go-gptscript"
+	"github.com/spf13/cobra"
+)
+
+// Parse parses a file on a server, and prints its tools.
+type Parse struct {
+	Client
+
+	JSON bool `name:"json" usage:"Print the nodes of the file as JSON instead of its tools" env:"CLICKY_SERVES_JSON"`
+}
+
+func (p *Parse) Customize(cmd *cobra.Command) {
+	cmd.Use = "parse [flags] FILE"
+	cmd.Short = "Parse a file on a server, and print its tools"
+	cmd.Long = `Parse a file on a server, and print its tools, with their arguments and the tools that they use.
+
+The content of FILE is sent to the server if it is a local file, and FILE is resolved by the server otherwise. With --json, the
+nodes of the file are printed as the server returned them.`
+	cmd.Args = cobra.ExactArgs(1)
+}
+
+func (p *Parse) Run(cmd *cobra.Command, args []string) error {
+	body := map[string]string{"file": args[0]}
+	if content, err := os.ReadFile(args[0]); err == nil {
+		body = map[string]string{"input": string(content)}
+	}
+
+	out, err := p.doJSON(cmd.Context(), http.MethodPost, "/parse", body)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Stdout json.RawMessage `json:"stdout"`
+	}
+	if err = json.Unmarshal(out, &resp); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if p.JSON {
+		var buf bytes.Buffer
+		if err = json.Indent(&buf, resp.Stdout, "", "  "); err != nil {
+			return fmt.Errorf("failed to format response: %w", err)
+		}
+		_, err = fmt.Println(buf.String())
+		return err
+	}
+
+	var doc struct {
+		Nodes []gptscript.Node `json:"nodes"`
+	}
+	if err = json.Unmarshal(resp.Stdout, &doc); err != nil {
+		return fmt.Errorf("failed to decode nodes: %w", err)
+	}
+
+	for i, node := range doc.Nodes {
+		if node.ToolNode == nil {
+			continue
+		}
+		printTool(node.ToolNode.Tool, i == 0)
+	}
+	return nil
+}
+
+// printTool prints the name, the description, the arguments, and the tools of a tool. The entry tool is the first tool of a file,
+// which is the tool that runs of the file run unless they ask for a sub tool.
+func printTool(t gptscript.Tool, entry bool) {
+	name := t.Name
+	if name == "" {
+		name = "(unnamed)"
+	}
+	if entry {
+		name += " (entry)"
+	}
+	if t.Description != "" {
+		name += ": " + t.Description
+	}
+	fmt.Println(name)
+
+	if t.Arguments != nil && len(t.Arguments.Properties) > 0 {
+		fmt.Println("  arguments:")
+		var names []string
+		for arg := range t.Arguments.Properties {
+			names = append(names, arg)
+		}
+		slices.Sort(names)
+		for _, arg := range names {
+			line := "    " + arg
+			if ref := t.Arguments.Properties[arg]; ref != nil && ref.Value != nil && ref.Value.Description != "" {
+				line += ": " + ref.Value.Description
+			}
+			fmt.Println(line)
+		}
+	}
+	if len(t.Tools) > 0 {
+		fmt.Println("  tools: " + strings.Join(t.Tools, ", "))
+	}
+	if t.Chat {
+		fmt.Println("  chat: true")
+	}
+}
@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// Run runs a file on a server, streaming its events to the terminal, and exits with the exit code of the run.
+type Run struct {
+	Client
+	Output
+
+	SubTool string `usage:"Tool of the file to run instead of its first tool" env:"CLICKY_SERVES_SUB_TOOL"`
+	Timeout string `usage:"Duration after which the run is aborted, like 30s or 5m" env:"CLICKY_SERVES_TIMEOUT"`
+}
+
+func (r *Run) Customize(cmd *cobra.Command) {
+	cmd.Use = "run [flags] FILE [INPUT]"
+	cmd.Short = "Run a file on a server, streaming its events to the terminal"
+	cmd.Long = `Run a file on a server, streaming its events to the terminal.
+
+FILE is uploaded to the server if it is a local file, and is resolved by the server otherwise, like a registry:// handle or the URL
+of a remote tool. INPUT is the input of the run, or - to read it from stdin. The output of the run is printed to stdout and its
+progress to stderr, and the command exits with the exit code of the run.`
+	cmd.Args = cobra.RangeArgs(1, 2)
+}
+
+func (r *Run) Run(cmd *cobra.Command, args []string) error {
+	code, err := r.run(cmd, args)
+	if err != nil {
+		return err
+	}
+	return exitWith(code)
+}
+
+// run runs the file, and returns the exit code of the run once the uploaded file, if there is one, has been deleted.
+func (r *Run) run(cmd *cobra.Command, args []string) (int, error) {
+	var input string
+	if len(args) > 1 {
+		input = args[1]
+		if input == "-" {
+			b, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read input: %w", err)
+			}
+			input = string(b)
+		}
+	}
+
+	file := args[0]
+	if info, err := os.Stat(file); err == nil && !info.IsDir() {
+		handle, id, err := r.upload(cmd, file)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			if _, err := r.doJSON(cmd.Context(), http.MethodDelete, "/files/"+url.PathEscape(id), nil); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to delete uploaded file: %v\n", err)
+			}
+		}()
+		file = handle
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"file":    file,
+		"input":   input,
+		"subTool": r.SubTool,
+		"timeout": r.Timeout,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := r.do(cmd.Context(), http.MethodPost, "/run-file-stream-with-events?format=ndjson", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	return r.stream(resp)
+}
+
+// upload uploads the local file to the server, and returns the handle that it can be run with and the ID that it is deleted with.
+func (r *Run) upload(cmd *cobra.Command, path string) (string, string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	var (
+		buf bytes.Buffer
+		mw  = multipart.NewWriter(&buf)
+	)
+	part, err := mw.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return "", "", err
+	}
+	if _, err = part.Write(content); err != nil {
+		return "", "", err
+	}
+	if err = mw.Close(); err != nil {
+		return "", "", err
+	}
+
+	resp, err := r.do(cmd.Context(), http.MethodPost, "/files", mw.FormDataContentType(), &buf)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to upload %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	var uploaded struct {
+		ID   string `json:"id"`
+		File string `json:"file"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		return "", "", fmt.Errorf("failed to decode uploaded file: %w", err)
+	}
+	return uploaded.File, uploaded.ID, nil
+}
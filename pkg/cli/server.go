@@ -3,13 +3,206 @@ package cli
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/thedadams/clicky-serves/pkg/log"
+	"github.com/thedadams/clicky-serves/pkg/objects"
 	"github.com/thedadams/clicky-serves/pkg/server"
 )
 
 type Server struct {
-	ServerPort string `usage:"Server port" default:"8080" env:"CLICKY_SERVES_SERVER_PORT"`
+	Config      string   `usage:"YAML or JSON config file, whose settings override the flags and are reloaded on SIGHUP or when the file changes" env:"CLICKY_SERVES_CONFIG"`
+	LogLevel    string   `usage:"Minimum level of the logs, one of debug, info, warn, or error" env:"CLICKY_SERVES_LOG_LEVEL"`
+	ServerPort  string   `usage:"Server port" default:"8080" env:"CLICKY_SERVES_SERVER_PORT"`
+	GRPCPort    string   `name:"grpc-port" usage:"Port of the gRPC server, which is not started if this is not set" env:"CLICKY_SERVES_GRPC_PORT"`
+	DebugPort   string   `usage:"Port of the debug server with pprof and runtime diagnostics, which has no authentication and is not started if this is not set" env:"CLICKY_SERVES_DEBUG_PORT"`
+	HTTP2       bool     `name:"http2" usage:"Serve HTTP/2 without TLS (h2c) on the server port, as well as HTTP/1.1" env:"CLICKY_SERVES_HTTP2"`
+	GraphQL     bool     `name:"graphql" usage:"Serve the GraphQL API at /graphql, with runs, registered tools, sessions, and usage, and subscriptions to the events of runs" env:"CLICKY_SERVES_GRAPHQL"`
+	JSONRPC     bool     `name:"jsonrpc" usage:"Serve JSON-RPC 2.0 at /jsonrpc, with methods to parse, run, stream, and cancel" env:"CLICKY_SERVES_JSONRPC"`
+	MCP         bool     `name:"mcp" usage:"Serve the registered tools as MCP tools at /mcp, and on stdio with --jsonrpc-stdio" env:"CLICKY_SERVES_MCP"`
+	ReadOnly    bool     `usage:"Start in read-only mode, which only allows parsing, formatting, and listing, and can be turned off through the admin API" env:"CLICKY_SERVES_READ_ONLY"`
+	APIKeys     []string `name:"api-keys" usage:"API keys that are allowed to access the server, in the form key:scope:tenant where scope is one of parse, exec, or admin, and tenant is optional" env:"CLICKY_SERVES_API_KEYS"`
+	APIKeysFile string   `name:"api-keys-file" usage:"File with one API key per line, in the same form as --api-keys" env:"CLICKY_SERVES_API_KEYS_FILE"`
+
+	LogFormat     string `usage:"Format of the logs, either text or json" default:"text" env:"CLICKY_SERVES_LOG_FORMAT"`
+	LogFile       string `usage:"File that the logs are appended to instead of stderr" env:"CLICKY_SERVES_LOG_FILE"`
+	LogMaxSize    int    `usage:"Size in megabytes that the log file is rotated at, 0 means that it is never rotated" default:"100" env:"CLICKY_SERVES_LOG_MAX_SIZE"`
+	LogMaxBackups int    `usage:"Number of rotated log files that are kept" default:"5" env:"CLICKY_SERVES_LOG_MAX_BACKUPS"`
+
+	JSONRPCStdio       bool   `name:"jsonrpc-stdio" usage:"Serve JSON-RPC 2.0 on stdin and stdout, one message per line, and stop once stdin is closed" env:"CLICKY_SERVES_JSONRPC_STDIO"`
+	JSONRPCStdioAPIKey string `name:"jsonrpc-stdio-api-key" usage:"API key that the JSON-RPC requests on stdin are authenticated with" env:"CLICKY_SERVES_JSONRPC_STDIO_API_KEY"`
+
+	ChatCompletionsTool string `usage:"Chat-enabled file or registry:// tool that the OpenAI compatible chat completions API at /v1/chat/completions chats with, which is disabled if this is not set" env:"CLICKY_SERVES_CHAT_COMPLETIONS_TOOL"`
+
+	JWTSecret         string `name:"jwt-secret" usage:"Shared secret for validating HMAC signed JWTs" env:"CLICKY_SERVES_JWT_SECRET"`
+	JWKSURL           string `name:"jwks-url" usage:"URL of the JWKS for validating JWTs signed with public key algorithms" env:"CLICKY_SERVES_JWKS_URL"`
+	JWTIssuer         string `name:"jwt-issuer" usage:"Required issuer of JWTs" env:"CLICKY_SERVES_JWT_ISSUER"`
+	JWTAudience       string `name:"jwt-audience" usage:"Required audience of JWTs" env:"CLICKY_SERVES_JWT_AUDIENCE"`
+	JWTScopeClaim     string `name:"jwt-scope-claim" usage:"JWT claim with the space-separated scopes of the caller" default:"scope" env:"CLICKY_SERVES_JWT_SCOPE_CLAIM"`
+	JWTToolPathsClaim string `name:"jwt-tool-paths-claim" usage:"JWT claim with the file path patterns the caller is allowed to run" default:"tool_paths" env:"CLICKY_SERVES_JWT_TOOL_PATHS_CLAIM"`
+	JWTTenantClaim    string `name:"jwt-tenant-claim" usage:"JWT claim with the tenant of the caller" default:"tenant" env:"CLICKY_SERVES_JWT_TENANT_CLAIM"`
+
+	MaxConcurrentRuns int `usage:"Maximum number of runs that can execute at the same time, 0 means no limit" default:"0" env:"CLICKY_SERVES_MAX_CONCURRENT_RUNS"`
+	MaxQueuedRuns     int `usage:"Maximum number of runs that can wait for a slot when the concurrency limit is reached" default:"100" env:"CLICKY_SERVES_MAX_QUEUED_RUNS"`
+
+	RunPriority int  `usage:"Priority of runs in the run queue, where higher priorities start first, which runs can lower but not raise" default:"0" env:"CLICKY_SERVES_RUN_PRIORITY"`
+	PreemptRuns bool `usage:"Cancel the running run with the lowest priority when a run with a higher priority is queued" env:"CLICKY_SERVES_PREEMPT_RUNS"`
+
+	QueueTenantMaxConcurrentRuns int `usage:"Maximum number of runs of each tenant that can execute at the same time, 0 means no limit" default:"0" env:"CLICKY_SERVES_QUEUE_TENANT_MAX_CONCURRENT_RUNS"`
+
+	MaxRunTimeout string `usage:"Maximum duration of a run, which is also the timeout of runs that don't request one" default:"15m" env:"CLICKY_SERVES_MAX_RUN_TIMEOUT"`
+
+	EnvAllowlist []string `usage:"Patterns of the environment variables that requests can set for gptscript, like WORKSPACE_*" env:"CLICKY_SERVES_ENV_ALLOWLIST"`
+	EnvDenylist  []string `usage:"Patterns of the environment variables that requests can't set, even if they match the allowlist" env:"CLICKY_SERVES_ENV_DENYLIST"`
+
+	ParseRateLimit string `usage:"Rate limit of each client on the parse endpoints, as requests per duration like 100/1m" env:"CLICKY_SERVES_PARSE_RATE_LIMIT"`
+	ExecRateLimit  string `usage:"Rate limit of each client on the exec endpoints, as requests per duration like 10/1m" env:"CLICKY_SERVES_EXEC_RATE_LIMIT"`
+
+	ResultCacheTTL  string `name:"result-cache-ttl" usage:"How long the output of runs that aren't streamed is cached for, 0 disables the cache" default:"0" env:"CLICKY_SERVES_RESULT_CACHE_TTL"`
+	ResultCacheSize int    `usage:"Maximum number of cached run outputs, 0 means no limit" default:"1000" env:"CLICKY_SERVES_RESULT_CACHE_SIZE"`
+	ParseCacheTTL   string `name:"parse-cache-ttl" usage:"How long the results of parsing files and tool content are cached for, by their content, 0 disables the cache" default:"10m" env:"CLICKY_SERVES_PARSE_CACHE_TTL"`
+	ParseCacheSize  int    `usage:"Maximum number of cached parse results, 0 means no limit" default:"1000" env:"CLICKY_SERVES_PARSE_CACHE_SIZE"`
+	ToolCacheTTL    string `name:"tool-cache-ttl" usage:"How long remote tools that are run as files are cached for after they are fetched, 0 leaves fetching them to gptscript" default:"0" env:"CLICKY_SERVES_TOOL_CACHE_TTL"`
+
+	CORSAllowedOrigins   []string `name:"cors-allowed-origins" usage:"Origins that browsers can make cross-origin requests from, which can contain a wildcard like https://*.example.com (default: any origin)" env:"CLICKY_SERVES_CORS_ALLOWED_ORIGINS"`
+	CORSAllowedMethods   []string `name:"cors-allowed-methods" usage:"Methods that browsers can use in cross-origin requests (default: GET, POST, PUT, DELETE, and HEAD)" env:"CLICKY_SERVES_CORS_ALLOWED_METHODS"`
+	CORSAllowedHeaders   []string `name:"cors-allowed-headers" usage:"Headers that browsers can send in cross-origin requests (default: the headers used by the API)" env:"CLICKY_SERVES_CORS_ALLOWED_HEADERS"`
+	CORSAllowCredentials bool     `name:"cors-allow-credentials" usage:"Allow browsers to send credentials like cookies in cross-origin requests, which requires the allowed origins to be set" env:"CLICKY_SERVES_CORS_ALLOW_CREDENTIALS"`
+	CORSMaxAge           string   `name:"cors-max-age" usage:"How long browsers can cache the result of a preflight request" default:"0s" env:"CLICKY_SERVES_CORS_MAX_AGE"`
+
+	UploadDir string `usage:"Directory that uploaded files are kept in, a temporary directory is used if not set" env:"CLICKY_SERVES_UPLOAD_DIR"`
+	CacheRoot string `usage:"Directory that the gptscript caches of each tenant are kept under, which makes the cacheDir of runs the name of a cache of their tenant" env:"CLICKY_SERVES_CACHE_ROOT"`
+
+	ToolDirs []string `usage:"Directories of the local files that runs can run and the directories that they can run in (default: the working directory)" env:"CLICKY_SERVES_TOOL_DIRS"`
+
+	HeartbeatInterval string `usage:"How long a stream can be idle before a heartbeat is written to it, 0 disables heartbeats" default:"15s" env:"CLICKY_SERVES_HEARTBEAT_INTERVAL"`
+
+	StreamBufferSize           int    `usage:"Number of events that are buffered for each stream while the client reads them" default:"256" env:"CLICKY_SERVES_STREAM_BUFFER_SIZE"`
+	StreamBufferPolicy         string `usage:"What happens when the buffer of a stream is full, either block to make the run wait for the client or drop-oldest to drop the oldest events" default:"block" env:"CLICKY_SERVES_STREAM_BUFFER_POLICY"`
+	StreamKeepRunsOnDisconnect bool   `usage:"Keep runs going when the client that started them disconnects, instead of canceling them" env:"CLICKY_SERVES_STREAM_KEEP_RUNS_ON_DISCONNECT"`
+	StreamWriteTimeout         string `usage:"How long a write to a stream can take before the client is given up on, 0 means no limit" default:"0s" env:"CLICKY_SERVES_STREAM_WRITE_TIMEOUT"`
+	StreamFlushInterval        string `usage:"How often streams are flushed to the client, 0 flushes each event as soon as it is written" default:"0s" env:"CLICKY_SERVES_STREAM_FLUSH_INTERVAL"`
+	StreamMaxOutputSize        int64  `usage:"Bytes of output that a streamed run can write before it is stopped and its stream is truncated, 0 means no limit" default:"104857600" env:"CLICKY_SERVES_STREAM_MAX_OUTPUT_SIZE"`
+
+	RetryMaxAttempts int      `usage:"Number of times that a run is attempted when it fails with a transient error of the model, 0 or 1 means no retries" default:"0" env:"CLICKY_SERVES_RETRY_MAX_ATTEMPTS"`
+	RetryBackoff     string   `usage:"Delay before the first retry of a run, which doubles with each retry" default:"1s" env:"CLICKY_SERVES_RETRY_BACKOFF"`
+	RetryMaxBackoff  string   `usage:"Longest delay between the attempts of a run" default:"30s" env:"CLICKY_SERVES_RETRY_MAX_BACKOFF"`
+	RetryOn          []string `usage:"Status codes of the errors of the model that runs are retried on, like 429 or 5xx (default: 429 and 5xx)" env:"CLICKY_SERVES_RETRY_ON"`
+
+	CircuitBreakerFailurePercent int    `usage:"Percentage of the latest runs of a provider of models that must have failed because of it for its runs to be rejected until it recovers, 0 disables the circuit breakers" default:"0" env:"CLICKY_SERVES_CIRCUIT_BREAKER_FAILURE_PERCENT"`
+	CircuitBreakerMinRuns        int    `usage:"Number of runs of a provider that must have ended before its circuit can open" default:"5" env:"CLICKY_SERVES_CIRCUIT_BREAKER_MIN_RUNS"`
+	CircuitBreakerWindow         int    `usage:"Number of the latest runs of a provider that its failure rate is computed from" default:"20" env:"CLICKY_SERVES_CIRCUIT_BREAKER_WINDOW"`
+	CircuitBreakerCooldown       string `usage:"How long the circuit of a provider stays open before a run is let through to probe it" default:"30s" env:"CLICKY_SERVES_CIRCUIT_BREAKER_COOLDOWN"`
+
+	CompressionDisabled bool `usage:"Send responses without compressing them, even if the client accepts zstd or gzip" env:"CLICKY_SERVES_COMPRESSION_DISABLED"`
+	CompressionMinSize  int  `usage:"Size in bytes of the smallest JSON response that is compressed" default:"1024" env:"CLICKY_SERVES_COMPRESSION_MIN_SIZE"`
+	CompressionStreams  bool `usage:"Compress streams of events too, flushing each event through the compressor" env:"CLICKY_SERVES_COMPRESSION_STREAMS"`
+
+	MaxBodySize    int64  `usage:"Size in bytes of the largest request body and websocket message" default:"33554432" env:"CLICKY_SERVES_MAX_BODY_SIZE"`
+	MaxContentSize int64  `usage:"Size in bytes of the largest tool content that is run, parsed, or registered" default:"1048576" env:"CLICKY_SERVES_MAX_CONTENT_SIZE"`
+	MaxInputSize   int64  `usage:"Size in bytes of the largest input of a run or message of a chat, including streamed inputs" default:"16777216" env:"CLICKY_SERVES_MAX_INPUT_SIZE"`
+	MaxUploadSize  int64  `usage:"Size in bytes of the largest uploaded file" default:"10485760" env:"CLICKY_SERVES_MAX_UPLOAD_SIZE"`
+	ParseTimeout   string `usage:"How long parsing a file or tool content can take before it is aborted" default:"30s" env:"CLICKY_SERVES_PARSE_TIMEOUT"`
+
+	JanitorInterval         string `usage:"How often the janitor removes the cache entries, uploaded files, cached tools, and workspaces that are too old or over their max size, 0 only runs it through the admin API" default:"10m" env:"CLICKY_SERVES_JANITOR_INTERVAL"`
+	JanitorCacheTTL         string `usage:"How long the entries of the cache directories of gptscript are kept after they last changed, 0 means no limit" default:"0s" env:"CLICKY_SERVES_JANITOR_CACHE_TTL"`
+	JanitorCacheMaxSize     int64  `usage:"Size in bytes that the cache directories of gptscript can take up, 0 means no limit" default:"0" env:"CLICKY_SERVES_JANITOR_CACHE_MAX_SIZE"`
+	JanitorUploadTTL        string `usage:"How long uploaded files are kept, 0 means no limit" default:"0s" env:"CLICKY_SERVES_JANITOR_UPLOAD_TTL"`
+	JanitorUploadMaxSize    int64  `usage:"Size in bytes that uploaded files can take up, 0 means no limit" default:"0" env:"CLICKY_SERVES_JANITOR_UPLOAD_MAX_SIZE"`
+	JanitorWorkspaceMaxSize int64  `usage:"Size in bytes that the workspaces of sessions can take up before the sessions used least recently are removed, 0 means no limit" default:"0" env:"CLICKY_SERVES_JANITOR_WORKSPACE_MAX_SIZE"`
+
+	RedactionPatterns      []string `usage:"Regular expressions of the text to redact from the streams of runs" env:"CLICKY_SERVES_REDACTION_PATTERNS"`
+	RedactionNamedPatterns []string `usage:"Built-in patterns of the text to redact from the streams of runs: aws-access-key, aws-secret-key, github-token, openai-key, bearer-token, private-key, email" env:"CLICKY_SERVES_REDACTION_NAMED_PATTERNS"`
+	RedactionReplacement   string   `usage:"What redacted text is replaced with" default:"[REDACTED]" env:"CLICKY_SERVES_REDACTION_REPLACEMENT"`
+
+	PolicyFilePaths          []string `usage:"Patterns of the local files that clients can run (default: any file)" env:"CLICKY_SERVES_POLICY_FILE_PATHS"`
+	PolicyRemoteTools        []string `usage:"Patterns of the remote tools that clients can run or reference, like github.com/gptscript-ai/* (default: any remote tool)" env:"CLICKY_SERVES_POLICY_REMOTE_TOOLS"`
+	PolicyDeniedInstructions []string `usage:"Regular expressions of the instructions that the tools of clients can't have" env:"CLICKY_SERVES_POLICY_DENIED_INSTRUCTIONS"`
+
+	CredentialsFile string `usage:"File to keep credentials in, encrypted with the credentials key, they are kept in memory if not set" env:"CLICKY_SERVES_CREDENTIALS_FILE"`
+	CredentialsKey  string `usage:"Key that the credentials file is encrypted with" env:"CLICKY_SERVES_CREDENTIALS_KEY"`
+
+	ArtifactsDir           string `usage:"Directory that the files that runs write to their workspaces are kept in once the runs end, artifacts aren't kept if neither it nor --artifacts-storage is set" env:"CLICKY_SERVES_ARTIFACTS_DIR"`
+	ArtifactsStorage       bool   `usage:"Keep artifacts in the storage bucket instead of a directory" env:"CLICKY_SERVES_ARTIFACTS_STORAGE"`
+	ArtifactsMaxSize       int64  `usage:"Size in bytes of the largest file that is kept as an artifact, 0 means no limit" default:"0" env:"CLICKY_SERVES_ARTIFACTS_MAX_SIZE"`
+	StorageProvider        string `usage:"Provider of the storage bucket that replicas share sessions, tools, and artifacts in: s3 or gcs (default: s3)" env:"CLICKY_SERVES_STORAGE_PROVIDER"`
+	StorageEndpoint        string `usage:"URL of the S3-compatible API of the storage bucket (default: AWS in the region, or GCS)" env:"CLICKY_SERVES_STORAGE_ENDPOINT"`
+	StorageRegion          string `usage:"Region of the storage bucket (default: us-east-1, or auto for GCS)" env:"CLICKY_SERVES_STORAGE_REGION"`
+	StorageBucket          string `usage:"Bucket that the state that replicas share is kept in, state is only kept on disk if it is not set" env:"CLICKY_SERVES_STORAGE_BUCKET"`
+	StoragePrefix          string `usage:"Prefix of the keys of the objects in the storage bucket" env:"CLICKY_SERVES_STORAGE_PREFIX"`
+	StorageAccessKeyID     string `name:"storage-access-key-id" usage:"Access key ID, or HMAC key for GCS, for the storage bucket (default: AWS_ACCESS_KEY_ID)" env:"CLICKY_SERVES_STORAGE_ACCESS_KEY_ID"`
+	StorageSecretAccessKey string `usage:"Secret access key, or HMAC secret for GCS, for the storage bucket (default: AWS_SECRET_ACCESS_KEY)" env:"CLICKY_SERVES_STORAGE_SECRET_ACCESS_KEY"`
+	StoragePathStyle       bool   `usage:"Put the bucket in the path of the requests to the storage instead of in their host, which most S3-compatible servers need" env:"CLICKY_SERVES_STORAGE_PATH_STYLE"`
+
+	ClusterURL       string `name:"cluster-url" usage:"URL that the other replicas reach this replica at, which enables cluster mode, where the requests about a run are forwarded to the replica that runs it" env:"CLICKY_SERVES_CLUSTER_URL"`
+	ClusterReplicaID string `name:"cluster-replica-id" usage:"ID of the replica in the cluster (default: the hostname)" env:"CLICKY_SERVES_CLUSTER_REPLICA_ID"`
+
+	DailyTokenQuota   int64  `usage:"Tokens that each client can use per day, 0 means no limit" default:"0" env:"CLICKY_SERVES_DAILY_TOKEN_QUOTA"`
+	MonthlyTokenQuota int64  `usage:"Tokens that each client can use per month, 0 means no limit" default:"0" env:"CLICKY_SERVES_MONTHLY_TOKEN_QUOTA"`
+	DailyCostQuota    string `usage:"Estimated cost in US dollars that each client can incur per day, 0 means no limit" default:"0" env:"CLICKY_SERVES_DAILY_COST_QUOTA"`
+	MonthlyCostQuota  string `usage:"Estimated cost in US dollars that each client can incur per month, 0 means no limit" default:"0" env:"CLICKY_SERVES_MONTHLY_COST_QUOTA"`
+
+	Backend string `usage:"Backend that runs are executed with, one of host, sandbox, kubernetes, or workers (default: sandbox or kubernetes if its image is set, otherwise host)" env:"CLICKY_SERVES_BACKEND"`
+
+	GPTScriptBin        string `name:"gptscript-bin" usage:"Path of the gptscript binary that runs on the host are executed with (default: $GPTSCRIPT_BIN or gptscript on the PATH)" env:"CLICKY_SERVES_GPTSCRIPT_BIN"`
+	GPTScriptVersion    string `name:"gptscript-version" usage:"Version of gptscript, like v0.9.5, to download when the server starts and execute runs on the host with" env:"CLICKY_SERVES_GPTSCRIPT_VERSION"`
+	GPTScriptChecksum   string `name:"gptscript-checksum" usage:"SHA-256 of the archive of the downloaded version of gptscript, which is checked against the checksums of the release if not set" env:"CLICKY_SERVES_GPTSCRIPT_CHECKSUM"`
+	GPTScriptReleaseURL string `name:"gptscript-release-url" usage:"URL of the releases of gptscript that it is downloaded from (default: the releases on GitHub)" env:"CLICKY_SERVES_GPTSCRIPT_RELEASE_URL"`
+	GPTScriptDir        string `name:"gptscript-dir" usage:"Directory that the downloaded versions of gptscript are kept in (default: a directory in the cache directory of the user)" env:"CLICKY_SERVES_GPTSCRIPT_DIR"`
+
+	ProcessCPUTimeLimit string `name:"process-cpu-time-limit" usage:"CPU time that the processes of a run on the host can use together before the run is killed, 0 means no limit (Linux only)" default:"0s" env:"CLICKY_SERVES_PROCESS_CPU_TIME_LIMIT"`
+	ProcessMemoryLimit  int64  `usage:"Resident memory in bytes that the processes of a run on the host can use together before the run is killed, 0 means no limit (Linux only)" default:"0" env:"CLICKY_SERVES_PROCESS_MEMORY_LIMIT"`
+	ProcessCountLimit   int    `usage:"Number of processes that a run on the host can have at once before it is killed, 0 means no limit (Linux only)" default:"0" env:"CLICKY_SERVES_PROCESS_COUNT_LIMIT"`
+
+	Worker            bool   `usage:"Run the jobs of the server at --worker-server instead of serving, whose backend must be workers" env:"CLICKY_SERVES_WORKER"`
+	WorkerServer      string `usage:"URL of the server that the worker runs the jobs of" env:"CLICKY_SERVES_WORKER_SERVER"`
+	WorkerAPIKey      string `name:"worker-api-key" usage:"API key with the admin scope that the worker authenticates to the server with" env:"CLICKY_SERVES_WORKER_API_KEY"`
+	WorkerConcurrency int    `usage:"Number of jobs that the worker runs at the same time" default:"1" env:"CLICKY_SERVES_WORKER_CONCURRENCY"`
+
+	SandboxRuntime        string   `usage:"Container runtime that runs are sandboxed with, like docker or podman (default: docker)" env:"CLICKY_SERVES_SANDBOX_RUNTIME"`
+	SandboxImage          string   `usage:"Image with gptscript on its PATH that each run is executed in, runs are executed on the host if not set" env:"CLICKY_SERVES_SANDBOX_IMAGE"`
+	SandboxMemory         string   `usage:"Memory limit of each sandbox container, like 512m" env:"CLICKY_SERVES_SANDBOX_MEMORY"`
+	SandboxCPUs           string   `name:"sandbox-cpus" usage:"CPU limit of each sandbox container, like 1.5" env:"CLICKY_SERVES_SANDBOX_CPUS"`
+	SandboxPidsLimit      int      `usage:"Maximum number of processes in each sandbox container, 0 means no limit" default:"0" env:"CLICKY_SERVES_SANDBOX_PIDS_LIMIT"`
+	SandboxNetwork        string   `usage:"Network of the sandbox containers, which must be able to reach the model provider" env:"CLICKY_SERVES_SANDBOX_NETWORK"`
+	SandboxSeccompProfile string   `usage:"Seccomp profile of the sandbox containers, instead of the default profile of the runtime" env:"CLICKY_SERVES_SANDBOX_SECCOMP_PROFILE"`
+	SandboxMounts         []string `usage:"Bind mounts of the sandbox containers, in the form source:target[:options]" env:"CLICKY_SERVES_SANDBOX_MOUNTS"`
+	SandboxEnv            []string `usage:"Patterns of the environment variables of the server that are passed to the sandbox containers (default: OPENAI_*)" env:"CLICKY_SERVES_SANDBOX_ENV"`
+
+	KubernetesAPIServer      string   `name:"kubernetes-api-server" usage:"API server of the Kubernetes cluster that runs are executed in (default: the cluster of the server)" env:"CLICKY_SERVES_KUBERNETES_API_SERVER"`
+	KubernetesTokenFile      string   `usage:"File with the token for the Kubernetes API server" env:"CLICKY_SERVES_KUBERNETES_TOKEN_FILE"`
+	KubernetesCAFile         string   `name:"kubernetes-ca-file" usage:"File with the CA of the Kubernetes API server" env:"CLICKY_SERVES_KUBERNETES_CA_FILE"`
+	KubernetesNamespace      string   `usage:"Namespace of the Kubernetes Jobs of runs (default: the namespace of the server)" env:"CLICKY_SERVES_KUBERNETES_NAMESPACE"`
+	KubernetesImage          string   `usage:"Image with gptscript on its PATH that each run is executed in as a Kubernetes Job, runs aren't executed in Kubernetes if not set" env:"CLICKY_SERVES_KUBERNETES_IMAGE"`
+	KubernetesHelperImage    string   `usage:"Image with mkfifo and cat that passes the output of runs back from Kubernetes (default: busybox)" env:"CLICKY_SERVES_KUBERNETES_HELPER_IMAGE"`
+	KubernetesCPURequest     string   `name:"kubernetes-cpu-request" usage:"CPU request of each run in Kubernetes, like 500m" env:"CLICKY_SERVES_KUBERNETES_CPU_REQUEST"`
+	KubernetesMemoryRequest  string   `usage:"Memory request of each run in Kubernetes, like 256Mi" env:"CLICKY_SERVES_KUBERNETES_MEMORY_REQUEST"`
+	KubernetesCPULimit       string   `name:"kubernetes-cpu-limit" usage:"CPU limit of each run in Kubernetes, like 1" env:"CLICKY_SERVES_KUBERNETES_CPU_LIMIT"`
+	KubernetesMemoryLimit    string   `usage:"Memory limit of each run in Kubernetes, like 512Mi" env:"CLICKY_SERVES_KUBERNETES_MEMORY_LIMIT"`
+	KubernetesServiceAccount string   `usage:"Service account of the pods of runs in Kubernetes, which get no credentials for the cluster if not set" env:"CLICKY_SERVES_KUBERNETES_SERVICE_ACCOUNT"`
+	KubernetesEnv            []string `usage:"Patterns of the environment variables of the server that are passed to the pods of runs in Kubernetes (default: OPENAI_*)" env:"CLICKY_SERVES_KUBERNETES_ENV"`
+
+	CallbackSecret string `usage:"Secret that the callbacks of runs are signed with, callbacks aren't signed if not set" env:"CLICKY_SERVES_CALLBACK_SECRET"`
+	SignedURLKey   string `name:"signed-url-key" usage:"Key that the signed URLs of the outputs and artifacts of runs are signed with, signed URLs are disabled if not set" env:"CLICKY_SERVES_SIGNED_URL_KEY"`
+
+	CallbackNetworks []string `usage:"Networks, as CIDRs or IP addresses, that callbacks can be sent to even though they aren't public (default: only public addresses)" env:"CLICKY_SERVES_CALLBACK_NETWORKS"`
+
+	AuditLog string `usage:"File, syslog: or syslog://host:port, or http(s) URL that a record of each parse and exec request is written to" env:"CLICKY_SERVES_AUDIT_LOG"`
+
+	Hooks []string `usage:"Names of registered hooks or paths of executables that are called before and after each run, in order" env:"CLICKY_SERVES_HOOKS"`
+
+	RunHistoryDB string `name:"run-history-db" usage:"Path of a SQLite database to keep the history of runs in, instead of keeping it in memory for an hour" env:"CLICKY_SERVES_RUN_HISTORY_DB"`
+}
+
+// Customize names the command after the binary, and makes the flags of the server local to it, so that the client subcommands
+// don't list them as their own.
+func (s *Server) Customize(cmd *cobra.Command) {
+	cmd.Use = "clicky-serves"
+	flags := cmd.PersistentFlags()
+	cmd.ResetFlags()
+	cmd.Flags().AddFlagSet(flags)
 }
 
 func (s *Server) Run(cmd *cobra.Command, _ []string) error {
@@ -17,7 +210,299 @@ func (s *Server) Run(cmd *cobra.Command, _ []string) error {
 		return fmt.Errorf("OPENAI_API_KEY environment variable must be set")
 	}
 
+	logFile, err := log.Configure(log.Options{
+		Format:     s.LogFormat,
+		Level:      s.LogLevel,
+		File:       s.LogFile,
+		MaxSize:    int64(s.LogMaxSize) << 20,
+		MaxBackups: s.LogMaxBackups,
+	})
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	if s.Worker {
+		return server.StartWorker(cmd.Context(), server.WorkerConfig{
+			Server:      s.WorkerServer,
+			APIKey:      s.WorkerAPIKey,
+			Concurrency: s.WorkerConcurrency,
+		})
+	}
+
+	maxRunTimeout, err := time.ParseDuration(s.MaxRunTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid max run timeout: %w", err)
+	}
+
+	heartbeatInterval, err := time.ParseDuration(s.HeartbeatInterval)
+	if err != nil {
+		return fmt.Errorf("invalid heartbeat interval: %w", err)
+	}
+
+	dailyCostQuota, err := strconv.ParseFloat(s.DailyCostQuota, 64)
+	if err != nil {
+		return fmt.Errorf("invalid daily cost quota: %w", err)
+	}
+
+	monthlyCostQuota, err := strconv.ParseFloat(s.MonthlyCostQuota, 64)
+	if err != nil {
+		return fmt.Errorf("invalid monthly cost quota: %w", err)
+	}
+
+	parseLimit, err := server.ParseRateLimit(s.ParseRateLimit)
+	if err != nil {
+		return fmt.Errorf("invalid parse rate limit: %w", err)
+	}
+
+	execLimit, err := server.ParseRateLimit(s.ExecRateLimit)
+	if err != nil {
+		return fmt.Errorf("invalid exec rate limit: %w", err)
+	}
+
+	resultCacheTTL, err := time.ParseDuration(s.ResultCacheTTL)
+	if err != nil {
+		return fmt.Errorf("invalid result cache TTL: %w", err)
+	}
+
+	parseCacheTTL, err := time.ParseDuration(s.ParseCacheTTL)
+	if err != nil {
+		return fmt.Errorf("invalid parse cache TTL: %w", err)
+	}
+
+	toolCacheTTL, err := time.ParseDuration(s.ToolCacheTTL)
+	if err != nil {
+		return fmt.Errorf("invalid tool cache TTL: %w", err)
+	}
+
+	corsMaxAge, err := time.ParseDuration(s.CORSMaxAge)
+	if err != nil {
+		return fmt.Errorf("invalid CORS max age: %w", err)
+	}
+
+	streamWriteTimeout, err := time.ParseDuration(s.StreamWriteTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid stream write timeout: %w", err)
+	}
+
+	streamFlushInterval, err := time.ParseDuration(s.StreamFlushInterval)
+	if err != nil {
+		return fmt.Errorf("invalid stream flush interval: %w", err)
+	}
+
+	retryBackoff, err := time.ParseDuration(s.RetryBackoff)
+	if err != nil {
+		return fmt.Errorf("invalid retry backoff: %w", err)
+	}
+
+	retryMaxBackoff, err := time.ParseDuration(s.RetryMaxBackoff)
+	if err != nil {
+		return fmt.Errorf("invalid retry max backoff: %w", err)
+	}
+
+	circuitBreakerCooldown, err := time.ParseDuration(s.CircuitBreakerCooldown)
+	if err != nil {
+		return fmt.Errorf("invalid circuit breaker cooldown: %w", err)
+	}
+
+	parseTimeout, err := time.ParseDuration(s.ParseTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid parse timeout: %w", err)
+	}
+
+	janitorInterval, err := time.ParseDuration(s.JanitorInterval)
+	if err != nil {
+		return fmt.Errorf("invalid janitor interval: %w", err)
+	}
+
+	janitorCacheTTL, err := time.ParseDuration(s.JanitorCacheTTL)
+	if err != nil {
+		return fmt.Errorf("invalid janitor cache TTL: %w", err)
+	}
+
+	janitorUploadTTL, err := time.ParseDuration(s.JanitorUploadTTL)
+	if err != nil {
+		return fmt.Errorf("invalid janitor upload TTL: %w", err)
+	}
+
+	processCPUTimeLimit, err := time.ParseDuration(s.ProcessCPUTimeLimit)
+	if err != nil {
+		return fmt.Errorf("invalid process CPU time limit: %w", err)
+	}
+
 	return server.Start(cmd.Context(), server.Config{
-		Port: s.ServerPort,
+		File:        s.Config,
+		LogLevel:    s.LogLevel,
+		ReadOnly:    s.ReadOnly,
+		Port:        s.ServerPort,
+		GRPCPort:    s.GRPCPort,
+		DebugPort:   s.DebugPort,
+		HTTP2:       s.HTTP2,
+		GraphQL:     s.GraphQL,
+		JSONRPC:     s.JSONRPC,
+		MCP:         s.MCP,
+		APIKeys:     s.APIKeys,
+		APIKeysFile: s.APIKeysFile,
+		JWT: server.JWTConfig{
+			Secret:         s.JWTSecret,
+			JWKSURL:        s.JWKSURL,
+			Issuer:         s.JWTIssuer,
+			Audience:       s.JWTAudience,
+			ScopeClaim:     s.JWTScopeClaim,
+			ToolPathsClaim: s.JWTToolPathsClaim,
+			TenantClaim:    s.JWTTenantClaim,
+		},
+		MaxConcurrentRuns: s.MaxConcurrentRuns,
+		MaxQueuedRuns:     s.MaxQueuedRuns,
+		RunPriority:       s.RunPriority,
+		PreemptRuns:       s.PreemptRuns,
+		MaxRunTimeout:     maxRunTimeout,
+		RunHistoryDB:      s.RunHistoryDB,
+		EnvAllowlist:      s.EnvAllowlist,
+		EnvDenylist:       s.EnvDenylist,
+		ParseRateLimit:    parseLimit,
+		ExecRateLimit:     execLimit,
+		ResultCacheTTL:    resultCacheTTL,
+		ResultCacheSize:   s.ResultCacheSize,
+		ParseCacheTTL:     parseCacheTTL,
+		ParseCacheSize:    s.ParseCacheSize,
+		ToolCacheTTL:      toolCacheTTL,
+		Queue: server.QueueConfig{
+			TenantMaxConcurrentRuns: s.QueueTenantMaxConcurrentRuns,
+		},
+		CORS: server.CORSConfig{
+			AllowedOrigins:   s.CORSAllowedOrigins,
+			AllowedMethods:   s.CORSAllowedMethods,
+			AllowedHeaders:   s.CORSAllowedHeaders,
+			AllowCredentials: s.CORSAllowCredentials,
+			MaxAge:           corsMaxAge,
+		},
+		UploadDir:         s.UploadDir,
+		CacheRoot:         s.CacheRoot,
+		ToolDirs:          s.ToolDirs,
+		HeartbeatInterval: heartbeatInterval,
+		CallbackSecret:    s.CallbackSecret,
+		CallbackNetworks:  s.CallbackNetworks,
+		SignedURLKey:      s.SignedURLKey,
+		AuditLog:          s.AuditLog,
+		Hooks:             s.Hooks,
+		CredentialsFile:   s.CredentialsFile,
+		CredentialsKey:    s.CredentialsKey,
+		Artifacts: server.ArtifactsConfig{
+			Dir:     s.ArtifactsDir,
+			Storage: s.ArtifactsStorage,
+			MaxSize: s.ArtifactsMaxSize,
+		},
+		Storage: objects.Config{
+			Provider:        s.StorageProvider,
+			Endpoint:        s.StorageEndpoint,
+			Region:          s.StorageRegion,
+			Bucket:          s.StorageBucket,
+			Prefix:          s.StoragePrefix,
+			AccessKeyID:     s.StorageAccessKeyID,
+			SecretAccessKey: s.StorageSecretAccessKey,
+			PathStyle:       s.StoragePathStyle,
+		},
+		Cluster: server.ClusterConfig{
+			URL:       s.ClusterURL,
+			ReplicaID: s.ClusterReplicaID,
+		},
+		JSONRPCStdio:        s.JSONRPCStdio,
+		JSONRPCStdioAPIKey:  s.JSONRPCStdioAPIKey,
+		ChatCompletionsTool: s.ChatCompletionsTool,
+		Quota: server.Quota{
+			DailyTokens:   s.DailyTokenQuota,
+			MonthlyTokens: s.MonthlyTokenQuota,
+			DailyCost:     dailyCostQuota,
+			MonthlyCost:   monthlyCostQuota,
+		},
+		Backend: s.Backend,
+		GPTScript: server.GPTScriptConfig{
+			Bin:        s.GPTScriptBin,
+			Version:    s.GPTScriptVersion,
+			Checksum:   s.GPTScriptChecksum,
+			ReleaseURL: s.GPTScriptReleaseURL,
+			Dir:        s.GPTScriptDir,
+		},
+		ProcessLimits: server.ProcessLimits{
+			CPUTime:   processCPUTimeLimit,
+			Memory:    s.ProcessMemoryLimit,
+			Processes: s.ProcessCountLimit,
+		},
+		Sandbox: server.SandboxConfig{
+			Runtime:        s.SandboxRuntime,
+			Image:          s.SandboxImage,
+			Memory:         s.SandboxMemory,
+			CPUs:           s.SandboxCPUs,
+			PidsLimit:      s.SandboxPidsLimit,
+			Network:        s.SandboxNetwork,
+			SeccompProfile: s.SandboxSeccompProfile,
+			Mounts:         s.SandboxMounts,
+			Env:            s.SandboxEnv,
+		},
+		Kubernetes: server.KubernetesConfig{
+			APIServer:      s.KubernetesAPIServer,
+			TokenFile:      s.KubernetesTokenFile,
+			CAFile:         s.KubernetesCAFile,
+			Namespace:      s.KubernetesNamespace,
+			Image:          s.KubernetesImage,
+			HelperImage:    s.KubernetesHelperImage,
+			CPURequest:     s.KubernetesCPURequest,
+			MemoryRequest:  s.KubernetesMemoryRequest,
+			CPULimit:       s.KubernetesCPULimit,
+			MemoryLimit:    s.KubernetesMemoryLimit,
+			ServiceAccount: s.KubernetesServiceAccount,
+			Env:            s.KubernetesEnv,
+		},
+		Stream: server.StreamConfig{
+			BufferSize:           s.StreamBufferSize,
+			BufferPolicy:         s.StreamBufferPolicy,
+			KeepRunsOnDisconnect: s.StreamKeepRunsOnDisconnect,
+			WriteTimeout:         streamWriteTimeout,
+			FlushInterval:        streamFlushInterval,
+			MaxOutputSize:        s.StreamMaxOutputSize,
+		},
+		Retry: server.RetryConfig{
+			MaxAttempts: s.RetryMaxAttempts,
+			Backoff:     retryBackoff,
+			MaxBackoff:  retryMaxBackoff,
+			On:          s.RetryOn,
+		},
+		CircuitBreaker: server.CircuitBreakerConfig{
+			FailurePercent: s.CircuitBreakerFailurePercent,
+			MinRuns:        s.CircuitBreakerMinRuns,
+			Window:         s.CircuitBreakerWindow,
+			Cooldown:       circuitBreakerCooldown,
+		},
+		Compression: server.CompressionConfig{
+			Disabled: s.CompressionDisabled,
+			MinSize:  &s.CompressionMinSize,
+			Streams:  s.CompressionStreams,
+		},
+		Limits: server.LimitsConfig{
+			Body:         s.MaxBodySize,
+			Content:      s.MaxContentSize,
+			Input:        s.MaxInputSize,
+			Upload:       s.MaxUploadSize,
+			ParseTimeout: parseTimeout,
+		},
+		Janitor: server.JanitorConfig{
+			Interval:         janitorInterval,
+			CacheTTL:         janitorCacheTTL,
+			CacheMaxSize:     s.JanitorCacheMaxSize,
+			UploadTTL:        janitorUploadTTL,
+			UploadMaxSize:    s.JanitorUploadMaxSize,
+			WorkspaceMaxSize: s.JanitorWorkspaceMaxSize,
+		},
+		Redaction: server.RedactionConfig{
+			Patterns:      s.RedactionPatterns,
+			NamedPatterns: s.RedactionNamedPatterns,
+			Replacement:   s.RedactionReplacement,
+		},
+		Policy: server.ToolPolicy{
+			FilePaths:          s.PolicyFilePaths,
+			RemoteTools:        s.PolicyRemoteTools,
+			DeniedInstructions: s.PolicyDeniedInstructions,
+		},
 	})
 }
@@ -0,0 +1,36 @@
+package cli
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/spf13/cobra"
+)
+
+// Watch follows a run on a server, streaming its events to the terminal, and exits with the exit code of the run.
+type Watch struct {
+	Client
+	Output
+}
+
+func (w *Watch) Customize(cmd *cobra.Command) {
+	cmd.Use = "watch [flags] RUN_ID"
+	cmd.Short = "Follow a run on a server, streaming its events to the terminal"
+	cmd.Long = `Follow a run on a server, streaming its events to the terminal from its first event until it ends.
+
+The output of the run is printed to stdout and its progress to stderr, and the command exits with the exit code of the run.`
+	cmd.Args = cobra.ExactArgs(1)
+}
+
+func (w *Watch) Run(cmd *cobra.Command, args []string) error {
+	resp, err := w.do(cmd.Context(), http.MethodGet, "/runs/"+url.PathEscape(args[0])+"/events?format=ndjson", "", nil)
+	if err != nil {
+		return err
+	}
+
+	code, err := w.stream(resp)
+	if err != nil {
+		return err
+	}
+	return exitWith(code)
+}
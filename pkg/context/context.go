@@ -10,7 +10,11 @@ import (
 type reqIDKey struct{}
 
 func WithNewRequestID(ctx context.Context) context.Context {
-	return context.WithValue(ctx, reqIDKey{}, uuid.NewString())
+	return WithRequestID(ctx, uuid.NewString())
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, reqIDKey{}, id)
 }
 
 func GetRequestID(ctx context.Context) string {
@@ -18,6 +22,17 @@ func GetRequestID(ctx context.Context) string {
 	return s
 }
 
+type runIDKey struct{}
+
+func WithRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, id)
+}
+
+func GetRunID(ctx context.Context) string {
+	s, _ := ctx.Value(runIDKey{}).(string)
+	return s
+}
+
 type loggerKey struct{}
 
 func WithLogger(ctx context.Context, log *slog.Logger) context.Context {
@@ -32,3 +47,36 @@ func GetLogger(ctx context.Context) *slog.Logger {
 
 	return l
 }
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Name  string
+	Scope string
+	// Tenant is the tenant of the caller, which scopes what the caller can see and do. It is empty for the default tenant.
+	Tenant string
+	// AllowedToolPaths are the patterns of the file paths the caller can run. If nil, the caller can run any tool.
+	AllowedToolPaths []string
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func GetIdentity(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+type runEnvKey struct{}
+
+// WithRunEnv sets the environment variables that were requested for the gptscript process of a run, in the form "NAME=value".
+func WithRunEnv(ctx context.Context, env []string) context.Context {
+	return context.WithValue(ctx, runEnvKey{}, env)
+}
+
+func GetRunEnv(ctx context.Context) []string {
+	env, _ := ctx.Value(runEnvKey{}).([]string)
+	return env
+}
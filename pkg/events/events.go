@@ -0,0 +1,335 @@
+// Package events defines the events that the server streams for runs, and the envelope that each of them is streamed in, so that the
+// server and its clients agree on their shapes. The JSON schemas of the events are served by the server at /events/schema.
+//
+// Most events are written by the server, like the output of a run and the changes of its lifecycle. The events of the calls of a
+// run are written by gptscript, and are all a Call, with the type that gptscript gave them.
+package events
+
+import (
+	"encoding/json"
+	"maps"
+	"reflect"
+	"time"
+
+	"github.com/gptscript-ai/go-gptscript"
+)
+
+// Version is the version of the envelope. It changes if the fields of the envelope change in a way that isn't backwards compatible.
+const Version = 1
+
+// The types of the events that are written by the server.
+const (
+	TypeStdout        = "stdout"
+	TypeStderr        = "stderr"
+	TypeError         = "error"
+	TypeDone          = "done"
+	TypeQueuePosition = "queuePosition"
+	TypeLifecycle     = "lifecycle"
+	TypeProgress      = "progress"
+	TypeUsage         = "usage"
+	TypeRetry         = "retry"
+	TypeTruncated     = "truncated"
+	// TypePing is the type of the heartbeats of the transports that can only write events. A heartbeat has no data.
+	TypePing = "ping"
+)
+
+// The types of the events that are written by gptscript.
+const (
+	TypeRunStart     = "runStart"
+	TypeRunFinish    = "runFinish"
+	TypeCallStart    = "callStart"
+	TypeCallChat     = "callChat"
+	TypeCallProgress = "callProgress"
+	TypeCallContinue = "callContinue"
+	TypeCallSubCalls = "callSubCalls"
+	TypeCallConfirm  = "callConfirm"
+	TypeCallFinish   = "callFinish"
+)
+
+// dataTypes are the types of the data of the events, by the type of the event.
+var dataTypes = map[string]reflect.Type{
+	TypeStdout:        reflect.TypeFor[Stdout](),
+	TypeStderr:        reflect.TypeFor[Stderr](),
+	TypeError:         reflect.TypeFor[Error](),
+	TypeDone:          reflect.TypeFor[Done](),
+	TypeQueuePosition: reflect.TypeFor[QueuePosition](),
+	TypeLifecycle:     reflect.TypeFor[Lifecycle](),
+	TypeProgress:      reflect.TypeFor[Progress](),
+	TypeUsage:         reflect.TypeFor[Usage](),
+	TypeRetry:         reflect.TypeFor[Retry](),
+	TypeTruncated:     reflect.TypeFor[Truncated](),
+	TypeRunStart:      reflect.TypeFor[Call](),
+	TypeRunFinish:     reflect.TypeFor[Call](),
+	TypeCallStart:     reflect.TypeFor[Call](),
+	TypeCallChat:      reflect.TypeFor[Call](),
+	TypeCallProgress:  reflect.TypeFor[Call](),
+	TypeCallContinue:  reflect.TypeFor[Call](),
+	TypeCallSubCalls:  reflect.TypeFor[Call](),
+	TypeCallConfirm:   reflect.TypeFor[Call](),
+	TypeCallFinish:    reflect.TypeFor[Call](),
+}
+
+// DataTypes returns the types of the data of the events, by the type of the event. Heartbeats aren't included, because they have
+// no data.
+func DataTypes() map[string]reflect.Type {
+	return maps.Clone(dataTypes)
+}
+
+// Event is the data of an event, which knows the type of the event.
+type Event interface {
+	EventType() string
+}
+
+// Envelope is the form that every event is streamed in, so that clients can order and deduplicate the events of a run.
+type Envelope struct {
+	Version int `json:"version"`
+	// ID is unique across all runs. It is only set for events that have a sequence number.
+	ID    string `json:"id,omitempty"`
+	RunID string `json:"runID,omitempty"`
+	// RequestID is the ID of the request that the event was written for. The events of a run have the ID of the request that
+	// started the run, even when they are streamed again to another request.
+	RequestID string `json:"requestID,omitempty"`
+	// Seq is the position of the event in the events of the run, starting at 1, which is also the event ID that the events of a
+	// run can be resumed after. Events that aren't kept in the run history, like queue positions and heartbeats, have no sequence number.
+	Seq int64 `json:"seq,omitempty"`
+	// Item is the index of the item of a batch that the event is from, if the event is streamed for a batch.
+	Item *int      `json:"item,omitempty"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Data is the event itself. When an envelope is decoded, it is the event of the type of the envelope, like a Stdout for stdout
+	// events and a Call for the events of gptscript, or the JSON of the event if its type is unknown.
+	Data any `json:"data,omitempty"`
+}
+
+// UnmarshalJSON decodes the envelope, and its data as the event of the type of the envelope.
+func (e *Envelope) UnmarshalJSON(b []byte) error {
+	type envelope Envelope
+	var raw struct {
+		envelope
+		Data json.RawMessage `json:"data,omitempty"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*e = Envelope(raw.envelope)
+	if len(raw.Data) == 0 {
+		return nil
+	}
+
+	data, err := Decode(e.Type, raw.Data)
+	if err != nil {
+		return err
+	}
+	e.Data = data
+	return nil
+}
+
+// Decode decodes the data of an event of the type into the type of its data, like a Stdout for stdout events. Unknown types are
+// returned as their JSON, so that they can be written again as they are.
+func Decode(eventType string, data []byte) (any, error) {
+	t, ok := dataTypes[eventType]
+	if !ok {
+		return json.RawMessage(data), nil
+	}
+
+	v := reflect.New(t)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+// Stdout is output of a run. Runs that stream their output write it in pieces as it comes, and other runs write it all at once
+// when they end.
+type Stdout struct {
+	Time   time.Time `json:"time"`
+	Stdout string    `json:"stdout"`
+	// Encoding is base64 if the output isn't valid UTF-8, and the output is base64 encoded.
+	Encoding string `json:"encoding,omitempty"`
+	// Done is set on the reply of a chat turn, and is whether the turn ended the chat.
+	Done     *bool `json:"done,omitempty"`
+	Redacted bool  `json:"redacted,omitempty"`
+}
+
+func (Stdout) EventType() string { return TypeStdout }
+
+// Stderr is error output of a run.
+type Stderr struct {
+	Time   time.Time `json:"time"`
+	Stderr string    `json:"stderr"`
+	// Encoding is base64 if the output isn't valid UTF-8, and the output is base64 encoded.
+	Encoding string `json:"encoding,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+func (Stderr) EventType() string { return TypeStderr }
+
+// Error is the reason that a run failed.
+type Error struct {
+	Time time.Time `json:"time"`
+	Err  string    `json:"err"`
+	// ExitCode is the exit code of gptscript, if it exited with one.
+	ExitCode int  `json:"exitCode,omitempty"`
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+func (Error) EventType() string { return TypeError }
+
+// Done is the last event of a run.
+type Done struct {
+	Time time.Time `json:"time"`
+	Done bool      `json:"done"`
+}
+
+func (Done) EventType() string { return TypeDone }
+
+// QueuePosition is the position of a run in the queue, while it waits to start.
+type QueuePosition struct {
+	Time          time.Time `json:"time"`
+	QueuePosition int       `json:"queuePosition"`
+}
+
+func (QueuePosition) EventType() string { return TypeQueuePosition }
+
+// LifecycleState is a state of a run as it is reported to the clients that stream it.
+type LifecycleState string
+
+const (
+	LifecycleQueued       LifecycleState = "queued"
+	LifecycleStarted      LifecycleState = "started"
+	LifecycleModelCalling LifecycleState = "modelCalling"
+	LifecycleToolCalling  LifecycleState = "toolCalling"
+	LifecycleFinished     LifecycleState = "finished"
+	LifecycleCanceled     LifecycleState = "canceled"
+	LifecycleErrored      LifecycleState = "errored"
+)
+
+// Lifecycle is a run entering another state.
+type Lifecycle struct {
+	Time      time.Time      `json:"time"`
+	Lifecycle LifecycleState `json:"lifecycle"`
+}
+
+func (Lifecycle) EventType() string { return TypeLifecycle }
+
+// Progress is how far along a run is, which is written whenever a call of the run starts or finishes.
+type Progress struct {
+	Time     time.Time   `json:"time"`
+	Progress RunProgress `json:"progress"`
+}
+
+func (Progress) EventType() string { return TypeProgress }
+
+// RunProgress is how many of the calls of a run have completed, out of the calls that have started so far. The total grows as the
+// model asks for more tools to be called.
+type RunProgress struct {
+	Completed int `json:"completed"`
+	Total     int `json:"total"`
+}
+
+// Usage is the usage of a run so far, which is written after each call of the run that used the model.
+type Usage struct {
+	Time  time.Time  `json:"time"`
+	Usage TokenUsage `json:"usage"`
+}
+
+func (Usage) EventType() string { return TypeUsage }
+
+// TokenUsage is the tokens that a run used, and what they cost if the server knows the prices of its models.
+type TokenUsage struct {
+	PromptTokens     int64   `json:"promptTokens"`
+	CompletionTokens int64   `json:"completionTokens"`
+	TotalTokens      int64   `json:"totalTokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// Retry is a run being tried again after an error of the model.
+type Retry struct {
+	Time     time.Time    `json:"time"`
+	Retry    RetryAttempt `json:"retry"`
+	Redacted bool         `json:"redacted,omitempty"`
+}
+
+func (Retry) EventType() string { return TypeRetry }
+
+// RetryAttempt is the attempt that a run is tried again with, and the error that it is tried again after. The status is the status
+// code of the error of the model, or output_schema if the output of the run didn't conform to its output schema.
+type RetryAttempt struct {
+	Attempt     int    `json:"attempt"`
+	MaxAttempts int    `json:"maxAttempts"`
+	Status      string `json:"status"`
+	Error       string `json:"error"`
+	// Delay is how long the run waits before it is tried again, like "2s".
+	Delay string `json:"delay"`
+}
+
+// Truncated is the output of a run exceeding the max output size, which stops the run.
+type Truncated struct {
+	Time      time.Time  `json:"time"`
+	Truncated Truncation `json:"truncated"`
+}
+
+func (Truncated) EventType() string { return TypeTruncated }
+
+// Truncation is the limit that the output of a run exceeded, in bytes.
+type Truncation struct {
+	Limit int64 `json:"limit"`
+}
+
+// Call is an event of gptscript about a run or one of its calls, like callStart, callProgress, and callFinish.
+type Call struct {
+	// Time is when gptscript wrote the event, if it said.
+	Time *time.Time `json:"time,omitempty"`
+	// Type is the type that gptscript gave the event, which is also the type of its envelope.
+	Type        string       `json:"type"`
+	RunID       string       `json:"runID,omitempty"`
+	CallContext *CallContext `json:"callContext,omitempty"`
+	// ToolSubCalls are the calls of tools that the model asked for, by the ID of the call, on callSubCalls events.
+	ToolSubCalls map[string]SubCall `json:"toolSubCalls,omitempty"`
+	ToolResults  int                `json:"toolResults,omitempty"`
+	// ChatCompletionID, ChatRequest, and ChatResponse are the ID, the request, and the response of a call of the model, in the form
+	// of the API of the model.
+	ChatCompletionID   string          `json:"chatCompletionId,omitempty"`
+	ChatRequest        json.RawMessage `json:"chatRequest,omitempty"`
+	ChatResponse       json.RawMessage `json:"chatResponse,omitempty"`
+	ChatResponseCached bool            `json:"chatResponseCached,omitempty"`
+	// Usage is the tokens that the call used, on callFinish events of calls of the model.
+	Usage *CallUsage `json:"usage,omitempty"`
+	// Content is the content of the call so far on callProgress events, and the result of the call on callFinish events.
+	Content string `json:"content,omitempty"`
+	// Program, Input, Output, and Err are the program of a run and its input on runStart events, and its output and error on
+	// runFinish events.
+	Program  json.RawMessage `json:"program,omitempty"`
+	Input    string          `json:"input,omitempty"`
+	Output   string          `json:"output,omitempty"`
+	Err      string          `json:"err,omitempty"`
+	Redacted bool            `json:"redacted,omitempty"`
+}
+
+func (c Call) EventType() string { return c.Type }
+
+// CallContext is the call that an event of gptscript is about.
+type CallContext struct {
+	ID string `json:"id"`
+	// ParentID is the ID of the call that made the call, which is empty for the call of the entry tool of a run.
+	ParentID     string          `json:"parentID,omitempty"`
+	Tool         *gptscript.Tool `json:"tool,omitempty"`
+	ToolCategory string          `json:"toolCategory,omitempty"`
+	DisplayText  string          `json:"displayText,omitempty"`
+	InputContext json.RawMessage `json:"inputContext,omitempty"`
+	AgentGroup   json.RawMessage `json:"agentGroup,omitempty"`
+}
+
+// SubCall is a call of a tool that the model asked for.
+type SubCall struct {
+	ToolID string `json:"toolID,omitempty"`
+	Input  string `json:"input,omitempty"`
+}
+
+// CallUsage is the tokens that a call of the model used.
+type CallUsage struct {
+	PromptTokens     int64 `json:"promptTokens,omitempty"`
+	CompletionTokens int64 `json:"completionTokens,omitempty"`
+	TotalTokens      int64 `json:"totalTokens,omitempty"`
+}
@@ -0,0 +1,88 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// level is the minimum level of the logs that are written, which can be changed while the process is running.
+var level = new(slog.LevelVar)
+
+// Options configure where and how the logs of the process are written.
+type Options struct {
+	// Format is the format of the lines, either text or json. It defaults to text.
+	Format string
+	// Level is the minimum level of the logs, one of debug, info, warn, or error. If it is not set, then the level isn't changed.
+	Level string
+	// File is the file that the logs are appended to. The logs are written to stderr if it is not set.
+	File string
+	// MaxSize is the size in bytes that the file is rotated at, 0 means that the file is never rotated.
+	MaxSize int64
+	// MaxBackups is the number of rotated files that are kept, as the file with .1, .2, and so on appended, .1 being the newest.
+	MaxBackups int
+}
+
+// Configure makes the logs of the process be written as the options say. The returned closer closes the file of the logs, if
+// there is one.
+func Configure(opts Options) (io.Closer, error) {
+	if opts.Level != "" {
+		l, err := ParseLevel(opts.Level)
+		if err != nil {
+			return nil, err
+		}
+		SetLevel(l)
+	}
+
+	var (
+		w      io.Writer = os.Stderr
+		closer io.Closer = io.NopCloser(nil)
+	)
+	if opts.File != "" {
+		f, err := openRotatingFile(opts.File, opts.MaxSize, opts.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = f, f
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	switch opts.Format {
+	case "", FormatText:
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, handlerOpts)))
+	case FormatJSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, handlerOpts)))
+	default:
+		_ = closer.Close()
+		return nil, fmt.Errorf("unknown log format %q, must be %s or %s", opts.Format, FormatText, FormatJSON)
+	}
+
+	return closer, nil
+}
+
+// ParseLevel parses the name of a level, one of debug, info, warn, or error.
+func ParseLevel(name string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid log level: %w", err)
+	}
+	return l, nil
+}
+
+// Level returns the minimum level of the logs that are written.
+func Level() slog.Level {
+	return level.Level()
+}
+
+// SetLevel changes the minimum level of the logs that are written.
+func SetLevel(l slog.Level) {
+	level.Set(l)
+	// The level of the default handler is changed too, in case the logs haven't been configured.
+	slog.SetLogLoggerLevel(l)
+}
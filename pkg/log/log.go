@@ -38,9 +38,9 @@ func (h *handler) Handle(ctx context.Context, record slog.Record) error {
 }
 
 func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return &handler{h: h.h.WithAttrs(attrs)}
+	return &handler{h: h.h.WithAttrs(attrs), id: h.id}
 }
 
 func (h *handler) WithGroup(name string) slog.Handler {
-	return &handler{h: h.h.WithGroup(name)}
+	return &handler{h: h.h.WithGroup(name), id: h.id}
 }
@@ -0,0 +1,85 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a file of logs that is moved aside and started again when it reaches its maximum size.
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// Write appends the line to the file, rotating the file first if the line would make it larger than its maximum size. Each line
+// is written whole to a single file.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file to the first backup, shifting the other backups along and dropping the oldest, and starts a new file.
+// The lock must be held by the caller.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	if r.maxBackups > 0 {
+		for i := r.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate log file: %w", err)
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,126 @@
+// Package objects keeps files in object storage, like an S3 or GCS bucket, so that the replicas of a server can share the state
+// that would otherwise only be on the disk of one of them.
+package objects
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// The providers of object storage.
+const (
+	ProviderS3  = "s3"
+	ProviderGCS = "gcs"
+)
+
+// Object is an object in a store.
+type Object struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Store is where objects are kept.
+type Store interface {
+	// Put saves the object, whose content is read from r, replacing the object with the same key.
+	Put(ctx context.Context, object Object, r io.Reader) error
+	// Open returns the object with the key with its content, which must be closed.
+	Open(ctx context.Context, key string) (io.ReadCloser, Object, error)
+	// List returns the objects whose keys start with the prefix, sorted by key. Their modification times are when they were put.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Delete deletes the object with the key. It is not an error if there is no such object.
+	Delete(ctx context.Context, key string) error
+}
+
+// Config configures the bucket that objects are kept in.
+type Config struct {
+	// Provider is s3, for AWS and S3-compatible servers, or gcs, for Google Cloud Storage through its S3-compatible API with HMAC
+	// keys. It defaults to s3.
+	Provider string
+	// Endpoint is the URL of the API of the provider, like the URL of a MinIO server. It defaults to the endpoint of AWS in the
+	// region, or to the endpoint of GCS.
+	Endpoint string
+	// Region defaults to us-east-1 for S3, and to auto for GCS.
+	Region string
+	Bucket string
+	// Prefix is the prefix of the keys of the objects in the bucket, so that a bucket can be shared with other applications.
+	Prefix string
+	// AccessKeyID and SecretAccessKey default to the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle puts the bucket in the path of the URLs of the requests instead of in their host, which most S3-compatible
+	// servers need.
+	PathStyle bool
+}
+
+// Enabled returns whether a bucket is configured.
+func (c Config) Enabled() bool {
+	return c.Bucket != ""
+}
+
+func (c Config) Validate() error {
+	switch c.Provider {
+	case "", ProviderS3, ProviderGCS:
+	default:
+		return fmt.Errorf("invalid provider %q, must be %s or %s", c.Provider, ProviderS3, ProviderGCS)
+	}
+	if !c.Enabled() && (c.Endpoint != "" || c.Prefix != "") {
+		return errors.New("the bucket is required")
+	}
+	return nil
+}
+
+// New returns the store of the bucket of the config.
+func New(config Config) (Store, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Provider == ProviderGCS {
+		if config.Endpoint == "" {
+			config.Endpoint = "https://storage.googleapis.com"
+		}
+		if config.Region == "" {
+			config.Region = "auto"
+		}
+	}
+	return NewS3(config)
+}
+
+// Prefixed returns the store that keeps its objects in the store, with the prefix added to their keys, so that a store can be
+// shared by several kinds of objects.
+func Prefixed(store Store, prefix string) Store {
+	return &prefixed{store: store, prefix: prefix}
+}
+
+type prefixed struct {
+	store  Store
+	prefix string
+}
+
+func (p *prefixed) Put(ctx context.Context, object Object, r io.Reader) error {
+	object.Key = p.prefix + object.Key
+	return p.store.Put(ctx, object, r)
+}
+
+func (p *prefixed) Open(ctx context.Context, key string) (io.ReadCloser, Object, error) {
+	rc, object, err := p.store.Open(ctx, p.prefix+key)
+	object.Key = key
+	return rc, object, err
+}
+
+func (p *prefixed) List(ctx context.Context, prefix string) ([]Object, error) {
+	list, err := p.store.List(ctx, p.prefix+prefix)
+	for i := range list {
+		list[i].Key = list[i].Key[len(p.prefix):]
+	}
+	return list, err
+}
+
+func (p *prefixed) Delete(ctx context.Context, key string) error {
+	return p.store.Delete(ctx, p.prefix+key)
+}
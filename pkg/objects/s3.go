@@ -0,0 +1,297 @@
+package objects
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// unsignedPayload is the hash of the content of requests whose content isn't signed, so that objects can be streamed to the
+	// bucket without reading them twice.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// emptyPayloadHash is the hash of the content of requests that have none.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// modTimeHeader is the metadata of an object that keeps the modification time of the file that it was put from.
+	modTimeHeader = "X-Amz-Meta-Mtime"
+)
+
+// S3 is a Store that keeps objects in an S3-compatible bucket. The requests are signed with AWS Signature Version 4.
+type S3 struct {
+	config   Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns a Store that keeps objects in the S3-compatible bucket of the config.
+func NewS3(config Config) (*S3, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("the bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	if config.AccessKeyID == "" {
+		config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if config.SecretAccessKey == "" {
+		config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("the access key ID and secret access key are required")
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid endpoint %q", config.Endpoint)
+	}
+
+	return &S3{config: config, endpoint: endpoint, client: http.DefaultClient}, nil
+}
+
+func (s *S3) Put(ctx context.Context, object Object, r io.Reader) error {
+	req, err := s.request(ctx, http.MethodPut, object.Key, nil, r)
+	if err != nil {
+		return err
+	}
+	// S3 needs the length of the content, since it isn't sent in chunks.
+	req.ContentLength = object.Size
+	if object.Size == 0 {
+		req.Body = http.NoBody
+	}
+	if !object.ModTime.IsZero() {
+		req.Header.Set(modTimeHeader, object.ModTime.UTC().Format(time.RFC3339Nano))
+	}
+
+	resp, err := s.do(req, unsignedPayload)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Open returns the object with the key. Its modification time is that of the file that it was put from, if it was put with one.
+func (s *S3) Open(ctx context.Context, key string) (io.ReadCloser, Object, error) {
+	req, err := s.request(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, Object{}, err
+	}
+
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, Object{}, err
+	}
+
+	object := Object{Key: key, Size: resp.ContentLength}
+	if t, err := time.Parse(time.RFC3339Nano, resp.Header.Get(modTimeHeader)); err == nil {
+		object.ModTime = t
+	} else if t, err = http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		object.ModTime = t
+	}
+	return resp.Body, object, nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix + prefix}}
+
+	var list []Object
+	for {
+		req, err := s.request(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.do(req, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the objects of the bucket: %w", err)
+		}
+
+		for _, c := range result.Contents {
+			list = append(list, Object{Key: strings.TrimPrefix(c.Key, s.config.Prefix), Size: c.Size, ModTime: c.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	return list, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := s.request(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, emptyPayloadHash)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// request returns a request for the object with the key, or for the bucket if the key is empty. The path and query of its URL are
+// escaped as they are when the request is signed.
+func (s *S3) request(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/") + "/"
+	if s.config.PathStyle {
+		p += s.config.Bucket + "/"
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	if key != "" {
+		p += s.config.Prefix + key
+	}
+	u.Path = p
+	u.RawPath = uriEscape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// do signs the request and sends it, returning an error if the status of the response isn't successful. An object that doesn't exist
+// is ErrNotFound.
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	signV4(req, s.config.AccessKeyID, s.config.SecretAccessKey, s.config.Region, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && req.Method != http.MethodPut && req.URL.Query().Get("list-type") == "" {
+		return nil, ErrNotFound
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s failed with status %d: %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// signV4 signs the request for S3 with AWS Signature Version 4, in its Authorization header. Every header that the request has
+// when it is signed is signed, along with its host.
+func signV4(req *http.Request, accessKeyID, secretAccessKey, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// The values of the headers are signed with their spaces trimmed, and the spaces within them collapsed into one.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		canonical := make([]string, len(values))
+		for i, v := range values {
+			canonical[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(canonical, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns the query sorted by name and escaped, as it is signed.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []string
+	for _, name := range names {
+		for _, v := range query[name] {
+			params = append(params, uriEscape(name, true)+"="+uriEscape(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEscape escapes every byte of the string except the unreserved characters of RFC 3986, and slashes unless escapeSlash is true.
+func uriEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !escapeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
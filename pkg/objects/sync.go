@@ -0,0 +1,161 @@
+package objects
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Pull makes the regular files of the directory the objects whose keys start with the prefix, with the rest of their keys as their
+// paths in the directory. Objects that the directory doesn't have, or that were put since their files were last pulled or pushed,
+// are downloaded. The files that have no object are removed, unless they were modified since the time, because then they are
+// changes that haven't been pushed yet.
+func Pull(ctx context.Context, store Store, prefix, dir string, since time.Time) error {
+	list, err := store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool, len(list))
+	for _, o := range list {
+		name := strings.TrimPrefix(o.Key, prefix)
+		p, ok := filePath(dir, name)
+		if !ok {
+			continue
+		}
+		keep[p] = true
+
+		if info, err := os.Lstat(p); err == nil && info.Mode().IsRegular() && info.Size() == o.Size && !info.ModTime().Before(o.ModTime) {
+			continue
+		}
+		if err = download(ctx, store, o, p); err != nil {
+			return fmt.Errorf("failed to pull %s: %w", name, err)
+		}
+	}
+
+	return filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || keep[p] {
+			return err
+		}
+		if info, err := entry.Info(); err != nil || !info.ModTime().Before(since) {
+			return err
+		}
+		return os.Remove(p)
+	})
+}
+
+// Push makes the objects whose keys start with the prefix the regular files of the directory, with their paths in the directory
+// added to the prefix. The files that were modified since the time, or that have no object, are uploaded. The objects whose files
+// are gone are deleted, unless they were put since the time, because then they were pushed from another directory in the meantime.
+// Symbolic links are skipped, so that the files outside of the directory are never pushed.
+func Push(ctx context.Context, store Store, prefix, dir string, since time.Time) error {
+	list, err := store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	stale := make(map[string]Object, len(list))
+	for _, o := range list {
+		stale[o.Key] = o
+	}
+
+	err = filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		key := prefix + filepath.ToSlash(rel)
+		o, ok := stale[key]
+		delete(stale, key)
+		if ok && o.Size == info.Size() && info.ModTime().Before(since) {
+			return nil
+		}
+		if err = upload(ctx, store, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}, p); err != nil {
+			return fmt.Errorf("failed to push %s: %w", rel, err)
+		}
+		// The file is as new as its object now, so that it isn't pulled again.
+		now := time.Now()
+		return os.Chtimes(p, now, now)
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, o := range stale {
+		if !o.ModTime.Before(since) {
+			continue
+		}
+		if err = store.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filePath returns the path in the directory of the object with the name, which must be a path that is separated by slashes and
+// that stays in the directory.
+func filePath(dir, name string) (string, bool) {
+	if name == "." || !fs.ValidPath(name) || strings.ContainsRune(name, '\\') {
+		return "", false
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), true
+}
+
+// download writes the object to the file at the path, whose modification time is the modification time of the object.
+func download(ctx context.Context, store Store, o Object, p string) error {
+	rc, _, err := store.Open(ctx, o.Key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err = os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	// The object is written to a temporary file first, so that a partial file is never read.
+	f, err := os.CreateTemp(filepath.Dir(p), ".pull-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = io.Copy(f, rc); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chtimes(f.Name(), o.ModTime, o.ModTime); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(p); err == nil && info.IsDir() {
+		return errors.New("a directory is in the way")
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func upload(ctx context.Context, store Store, o Object, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return store.Put(ctx, o, io.LimitReader(f, o.Size))
+}
@@ -0,0 +1,119 @@
+package runner
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Process is a gptscript process for a Backend to run.
+type Process struct {
+	// Args are the arguments of gptscript.
+	Args []string
+	// Env is added to the environment of the server to make up the environment of the process.
+	Env []string
+	// Stdin is the standard input of the process, which has none if it is nil.
+	Stdin io.Reader
+	// Stdout and Stderr are where the output of the process is written. If Events isn't nil, then the process streams the events
+	// of the run to it.
+	Stdout io.Writer
+	Stderr io.Writer
+	Events io.Writer
+	// Started is called with the PID of the process on the host once it has started, if there is one. Backends that run the
+	// process through a command on the host, like the CLI of a container runtime, call it with the PID of the command.
+	Started func(pid int)
+	// Limits are the resources that the process can use before it is killed. Only the Host backend enforces them, since the other
+	// backends have limits of their own.
+	Limits Limits
+}
+
+// started calls the Started function of the process, if it has one.
+func (p Process) started(c *exec.Cmd) {
+	if p.Started != nil && c.Process != nil {
+		p.Started(c.Process.Pid)
+	}
+}
+
+// Backend runs the gptscript processes of runs.
+type Backend interface {
+	// Start starts the process, which is stopped when the context is done. The returned function waits for the process to exit
+	// and for all of its output to be written.
+	Start(ctx context.Context, p Process) (func() error, error)
+}
+
+// Host is the Backend that runs gptscript directly on the host, as the user of the server.
+type Host struct{}
+
+func (Host) Start(ctx context.Context, p Process) (func() error, error) {
+	c := exec.CommandContext(ctx, getCommand(), p.Args...)
+	if len(p.Env) > 0 {
+		c.Env = append(os.Environ(), p.Env...)
+	}
+	c.Stdin, c.Stdout, c.Stderr = p.Stdin, p.Stdout, p.Stderr
+
+	if p.Events == nil {
+		if err := c.Start(); err != nil {
+			return nil, err
+		}
+		p.started(c)
+		return p.watch(c, c.Wait), nil
+	}
+
+	eventsRead, eventsWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	appendExtraFiles(c, eventsWrite)
+	err = c.Start()
+	// Close the parent pipe after starting the child process, so that the events end when the child exits.
+	_ = eventsWrite.Close()
+	if err != nil {
+		_ = eventsRead.Close()
+		return nil, err
+	}
+	p.started(c)
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		defer eventsRead.Close()
+		_, _ = io.Copy(p.Events, eventsRead)
+	}()
+
+	return p.watch(c, func() error {
+		err := c.Wait()
+		<-copied
+		return err
+	}), nil
+}
+
+// watch enforces the limits of the process on the started command, and returns a function that waits for it with wait. If the
+// command was killed because it exceeded a limit, then the function returns a LimitError.
+func (p Process) watch(c *exec.Cmd, wait func() error) func() error {
+	if !p.Limits.enabled() {
+		return wait
+	}
+
+	done := make(chan struct{})
+	exceeded := watchLimits(c.Process.Pid, p.Limits, done)
+	return func() error {
+		err := wait()
+		close(done)
+		select {
+		case le := <-exceeded:
+			le.Err = err
+			return le
+		default:
+			return err
+		}
+	}
+}
+
+func (o Options) backend() Backend {
+	if o.Backend == nil {
+		return Host{}
+	}
+	return o.Backend
+}
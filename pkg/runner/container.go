@@ -0,0 +1,174 @@
+package runner
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// containerEventsDir is where the directory with the pipe of the events of a run is mounted in its container.
+	containerEventsDir = "/run/clicky-serves"
+	// containerStopTimeout is how long removing the container of a canceled run can take.
+	containerStopTimeout = 10 * time.Second
+)
+
+// Container is a Backend that runs gptscript in a new container for each process, with Docker or Podman. The tools of a run can
+// only reach the files that are mounted into the container, and can't use more memory, CPU, or processes than the limits.
+type Container struct {
+	// Runtime is the command of the container runtime, like docker or podman. It defaults to docker.
+	Runtime string
+	// Image is the image of the containers, which must have gptscript on its PATH.
+	Image string
+
+	// Memory and CPUs are the limits of each container, in the syntax of the runtime, like "512m" and "1.5".
+	// PidsLimit is the number of processes that can run in each container. A limit that isn't set means no limit.
+	Memory    string
+	CPUs      string
+	PidsLimit int
+
+	// Network is the network of the containers, which must be able to reach the model provider. It defaults to the default
+	// network of the runtime.
+	Network string
+	// SeccompProfile is the path of a seccomp profile that replaces the default profile of the runtime.
+	SeccompProfile string
+
+	// Mounts are the bind mounts of the containers, in the form "source:target[:options]".
+	Mounts []string
+	// Workdir is the working directory of gptscript in the containers.
+	Workdir string
+	// Env are patterns, in the syntax of path.Match, of the environment variables of the server that are passed to the
+	// containers. The environment variables of runs are always passed.
+	Env []string
+}
+
+func (c Container) Start(ctx context.Context, p Process) (func() error, error) {
+	if c.Image == "" {
+		return nil, errors.New("the image of the container is not set")
+	}
+
+	name, err := containerName()
+	if err != nil {
+		return nil, err
+	}
+
+	runArgs := []string{
+		"run", "--rm", "--interactive", "--name", name, "--entrypoint", "gptscript",
+		"--cap-drop", "ALL", "--security-opt", "no-new-privileges",
+	}
+	if c.Memory != "" {
+		// Setting the swap limit to the memory limit keeps the container from swapping.
+		runArgs = append(runArgs, "--memory", c.Memory, "--memory-swap", c.Memory)
+	}
+	if c.CPUs != "" {
+		runArgs = append(runArgs, "--cpus", c.CPUs)
+	}
+	if c.PidsLimit > 0 {
+		runArgs = append(runArgs, "--pids-limit", strconv.Itoa(c.PidsLimit))
+	}
+	if c.Network != "" {
+		runArgs = append(runArgs, "--network", c.Network)
+	}
+	if c.SeccompProfile != "" {
+		runArgs = append(runArgs, "--security-opt", "seccomp="+c.SeccompProfile)
+	}
+	for _, m := range c.Mounts {
+		runArgs = append(runArgs, "--volume", m)
+	}
+	if c.Workdir != "" {
+		runArgs = append(runArgs, "--workdir", c.Workdir)
+	}
+	// Only the names of the variables are given, so that their values are read from the environment of the runtime command instead
+	// of being visible in its arguments.
+	for _, name := range envNames(c.Env, p.Env) {
+		runArgs = append(runArgs, "--env", name)
+	}
+
+	args, finish := p.Args, func() {}
+	if p.Events != nil {
+		var dir string
+		if dir, finish, err = relayEvents(p.Events); err != nil {
+			return nil, err
+		}
+
+		runArgs = append(runArgs, "--volume", dir+":"+containerEventsDir)
+		args = append([]string{"--events-stream-to=" + containerEventsDir + "/" + eventsPipe}, args...)
+	}
+
+	cmd := exec.CommandContext(ctx, c.runtime(), append(append(runArgs, c.Image), args...)...)
+	cmd.Env = append(os.Environ(), p.Env...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = p.Stdin, p.Stdout, p.Stderr
+
+	// Killing the runtime command doesn't stop the container, so the container is removed when the run is canceled.
+	cmd.Cancel = func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), containerStopTimeout)
+		defer cancel()
+
+		_ = exec.CommandContext(ctx, c.runtime(), "rm", "--force", name).Run()
+		return cmd.Process.Kill()
+	}
+	cmd.WaitDelay = containerStopTimeout
+
+	if err = cmd.Start(); err != nil {
+		finish()
+		return nil, err
+	}
+	p.started(cmd)
+
+	return func() error {
+		err := cmd.Wait()
+		finish()
+		return err
+	}, nil
+}
+
+func (c Container) runtime() string {
+	if c.Runtime == "" {
+		return "docker"
+	}
+	return c.Runtime
+}
+
+// envNames returns the names of the environment variables that are passed to a sandbox, which are those of the run and those of
+// the server that match the patterns.
+func envNames(patterns, env []string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(kv string) {
+		name, _, _ := strings.Cut(kv, "=")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				add(kv)
+				break
+			}
+		}
+	}
+	for _, kv := range env {
+		add(kv)
+	}
+	return names
+}
+
+// containerName returns a random name for a container, which is used to remove the container when its run is canceled.
+func containerName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "clicky-serves-" + hex.EncodeToString(b), nil
+}
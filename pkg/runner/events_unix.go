@@ -0,0 +1,64 @@
+//go:build !windows
+
+package runner
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// eventsPipe is the name of the pipe that a process in a container writes its events to.
+const eventsPipe = "events"
+
+// relayEvents makes a named pipe in a new directory, which is mounted into a container for gptscript to write its events to, and
+// copies the events from the pipe to events. Files can't be passed into a container, which is why the pipe is needed.
+// The returned function must be called once the runtime command has exited, and waits for all the events to be copied.
+func relayEvents(events io.Writer) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "clicky-serves-events-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The user of the container may not be the user of the server, so it must be able to write to the pipe.
+	pipe := filepath.Join(dir, eventsPipe)
+	if err = errors.Join(os.Chmod(dir, 0o755), syscall.Mkfifo(pipe, 0o600), os.Chmod(pipe, 0o622)); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+
+		// Opening the pipe waits until gptscript opens it for writing, and reading it ends when gptscript closes it.
+		f, err := os.Open(pipe)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+
+		_, _ = io.Copy(events, f)
+	}()
+
+	return dir, func() {
+		defer os.RemoveAll(dir)
+
+		// If gptscript never opened the pipe, then the copy is still waiting to open it, and opening the pipe for writing lets it
+		// finish. Opening fails until the copy has opened the pipe, so it is tried until the copy is done.
+		for {
+			if w, err := os.OpenFile(pipe, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+				_ = w.Close()
+			}
+
+			select {
+			case <-copied:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}, nil
+}
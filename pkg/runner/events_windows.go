@@ -0,0 +1,13 @@
+package runner
+
+import (
+	"errors"
+	"io"
+)
+
+const eventsPipe = "events"
+
+// relayEvents is not supported on Windows, which doesn't have named pipes that can be mounted into a container.
+func relayEvents(io.Writer) (string, func(), error) {
+	return "", nil, errors.New("streaming the events of a run in a container is not supported on Windows")
+}
@@ -0,0 +1,305 @@
+package runner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	// DefaultReleaseURL is the URL of the releases of gptscript, which each have their archives and checksums.txt in a directory named
+	// after their version.
+	DefaultReleaseURL = "https://github.com/gptscript-ai/gptscript/releases/download"
+
+	// maxArchiveSize is the size in bytes of the largest archive of gptscript that is downloaded.
+	maxArchiveSize = 512 << 20
+)
+
+// DownloadOptions are the options of downloading a release of gptscript.
+type DownloadOptions struct {
+	// Version is the version of the release, like v0.9.5.
+	Version string
+	// ReleaseURL is the URL of the releases, which defaults to DefaultReleaseURL.
+	ReleaseURL string
+	// Checksum is the SHA-256 of the archive of the release for the platform of the server, in hex. If it isn't set, then the archive
+	// is checked against the checksums.txt of the release.
+	Checksum string
+	// Dir is the directory that the binary is kept in, in a directory named after its version, so that it is only downloaded once.
+	Dir string
+}
+
+// SetCommand makes the binary at the path the gptscript binary that processes are started with, by the gptscript SDK too.
+func SetCommand(path string) error {
+	return os.Setenv("GPTSCRIPT_BIN", path)
+}
+
+// Download downloads the release of gptscript for the platform of the server into the directory of the options, unless it was
+// downloaded before, and returns the path of its binary. The archive of the release is verified against its checksum before the
+// binary is extracted from it. The archive is kept with the binary, and a binary that was downloaded before is verified against it
+// every time, so that a binary that was only partly written or that was changed is downloaded again.
+func Download(ctx context.Context, opts DownloadOptions) (string, error) {
+	if opts.ReleaseURL == "" {
+		opts.ReleaseURL = DefaultReleaseURL
+	}
+
+	bin := "gptscript"
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+
+	archive, err := archiveName(opts.Version)
+	if err != nil {
+		return "", err
+	}
+	releaseURL := strings.TrimSuffix(opts.ReleaseURL, "/") + "/" + opts.Version + "/"
+
+	dir := filepath.Join(opts.Dir, opts.Version)
+	binPath := filepath.Join(dir, bin)
+	archivePath := filepath.Join(dir, archive)
+	// The checksum of the archive from the checksums of the release is kept with it, so that the checksums aren't downloaded every
+	// time.
+	checksumPath := archivePath + ".sha256"
+
+	checksum := strings.ToLower(opts.Checksum)
+	if checksum == "" {
+		if b, err := os.ReadFile(checksumPath); err == nil {
+			checksum = strings.TrimSpace(string(b))
+		} else if checksum, err = releaseChecksum(ctx, releaseURL+"checksums.txt", archive); err != nil {
+			return "", err
+		}
+	}
+
+	if verifyBinary(archivePath, archive, binPath, bin, checksum) == nil {
+		return binPath, nil
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create directory of gptscript: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, ".archive-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to download gptscript: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sum, err := downloadFile(ctx, releaseURL+archive, f)
+	if err != nil {
+		return "", fmt.Errorf("failed to download gptscript: %w", err)
+	}
+	if sum != checksum {
+		return "", fmt.Errorf("checksum of %s is %s, but %s was expected", archive, sum, checksum)
+	}
+
+	// The binary is extracted to a temporary file that is renamed once it is complete, so that a partial binary is never run.
+	tmp, err := os.CreateTemp(dir, ".gptscript-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to extract gptscript: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = extractFile(f, archive, bin, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to extract gptscript: %w", err)
+	}
+
+	if err = os.Chmod(tmp.Name(), 0o755); err != nil {
+		return "", fmt.Errorf("failed to extract gptscript: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), binPath); err != nil {
+		return "", fmt.Errorf("failed to extract gptscript: %w", err)
+	}
+	// The archive is closed before it is renamed, since open files can't be renamed on Windows.
+	if err = f.Close(); err != nil {
+		return "", fmt.Errorf("failed to keep the archive of gptscript: %w", err)
+	}
+	if err = os.Rename(f.Name(), archivePath); err != nil {
+		return "", fmt.Errorf("failed to keep the archive of gptscript: %w", err)
+	}
+	if err = os.WriteFile(checksumPath, []byte(checksum+"\n"), 0o644); err != nil {
+		return "", fmt.Errorf("failed to keep the checksum of gptscript: %w", err)
+	}
+	return binPath, nil
+}
+
+// verifyBinary returns an error if the archive doesn't have the checksum, or if the binary isn't the one in the archive.
+func verifyBinary(archivePath, archive, binPath, bin, checksum string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != checksum {
+		return fmt.Errorf("checksum of %s is %s, but %s was expected", archive, sum, checksum)
+	}
+
+	want := sha256.New()
+	if err = extractFile(f, archive, bin, want); err != nil {
+		return err
+	}
+	got, err := fileSHA256(binPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want.Sum(nil)) {
+		return fmt.Errorf("%s isn't the binary of %s", binPath, archive)
+	}
+	return nil
+}
+
+func fileSHA256(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// archiveName returns the name of the archive of the release for the platform of the server.
+func archiveName(version string) (string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return fmt.Sprintf("gptscript-%s-linux-%s.tar.gz", version, runtime.GOARCH), nil
+	case "darwin":
+		return fmt.Sprintf("gptscript-%s-macOS-universal.tar.gz", version), nil
+	case "windows":
+		return fmt.Sprintf("gptscript-%s-windows-%s.zip", version, runtime.GOARCH), nil
+	default:
+		return "", fmt.Errorf("gptscript isn't released for %s", runtime.GOOS)
+	}
+}
+
+// releaseChecksum returns the checksum of the archive in the checksums file of a release, whose lines are a checksum and the name
+// of an archive.
+func releaseChecksum(ctx context.Context, url, archive string) (string, error) {
+	resp, err := get(ctx, url)
+	if err != nil {
+		return "", fmt.Errorf("failed to download checksums of gptscript: %w", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1<<20))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == archive {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to download checksums of gptscript: %w", err)
+	}
+	return "", fmt.Errorf("the checksums of gptscript don't have a checksum of %s", archive)
+}
+
+// downloadFile writes the file at the URL to w, and returns its SHA-256 in hex.
+func downloadFile(ctx context.Context, url string, w io.Writer) (string, error) {
+	resp, err := get(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(resp.Body, maxArchiveSize+1))
+	if err != nil {
+		return "", err
+	}
+	if n > maxArchiveSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", url, maxArchiveSize)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return resp, nil
+}
+
+// extractFile writes the file with the name, in any directory of the archive, to w.
+func extractFile(f *os.File, archive, name string, w io.Writer) error {
+	if strings.HasSuffix(archive, ".zip") {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return err
+		}
+		for _, zf := range zr.File {
+			if path.Base(zf.Name) == name && !zf.FileInfo().IsDir() {
+				rc, err := zf.Open()
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+				_, err = io.Copy(w, rc)
+				return err
+			}
+		}
+		return fmt.Errorf("%s has no %s", archive, name)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s has no %s", archive, name)
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg && path.Base(header.Name) == name {
+			_, err = io.Copy(w, tr)
+			return err
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package runner
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownload(t *testing.T) {
+	archive, err := archiveName("v1.0.0")
+	if err != nil {
+		t.Skip(err)
+	}
+	if !strings.HasSuffix(archive, ".tar.gz") {
+		t.Skip("the archive of the platform isn't a tarball")
+	}
+
+	binary := []byte("#!/bin/sh\necho gptscript\n")
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err = tw.WriteHeader(&tar.Header{Name: "gptscript", Mode: 0o755, Size: int64(len(binary)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tw.Write(binary); err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	checksum := hex.EncodeToString(sum[:])
+
+	var downloads int
+	releases := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.0.0/" + archive:
+			downloads++
+			_, _ = w.Write(buf.Bytes())
+		case "/v1.0.0/checksums.txt":
+			_, _ = w.Write([]byte(checksum + "  " + archive + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer releases.Close()
+
+	dir := t.TempDir()
+	download := func(checksum string) (string, error) {
+		return Download(context.Background(), DownloadOptions{Version: "v1.0.0", ReleaseURL: releases.URL, Checksum: checksum, Dir: dir})
+	}
+
+	binPath, err := download(checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(binPath); err != nil || !bytes.Equal(got, binary) {
+		t.Fatalf("got binary %q, %v, want the binary of the archive", got, err)
+	}
+
+	// A binary that was downloaded before is only downloaded again if it changed.
+	if _, err = download(checksum); err != nil {
+		t.Fatal(err)
+	}
+	if downloads != 1 {
+		t.Fatalf("got %d downloads of an unchanged binary, want 1", downloads)
+	}
+
+	for _, change := range []struct {
+		name string
+		path string
+	}{
+		{name: "binary", path: binPath},
+		{name: "archive", path: filepath.Join(dir, "v1.0.0", archive)},
+	} {
+		t.Run(change.name, func(t *testing.T) {
+			if err = os.WriteFile(change.path, []byte("changed"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			before := downloads
+			if _, err = download(""); err != nil {
+				t.Fatal(err)
+			}
+			if downloads != before+1 {
+				t.Errorf("got %d downloads, want the changed %s to be downloaded again", downloads-before, change.name)
+			}
+			if got, err := os.ReadFile(binPath); err != nil || !bytes.Equal(got, binary) {
+				t.Errorf("got binary %q, %v, want the binary of the archive", got, err)
+			}
+		})
+	}
+
+	if _, err = download(strings.Repeat("0", 64)); err == nil {
+		t.Error("expected an error for an archive that doesn't have the pinned checksum")
+	}
+}
@@ -0,0 +1,197 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// serviceAccountDir is where the credentials of the service account of a pod are mounted.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient makes requests to the API server of a Kubernetes cluster.
+type kubeClient struct {
+	server    string
+	tokenFile string
+	http      *http.Client
+}
+
+// newKubeClient returns a client of the API server. If the server isn't set, then the client connects to the cluster that the
+// server runs in, with the credentials of its service account.
+func newKubeClient(server, tokenFile, caFile string) (*kubeClient, error) {
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("not running in a Kubernetes cluster, so the API server must be set")
+		}
+
+		server = "https://" + net.JoinHostPort(host, port)
+		if tokenFile == "" {
+			tokenFile = filepath.Join(serviceAccountDir, "token")
+		}
+		if caFile == "" {
+			caFile = filepath.Join(serviceAccountDir, "ca.crt")
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA of the API server: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &kubeClient{
+		server:    strings.TrimSuffix(server, "/"),
+		tokenFile: tokenFile,
+		http:      &http.Client{Transport: transport},
+	}, nil
+}
+
+// kubeStatusError is the error of a request that the API server rejected.
+type kubeStatusError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *kubeStatusError) Error() string {
+	return fmt.Sprintf("kubernetes API error (%d %s): %s", e.Code, e.Reason, e.Message)
+}
+
+// isKubeStatus returns whether the error is a kubeStatusError with the status code.
+func isKubeStatus(err error, code int) bool {
+	var se *kubeStatusError
+	return errors.As(err, &se) && se.Code == code
+}
+
+// do makes a request to the API server. The body, if any, is sent as JSON, and the response is decoded into out, if it isn't nil.
+func (k *kubeClient) do(ctx context.Context, method, path, contentType string, body, out any) error {
+	resp, err := k.request(ctx, method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// stream makes a GET request to the API server, and returns the body of the response for the caller to read and close.
+func (k *kubeClient) stream(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := k.request(ctx, http.MethodGet, path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (k *kubeClient) request(ctx context.Context, method, path, contentType string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.server+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	// The token is read for every request, because the token of a service account is rotated.
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the token for the API server: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		se := &kubeStatusError{Code: resp.StatusCode}
+		if err = json.NewDecoder(resp.Body).Decode(se); err != nil || se.Message == "" {
+			se.Message = http.StatusText(resp.StatusCode)
+		}
+		se.Code = resp.StatusCode
+		return nil, se
+	}
+
+	return resp, nil
+}
+
+// kubePod is the part of a pod that the backend uses.
+type kubePod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Phase                 string                `json:"phase"`
+		Message               string                `json:"message"`
+		InitContainerStatuses []kubeContainerStatus `json:"initContainerStatuses"`
+		ContainerStatuses     []kubeContainerStatus `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+type kubeContainerStatus struct {
+	Name  string `json:"name"`
+	State struct {
+		Waiting *struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"waiting"`
+		Running    *struct{}       `json:"running"`
+		Terminated *kubeTerminated `json:"terminated"`
+	} `json:"state"`
+}
+
+// kubeTerminated is how a container exited.
+type kubeTerminated struct {
+	ExitCode int    `json:"exitCode"`
+	Reason   string `json:"reason"`
+	Message  string `json:"message"`
+}
+
+// container returns the status of the container of the pod, which is nil if the pod has no status for it yet.
+func (p kubePod) container(name string) *kubeContainerStatus {
+	for _, statuses := range [][]kubeContainerStatus{p.Status.InitContainerStatuses, p.Status.ContainerStatuses} {
+		for i := range statuses {
+			if statuses[i].Name == name {
+				return &statuses[i]
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// kubeIODir is where the pipes of the output and events of gptscript are, in the pods of runs.
+	kubeIODir = "/run/clicky-serves/io"
+	// kubeToolDir is where the tool that a run reads from its standard input is mounted, in the pods of runs.
+	kubeToolDir = "/run/clicky-serves/tool"
+	kubeToolKey = "tool.gpt"
+
+	// kubePollInterval is how often the pod of a run is checked while waiting for it to start and to finish.
+	kubePollInterval = time.Second
+	// kubeDrainTimeout is how long the output and events of a pod can take to end after gptscript exits.
+	kubeDrainTimeout = 10 * time.Second
+	// kubeDeleteTimeout is how long deleting the Job of a run can take.
+	kubeDeleteTimeout = 30 * time.Second
+	// kubeJobTTL is how long a finished Job is kept if the server doesn't delete it, like when the server stops during the run.
+	kubeJobTTL = 10 * time.Minute
+
+	kubeContainerGPTScript = "gptscript"
+	kubeContainerOutput    = "output"
+	kubeContainerEvents    = "events"
+	kubeContainerPipes     = "pipes"
+)
+
+// kubeFatalReasons are the reasons that a container is waiting to start that it won't recover from.
+var kubeFatalReasons = []string{"ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CreateContainerError"}
+
+// KubernetesConfig configures the Kubernetes backend.
+type KubernetesConfig struct {
+	// APIServer is the URL of the API server, with TokenFile and CAFile being the files of the bearer token and the CA that the
+	// server is verified with. If the API server isn't set, then the cluster that the server runs in is used, with the credentials
+	// of its service account.
+	APIServer string
+	TokenFile string
+	CAFile    string
+
+	// Namespace is the namespace of the Jobs. It defaults to the namespace of the server, or to default.
+	Namespace string
+	// Image is the image of gptscript, which must have gptscript on its PATH.
+	Image string
+	// HelperImage is the image of the containers that pass the output and events of gptscript back to the server, which must
+	// have mkfifo and cat. It defaults to busybox.
+	HelperImage string
+
+	// CPURequest, MemoryRequest, CPULimit, and MemoryLimit are the resources of the gptscript container, like "500m" and "512Mi".
+	CPURequest    string
+	MemoryRequest string
+	CPULimit      string
+	MemoryLimit   string
+
+	// ServiceAccount is the service account of the pods. If it isn't set, then the pods get no credentials for the cluster.
+	ServiceAccount string
+	// Env are patterns, in the syntax of path.Match, of the environment variables of the server that are passed to the pods.
+	// The environment variables of runs are always passed.
+	Env []string
+}
+
+// Kubernetes is a Backend that runs each gptscript process as a Kubernetes Job, so that runs are spread across a cluster.
+//
+// The logs of a pod can't tell stdout from stderr, so gptscript writes its output and events to named pipes, which helper
+// containers in the same pod copy to their logs. The logs of each container are then streamed back to the server. The environment
+// variables of a run and the tool that it reads from its standard input are kept in a Secret, which is deleted with the Job.
+// Files are resolved in the pod, so the files that runs use must be in the image or be URLs.
+type Kubernetes struct {
+	config KubernetesConfig
+	client *kubeClient
+}
+
+// NewKubernetes returns a Kubernetes backend. The credentials of the API server are read, but no requests are made.
+func NewKubernetes(config KubernetesConfig) (*Kubernetes, error) {
+	if config.Image == "" {
+		return nil, errors.New("the image of gptscript is not set")
+	}
+
+	client, err := newKubeClient(config.APIServer, config.TokenFile, config.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Namespace == "" {
+		config.Namespace = "default"
+		if ns, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil && config.APIServer == "" {
+			config.Namespace = strings.TrimSpace(string(ns))
+		}
+	}
+	if config.HelperImage == "" {
+		config.HelperImage = "busybox"
+	}
+
+	return &Kubernetes{config: config, client: client}, nil
+}
+
+func (k *Kubernetes) Start(ctx context.Context, p Process) (func() error, error) {
+	name, err := containerName()
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"--output=" + kubeIODir + "/" + kubeContainerOutput}, p.Args...)
+	if p.Events != nil {
+		args = append([]string{"--events-stream-to=" + kubeIODir + "/" + kubeContainerEvents}, args...)
+	}
+
+	secret := make(map[string]string)
+	if p.Stdin != nil {
+		tool, err := io.ReadAll(p.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tool: %w", err)
+		}
+
+		// A Job has no standard input, so gptscript reads the tool, or the input of a file, from the Secret instead. This limits the
+		// input to the size of a Secret.
+		secret[kubeToolKey] = string(tool)
+		if i := slices.Index(args, "-"); i >= 0 {
+			args[i] = kubeToolDir + "/" + kubeToolKey
+		} else if i = slices.Index(args, "--input=-"); i >= 0 {
+			args[i] = "--input=" + kubeToolDir + "/" + kubeToolKey
+		}
+	}
+
+	values := make(map[string]string)
+	for _, kv := range append(os.Environ(), p.Env...) {
+		name, value, _ := strings.Cut(kv, "=")
+		values[name] = value
+	}
+
+	// The values are kept in the Secret, so that they aren't visible to those who can read the Job.
+	var env []map[string]any
+	for i, envName := range envNames(k.config.Env, p.Env) {
+		key := fmt.Sprintf("env-%d", i)
+		secret[key] = values[envName]
+		env = append(env, map[string]any{
+			"name":      envName,
+			"valueFrom": map[string]any{"secretKeyRef": map[string]any{"name": name, "key": key}},
+		})
+	}
+
+	if err = k.client.do(ctx, http.MethodPost, k.path("/api/v1", "secrets"), "application/json", map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]any{"name": name, "labels": kubeLabels()},
+		"type":       "Opaque",
+		"stringData": secret,
+	}, nil); err != nil {
+		return nil, fmt.Errorf("failed to create the secret of the run: %w", err)
+	}
+
+	var job struct {
+		Metadata struct {
+			UID string `json:"uid"`
+		} `json:"metadata"`
+	}
+	if err = k.client.do(ctx, http.MethodPost, k.path("/apis/batch/v1", "jobs"), "application/json", k.job(ctx, name, args, env, p.Events != nil), &job); err != nil {
+		k.delete(name)
+		return nil, fmt.Errorf("failed to create the job of the run: %w", err)
+	}
+
+	// The Secret is owned by the Job, so that it is deleted along with the Job if the server doesn't delete it.
+	_ = k.client.do(ctx, http.MethodPatch, k.path("/api/v1", "secrets", name), "application/merge-patch+json", map[string]any{
+		"metadata": map[string]any{"ownerReferences": []map[string]any{{
+			"apiVersion": "batch/v1",
+			"kind":       "Job",
+			"name":       name,
+			"uid":        job.Metadata.UID,
+		}}},
+	}, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		defer k.delete(name)
+		done <- k.run(ctx, name, p)
+	}()
+
+	return func() error { return <-done }, nil
+}
+
+// run streams the output of the pod of the Job to the process until gptscript exits, and returns the error of gptscript.
+func (k *Kubernetes) run(ctx context.Context, job string, p Process) error {
+	pod, err := k.waitForStart(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	streamCtx, cancelStreams := context.WithCancel(ctx)
+	defer cancelStreams()
+
+	streams := map[string]io.Writer{kubeContainerOutput: p.Stdout}
+	if p.Events != nil {
+		streams[kubeContainerEvents] = p.Events
+	}
+
+	wg := new(sync.WaitGroup)
+	for container, w := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k.streamLogs(streamCtx, pod, container, w)
+		}()
+	}
+
+	// The output of gptscript is written to its pipe, so the logs of the gptscript container are its standard error.
+	k.streamLogs(ctx, pod, kubeContainerGPTScript, p.Stderr)
+
+	exit, err := k.waitForExit(ctx, pod)
+	if err != nil {
+		return err
+	}
+
+	// The helper containers reach the end of the pipes when gptscript closes them. If gptscript exited without opening them, then
+	// the helpers never do, so the output is cut off shortly after gptscript exits.
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(kubeDrainTimeout):
+		cancelStreams()
+		<-drained
+	}
+
+	if exit.ExitCode != 0 {
+		return fmt.Errorf("gptscript exited with code %d: %s", exit.ExitCode, strings.TrimSpace(exit.Reason+" "+exit.Message))
+	}
+	return nil
+}
+
+// waitForStart waits until the gptscript container of the pod of the Job has started, and returns the name of the pod.
+func (k *Kubernetes) waitForStart(ctx context.Context, job string) (string, error) {
+	for {
+		var pods struct {
+			Items []kubePod `json:"items"`
+		}
+		if err := k.client.do(ctx, http.MethodGet, k.path("/api/v1", "pods")+"?labelSelector="+url.QueryEscape("job-name="+job), "", nil, &pods); err != nil {
+			return "", fmt.Errorf("failed to get the pod of the run: %w", err)
+		}
+
+		if len(pods.Items) > 0 {
+			pod := pods.Items[0]
+			for _, statuses := range [][]kubeContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+				for _, s := range statuses {
+					if s.State.Waiting != nil && slices.Contains(kubeFatalReasons, s.State.Waiting.Reason) {
+						return "", fmt.Errorf("container %s of the run can't start: %s: %s", s.Name, s.State.Waiting.Reason, s.State.Waiting.Message)
+					}
+				}
+			}
+
+			if s := pod.container(kubeContainerGPTScript); s != nil && (s.State.Running != nil || s.State.Terminated != nil) {
+				return pod.Metadata.Name, nil
+			}
+			if pod.Status.Phase == "Failed" {
+				return "", fmt.Errorf("the pod of the run failed: %s", pod.Status.Message)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(kubePollInterval):
+		}
+	}
+}
+
+// waitForExit waits until the gptscript container of the pod has exited, and returns how it exited.
+func (k *Kubernetes) waitForExit(ctx context.Context, pod string) (*kubeTerminated, error) {
+	for {
+		var p kubePod
+		if err := k.client.do(ctx, http.MethodGet, k.path("/api/v1", "pods", pod), "", nil, &p); err != nil {
+			return nil, fmt.Errorf("failed to get the pod of the run: %w", err)
+		}
+
+		if s := p.container(kubeContainerGPTScript); s != nil && s.State.Terminated != nil {
+			return s.State.Terminated, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(kubePollInterval):
+		}
+	}
+}
+
+// streamLogs copies the logs of the container of the pod to w, until the container exits or the context is done.
+func (k *Kubernetes) streamLogs(ctx context.Context, pod, container string, w io.Writer) {
+	for {
+		logs, err := k.client.stream(ctx, k.path("/api/v1", "pods", pod, "log")+"?follow=true&container="+url.QueryEscape(container))
+		if err == nil {
+			_, _ = io.Copy(w, logs)
+			_ = logs.Close()
+			return
+		}
+
+		// The logs of a container that hasn't started yet are a bad request, so they are requested again until it starts.
+		if !isKubeStatus(err, http.StatusBadRequest) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(kubePollInterval):
+		}
+	}
+}
+
+// Ping checks that the API server is reachable and that the server can list the Jobs of runs in the namespace of the backend.
+func (k *Kubernetes) Ping(ctx context.Context) error {
+	if err := k.client.do(ctx, http.MethodGet, k.path("/apis/batch/v1", "jobs")+"?limit=1", "", nil, nil); err != nil {
+		return fmt.Errorf("failed to list the jobs of runs: %w", err)
+	}
+	return nil
+}
+
+// delete deletes the Job of a run, along with its pod and Secret.
+func (k *Kubernetes) delete(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeDeleteTimeout)
+	defer cancel()
+
+	_ = k.client.do(ctx, http.MethodDelete, k.path("/apis/batch/v1", "jobs", name)+"?propagationPolicy=Background", "", nil, nil)
+	_ = k.client.do(ctx, http.MethodDelete, k.path("/api/v1", "secrets", name), "", nil, nil)
+}
+
+// job returns the Job of a run. If the context has a deadline, then the Job is stopped by Kubernetes at the deadline, in case the
+// server doesn't stop it.
+func (k *Kubernetes) job(ctx context.Context, name string, args []string, env []map[string]any, events bool) map[string]any {
+	ioMount := map[string]any{"name": "io", "mountPath": kubeIODir}
+	restricted := map[string]any{
+		"allowPrivilegeEscalation": false,
+		"capabilities":             map[string]any{"drop": []string{"ALL"}},
+	}
+
+	pipes := []string{kubeIODir + "/" + kubeContainerOutput}
+	helpers := []string{kubeContainerOutput}
+	if events {
+		pipes = append(pipes, kubeIODir+"/"+kubeContainerEvents)
+		helpers = append(helpers, kubeContainerEvents)
+	}
+
+	resources := map[string]map[string]string{"requests": {}, "limits": {}}
+	for _, r := range []struct{ kind, name, value string }{
+		{"requests", "cpu", k.config.CPURequest},
+		{"requests", "memory", k.config.MemoryRequest},
+		{"limits", "cpu", k.config.CPULimit},
+		{"limits", "memory", k.config.MemoryLimit},
+	} {
+		if r.value != "" {
+			resources[r.kind][r.name] = r.value
+		}
+	}
+
+	containers := []map[string]any{{
+		"name":            kubeContainerGPTScript,
+		"image":           k.config.Image,
+		"command":         []string{"gptscript"},
+		"args":            args,
+		"env":             env,
+		"resources":       resources,
+		"securityContext": restricted,
+		"volumeMounts": []map[string]any{
+			ioMount,
+			{"name": "tool", "mountPath": kubeToolDir, "readOnly": true},
+		},
+	}}
+	for _, helper := range helpers {
+		containers = append(containers, map[string]any{
+			"name":            helper,
+			"image":           k.config.HelperImage,
+			"command":         []string{"cat", kubeIODir + "/" + helper},
+			"securityContext": restricted,
+			"volumeMounts":    []map[string]any{ioMount},
+		})
+	}
+
+	podSpec := map[string]any{
+		"restartPolicy":                "Never",
+		"automountServiceAccountToken": k.config.ServiceAccount != "",
+		"initContainers": []map[string]any{{
+			"name":            kubeContainerPipes,
+			"image":           k.config.HelperImage,
+			"command":         append([]string{"mkfifo", "-m", "666"}, pipes...),
+			"securityContext": restricted,
+			"volumeMounts":    []map[string]any{ioMount},
+		}},
+		"containers": containers,
+		"volumes": []map[string]any{
+			{"name": "io", "emptyDir": map[string]any{}},
+			{"name": "tool", "secret": map[string]any{
+				"secretName": name,
+				"items":      []map[string]any{{"key": kubeToolKey, "path": kubeToolKey}},
+				// Runs of files have no tool in the Secret.
+				"optional": true,
+			}},
+		},
+	}
+	if k.config.ServiceAccount != "" {
+		podSpec["serviceAccountName"] = k.config.ServiceAccount
+	}
+
+	spec := map[string]any{
+		"backoffLimit":            0,
+		"ttlSecondsAfterFinished": int(kubeJobTTL.Seconds()),
+		"template": map[string]any{
+			"metadata": map[string]any{"labels": kubeLabels()},
+			"spec":     podSpec,
+		},
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		spec["activeDeadlineSeconds"] = max(1, int(math.Ceil(time.Until(deadline).Seconds())))
+	}
+
+	return map[string]any{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   map[string]any{"name": name, "labels": kubeLabels()},
+		"spec":       spec,
+	}
+}
+
+// path returns the path of the resource in the namespace of the backend, under the prefix of its API group.
+func (k *Kubernetes) path(prefix, resource string, names ...string) string {
+	p := prefix + "/namespaces/" + url.PathEscape(k.config.Namespace) + "/" + resource
+	for _, n := range names {
+		p += "/" + url.PathEscape(n)
+	}
+	return p
+}
+
+func kubeLabels() map[string]string {
+	return map[string]string{"app.kubernetes.io/managed-by": "clicky-serves"}
+}
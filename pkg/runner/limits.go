@@ -0,0 +1,59 @@
+package runner
+
+import (
+	"fmt"
+	"time"
+)
+
+// The resources that a process can exceed the limit of.
+const (
+	ResourceCPUTime   = "cpu_time"
+	ResourceMemory    = "memory"
+	ResourceProcesses = "processes"
+)
+
+// Limits are the resources that a process on the host, together with the processes that it starts, can use before they are all
+// killed. A limit of 0 means no limit. The limits are only enforced on Linux, where LimitsSupported is true.
+type Limits struct {
+	// CPUTime is the CPU time that the processes can use together.
+	CPUTime time.Duration
+	// Memory is the resident memory in bytes that the processes can use together.
+	Memory int64
+	// Processes is the number of processes that can run at once, including the first one.
+	Processes int
+}
+
+func (l Limits) enabled() bool {
+	return l.CPUTime > 0 || l.Memory > 0 || l.Processes > 0
+}
+
+// LimitError is the error of a process that was killed because it, or the processes that it started, exceeded one of its limits.
+type LimitError struct {
+	// Resource is the resource that was exceeded: ResourceCPUTime, ResourceMemory, or ResourceProcesses.
+	Resource string
+	// Limit is the limit of the resource, in the form that it is reported in.
+	Limit string
+	// Err is the error that waiting for the killed process returned.
+	Err error
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("the run exceeded its %s limit of %s and was killed", e.Resource, e.Limit)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// exceeded returns the error for the first limit that the usage exceeds, or nil if it is within the limits.
+func (l Limits) exceeded(cpuTime time.Duration, memory int64, processes int) *LimitError {
+	switch {
+	case l.CPUTime > 0 && cpuTime > l.CPUTime:
+		return &LimitError{Resource: ResourceCPUTime, Limit: l.CPUTime.String()}
+	case l.Memory > 0 && memory > l.Memory:
+		return &LimitError{Resource: ResourceMemory, Limit: fmt.Sprintf("%d bytes", l.Memory)}
+	case l.Processes > 0 && processes > l.Processes:
+		return &LimitError{Resource: ResourceProcesses, Limit: fmt.Sprint(l.Processes)}
+	}
+	return nil
+}
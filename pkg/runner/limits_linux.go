@@ -0,0 +1,140 @@
+package runner
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// LimitsSupported is whether the limits of processes are enforced on this platform.
+const LimitsSupported = true
+
+const (
+	// limitsInterval is how often the usage of a process and the processes that it started is checked against its limits.
+	limitsInterval = 250 * time.Millisecond
+	// clockTicks is the number of clock ticks per second that the CPU times in /proc are counted in, which is 100 on Linux on all
+	// architectures.
+	clockTicks = 100
+)
+
+// procStat is the part of /proc/[pid]/stat that the limits are checked with.
+type procStat struct {
+	ppid    int
+	cpuTime time.Duration
+	rss     int64
+}
+
+// watchLimits checks the usage of the process and of the processes that it started until done is closed. Once they exceed one of
+// the limits, it sends the error to the returned channel and kills all of them. Usage isn't sampled more often than every
+// limitsInterval, so processes can briefly exceed their limits before they are killed.
+func watchLimits(pid int, limits Limits, done <-chan struct{}) <-chan *LimitError {
+	exceeded := make(chan *LimitError, 1)
+	go func() {
+		ticker := time.NewTicker(limitsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			tree := processTree(pid)
+			if len(tree) == 0 {
+				return
+			}
+
+			var (
+				cpuTime time.Duration
+				memory  int64
+			)
+			for _, stat := range tree {
+				cpuTime += stat.cpuTime
+				memory += stat.rss
+			}
+
+			if le := limits.exceeded(cpuTime, memory, len(tree)); le != nil {
+				// The error is sent before the processes are killed, so that it is there once waiting for the process returns.
+				exceeded <- le
+				for p := range tree {
+					_ = syscall.Kill(p, syscall.SIGKILL)
+				}
+				return
+			}
+		}
+	}()
+	return exceeded
+}
+
+// processTree returns the stats of the process and of all of the processes that it started, by their PIDs.
+func processTree(pid int) map[int]procStat {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	stats := make(map[int]procStat, len(entries))
+	for _, e := range entries {
+		p, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if stat, ok := readProcStat(p); ok {
+			stats[p] = stat
+		}
+	}
+
+	tree := make(map[int]procStat)
+	if stat, ok := stats[pid]; ok {
+		tree[pid] = stat
+	}
+	// The processes are added until no more children of the processes in the tree are found, since their PIDs aren't ordered by
+	// when they were started.
+	for added := len(tree) > 0; added; {
+		added = false
+		for p, stat := range stats {
+			if _, ok := tree[p]; !ok {
+				if _, ok = tree[stat.ppid]; ok {
+					tree[p] = stat
+					added = true
+				}
+			}
+		}
+	}
+	return tree
+}
+
+// readProcStat reads the parent, the CPU time, including that of the children that were waited for, and the resident memory of
+// the process.
+func readProcStat(pid int) (procStat, bool) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return procStat{}, false
+	}
+
+	// The name of the command is in parentheses and can have spaces and parentheses in it, so the fields after it are found from
+	// the last closing parenthesis.
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return procStat{}, false
+	}
+	fields := bytes.Fields(data[i+1:])
+	if len(fields) < 22 {
+		return procStat{}, false
+	}
+
+	field := func(n int) int64 {
+		v, _ := strconv.ParseInt(string(fields[n]), 10, 64)
+		return v
+	}
+
+	ticks := field(11) + field(12) + field(13) + field(14)
+	return procStat{
+		ppid:    int(field(1)),
+		cpuTime: time.Duration(ticks) * time.Second / clockTicks,
+		rss:     field(21) * int64(os.Getpagesize()),
+	}, true
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package runner
+
+// LimitsSupported is whether the limits of processes are enforced on this platform.
+const LimitsSupported = false
+
+// watchLimits doesn't enforce the limits on this platform, so it never reports that they were exceeded.
+func watchLimits(int, Limits, <-chan struct{}) <-chan *LimitError {
+	return nil
+}
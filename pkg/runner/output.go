@@ -0,0 +1,117 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// OutputLimitError is the error of a process that was stopped because its output was larger than the max output size of its
+// options. The output that was read before the limit was reached is kept, and the rest of it is dropped.
+type OutputLimitError struct {
+	// Limit is the max output size in bytes.
+	Limit int64
+	// Err is the error that waiting for the stopped process returned.
+	Err error
+}
+
+func (e *OutputLimitError) Error() string {
+	return fmt.Sprintf("the output of the run exceeded its limit of %d bytes, so it was truncated and the run was stopped", e.Limit)
+}
+
+func (e *OutputLimitError) Unwrap() error {
+	return e.Err
+}
+
+// outputLimit counts the bytes that are read from all of the outputs of a process together, and stops the process once more than
+// the limit is read. A nil outputLimit doesn't limit anything.
+type outputLimit struct {
+	limit int64
+	stop  context.CancelFunc
+	// onExceeded is called once the limit is exceeded, to end the reads of the outputs that are waiting for more output.
+	onExceeded func()
+
+	lock     sync.Mutex
+	read     int64
+	exceeded bool
+}
+
+// limitOutput returns the context to start a process with, which is canceled to stop the process once its output exceeds the limit,
+// and the limit to read the outputs of the process through. Once the limit is exceeded, onExceeded is called too, since the
+// processes that the process started can keep its outputs open after it is stopped. If the limit is 0, then the output isn't
+// limited.
+func limitOutput(ctx context.Context, limit int64, onExceeded func()) (context.Context, *outputLimit) {
+	if limit <= 0 {
+		return ctx, nil
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	return ctx, &outputLimit{limit: limit, stop: stop, onExceeded: onExceeded}
+}
+
+// reader returns a reader of r that ends once the limit is exceeded, with the part of the last read that fit in the limit.
+func (o *outputLimit) reader(r io.Reader) io.Reader {
+	if o == nil {
+		return r
+	}
+	return &limitedReader{limit: o, r: r}
+}
+
+// take counts n more bytes, and returns how many of them fit in the limit. The process is stopped once they don't all fit.
+func (o *outputLimit) take(n int) (int, bool) {
+	o.lock.Lock()
+	if o.exceeded {
+		o.lock.Unlock()
+		return 0, false
+	}
+	if o.read+int64(n) <= o.limit {
+		o.read += int64(n)
+		o.lock.Unlock()
+		return n, true
+	}
+
+	allowed := int(o.limit - o.read)
+	o.read = o.limit
+	o.exceeded = true
+	o.lock.Unlock()
+
+	// The reads that onExceeded ends call take again, so it is called without the lock.
+	o.stop()
+	o.onExceeded()
+	return allowed, false
+}
+
+// done releases the context of the process once it has exited, and returns the error of waiting for it, which is an
+// OutputLimitError if the limit was exceeded.
+func (o *outputLimit) done(err error) error {
+	if o == nil {
+		return err
+	}
+
+	o.stop()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.exceeded {
+		return &OutputLimitError{Limit: o.limit, Err: err}
+	}
+	return err
+}
+
+type limitedReader struct {
+	limit *outputLimit
+	r     io.Reader
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if _, ok := l.limit.take(0); !ok {
+		return 0, io.EOF
+	}
+
+	// A read that fails because the limit was exceeded while it waited ends the output too.
+	n, err := l.r.Read(p)
+	if n, ok := l.limit.take(n); !ok {
+		return n, io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,303 @@
+// Package runner starts gptscript processes in the same way as the gptscript SDK, but gives the server control over the
+// environment of each process.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gptscript-ai/go-gptscript"
+)
+
+// Options are the gptscript options of a run, along with the options of the process that runs it.
+type Options struct {
+	gptscript.Opts
+
+	// Env is added to the environment of the server to make up the environment of the process.
+	Env []string
+
+	// Backend starts the process. If it is nil, then the process runs on the host.
+	Backend Backend
+
+	// Started is called with the PID of the process once it has started, if the backend runs it on the host.
+	Started func(pid int)
+
+	// Limits are the resources that the process can use before it is killed, if it runs on the host.
+	Limits Limits
+
+	// MaxOutput is the number of bytes that can be read from the stdout, the stderr, and the events of a process that is streamed,
+	// together, before the process is stopped and its output is truncated. If it is 0, then the output isn't limited.
+	MaxOutput int64
+
+	// Stdin is read as the input of a file that is run, in place of the input argument, so that inputs that are too large for an
+	// argument are streamed to the process. It can only be read once.
+	Stdin io.Reader
+
+	// ChatState is the state of a chat to continue, or "null" to start a new chat. When it is set, the output of the process is
+	// the chat response, which includes the state to continue the chat with.
+	ChatState string
+}
+
+func (o Options) toArgs() []string {
+	var args []string
+	if o.DisableCache {
+		args = append(args, "--disable-cache")
+	}
+	if o.CacheDir != "" {
+		args = append(args, "--cache-dir="+o.CacheDir)
+	}
+	if o.Chdir != "" {
+		args = append(args, "--chdir="+o.Chdir)
+	}
+	if o.SubTool != "" {
+		args = append(args, "--sub-tool="+o.SubTool)
+	}
+	if o.ChatState != "" {
+		args = append(args, "--chat-state="+o.ChatState)
+	}
+	return append(args, "--quiet="+fmt.Sprint(o.Quiet))
+}
+
+// ExecTool will execute a tool. The tool must be a fmt.Stringer, and the string should be a valid gptscript file.
+func ExecTool(ctx context.Context, opts Options, tools ...fmt.Stringer) (string, error) {
+	return run(ctx, opts, strings.NewReader(concatTools(tools)), append(opts.toArgs(), "-"))
+}
+
+// ExecFile will execute the file at the given path with the given input.
+// The file at the path should be a valid gptscript file.
+// The input should be command line arguments in the form of a string (i.e. "--arg1 value1 --arg2 value2").
+func ExecFile(ctx context.Context, toolPath, input string, opts Options) (string, error) {
+	stdin, args := fileArgs(opts, toolPath, input)
+	return run(ctx, opts, stdin, args)
+}
+
+// StreamExecTool will execute a tool. The tool must be a fmt.Stringer, and the string should be a valid gptscript file.
+// This returns two io.Readers, one for stdout and one for stderr, and a function to wait for the process to exit.
+// Reading from stdOut and stdErr should be completed before calling the wait function.
+func StreamExecTool(ctx context.Context, opts Options, tools ...fmt.Stringer) (io.Reader, io.Reader, func() error) {
+	stdout, stderr, _, wait := stream(ctx, opts, strings.NewReader(concatTools(tools)), false, append(opts.toArgs(), "-"))
+	return stdout, stderr, wait
+}
+
+// StreamExecFile will execute the file at the given path with the given input.
+// This returns two io.Readers, one for stdout and one for stderr, and a function to wait for the process to exit.
+// Reading from stdOut and stdErr should be completed before calling the wait function.
+func StreamExecFile(ctx context.Context, toolPath, input string, opts Options) (io.Reader, io.Reader, func() error) {
+	stdin, args := fileArgs(opts, toolPath, input)
+	stdout, stderr, _, wait := stream(ctx, opts, stdin, false, args)
+	return stdout, stderr, wait
+}
+
+// StreamExecToolWithEvents will execute a tool. The tool must be a fmt.Stringer, and the string should be a valid gptscript file.
+// This returns three io.Readers, one for stdout, one for stderr, and one for events, and a function to wait for the process to exit.
+// Reading from stdOut, stdErr, and events should be completed before calling the wait function.
+func StreamExecToolWithEvents(ctx context.Context, opts Options, tools ...fmt.Stringer) (io.Reader, io.Reader, io.Reader, func() error) {
+	return stream(ctx, opts, strings.NewReader(concatTools(tools)), true, append(opts.toArgs(), "-"))
+}
+
+// StreamExecFileWithEvents will execute the file at the given path with the given input.
+// This returns three io.Readers, one for stdout, one for stderr, and one for events, and a function to wait for the process to exit.
+// Reading from stdOut, stdErr, and events should be completed before calling the wait function.
+func StreamExecFileWithEvents(ctx context.Context, toolPath, input string, opts Options) (io.Reader, io.Reader, io.Reader, func() error) {
+	stdin, args := fileArgs(opts, toolPath, input)
+	return stream(ctx, opts, stdin, true, args)
+}
+
+// StreamExecToolInputWithEvents is StreamExecToolWithEvents, but also passes the input to the tool, which is needed to
+// send a message to a chat.
+func StreamExecToolInputWithEvents(ctx context.Context, input string, opts Options, tools ...fmt.Stringer) (io.Reader, io.Reader, io.Reader, func() error) {
+	return stream(ctx, opts, strings.NewReader(concatTools(tools)), true, withInput(append(opts.toArgs(), "-"), input))
+}
+
+// Parse will parse the given file into an array of Nodes.
+func Parse(ctx context.Context, fileName string, opts Options) ([]gptscript.Node, error) {
+	return parse(ctx, opts, nil, append(opts.toArgs(), "parse", fileName))
+}
+
+// ParseTool will parse the given string into a tool.
+func ParseTool(ctx context.Context, input string, opts Options) ([]gptscript.Node, error) {
+	return parse(ctx, opts, strings.NewReader(input), []string{"parse", "-"})
+}
+
+// Version returns the output of gptscript --version.
+func Version(ctx context.Context, opts Options) (string, error) {
+	return run(ctx, opts, nil, []string{"--version"})
+}
+
+// ListTools returns the built-in tools of gptscript, in the text format of gptscript.
+func ListTools(ctx context.Context, opts Options) (string, error) {
+	return run(ctx, opts, nil, append(opts.toArgs(), "--list-tools"))
+}
+
+// ListModels returns the models that gptscript can use with the provider of its environment.
+func ListModels(ctx context.Context, opts Options) ([]string, error) {
+	out, err := run(ctx, opts, nil, append(opts.toArgs(), "--list-models"))
+	if err != nil {
+		return nil, err
+	}
+
+	var models []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			models = append(models, line)
+		}
+	}
+	return models, nil
+}
+
+// Fmt formats the nodes as the canonical gptscript text, the reverse of parsing it.
+func Fmt(ctx context.Context, nodes []gptscript.Node, opts Options) (string, error) {
+	b, err := json.Marshal(gptscript.Document{Nodes: nodes})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal nodes: %w", err)
+	}
+
+	return run(ctx, opts, bytes.NewReader(b), []string{"fmt", "-"})
+}
+
+// CommandError is the error of a gptscript process that failed, with what it wrote to its standard error.
+type CommandError struct {
+	Stderr string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("failed to wait for command, stderr: %s: %v", e.Stderr, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// run runs the process to completion and returns its stdout.
+func run(ctx context.Context, opts Options, stdin io.Reader, args []string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	wait, err := opts.backend().Start(ctx, Process{Args: args, Env: opts.Env, Stdin: stdin, Stdout: &stdout, Stderr: &stderr, Started: opts.Started, Limits: opts.Limits})
+	if err != nil {
+		return "", fmt.Errorf("failed to start command: %w", err)
+	}
+
+	if err = wait(); err != nil {
+		return "", &CommandError{Stderr: stderr.String(), Err: err}
+	}
+
+	return stdout.String(), nil
+}
+
+// stream starts the process and returns readers of its output, which end once the process has exited, and a function that waits
+// for the process to exit. The events reader is always at EOF if the events aren't streamed.
+func stream(ctx context.Context, opts Options, stdin io.Reader, withEvents bool, args []string) (io.Reader, io.Reader, io.Reader, func() error) {
+	// The output is written to OS pipes, rather than io.Pipes, so that it is buffered while another stream is being read.
+	var reads, writes []*os.File
+	for range 3 {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeAll(reads, writes)
+			return new(reader), new(reader), new(reader), func() error { return err }
+		}
+		reads, writes = append(reads, r), append(writes, w)
+	}
+
+	p := Process{Args: args, Env: opts.Env, Stdin: stdin, Stdout: writes[0], Stderr: writes[1], Started: opts.Started, Limits: opts.Limits}
+	var events io.Reader = new(reader)
+	if withEvents {
+		events, p.Events = reads[2], writes[2]
+	}
+
+	ctx, limit := limitOutput(ctx, opts.MaxOutput, func() { closeAll(reads) })
+	wait, err := opts.backend().Start(ctx, p)
+	if err != nil {
+		_ = limit.done(nil)
+		closeAll(reads, writes)
+		return new(reader), new(reader), new(reader), func() error { return err }
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := wait()
+		// All of the output has been written once the process has been waited for, so the readers can end.
+		closeAll(writes)
+		done <- limit.done(err)
+	}()
+
+	return limit.reader(reads[0]), limit.reader(reads[1]), limit.reader(events), func() error {
+		err := <-done
+		closeAll(reads)
+		return err
+	}
+}
+
+func closeAll(files ...[]*os.File) {
+	for _, fs := range files {
+		for _, f := range fs {
+			_ = f.Close()
+		}
+	}
+}
+
+func parse(ctx context.Context, opts Options, stdin io.Reader, args []string) ([]gptscript.Node, error) {
+	output, err := run(ctx, opts, stdin, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc gptscript.Document
+	if err = json.Unmarshal([]byte(output), &doc); err != nil {
+		return nil, err
+	}
+
+	return doc.Nodes, nil
+}
+
+// fileArgs returns the standard input and the arguments of the process that runs the file. If the options have a standard input,
+// then gptscript reads the input of the file from it instead of from the input argument.
+func fileArgs(opts Options, toolPath, input string) (io.Reader, []string) {
+	if opts.Stdin != nil {
+		return opts.Stdin, append(opts.toArgs(), "--input=-", toolPath)
+	}
+	return nil, withInput(append(opts.toArgs(), toolPath), input)
+}
+
+func withInput(args []string, input string) []string {
+	if input != "" {
+		args = append(args, input)
+	}
+	return args
+}
+
+func concatTools(tools []fmt.Stringer) string {
+	var sb strings.Builder
+	for i, tool := range tools {
+		sb.WriteString(tool.String())
+		if i < len(tools)-1 {
+			sb.WriteString("\n---\n")
+		}
+	}
+	return sb.String()
+}
+
+// LookPath returns the path of the gptscript binary that processes are started with.
+func LookPath() (string, error) {
+	return exec.LookPath(getCommand())
+}
+
+func getCommand() string {
+	if gptScriptBin := os.Getenv("GPTSCRIPT_BIN"); gptScriptBin != "" {
+		return gptScriptBin
+	}
+
+	return "gptscript"
+}
+
+// reader is an io.Reader that is always at EOF. It is returned in place of the output of a process that couldn't be started.
+type reader struct{}
+
+func (r reader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,242 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// fileMagic starts the header of every credentials file but those of the first version, which started with the nonce and
+	// were encrypted with the SHA-256 of the passphrase.
+	fileMagic   = "CSCF"
+	fileVersion = 1
+	saltSize    = 16
+	headerSize  = len(fileMagic) + 4 + saltSize
+
+	// The parameters of scrypt are kept in the header of each file, so that they can be raised without breaking existing files.
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+	// maxScryptLogN keeps a file from making the server spend too much memory on deriving its key.
+	maxScryptLogN = 20
+)
+
+// File is a Store that keeps credentials in a file that is encrypted with AES-256-GCM. The credentials are kept in memory as well,
+// and the whole file is written again whenever a credential changes.
+//
+// The file starts with a header of the magic CSCF, the version of the format, the scrypt parameters log2(N), r, and p, each in a
+// byte, and the salt of the key, which is followed by the nonce and the encrypted credentials. The header is authenticated along
+// with the credentials.
+type File struct {
+	*Memory
+	path   string
+	header []byte
+	aead   cipher.AEAD
+}
+
+// NewFile returns a Store that keeps credentials in the file at the path, encrypted with a key that is derived from the passphrase
+// with scrypt. The credentials in the file are loaded, so the passphrase must be the one that the file was written with. Files
+// of the first version of the format are written again in the current version once they are loaded.
+func NewFile(path, passphrase string) (*File, error) {
+	if passphrase == "" {
+		return nil, errors.New("a key is required to encrypt the credentials file")
+	}
+
+	f := &File{Memory: NewMemory(), path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err = f.newKey(passphrase); err != nil {
+			return nil, err
+		}
+		return f, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+
+	if !bytes.HasPrefix(data, []byte(fileMagic)) {
+		if err = f.migrate(passphrase, data); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	if len(data) < headerSize {
+		return nil, errors.New("credentials file is corrupt")
+	}
+	if version := data[len(fileMagic)]; version != fileVersion {
+		return nil, fmt.Errorf("unsupported version %d of the credentials file", version)
+	}
+
+	f.header = data[:headerSize]
+	if f.aead, err = deriveAEAD(passphrase, f.header); err != nil {
+		return nil, err
+	}
+	if err = f.load(data[headerSize:]); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// newKey derives a new key from the passphrase with a random salt, which the file is written with from then on.
+func (f *File) newKey(passphrase string) error {
+	header := make([]byte, headerSize)
+	copy(header, fileMagic)
+	header[len(fileMagic)] = fileVersion
+	header[len(fileMagic)+1], header[len(fileMagic)+2], header[len(fileMagic)+3] = scryptLogN, scryptR, scryptP
+	if _, err := rand.Read(header[len(fileMagic)+4:]); err != nil {
+		return err
+	}
+
+	aead, err := deriveAEAD(passphrase, header)
+	if err != nil {
+		return err
+	}
+
+	f.header, f.aead = header, aead
+	return nil
+}
+
+// migrate loads the credentials of a file of the first version of the format, whose key is the SHA-256 of the passphrase, and
+// writes them again with a key that is derived with scrypt.
+func (f *File) migrate(passphrase string, data []byte) error {
+	key := sha256.Sum256([]byte(passphrase))
+	aead, err := newAEAD(key[:])
+	if err != nil {
+		return err
+	}
+
+	f.aead = aead
+	if err = f.load(data); err != nil {
+		return err
+	}
+
+	if err = f.newKey(passphrase); err != nil {
+		return err
+	}
+	return f.write()
+}
+
+// deriveAEAD derives the key from the passphrase with the scrypt parameters and the salt of the header.
+func deriveAEAD(passphrase string, header []byte) (cipher.AEAD, error) {
+	params := header[len(fileMagic)+1 : len(fileMagic)+4]
+	logN, r, p := int(params[0]), int(params[1]), int(params[2])
+	if logN < 1 || logN > maxScryptLogN || r < 1 || p < 1 {
+		return nil, errors.New("credentials file is corrupt, its scrypt parameters are invalid")
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), header[len(fileMagic)+4:], 1<<logN, r, p, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive the key of the credentials file: %w", err)
+	}
+	return newAEAD(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (f *File) SaveCredential(_ context.Context, credential Credential) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	credential.Env = maps.Clone(credential.Env)
+	k := key(credential.Tenant, credential.Name)
+	previous, ok := f.credentials[k]
+	f.credentials[k] = credential
+
+	if err := f.write(); err != nil {
+		if ok {
+			f.credentials[k] = previous
+		} else {
+			delete(f.credentials, k)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *File) DeleteCredential(_ context.Context, tenant, name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	k := key(tenant, name)
+	previous, ok := f.credentials[k]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(f.credentials, k)
+	if err := f.write(); err != nil {
+		f.credentials[k] = previous
+		return err
+	}
+	return nil
+}
+
+// load decrypts the credentials of the file, which are the nonce and the ciphertext that follow its header.
+func (f *File) load(data []byte) error {
+	if len(data) < f.aead.NonceSize() {
+		return errors.New("credentials file is corrupt")
+	}
+
+	plaintext, err := f.aead.Open(nil, data[:f.aead.NonceSize()], data[f.aead.NonceSize():], f.header)
+	if err != nil {
+		return errors.New("failed to decrypt credentials file, the key may be wrong")
+	}
+
+	if err = json.Unmarshal(plaintext, &f.credentials); err != nil {
+		return fmt.Errorf("failed to decode credentials file: %w", err)
+	}
+	return nil
+}
+
+// write encrypts the credentials and replaces the file with them. The lock must be held by the caller.
+func (f *File) write() error {
+	plaintext, err := json.Marshal(f.credentials)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	data := append(bytes.Clone(f.header), nonce...)
+
+	// The file is written next to the old one and then renamed over it, so that a failed write doesn't lose the credentials.
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write credentials file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(f.aead.Seal(data, nonce, plaintext, f.header)); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write credentials file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write credentials file: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to write credentials file: %w", err)
+	}
+	return nil
+}
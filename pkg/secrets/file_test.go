@@ -0,0 +1,170 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	ctx := context.Background()
+
+	f, err := NewFile(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.SaveCredential(ctx, Credential{Tenant: "acme", Name: "github", Env: map[string]string{"GITHUB_TOKEN": "secret-token"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(fileMagic)) || data[len(fileMagic)] != fileVersion {
+		t.Fatalf("the file doesn't start with the header of version %d", fileVersion)
+	}
+	if bytes.Contains(data, []byte("secret-token")) {
+		t.Fatal("the credential is in the file in plaintext")
+	}
+
+	loaded, err := NewFile(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := loaded.GetCredential(ctx, "acme", "github")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Env["GITHUB_TOKEN"] != "secret-token" {
+		t.Errorf("got env %v, want the token", c.Env)
+	}
+
+	if _, err = NewFile(path, "wrong"); err == nil {
+		t.Error("expected an error for the wrong passphrase")
+	}
+}
+
+func TestFileSalt(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// Files with the same passphrase have different salts, so their keys can't be attacked together.
+	var headers [][]byte
+	for _, name := range []string{"a", "b"} {
+		f, err := NewFile(filepath.Join(dir, name), "passphrase")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.SaveCredential(ctx, Credential{Name: "c"}); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, data[:headerSize])
+	}
+
+	if bytes.Equal(headers[0], headers[1]) {
+		t.Fatal("the files have the same salt")
+	}
+}
+
+func TestFileTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{name: "version", tamper: func(b []byte) []byte { b[len(fileMagic)] = fileVersion + 1; return b }},
+		{name: "scrypt parameters", tamper: func(b []byte) []byte { b[len(fileMagic)+1] = scryptLogN - 1; return b }},
+		{name: "huge scrypt parameters", tamper: func(b []byte) []byte { b[len(fileMagic)+1] = 60; return b }},
+		{name: "salt", tamper: func(b []byte) []byte { b[headerSize-1] ^= 1; return b }},
+		{name: "ciphertext", tamper: func(b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		{name: "truncated header", tamper: func(b []byte) []byte { return b[:headerSize-1] }},
+		{name: "truncated nonce", tamper: func(b []byte) []byte { return b[:headerSize+4] }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials")
+			f, err := NewFile(path, "passphrase")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = f.SaveCredential(context.Background(), Credential{Name: "c"}); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = os.WriteFile(path, tt.tamper(data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = NewFile(path, "passphrase"); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestFileMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	ctx := context.Background()
+
+	// Files of the first version are the nonce and the credentials, encrypted with the SHA-256 of the passphrase.
+	legacyKey := sha256.Sum256([]byte("passphrase"))
+	aead, err := newAEAD(legacyKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := json.Marshal(map[string]Credential{key("", "c"): {Name: "c", Env: map[string]string{"TOKEN": "value"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, aead.Seal(nonce, nonce, plaintext, nil), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewFile(path, "wrong"); err == nil {
+		t.Fatal("expected an error for the wrong passphrase")
+	}
+
+	if _, err = NewFile(path, "passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(fileMagic)) {
+		t.Fatal("the file wasn't written again in the current version")
+	}
+
+	f, err := NewFile(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := f.GetCredential(ctx, "", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Env["TOKEN"] != "value" {
+		t.Errorf("got env %v after the migration, want the token", c.Env)
+	}
+}
@@ -0,0 +1,74 @@
+package secrets
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Memory is a Store that keeps credentials in memory, so they are lost when the server stops.
+type Memory struct {
+	lock        sync.RWMutex
+	credentials map[string]Credential
+}
+
+func NewMemory() *Memory {
+	return &Memory{credentials: make(map[string]Credential)}
+}
+
+func (m *Memory) SaveCredential(_ context.Context, credential Credential) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	credential.Env = maps.Clone(credential.Env)
+	m.credentials[key(credential.Tenant, credential.Name)] = credential
+	return nil
+}
+
+func (m *Memory) GetCredential(_ context.Context, tenant, name string) (Credential, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	credential, ok := m.credentials[key(tenant, name)]
+	if !ok {
+		return Credential{}, ErrNotFound
+	}
+
+	credential.Env = maps.Clone(credential.Env)
+	return credential, nil
+}
+
+func (m *Memory) ListCredentials(_ context.Context, tenant string) ([]Credential, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	credentials := make([]Credential, 0, len(m.credentials))
+	for _, c := range m.credentials {
+		if c.Tenant != tenant {
+			continue
+		}
+		c.Env = maps.Clone(c.Env)
+		credentials = append(credentials, c)
+	}
+
+	slices.SortFunc(credentials, func(a, b Credential) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return credentials, nil
+}
+
+func (m *Memory) DeleteCredential(_ context.Context, tenant, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	k := key(tenant, name)
+	if _, ok := m.credentials[k]; !ok {
+		return ErrNotFound
+	}
+
+	delete(m.credentials, k)
+	return nil
+}
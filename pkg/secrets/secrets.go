@@ -0,0 +1,41 @@
+// Package secrets keeps the credentials that runs can use by name, so that clients don't have to send secrets with every request.
+//
+// Credentials belong to a tenant, and a tenant can only get, list, and delete its own credentials. The empty tenant is the tenant
+// of the clients that don't have one.
+package secrets
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Credential is a named set of environment variables, like API keys and tokens, that are added to the environment of a run.
+type Credential struct {
+	Name      string            `json:"name"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Env       map[string]string `json:"env"`
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+// Store is where credentials are kept.
+type Store interface {
+	// SaveCredential creates the credential, or replaces it if a credential of its tenant with the same name exists.
+	SaveCredential(ctx context.Context, credential Credential) error
+	GetCredential(ctx context.Context, tenant, name string) (Credential, error)
+	// ListCredentials returns every credential of the tenant, sorted by name.
+	ListCredentials(ctx context.Context, tenant string) ([]Credential, error)
+	DeleteCredential(ctx context.Context, tenant, name string) error
+}
+
+// key returns the key of the credential of the tenant. The credentials of the empty tenant are keyed by their names, so that the
+// credentials that were saved before there were tenants keep their keys, and names can't contain a "/", so keys can't clash.
+func key(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + "/" + name
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	httppprof "net/http/pprof"
+	"runtime/pprof"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/log"
+)
+
+var (
+	errDraining = errors.New("the server is draining and isn't accepting new runs")
+	errReadOnly = errors.New("the server is in read-only mode, which only allows parsing, formatting, and listing")
+)
+
+// activeRun is a run that is queued or running, as it is listed by the admin endpoint.
+type activeRun struct {
+	run
+	// Elapsed is how long ago the run started, including the time it was queued.
+	Elapsed string `json:"elapsed"`
+	// PIDs are the PIDs of the processes that the run started on the host, which it has none of if its backend doesn't run
+	// them on the host.
+	PIDs []int `json:"pids,omitempty"`
+}
+
+// logLevel is the body of the log level endpoints.
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+func (l *logLevel) validate() error {
+	if l.Level == "" {
+		return missingField("level", "level is required")
+	}
+	if _, err := log.ParseLevel(l.Level); err != nil {
+		return invalidField("level", err.Error())
+	}
+	return nil
+}
+
+// drainState is the body of the drain endpoints.
+type drainState struct {
+	Draining bool `json:"draining"`
+	// ActiveRuns is the number of runs that are queued or running, which the server can be stopped once there are none of.
+	ActiveRuns int `json:"activeRuns"`
+}
+
+// listActiveRuns returns the runs of the tenant of the caller that are queued or running, with how long they have been going and
+// the PIDs of their processes.
+func (s *server) listActiveRuns(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantOf(r.Context())
+	writeResponse(w, map[string][]activeRun{"runs": s.runs.activeOf(func(r *run) bool { return r.Tenant == tenant })})
+}
+
+// profile writes the named runtime profile of the server, like goroutine or heap, in the format of pprof. The debug query
+// parameter is passed to the profile, so that debug=1 or debug=2 give the profile as text.
+func profile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if pprof.Lookup(name) == nil {
+		names := make([]string, 0)
+		for _, p := range pprof.Profiles() {
+			names = append(names, p.Name())
+		}
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown profile %q, must be one of %v", name, names))
+		return
+	}
+
+	httppprof.Handler(name).ServeHTTP(w, r)
+}
+
+// getLogLevel returns the minimum level of the logs of the server.
+func getLogLevel(w http.ResponseWriter, _ *http.Request) {
+	writeResponse(w, logLevel{Level: log.Level().String()})
+}
+
+// setLogLevel changes the minimum level of the logs of the server until it is restarted, or until the config is reloaded with a
+// log level.
+func setLogLevel(w http.ResponseWriter, r *http.Request) {
+	req := new(logLevel)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	level, _ := log.ParseLevel(req.Level)
+	log.SetLevel(level)
+	ccontext.GetLogger(r.Context()).Info("Changed log level", "level", level.String())
+	writeResponse(w, logLevel{Level: level.String()})
+}
+
+// getDrain returns whether the server is draining, and how many runs it is waiting for.
+func (s *server) getDrain(w http.ResponseWriter, _ *http.Request) {
+	writeResponse(w, drainState{Draining: s.draining.Load(), ActiveRuns: len(s.runs.active())})
+}
+
+// setDrain starts or stops draining the server. While it is draining, new runs are rejected with a 503 status code and the server
+// isn't ready, but the runs in progress carry on.
+func (s *server) setDrain(w http.ResponseWriter, r *http.Request) {
+	req := new(drainState)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if s.draining.Swap(req.Draining) != req.Draining {
+		ccontext.GetLogger(r.Context()).Info("Changed drain mode", "draining", req.Draining)
+	}
+	s.getDrain(w, r)
+}
+
+// readOnlyState is the body of the read-only endpoints.
+type readOnlyState struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// executes returns whether the endpoint runs something or changes the state of the callers, so that it is rejected in read-only mode.
+// The endpoints of admins aren't, so that read-only mode can be turned off through them. The websocket runs over a GET.
+func (rt route) executes() bool {
+	return rt.scope == scopeExec && (rt.method != http.MethodGet || rt.path == "/ws")
+}
+
+// rejectReadOnly rejects the requests with a 403 status code while the server is in read-only mode.
+func (s *server) rejectReadOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.readOnly.Load() {
+			writeError(w, http.StatusForbidden, errReadOnly)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// getReadOnly returns whether the server is in read-only mode.
+func (s *server) getReadOnly(w http.ResponseWriter, _ *http.Request) {
+	writeResponse(w, readOnlyState{ReadOnly: s.readOnly.Load()})
+}
+
+// setReadOnly turns read-only mode on or off until the server restarts, or until the read-only setting of its config changes. Runs
+// in progress carry on when it is turned on.
+func (s *server) setReadOnly(w http.ResponseWriter, r *http.Request) {
+	req := new(readOnlyState)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if s.readOnly.Swap(req.ReadOnly) != req.ReadOnly {
+		ccontext.GetLogger(r.Context()).Info("Changed read-only mode", "readOnly", req.ReadOnly)
+	}
+	s.getReadOnly(w, r)
+}
+
+type processStartedKey struct{}
+
+// withProcessStarted sets the function that is called with the PID of each process that the run starts on the host.
+func withProcessStarted(ctx context.Context, started func(pid int)) context.Context {
+	return context.WithValue(ctx, processStartedKey{}, started)
+}
+
+// processStarted returns the function that is called with the PID of each process that the run of the context starts on the
+// host, which is nil if there is none.
+func processStarted(ctx context.Context) func(pid int) {
+	started, _ := ctx.Value(processStartedKey{}).(func(pid int))
+	return started
+}
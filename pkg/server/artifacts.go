@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/thedadams/clicky-serves/pkg/artifacts"
+	"github.com/thedadams/clicky-serves/pkg/objects"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+// ArtifactsConfig configures the artifacts of runs, which are the files that runs write to their workspaces. When artifacts are
+// kept, each run that isn't part of a session gets a workspace of its own, and the files in the workspace of a run are kept once
+// the run ends, so that they can be downloaded from /runs/{id}/artifacts. Artifacts are kept until they are removed from the
+// directory or the storage, like by a lifecycle rule of the bucket.
+type ArtifactsConfig struct {
+	// Dir is the directory that artifacts are kept in, and Storage keeps them in the storage of the server instead. Artifacts
+	// aren't kept if neither is set.
+	Dir     string
+	Storage bool
+	// MaxSize is the size in bytes of the largest file that is kept as an artifact. Larger files are skipped. 0 means no limit.
+	MaxSize int64
+}
+
+func (c ArtifactsConfig) enabled() bool {
+	return c.Dir != "" || c.Storage
+}
+
+func (c ArtifactsConfig) validate() error {
+	if c.Dir != "" && c.Storage {
+		return errors.New("only one of the directory and the storage can be set")
+	}
+	if c.MaxSize < 0 {
+		return errors.New("max size must not be negative")
+	}
+	return nil
+}
+
+// newArtifactStore returns the store that the artifacts of runs are kept in, or nil if artifacts aren't kept.
+func newArtifactStore(c ArtifactsConfig, storage objects.Store) (artifacts.Store, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	if c.Dir != "" {
+		return artifacts.NewDir(c.Dir)
+	}
+	return artifacts.NewBucket(objects.Prefixed(storage, storageArtifacts)), nil
+}
+
+// keepArtifacts keeps the regular files of the workspace of the run that changed since it started as its artifacts, skipping those
+// that are larger than the maximum size. Symbolic links are skipped, so that a run can't make files outside of its workspace into
+// its artifacts.
+func (s *server) keepArtifacts(ctx context.Context, l *slog.Logger, runID string, rw *runWorkspace) {
+	maxSize := s.current().config.Artifacts.MaxSize
+	var kept int
+	err := filepath.WalkDir(rw.dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(rw.since) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(rw.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if maxSize > 0 && info.Size() > maxSize {
+			l.Warn("Skipped artifact that is larger than the maximum size", "artifact", name, "size", info.Size())
+			return nil
+		}
+
+		if err = s.putArtifact(ctx, runID, p, artifacts.Artifact{Name: name, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+			l.Error("Failed to keep artifact", "artifact", name, "error", err)
+			return nil
+		}
+		kept++
+		return nil
+	})
+	if err != nil {
+		l.Error("Failed to collect artifacts of run", "error", err)
+	}
+	if kept > 0 {
+		l.Debug("kept artifacts of run", "count", kept)
+	}
+}
+
+func (s *server) putArtifact(ctx context.Context, runID, p string, artifact artifacts.Artifact) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.artifacts.Put(ctx, runID, artifact, io.LimitReader(f, artifact.Size))
+}
+
+// artifactsRun returns the run of the request, whose artifacts are requested, writing an error to the response if artifacts aren't
+// kept or the tenant of the request has no such run.
+func (s *server) artifactsRun(w http.ResponseWriter, r *http.Request) (store.Run, bool) {
+	if s.artifacts == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("the server doesn't keep the artifacts of runs"))
+		return store.Run{}, false
+	}
+
+	run, err := s.store.GetRun(r.Context(), tenantOf(r.Context()), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("run %q not found", r.PathValue("id")))
+		return store.Run{}, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get run: %w", err))
+		return store.Run{}, false
+	}
+	return run, true
+}
+
+// listArtifacts returns the artifacts of a run. The status is 202 while the run hasn't ended, because its artifacts are only kept
+// once it has.
+func (s *server) listArtifacts(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.artifactsRun(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := s.artifacts.List(r.Context(), run.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to list artifacts: %w", err))
+		return
+	}
+
+	if run.EndTime == nil {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	writeResponse(w, map[string][]artifacts.Artifact{"artifacts": list})
+}
+
+// getArtifact downloads an artifact of a run, whose name is its path in the workspace of the run.
+func (s *server) getArtifact(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.artifactsRun(w, r)
+	if !ok {
+		return
+	}
+
+	name := r.PathValue("name")
+	content, artifact, err := s.artifacts.Open(r.Context(), run.ID, name)
+	if errors.Is(err, artifacts.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("artifact %q of run %q not found", name, run.ID))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get artifact: %w", err))
+		return
+	}
+	defer content.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+	if artifact.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(artifact.Size, 10))
+	}
+	if !artifact.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", artifact.ModTime.UTC().Format(http.TimeFormat))
+	}
+	_, _ = io.Copy(w, content)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/events"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+// runOutput is the outcome of a run. It is also the body of the callback of a run.
+type runOutput struct {
+	RunID  string `json:"runID"`
+	Status string `json:"status"`
+	Stdout string `json:"stdout"`
+	// Encoding is the encoding of the stdout if it isn't valid UTF-8, in which case it can also be downloaded as it is from
+	// /runs/{id}/output/raw.
+	Encoding  string     `json:"encoding,omitempty"`
+	Stderr    string     `json:"stderr"`
+	Error     string     `json:"error,omitempty"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+}
+
+// runSubmission is the response to a run that was submitted to run in the background.
+type runSubmission struct {
+	RunID  string   `json:"runID"`
+	Status runState `json:"status"`
+}
+
+// runResult is the response to a run that was submitted to run while the client waits.
+type runResult struct {
+	RunID    string `json:"runID"`
+	Stdout   string `json:"stdout"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// submitRun runs a tool or file. If the async query parameter is true, then the run is started in the background and its ID is
+// returned right away, so that its output can be fetched from /runs/{id}/output and its events streamed from /runs/{id}/events.
+// Otherwise, the response is the output of the run once it has finished.
+func (s *server) submitRun(w http.ResponseWriter, r *http.Request) {
+	req := new(toolOrFile)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	async, err := asyncQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	pr, code, err := s.prepareRun(r.Context(), ccontext.GetIdentity(r.Context()), *req)
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	// A dry run only returns the plan of the run, so it is the same whether or not it is async.
+	if req.options().DryRun {
+		s.writePlan(w, r, req.options(), req.gptscriptOpts(), pr.env, pr.parse)
+		return
+	}
+
+	if !async {
+		runID, out, err := s.runPrepared(r.Context(), pr, discardEvents{}, nil)
+		w.Header().Set(runIDHeader, runID)
+		if runID == "" {
+			writeRunError(w, err)
+			return
+		} else if err != nil {
+			writeEngineError(r.Context(), w, err, "failed to run")
+			return
+		}
+
+		if out, err = transformOutput(r.Context(), req.options().Transform, out); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		result := runResult{RunID: runID}
+		result.Stdout, result.Encoding = encodeOutput(out)
+		writeResponse(w, result)
+		return
+	}
+
+	// A run that is submitted while the queue is full would be rejected once it is in the background, so it is rejected now
+	// while the client can still be told to retry.
+	if s.limiter.saturated() {
+		writeRunError(w, errQueueFull)
+		return
+	}
+
+	var (
+		runID      = s.cluster.newRunID()
+		registered = make(chan struct{})
+		// The run outlives the request, so it isn't canceled when the request ends.
+		ctx = withRunRegistered(ccontext.WithRunID(context.WithoutCancel(r.Context()), runID), registered)
+	)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := s.runPrepared(ctx, pr, discardEvents{}, nil)
+		if err != nil {
+			ccontext.GetLogger(ctx).Debug("Background run failed", "run_id", runID, "error", err)
+		}
+		done <- err
+	}()
+
+	// The response waits until the run is in the run history, so that its output can be fetched as soon as the client has its ID.
+	select {
+	case <-registered:
+	case err = <-done:
+		// The run ended without being registered, so it never started.
+		select {
+		case <-registered:
+		default:
+			writeRunError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set(runIDHeader, runID)
+	w.Header().Set("Location", "/runs/"+runID+"/output")
+	w.WriteHeader(http.StatusAccepted)
+	writeResponse(w, runSubmission{RunID: runID, Status: runStateQueued})
+}
+
+type runRegisteredKey struct{}
+
+// withRunRegistered sets a channel that is closed once the run is in the run registry and the run history, before it waits in the
+// run queue.
+func withRunRegistered(ctx context.Context, registered chan struct{}) context.Context {
+	return context.WithValue(ctx, runRegisteredKey{}, registered)
+}
+
+func runRegistered(ctx context.Context) chan struct{} {
+	ch, _ := ctx.Value(runRegisteredKey{}).(chan struct{})
+	return ch
+}
+
+func asyncQuery(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("async")
+	if v == "" {
+		return false, nil
+	}
+
+	async, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, invalidField("async", fmt.Sprintf("invalid async %q, must be true or false", v))
+	}
+	return async, nil
+}
+
+// getRunOutput returns the outcome of the run. The status is 202 while the run hasn't ended, and 200 once it has, whether the run
+// succeeded or not. The stdout of a run that finished is transformed with the transform of the jmespath or jq query parameter.
+func (s *server) getRunOutput(w http.ResponseWriter, r *http.Request) {
+	transform, err := transformQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	out, err := s.runOutput(r.Context(), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("run %q not found", r.PathValue("id")))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get run: %w", err))
+		return
+	}
+
+	if out.EndTime == nil {
+		w.WriteHeader(http.StatusAccepted)
+	} else if transform != nil && out.Status == string(runStateFinished) {
+		if out.Encoding != "" {
+			err = invalidOutput("the stdout of the run is not valid JSON, so it can't be transformed")
+		} else {
+			out.Stdout, err = transform.apply(r.Context(), out.Stdout)
+		}
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+	}
+	writeResponse(w, out)
+}
+
+// runOutput returns the outcome of the run from the run history. The stderr is the stderr that was streamed by the run, so it is
+// empty for runs that weren't streamed, whose stderr is part of their error if they failed.
+func (s *server) runOutput(ctx context.Context, runID string) (runOutput, error) {
+	run, err := s.store.GetRun(ctx, tenantOf(ctx), runID)
+	if err != nil {
+		return runOutput{}, err
+	}
+
+	history, err := s.store.ListEvents(ctx, runID, 0)
+	if err != nil {
+		return runOutput{}, err
+	}
+
+	var stderr strings.Builder
+	for _, e := range history {
+		var env events.Envelope
+		if err = json.Unmarshal(e.Data, &env); err != nil {
+			continue
+		}
+		if out, ok := env.Data.(events.Stderr); ok {
+			stderr.WriteString(out.Stderr)
+		}
+	}
+
+	stdout, encoding := encodeOutput(run.Output)
+	return runOutput{
+		RunID:     run.ID,
+		Status:    run.State,
+		Stdout:    stdout,
+		Encoding:  encoding,
+		Stderr:    stderr.String(),
+		Error:     run.Error,
+		StartTime: run.StartTime,
+		EndTime:   run.EndTime,
+	}, nil
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+const (
+	// maxAuditBody is how much of the body of a request is kept to find the tool and options that it requested. The whole body
+	// is hashed regardless.
+	maxAuditBody = 1 << 20
+	// maxAuditErrorBody is how much of the body of an error response is kept to find the error that the request was rejected with.
+	maxAuditErrorBody = 64 << 10
+	// auditHTTPTimeout is how long an audit record can take to be sent to an HTTP sink.
+	auditHTTPTimeout = 10 * time.Second
+)
+
+// auditRecord is the record of a request to parse or execute that is written to the audit log.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestID"`
+	// Client is the name of the caller, Scope is the scope that it was granted, and Tenant is its tenant. They are empty if
+	// authentication is disabled.
+	Client string `json:"client,omitempty"`
+	Scope  string `json:"scope,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	RunID  string `json:"runID,omitempty"`
+	// Tool is the file or the name of the tool that was requested, which is empty for tools that are given as content.
+	Tool string `json:"tool,omitempty"`
+	// InputHash is the SHA-256 hash of the body of the request, so that the request can be matched without it being logged.
+	InputHash string        `json:"inputHash"`
+	Options   *auditOptions `json:"options,omitempty"`
+	// Status is the status code of the response, and Result is the state of the run when the response was done, if there is one.
+	// Error is why the run failed, or why the request was rejected, like a run that was denied by a policy, along with the code of
+	// the error response.
+	Status    int       `json:"status"`
+	Result    string    `json:"result,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ErrorCode errorCode `json:"errorCode,omitempty"`
+	Duration  float64   `json:"durationSeconds"`
+}
+
+// auditOptions are the options that a request set. Only the names of the environment variables are kept, because their values
+// can be secrets.
+type auditOptions struct {
+	requestOpts
+	Timeout     string   `json:"timeout,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	NoCache     bool     `json:"noCache,omitempty"`
+	CallbackURL string   `json:"callbackURL,omitempty"`
+	Credentials []string `json:"credentials,omitempty"`
+	Env         []string `json:"env,omitempty"`
+}
+
+// auditInput is the part of the body of a request that is audited. Requests that nest their tool or file are audited by what
+// they nest.
+type auditInput struct {
+	runOptions
+	requestOpts
+	// File is either the path of a file, or a nested file request.
+	File json.RawMessage `json:"file"`
+	Name string          `json:"name"`
+	Tool *auditInput     `json:"tool"`
+}
+
+// tool returns the file or the name of the tool of the request, and the options that the request set.
+func (a *auditInput) tool() (string, *auditOptions) {
+	if a.Tool != nil {
+		return a.Tool.tool()
+	}
+
+	var path string
+	if len(a.File) > 0 && json.Unmarshal(a.File, &path) != nil {
+		nested := new(auditInput)
+		if json.Unmarshal(a.File, nested) == nil {
+			return nested.tool()
+		}
+	}
+	if path == "" {
+		path = a.Name
+	}
+
+	env := make([]string, 0, len(a.Env))
+	for name := range a.Env {
+		env = append(env, name)
+	}
+	slices.Sort(env)
+	return path, &auditOptions{
+		requestOpts: a.requestOpts,
+		Timeout:     a.Timeout,
+		Model:       a.Model,
+		NoCache:     a.NoCache,
+		CallbackURL: a.CallbackURL,
+		Credentials: a.Credentials,
+		Env:         env,
+	}
+}
+
+// auditSink is where the records of the audit log are written.
+type auditSink interface {
+	write(ctx context.Context, record auditRecord) error
+	close() error
+}
+
+// newAuditSink returns the sink of the audit log. The log is either the path of a file that records are appended to, syslog: or
+// syslog://host:port for the local or a remote syslog, or an http or https URL that each record is posted to.
+func newAuditSink(log string) (auditSink, error) {
+	switch {
+	case log == "":
+		return nil, nil
+	case log == "syslog:" || strings.HasPrefix(log, "syslog://"):
+		return newSyslogAuditSink(strings.TrimPrefix(strings.TrimPrefix(log, "syslog:"), "//"))
+	case strings.HasPrefix(log, "http://") || strings.HasPrefix(log, "https://"):
+		return &httpAuditSink{url: log, client: &http.Client{Timeout: auditHTTPTimeout}}, nil
+	default:
+		return newFileAuditSink(strings.TrimPrefix(log, "file://"))
+	}
+}
+
+// fileAuditSink appends each record to a file as a line of JSON.
+type fileAuditSink struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+func newFileAuditSink(path string) (*fileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &fileAuditSink{f: f}, nil
+}
+
+func (s *fileAuditSink) write(_ context.Context, record auditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The record is written with a single write, so that it is appended as a whole.
+	if _, err = s.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileAuditSink) close() error {
+	return s.f.Close()
+}
+
+// httpAuditSink posts each record as JSON to a URL.
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpAuditSink) write(ctx context.Context, record auditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d from audit log", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *httpAuditSink) close() error {
+	return nil
+}
+
+// audit wraps the handler so that a record of each request is written to the audit log, if there is one.
+func (s *server) audit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auditLog == nil {
+			h(w, r)
+			return
+		}
+
+		start := time.Now()
+		body := &auditBody{ReadCloser: r.Body, hash: sha256.New()}
+		r.Body = body
+		aw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		h(aw, r)
+
+		record := auditRecord{
+			Time:      start,
+			RequestID: ccontext.GetRequestID(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			RunID:     w.Header().Get(runIDHeader),
+			InputHash: hex.EncodeToString(body.hash.Sum(nil)),
+			Status:    aw.status,
+			Duration:  time.Since(start).Seconds(),
+		}
+		if id := ccontext.GetIdentity(r.Context()); id != nil {
+			record.Client, record.Scope, record.Tenant = id.Name, id.Scope, id.Tenant
+		}
+
+		if !body.truncated && body.buf.Len() > 0 {
+			in := new(auditInput)
+			if json.Unmarshal(body.buf.Bytes(), in) == nil {
+				record.Tool, record.Options = in.tool()
+			}
+		}
+
+		if record.RunID != "" {
+			if run, err := s.store.GetRun(context.WithoutCancel(r.Context()), record.Tenant, record.RunID); err == nil {
+				record.Result, record.Error = run.State, run.Error
+			}
+		} else if aw.status >= http.StatusBadRequest {
+			var resp errorResponse
+			if json.Unmarshal(aw.errBody.Bytes(), &resp) == nil {
+				record.Error, record.ErrorCode = resp.Error, resp.Code
+			}
+		}
+
+		if err := s.auditLog.write(context.WithoutCancel(r.Context()), record); err != nil {
+			ccontext.GetLogger(r.Context()).Error("Failed to write audit record", "error", err)
+		}
+	}
+}
+
+// auditBody hashes the body of a request as it is read, and keeps its beginning.
+type auditBody struct {
+	io.ReadCloser
+	hash      hash.Hash
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	_, _ = b.hash.Write(p[:n])
+	if b.buf.Len()+n <= maxAuditBody {
+		b.buf.Write(p[:n])
+	} else {
+		b.truncated = true
+	}
+	return n, err
+}
+
+// auditResponseWriter records the status code of a response, and the body of an error response. Streams are flushed and websockets
+// are hijacked through it.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	errBody     bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	if w.status >= http.StatusBadRequest && w.errBody.Len()+len(b) <= maxAuditErrorBody {
+		w.errBody.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response can't be hijacked")
+	}
+
+	w.status, w.wroteHeader = http.StatusSwitchingProtocols, true
+	return h.Hijack()
+}
+
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// closeAuditLog closes the audit log, if there is one.
+func (s *server) closeAuditLog() {
+	if s.auditLog == nil {
+		return
+	}
+	if err := s.auditLog.close(); err != nil {
+		slog.Error("Failed to close audit log", "error", err)
+	}
+}
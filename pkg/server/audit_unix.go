@@ -0,0 +1,41 @@
+//go:build !windows
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+)
+
+// syslogAuditSink writes each record as JSON to syslog.
+type syslogAuditSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogAuditSink returns a sink that writes to the syslog at the address, or the local syslog if the address is empty.
+func newSyslogAuditSink(addr string) (*syslogAuditSink, error) {
+	network := ""
+	if addr != "" {
+		network = "udp"
+	}
+
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTH, "clicky-serves")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	return &syslogAuditSink{w: w}, nil
+}
+
+func (s *syslogAuditSink) write(_ context.Context, record auditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(b))
+}
+
+func (s *syslogAuditSink) close() error {
+	return s.w.Close()
+}
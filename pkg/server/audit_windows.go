@@ -0,0 +1,7 @@
+package server
+
+import "errors"
+
+func newSyslogAuditSink(string) (auditSink, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
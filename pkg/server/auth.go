@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/thedadams/clicky-serves/pkg/context"
+)
+
+// scope is the level of access granted to a caller. Each scope includes the access granted by the scopes below it.
+type scope int
+
+const (
+	scopeNone scope = iota
+	scopeParse
+	scopeExec
+	scopeAdmin
+)
+
+func parseScope(s string) (scope, error) {
+	switch s {
+	case "parse":
+		return scopeParse, nil
+	case "exec":
+		return scopeExec, nil
+	case "admin":
+		return scopeAdmin, nil
+	default:
+		return scopeNone, fmt.Errorf("unknown scope %q", s)
+	}
+}
+
+func (s scope) String() string {
+	switch s {
+	case scopeParse:
+		return "parse"
+	case scopeExec:
+		return "exec"
+	case scopeAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+// errUnrecognizedCredentials is returned by an authenticator when the credentials of a request are not meant for it.
+var errUnrecognizedCredentials = errors.New("unrecognized credentials")
+
+// authenticator validates the credentials of a request and returns the identity of the caller.
+// If no credentials were provided, then the authenticator should return a nil identity and no error.
+type authenticator interface {
+	authenticate(r *http.Request) (*context.Identity, error)
+}
+
+// authenticate is a middleware that identifies the caller with the current authenticators and adds the identity to the request
+// context. Requests without credentials are passed through so that requireScope can decide whether the route requires them.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var unrecognized bool
+		for _, a := range s.current().authenticators {
+			id, err := a.authenticate(r)
+			if errors.Is(err, errUnrecognizedCredentials) {
+				unrecognized = true
+				continue
+			} else if err != nil {
+				context.GetLogger(r.Context()).Debug("failed to authenticate request", "error", err)
+				writeUnauthorized(w, err)
+				return
+			}
+
+			if id != nil {
+				next.ServeHTTP(w, r.WithContext(context.WithIdentity(r.Context(), id)))
+				return
+			}
+		}
+
+		if unrecognized {
+			writeUnauthorized(w, errors.New("invalid credentials"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireScope wraps the handler so that it is only called if the caller has been granted the given scope.
+// If no scope is required, then the handler is returned as is. Whether authentication is enabled is checked for each request,
+// because it can change when the config is reloaded.
+func (s *server) requireScope(required scope, h http.HandlerFunc) http.HandlerFunc {
+	if required == scopeNone {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.current().authEnabled() {
+			h(w, r)
+			return
+		}
+
+		id := context.GetIdentity(r.Context())
+		if id == nil {
+			writeUnauthorized(w, errors.New("missing credentials"))
+			return
+		}
+
+		if granted, _ := parseScope(id.Scope); granted < required {
+			writeError(w, http.StatusForbidden, fmt.Errorf("%s does not have the %s scope", id.Name, required))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// allowedToolPath reports whether the caller is allowed to run the tool at the given path.
+// Tools passed as content have no path, and are only allowed if the caller can run any tool.
+func allowedToolPath(id *context.Identity, path string) bool {
+	if id == nil || id.AllowedToolPaths == nil {
+		return true
+	}
+
+	for _, pattern := range id.AllowedToolPaths {
+		if ok, _ := filepath.Match(pattern, path); ok && path != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, err)
+}
+
+// bearerToken returns the token from the Authorization header of the request, or the empty string if there isn't one.
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// apiKeyAuthenticator authenticates requests with static API keys passed as bearer tokens.
+type apiKeyAuthenticator struct {
+	// identities are keyed by the hash of the API key, so that the keys themselves are not kept around.
+	identities map[string]*context.Identity
+}
+
+// newAPIKeyAuthenticator creates an authenticator from API keys in the form "key:scope:tenant", where the scope defaults to exec
+// and the tenant to the default tenant.
+// The keys can be passed directly, or in a file with one key per line. Empty lines and lines starting with # in the file are ignored.
+func newAPIKeyAuthenticator(keys []string, file string) (*apiKeyAuthenticator, error) {
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open API keys file: %w", err)
+		}
+		defer f.Close()
+
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if line := strings.TrimSpace(s.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+		if err = s.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read API keys file: %w", err)
+		}
+	}
+
+	a := &apiKeyAuthenticator{identities: make(map[string]*context.Identity, len(keys))}
+	for _, k := range keys {
+		key, rest, _ := strings.Cut(k, ":")
+		sc, tenant, _ := strings.Cut(rest, ":")
+		if key == "" {
+			return nil, errors.New("API key must not be empty")
+		} else if sc == "" {
+			sc = scopeExec.String()
+		}
+
+		parsed, err := parseScope(sc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API key: %w", err)
+		}
+		if err = validateTenant(tenant); err != nil {
+			return nil, fmt.Errorf("invalid API key: %w", err)
+		}
+
+		hash := hashKey(key)
+		a.identities[hash] = &context.Identity{
+			Name:   "key-" + hash[:8],
+			Scope:  parsed.String(),
+			Tenant: tenant,
+		}
+	}
+
+	return a, nil
+}
+
+func (a *apiKeyAuthenticator) authenticate(r *http.Request) (*context.Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil
+	}
+
+	id, ok := a.identities[hashKey(token)]
+	if !ok {
+		return nil, errUnrecognizedCredentials
+	}
+
+	return id, nil
+}
+
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thedadams/clicky-serves/pkg/context"
+)
+
+func TestNewAPIKeyAuthenticator(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		file    string
+		want    map[string]context.Identity
+		wantErr bool
+	}{
+		{
+			name: "scope defaults to exec",
+			keys: []string{"secret"},
+			want: map[string]context.Identity{"secret": {Scope: "exec"}},
+		},
+		{
+			name: "scope and tenant",
+			keys: []string{"parser:parse", "admin:admin:acme"},
+			want: map[string]context.Identity{"parser": {Scope: "parse"}, "admin": {Scope: "admin", Tenant: "acme"}},
+		},
+		{
+			name: "keys from file",
+			file: "# a comment\n\nfile-key:admin\n  other-key  \n",
+			want: map[string]context.Identity{"file-key": {Scope: "admin"}, "other-key": {Scope: "exec"}},
+		},
+		{
+			name:    "empty key",
+			keys:    []string{":admin"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown scope",
+			keys:    []string{"key:root"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid tenant",
+			keys:    []string{"key:exec:../other"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var file string
+			if tt.file != "" {
+				file = filepath.Join(t.TempDir(), "keys")
+				if err := os.WriteFile(file, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			a, err := newAPIKeyAuthenticator(tt.keys, file)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(a.identities) != len(tt.want) {
+				t.Fatalf("got %d identities, want %d", len(a.identities), len(tt.want))
+			}
+			for key, want := range tt.want {
+				id, err := a.authenticate(requestWithToken(key))
+				if err != nil {
+					t.Fatalf("key %q: unexpected error: %v", key, err)
+				}
+				if id.Scope != want.Scope || id.Tenant != want.Tenant {
+					t.Errorf("key %q: got scope %q and tenant %q, want scope %q and tenant %q", key, id.Scope, id.Tenant, want.Scope, want.Tenant)
+				}
+			}
+		})
+	}
+}
+
+func TestNewAPIKeyAuthenticatorMissingFile(t *testing.T) {
+	if _, err := newAPIKeyAuthenticator(nil, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestAPIKeyAuthenticate(t *testing.T) {
+	a, err := newAPIKeyAuthenticator([]string{"secret:admin"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		wantID  bool
+		wantErr error
+	}{
+		{name: "valid key", header: "Bearer secret", wantID: true},
+		{name: "surrounding spaces are trimmed", header: "Bearer  secret ", wantID: true},
+		{name: "no credentials", header: ""},
+		{name: "not a bearer token", header: "Basic secret"},
+		{name: "wrong key", header: "Bearer wrong", wantErr: errUnrecognizedCredentials},
+		{name: "prefix of the key", header: "Bearer secre", wantErr: errUnrecognizedCredentials},
+		{name: "case of the key matters", header: "Bearer SECRET", wantErr: errUnrecognizedCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			id, err := a.authenticate(r)
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if (id != nil) != tt.wantID {
+				t.Fatalf("got identity %v, want one: %v", id, tt.wantID)
+			}
+			if id != nil && id.Scope != "admin" {
+				t.Errorf("got scope %q, want admin", id.Scope)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAndRequireScope(t *testing.T) {
+	a, err := newAPIKeyAuthenticator([]string{"parser:parse", "runner:exec", "admin:admin"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := new(server)
+	s.settings.Store(&settings{authenticators: []authenticator{a}})
+
+	tests := []struct {
+		name     string
+		token    string
+		required scope
+		want     int
+	}{
+		{name: "no scope required", required: scopeNone, want: http.StatusOK},
+		{name: "missing credentials", required: scopeParse, want: http.StatusUnauthorized},
+		{name: "unknown key", token: "wrong", required: scopeParse, want: http.StatusUnauthorized},
+		{name: "same scope", token: "parser", required: scopeParse, want: http.StatusOK},
+		{name: "higher scope", token: "admin", required: scopeExec, want: http.StatusOK},
+		{name: "lower scope", token: "parser", required: scopeExec, want: http.StatusForbidden},
+		{name: "exec is not admin", token: "runner", required: scopeAdmin, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := s.authenticate(s.requireScope(tt.required, func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, requestWithToken(tt.token))
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Error("expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestRequireScopeWithoutAuthentication(t *testing.T) {
+	s := new(server)
+	s.settings.Store(new(settings))
+
+	w := httptest.NewRecorder()
+	s.requireScope(scopeAdmin, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})(w, requestWithToken(""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestAllowedToolPath(t *testing.T) {
+	tests := []struct {
+		name string
+		id   *context.Identity
+		path string
+		want bool
+	}{
+		{name: "no identity", path: "/tools/a.gpt", want: true},
+		{name: "no restriction", id: &context.Identity{}, path: "/tools/a.gpt", want: true},
+		{name: "matching pattern", id: &context.Identity{AllowedToolPaths: []string{"/tools/*.gpt"}}, path: "/tools/a.gpt", want: true},
+		{name: "no matching pattern", id: &context.Identity{AllowedToolPaths: []string{"/tools/*.gpt"}}, path: "/other/a.gpt"},
+		{name: "pattern doesn't cross directories", id: &context.Identity{AllowedToolPaths: []string{"/tools/*"}}, path: "/tools/sub/a.gpt"},
+		{name: "tool content without a path", id: &context.Identity{AllowedToolPaths: []string{"*"}}, path: ""},
+		{name: "empty list allows nothing", id: &context.Identity{AllowedToolPaths: []string{}}, path: "/tools/a.gpt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowedToolPath(tt.id, tt.path); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// requestWithToken returns a GET request with the token as its bearer token, or without credentials if the token is empty.
+func requestWithToken(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+const (
+	// BackendHost runs gptscript directly on the host, as the user of the server.
+	BackendHost = "host"
+	// BackendSandbox runs gptscript in a container for each process, as configured by Config.Sandbox.
+	BackendSandbox = "sandbox"
+	// BackendKubernetes runs gptscript as a Kubernetes Job for each process, as configured by Config.Kubernetes.
+	BackendKubernetes = "kubernetes"
+	// BackendWorkers queues the gptscript processes of runs for workers to run, which are started with StartWorker.
+	BackendWorkers = "workers"
+)
+
+// ExecBackend starts the gptscript processes of runs. Parsing, running, and streaming all go through the backend of the server,
+// so that how runs are executed can change without changing the handlers.
+type ExecBackend = runner.Backend
+
+// BackendFactory builds a backend from the config of the server. It is called again whenever the config is reloaded.
+type BackendFactory func(config Config) (ExecBackend, error)
+
+var (
+	backendsLock sync.RWMutex
+	backends     = map[string]BackendFactory{
+		BackendHost: func(Config) (ExecBackend, error) {
+			return runner.Host{}, nil
+		},
+		BackendSandbox:    newSandbox,
+		BackendKubernetes: newKubernetes,
+	}
+)
+
+// RegisterBackend makes a backend available to be chosen by Config.Backend. A backend that is registered with the name of another
+// replaces it. Backends should be registered before the server is started.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	backends[name] = factory
+}
+
+// newBackend builds the backend that is chosen by the config.
+func newBackend(config Config) (ExecBackend, error) {
+	name, err := config.backendName()
+	if err != nil {
+		return nil, err
+	}
+
+	backendsLock.RLock()
+	factory, ok := backends[name]
+	backendsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, must be one of %v", name, backendNames())
+	}
+
+	b, err := factory(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s backend: %w", name, err)
+	}
+	return b, nil
+}
+
+// backendName returns the name of the backend of the config. If it isn't set, then the sandbox or Kubernetes is used if its image
+// is set, and otherwise runs are executed on the host.
+func (c Config) backendName() (string, error) {
+	switch {
+	case c.Backend != "":
+		return c.Backend, nil
+	case c.Sandbox.enabled() && c.Kubernetes.enabled():
+		return "", errors.New("runs can be executed in either a sandbox or Kubernetes, but not both, unless the backend is set")
+	case c.Sandbox.enabled():
+		return BackendSandbox, nil
+	case c.Kubernetes.enabled():
+		return BackendKubernetes, nil
+	default:
+		return BackendHost, nil
+	}
+}
+
+func backendNames() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// backend returns the backend that runs are executed with.
+func (s *server) backend() ExecBackend {
+	return s.current().backend
+}
+
+type backendKey struct{}
+
+// withBackend sets the backend that the gptscript processes of a run are started with.
+func withBackend(ctx context.Context, b ExecBackend) context.Context {
+	return context.WithValue(ctx, backendKey{}, b)
+}
+
+// runBackend returns the backend of the run of the context, which is nil if the run is executed on the host.
+func runBackend(ctx context.Context) ExecBackend {
+	b, _ := ctx.Value(backendKey{}).(ExecBackend)
+	return b
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gptscript-ai/go-gptscript"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+// toolOrFile is exactly one of a tool or a file, for the runs that aren't started by a request for a single tool or file.
+type toolOrFile struct {
+	Tool *toolRequest `json:"tool,omitempty"`
+	File *fileRequest `json:"file,omitempty"`
+}
+
+func (t *toolOrFile) validate() error {
+	return validateToolOrFile(t.Tool, t.File)
+}
+
+// name returns the name of the tool or the registered tool or path of the file, which the sinks of notifications are filtered by.
+func (t toolOrFile) name() string {
+	if t.Tool != nil {
+		return t.Tool.Name
+	}
+	return toolName(t.File.File, "")
+}
+
+// options returns the options of the tool or file that are handled by the server.
+func (t toolOrFile) options() runOptions {
+	if t.Tool != nil {
+		return t.Tool.runOptions
+	}
+	return t.File.runOptions
+}
+
+// gptscriptOpts returns the gptscript options of the tool or file.
+func (t toolOrFile) gptscriptOpts() requestOpts {
+	if t.Tool != nil {
+		return t.Tool.requestOpts
+	}
+	return t.File.requestOpts
+}
+
+// preparedRun is a tool or file that the caller is allowed to run, with its options checked.
+type preparedRun struct {
+	item    toolOrFile
+	timeout time.Duration
+	env     []string
+	path    string
+	limits  *toolLimits
+}
+
+// prepareRun checks that the caller is allowed to run the tool or file, and checks its options, and checks it with checkRun. If
+// the caller is nil, then any tool or file is allowed, apart from what the policy of the client of the context denies. The returned status code is the status of the error.
+func (s *server) prepareRun(ctx context.Context, id *ccontext.Identity, item toolOrFile) (preparedRun, int, error) {
+	var file string
+	if item.File != nil {
+		file = item.File.File
+	}
+
+	if file != "" && !allowedToolPath(id, file) {
+		return preparedRun{}, http.StatusForbidden, fmt.Errorf("not allowed to run %s", file)
+	}
+
+	path, limits, code, err := s.resolveFile(ctx, file)
+	if err != nil {
+		return preparedRun{}, code, err
+	}
+
+	// The options are held to the limits of a registered tool without changing the item, so that the item of a schedule keeps
+	// running the latest version of the tool with its own limits.
+	opts, err := limits.options(item.options(), s.current().config.DefaultModel)
+	if err != nil {
+		return preparedRun{}, http.StatusBadRequest, err
+	}
+
+	timeout, err := s.runTimeout(opts.Timeout)
+	if err != nil {
+		return preparedRun{}, http.StatusBadRequest, err
+	}
+
+	env, err := s.runEnv(ctx, opts)
+	if err != nil {
+		return preparedRun{}, http.StatusBadRequest, err
+	}
+
+	if code, err := s.checkRun(ctx, item, env, path); err != nil {
+		return preparedRun{}, code, err
+	}
+
+	return preparedRun{item: item, timeout: limits.runTimeout(timeout), env: env, path: path, limits: limits}, 0, nil
+}
+
+// parse parses the tool or file, for planning a dry run of it.
+func (pr preparedRun) parse(ctx context.Context, opts runner.Options) ([]gptscript.Node, error) {
+	if pr.item.File != nil {
+		return runner.Parse(ctx, pr.path, opts)
+	}
+	return runner.ParseTool(ctx, pr.item.Tool.tool().String(), opts)
+}
+
+// runPrepared runs the tool or file as a run of its own, writing its events to the event writer, and returns the ID and the output
+// of the run. The run ID is empty if the run didn't start, in which case the error is the reason that it didn't.
+func (s *server) runPrepared(ctx context.Context, pr preparedRun, w eventWriter, queued queueNotifier) (string, string, error) {
+	var (
+		t     = runTypeTool
+		input any
+	)
+	if pr.item.File != nil {
+		t, input = runTypeFile, pr.item.File
+	} else {
+		input = pr.item.Tool
+	}
+
+	// The run sets its ID on the response that it is given, so it gets a response of its own instead of one that may be shared.
+	resp := &discardResponse{header: make(http.Header)}
+	ctx, l, end, err := s.beginRun(pr.limits.context(pr.item.options().context(ctx, pr.env)), t, input, pr.timeout, resp, queued)
+	if err != nil {
+		return "", "", err
+	}
+
+	runID := ccontext.GetRunID(ctx)
+	w = s.runEventWriter(ctx, l, w)
+
+	var out string
+	if pr.item.File != nil {
+		l.Debug("executing file", "file", pr.item.File)
+		out, err = execFileStreamWithEvents(ctx, l, w, pr.item.File.requestOpts, pr.path, pr.item.File.Input)
+	} else {
+		l.Debug("executing tool", "tool", pr.item.Tool)
+		out, err = execToolStreamWithEvents(ctx, l, w, pr.item.Tool.requestOpts, pr.item.Tool.tool())
+	}
+	end(out, err)
+
+	return runID, out, err
+}
+
+// discardEvents is an eventWriter for runs whose events are only kept in the run history.
+type discardEvents struct{}
+
+func (discardEvents) writeEvent(any) {}
+
+func (discardEvents) finish() {}
+
+// discardResponse is a response writer that only keeps its headers.
+type discardResponse struct {
+	header http.Header
+}
+
+func (d *discardResponse) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponse) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardResponse) WriteHeader(int) {}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+const (
+	// maxBatchItems is the number of items that a batch can have.
+	maxBatchItems = 100
+	// defaultBatchParallelism is the number of items of a batch that run at the same time, unless the batch asks for another number.
+	defaultBatchParallelism = 4
+	// maxBatchParallelism is the most items of a batch that can run at the same time. The run limiter of the server still applies.
+	maxBatchParallelism = 16
+)
+
+// batchRequest runs a list of tools and files. Each item is a run of its own, with its own run ID.
+type batchRequest struct {
+	Items []toolOrFile `json:"items"`
+	// Parallelism is the number of items that run at the same time.
+	Parallelism int `json:"parallelism,omitempty"`
+}
+
+func (b *batchRequest) validate() error {
+	switch {
+	case len(b.Items) == 0:
+		return missingField("items", "at least one item is required")
+	case len(b.Items) > maxBatchItems:
+		return invalidField("items", fmt.Sprintf("a batch can have at most %d items", maxBatchItems))
+	case b.Parallelism < 0 || b.Parallelism > maxBatchParallelism:
+		return invalidField("parallelism", fmt.Sprintf("parallelism must be between 1 and %d", maxBatchParallelism))
+	}
+
+	for i, item := range b.Items {
+		if err := item.validate(); err != nil {
+			return batchItemError(i, err)
+		}
+		if err := rejectDryRun(item.options(), "the items of a batch"); err != nil {
+			return batchItemError(i, err)
+		}
+	}
+	return nil
+}
+
+// batchResult is the outcome of an item of a batch.
+type batchResult struct {
+	Item     int    `json:"item"`
+	RunID    string `json:"runID,omitempty"`
+	Stdout   string `json:"stdout"`
+	Encoding string `json:"encoding,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// batchItemError returns the error of an item of a batch, with the field of the error prefixed with the item.
+func batchItemError(i int, err error) error {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		return invalidField(fmt.Sprintf("items[%d]", i), fmt.Sprintf("item %d: %v", i, err))
+	}
+
+	field := fmt.Sprintf("items[%d]", i)
+	if reqErr.field != "" {
+		field += "." + reqErr.field
+	}
+	return &requestError{code: reqErr.code, field: field, msg: fmt.Sprintf("item %d: %s", i, reqErr.msg)}
+}
+
+// batch runs the items of the batch and returns all of their outputs once every item has finished. A batch succeeds even if some
+// of its items fail, and the error of each item is in its result.
+func (s *server) batch(w http.ResponseWriter, r *http.Request) {
+	runs, parallelism, ok := s.prepareBatch(w, r)
+	if !ok {
+		return
+	}
+
+	results := make([]batchResult, len(runs))
+	runBatch(runs, parallelism, func(i int, run preparedRun) {
+		results[i] = s.runBatchItem(r.Context(), i, run, discardEvents{}, nil)
+	})
+
+	writeResponse(w, batchResponse{Results: results})
+}
+
+// batchStream runs the items of the batch, streaming their events as server sent events or newline-delimited JSON. The events of
+// the items are interleaved, and the envelope of each event has the index of its item.
+func (s *server) batchStream(w http.ResponseWriter, r *http.Request) {
+	runs, parallelism, ok := s.prepareBatch(w, r)
+	if !ok {
+		return
+	}
+
+	l := ccontext.GetLogger(r.Context())
+	sw, closeStream := s.openStream(l, w, r)
+	defer closeStream()
+	sw = filterEvents(r, sw)
+
+	lock := new(sync.Mutex)
+	runBatch(runs, parallelism, func(i int, run preparedRun) {
+		bw := &batchItemWriter{lock: lock, w: sw, item: i}
+		result := s.runBatchItem(r.Context(), i, run, bw, notifyQueue(func(_ *slog.Logger, _ http.ResponseWriter, event any) {
+			bw.writeEvent(event)
+		}))
+
+		// Items that didn't start have no events, so their error is written here.
+		if result.RunID == "" {
+			bw.writeEvent(newEventEnvelope("", 0, events.Error{Time: time.Now(), Err: result.Error}))
+		}
+	})
+
+	sw.finish()
+}
+
+// prepareBatch decodes the batch, and checks that the caller is allowed to run each item before any of them run.
+// If it returns false, then the error has been written to the response.
+func (s *server) prepareBatch(w http.ResponseWriter, r *http.Request) ([]preparedRun, int, bool) {
+	req := new(batchRequest)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, 0, false
+	}
+
+	runs := make([]preparedRun, len(req.Items))
+	for i, item := range req.Items {
+		pr, code, err := s.prepareRun(r.Context(), ccontext.GetIdentity(r.Context()), item)
+		if err != nil {
+			writeError(w, code, batchItemError(i, err))
+			return nil, 0, false
+		}
+		runs[i] = pr
+	}
+
+	parallelism := req.Parallelism
+	if parallelism == 0 {
+		parallelism = defaultBatchParallelism
+	}
+
+	return runs, parallelism, true
+}
+
+// runBatch calls run for each item of the batch, with at most parallelism calls at the same time, and returns once every call has returned.
+func runBatch(runs []preparedRun, parallelism int, run func(int, preparedRun)) {
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, parallelism)
+	)
+	for i, br := range runs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			run(i, br)
+		}()
+	}
+	wg.Wait()
+}
+
+// runBatchItem runs an item of a batch as a run of its own, writing its events to the event writer.
+func (s *server) runBatchItem(ctx context.Context, i int, pr preparedRun, w eventWriter, queued queueNotifier) batchResult {
+	runID, out, err := s.runPrepared(ctx, pr, w, queued)
+	if err == nil {
+		out, err = transformOutput(ctx, pr.item.options().Transform, out)
+	}
+
+	result := batchResult{Item: i, RunID: runID}
+	result.Stdout, result.Encoding = encodeOutput(out)
+	if err != nil && runID == "" {
+		result.Error = fmt.Sprintf("run did not start: %v", err)
+	} else if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// batchItemWriter is an eventWriter for an item of a batch, which adds the index of the item to the events and writes them to the
+// stream of the batch. The stream is finished once every item has finished, not when an item does.
+type batchItemWriter struct {
+	lock *sync.Mutex
+	w    streamWriter
+	item int
+}
+
+func (b *batchItemWriter) writeEvent(event any) {
+	if e, ok := event.(events.Envelope); ok {
+		e.Item = &b.item
+		event = e
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.w.writeEvent(event)
+}
+
+func (b *batchItemWriter) finish() {}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/brokers"
+)
+
+const (
+	// brokerQueueSize is how many events can wait to be published to a broker. Events are dropped while the queue is full, so that
+	// a broker that is slow or down doesn't slow the runs down.
+	brokerQueueSize = 4096
+	// brokerBatchSize is the most events that are published to a broker at once.
+	brokerBatchSize = 256
+	// brokerPublishTimeout is how long a batch of events can take to be published.
+	brokerPublishTimeout = 30 * time.Second
+	// brokerCloseTimeout is how long the events that are waiting to be published are given to be published when the server stops.
+	brokerCloseTimeout = 10 * time.Second
+
+	brokerResultPublished = "published"
+	brokerResultFailed    = "failed"
+	brokerResultDropped   = "dropped"
+)
+
+// BrokerConfig configures a message broker that the events of runs are published to as they are kept in the run history, so that
+// other systems can consume them without streaming them. Each event is published as its envelope in JSON, with the ID of its run
+// as its key, like the lifecycle events of the run and the events of gptscript.
+type BrokerConfig struct {
+	// Type and URL are the type and the URL of the broker, as described by brokers.Config.
+	Type string
+	URL  string
+	// Topic is the subject of NATS, the topic of Kafka, or the stream of Redis that the events are published to.
+	Topic string
+	// Tenants are the tenants whose runs have their events published, where the empty name is the default tenant, and Events are
+	// the types of the events that are published. The events of every tenant, or of every type, are published if they are empty.
+	Tenants []string
+	Events  []string
+}
+
+func (c BrokerConfig) validate() error {
+	if err := (brokers.Config{Type: c.Type, URL: c.URL}).Validate(); err != nil {
+		return err
+	}
+	if c.Topic == "" {
+		return errors.New("the topic is required")
+	}
+	for _, tenant := range c.Tenants {
+		if err := validateTenant(tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventPublisher publishes the events of runs to the brokers, each in the background, in the order that they are written.
+type eventPublisher struct {
+	// lock is held to publish, and to close, so that no event is queued once the queues are closed.
+	lock   sync.RWMutex
+	closed bool
+	sinks  []*brokerSink
+	done   sync.WaitGroup
+}
+
+type brokerSink struct {
+	config    BrokerConfig
+	publisher brokers.Publisher
+	queue     chan brokers.Message
+	// failing is whether the last publish failed, so that only the changes between failing and publishing again are logged.
+	failing bool
+}
+
+// newEventPublisher returns the publisher of the events of runs to the brokers, or nil if there are none.
+func newEventPublisher(configs []BrokerConfig) (*eventPublisher, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	p := new(eventPublisher)
+	for _, c := range configs {
+		publisher, err := brokers.New(brokers.Config{Type: c.Type, URL: c.URL})
+		if err != nil {
+			for _, s := range p.sinks {
+				_ = s.publisher.Close()
+			}
+			return nil, err
+		}
+		p.sinks = append(p.sinks, &brokerSink{config: c, publisher: publisher, queue: make(chan brokers.Message, brokerQueueSize)})
+	}
+
+	for _, s := range p.sinks {
+		p.done.Add(1)
+		go func() {
+			defer p.done.Done()
+			s.run()
+		}()
+	}
+	return p, nil
+}
+
+// publish queues the event of the run of the tenant to be published to the brokers that it matches. The event is dropped for the
+// brokers whose queues are full.
+func (p *eventPublisher) publish(tenant, runID, eventType string, data []byte) {
+	if p == nil {
+		return
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return
+	}
+
+	for _, s := range p.sinks {
+		if !s.matches(tenant, eventType) {
+			continue
+		}
+
+		select {
+		case s.queue <- brokers.Message{Topic: s.config.Topic, Key: runID, Value: data}:
+		default:
+			brokerEvents.WithLabelValues(s.config.Type, brokerResultDropped).Inc()
+		}
+	}
+}
+
+// close stops queuing events, and closes the brokers once the queued events have been published, or once they have been given
+// brokerCloseTimeout to be.
+func (p *eventPublisher) close() {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	p.closed = true
+	for _, s := range p.sinks {
+		close(s.queue)
+	}
+	p.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.done.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(brokerCloseTimeout):
+		slog.Warn("Stopped publishing events to brokers before they were all published")
+	}
+
+	for _, s := range p.sinks {
+		if err := s.publisher.Close(); err != nil {
+			slog.Error("Failed to close broker", "type", s.config.Type, "error", err)
+		}
+	}
+}
+
+func (s *brokerSink) matches(tenant, eventType string) bool {
+	return (len(s.config.Tenants) == 0 || slices.Contains(s.config.Tenants, tenant)) &&
+		(len(s.config.Events) == 0 || slices.Contains(s.config.Events, eventType))
+}
+
+// run publishes the queued events until the queue is closed. The events that are queued while a batch is published are published
+// together in the next batch.
+func (s *brokerSink) run() {
+	l := slog.Default().With("type", s.config.Type, "topic", s.config.Topic)
+	for m := range s.queue {
+		batch := []brokers.Message{m}
+	drain:
+		for len(batch) < brokerBatchSize {
+			select {
+			case m, ok := <-s.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, m)
+			default:
+				break drain
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), brokerPublishTimeout)
+		err := s.publisher.Publish(ctx, batch...)
+		cancel()
+
+		if err != nil {
+			brokerEvents.WithLabelValues(s.config.Type, brokerResultFailed).Add(float64(len(batch)))
+			if !s.failing {
+				l.Warn("Failed to publish events to broker", "events", len(batch), "error", err)
+			} else {
+				l.Debug("failed to publish events to broker", "events", len(batch), "error", err)
+			}
+			s.failing = true
+			continue
+		}
+
+		brokerEvents.WithLabelValues(s.config.Type, brokerResultPublished).Add(float64(len(batch)))
+		if s.failing {
+			l.Info("Published events to broker again")
+			s.failing = false
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+const cacheHeader = "X-Cache"
+
+// resultCache keeps the stdout of successful runs, so that repeating a run returns the same output without running it again.
+type resultCache struct {
+	lock       sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	output  string
+	expires time.Time
+}
+
+// newResultCache returns a cache that keeps results for the TTL, or nil if the TTL is not positive. If the cache has maxEntries
+// entries, then the entry that expires soonest is evicted to make room for a new one.
+func newResultCache(ttl time.Duration, maxEntries int) *resultCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &resultCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]cacheEntry)}
+}
+
+func (c *resultCache) get(key string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.output, true
+}
+
+func (c *resultCache) set(key, output string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	if _, ok := c.entries[key]; !ok && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		var (
+			oldest  string
+			expires time.Time
+		)
+		for k, e := range c.entries {
+			if oldest == "" || e.expires.Before(expires) {
+				oldest, expires = k, e.expires
+			}
+		}
+		delete(c.entries, oldest)
+	}
+
+	c.entries[key] = cacheEntry{output: output, expires: now.Add(c.ttl)}
+}
+
+type noCacheKey struct{}
+
+// withoutResultCache marks the run as one that must not be served from, or stored in, the result cache.
+func withoutResultCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+func useResultCache(ctx context.Context) bool {
+	noCache, _ := ctx.Value(noCacheKey{}).(bool)
+	return !noCache
+}
+
+// cacheKey returns the key of a run from everything that determines its output: the options, including the defaults, the tool or
+// the content of the file, the input, and the environment that was requested for it. The tenant of the run is part of the key, so
+// that tenants never get each other's results.
+func cacheKey(ctx context.Context, opts requestOpts, parts ...string) (string, error) {
+	b, err := json.Marshal(map[string]any{
+		"opts":   applyDefaultOpts(ctx, opts),
+		"parts":  parts,
+		"env":    ccontext.GetRunEnv(ctx),
+		"tenant": tenantOf(ctx),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// cachedTool wraps the process function of a tool run so that its output is served from the result cache if it is there, and
+// stored in the cache if the run succeeds.
+func (s *server) cachedTool(process func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, tool fmt.Stringer) (string, error)) func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, tool fmt.Stringer) (string, error) {
+	if s.cache == nil {
+		return process
+	}
+
+	return func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, tool fmt.Stringer) (string, error) {
+		key, err := cacheKey(ctx, opts, "tool", tool.String())
+		if err != nil {
+			l.Warn("failed to compute cache key", "error", err)
+			return process(ctx, l, w, opts, tool)
+		}
+
+		return s.cached(ctx, l, w, key, func() (string, error) {
+			return process(ctx, l, w, opts, tool)
+		})
+	}
+}
+
+// cachedFile wraps the process function of a file run in the same way as cachedTool. Only the content of the file itself is part
+// of the key, so changes to the files that it refers to aren't noticed until the cached result expires.
+func (s *server) cachedFile(process func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error)) func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error) {
+	if s.cache == nil {
+		return process
+	}
+
+	return func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			// The file may not be local, like a URL, in which case its content can't be known, so the run isn't cached.
+			return process(ctx, l, w, opts, path, input)
+		}
+
+		sum := sha256.Sum256(content)
+		key, err := cacheKey(ctx, opts, "file", path, hex.EncodeToString(sum[:]), input)
+		if err != nil {
+			l.Warn("failed to compute cache key", "error", err)
+			return process(ctx, l, w, opts, path, input)
+		}
+
+		return s.cached(ctx, l, w, key, func() (string, error) {
+			return process(ctx, l, w, opts, path, input)
+		})
+	}
+}
+
+// cached writes the cached output for the key to the response if there is one. Otherwise, it runs the process function, and
+// caches its output if it succeeds.
+func (s *server) cached(ctx context.Context, l *slog.Logger, w http.ResponseWriter, key string, process func() (string, error)) (string, error) {
+	if !useResultCache(ctx) {
+		return process()
+	}
+
+	// Output that was cached for a run without an output schema is only served if it conforms to the schema of this run.
+	if out, ok := s.cache.get(key); ok && runOutputSchema(ctx).check(out) == nil {
+		cacheLookups.WithLabelValues(cacheResultHit).Inc()
+		l.Debug("serving run from the result cache")
+
+		w.Header().Set(cacheHeader, "HIT")
+		writeOutput(ctx, w, out)
+		return out, nil
+	}
+
+	cacheLookups.WithLabelValues(cacheResultMiss).Inc()
+	w.Header().Set(cacheHeader, "MISS")
+
+	out, err := process()
+	if err == nil {
+		s.cache.set(key, out)
+	}
+	return out, err
+}
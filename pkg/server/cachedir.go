@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// defaultCacheName is the name of the cache directory of a tenant that runs use if they don't set a cacheDir.
+const defaultCacheName = "default"
+
+// cacheNamePattern is what the cacheDir of a run must look like when the server has a cache root: the name of one of the cache
+// directories of the tenant of the run, which can't reach outside of them.
+var cacheNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// validateCacheName checks the cacheDir of a run or of default options when the server has a cache root.
+func validateCacheName(name string) error {
+	if name != "" && !cacheNamePattern.MatchString(name) {
+		return invalidField("cacheDir", fmt.Sprintf("invalid cacheDir %q, which must be the name of a cache directory, like project-a, since the caches are kept by the server", name))
+	}
+	return nil
+}
+
+// checkCacheDir returns an error if the server has a cache root and the cacheDir of the options isn't the name of a cache directory.
+func (s *server) checkCacheDir(cacheDir string) error {
+	if s.current().config.CacheRoot == "" {
+		return nil
+	}
+	return validateCacheName(cacheDir)
+}
+
+type cacheRootKey struct{}
+
+// withCacheRoot sets the directory that the cache directories of gptscript are kept under, if the server has one.
+func withCacheRoot(ctx context.Context, root string) context.Context {
+	if root == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, cacheRootKey{}, root)
+}
+
+// scopeCacheDir returns the cache directory of gptscript for the cacheDir of a run of the tenant, which is a directory of the tenant
+// under the cache root of the context if it has one, so that tenants never share cached prompts and responses. Without a cache root,
+// the cacheDir is used as it is.
+func scopeCacheDir(ctx context.Context, tenant, cacheDir string) string {
+	root, _ := ctx.Value(cacheRootKey{}).(string)
+	if root == "" {
+		return cacheDir
+	}
+
+	// The cacheDir was checked with the run, so this only keeps a name that wasn't from reaching outside of the tenant.
+	if !cacheNamePattern.MatchString(cacheDir) {
+		cacheDir = defaultCacheName
+	}
+	return filepath.Join(tenantCacheRoot(root, tenant), cacheDir)
+}
+
+// tenantCacheRoot returns the directory of the cache directories of the tenant, which is laid out like the uploaded files.
+func tenantCacheRoot(root, tenant string) string {
+	if tenant == "" {
+		return root
+	}
+	return filepath.Join(root, ".tenants", tenant)
+}
+
+// cacheRootDirs returns the cache directories of every tenant under the cache root.
+func cacheRootDirs(root string) []string {
+	var dirs []string
+	add := func(dir string) {
+		des, _ := os.ReadDir(dir)
+		for _, de := range des {
+			if de.IsDir() && !hiddenEntry(de.Name()) {
+				dirs = append(dirs, filepath.Join(dir, de.Name()))
+			}
+		}
+	}
+
+	add(root)
+	tenants, _ := os.ReadDir(filepath.Join(root, ".tenants"))
+	for _, tenant := range tenants {
+		add(filepath.Join(root, ".tenants", tenant.Name()))
+	}
+	return dirs
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/runner"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+// callRequest calls a registered tool like a function: its arguments are typed JSON that is checked against the arguments that
+// the tool declares, and its output is the JSON that the tool writes to stdout.
+type callRequest struct {
+	runOptions `json:",inline"`
+	// Args are the arguments of the tool, which are passed to it as a JSON object.
+	Args map[string]json.RawMessage `json:"args,omitempty"`
+	// Version is the version of the tool to call, or 0 for its latest version.
+	Version int `json:"version,omitempty"`
+	// SubTool is the name of the tool of the registered tool to call, instead of its first tool.
+	SubTool string `json:"subTool,omitempty"`
+}
+
+func (c *callRequest) validate() error {
+	if c.Version < 0 {
+		return invalidField("version", "version must be positive")
+	}
+	return c.runOptions.validate()
+}
+
+// callResponse is the output of a call of a registered tool. The output is the stdout of the tool as the JSON value that it is, or
+// as a string if it isn't JSON, which is base64 encoded if the encoding says so.
+type callResponse struct {
+	RunID    string          `json:"runID,omitempty"`
+	Output   json.RawMessage `json:"output"`
+	Encoding string          `json:"encoding,omitempty"`
+}
+
+// callRegisteredTool runs the registered tool of the path with the typed arguments of the request, once they are checked against
+// the arguments that the tool declares, and responds with the output of the tool as JSON. Calls aren't served from the result
+// cache, since their responses aren't the responses of runs.
+func (s *server) callRegisteredTool(w http.ResponseWriter, r *http.Request) {
+	req := new(callRequest)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tool, code, err := s.getRegisteredTool(r, req.Version)
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	if code, err = s.checkCallArgs(r.Context(), tool, req.SubTool, req.Args); err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	fr := &fileRequest{runOptions: req.runOptions, requestOpts: requestOpts{SubTool: req.SubTool}, File: registryHandle(tool.Name, tool.Version)}
+	if len(req.Args) > 0 {
+		input, err := json.Marshal(req.Args)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal arguments: %w", err))
+			return
+		}
+		fr.Input = string(input)
+	}
+	if err = fr.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.runFile(w, r, fr, true, callFile, nil)
+}
+
+// checkCallArgs checks the arguments against the arguments of the tool of the registered tool that is called, which is its first
+// tool unless the subTool is another: that they are the arguments that it declares, and that their values match the schemas of
+// those arguments. The returned status code is the status of the error.
+func (s *server) checkCallArgs(ctx context.Context, tool store.Tool, subTool string, args map[string]json.RawMessage) (int, error) {
+	ctx, cancel := s.commandContext(ctx)
+	defer cancel()
+	ctx, cancel = s.parseContext(ctx)
+	defer cancel()
+
+	nodes, err := runner.ParseTool(ctx, tool.Content, runnerOptions(ctx, requestOpts{}))
+	if err != nil {
+		return engineError(ctx, err, "failed to parse tool")
+	}
+	entry, _, err := entryTool(nodes, subTool)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if err = checkArgs(entry, args); err != nil {
+		// The arguments of a call are its args, not the input of a run.
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			reqErr.field = "args"
+		}
+		return http.StatusBadRequest, err
+	}
+	if entry.Arguments == nil {
+		return 0, nil
+	}
+
+	// The arguments of gptscript tools are OpenAPI schemas, which are JSON schemas for the arguments that tools declare.
+	b, err := json.Marshal(entry.Arguments)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to marshal the arguments of tool %q: %w", entry.Name, err)
+	}
+	schema, err := compileSchema(b)
+	if err != nil {
+		ccontext.GetLogger(ctx).Debug("not checking the types of the arguments because their schema doesn't compile", "tool", tool.Name, "error", err)
+		return 0, nil
+	}
+
+	values := make(map[string]any, len(args))
+	for name, raw := range args {
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		var v any
+		if err = d.Decode(&v); err != nil {
+			return http.StatusBadRequest, invalidField("args."+name, fmt.Sprintf("invalid argument %q: %v", name, err))
+		}
+		values[name] = v
+	}
+
+	var validationErr *jsonschema.ValidationError
+	if err = schema.Validate(values); errors.As(err, &validationErr) {
+		return http.StatusBadRequest, invalidField("args", fmt.Sprintf("invalid arguments for tool %q: %s", entry.Name, strings.Join(schemaDiagnostics(validationErr), "; ")))
+	} else if err != nil {
+		return http.StatusBadRequest, invalidField("args", fmt.Sprintf("invalid arguments for tool %q: %v", entry.Name, err))
+	}
+	return 0, nil
+}
+
+// callFile runs the file like execFile, and writes the output to the response as a callResponse. The output is also returned.
+func callFile(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error) {
+	ctx, span := startSpan(ctx, "exec")
+	out, err := retryRun(ctx, l, nil, func(eventWriter) (string, error) {
+		return runner.ExecFile(ctx, path, input, runnerOptions(ctx, opts))
+	})
+	if err = endSpan(span, err); err != nil {
+		l.Error("failed to call tool", "error", err)
+		writeEngineError(ctx, w, err, "failed to call tool")
+		return "", err
+	}
+
+	transformed, err := transformOutput(ctx, runOutputTransform(ctx), out)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return out, nil
+	}
+
+	resp := callResponse{RunID: w.Header().Get(runIDHeader)}
+	if trimmed := bytes.TrimSpace([]byte(transformed)); json.Valid(trimmed) {
+		resp.Output = trimmed
+	} else {
+		var encoded string
+		encoded, resp.Encoding = encodeOutput(transformed)
+		resp.Output, _ = json.Marshal(encoded)
+	}
+	writeResponse(w, resp)
+	return out, nil
+}
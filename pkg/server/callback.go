@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// callbackSignatureHeader has the HMAC-SHA256 of the timestamp and the body of a callback, as sha256=<hex>.
+	callbackSignatureHeader = "X-Clicky-Serves-Signature"
+	// callbackTimestampHeader has the Unix time at which a callback was signed, so that receivers can reject old callbacks.
+	callbackTimestampHeader = "X-Clicky-Serves-Timestamp"
+
+	callbackAttempts = 5
+	callbackTimeout  = 10 * time.Second
+	// callbackBackoff is the wait before the second attempt, which doubles for every attempt after it.
+	callbackBackoff = time.Second
+
+	callbackResultDelivered = "delivered"
+	callbackResultFailed    = "failed"
+)
+
+// errCallbackAddressBlocked is the error of a callback to an address that isn't public, which isn't retried.
+var errCallbackAddressBlocked = errors.New("callbacks can't be sent to addresses that aren't public")
+
+// nonPublicNetworks are the networks that aren't public, but that net/netip doesn't consider private, like the shared address
+// space that some clouds serve their metadata from.
+var nonPublicNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+// publicAddr reports whether the address is public, rather than loopback, private, link-local, like the metadata endpoints of
+// clouds, or otherwise reserved.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	return !slices.ContainsFunc(nonPublicNetworks, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// parseCallbackNetworks parses the networks that callbacks can be sent to even though they aren't public, which are CIDRs, like
+// 10.0.0.0/8, or IP addresses.
+func parseCallbackNetworks(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, n := range networks {
+		if addr, err := netip.ParseAddr(n); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		p, err := netip.ParsePrefix(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid callback network %q, must be a CIDR or an IP address", n)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// newCallbackClient returns the client that callbacks are sent with. The client only connects to public addresses and the allowed
+// networks, which is checked once the host of the callback URL has been resolved, so that clients can't make the server post
+// the outputs of runs to its own network or to the metadata endpoint of its cloud, even through DNS or redirects. Callbacks
+// don't go through the proxy of the environment, since the address of the proxy is all that the client would check.
+func newCallbackClient(allowed []netip.Prefix) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: callbackTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+
+			if !publicAddr(addr) && !slices.ContainsFunc(allowed, func(p netip.Prefix) bool { return p.Contains(addr.Unmap()) }) {
+				return fmt.Errorf("%w: %s", errCallbackAddressBlocked, addr)
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport, Timeout: callbackTimeout}
+}
+
+// validateCallbackURL checks that the callback URL is an absolute HTTP or HTTPS URL.
+func validateCallbackURL(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalidField("callbackURL", "callbackURL must be an absolute http or https URL")
+	}
+	return nil
+}
+
+type callbackKey struct{}
+
+// withCallback sets the URL that the outcome of the run is sent to when it ends.
+func withCallback(ctx context.Context, callbackURL string) context.Context {
+	return context.WithValue(ctx, callbackKey{}, callbackURL)
+}
+
+func callbackURL(ctx context.Context) string {
+	u, _ := ctx.Value(callbackKey{}).(string)
+	return u
+}
+
+// callback sends the outcome of the run to the callback URL of the run in the background, if it has one.
+func (s *server) callback(ctx context.Context, l *slog.Logger, runID string) {
+	if u := callbackURL(ctx); u != "" {
+		go s.sendCallback(l, u, runID)
+	}
+}
+
+// sendCallback sends the outcome of the run to the callback URL, retrying with backoff if the receiver can't be reached or
+// responds with an error that may be temporary. It is meant to be called in its own goroutine once the run has ended.
+func (s *server) sendCallback(l *slog.Logger, callbackURL, runID string) {
+	payload, err := s.runOutput(context.Background(), runID)
+	if err != nil {
+		l.Error("Failed to build callback", "error", err)
+		callbackDeliveries.WithLabelValues(callbackResultFailed).Inc()
+		return
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		l.Error("Failed to marshal callback", "error", err)
+		callbackDeliveries.WithLabelValues(callbackResultFailed).Inc()
+		return
+	}
+
+	backoff := callbackBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.postCallback(callbackURL, runID, body)
+		if err == nil {
+			l.Debug("Delivered callback", "attempt", attempt)
+			callbackDeliveries.WithLabelValues(callbackResultDelivered).Inc()
+			return
+		}
+
+		if !retry || attempt == callbackAttempts {
+			l.Warn("Failed to deliver callback", "attempt", attempt, "error", err)
+			callbackDeliveries.WithLabelValues(callbackResultFailed).Inc()
+			return
+		}
+
+		l.Debug("Retrying callback", "attempt", attempt, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postCallback makes one attempt to deliver the callback. If it fails, then the returned bool is whether it is worth retrying.
+func (s *server) postCallback(callbackURL, runID string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(runIDHeader, runID)
+	if secret := s.current().config.CallbackSecret; secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(callbackTimestampHeader, timestamp)
+		req.Header.Set(callbackSignatureHeader, "sha256="+signCallback(secret, timestamp, body))
+	}
+
+	resp, err := s.current().callbacks.Do(req)
+	if err != nil {
+		return !errors.Is(err, errCallbackAddressBlocked), err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	// Other client errors mean that the callback was rejected, so sending it again won't help.
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("callback URL responded with %s", resp.Status)
+}
+
+// signCallback returns the hex encoded HMAC-SHA256 of the timestamp and the body, joined by a period.
+func signCallback(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "93.184.216.34", want: true},
+		{addr: "2606:2800:220:1:248:1893:25c8:1946", want: true},
+		{addr: "127.0.0.1"},
+		{addr: "::1"},
+		{addr: "10.1.2.3"},
+		{addr: "172.16.0.1"},
+		{addr: "192.168.1.1"},
+		{addr: "169.254.169.254"},
+		{addr: "fe80::1"},
+		{addr: "fd00:ec2::254"},
+		{addr: "100.100.100.200"},
+		{addr: "0.0.0.0"},
+		{addr: "::"},
+		{addr: "224.0.0.1"},
+		{addr: "::ffff:127.0.0.1"},
+		{addr: "::ffff:169.254.169.254"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCallbackNetworks(t *testing.T) {
+	prefixes, err := parseCallbackNetworks([]string{"10.0.0.0/8", "192.168.1.5", "fd00::/8", "10.1.2.3/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"10.0.0.0/8", "192.168.1.5/32", "fd00::/8", "10.1.0.0/16"}
+	for i, p := range prefixes {
+		if p.String() != want[i] {
+			t.Errorf("got network %s, want %s", p, want[i])
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "example.com", ""} {
+		if _, err = parseCallbackNetworks([]string{invalid}); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestCallbackClient(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	// Redirects to addresses that aren't public are refused too, even from an allowed receiver.
+	redirect := httptest.NewServer(http.RedirectHandler(receiver.URL, http.StatusFound))
+	defer redirect.Close()
+
+	tests := []struct {
+		name      string
+		allowed   []string
+		url       string
+		wantRetry bool
+		wantErr   error
+	}{
+		{name: "loopback", url: receiver.URL, wantErr: errCallbackAddressBlocked},
+		{name: "cloud metadata", url: "http://169.254.169.254/latest/meta-data/", wantErr: errCallbackAddressBlocked},
+		{name: "loopback by name", url: "http://localhost:1/", wantErr: errCallbackAddressBlocked},
+		{name: "allowed network", allowed: []string{"127.0.0.0/8", "::1"}, url: receiver.URL},
+		{name: "allowed address", allowed: []string{"127.0.0.1", "::1"}, url: redirect.URL},
+		{name: "other allowed network", allowed: []string{"10.0.0.0/8"}, url: redirect.URL, wantErr: errCallbackAddressBlocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, err := parseCallbackNetworks(tt.allowed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := new(server)
+			s.settings.Store(&settings{callbacks: newCallbackClient(networks)})
+
+			retry, err := s.postCallback(tt.url, "run", []byte("{}"))
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if retry != tt.wantRetry {
+				t.Errorf("got retry %v, want %v", retry, tt.wantRetry)
+			}
+		})
+	}
+}
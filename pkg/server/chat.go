@@ -0,0 +1,448 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/events"
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+// chatRetention is how long a chat session is kept after its last turn.
+const chatRetention = time.Hour
+
+var (
+	errChatNotFound = errors.New("chat not found")
+	errChatBusy     = errors.New("chat is already running a turn")
+	errChatDone     = errors.New("chat has ended")
+)
+
+// chatRequest starts a chat with exactly one of a tool or a file, which must be chat-enabled.
+type chatRequest struct {
+	Tool *toolRequest `json:"tool,omitempty"`
+	File *fileRequest `json:"file,omitempty"`
+}
+
+func (c *chatRequest) validate() error {
+	if err := validateToolOrFile(c.Tool, c.File); err != nil {
+		return err
+	}
+	return rejectDryRun(c.options(), "chats")
+}
+
+// options returns the options of the tool or file that are handled by the server.
+func (c chatRequest) options() runOptions {
+	if c.Tool != nil {
+		return c.Tool.runOptions
+	}
+	return c.File.runOptions
+}
+
+// chatMessage is a message sent by the client to a chat.
+type chatMessage struct {
+	Message string `json:"message"`
+}
+
+// chatTurn is the input of the run of a turn of a chat.
+type chatTurn struct {
+	Chat    string `json:"chat"`
+	Message string `json:"message"`
+}
+
+// chatResponse is the output of gptscript for a turn of a chat.
+type chatResponse struct {
+	Done    bool            `json:"done"`
+	Content string          `json:"content"`
+	ToolID  string          `json:"toolID,omitempty"`
+	State   json.RawMessage `json:"state,omitempty"`
+}
+
+type chatSession struct {
+	ID        string      `json:"id"`
+	Request   chatRequest `json:"request"`
+	Turns     int         `json:"turns"`
+	Done      bool        `json:"done"`
+	Running   bool        `json:"running"`
+	CreatedAt time.Time   `json:"createdAt"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+	LastRunID string      `json:"lastRunID,omitempty"`
+	owner     chatCaller
+	// session is the ID of the session that the chat was created with, whose workspace and credentials its turns use.
+	session string
+	state   json.RawMessage
+}
+
+// chatCaller is the caller that owns a chat. Callers are told apart by their tenant as well as their name, so that callers of
+// different tenants with the same name can't use each other's chats.
+type chatCaller struct {
+	tenant string
+	name   string
+}
+
+// chatRegistry keeps the state of chats between turns.
+type chatRegistry struct {
+	lock  sync.Mutex
+	chats map[string]*chatSession
+}
+
+func newChatRegistry() *chatRegistry {
+	return &chatRegistry{chats: make(map[string]*chatSession)}
+}
+
+func (cr *chatRegistry) create(owner chatCaller, session string, req chatRequest) chatSession {
+	now := time.Now()
+	c := &chatSession{
+		ID:        uuid.NewString(),
+		Request:   req,
+		CreatedAt: now,
+		UpdatedAt: now,
+		owner:     owner,
+		session:   session,
+	}
+
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	cr.prune()
+	cr.chats[c.ID] = c
+
+	return *c
+}
+
+// get returns the chat with the given ID, if it is owned by the owner.
+func (cr *chatRegistry) get(id string, owner chatCaller) (chatSession, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	c, ok := cr.chats[id]
+	if !ok || c.owner != owner {
+		return chatSession{}, errChatNotFound
+	}
+
+	return *c, nil
+}
+
+func (cr *chatRegistry) delete(id string, owner chatCaller) error {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	c, ok := cr.chats[id]
+	if !ok || c.owner != owner {
+		return errChatNotFound
+	}
+
+	delete(cr.chats, id)
+	return nil
+}
+
+// startTurn marks the chat as running a turn, so that only one turn runs at a time, and returns the state to continue the chat with.
+func (cr *chatRegistry) startTurn(id string, owner chatCaller) (chatSession, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	c, ok := cr.chats[id]
+	switch {
+	case !ok || c.owner != owner:
+		return chatSession{}, errChatNotFound
+	case c.Done:
+		return chatSession{}, errChatDone
+	case c.Running:
+		return chatSession{}, errChatBusy
+	}
+
+	c.Running = true
+	c.UpdatedAt = time.Now()
+	return *c, nil
+}
+
+// endTurn records the outcome of a turn. If the turn failed, then the state of the chat is left as it was, so the message can be sent again.
+func (cr *chatRegistry) endTurn(id, runID string, resp *chatResponse) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	c, ok := cr.chats[id]
+	if !ok {
+		return
+	}
+
+	c.Running = false
+	c.UpdatedAt = time.Now()
+	c.LastRunID = runID
+	if resp != nil {
+		c.Turns++
+		c.Done = resp.Done
+		c.state = resp.State
+	}
+}
+
+// prune removes the chats that haven't had a turn for chatRetention. The lock must be held by the caller.
+func (cr *chatRegistry) prune() {
+	for id, c := range cr.chats {
+		if !c.Running && time.Since(c.UpdatedAt) > chatRetention {
+			delete(cr.chats, id)
+		}
+	}
+}
+
+// chatOwner returns the name of the caller, which is the only one that can use the chats it creates.
+func chatOwner(r *http.Request) string {
+	if id := ccontext.GetIdentity(r.Context()); id != nil {
+		return id.Name
+	}
+	return ""
+}
+
+// chatCallerOf returns the caller of the request, as the owner of the chats it creates.
+func chatCallerOf(r *http.Request) chatCaller {
+	return chatCaller{tenant: tenantOf(r.Context()), name: chatOwner(r)}
+}
+
+// createChat creates a chat with a chat-enabled tool or file. Messages are sent to the chat with sendChatMessage.
+func (s *server) createChat(w http.ResponseWriter, r *http.Request) {
+	req := new(chatRequest)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var path string
+	if req.File != nil {
+		path = req.File.File
+	}
+
+	if !allowedToolPath(ccontext.GetIdentity(r.Context()), path) {
+		writeError(w, http.StatusForbidden, errors.New("not allowed to run this tool"))
+		return
+	}
+
+	resolved, limits, code, err := s.resolveFile(r.Context(), path)
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	// The limits of a registered tool are applied to each turn, since each turn runs the latest version of the tool.
+	opts, err := limits.options(req.options(), s.current().config.DefaultModel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := s.runTimeout(opts.Timeout); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	env, err := s.runEnv(r.Context(), opts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if code, err := s.checkRun(r.Context(), toolOrFile{Tool: req.Tool, File: req.File}, env, resolved); err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	var sessionID string
+	if sess := sessionOf(r.Context()); sess != nil {
+		sessionID = sess.id
+	}
+	c := s.chats.create(chatCallerOf(r), sessionID, *req)
+	if sessionID != "" {
+		s.sessions.bindChat(r.Context(), sessionID, c.ID)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	writeResponse(w, c)
+}
+
+func (s *server) getChat(w http.ResponseWriter, r *http.Request) {
+	c, err := s.chats.get(r.PathValue("id"), chatCallerOf(r))
+	if err != nil {
+		writeError(w, chatErrorCode(err), err)
+		return
+	}
+
+	writeResponse(w, c)
+}
+
+func (s *server) deleteChat(w http.ResponseWriter, r *http.Request) {
+	if err := s.chats.delete(r.PathValue("id"), chatCallerOf(r)); err != nil {
+		writeError(w, chatErrorCode(err), err)
+		return
+	}
+
+	writeResponse(w, map[string]string{"status": "ok"})
+}
+
+// sendChatMessage runs a turn of the chat with the message as input, streaming the events of the turn as server sent events
+// or newline-delimited JSON.
+// The last stdout event has the reply of the tool, and whether the chat has ended.
+func (s *server) sendChatMessage(w http.ResponseWriter, r *http.Request) {
+	msg := new(chatMessage)
+	if err := decodeRequest(r.Body, msg); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.limits().checkInput("message", msg.Message); err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	c, err := s.chats.startTurn(r.PathValue("id"), chatCallerOf(r))
+	if err != nil {
+		writeError(w, chatErrorCode(err), err)
+		return
+	}
+
+	var (
+		resp  *chatResponse
+		runID string
+	)
+	defer func() {
+		s.chats.endTurn(c.ID, runID, resp)
+	}()
+
+	// The turns of a chat that was created with a session use the session, whether or not the message was sent with its token.
+	if c.session != "" {
+		sess, err := s.sessions.getByID(r.Context(), c.session, chatCallerOf(r))
+		if err != nil {
+			writeError(w, http.StatusNotFound, errors.New("the session of the chat was deleted or has expired"))
+			return
+		}
+		r = r.WithContext(withSession(r.Context(), sess))
+	}
+
+	var (
+		path   string
+		limits *toolLimits
+	)
+	if c.Request.File != nil {
+		var code int
+		if path, limits, code, err = s.resolveFile(r.Context(), c.Request.File.File); err != nil {
+			writeError(w, code, err)
+			return
+		}
+	}
+
+	opts, err := limits.options(c.Request.options(), s.current().config.DefaultModel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	timeout, err := s.runTimeout(opts.Timeout)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	timeout = limits.runTimeout(timeout)
+
+	env, err := s.runEnv(r.Context(), opts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// The turn is given to the run by a pointer, so that the hooks of the run can change its message.
+	turn := &chatTurn{Chat: c.ID, Message: msg.Message}
+	ctx, l, end, err := s.beginRun(limits.context(opts.context(r.Context(), env)), runTypeChat, turn, timeout, w, queuePositionWriter(r))
+	if err != nil {
+		writeRunError(w, err)
+		return
+	}
+	runID = ccontext.GetRunID(ctx)
+
+	state := "null"
+	if len(c.state) > 0 {
+		state = string(c.state)
+	}
+
+	sw, closeStream := s.openStream(l, w, r)
+	defer closeStream()
+	sw = filterEvents(r, sw)
+
+	l.Debug("sending chat message", "chat", c.ID, "message", turn.Message)
+	resp, err = execChatTurn(ctx, l, s.runEventWriter(ctx, l, sw), c, path, state, turn.Message)
+	if err != nil {
+		resp = nil
+		end("", err)
+		return
+	}
+
+	end(resp.Content, nil)
+}
+
+// execChatTurn runs a turn of the chat, and streams the events to the event writer. If the chat is with a file, then path is the
+// path of the file to run.
+func execChatTurn(ctx context.Context, l *slog.Logger, w eventWriter, c chatSession, path, state, message string) (*chatResponse, error) {
+	ctx, span := startSpan(ctx, "chat")
+
+	// The response of the turn is the response of its last attempt.
+	cw := &chatWriter{eventWriter: w}
+	_, err := retryRun(ctx, l, cw, func(w eventWriter) (string, error) {
+		var (
+			stdout, stderr, events io.Reader
+			wait                   func() error
+		)
+		if c.Request.Tool != nil {
+			opts := runnerOptions(ctx, c.Request.Tool.requestOpts)
+			opts.ChatState = state
+			stdout, stderr, events, wait = runner.StreamExecToolInputWithEvents(ctx, message, opts, c.Request.Tool.tool())
+		} else {
+			opts := runnerOptions(ctx, c.Request.File.requestOpts)
+			opts.ChatState = state
+			stdout, stderr, events, wait = runner.StreamExecFileWithEvents(ctx, path, message, opts)
+		}
+
+		return processEventStreamOutput(ctx, l, w, stdout, stderr, events, wait)
+	})
+	if err = endSpan(span, err); err != nil {
+		return nil, err
+	}
+
+	return &cw.resp, nil
+}
+
+// chatWriter is an eventWriter that replaces the stdout of a chat turn, which is the chat response, with the reply of the tool
+// and whether the chat has ended. The chat response is kept so that the state of the chat can be saved.
+type chatWriter struct {
+	eventWriter
+	resp chatResponse
+}
+
+func (c *chatWriter) writeEvent(event any) {
+	e, ok := event.(events.Stdout)
+	if !ok {
+		c.eventWriter.writeEvent(event)
+		return
+	}
+
+	// A tool that is not chat-enabled only has output, which ends the chat.
+	if err := json.Unmarshal([]byte(e.Stdout), &c.resp); err != nil {
+		c.resp = chatResponse{Done: true, Content: e.Stdout}
+	}
+
+	done := c.resp.Done
+	c.eventWriter.writeEvent(events.Stdout{Time: e.Time, Stdout: c.resp.Content, Done: &done})
+}
+
+func chatErrorCode(err error) int {
+	switch {
+	case errors.Is(err, errChatNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errChatBusy), errors.Is(err, errChatDone):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
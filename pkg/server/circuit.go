@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+const (
+	// defaultCircuitMinRuns is the number of runs that a circuit needs to have seen before it can open, if it isn't configured.
+	defaultCircuitMinRuns = 5
+	// defaultCircuitWindow is the number of the latest runs that the failure rate of a circuit is computed from, if it isn't
+	// configured.
+	defaultCircuitWindow = 20
+	// defaultCircuitCooldown is how long a circuit stays open before a run is let through to probe the provider, if it isn't
+	// configured.
+	defaultCircuitCooldown = 30 * time.Second
+
+	// defaultProvider is the name of the provider of runs that aren't routed to one, which use the provider of the server.
+	defaultProvider = "default"
+)
+
+// providerErrorPattern matches the errors that mean that the provider of the model failed, rather than the run: errors of the
+// provider itself, and failures to reach it.
+var providerErrorPattern = regexp.MustCompile(`(?i)status(?: code)?:?\s*5\d\d\b|connection refused|connection reset|no such host|i/o timeout|TLS handshake timeout`)
+
+// The states of a circuit, which are also the values of the circuit state metric.
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+// CircuitBreakerConfig configures the circuit breakers of the providers of models. When the runs of a provider fail because of
+// the provider too often, its circuit opens, and its runs are rejected right away instead of starting processes that would fail.
+// Once the cooldown has passed, one run is let through to probe the provider, which closes the circuit if it succeeds.
+type CircuitBreakerConfig struct {
+	// FailurePercent is the percentage of the latest runs of a provider that must have failed because of the provider for its
+	// circuit to open. The circuit breakers are disabled if it is 0.
+	FailurePercent int
+	// MinRuns is the number of runs of a provider that must have ended before its circuit can open, and Window is the number of
+	// the latest runs that the failure rate is computed from. They default to 5 and 20.
+	MinRuns int
+	Window  int
+	// Cooldown is how long a circuit stays open before a run is let through to probe the provider. It defaults to 30s.
+	Cooldown time.Duration
+}
+
+func (c CircuitBreakerConfig) validate() error {
+	if c.FailurePercent < 0 || c.FailurePercent > 100 {
+		return fmt.Errorf("failure percent must be between 0 and 100")
+	}
+	if c.MinRuns < 0 || c.Window < 0 || c.Cooldown < 0 {
+		return fmt.Errorf("min runs, window, and cooldown must not be negative")
+	}
+	if c.MinRuns > 0 && c.Window > 0 && c.MinRuns > c.Window {
+		return fmt.Errorf("min runs must not be more than the window")
+	}
+	return nil
+}
+
+func (c CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if c.MinRuns == 0 {
+		c.MinRuns = defaultCircuitMinRuns
+	}
+	if c.Window == 0 {
+		c.Window = max(defaultCircuitWindow, c.MinRuns)
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = defaultCircuitCooldown
+	}
+	return c
+}
+
+// circuitOpenError is the error of a run that was rejected because the circuit of its provider is open.
+type circuitOpenError struct {
+	provider string
+	// retry is when the next run of the provider is let through to probe it.
+	retry time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("the provider %q of the model is failing, so its runs are rejected until it recovers, try again after %s", e.provider, e.retry.Format(time.RFC3339))
+}
+
+func writeCircuitOpenError(w http.ResponseWriter, err *circuitOpenError) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(time.Until(err.retry).Seconds())))))
+	writeError(w, http.StatusServiceUnavailable, &requestError{code: errorCodeCircuitOpen, msg: err.Error()})
+}
+
+// circuit is the circuit breaker of a provider.
+type circuit struct {
+	state int
+	// outcomes are whether the latest runs of the provider failed because of it, oldest first.
+	outcomes []bool
+	// openedAt is when the circuit last opened.
+	openedAt time.Time
+	// probing is whether a run has been let through to probe the provider while the circuit is half-open.
+	probing bool
+}
+
+// circuitBreakers are the circuit breakers of the providers, by the name of the provider.
+type circuitBreakers struct {
+	lock     sync.Mutex
+	circuits map[string]*circuit
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{circuits: make(map[string]*circuit)}
+}
+
+// allow returns an error if the circuit of the provider is open. Otherwise, the run can go ahead, and the returned function must be
+// called with the error of the run when it ends, so that the outcome is recorded.
+func (cb *circuitBreakers) allow(provider string, config CircuitBreakerConfig) (func(error), error) {
+	if config.FailurePercent == 0 {
+		return func(error) {}, nil
+	}
+	config = config.withDefaults()
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	c, ok := cb.circuits[provider]
+	if !ok {
+		c = new(circuit)
+		cb.circuits[provider] = c
+	}
+
+	var probe bool
+	switch c.state {
+	case circuitOpen:
+		if retry := c.openedAt.Add(config.Cooldown); time.Now().Before(retry) {
+			return nil, &circuitOpenError{provider: provider, retry: retry}
+		}
+		cb.setState(provider, c, circuitHalfOpen)
+		fallthrough
+	case circuitHalfOpen:
+		if c.probing {
+			return nil, &circuitOpenError{provider: provider, retry: time.Now().Add(config.Cooldown)}
+		}
+		c.probing, probe = true, true
+	}
+
+	return func(err error) {
+		cb.record(provider, config, probe, err)
+	}, nil
+}
+
+// record records the outcome of a run of the provider. Runs that failed for reasons other than the provider don't count either way,
+// but a probe that did lets another run probe the provider.
+func (cb *circuitBreakers) record(provider string, config CircuitBreakerConfig, probe bool, err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	c := cb.circuits[provider]
+	if probe {
+		c.probing = false
+	}
+
+	failed := err != nil && providerErrorPattern.MatchString(err.Error())
+	if err != nil && !failed {
+		return
+	}
+
+	if probe {
+		if failed {
+			c.openedAt = time.Now()
+			cb.setState(provider, c, circuitOpen)
+			slog.Warn("Circuit of provider is still open, the probe failed", "provider", provider)
+		} else {
+			c.outcomes = nil
+			cb.setState(provider, c, circuitClosed)
+			slog.Info("Closed circuit of provider, the probe succeeded", "provider", provider)
+		}
+		return
+	}
+
+	if c.state != circuitClosed {
+		// The run started before the circuit opened.
+		return
+	}
+
+	c.outcomes = append(c.outcomes, failed)
+	if len(c.outcomes) > config.Window {
+		c.outcomes = c.outcomes[len(c.outcomes)-config.Window:]
+	}
+
+	var failures int
+	for _, f := range c.outcomes {
+		if f {
+			failures++
+		}
+	}
+	if len(c.outcomes) >= config.MinRuns && failures*100 >= config.FailurePercent*len(c.outcomes) {
+		c.openedAt = time.Now()
+		cb.setState(provider, c, circuitOpen)
+		slog.Warn("Opened circuit of provider, its runs are rejected until it recovers", "provider", provider, "failures", failures, "runs", len(c.outcomes))
+	}
+}
+
+// setState sets the state of the circuit of the provider. The lock must be held by the caller.
+func (cb *circuitBreakers) setState(provider string, c *circuit, state int) {
+	c.state = state
+	circuitState.WithLabelValues(provider).Set(float64(state))
+}
+
+// runProvider returns the name of the provider of a run, which is the base URL that the model of the run is routed to, or the
+// provider of the server if it isn't routed to one.
+func runProvider(ctx context.Context) string {
+	for _, kv := range ccontext.GetRunEnv(ctx) {
+		if baseURL, ok := strings.CutPrefix(kv, "OPENAI_BASE_URL="); ok && baseURL != "" {
+			return baseURL
+		}
+	}
+	return defaultProvider
+}
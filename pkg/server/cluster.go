@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/objects"
+)
+
+const (
+	// forwardedHeader is the header of the requests that a replica forwards to the replica of their run, with the ID of the replica
+	// that forwarded them, so that they are never forwarded again.
+	forwardedHeader = "X-Forwarded-Replica"
+	// clusterHeartbeat is how often a replica registers itself again, and replicaTimeout is how long after its last heartbeat a
+	// replica is taken to be gone.
+	clusterHeartbeat = 10 * time.Second
+	replicaTimeout   = 3 * clusterHeartbeat
+)
+
+var (
+	errReplicaUnavailable = errors.New("replica is unavailable")
+	validReplicaID        = regexp.MustCompile(`^[a-zA-Z0-9-]{1,63}$`)
+)
+
+// ClusterConfig configures cluster mode, in which several replicas of the server serve the same clients behind a load balancer.
+// Each replica registers itself in the storage of the server, and the ID of each run starts with the ID of the replica that runs
+// it, so that the requests about a run, like reconnecting to its events or canceling it, are forwarded to that replica by whichever
+// replica gets them.
+type ClusterConfig struct {
+	// URL is the URL that the other replicas reach this replica at, like http://10.0.0.5:8080. Cluster mode is enabled when it is
+	// set, which needs the storage of the server.
+	URL string
+	// ReplicaID identifies the replica in the cluster, with letters, digits, and dashes. It defaults to the hostname, which is
+	// the name of the pod in Kubernetes.
+	ReplicaID string
+}
+
+func (c ClusterConfig) enabled() bool {
+	return c.URL != ""
+}
+
+func (c ClusterConfig) validate() error {
+	if !c.enabled() {
+		if c.ReplicaID != "" {
+			return errors.New("the URL is required")
+		}
+		return nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q, must be an http or https URL", c.URL)
+	}
+	if c.ReplicaID != "" && !validReplicaID.MatchString(c.ReplicaID) {
+		return fmt.Errorf("invalid replica ID %q, must be letters, digits, and dashes", c.ReplicaID)
+	}
+	return nil
+}
+
+// replica is a replica of the server as it is registered in the storage of the server.
+type replica struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Heartbeat is when the replica last registered itself.
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+// cluster is the replica of the server in cluster mode, and the replicas that it knows of.
+type cluster struct {
+	self    replica
+	storage objects.Store
+
+	lock sync.Mutex
+	// replicas are the replicas that requests were forwarded to, which are looked up again once their heartbeat is stale.
+	replicas map[string]replica
+}
+
+// newCluster returns the replica of the server in cluster mode, or nil if cluster mode is disabled. The storage is nil if the server
+// has none.
+func newCluster(c ClusterConfig, storage objects.Store) (*cluster, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	if storage == nil {
+		return nil, errors.New("cluster mode needs the storage of the server")
+	}
+
+	id := c.ReplicaID
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the ID of the replica: %w", err)
+		}
+		id, _, _ = strings.Cut(hostname, ".")
+		if !validReplicaID.MatchString(id) {
+			return nil, fmt.Errorf("the hostname %q isn't a valid replica ID, so the replica ID must be set", hostname)
+		}
+	}
+
+	return &cluster{
+		self:     replica{ID: id, URL: strings.TrimSuffix(c.URL, "/")},
+		storage:  storage,
+		replicas: make(map[string]replica),
+	}, nil
+}
+
+// start registers the replica, and then registers it again every heartbeat until the returned function is called, which removes
+// it from the cluster.
+func (c *cluster) start(ctx context.Context) (func(), error) {
+	if c == nil {
+		return func() {}, nil
+	}
+	if err := c.register(ctx); err != nil {
+		return nil, fmt.Errorf("failed to register replica: %w", err)
+	}
+	slog.Info("Joined cluster", "replica", c.self.ID, "url", c.self.URL)
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(clusterHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.register(ctx); err != nil && ctx.Err() == nil {
+					slog.Error("Failed to register replica", "replica", c.self.ID, "error", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := c.storage.Delete(ctx, replicaKey(c.self.ID)); err != nil {
+			slog.Error("Failed to leave cluster", "replica", c.self.ID, "error", err)
+		}
+	}, nil
+}
+
+func (c *cluster) register(ctx context.Context) error {
+	r := c.self
+	r.Heartbeat = time.Now()
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return c.storage.Put(ctx, objects.Object{Key: replicaKey(r.ID), Size: int64(len(b))}, bytes.NewReader(b))
+}
+
+// newRunID returns the ID of a new run, which starts with the ID of the replica in cluster mode.
+func (c *cluster) newRunID() string {
+	if c == nil {
+		return uuid.NewString()
+	}
+	return c.self.ID + "." + uuid.NewString()
+}
+
+// runReplica returns the ID of the replica of the run with the ID, or an empty string if the run wasn't started in cluster mode.
+func runReplica(runID string) string {
+	id, _, ok := strings.Cut(runID, ".")
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// replica returns the replica with the ID, or errReplicaUnavailable if it isn't registered or its heartbeat is stale.
+func (c *cluster) replica(ctx context.Context, id string) (replica, error) {
+	c.lock.Lock()
+	r, ok := c.replicas[id]
+	c.lock.Unlock()
+	if ok && time.Since(r.Heartbeat) < replicaTimeout {
+		return r, nil
+	}
+
+	r, err := c.load(ctx, replicaKey(id))
+	if errors.Is(err, objects.ErrNotFound) {
+		return replica{}, errReplicaUnavailable
+	} else if err != nil {
+		return replica{}, err
+	}
+	if time.Since(r.Heartbeat) >= replicaTimeout {
+		return replica{}, errReplicaUnavailable
+	}
+
+	c.lock.Lock()
+	c.replicas[id] = r
+	c.lock.Unlock()
+	return r, nil
+}
+
+// list returns the replicas that are registered, including those whose heartbeat is stale, sorted by ID.
+func (c *cluster) list(ctx context.Context) ([]replica, error) {
+	objs, err := c.storage.List(ctx, "replicas/")
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]replica, 0, len(objs))
+	for _, o := range objs {
+		r, err := c.load(ctx, o.Key)
+		if errors.Is(err, objects.ErrNotFound) {
+			// The replica left the cluster since the replicas were listed.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+func (c *cluster) load(ctx context.Context, key string) (replica, error) {
+	rc, _, err := c.storage.Open(ctx, key)
+	if err != nil {
+		return replica{}, err
+	}
+	defer rc.Close()
+
+	var r replica
+	if err = json.NewDecoder(rc).Decode(&r); err != nil {
+		return replica{}, fmt.Errorf("failed to read replica: %w", err)
+	}
+	return r, nil
+}
+
+func replicaKey(id string) string {
+	return "replicas/" + id + ".json"
+}
+
+// routeRun forwards the requests about the run of the {id} of their path to the replica of the run, if the server is in cluster mode
+// and another replica started the run, because only that replica has the run. Requests that were forwarded are always handled by
+// the replica that gets them.
+func (s *server) routeRun(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := runReplica(r.PathValue("id"))
+		if s.cluster == nil || owner == "" || owner == s.cluster.self.ID || r.Header.Get(forwardedHeader) != "" {
+			next(w, r)
+			return
+		}
+
+		target, err := s.cluster.replica(r.Context(), owner)
+		if errors.Is(err, errReplicaUnavailable) {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("replica %q of run %q is unavailable", owner, r.PathValue("id")))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to find replica of run: %w", err))
+			return
+		}
+		targetURL, err := url.Parse(target.URL)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("invalid URL of replica %q: %w", owner, err))
+			return
+		}
+
+		ccontext.GetLogger(r.Context()).Debug("forwarding request to the replica of its run", "replica", owner)
+
+		// The replica of the run handles the request with the same middleware, so the headers that were set on the response so far
+		// are replaced by those of its response.
+		clear(w.Header())
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(targetURL)
+				pr.SetXForwarded()
+				pr.Out.Header.Set(forwardedHeader, s.cluster.self.ID)
+				pr.Out.Header.Set(requestIDHeader, ccontext.GetRequestID(r.Context()))
+			},
+			// Streams of events are written to the client as they arrive.
+			FlushInterval: -1,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				ccontext.GetLogger(r.Context()).Error("Failed to forward request to the replica of its run", "replica", owner, "error", err)
+				writeError(w, http.StatusBadGateway, fmt.Errorf("failed to forward request to replica %q", owner))
+			},
+		}
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// listReplicas lists the replicas of the cluster, and whether each is available.
+func (s *server) listReplicas(w http.ResponseWriter, r *http.Request) {
+	if s.cluster == nil {
+		writeError(w, http.StatusNotFound, errors.New("cluster mode is disabled"))
+		return
+	}
+
+	list, err := s.cluster.list(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to list replicas: %w", err))
+		return
+	}
+
+	replicas := make([]replicaInfo, 0, len(list))
+	for _, rep := range list {
+		replicas = append(replicas, replicaInfo{
+			ID:        rep.ID,
+			URL:       rep.URL,
+			Heartbeat: rep.Heartbeat,
+			Self:      rep.ID == s.cluster.self.ID,
+			Available: time.Since(rep.Heartbeat) < replicaTimeout,
+		})
+	}
+	writeResponse(w, map[string][]replicaInfo{"replicas": replicas})
+}
+
+// replicaInfo is a replica as it is returned by the API.
+type replicaInfo struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Heartbeat time.Time `json:"heartbeat"`
+	// Self is whether the replica is the one that handled the request.
+	Self      bool `json:"self"`
+	Available bool `json:"available"`
+}
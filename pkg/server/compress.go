@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+
+	// defaultCompressionMinSize is the size in bytes of the smallest response that is compressed if the minimum isn't configured.
+	defaultCompressionMinSize = 1024
+)
+
+// CompressionConfig configures the compression of responses, which is negotiated with the Accept-Encoding header of each request.
+// JSON responses are compressed with zstd or gzip, unless compression is disabled.
+type CompressionConfig struct {
+	// Disabled turns compression off, so that every response is sent as it is.
+	Disabled bool
+	// MinSize is the size in bytes of the smallest JSON response that is compressed, because compressing small responses makes them
+	// bigger. It defaults to 1024 if it isn't set, and every JSON response is compressed if it is 0.
+	MinSize *int
+	// Streams turns on the compression of streams of events. Each event is flushed through the compressor as it is written, so the
+	// client receives it right away, but proxies that don't understand compressed streams may hold it up.
+	Streams bool
+}
+
+func (c CompressionConfig) validate() error {
+	if c.MinSize != nil && *c.MinSize < 0 {
+		return fmt.Errorf("minimum size must not be negative")
+	}
+	return nil
+}
+
+// encoder is a compressor of a response.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var (
+	gzipEncoders = sync.Pool{New: func() any {
+		return gzip.NewWriter(nil)
+	}}
+	zstdEncoders = sync.Pool{New: func() any {
+		// The encoder only fails to be created with invalid options.
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return e
+	}}
+)
+
+// newEncoder returns a compressor with the encoding that writes to w, and a function that returns it to its pool once it is closed.
+func newEncoder(encoding string, w io.Writer) (encoder, func()) {
+	if encoding == encodingZstd {
+		e := zstdEncoders.Get().(*zstd.Encoder)
+		e.Reset(w)
+		return e, func() { zstdEncoders.Put(e) }
+	}
+
+	e := gzipEncoders.Get().(*gzip.Writer)
+	e.Reset(w)
+	return e, func() { gzipEncoders.Put(e) }
+}
+
+// compress compresses the responses whose request accepts zstd or gzip, if they are JSON, or if they are streams of events and
+// the config says to compress streams. Responses that are already encoded, like the metrics, are sent as they are.
+func (s *server) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := s.current().config.Compression
+		if config.Disabled || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		minSize := defaultCompressionMinSize
+		if config.MinSize != nil {
+			minSize = *config.MinSize
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			minSize:        minSize,
+			streams:        config.Streams,
+			status:         http.StatusOK,
+		}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the encoding of the response from the Accept-Encoding header of the request, which is zstd or gzip,
+// whichever the request prefers, with zstd being chosen if it prefers neither. It is empty if the request accepts neither.
+func negotiateEncoding(accept string) string {
+	var (
+		best     string
+		bestQ    float64
+		wildcard = -1.0
+	)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch name {
+		case "*":
+			wildcard = q
+		case encodingZstd, encodingGzip:
+			if q > bestQ || (q == bestQ && q > 0 && name == encodingZstd) {
+				best, bestQ = name, q
+			}
+		}
+	}
+
+	if best == "" && wildcard > 0 {
+		return encodingZstd
+	}
+	return best
+}
+
+// compressWriter compresses a response once it knows that the response should be compressed. A JSON response is buffered until it
+// has reached the minimum size, and is sent as it is if it never does. Streams are flushed through the compressor, so that each
+// event reaches the client as soon as it is written. Websockets are hijacked through it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	streams  bool
+
+	status  int
+	decided bool
+	buf     []byte
+	enc     encoder
+	release func()
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.decided {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	c.status = code
+
+	// Informational responses don't have a body, so they are sent right away.
+	if code < http.StatusOK {
+		c.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.decided {
+		switch c.kind() {
+		case "":
+			c.passThrough()
+		case "stream":
+			c.startCompressing()
+		default:
+			c.buf = append(c.buf, b...)
+			if len(c.buf) < c.minSize {
+				return len(b), nil
+			}
+
+			buf := c.buf
+			c.buf = nil
+			c.startCompressing()
+			if _, err := c.enc.Write(buf); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+	}
+
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far to the client. A response that hasn't been decided on yet is decided on now, because
+// the client is waiting for it.
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		if c.kind() == "stream" {
+			c.startCompressing()
+		} else {
+			c.passThrough()
+		}
+	}
+
+	if c.enc != nil {
+		_ = c.enc.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response can't be hijacked")
+	}
+
+	c.decided = true
+	return h.Hijack()
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// kind returns whether the response should be compressed once it is big enough, which it should be if it is JSON, or right away,
+// which it should be if it is a stream of events that is compressed. It returns an empty string if the response shouldn't be
+// compressed.
+func (c *compressWriter) kind() string {
+	h := c.Header()
+	if h.Get("Content-Encoding") != "" || c.status == http.StatusNoContent || c.status == http.StatusNotModified {
+		return ""
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		return "json"
+	case "text/event-stream", ndjsonContentType:
+		if c.streams {
+			return "stream"
+		}
+	}
+	return ""
+}
+
+// startCompressing sends the headers of the compressed response, and compresses everything that is written after them.
+func (c *compressWriter) startCompressing() {
+	c.decided = true
+
+	h := c.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", c.encoding)
+	c.ResponseWriter.WriteHeader(c.status)
+
+	c.enc, c.release = newEncoder(c.encoding, c.ResponseWriter)
+}
+
+// passThrough sends the headers of the response as they are, with what has been buffered, and sends everything that is written
+// after them as it is.
+func (c *compressWriter) passThrough() {
+	c.decided = true
+	c.ResponseWriter.WriteHeader(c.status)
+	if len(c.buf) > 0 {
+		_, _ = c.ResponseWriter.Write(c.buf)
+		c.buf = nil
+	}
+}
+
+// close sends the rest of the response. It is called once the handler has returned.
+func (c *compressWriter) close() {
+	if !c.decided {
+		// A response that was never written to still has its status code sent, unless the handler didn't write a header either.
+		if c.status != http.StatusOK || len(c.buf) > 0 {
+			c.passThrough()
+		}
+		return
+	}
+
+	if c.enc != nil {
+		_ = c.enc.Close()
+		c.release()
+		c.enc = nil
+	}
+}
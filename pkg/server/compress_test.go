@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressMinSize(t *testing.T) {
+	zero, small := 0, 10
+	tests := []struct {
+		name    string
+		minSize *int
+		want    string
+	}{
+		{name: "default", want: ""},
+		{name: "zero", minSize: &zero, want: encodingGzip},
+		{name: "smaller than the response", minSize: &small, want: encodingGzip},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := new(server)
+			s.settings.Store(&settings{config: Config{Compression: CompressionConfig{MinSize: tt.minSize}}})
+
+			handler := s.compress(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				writeResponse(w, map[string]string{"status": "ok"})
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", encodingGzip)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if got := rec.Header().Get("Content-Encoding"); got != tt.want {
+				t.Errorf("got encoding %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCompressionMinSize(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("compression:\n  minSize: 0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A minimum size of 0 in the file overrides the one of the flags, without changing the config that the file is loaded over.
+	minSize := 1024
+	base := Config{File: file, Compression: CompressionConfig{MinSize: &minSize}}
+	c, err := loadConfig(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Compression.MinSize == nil || *c.Compression.MinSize != 0 {
+		t.Errorf("got minimum size %v, want 0", c.Compression.MinSize)
+	}
+	if minSize != 1024 {
+		t.Errorf("the minimum size of the flags was changed to %d", minSize)
+	}
+}
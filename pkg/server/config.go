@@ -0,0 +1,1259 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gptscript-ai/go-gptscript"
+	"github.com/thedadams/clicky-serves/pkg/log"
+	"github.com/thedadams/clicky-serves/pkg/objects"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configWatchInterval is how often the config file is checked for changes.
+	configWatchInterval = 5 * time.Second
+
+	redacted = "REDACTED"
+)
+
+// fileConfig is the configuration as it is written in a config file, in YAML or JSON. It is also the body of the config endpoint.
+type fileConfig struct {
+	Port                string                       `json:"port" yaml:"port"`
+	GRPCPort            string                       `json:"grpcPort" yaml:"grpcPort"`
+	DebugPort           string                       `json:"debugPort" yaml:"debugPort"`
+	HTTP2               bool                         `json:"http2" yaml:"http2"`
+	GraphQL             bool                         `json:"graphql" yaml:"graphql"`
+	JSONRPC             bool                         `json:"jsonrpc" yaml:"jsonrpc"`
+	MCP                 bool                         `json:"mcp" yaml:"mcp"`
+	JSONRPCStdio        bool                         `json:"jsonrpcStdio" yaml:"jsonrpcStdio"`
+	JSONRPCStdioAPIKey  string                       `json:"jsonrpcStdioAPIKey" yaml:"jsonrpcStdioAPIKey"`
+	ChatCompletionsTool string                       `json:"chatCompletionsTool" yaml:"chatCompletionsTool"`
+	LogLevel            string                       `json:"logLevel" yaml:"logLevel"`
+	ReadOnly            bool                         `json:"readOnly" yaml:"readOnly"`
+	APIKeys             []string                     `json:"apiKeys" yaml:"apiKeys"`
+	APIKeysFile         string                       `json:"apiKeysFile" yaml:"apiKeysFile"`
+	JWT                 fileJWTConfig                `json:"jwt" yaml:"jwt"`
+	MaxConcurrentRuns   int                          `json:"maxConcurrentRuns" yaml:"maxConcurrentRuns"`
+	MaxQueuedRuns       int                          `json:"maxQueuedRuns" yaml:"maxQueuedRuns"`
+	RunPriority         int                          `json:"runPriority" yaml:"runPriority"`
+	ClientRunPriorities map[string]int               `json:"clientRunPriorities" yaml:"clientRunPriorities"`
+	PreemptRuns         bool                         `json:"preemptRuns" yaml:"preemptRuns"`
+	Queue               fileQueueConfig              `json:"queue" yaml:"queue"`
+	MaxRunTimeout       string                       `json:"maxRunTimeout" yaml:"maxRunTimeout"`
+	RunHistoryDB        string                       `json:"runHistoryDB" yaml:"runHistoryDB"`
+	EnvAllowlist        []string                     `json:"envAllowlist" yaml:"envAllowlist"`
+	EnvDenylist         []string                     `json:"envDenylist" yaml:"envDenylist"`
+	ParseRateLimit      string                       `json:"parseRateLimit" yaml:"parseRateLimit"`
+	ExecRateLimit       string                       `json:"execRateLimit" yaml:"execRateLimit"`
+	ResultCacheTTL      string                       `json:"resultCacheTTL" yaml:"resultCacheTTL"`
+	ResultCacheSize     int                          `json:"resultCacheSize" yaml:"resultCacheSize"`
+	ParseCacheTTL       string                       `json:"parseCacheTTL" yaml:"parseCacheTTL"`
+	ParseCacheSize      int                          `json:"parseCacheSize" yaml:"parseCacheSize"`
+	ToolCacheTTL        string                       `json:"toolCacheTTL" yaml:"toolCacheTTL"`
+	CORS                fileCORSConfig               `json:"cors" yaml:"cors"`
+	UploadDir           string                       `json:"uploadDir" yaml:"uploadDir"`
+	HeartbeatInterval   string                       `json:"heartbeatInterval" yaml:"heartbeatInterval"`
+	Stream              fileStreamConfig             `json:"stream" yaml:"stream"`
+	Retry               fileRetryConfig              `json:"retry" yaml:"retry"`
+	CircuitBreaker      fileCircuitBreakerConfig     `json:"circuitBreaker" yaml:"circuitBreaker"`
+	Compression         fileCompressionConfig        `json:"compression" yaml:"compression"`
+	Limits              fileLimitsConfig             `json:"limits" yaml:"limits"`
+	Janitor             fileJanitorConfig            `json:"janitor" yaml:"janitor"`
+	DefaultOpts         fileOpts                     `json:"defaultOpts" yaml:"defaultOpts"`
+	ClientOpts          map[string]fileClientOpts    `json:"clientOpts" yaml:"clientOpts"`
+	LockedOpts          []string                     `json:"lockedOpts" yaml:"lockedOpts"`
+	CacheRoot           string                       `json:"cacheRoot" yaml:"cacheRoot"`
+	ToolDirs            []string                     `json:"toolDirs" yaml:"toolDirs"`
+	CallbackSecret      string                       `json:"callbackSecret" yaml:"callbackSecret"`
+	CallbackNetworks    []string                     `json:"callbackNetworks" yaml:"callbackNetworks"`
+	SignedURLKey        string                       `json:"signedURLKey" yaml:"signedURLKey"`
+	Notifications       []fileNotificationSink       `json:"notifications" yaml:"notifications"`
+	Brokers             []fileBrokerConfig           `json:"brokers" yaml:"brokers"`
+	AuditLog            string                       `json:"auditLog" yaml:"auditLog"`
+	Hooks               []string                     `json:"hooks" yaml:"hooks"`
+	Redaction           fileRedactionConfig          `json:"redaction" yaml:"redaction"`
+	Policy              filePolicy                   `json:"policy" yaml:"policy"`
+	ClientPolicies      map[string]filePolicy        `json:"clientPolicies" yaml:"clientPolicies"`
+	Models              map[string]fileModelRoute    `json:"models" yaml:"models"`
+	DefaultModel        string                       `json:"defaultModel" yaml:"defaultModel"`
+	CredentialsFile     string                       `json:"credentialsFile" yaml:"credentialsFile"`
+	CredentialsKey      string                       `json:"credentialsKey" yaml:"credentialsKey"`
+	Artifacts           fileArtifactsConfig          `json:"artifacts" yaml:"artifacts"`
+	Storage             fileStorageConfig            `json:"storage" yaml:"storage"`
+	Cluster             fileClusterConfig            `json:"cluster" yaml:"cluster"`
+	Quota               fileQuota                    `json:"quota" yaml:"quota"`
+	ClientQuotas        map[string]fileQuota         `json:"clientQuotas" yaml:"clientQuotas"`
+	TenantQuotas        map[string]fileQuota         `json:"tenantQuotas" yaml:"tenantQuotas"`
+	Backend             string                       `json:"backend" yaml:"backend"`
+	GPTScript           fileGPTScriptConfig          `json:"gptscript" yaml:"gptscript"`
+	ProcessLimits       fileProcessLimits            `json:"processLimits" yaml:"processLimits"`
+	ClientProcessLimits map[string]fileProcessLimits `json:"clientProcessLimits" yaml:"clientProcessLimits"`
+	Sandbox             fileSandboxConfig            `json:"sandbox" yaml:"sandbox"`
+	Kubernetes          fileKubernetesConfig         `json:"kubernetes" yaml:"kubernetes"`
+}
+
+type fileJWTConfig struct {
+	Secret         string `json:"secret" yaml:"secret"`
+	JWKSURL        string `json:"jwksURL" yaml:"jwksURL"`
+	Issuer         string `json:"issuer" yaml:"issuer"`
+	Audience       string `json:"audience" yaml:"audience"`
+	ScopeClaim     string `json:"scopeClaim" yaml:"scopeClaim"`
+	ToolPathsClaim string `json:"toolPathsClaim" yaml:"toolPathsClaim"`
+	TenantClaim    string `json:"tenantClaim" yaml:"tenantClaim"`
+}
+
+type fileCORSConfig struct {
+	AllowedOrigins   []string `json:"allowedOrigins" yaml:"allowedOrigins"`
+	AllowedMethods   []string `json:"allowedMethods" yaml:"allowedMethods"`
+	AllowedHeaders   []string `json:"allowedHeaders" yaml:"allowedHeaders"`
+	AllowCredentials bool     `json:"allowCredentials" yaml:"allowCredentials"`
+	MaxAge           string   `json:"maxAge" yaml:"maxAge"`
+}
+
+type fileModelRoute struct {
+	Provider        string  `json:"provider" yaml:"provider"`
+	Model           string  `json:"model" yaml:"model"`
+	BaseURL         string  `json:"baseURL" yaml:"baseURL"`
+	APIKey          string  `json:"apiKey" yaml:"apiKey"`
+	APIVersion      string  `json:"apiVersion" yaml:"apiVersion"`
+	PromptPrice     float64 `json:"promptPrice" yaml:"promptPrice"`
+	CompletionPrice float64 `json:"completionPrice" yaml:"completionPrice"`
+}
+
+type fileQuota struct {
+	DailyTokens   int64   `json:"dailyTokens" yaml:"dailyTokens"`
+	MonthlyTokens int64   `json:"monthlyTokens" yaml:"monthlyTokens"`
+	DailyCost     float64 `json:"dailyCost" yaml:"dailyCost"`
+	MonthlyCost   float64 `json:"monthlyCost" yaml:"monthlyCost"`
+}
+
+type filePolicy struct {
+	FilePaths          []string `json:"filePaths" yaml:"filePaths"`
+	RemoteTools        []string `json:"remoteTools" yaml:"remoteTools"`
+	DeniedInstructions []string `json:"deniedInstructions" yaml:"deniedInstructions"`
+}
+
+type fileGPTScriptConfig struct {
+	Bin        string `json:"bin" yaml:"bin"`
+	Version    string `json:"version" yaml:"version"`
+	Checksum   string `json:"checksum" yaml:"checksum"`
+	ReleaseURL string `json:"releaseURL" yaml:"releaseURL"`
+	Dir        string `json:"dir" yaml:"dir"`
+}
+
+type fileProcessLimits struct {
+	CPUTime   string `json:"cpuTime" yaml:"cpuTime"`
+	Memory    int64  `json:"memory" yaml:"memory"`
+	Processes int    `json:"processes" yaml:"processes"`
+}
+
+type fileSandboxConfig struct {
+	Runtime        string   `json:"runtime" yaml:"runtime"`
+	Image          string   `json:"image" yaml:"image"`
+	Memory         string   `json:"memory" yaml:"memory"`
+	CPUs           string   `json:"cpus" yaml:"cpus"`
+	PidsLimit      int      `json:"pidsLimit" yaml:"pidsLimit"`
+	Network        string   `json:"network" yaml:"network"`
+	SeccompProfile string   `json:"seccompProfile" yaml:"seccompProfile"`
+	Mounts         []string `json:"mounts" yaml:"mounts"`
+	Env            []string `json:"env" yaml:"env"`
+}
+
+type fileArtifactsConfig struct {
+	Dir     string `json:"dir" yaml:"dir"`
+	Storage bool   `json:"storage" yaml:"storage"`
+	MaxSize int64  `json:"maxSize" yaml:"maxSize"`
+}
+
+type fileStorageConfig struct {
+	Provider        string `json:"provider" yaml:"provider"`
+	Endpoint        string `json:"endpoint" yaml:"endpoint"`
+	Region          string `json:"region" yaml:"region"`
+	Bucket          string `json:"bucket" yaml:"bucket"`
+	Prefix          string `json:"prefix" yaml:"prefix"`
+	AccessKeyID     string `json:"accessKeyID" yaml:"accessKeyID"`
+	SecretAccessKey string `json:"secretAccessKey" yaml:"secretAccessKey"`
+	PathStyle       bool   `json:"pathStyle" yaml:"pathStyle"`
+}
+
+type fileClusterConfig struct {
+	URL       string `json:"url" yaml:"url"`
+	ReplicaID string `json:"replicaID" yaml:"replicaID"`
+}
+
+type fileKubernetesConfig struct {
+	APIServer      string   `json:"apiServer" yaml:"apiServer"`
+	TokenFile      string   `json:"tokenFile" yaml:"tokenFile"`
+	CAFile         string   `json:"caFile" yaml:"caFile"`
+	Namespace      string   `json:"namespace" yaml:"namespace"`
+	Image          string   `json:"image" yaml:"image"`
+	HelperImage    string   `json:"helperImage" yaml:"helperImage"`
+	CPURequest     string   `json:"cpuRequest" yaml:"cpuRequest"`
+	MemoryRequest  string   `json:"memoryRequest" yaml:"memoryRequest"`
+	CPULimit       string   `json:"cpuLimit" yaml:"cpuLimit"`
+	MemoryLimit    string   `json:"memoryLimit" yaml:"memoryLimit"`
+	ServiceAccount string   `json:"serviceAccount" yaml:"serviceAccount"`
+	Env            []string `json:"env" yaml:"env"`
+}
+
+type fileStreamConfig struct {
+	BufferSize           int    `json:"bufferSize" yaml:"bufferSize"`
+	BufferPolicy         string `json:"bufferPolicy" yaml:"bufferPolicy"`
+	KeepRunsOnDisconnect bool   `json:"keepRunsOnDisconnect" yaml:"keepRunsOnDisconnect"`
+	WriteTimeout         string `json:"writeTimeout" yaml:"writeTimeout"`
+	FlushInterval        string `json:"flushInterval" yaml:"flushInterval"`
+	MaxOutputSize        int64  `json:"maxOutputSize" yaml:"maxOutputSize"`
+}
+
+type fileRetryConfig struct {
+	MaxAttempts int      `json:"maxAttempts" yaml:"maxAttempts"`
+	Backoff     string   `json:"backoff" yaml:"backoff"`
+	MaxBackoff  string   `json:"maxBackoff" yaml:"maxBackoff"`
+	On          []string `json:"on" yaml:"on"`
+}
+
+type fileCircuitBreakerConfig struct {
+	FailurePercent int    `json:"failurePercent" yaml:"failurePercent"`
+	MinRuns        int    `json:"minRuns" yaml:"minRuns"`
+	Window         int    `json:"window" yaml:"window"`
+	Cooldown       string `json:"cooldown" yaml:"cooldown"`
+}
+
+type fileQueueConfig struct {
+	ClientWeights           map[string]int `json:"clientWeights" yaml:"clientWeights"`
+	TenantMaxConcurrentRuns int            `json:"tenantMaxConcurrentRuns" yaml:"tenantMaxConcurrentRuns"`
+	TenantLimits            map[string]int `json:"tenantLimits" yaml:"tenantLimits"`
+}
+
+type fileNotificationSink struct {
+	Type    string         `json:"type" yaml:"type"`
+	URL     string         `json:"url" yaml:"url"`
+	SMTP    fileSMTPConfig `json:"smtp" yaml:"smtp"`
+	Tools   []string       `json:"tools" yaml:"tools"`
+	States  []string       `json:"states" yaml:"states"`
+	Tenants []string       `json:"tenants" yaml:"tenants"`
+}
+
+type fileSMTPConfig struct {
+	Addr     string   `json:"addr" yaml:"addr"`
+	Username string   `json:"username" yaml:"username"`
+	Password string   `json:"password" yaml:"password"`
+	From     string   `json:"from" yaml:"from"`
+	To       []string `json:"to" yaml:"to"`
+}
+
+type fileBrokerConfig struct {
+	Type    string   `json:"type" yaml:"type"`
+	URL     string   `json:"url" yaml:"url"`
+	Topic   string   `json:"topic" yaml:"topic"`
+	Tenants []string `json:"tenants" yaml:"tenants"`
+	Events  []string `json:"events" yaml:"events"`
+}
+
+type fileCompressionConfig struct {
+	Disabled bool `json:"disabled" yaml:"disabled"`
+	MinSize  *int `json:"minSize" yaml:"minSize"`
+	Streams  bool `json:"streams" yaml:"streams"`
+}
+
+// newFileCompressionConfig copies the minimum size, since the config file is decoded into it and the config must not change.
+func newFileCompressionConfig(c CompressionConfig) fileCompressionConfig {
+	if c.MinSize != nil {
+		minSize := *c.MinSize
+		c.MinSize = &minSize
+	}
+	return fileCompressionConfig(c)
+}
+
+type fileLimitsConfig struct {
+	Body         int64  `json:"body" yaml:"body"`
+	Content      int64  `json:"content" yaml:"content"`
+	Input        int64  `json:"input" yaml:"input"`
+	Upload       int64  `json:"upload" yaml:"upload"`
+	ParseTimeout string `json:"parseTimeout" yaml:"parseTimeout"`
+}
+
+type fileJanitorConfig struct {
+	Interval         string `json:"interval" yaml:"interval"`
+	CacheTTL         string `json:"cacheTTL" yaml:"cacheTTL"`
+	CacheMaxSize     int64  `json:"cacheMaxSize" yaml:"cacheMaxSize"`
+	UploadTTL        string `json:"uploadTTL" yaml:"uploadTTL"`
+	UploadMaxSize    int64  `json:"uploadMaxSize" yaml:"uploadMaxSize"`
+	WorkspaceMaxSize int64  `json:"workspaceMaxSize" yaml:"workspaceMaxSize"`
+}
+
+type fileRedactionConfig struct {
+	Patterns      []string `json:"patterns" yaml:"patterns"`
+	NamedPatterns []string `json:"namedPatterns" yaml:"namedPatterns"`
+	Replacement   string   `json:"replacement" yaml:"replacement"`
+}
+
+// fileOpts are the gptscript options, with the same names as in requests.
+type fileOpts struct {
+	DisableCache bool   `json:"disableCache" yaml:"disableCache"`
+	CacheDir     string `json:"cacheDir" yaml:"cacheDir"`
+	Quiet        bool   `json:"quiet" yaml:"quiet"`
+	Chdir        string `json:"chdir" yaml:"chdir"`
+	SubTool      string `json:"subTool" yaml:"subTool"`
+}
+
+// fileClientOpts are the default options of a client, whose disableCache and quiet are only set if the file sets them.
+type fileClientOpts struct {
+	DisableCache *bool  `json:"disableCache,omitempty" yaml:"disableCache,omitempty"`
+	CacheDir     string `json:"cacheDir" yaml:"cacheDir"`
+	Quiet        *bool  `json:"quiet,omitempty" yaml:"quiet,omitempty"`
+	Chdir        string `json:"chdir" yaml:"chdir"`
+	SubTool      string `json:"subTool" yaml:"subTool"`
+}
+
+func newFileConfig(c Config) fileConfig {
+	return fileConfig{
+		Port:        c.Port,
+		GRPCPort:    c.GRPCPort,
+		DebugPort:   c.DebugPort,
+		HTTP2:       c.HTTP2,
+		GraphQL:     c.GraphQL,
+		JSONRPC:     c.JSONRPC,
+		MCP:         c.MCP,
+		LogLevel:    c.LogLevel,
+		ReadOnly:    c.ReadOnly,
+		APIKeys:     c.APIKeys,
+		APIKeysFile: c.APIKeysFile,
+		JWT: fileJWTConfig{
+			Secret:         c.JWT.Secret,
+			JWKSURL:        c.JWT.JWKSURL,
+			Issuer:         c.JWT.Issuer,
+			Audience:       c.JWT.Audience,
+			ScopeClaim:     c.JWT.ScopeClaim,
+			ToolPathsClaim: c.JWT.ToolPathsClaim,
+			TenantClaim:    c.JWT.TenantClaim,
+		},
+		MaxConcurrentRuns: c.MaxConcurrentRuns,
+		MaxQueuedRuns:     c.MaxQueuedRuns,
+		RunPriority:       c.RunPriority,
+		PreemptRuns:       c.PreemptRuns,
+		MaxRunTimeout:     c.MaxRunTimeout.String(),
+		RunHistoryDB:      c.RunHistoryDB,
+		EnvAllowlist:      c.EnvAllowlist,
+		EnvDenylist:       c.EnvDenylist,
+		ParseRateLimit:    c.ParseRateLimit.String(),
+		ExecRateLimit:     c.ExecRateLimit.String(),
+		ResultCacheTTL:    c.ResultCacheTTL.String(),
+		ResultCacheSize:   c.ResultCacheSize,
+		ParseCacheTTL:     c.ParseCacheTTL.String(),
+		ParseCacheSize:    c.ParseCacheSize,
+		ToolCacheTTL:      c.ToolCacheTTL.String(),
+		CORS: fileCORSConfig{
+			AllowedOrigins:   c.CORS.AllowedOrigins,
+			AllowedMethods:   c.CORS.AllowedMethods,
+			AllowedHeaders:   c.CORS.AllowedHeaders,
+			AllowCredentials: c.CORS.AllowCredentials,
+			MaxAge:           c.CORS.MaxAge.String(),
+		},
+		UploadDir:           c.UploadDir,
+		HeartbeatInterval:   c.HeartbeatInterval.String(),
+		Queue:               fileQueueConfig(c.Queue),
+		Compression:         newFileCompressionConfig(c.Compression),
+		DefaultOpts:         fileOpts(c.DefaultOpts),
+		ClientOpts:          newFileClientOpts(c.ClientOpts),
+		LockedOpts:          c.LockedOpts,
+		CacheRoot:           c.CacheRoot,
+		ToolDirs:            c.ToolDirs,
+		CallbackSecret:      c.CallbackSecret,
+		CallbackNetworks:    c.CallbackNetworks,
+		SignedURLKey:        c.SignedURLKey,
+		Notifications:       fileNotificationSinks(c.Notifications),
+		Brokers:             fileBrokers(c.Brokers),
+		AuditLog:            c.AuditLog,
+		Hooks:               c.Hooks,
+		Redaction:           fileRedactionConfig(c.Redaction),
+		Policy:              filePolicy(c.Policy),
+		ClientPolicies:      fileClientPolicies(c.ClientPolicies),
+		Models:              fileModelRoutes(c.Models),
+		DefaultModel:        c.DefaultModel,
+		CredentialsFile:     c.CredentialsFile,
+		CredentialsKey:      c.CredentialsKey,
+		Artifacts:           fileArtifactsConfig(c.Artifacts),
+		Storage:             fileStorageConfig(c.Storage),
+		Cluster:             fileClusterConfig(c.Cluster),
+		JSONRPCStdio:        c.JSONRPCStdio,
+		JSONRPCStdioAPIKey:  c.JSONRPCStdioAPIKey,
+		ChatCompletionsTool: c.ChatCompletionsTool,
+		Quota:               fileQuota(c.Quota),
+		ClientQuotas:        fileClientQuotas(c.ClientQuotas),
+		ClientRunPriorities: c.ClientRunPriorities,
+		TenantQuotas:        fileClientQuotas(c.TenantQuotas),
+		Backend:             c.Backend,
+		GPTScript:           fileGPTScriptConfig(c.GPTScript),
+		ProcessLimits:       newFileProcessLimits(c.ProcessLimits),
+		ClientProcessLimits: fileClientProcessLimits(c.ClientProcessLimits),
+		Sandbox:             fileSandboxConfig(c.Sandbox),
+		Kubernetes:          fileKubernetesConfig(c.Kubernetes),
+		Stream: fileStreamConfig{
+			BufferSize:           c.Stream.BufferSize,
+			BufferPolicy:         c.Stream.BufferPolicy,
+			KeepRunsOnDisconnect: c.Stream.KeepRunsOnDisconnect,
+			WriteTimeout:         c.Stream.WriteTimeout.String(),
+			FlushInterval:        c.Stream.FlushInterval.String(),
+			MaxOutputSize:        c.Stream.MaxOutputSize,
+		},
+		Retry: fileRetryConfig{
+			MaxAttempts: c.Retry.MaxAttempts,
+			Backoff:     c.Retry.Backoff.String(),
+			MaxBackoff:  c.Retry.MaxBackoff.String(),
+			On:          c.Retry.On,
+		},
+		CircuitBreaker: fileCircuitBreakerConfig{
+			FailurePercent: c.CircuitBreaker.FailurePercent,
+			MinRuns:        c.CircuitBreaker.MinRuns,
+			Window:         c.CircuitBreaker.Window,
+			Cooldown:       c.CircuitBreaker.Cooldown.String(),
+		},
+		Limits: fileLimitsConfig{
+			Body:         c.Limits.Body,
+			Content:      c.Limits.Content,
+			Input:        c.Limits.Input,
+			Upload:       c.Limits.Upload,
+			ParseTimeout: c.Limits.ParseTimeout.String(),
+		},
+		Janitor: fileJanitorConfig{
+			Interval:         c.Janitor.Interval.String(),
+			CacheTTL:         c.Janitor.CacheTTL.String(),
+			CacheMaxSize:     c.Janitor.CacheMaxSize,
+			UploadTTL:        c.Janitor.UploadTTL.String(),
+			UploadMaxSize:    c.Janitor.UploadMaxSize,
+			WorkspaceMaxSize: c.Janitor.WorkspaceMaxSize,
+		},
+	}
+}
+
+func fileClientQuotas(quotas map[string]Quota) map[string]fileQuota {
+	if quotas == nil {
+		return nil
+	}
+
+	fq := make(map[string]fileQuota, len(quotas))
+	for client, q := range quotas {
+		fq[client] = fileQuota(q)
+	}
+	return fq
+}
+
+func fileNotificationSinks(sinks []NotificationSink) []fileNotificationSink {
+	if sinks == nil {
+		return nil
+	}
+
+	fs := make([]fileNotificationSink, 0, len(sinks))
+	for _, n := range sinks {
+		fs = append(fs, fileNotificationSink{
+			Type:    n.Type,
+			URL:     n.URL,
+			SMTP:    fileSMTPConfig(n.SMTP),
+			Tools:   n.Tools,
+			States:  n.States,
+			Tenants: n.Tenants,
+		})
+	}
+	return fs
+}
+
+func notificationSinks(sinks []fileNotificationSink) []NotificationSink {
+	if sinks == nil {
+		return nil
+	}
+
+	ns := make([]NotificationSink, 0, len(sinks))
+	for _, f := range sinks {
+		ns = append(ns, NotificationSink{
+			Type:    f.Type,
+			URL:     f.URL,
+			SMTP:    SMTPConfig(f.SMTP),
+			Tools:   f.Tools,
+			States:  f.States,
+			Tenants: f.Tenants,
+		})
+	}
+	return ns
+}
+
+func fileBrokers(configs []BrokerConfig) []fileBrokerConfig {
+	if configs == nil {
+		return nil
+	}
+
+	fb := make([]fileBrokerConfig, 0, len(configs))
+	for _, b := range configs {
+		fb = append(fb, fileBrokerConfig(b))
+	}
+	return fb
+}
+
+func brokerConfigs(configs []fileBrokerConfig) []BrokerConfig {
+	if configs == nil {
+		return nil
+	}
+
+	bc := make([]BrokerConfig, 0, len(configs))
+	for _, f := range configs {
+		bc = append(bc, BrokerConfig(f))
+	}
+	return bc
+}
+
+func newFileProcessLimits(l ProcessLimits) fileProcessLimits {
+	return fileProcessLimits{CPUTime: l.CPUTime.String(), Memory: l.Memory, Processes: l.Processes}
+}
+
+func fileClientProcessLimits(limits map[string]ProcessLimits) map[string]fileProcessLimits {
+	if limits == nil {
+		return nil
+	}
+
+	fl := make(map[string]fileProcessLimits, len(limits))
+	for client, l := range limits {
+		fl[client] = newFileProcessLimits(l)
+	}
+	return fl
+}
+
+// limits converts the file process limits back to ProcessLimits. The CPU time can be left out, which means no limit, since the limits
+// of clients don't have the CPU time of the command line filled in.
+func (f fileProcessLimits) limits() (ProcessLimits, error) {
+	l := ProcessLimits{Memory: f.Memory, Processes: f.Processes}
+	if f.CPUTime != "" {
+		var err error
+		if l.CPUTime, err = time.ParseDuration(f.CPUTime); err != nil {
+			return ProcessLimits{}, fmt.Errorf("invalid cpuTime: %w", err)
+		}
+	}
+	return l, nil
+}
+
+func newFileClientOpts(opts map[string]ClientOpts) map[string]fileClientOpts {
+	if opts == nil {
+		return nil
+	}
+
+	fo := make(map[string]fileClientOpts, len(opts))
+	for client, o := range opts {
+		// The options are copied, so that decoding a file over them doesn't change the config that they are from.
+		o.DisableCache, o.Quiet = copyBool(o.DisableCache), copyBool(o.Quiet)
+		fo[client] = fileClientOpts(o)
+	}
+	return fo
+}
+
+func copyBool(b *bool) *bool {
+	if b == nil {
+		return nil
+	}
+	v := *b
+	return &v
+}
+
+func fileClientPolicies(policies map[string]ToolPolicy) map[string]filePolicy {
+	if policies == nil {
+		return nil
+	}
+
+	fp := make(map[string]filePolicy, len(policies))
+	for client, p := range policies {
+		fp[client] = filePolicy(p)
+	}
+	return fp
+}
+
+func fileModelRoutes(models map[string]ModelRoute) map[string]fileModelRoute {
+	if models == nil {
+		return nil
+	}
+
+	routes := make(map[string]fileModelRoute, len(models))
+	for name, m := range models {
+		routes[name] = fileModelRoute(m)
+	}
+	return routes
+}
+
+// config converts the file config back to a Config. The file of the returned config is the given file.
+func (f fileConfig) config(file string) (Config, error) {
+	var (
+		c = Config{
+			File:        file,
+			Port:        f.Port,
+			GRPCPort:    f.GRPCPort,
+			DebugPort:   f.DebugPort,
+			HTTP2:       f.HTTP2,
+			GraphQL:     f.GraphQL,
+			JSONRPC:     f.JSONRPC,
+			MCP:         f.MCP,
+			LogLevel:    f.LogLevel,
+			ReadOnly:    f.ReadOnly,
+			APIKeys:     f.APIKeys,
+			APIKeysFile: f.APIKeysFile,
+			JWT: JWTConfig{
+				Secret:         f.JWT.Secret,
+				JWKSURL:        f.JWT.JWKSURL,
+				Issuer:         f.JWT.Issuer,
+				Audience:       f.JWT.Audience,
+				ScopeClaim:     f.JWT.ScopeClaim,
+				ToolPathsClaim: f.JWT.ToolPathsClaim,
+				TenantClaim:    f.JWT.TenantClaim,
+			},
+			MaxConcurrentRuns: f.MaxConcurrentRuns,
+			MaxQueuedRuns:     f.MaxQueuedRuns,
+			RunPriority:       f.RunPriority,
+			PreemptRuns:       f.PreemptRuns,
+			RunHistoryDB:      f.RunHistoryDB,
+			EnvAllowlist:      f.EnvAllowlist,
+			EnvDenylist:       f.EnvDenylist,
+			ResultCacheSize:   f.ResultCacheSize,
+			ParseCacheSize:    f.ParseCacheSize,
+			CallbackNetworks:  f.CallbackNetworks,
+			CORS: CORSConfig{
+				AllowedOrigins:   f.CORS.AllowedOrigins,
+				AllowedMethods:   f.CORS.AllowedMethods,
+				AllowedHeaders:   f.CORS.AllowedHeaders,
+				AllowCredentials: f.CORS.AllowCredentials,
+			},
+			UploadDir:       f.UploadDir,
+			Queue:           QueueConfig(f.Queue),
+			Compression:     CompressionConfig(f.Compression),
+			DefaultOpts:     gptscript.Opts(f.DefaultOpts),
+			LockedOpts:      f.LockedOpts,
+			CacheRoot:       f.CacheRoot,
+			ToolDirs:        f.ToolDirs,
+			CallbackSecret:  f.CallbackSecret,
+			SignedURLKey:    f.SignedURLKey,
+			Notifications:   notificationSinks(f.Notifications),
+			Brokers:         brokerConfigs(f.Brokers),
+			AuditLog:        f.AuditLog,
+			Hooks:           f.Hooks,
+			Redaction:       RedactionConfig(f.Redaction),
+			Policy:          ToolPolicy(f.Policy),
+			DefaultModel:    f.DefaultModel,
+			CredentialsFile: f.CredentialsFile,
+			CredentialsKey:  f.CredentialsKey,
+			Artifacts:       ArtifactsConfig(f.Artifacts),
+			Storage:         objects.Config(f.Storage),
+			Cluster:         ClusterConfig(f.Cluster),
+			Quota:           Quota(f.Quota),
+			Backend:         f.Backend,
+			GPTScript:       GPTScriptConfig(f.GPTScript),
+			Sandbox:         SandboxConfig(f.Sandbox),
+			Kubernetes:      KubernetesConfig(f.Kubernetes),
+			Stream: StreamConfig{
+				BufferSize:           f.Stream.BufferSize,
+				BufferPolicy:         f.Stream.BufferPolicy,
+				KeepRunsOnDisconnect: f.Stream.KeepRunsOnDisconnect,
+				MaxOutputSize:        f.Stream.MaxOutputSize,
+			},
+			Retry: RetryConfig{
+				MaxAttempts: f.Retry.MaxAttempts,
+				On:          f.Retry.On,
+			},
+			CircuitBreaker: CircuitBreakerConfig{
+				FailurePercent: f.CircuitBreaker.FailurePercent,
+				MinRuns:        f.CircuitBreaker.MinRuns,
+				Window:         f.CircuitBreaker.Window,
+			},
+			Limits: LimitsConfig{
+				Body:    f.Limits.Body,
+				Content: f.Limits.Content,
+				Input:   f.Limits.Input,
+				Upload:  f.Limits.Upload,
+			},
+			Janitor: JanitorConfig{
+				CacheMaxSize:     f.Janitor.CacheMaxSize,
+				UploadMaxSize:    f.Janitor.UploadMaxSize,
+				WorkspaceMaxSize: f.Janitor.WorkspaceMaxSize,
+			},
+			JSONRPCStdio:        f.JSONRPCStdio,
+			JSONRPCStdioAPIKey:  f.JSONRPCStdioAPIKey,
+			ChatCompletionsTool: f.ChatCompletionsTool,
+			ClientRunPriorities: f.ClientRunPriorities,
+		}
+		err error
+	)
+
+	for _, d := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"maxRunTimeout", f.MaxRunTimeout, &c.MaxRunTimeout},
+		{"resultCacheTTL", f.ResultCacheTTL, &c.ResultCacheTTL},
+		{"parseCacheTTL", f.ParseCacheTTL, &c.ParseCacheTTL},
+		{"toolCacheTTL", f.ToolCacheTTL, &c.ToolCacheTTL},
+		{"cors.maxAge", f.CORS.MaxAge, &c.CORS.MaxAge},
+		{"heartbeatInterval", f.HeartbeatInterval, &c.HeartbeatInterval},
+		{"stream.writeTimeout", f.Stream.WriteTimeout, &c.Stream.WriteTimeout},
+		{"stream.flushInterval", f.Stream.FlushInterval, &c.Stream.FlushInterval},
+		{"retry.backoff", f.Retry.Backoff, &c.Retry.Backoff},
+		{"retry.maxBackoff", f.Retry.MaxBackoff, &c.Retry.MaxBackoff},
+		{"circuitBreaker.cooldown", f.CircuitBreaker.Cooldown, &c.CircuitBreaker.Cooldown},
+		{"limits.parseTimeout", f.Limits.ParseTimeout, &c.Limits.ParseTimeout},
+		{"janitor.interval", f.Janitor.Interval, &c.Janitor.Interval},
+		{"janitor.cacheTTL", f.Janitor.CacheTTL, &c.Janitor.CacheTTL},
+		{"janitor.uploadTTL", f.Janitor.UploadTTL, &c.Janitor.UploadTTL},
+	} {
+		if *d.dest, err = time.ParseDuration(d.value); err != nil {
+			return Config{}, fmt.Errorf("invalid %s: %w", d.name, err)
+		}
+	}
+
+	if f.ClientQuotas != nil {
+		c.ClientQuotas = make(map[string]Quota, len(f.ClientQuotas))
+		for client, q := range f.ClientQuotas {
+			c.ClientQuotas[client] = Quota(q)
+		}
+	}
+
+	if f.TenantQuotas != nil {
+		c.TenantQuotas = make(map[string]Quota, len(f.TenantQuotas))
+		for tenant, q := range f.TenantQuotas {
+			c.TenantQuotas[tenant] = Quota(q)
+		}
+	}
+
+	if c.ProcessLimits, err = f.ProcessLimits.limits(); err != nil {
+		return Config{}, fmt.Errorf("invalid processLimits: %w", err)
+	}
+	if f.ClientProcessLimits != nil {
+		c.ClientProcessLimits = make(map[string]ProcessLimits, len(f.ClientProcessLimits))
+		for client, l := range f.ClientProcessLimits {
+			if c.ClientProcessLimits[client], err = l.limits(); err != nil {
+				return Config{}, fmt.Errorf("invalid process limits of client %q: %w", client, err)
+			}
+		}
+	}
+
+	if f.ClientOpts != nil {
+		c.ClientOpts = make(map[string]ClientOpts, len(f.ClientOpts))
+		for client, o := range f.ClientOpts {
+			c.ClientOpts[client] = ClientOpts(o)
+		}
+	}
+
+	if f.ClientPolicies != nil {
+		c.ClientPolicies = make(map[string]ToolPolicy, len(f.ClientPolicies))
+		for client, p := range f.ClientPolicies {
+			c.ClientPolicies[client] = ToolPolicy(p)
+		}
+	}
+
+	if f.Models != nil {
+		c.Models = make(map[string]ModelRoute, len(f.Models))
+		for name, m := range f.Models {
+			c.Models[name] = ModelRoute(m)
+		}
+	}
+
+	if c.ParseRateLimit, err = ParseRateLimit(f.ParseRateLimit); err != nil {
+		return Config{}, fmt.Errorf("invalid parseRateLimit: %w", err)
+	}
+	if c.ExecRateLimit, err = ParseRateLimit(f.ExecRateLimit); err != nil {
+		return Config{}, fmt.Errorf("invalid execRateLimit: %w", err)
+	}
+
+	return c, nil
+}
+
+// redact replaces the secrets in the config, leaving the scopes of the API keys so that it is clear what they grant.
+func (f fileConfig) redact() fileConfig {
+	keys := make([]string, 0, len(f.APIKeys))
+	for _, k := range f.APIKeys {
+		_, sc, ok := strings.Cut(k, ":")
+		if ok {
+			keys = append(keys, redacted+":"+sc)
+		} else {
+			keys = append(keys, redacted)
+		}
+	}
+	f.APIKeys = keys
+
+	if f.JWT.Secret != "" {
+		f.JWT.Secret = redacted
+	}
+	if f.CallbackSecret != "" {
+		f.CallbackSecret = redacted
+	}
+	if f.SignedURLKey != "" {
+		f.SignedURLKey = redacted
+	}
+	if f.JSONRPCStdioAPIKey != "" {
+		f.JSONRPCStdioAPIKey = redacted
+	}
+	if f.CredentialsKey != "" {
+		f.CredentialsKey = redacted
+	}
+
+	models := make(map[string]fileModelRoute, len(f.Models))
+	for name, m := range f.Models {
+		if m.APIKey != "" {
+			m.APIKey = redacted
+		}
+		models[name] = m
+	}
+	f.Models = models
+
+	// The URLs of incoming webhooks of Slack are their credentials.
+	sinks := make([]fileNotificationSink, 0, len(f.Notifications))
+	for _, n := range f.Notifications {
+		if n.Type == notificationSlack && n.URL != "" {
+			n.URL = redacted
+		}
+		if n.SMTP.Password != "" {
+			n.SMTP.Password = redacted
+		}
+		sinks = append(sinks, n)
+	}
+	f.Notifications = sinks
+
+	// The URLs of brokers can have their credentials.
+	brokers := make([]fileBrokerConfig, 0, len(f.Brokers))
+	for _, b := range f.Brokers {
+		if u, err := url.Parse(b.URL); err == nil && u.User != nil {
+			u.User = url.User(redacted)
+			b.URL = u.String()
+		}
+		brokers = append(brokers, b)
+	}
+	f.Brokers = brokers
+
+	return f
+}
+
+// loadConfig returns the config with the settings of its config file applied on top. Settings that aren't in the file keep the
+// value they have in the given config, which comes from the flags. If there is no config file, then the config is returned as is.
+func loadConfig(c Config) (Config, error) {
+	if c.File == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(c.File)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// JSON is a subset of YAML, so both can be decoded as YAML.
+	f := newFileConfig(c)
+	if err = yaml.Unmarshal(data, &f); err != nil {
+		return Config{}, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	return f.config(c.File)
+}
+
+// settings are the parts of the config that are applied again when the config is reloaded, along with what is built from them.
+type settings struct {
+	config         Config
+	authenticators []authenticator
+	env            *envPolicy
+	// backend is the backend that runs are executed with.
+	backend ExecBackend
+	// hooks are called before and after each run.
+	hooks []namedHook
+	// redactor redacts the events of runs, if redaction is configured.
+	redactor *redactor
+	// callbacks is the client that the callbacks of runs are sent with.
+	callbacks *http.Client
+	// stop stops the background work of the authenticators, like refreshing the JWKS.
+	stop context.CancelFunc
+}
+
+// newSettings builds the settings from the config.
+func newSettings(ctx context.Context, config Config) (*settings, error) {
+	if config.MaxRunTimeout <= 0 {
+		config.MaxRunTimeout = toolRunTimeout
+	}
+
+	if config.LogLevel != "" {
+		if _, err := log.ParseLevel(config.LogLevel); err != nil {
+			return nil, err
+		}
+	}
+
+	env, err := newEnvPolicy(config.EnvAllowlist, config.EnvDenylist)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validateModels(config.Models, config.DefaultModel); err != nil {
+		return nil, err
+	}
+
+	if err = config.Quota.validate(); err != nil {
+		return nil, fmt.Errorf("invalid quota: %w", err)
+	}
+	for client, q := range config.ClientQuotas {
+		if err = q.validate(); err != nil {
+			return nil, fmt.Errorf("invalid quota of client %q: %w", client, err)
+		}
+	}
+	if err = config.ProcessLimits.validate(); err != nil {
+		return nil, fmt.Errorf("invalid process limits: %w", err)
+	}
+	for client, l := range config.ClientProcessLimits {
+		if err = l.validate(); err != nil {
+			return nil, fmt.Errorf("invalid process limits of client %q: %w", client, err)
+		}
+	}
+	for tenant, q := range config.TenantQuotas {
+		if err = validateTenant(tenant); err != nil {
+			return nil, fmt.Errorf("invalid quota of tenant: %w", err)
+		}
+		if err = q.validate(); err != nil {
+			return nil, fmt.Errorf("invalid quota of tenant %q: %w", tenant, err)
+		}
+	}
+
+	for _, name := range config.LockedOpts {
+		if !slices.Contains(optNames, name) {
+			return nil, fmt.Errorf("invalid locked option %q, must be one of %s", name, strings.Join(optNames, ", "))
+		}
+	}
+
+	// The tool directories are compared with the absolute paths of the files of runs, so relative directories are relative to the
+	// working directory of the server.
+	toolDirs := make([]string, len(config.ToolDirs))
+	for i, dir := range config.ToolDirs {
+		if toolDirs[i], err = filepath.Abs(dir); err != nil {
+			return nil, fmt.Errorf("invalid tool directory %q: %w", dir, err)
+		}
+	}
+	config.ToolDirs = toolDirs
+
+	// With a cache root, the cacheDir of the default options is the name of a cache directory of each tenant, like that of runs.
+	if config.CacheRoot != "" {
+		if config.CacheRoot, err = filepath.Abs(config.CacheRoot); err != nil {
+			return nil, fmt.Errorf("invalid cache root: %w", err)
+		}
+		if err = validateCacheName(config.DefaultOpts.CacheDir); err != nil {
+			return nil, fmt.Errorf("invalid default options: %w", err)
+		}
+		for client, opts := range config.ClientOpts {
+			if err = validateCacheName(opts.CacheDir); err != nil {
+				return nil, fmt.Errorf("invalid options of client %q: %w", client, err)
+			}
+		}
+	}
+
+	if err = config.Policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	for client, p := range config.ClientPolicies {
+		if err = p.validate(); err != nil {
+			return nil, fmt.Errorf("invalid policy of client %q: %w", client, err)
+		}
+	}
+
+	if err = config.Stream.validate(); err != nil {
+		return nil, fmt.Errorf("invalid stream: %w", err)
+	}
+
+	if err = config.Retry.validate(); err != nil {
+		return nil, fmt.Errorf("invalid retry: %w", err)
+	}
+
+	if err = config.CircuitBreaker.validate(); err != nil {
+		return nil, fmt.Errorf("invalid circuit breaker: %w", err)
+	}
+
+	if err = config.Queue.validate(); err != nil {
+		return nil, fmt.Errorf("invalid queue: %w", err)
+	}
+
+	for i, n := range config.Notifications {
+		if err = n.validate(); err != nil {
+			return nil, fmt.Errorf("invalid notification %d: %w", i, err)
+		}
+	}
+
+	for i, b := range config.Brokers {
+		if err = b.validate(); err != nil {
+			return nil, fmt.Errorf("invalid broker %d: %w", i, err)
+		}
+	}
+
+	if err = config.Compression.validate(); err != nil {
+		return nil, fmt.Errorf("invalid compression: %w", err)
+	}
+
+	if err = config.Limits.validate(); err != nil {
+		return nil, fmt.Errorf("invalid limits: %w", err)
+	}
+
+	if err = config.Janitor.validate(); err != nil {
+		return nil, fmt.Errorf("invalid janitor: %w", err)
+	}
+
+	if err = config.Storage.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid storage: %w", err)
+	}
+
+	if err = config.Artifacts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid artifacts: %w", err)
+	}
+	if config.Artifacts.Storage && !config.Storage.Enabled() {
+		return nil, fmt.Errorf("invalid artifacts: the storage of the server must be configured to keep artifacts in it")
+	}
+
+	if err = config.Cluster.validate(); err != nil {
+		return nil, fmt.Errorf("invalid cluster: %w", err)
+	}
+	if config.Cluster.enabled() && !config.Storage.Enabled() {
+		return nil, fmt.Errorf("invalid cluster: the storage of the server must be configured for the replicas to register in it")
+	}
+
+	if err = config.GPTScript.validate(); err != nil {
+		return nil, fmt.Errorf("invalid gptscript: %w", err)
+	}
+
+	if err = config.Sandbox.validate(); err != nil {
+		return nil, fmt.Errorf("invalid sandbox: %w", err)
+	}
+
+	backend, err := newBackend(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks, err := newHooks(config.Hooks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hooks: %w", err)
+	}
+
+	redactor, err := newRedactor(config.Redaction)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction: %w", err)
+	}
+
+	callbackNetworks, err := parseCallbackNetworks(config.CallbackNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	st := &settings{config: config, env: env, backend: backend, hooks: hooks, redactor: redactor, callbacks: newCallbackClient(callbackNetworks), stop: cancel}
+
+	if len(config.APIKeys) > 0 || config.APIKeysFile != "" {
+		a, err := newAPIKeyAuthenticator(config.APIKeys, config.APIKeysFile)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		st.authenticators = append(st.authenticators, a)
+	}
+	if config.JWT.Secret != "" || config.JWT.JWKSURL != "" {
+		a, err := newJWTAuthenticator(ctx, config.JWT)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		st.authenticators = append(st.authenticators, a)
+	}
+	// Signed URLs are only authenticated if authentication is enabled, since every request is allowed otherwise.
+	if len(st.authenticators) > 0 && config.SignedURLKey != "" {
+		st.authenticators = append(st.authenticators, &signedURLAuthenticator{key: []byte(config.SignedURLKey)})
+	}
+
+	return st, nil
+}
+
+func (st *settings) authEnabled() bool {
+	return len(st.authenticators) > 0
+}
+
+// restartOnly are the settings that are only applied when the server starts.
+func (st *settings) restartOnly() any {
+	c := st.config
+	return []any{c.Port, c.GRPCPort, c.DebugPort, c.HTTP2, c.JSONRPCStdio, c.JSONRPCStdioAPIKey, c.RunHistoryDB, c.ResultCacheTTL, c.ResultCacheSize, c.ParseCacheTTL, c.ParseCacheSize, c.ToolCacheTTL, c.CORS, c.UploadDir, c.CredentialsFile, c.CredentialsKey, c.AuditLog, c.Artifacts, c.Storage, c.Cluster, c.GPTScript, c.Brokers}
+}
+
+// current returns the settings that are in effect.
+func (s *server) current() *settings {
+	return s.settings.Load()
+}
+
+// applySettings puts the settings into effect, and stops the background work of the settings that they replace.
+func (s *server) applySettings(st *settings) {
+	if st.config.LogLevel != "" {
+		level, _ := log.ParseLevel(st.config.LogLevel)
+		log.SetLevel(level)
+	}
+
+	s.limiter.setLimits(st.config.MaxConcurrentRuns, st.config.MaxQueuedRuns, st.config.PreemptRuns)
+	s.rateLimiters[scopeParse].setLimit(st.config.ParseRateLimit)
+	s.rateLimiters[scopeExec].setLimit(st.config.ExecRateLimit)
+
+	// Read-only mode is only changed when the config changes it, so that reloading the config doesn't undo a change through the admin
+	// API.
+	if previous := s.current(); previous == nil || previous.config.ReadOnly != st.config.ReadOnly {
+		if s.readOnly.Swap(st.config.ReadOnly) != st.config.ReadOnly {
+			slog.Info("Changed read-only mode", "readOnly", st.config.ReadOnly)
+		}
+	}
+
+	if previous := s.settings.Swap(st); previous != nil {
+		previous.stop()
+	}
+}
+
+// reload loads the config again and applies the settings that can change while the server is running. If the config is invalid,
+// then the current settings are kept.
+func (s *server) reload(ctx context.Context, base Config) {
+	config, err := loadConfig(base)
+	if err != nil {
+		slog.Error("Failed to reload config", "error", err)
+		return
+	}
+
+	current := s.current()
+	st, err := newSettings(ctx, config)
+	if err != nil {
+		slog.Error("Failed to reload config", "error", err)
+		return
+	}
+
+	if !reflect.DeepEqual(st.restartOnly(), current.restartOnly()) {
+		slog.Warn("Some changes to the config are only applied when the server is restarted: the ports, JSON-RPC on stdio, the run history, the result, parse, and tool caches, CORS, the upload directory, the artifacts, the storage, the cluster, the gptscript binary, and the brokers")
+	}
+
+	s.applySettings(st)
+	slog.Info("Reloaded config", "file", config.File)
+}
+
+// watchConfig reloads the config when the server receives SIGHUP, or when the config file changes, until the context is done.
+func (s *server) watchConfig(ctx context.Context, base Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	if base.File == "" {
+		// There is nothing to reload without a config file, but SIGHUP is still handled so that it doesn't stop the server.
+		for {
+			select {
+			case <-hup:
+				slog.Info("Ignoring SIGHUP because there is no config file")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	var modTime time.Time
+	if fi, err := os.Stat(base.File); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			s.reload(ctx, base)
+		case <-ticker.C:
+			fi, err := os.Stat(base.File)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			s.reload(ctx, base)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getConfig returns the config that is in effect, with the secrets redacted.
+func (s *server) getConfig(w http.ResponseWriter, _ *http.Request) {
+	writeResponse(w, newFileConfig(s.current().config).redact())
+}
+
+type defaultOptsKey struct{}
+
+// withDefaultOpts sets the gptscript options that are used for the options that a run doesn't set.
+func withDefaultOpts(ctx context.Context, opts gptscript.Opts) context.Context {
+	return context.WithValue(ctx, defaultOptsKey{}, opts)
+}
+
+// applyDefaultOpts fills in the options that aren't set with the default options of the context, and scopes the cache directory
+// to the tenant of the context if the context has a cache root.
+func applyDefaultOpts(ctx context.Context, opts requestOpts) gptscript.Opts {
+	defaults, _ := ctx.Value(defaultOptsKey{}).(gptscript.Opts)
+	o := layerOpts(opts, defaults)
+	o.CacheDir = scopeCacheDir(ctx, tenantOf(ctx), o.CacheDir)
+	return o
+}
+
+// optNames are the names of the gptscript options, as they are named in requests, which are the options that can be locked.
+var optNames = []string{"disableCache", "cacheDir", "quiet", "chdir", "subTool"}
+
+// defaultOpts returns the default options of the client, which are its own defaults layered over the defaults of the server.
+func (s *server) defaultOpts(client string) gptscript.Opts {
+	config := s.current().config
+	if opts, ok := config.ClientOpts[client]; ok {
+		return layerOpts(requestOpts(opts), config.DefaultOpts)
+	}
+	return config.DefaultOpts
+}
+
+// checkLockedOpts returns an error if the options set a locked option to something other than its default for the client.
+func (s *server) checkLockedOpts(client string, opts requestOpts) error {
+	defaults := s.defaultOpts(client)
+	for _, name := range s.current().config.LockedOpts {
+		var overridden bool
+		switch name {
+		case "disableCache":
+			overridden = opts.DisableCache != nil && *opts.DisableCache != defaults.DisableCache
+		case "cacheDir":
+			overridden = opts.CacheDir != "" && opts.CacheDir != defaults.CacheDir
+		case "quiet":
+			overridden = opts.Quiet != nil && *opts.Quiet != defaults.Quiet
+		case "chdir":
+			overridden = opts.Chdir != "" && opts.Chdir != defaults.Chdir
+		case "subTool":
+			overridden = opts.SubTool != "" && opts.SubTool != defaults.SubTool
+		}
+		if overridden {
+			return invalidField(name, fmt.Sprintf("%s is locked by the server and can't be set", name))
+		}
+	}
+	return nil
+}
+
+// layerOpts fills in the options that aren't set with the defaults. An option that the request or the client set to false overrides
+// a default of true.
+func layerOpts(opts requestOpts, defaults gptscript.Opts) gptscript.Opts {
+	if opts.DisableCache != nil {
+		defaults.DisableCache = *opts.DisableCache
+	}
+	if opts.Quiet != nil {
+		defaults.Quiet = *opts.Quiet
+	}
+	if opts.CacheDir != "" {
+		defaults.CacheDir = opts.CacheDir
+	}
+	if opts.Chdir != "" {
+		defaults.Chdir = opts.Chdir
+	}
+	if opts.SubTool != "" {
+		defaults.SubTool = opts.SubTool
+	}
+	return defaults
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gptscript-ai/go-gptscript"
+)
+
+func TestLayerOpts(t *testing.T) {
+	defaults := gptscript.Opts{DisableCache: true, Quiet: true, CacheDir: "default", SubTool: "main"}
+
+	tests := []struct {
+		name    string
+		request string
+		want    gptscript.Opts
+	}{
+		{name: "not set", request: `{}`, want: defaults},
+		{
+			name:    "false overrides true",
+			request: `{"disableCache": false, "quiet": false}`,
+			want:    gptscript.Opts{CacheDir: "default", SubTool: "main"},
+		},
+		{
+			name:    "set",
+			request: `{"disableCache": true, "cacheDir": "mine", "chdir": "dir", "subTool": "other"}`,
+			want:    gptscript.Opts{DisableCache: true, Quiet: true, CacheDir: "mine", Chdir: "dir", SubTool: "other"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req fileRequest
+			if err := json.Unmarshal([]byte(tt.request), &req); err != nil {
+				t.Fatal(err)
+			}
+			if got := layerOpts(req.requestOpts, defaults); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckLockedOpts(t *testing.T) {
+	s := new(server)
+	s.settings.Store(&settings{config: Config{DefaultOpts: gptscript.Opts{Quiet: true}, LockedOpts: []string{"quiet"}}})
+
+	yes, no := true, false
+	if err := s.checkLockedOpts("", requestOpts{Quiet: &yes}); err != nil {
+		t.Errorf("unexpected error for the default: %v", err)
+	}
+	if err := s.checkLockedOpts("", requestOpts{}); err != nil {
+		t.Errorf("unexpected error for options that aren't set: %v", err)
+	}
+	if err := s.checkLockedOpts("", requestOpts{Quiet: &no}); err == nil {
+		t.Error("expected an error for overriding the locked default")
+	}
+}
+
+func TestClientDefaultOpts(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	data := `
+defaultOpts:
+  disableCache: true
+  quiet: true
+clientOpts:
+  verbose:
+    quiet: false
+  cached:
+    disableCache: false
+    subTool: main
+  unset:
+    cacheDir: unset
+`
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(Config{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := new(server)
+	s.settings.Store(&settings{config: config})
+
+	tests := []struct {
+		client string
+		want   gptscript.Opts
+	}{
+		{client: "other", want: gptscript.Opts{DisableCache: true, Quiet: true}},
+		{client: "verbose", want: gptscript.Opts{DisableCache: true}},
+		{client: "cached", want: gptscript.Opts{Quiet: true, SubTool: "main"}},
+		{client: "unset", want: gptscript.Opts{DisableCache: true, Quiet: true, CacheDir: "unset"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.client, func(t *testing.T) {
+			if got := s.defaultOpts(tt.client); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
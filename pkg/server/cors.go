@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/rs/cors"
+)
+
+// CORSConfig configures the cross-origin requests that browsers are allowed to make. Empty fields use the defaults, which allow
+// any origin to use the methods and headers of the API without credentials.
+type CORSConfig struct {
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// AllowCredentials allows browsers to send cookies and other credentials, which requires the allowed origins to be set.
+	AllowCredentials bool
+	// MaxAge is how long browsers can cache the result of a preflight request.
+	MaxAge time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodHead}
+	// The default headers include those sent by EventSource and the run ID, so that browsers can resume streams of server sent
+	// events, If-None-Match, so that editors in the browser can revalidate parses, and the request ID, so that their requests can
+	// be traced.
+	defaultCORSHeaders = []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "Authorization", "Cache-Control", "If-None-Match", lastEventIDHeader, runIDHeader, sessionHeader, requestIDHeader}
+	// corsExposedHeaders are the response headers that scripts in the browser are allowed to read, including the ID of the request,
+	// so that errors can be reported with it.
+	corsExposedHeaders = []string{runIDHeader, requestIDHeader, cacheHeader, "ETag", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"}
+)
+
+func newCORS(config CORSConfig) (*cors.Cors, error) {
+	origins := config.AllowedOrigins
+	if len(origins) == 0 {
+		origins = []string{"*"}
+	}
+	if config.AllowCredentials && slices.Contains(origins, "*") {
+		return nil, errors.New("allowing credentials in cross-origin requests requires the allowed origins to be set")
+	}
+
+	methods := config.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+
+	headers := config.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+
+	return cors.New(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   methods,
+		AllowedHeaders:   headers,
+		ExposedHeaders:   corsExposedHeaders,
+		AllowCredentials: config.AllowCredentials,
+		MaxAge:           int(config.MaxAge.Seconds()),
+	}), nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORSRequestID(t *testing.T) {
+	c, err := newCORS(CORSConfig{AllowedOrigins: []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set(requestIDHeader, "id")
+	}))
+
+	preflight := httptest.NewRequest(http.MethodOptions, "/runs", nil)
+	preflight.Header.Set("Origin", "https://example.com")
+	preflight.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	preflight.Header.Set("Access-Control-Request-Headers", strings.ToLower(requestIDHeader))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, preflight)
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); !strings.EqualFold(got, requestIDHeader) {
+		t.Errorf("got allowed headers %q, want %s", got, requestIDHeader)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/runs", nil)
+	r.Header.Set("Origin", "https://example.com")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(got, http.CanonicalHeaderKey(requestIDHeader)) {
+		t.Errorf("got exposed headers %q, want them to include %s", got, requestIDHeader)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/secrets"
+)
+
+// credentialName is the syntax of the names of credentials, which are part of the path of the credential.
+var credentialName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// credentialRequest creates or replaces a credential, which is a set of environment variables that runs can use by its name.
+type credentialRequest struct {
+	Env map[string]string `json:"env"`
+}
+
+func (c *credentialRequest) validate() error {
+	if len(c.Env) == 0 {
+		return missingField("env", "at least one environment variable is required")
+	}
+
+	for name, value := range c.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") || strings.ContainsRune(value, 0) {
+			return invalidField("env", fmt.Sprintf("invalid environment variable %q", name))
+		}
+		if matchesAny(protectedEnv, name) {
+			return invalidField("env", fmt.Sprintf("environment variable %q is used by the server and can't be part of a credential", name))
+		}
+	}
+	return nil
+}
+
+// credential is a credential as it is returned by the API, which has the names of its environment variables but never their values.
+type credential struct {
+	Name      string    `json:"name"`
+	Env       []string  `json:"env"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func newCredential(c secrets.Credential) credential {
+	env := make([]string, 0, len(c.Env))
+	for name := range c.Env {
+		env = append(env, name)
+	}
+	slices.Sort(env)
+
+	return credential{Name: c.Name, Env: env, CreatedAt: c.CreatedAt, UpdatedAt: c.UpdatedAt}
+}
+
+// credentialEnv returns the environment variables of the credentials of the tenant, in the form "NAME=value". Credentials are
+// looked up when each run starts, so runs use the values that the credentials have at the time.
+func (s *server) credentialEnv(tenant string, names []string) ([]string, error) {
+	var env []string
+	for _, name := range names {
+		c, err := s.secrets.GetCredential(context.Background(), tenant, name)
+		if errors.Is(err, secrets.ErrNotFound) {
+			return nil, invalidField("credentials", fmt.Sprintf("credential %q not found", name))
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get credential %q: %w", name, err)
+		}
+
+		for k, v := range c.Env {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env, nil
+}
+
+// putCredential creates or replaces the credential of the path.
+func (s *server) putCredential(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !credentialName.MatchString(name) {
+		writeError(w, http.StatusBadRequest, invalidField("name", "the name of a credential can only have letters, digits, periods, dashes, and underscores"))
+		return
+	}
+
+	req := new(credentialRequest)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now()
+	c := secrets.Credential{Name: name, Tenant: tenantOf(r.Context()), Env: req.Env, CreatedAt: now, UpdatedAt: now}
+
+	existing, err := s.secrets.GetCredential(r.Context(), c.Tenant, name)
+	if err == nil {
+		c.CreatedAt = existing.CreatedAt
+	} else if !errors.Is(err, secrets.ErrNotFound) {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get credential: %w", err))
+		return
+	}
+
+	if err := s.secrets.SaveCredential(r.Context(), c); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to save credential: %w", err))
+		return
+	}
+
+	if errors.Is(err, secrets.ErrNotFound) {
+		w.WriteHeader(http.StatusCreated)
+	}
+	writeResponse(w, newCredential(c))
+}
+
+// listCredentials lists the credentials of the tenant of the caller, sorted by name.
+func (s *server) listCredentials(w http.ResponseWriter, r *http.Request) {
+	all, err := s.secrets.ListCredentials(r.Context(), tenantOf(r.Context()))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to list credentials: %w", err))
+		return
+	}
+
+	credentials := make([]credential, 0, len(all))
+	for _, c := range all {
+		credentials = append(credentials, newCredential(c))
+	}
+
+	writeResponse(w, map[string][]credential{"credentials": credentials})
+}
+
+func (s *server) getCredential(w http.ResponseWriter, r *http.Request) {
+	c, err := s.secrets.GetCredential(r.Context(), tenantOf(r.Context()), r.PathValue("name"))
+	if err != nil {
+		writeError(w, credentialErrorCode(err), credentialError(r, err))
+		return
+	}
+
+	writeResponse(w, newCredential(c))
+}
+
+// deleteCredential deletes the credential. Runs that use it and are already running keep its environment variables.
+func (s *server) deleteCredential(w http.ResponseWriter, r *http.Request) {
+	if err := s.secrets.DeleteCredential(r.Context(), tenantOf(r.Context()), r.PathValue("name")); err != nil {
+		writeError(w, credentialErrorCode(err), credentialError(r, err))
+		return
+	}
+
+	writeResponse(w, map[string]string{"status": "ok"})
+}
+
+func credentialError(r *http.Request, err error) error {
+	if errors.Is(err, secrets.ErrNotFound) {
+		return fmt.Errorf("credential %q not found", r.PathValue("name"))
+	}
+	return err
+}
+
+func credentialErrorCode(err error) int {
+	if errors.Is(err, secrets.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"time"
+)
+
+// debugVars are the runtime diagnostics of the server, in the style of expvar. Comparing the number of goroutines with the
+// number of open streams and active runs shows whether goroutines are being leaked.
+type debugVars struct {
+	Cmdline     []string `json:"cmdline"`
+	Uptime      string   `json:"uptime"`
+	Goroutines  int      `json:"goroutines"`
+	OpenStreams int64    `json:"openStreams"`
+	// Runs is the number of runs in each state that are in progress.
+	Runs     map[runState]int `json:"runs"`
+	Queue    queueStats       `json:"queue"`
+	Draining bool             `json:"draining"`
+	ReadOnly bool             `json:"readOnly"`
+	MemStats runtime.MemStats `json:"memstats"`
+}
+
+// debugHandler returns the handler of the debug server, which serves pprof under /debug/pprof/ and the runtime diagnostics of the
+// server at /debug/vars. It has no authentication, so its port shouldn't be reachable from outside of the host or cluster.
+func (s *server) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/vars", s.debugVars)
+	return mux
+}
+
+// debugVars writes the runtime diagnostics of the server.
+func (s *server) debugVars(w http.ResponseWriter, _ *http.Request) {
+	vars := debugVars{
+		Cmdline:     os.Args,
+		Uptime:      time.Since(s.started).Round(time.Second).String(),
+		Goroutines:  runtime.NumGoroutine(),
+		OpenStreams: s.openStreams.Load(),
+		Runs:        map[runState]int{runStateQueued: 0, runStateRunning: 0},
+		Queue:       s.limiter.stats(),
+		Draining:    s.draining.Load(),
+		ReadOnly:    s.readOnly.Load(),
+	}
+	for _, r := range s.runs.active() {
+		vars.Runs[r.State]++
+	}
+	runtime.ReadMemStats(&vars.MemStats)
+
+	w.Header().Set("Content-Type", "application/json")
+	writeResponse(w, vars)
+}
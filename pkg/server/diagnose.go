@@ -0,0 +1,426 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+const (
+	diagnosticError   = "error"
+	diagnosticWarning = "warning"
+
+	diagnosticSyntax           = "syntax"
+	diagnosticUnknownDirective = "unknown-directive"
+	diagnosticInvalidValue     = "invalid-value"
+	diagnosticUnresolvedTool   = "unresolved-tool"
+	diagnosticDuplicateTool    = "duplicate-tool"
+)
+
+var (
+	// directiveLine matches the lines of the header of a tool that look like directives, like "Tools: search".
+	directiveLine = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9 _-]{0,31}):(.*)$`)
+	// errorLine finds the line that an error of gptscript is about, like "line 3" in the errors of its parser.
+	errorLine = regexp.MustCompile(`(?i)\bline:?\s*(\d+)`)
+)
+
+// directiveKind is how the value of a directive is checked.
+type directiveKind int
+
+const (
+	directiveText directiveKind = iota
+	directiveBool
+	directiveInt
+	directiveFloat
+	directiveArg
+	// directiveRefs is a directive whose value is a list of references to other tools.
+	directiveRefs
+)
+
+// directives are the directives of the header of a tool, by their names in lower case without spaces, dashes, or underscores, which
+// is how gptscript matches them.
+var directives = map[string]directiveKind{
+	"name":            directiveText,
+	"description":     directiveText,
+	"model":           directiveText,
+	"modelname":       directiveText,
+	"globalmodel":     directiveText,
+	"globalmodelname": directiveText,
+	"modelprovider":   directiveBool,
+	"internalprompt":  directiveBool,
+	"chat":            directiveBool,
+	"cache":           directiveBool,
+	"jsonresponse":    directiveBool,
+	"maxtokens":       directiveInt,
+	"temperature":     directiveFloat,
+	"args":            directiveArg,
+	"arg":             directiveArg,
+	"param":           directiveArg,
+	"params":          directiveArg,
+	"parameter":       directiveArg,
+	"parameters":      directiveArg,
+	"tools":           directiveRefs,
+	"tool":            directiveRefs,
+	"globaltools":     directiveRefs,
+	"globaltool":      directiveRefs,
+	"context":         directiveRefs,
+	"export":          directiveRefs,
+	"exports":         directiveRefs,
+	"exporttool":      directiveRefs,
+	"exporttools":     directiveRefs,
+	"sharetool":       directiveRefs,
+	"sharetools":      directiveRefs,
+	"exportcontext":   directiveRefs,
+	"sharecontext":    directiveRefs,
+	"credentials":     directiveRefs,
+	"credential":      directiveRefs,
+	"creds":           directiveRefs,
+	"cred":            directiveRefs,
+}
+
+// diagnoseRequest is tool content to find the problems of, with the options that it would be parsed with.
+type diagnoseRequest struct {
+	requestOpts `json:",inline"`
+	Content     string `json:"content"`
+}
+
+func (d *diagnoseRequest) validate() error {
+	if d.Content == "" {
+		return missingField("content", "content is required")
+	}
+	return nil
+}
+
+// diagnostic is a problem of tool content, at a position that editors can mark. Lines and columns start at 1, and columns count
+// characters. EndColumn is the column after the last character of the problem, if the problem isn't the whole line.
+type diagnostic struct {
+	Severity  string `json:"severity"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column,omitempty"`
+	EndColumn int    `json:"endColumn,omitempty"`
+}
+
+type diagnoseResponse struct {
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+// diagnose parses the tool content and returns its problems: the errors of the parser of gptscript, and the problems that gptscript
+// doesn't report when it parses, like directives with typos, which it takes as the start of the instructions, and references to
+// tools that aren't in the content. Content that has problems is still a 200, since the problems are the response.
+func (s *server) diagnose(w http.ResponseWriter, r *http.Request) {
+	req := new(diagnoseRequest)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := s.limits().checkContent("content", req.Content); err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	l := ccontext.GetLogger(r.Context())
+	l.Debug("diagnosing content")
+
+	ctx, cancel := s.commandContext(r.Context())
+	defer cancel()
+	ctx, cancelParse := s.parseContext(ctx)
+	defer cancelParse()
+
+	diagnostics := diagnoseContent(req.Content)
+
+	_, err := runner.ParseTool(ctx, req.Content, runnerOptions(ctx, req.requestOpts))
+	if errors.Is(context.Cause(ctx), errParseTimeout) {
+		l.Warn("Parsing took too long", "timeout", s.limits().ParseTimeout)
+		writeError(w, http.StatusBadRequest, &requestError{code: errorCodeInvalidRequest, msg: errParseTimeout.Error()})
+		return
+	} else if cmdErr := new(runner.CommandError); errors.As(err, &cmdErr) {
+		diagnostics = withParseError(diagnostics, cmdErr)
+	} else if err != nil {
+		writeEngineError(ctx, w, err, "failed to parse content")
+		return
+	}
+
+	slices.SortStableFunc(diagnostics, func(a, b diagnostic) int {
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return a.Column - b.Column
+	})
+	writeResponse(w, diagnoseResponse{Diagnostics: diagnostics})
+}
+
+// withParseError adds the error of the parser of gptscript to the diagnostics, at the line that the error names, or at the first
+// line if it names none. If there already is an error at that line, then the error is left out, since it is most likely the same
+// problem.
+func withParseError(diagnostics []diagnostic, err *runner.CommandError) []diagnostic {
+	msg := err.Err.Error()
+	lines := strings.Split(strings.TrimSpace(err.Stderr), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		msg = strings.TrimPrefix(strings.TrimPrefix(last, "Error: "), "error: ")
+	}
+
+	line := 1
+	if m := errorLine.FindStringSubmatch(msg); m != nil {
+		line, _ = strconv.Atoi(m[1])
+	}
+
+	for _, d := range diagnostics {
+		if d.Line == line && d.Severity == diagnosticError {
+			return diagnostics
+		}
+	}
+	return append(diagnostics, diagnostic{Severity: diagnosticError, Code: diagnosticSyntax, Message: msg, Line: line})
+}
+
+// toolReference is a reference of a tool to another tool, at its position in the content.
+type toolReference struct {
+	name   string
+	line   int
+	column int
+}
+
+// diagnoseContent finds the problems of the headers of the tools of the content, and the references to tools that can't be resolved,
+// in the same way that gptscript reads the headers: each tool starts after a line of "---", and its header ends at the first line
+// that isn't a directive, a comment, or blank.
+func diagnoseContent(content string) []diagnostic {
+	var (
+		diagnostics = make([]diagnostic, 0)
+		names       = make(map[string]bool)
+		refs        []toolReference
+		inHeader    = true
+		lines       = strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	)
+
+	for i, line := range lines {
+		lineNo := i + 1
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "---" {
+			inHeader = true
+			continue
+		}
+		if !inHeader || trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "#") {
+			// A line starting with #! starts the command of the tool, and the other lines starting with # are comments.
+			inHeader = !strings.HasPrefix(trimmed, "#!")
+			continue
+		}
+
+		m := directiveLine.FindStringSubmatch(line)
+		if m == nil {
+			inHeader = false
+			continue
+		}
+
+		key, value := m[1], m[2]
+		valueColumn := utf8.RuneCountInString(key) + 2 + leadingSpace(value)
+		value = strings.TrimSpace(value)
+		kind, ok := directives[normalizeDirective(key)]
+		if !ok {
+			inHeader = false
+			if d, ok := unknownDirective(key, lineNo, lines[i+1:]); ok {
+				diagnostics = append(diagnostics, d)
+			}
+			continue
+		}
+
+		invalid := func(msg string) {
+			diagnostics = append(diagnostics, diagnostic{
+				Severity:  diagnosticError,
+				Code:      diagnosticInvalidValue,
+				Message:   msg,
+				Line:      lineNo,
+				Column:    valueColumn,
+				EndColumn: valueColumn + utf8.RuneCountInString(value),
+			})
+		}
+
+		switch kind {
+		case directiveText:
+			if normalizeDirective(key) != "name" || value == "" {
+				break
+			}
+			if names[strings.ToLower(value)] {
+				diagnostics = append(diagnostics, diagnostic{
+					Severity:  diagnosticWarning,
+					Code:      diagnosticDuplicateTool,
+					Message:   fmt.Sprintf("there is another tool named %q before this one, which references to %q go to", value, value),
+					Line:      lineNo,
+					Column:    valueColumn,
+					EndColumn: valueColumn + utf8.RuneCountInString(value),
+				})
+			}
+			names[strings.ToLower(value)] = true
+		case directiveBool:
+			if _, err := strconv.ParseBool(strings.ToLower(value)); err != nil {
+				invalid(fmt.Sprintf("%s must be true or false", key))
+			}
+		case directiveInt:
+			if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+				invalid(fmt.Sprintf("%s must be a positive whole number", key))
+			}
+		case directiveFloat:
+			if _, err := strconv.ParseFloat(value, 32); err != nil {
+				invalid(fmt.Sprintf("%s must be a number", key))
+			}
+		case directiveArg:
+			if name, _, ok := strings.Cut(value, ":"); !ok || strings.TrimSpace(name) == "" {
+				invalid("an argument must be given as name: description")
+			}
+		case directiveRefs:
+			for _, ref := range splitReferences(value) {
+				refs = append(refs, toolReference{name: ref.text, line: lineNo, column: valueColumn + ref.offset})
+			}
+		}
+	}
+
+	for _, ref := range refs {
+		name := referencedTool(ref.name)
+		if names[strings.ToLower(name)] || externalTool(ref.name) {
+			continue
+		}
+		diagnostics = append(diagnostics, diagnostic{
+			Severity:  diagnosticError,
+			Code:      diagnosticUnresolvedTool,
+			Message:   fmt.Sprintf("there is no tool named %q in the content, and it isn't a system tool, a file, or a remote tool", name),
+			Line:      ref.line,
+			Column:    ref.column,
+			EndColumn: ref.column + utf8.RuneCountInString(name),
+		})
+	}
+	return diagnostics
+}
+
+// unknownDirective returns a warning about a line that looks like a directive with a name that gptscript doesn't know, which makes
+// the line the start of the instructions of the tool. Since instructions can have lines like that too, the line is only reported
+// if its name is close to the name of a directive, or if the header seems to carry on after it.
+func unknownDirective(key string, lineNo int, rest []string) (diagnostic, bool) {
+	d := diagnostic{
+		Severity:  diagnosticWarning,
+		Code:      diagnosticUnknownDirective,
+		Message:   fmt.Sprintf("%q isn't a directive, so this line and the rest of the tool are instructions", key),
+		Line:      lineNo,
+		Column:    1,
+		EndColumn: 1 + utf8.RuneCountInString(key),
+	}
+
+	if suggestion := closestDirective(key); suggestion != "" {
+		d.Message += fmt.Sprintf("; did you mean %q?", suggestion)
+		return d, true
+	}
+
+	for _, line := range rest {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if m := directiveLine.FindStringSubmatch(line); m != nil {
+			if _, ok := directives[normalizeDirective(m[1])]; ok {
+				return d, true
+			}
+		}
+		break
+	}
+	return diagnostic{}, false
+}
+
+// closestDirective returns the directive whose name is at most two edits away from the key, or nothing if there is none.
+func closestDirective(key string) string {
+	normalized := normalizeDirective(key)
+	best, bestDistance := "", 3
+	for name := range directives {
+		if d := editDistance(normalized, name); d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func normalizeDirective(key string) string {
+	return strings.NewReplacer(" ", "", "-", "", "_", "").Replace(strings.ToLower(key))
+}
+
+// reference is a part of a comma separated list of references, at its offset in characters from the start of the list.
+type reference struct {
+	text   string
+	offset int
+}
+
+// splitReferences splits the value of a directive that lists references to tools at the commas that aren't in quotes.
+func splitReferences(value string) []reference {
+	var (
+		refs   []reference
+		start  int
+		quoted bool
+	)
+	add := func(end int) {
+		part := value[start:end]
+		if text := strings.TrimSpace(part); text != "" {
+			offset := utf8.RuneCountInString(value[:start]) + leadingSpace(part)
+			refs = append(refs, reference{text: text, offset: offset})
+		}
+	}
+
+	for i, c := range value {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				add(i)
+				start = i + 1
+			}
+		}
+	}
+	add(len(value))
+	return refs
+}
+
+// externalTool returns whether the reference is to a tool that isn't in the content: a system tool, a tool from a file, or a remote
+// tool, which can't be resolved without loading it.
+func externalTool(ref string) bool {
+	if _, _, ok := strings.Cut(ref, " from "); ok {
+		return true
+	}
+	name := referencedTool(ref)
+	return strings.HasPrefix(strings.ToLower(name), "sys.") || strings.ContainsAny(name, `/\`) || filepath.Ext(name) != ""
+}
+
+// leadingSpace returns the number of characters of white space at the start of s.
+func leadingSpace(s string) int {
+	return utf8.RuneCountInString(s) - utf8.RuneCountInString(strings.TrimLeft(s, " \t"))
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+var (
+	// notFoundPattern finds the errors of gptscript about files and tools that don't exist, on Unix and on Windows.
+	notFoundPattern = regexp.MustCompile(`(?i)no such file or directory|cannot find the (?:file|path) specified|(?:failed to find|unknown|could not find) tool|tool \S+ not found`)
+	// invalidToolPattern finds the errors of gptscript about tool content that it can't parse or load.
+	invalidToolPattern = regexp.MustCompile(`(?i)\bline:?\s*\d+|\binvalid tool\b|failed to parse|\bparse error\b|\bsyntax error\b|duplicate tool name`)
+)
+
+// runError is the error of a streamed run, whose message is the one that was written in the err event of the stream, and which wraps
+// what caused it, so that the status of the response can be chosen from the cause.
+type runError struct {
+	msg string
+	err error
+}
+
+func (e *runError) Error() string {
+	return e.msg
+}
+
+func (e *runError) Unwrap() error {
+	return e.err
+}
+
+// engineError returns the status code and error to respond with when a gptscript process fails, so that clients can tell errors in
+// what they sent from errors of the model and of gptscript. Tools and files that don't exist are a 404 and tool content that
+// gptscript can't parse is a 400, which aren't worth retrying, while errors of the model and of gptscript are a 502, and processes
+// that took too long, which is checked with their context, are a 504. Runs that exceeded a process limit or the max output size are
+// a 422, since they would exceed it again, and so are runs whose stdout doesn't conform to their output schema. Errors that don't come from gptscript, like those of starting it, stay a 500. The msg
+// describes what failed.
+func engineError(ctx context.Context, err error, msg string) (int, error) {
+	msg = fmt.Sprintf("%s: %v", msg, err)
+
+	var cmdErr *runner.CommandError
+	switch {
+	case errors.As(err, new(*runner.LimitError)), errors.As(err, new(*runner.OutputLimitError)):
+		return http.StatusUnprocessableEntity, &requestError{code: errorCodeLimitExceeded, msg: msg}
+	case errors.As(err, new(*outputSchemaError)):
+		return http.StatusUnprocessableEntity, &requestError{code: errorCodeInvalidOutput, msg: msg}
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		// When the context is done, the process is killed and the error is the exit error of the process, so check the context too.
+		return http.StatusGatewayTimeout, &requestError{code: errorCodeTimeout, msg: msg}
+	case !errors.As(err, &cmdErr):
+		return http.StatusInternalServerError, errors.New(msg)
+	case retryStatusPattern.MatchString(cmdErr.Stderr):
+		return http.StatusBadGateway, &requestError{code: errorCodeModelError, msg: msg}
+	case notFoundPattern.MatchString(cmdErr.Stderr):
+		return http.StatusNotFound, &requestError{code: errorCodeNotFound, msg: msg}
+	case invalidToolPattern.MatchString(cmdErr.Stderr):
+		return http.StatusBadRequest, &requestError{code: errorCodeInvalidTool, msg: msg}
+	default:
+		return http.StatusBadGateway, &requestError{code: errorCodeEngineError, msg: msg}
+	}
+}
+
+// writeEngineError writes the error of a gptscript process that failed with the status code of engineError.
+func writeEngineError(ctx context.Context, w http.ResponseWriter, err error, msg string) {
+	code, err := engineError(ctx, err, msg)
+	writeError(w, code, err)
+}
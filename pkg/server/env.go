@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// protectedEnv are the patterns of the environment variables that requests can never set, because the server and gptscript
+// rely on them. They are denied regardless of the configured allowlist.
+var protectedEnv = []string{"OPENAI_*", "GPTSCRIPT_*", "TRACEPARENT", "TRACESTATE", "OTEL_*"}
+
+// envPolicy decides which environment variables a request can set for the gptscript process of its run. A variable can be set if
+// its name matches a pattern of the allowlist and no pattern of the denylist. The patterns are in the syntax of path.Match.
+type envPolicy struct {
+	allow []string
+	deny  []string
+}
+
+func newEnvPolicy(allow, deny []string) (*envPolicy, error) {
+	for _, pattern := range slices.Concat(allow, deny) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid environment variable pattern %q: %w", pattern, err)
+		}
+	}
+
+	return &envPolicy{allow: allow, deny: slices.Concat(protectedEnv, deny)}, nil
+}
+
+func (p *envPolicy) allowed(name string) bool {
+	return matchesAny(p.allow, name) && !matchesAny(p.deny, name)
+}
+
+// runEnv returns the requested environment variables in the form "NAME=value", sorted by name, along with those of the requested
+// model and credentials, and of the session of the context if there is one. An error is returned if any of them can't be set, if
+// the model isn't allowed, or if a credential of the tenant of the context doesn't exist.
+func (s *server) runEnv(ctx context.Context, o runOptions) ([]string, error) {
+	policy := s.current().env
+	env := make([]string, 0, len(o.Env))
+	for name, value := range o.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") || strings.ContainsRune(value, 0) {
+			return nil, invalidField("env", fmt.Sprintf("invalid environment variable %q", name))
+		}
+		if !policy.allowed(name) {
+			return nil, invalidField("env", fmt.Sprintf("not allowed to set environment variable %q", name))
+		}
+		env = append(env, name+"="+value)
+	}
+
+	// The variables of the model are protected, so they can't clash with the requested ones.
+	modelEnv, err := s.modelEnv(o.Model)
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, modelEnv...)
+
+	credentials, workspaceEnv := sessionEnv(ctx, o.Credentials)
+	credentialEnv, err := s.credentialEnv(tenantOf(ctx), credentials)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range append(credentialEnv, workspaceEnv...) {
+		name, _, _ := strings.Cut(kv, "=")
+		if slices.ContainsFunc(env, func(e string) bool { return strings.HasPrefix(e, name+"=") }) {
+			return nil, invalidField("credentials", fmt.Sprintf("environment variable %q is set more than once", name))
+		}
+		env = append(env, kv)
+	}
+
+	slices.Sort(env)
+	return env, nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+// outputEventKeys map the keys that identify the events that don't have a type field to their type.
+var outputEventKeys = []struct {
+	key       string
+	eventType string
+}{
+	{"stdout", events.TypeStdout},
+	{"stderr", events.TypeStderr},
+	{"err", events.TypeError},
+	{"done", events.TypeDone},
+	{"queuePosition", events.TypeQueuePosition},
+	{"lifecycle", events.TypeLifecycle},
+	{"progress", events.TypeProgress},
+	{"usage", events.TypeUsage},
+	{"retry", events.TypeRetry},
+	{"truncated", events.TypeTruncated},
+	{"ping", events.TypePing},
+}
+
+// newEventEnvelope wraps the event in an envelope. A sequence number of 0 means that the event is not part of the sequence of
+// events of the run.
+func newEventEnvelope(runID string, seq int64, event any) events.Envelope {
+	e := events.Envelope{
+		Version: events.Version,
+		RunID:   runID,
+		Seq:     seq,
+		Type:    eventType(event),
+		Time:    time.Now(),
+		Data:    event,
+	}
+	if seq > 0 {
+		e.ID = runID + "-" + strconv.FormatInt(seq, 10)
+	}
+	return e
+}
+
+// eventID returns the ID of the event in a stream of server sent events, which is the sequence number of its envelope, the same as
+// the ID of the event in the events of its run. Events without a sequence number, and the events of batches, which interleave the
+// events of several runs, have no ID.
+func eventID(event any) string {
+	if e, ok := event.(events.Envelope); ok && e.Seq > 0 && e.Item == nil {
+		return strconv.FormatInt(e.Seq, 10)
+	}
+	return ""
+}
+
+// withRequestID sets the request ID of the event if it is an envelope without one.
+func withRequestID(event any, requestID string) any {
+	if e, ok := event.(events.Envelope); ok && e.RequestID == "" {
+		e.RequestID = requestID
+		return e
+	}
+	return event
+}
+
+// eventType returns the type of the event: the type of the typed events and envelopes, or, for events that were decoded from JSON,
+// their type field or the type of the key that they have, like stdout.
+func eventType(event any) string {
+	var e map[string]any
+	switch ev := event.(type) {
+	case events.Envelope:
+		return ev.Type
+	case events.Event:
+		return ev.EventType()
+	case map[string]any:
+		e = ev
+	default:
+		b, err := json.Marshal(event)
+		if err != nil {
+			return ""
+		}
+		if err = json.Unmarshal(b, &e); err != nil {
+			return ""
+		}
+	}
+
+	if t, ok := e["type"].(string); ok {
+		return t
+	}
+	for _, k := range outputEventKeys {
+		if _, ok := e[k.key]; ok {
+			return k.eventType
+		}
+	}
+	return ""
+}
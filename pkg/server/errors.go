@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errorCode is a machine-readable code for an error, which is more specific than the status code of the response.
+type errorCode string
+
+const (
+	errorCodeInvalidJSON     errorCode = "invalid_json"
+	errorCodeUnknownField    errorCode = "unknown_field"
+	errorCodeMissingField    errorCode = "missing_field"
+	errorCodeInvalidField    errorCode = "invalid_field"
+	errorCodeInvalidRequest  errorCode = "invalid_request"
+	errorCodeUnauthorized    errorCode = "unauthorized"
+	errorCodeForbidden       errorCode = "forbidden"
+	errorCodePolicyDenied    errorCode = "policy_denied"
+	errorCodeNotFound        errorCode = "not_found"
+	errorCodeConflict        errorCode = "conflict"
+	errorCodeTooLarge        errorCode = "too_large"
+	errorCodeTooManyRequests errorCode = "too_many_requests"
+	errorCodeQuotaExceeded   errorCode = "quota_exceeded"
+	errorCodeNotImplemented  errorCode = "not_implemented"
+	errorCodeUnavailable     errorCode = "unavailable"
+	errorCodeCircuitOpen     errorCode = "circuit_open"
+	errorCodeInvalidTool     errorCode = "invalid_tool"
+	errorCodeLimitExceeded   errorCode = "limit_exceeded"
+	errorCodeInvalidOutput   errorCode = "invalid_output"
+	errorCodeModelError      errorCode = "model_error"
+	errorCodeEngineError     errorCode = "engine_error"
+	errorCodeTimeout         errorCode = "timeout"
+	errorCodeInternal        errorCode = "internal"
+)
+
+// errorResponse is the body of every error response. Error is the message, which is meant for people, and Code is meant for
+// programs. Field is the request field that the error is about, if there is one.
+type errorResponse struct {
+	Error string    `json:"error"`
+	Code  errorCode `json:"code"`
+	Field string    `json:"field,omitempty"`
+	// RequestID is the ID of the request, which is also in the logs of the server about it.
+	RequestID string `json:"requestID,omitempty"`
+}
+
+// requestError is an error in a request, with a code that describes what is wrong with it.
+type requestError struct {
+	code  errorCode
+	field string
+	msg   string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func missingField(field, msg string) error {
+	return &requestError{code: errorCodeMissingField, field: field, msg: msg}
+}
+
+func invalidField(field, msg string) error {
+	return &requestError{code: errorCodeInvalidField, field: field, msg: msg}
+}
+
+func tooLarge(field, msg string) error {
+	return &requestError{code: errorCodeTooLarge, field: field, msg: msg}
+}
+
+// validator is implemented by request bodies that check their fields once they have been decoded.
+type validator interface {
+	validate() error
+}
+
+// decodeRequest decodes the JSON body into v, rejecting unknown fields, and then validates it if it is a validator. Bodies that
+// were cut off by the body limit of their route are reported as too large.
+func decodeRequest(body io.Reader, v any) error {
+	d := json.NewDecoder(body)
+	d.DisallowUnknownFields()
+
+	if err := d.Decode(v); err != nil {
+		var (
+			syntaxErr   *json.SyntaxError
+			typeErr     *json.UnmarshalTypeError
+			maxBytesErr *http.MaxBytesError
+		)
+		switch {
+		case errors.As(err, &maxBytesErr):
+			return tooLarge("", fmt.Sprintf("request body must be at most %d bytes", maxBytesErr.Limit))
+		case errors.As(err, &typeErr):
+			return invalidField(typeErr.Field, fmt.Sprintf("invalid request body: %s must be %s", typeErr.Field, typeErr.Type))
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return &requestError{code: errorCodeUnknownField, field: field, msg: fmt.Sprintf("invalid request body: unknown field %q", field)}
+		case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+			return &requestError{code: errorCodeInvalidJSON, msg: fmt.Sprintf("invalid request body: %v", err)}
+		default:
+			return &requestError{code: errorCodeInvalidRequest, msg: fmt.Sprintf("invalid request body: %v", err)}
+		}
+	}
+
+	if val, ok := v.(validator); ok {
+		return val.validate()
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	resp := errorResponse{
+		Error:     err.Error(),
+		Code:      statusErrorCode(code),
+		RequestID: w.Header().Get(requestIDHeader),
+	}
+
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		resp.Code = reqErr.code
+		resp.Field = reqErr.field
+		if reqErr.code == errorCodeTooLarge {
+			// Handlers respond to the errors of decodeRequest with a 400, but the body being too large has a status of its own.
+			code = http.StatusRequestEntityTooLarge
+		}
+	}
+
+	w.WriteHeader(code)
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"error": "%s", "code": "%s"}`, err.Error(), errorCodeInternal)))
+		return
+	}
+
+	_, _ = w.Write(b)
+}
+
+// statusErrorCode returns the error code for errors that don't have a more specific code.
+func statusErrorCode(code int) errorCode {
+	switch code {
+	case http.StatusBadRequest:
+		return errorCodeInvalidRequest
+	case http.StatusUnauthorized:
+		return errorCodeUnauthorized
+	case http.StatusForbidden:
+		return errorCodeForbidden
+	case http.StatusNotFound:
+		return errorCodeNotFound
+	case http.StatusConflict:
+		return errorCodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return errorCodeTooLarge
+	case http.StatusUnprocessableEntity:
+		return errorCodeLimitExceeded
+	case http.StatusTooManyRequests:
+		return errorCodeTooManyRequests
+	case http.StatusNotImplemented:
+		return errorCodeNotImplemented
+	case http.StatusBadGateway:
+		return errorCodeEngineError
+	case http.StatusServiceUnavailable:
+		return errorCodeUnavailable
+	case http.StatusGatewayTimeout:
+		return errorCodeTimeout
+	default:
+		return errorCodeInternal
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// eventWriter is the transport that the output and events of a streaming run are written to.
+type eventWriter interface {
+	// writeEvent will write a single event to the client.
+	writeEvent(event any)
+	// finish will signal to the client that no more events will be written.
+	finish()
+}
+
+// streamWriter is an eventWriter that writes events to a connection that stays open for the whole run.
+type streamWriter interface {
+	eventWriter
+	// writeEncodedEvent writes an event that is already JSON encoded. If id is not empty, then it is the ID of the event.
+	writeEncodedEvent(id string, ev []byte)
+	// writeHeartbeat writes something that keeps the connection alive without carrying an event.
+	writeHeartbeat()
+}
+
+// newStreamWriter returns the stream writer for the format the client asked for: newline-delimited JSON if the request
+// accepts application/x-ndjson or has the format=ndjson query parameter, and server sent events otherwise.
+func newStreamWriter(l *slog.Logger, w http.ResponseWriter, r *http.Request) streamWriter {
+	requestID := ccontext.GetRequestID(r.Context())
+	if r.URL.Query().Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), ndjsonContentType) {
+		return newNDJSONWriter(l, w, requestID)
+	}
+	return newSSEWriter(l, w, requestID)
+}
+
+// sseWriter is an eventWriter that writes events to the response as server sent events. Envelopes without a request ID are given
+// the ID of the request of the response.
+type sseWriter struct {
+	l         *slog.Logger
+	w         http.ResponseWriter
+	requestID string
+}
+
+func newSSEWriter(l *slog.Logger, w http.ResponseWriter, requestID string) *sseWriter {
+	setStreamingHeaders(w)
+	return &sseWriter{l: l, w: w, requestID: requestID}
+}
+
+// writeEvent writes the event with the ID of its envelope, if it has one, so that a client can resume the stream after it with the
+// Last-Event-ID header.
+func (s *sseWriter) writeEvent(event any) {
+	event = withRequestID(event, s.requestID)
+	ev, err := json.Marshal(event)
+	if err != nil {
+		s.l.Warn("failed to marshal event", "error", err)
+		return
+	}
+
+	writeServerSentEventData(s.l, s.w, eventID(event), ev)
+}
+
+func (s *sseWriter) writeEncodedEvent(id string, ev []byte) {
+	writeServerSentEventData(s.l, s.w, id, ev)
+}
+
+// writeHeartbeat writes a comment, which keeps the connection alive without being seen as an event by clients.
+func (s *sseWriter) writeHeartbeat() {
+	if _, err := s.w.Write([]byte(": ping\n\n")); err != nil {
+		s.l.Debug("failed to write heartbeat", "error", err)
+		return
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *sseWriter) finish() {
+	_, err := s.w.Write([]byte("data: [DONE]\n\n"))
+	if err == nil {
+		if f, ok := s.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// writeServerSentEventData writes the JSON encoded event as a server sent event. If id is not empty, then it is the ID of the event.
+func writeServerSentEventData(l *slog.Logger, w http.ResponseWriter, id string, ev []byte) {
+	var idField string
+	if id != "" {
+		idField = "id: " + id + "\n"
+	}
+
+	n, err := w.Write([]byte(fmt.Sprintf("%sdata: %s\n\n", idField, ev)))
+	if err == nil {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		eventsWritten.WithLabelValues(transportSSE).Inc()
+	}
+
+	bytesStreamed.WithLabelValues(transportSSE).Add(float64(n))
+
+	l.Debug("wrote event", "event", string(ev))
+}
+
+// ndjsonWriter is an eventWriter that writes events to the response as newline-delimited JSON, one event per line.
+// The stream ends when the response does, so there is no DONE event. Envelopes without a request ID are given the ID of the
+// request of the response.
+type ndjsonWriter struct {
+	l         *slog.Logger
+	w         http.ResponseWriter
+	requestID string
+}
+
+func newNDJSONWriter(l *slog.Logger, w http.ResponseWriter, requestID string) *ndjsonWriter {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	return &ndjsonWriter{l: l, w: w, requestID: requestID}
+}
+
+func (n *ndjsonWriter) writeEvent(event any) {
+	ev, err := json.Marshal(withRequestID(event, n.requestID))
+	if err != nil {
+		n.l.Warn("failed to marshal event", "error", err)
+		return
+	}
+
+	n.writeEncodedEvent("", ev)
+}
+
+// writeEncodedEvent writes the event as a line. Lines don't have IDs, so the ID is dropped.
+func (n *ndjsonWriter) writeEncodedEvent(_ string, ev []byte) {
+	written, err := n.w.Write(append(ev, '\n'))
+	if err == nil {
+		if f, ok := n.w.(http.Flusher); ok {
+			f.Flush()
+		}
+		eventsWritten.WithLabelValues(transportNDJSON).Inc()
+	}
+
+	bytesStreamed.WithLabelValues(transportNDJSON).Add(float64(written))
+
+	n.l.Debug("wrote event", "event", string(ev))
+}
+
+func (n *ndjsonWriter) writeHeartbeat() {
+	n.writeEvent(heartbeatEvent())
+}
+
+func (n *ndjsonWriter) finish() {}
+
+// setStreamingHeaders sets the headers of a stream of server sent events. X-Accel-Buffering tells proxies like nginx not to buffer
+// the stream, which would make its events arrive in bursts.
+func setStreamingHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+}
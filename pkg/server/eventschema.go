@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+// eventsSchema writes the JSON schemas of the events that are streamed for runs: the schema of the envelope of the events, and the
+// schema of the data of each type of event. The schemas of the types that they refer to are in $defs.
+func eventsSchema(w http.ResponseWriter, _ *http.Request) {
+	writeResponse(w, newEventsSchema())
+}
+
+func newEventsSchema() map[string]any {
+	sg := newSchemaGenerator("#/$defs/")
+
+	data := make(map[string]any)
+	for eventType, t := range events.DataTypes() {
+		data[eventType] = sg.schema(t)
+	}
+
+	return map[string]any{
+		"$schema":  "https://json-schema.org/draft/2020-12/schema",
+		"version":  events.Version,
+		"envelope": sg.schema(reflect.TypeFor[events.Envelope]()),
+		"events":   data,
+		"$defs":    sg.schemas,
+	}
+}
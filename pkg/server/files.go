@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+const (
+	// uploadScheme is the prefix of the handles of uploaded files, which can be used as the file of a run.
+	uploadScheme = "upload://"
+)
+
+var errUploadNotFound = errors.New("uploaded file not found")
+
+// uploadedFile describes a file that was uploaded. File is the handle that is used as the file of a run.
+type uploadedFile struct {
+	ID        string    `json:"id"`
+	File      string    `json:"file"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// uploadStore keeps uploaded files in a directory, each in a file named after its ID. The files of each tenant other than the
+// default tenant are kept in a directory of their own, so that a tenant can only run and delete its own files.
+type uploadStore struct {
+	dir string
+}
+
+// newUploadStore returns a store that keeps uploaded files in the directory. If the directory is empty, then a temporary
+// directory is used, which is removed by the returned function.
+func newUploadStore(dir string) (*uploadStore, func(), error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, nil, fmt.Errorf("failed to create upload directory: %w", err)
+		}
+		return &uploadStore{dir: dir}, func() {}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "clicky-serves-uploads-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	return &uploadStore{dir: dir}, func() { _ = os.RemoveAll(dir) }, nil
+}
+
+// save writes the content to a new file. The file is written to a temporary name first, so that a partial upload can't be run.
+func (u *uploadStore) save(tenant, name string, content io.Reader) (uploadedFile, error) {
+	id := uuid.NewString()
+
+	dir := u.tenantDir(tenant)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return uploadedFile{}, err
+	}
+
+	f, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return uploadedFile{}, err
+	}
+	defer os.Remove(f.Name())
+
+	size, err := io.Copy(f, content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return uploadedFile{}, err
+	}
+
+	if err = os.Rename(f.Name(), u.path(tenant, id)); err != nil {
+		return uploadedFile{}, err
+	}
+
+	return uploadedFile{
+		ID:        id,
+		File:      uploadScheme + id,
+		Name:      name,
+		Size:      size,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func (u *uploadStore) delete(tenant, id string) error {
+	if err := uuid.Validate(id); err != nil {
+		return errUploadNotFound
+	}
+
+	if err := os.Remove(u.path(tenant, id)); errors.Is(err, fs.ErrNotExist) {
+		return errUploadNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// entries returns the uploaded files of every tenant, leaving out the files that are still being uploaded.
+func (u *uploadStore) entries() []diskEntry {
+	entries := dirEntries(u.dir, hiddenEntry)
+
+	tenants, _ := os.ReadDir(filepath.Join(u.dir, ".tenants"))
+	for _, tenant := range tenants {
+		entries = append(entries, dirEntries(filepath.Join(u.dir, ".tenants", tenant.Name()), hiddenEntry)...)
+	}
+	return entries
+}
+
+// resolve returns the path of the file to run. Handles of uploaded files are resolved to the path of the upload of the tenant, and
+// any other file is returned as is.
+func (u *uploadStore) resolve(tenant, file string) (string, error) {
+	id, ok := strings.CutPrefix(file, uploadScheme)
+	if !ok {
+		return file, nil
+	}
+
+	if err := uuid.Validate(id); err != nil {
+		return "", invalidField("file", fmt.Sprintf("invalid uploaded file %q", file))
+	}
+
+	path := u.path(tenant, id)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return "", invalidField("file", fmt.Sprintf("uploaded file %q not found", file))
+	} else if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// allowedLocalPath reports whether the path, which is the file of a run or the directory that it runs in, is in a directory that
+// the tenant of the context can use: a tool directory of the server, the uploaded files of the tenant, or the workspace of the
+// session of the context. The upload directory also holds the files of the other tenants and the workspaces of other sessions and
+// runs, so nothing else in it can be used, even if it is in a tool directory. Symbolic links are followed, so that a link can't
+// lead out of these directories.
+func (s *server) allowedLocalPath(ctx context.Context, path string) bool {
+	path, err := realPath(path)
+	if err != nil {
+		return false
+	}
+
+	if sess := sessionOf(ctx); sess != nil && withinDir(sess.workspace, path) {
+		return true
+	}
+	if dir, err := realPath(s.uploads.tenantDir(tenantOf(ctx))); err == nil && filepath.Dir(path) == dir {
+		return true
+	}
+	if withinDir(s.uploads.dir, path) {
+		return false
+	}
+
+	dirs := s.current().config.ToolDirs
+	if len(dirs) == 0 {
+		// Without tool directories, runs can use the working directory of the server, like gptscript does.
+		wd, err := os.Getwd()
+		if err != nil {
+			return false
+		}
+		dirs = []string{wd}
+	}
+	for _, dir := range dirs {
+		if withinDir(dir, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkChdir returns an error if the chdir of the options of a run is a directory that the tenant of the context can't use. The
+// chdir of the default options of the client is set by the server, so it is always allowed.
+func (s *server) checkChdir(ctx context.Context, chdir string) error {
+	if chdir == "" || chdir == s.defaultOpts(usageClient(ctx)).Chdir || s.allowedLocalPath(ctx, chdir) {
+		return nil
+	}
+	return invalidField("chdir", fmt.Sprintf("%s is outside of the directories that runs can use", chdir))
+}
+
+// localFile reports whether the file of a run is a path on the disk of the server, rather than an uploaded file, a registered tool,
+// or a remote tool.
+func localFile(file string) bool {
+	if file == "" || strings.HasPrefix(file, uploadScheme) || strings.HasPrefix(file, registryScheme) {
+		return false
+	}
+	_, remote := remoteTool(file)
+	return !remote
+}
+
+// realPath returns the absolute path with its symbolic links resolved. The part of the path that doesn't exist can't be resolved,
+// so it is joined to the deepest directory of the path that does.
+func realPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	var rest []string
+	for dir := path; ; {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return path, nil
+		}
+		rest = append([]string{filepath.Base(dir)}, rest...)
+		dir = parent
+	}
+}
+
+// withinDir reports whether the path, which has its symbolic links resolved, is the directory or is in it.
+func withinDir(dir, path string) bool {
+	dir, err := realPath(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+func (u *uploadStore) path(tenant, id string) string {
+	return filepath.Join(u.tenantDir(tenant), id+".gpt")
+}
+
+// tenantDir returns the directory of the files of the tenant.
+func (u *uploadStore) tenantDir(tenant string) string {
+	if tenant == "" {
+		return u.dir
+	}
+	return filepath.Join(u.dir, ".tenants", tenant)
+}
+
+// uploadFile stores the file in the file field of a multipart form, and returns the handle that it can be run with. The body of the
+// request is limited to the upload limit by its route.
+func (s *server) uploadFile(w http.ResponseWriter, r *http.Request) {
+	f, header, err := r.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, tooLarge("file", fmt.Sprintf("file must be at most %d bytes", maxBytesErr.Limit)))
+			return
+		}
+		writeError(w, http.StatusBadRequest, missingField("file", fmt.Sprintf("a multipart form with a file field is required: %v", err)))
+		return
+	}
+	defer f.Close()
+
+	upload, err := s.uploads.save(tenantOf(r.Context()), header.Filename, f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to save file: %w", err))
+		return
+	}
+
+	ccontext.GetLogger(r.Context()).Info("Uploaded file", "file", upload.File, "name", upload.Name, "size", upload.Size)
+
+	w.WriteHeader(http.StatusCreated)
+	writeResponse(w, upload)
+}
+
+func (s *server) deleteFile(w http.ResponseWriter, r *http.Request) {
+	if err := s.uploads.delete(tenantOf(r.Context()), r.PathValue("id")); errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("file %q not found", r.PathValue("id")))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to delete file: %w", err))
+		return
+	}
+
+	writeResponse(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gptscript-ai/go-gptscript"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+func TestAllowedLocalPath(t *testing.T) {
+	root := t.TempDir()
+	tools := filepath.Join(root, "tools")
+	uploads := filepath.Join(root, "tools", "uploads")
+	workspace := filepath.Join(uploads, ".sessions", "mine")
+	for _, dir := range []string{tools, filepath.Join(uploads, ".tenants", "acme"), filepath.Join(uploads, ".tenants", "other"), workspace, filepath.Join(uploads, ".workspaces", "run")} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link in the workspace of the session can't lead to the files of another tenant.
+	if err := os.Symlink(filepath.Join(uploads, ".tenants", "other"), filepath.Join(workspace, "other")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{uploads: &uploadStore{dir: uploads}}
+	s.settings.Store(&settings{config: Config{ToolDirs: []string{tools}}})
+
+	ctx := ccontext.WithIdentity(context.Background(), &ccontext.Identity{Name: "alice", Tenant: "acme"})
+	ctx = withSession(ctx, &session{workspace: workspace})
+
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{name: "tool", path: filepath.Join(tools, "tool.gpt"), want: true},
+		{name: "upload of the tenant", path: filepath.Join(uploads, ".tenants", "acme", "file.gpt"), want: true},
+		{name: "workspace of the session", path: filepath.Join(workspace, "dir"), want: true},
+		{name: "upload of another tenant", path: filepath.Join(uploads, ".tenants", "other", "file.gpt")},
+		{name: "upload of the default tenant", path: filepath.Join(uploads, "file.gpt")},
+		{name: "workspace of a run", path: filepath.Join(uploads, ".workspaces", "run")},
+		{name: "upload directory", path: uploads},
+		{name: "dot dot", path: filepath.Join(tools, "..", "tool.gpt")},
+		{name: "outside", path: filepath.Join(root, "tool.gpt")},
+		{name: "link out of the workspace", path: filepath.Join(workspace, "other", "file.gpt")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.allowedLocalPath(ctx, tt.path); got != tt.want {
+				t.Errorf("got %v for %s, want %v", got, tt.path, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckChdir(t *testing.T) {
+	root := t.TempDir()
+	tools := filepath.Join(root, "tools")
+
+	s := &server{uploads: &uploadStore{dir: filepath.Join(root, "uploads")}}
+	s.settings.Store(&settings{config: Config{ToolDirs: []string{tools}, DefaultOpts: gptscript.Opts{Chdir: "/srv"}}})
+
+	// The chdir of the default options is set by the server, so it is allowed even though it isn't in a tool directory.
+	for _, chdir := range []string{"", "/srv", filepath.Join(tools, "project")} {
+		if err := s.checkChdir(context.Background(), chdir); err != nil {
+			t.Errorf("unexpected error for %q: %v", chdir, err)
+		}
+	}
+	for _, chdir := range []string{root, filepath.Join(root, "uploads", ".tenants", "other"), filepath.Join(tools, "..")} {
+		if err := s.checkChdir(context.Background(), chdir); err == nil {
+			t.Errorf("expected an error for %q", chdir)
+		}
+	}
+}
+
+func TestLocalFile(t *testing.T) {
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{file: "tool.gpt", want: true},
+		{file: "../tool.gpt", want: true},
+		{file: "/etc/tool.gpt", want: true},
+		{file: "upload://2d9d4f6e-4d1c-4b5e-9b8a-6f0b1b4a9a11"},
+		{file: "registry://tool"},
+		{file: "github.com/gptscript-ai/tool"},
+		{file: "https://example.com/tool.gpt"},
+		{file: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			if got := localFile(tt.file); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
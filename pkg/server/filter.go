@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+// eventFilter is a streamWriter that only writes the events of the types that the client asked for. Errors and the end of the
+// run are always written, so that a client always learns whether a run failed.
+type eventFilter struct {
+	streamWriter
+	types map[string]bool
+}
+
+// filterEvents wraps the stream so that only the event types in the comma-separated events query parameter of the request are
+// written, like ?events=callStart,callFinish,stderr. The types are those of the event envelopes. If the parameter is not set,
+// then the stream is returned as is.
+func filterEvents(r *http.Request, w streamWriter) streamWriter {
+	query := r.URL.Query().Get("events")
+	if query == "" {
+		return w
+	}
+
+	types := make(map[string]bool)
+	for _, t := range strings.Split(query, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	if len(types) == 0 {
+		return w
+	}
+
+	return &eventFilter{streamWriter: w, types: types}
+}
+
+func (f *eventFilter) writeEvent(event any) {
+	if f.allowed(event) {
+		f.streamWriter.writeEvent(event)
+	}
+}
+
+func (f *eventFilter) writeEncodedEvent(id string, ev []byte) {
+	var event map[string]any
+	if err := json.Unmarshal(ev, &event); err == nil && !f.allowed(event) {
+		return
+	}
+
+	f.streamWriter.writeEncodedEvent(id, ev)
+}
+
+func (f *eventFilter) allowed(event any) bool {
+	t := eventType(event)
+	return t == events.TypeError || t == events.TypeDone || f.types[t]
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+const (
+	gptscriptSourceBin      = "bin"
+	gptscriptSourceDownload = "download"
+	gptscriptSourceEnv      = "env"
+	gptscriptSourcePath     = "path"
+)
+
+var (
+	validGPTScriptVersion = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+([-+][0-9A-Za-z.-]+)?$`)
+	validChecksum         = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+)
+
+// GPTScriptConfig configures the gptscript binary that the runs on the host are executed with. If neither the binary nor a version
+// is set, then the binary is the one in GPTSCRIPT_BIN, or gptscript on the PATH.
+type GPTScriptConfig struct {
+	// Bin is the path of the gptscript binary.
+	Bin string
+	// Version is the version of gptscript, like v0.9.5, that is downloaded when the server starts, unless it was downloaded
+	// before. The archive of the release is verified against Checksum, the SHA-256 of the archive in hex, if it is set, and
+	// against the checksums of the release otherwise. A version that was downloaded before is verified again when the server starts,
+	// and is downloaded again if it changed.
+	Version  string
+	Checksum string
+	// ReleaseURL is the URL of the releases of gptscript that it is downloaded from, which defaults to the releases on GitHub.
+	ReleaseURL string
+	// Dir is the directory that the downloaded versions of gptscript are kept in. It defaults to a directory in the cache directory
+	// of the user.
+	Dir string
+}
+
+func (c GPTScriptConfig) validate() error {
+	if c.Bin != "" && c.Version != "" {
+		return errors.New("only one of the binary or the version can be set")
+	}
+	if c.Version == "" && (c.Checksum != "" || c.ReleaseURL != "" || c.Dir != "") {
+		return errors.New("the checksum, release URL, and directory can only be set with the version")
+	}
+	if c.Version != "" && !validGPTScriptVersion.MatchString(c.Version) {
+		return fmt.Errorf("invalid version %q, must be like v0.9.5", c.Version)
+	}
+	if c.Checksum != "" && !validChecksum.MatchString(c.Checksum) {
+		return errors.New("invalid checksum, must be a SHA-256 in hex")
+	}
+	if c.ReleaseURL != "" {
+		if u, err := url.Parse(c.ReleaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid release URL %q, must be an http or https URL", c.ReleaseURL)
+		}
+	}
+	return nil
+}
+
+// gptscriptBinary is the gptscript binary that the server resolved when it started, and where it came from: the binary of the
+// config, a download of the version of the config, GPTSCRIPT_BIN, or the PATH.
+type gptscriptBinary struct {
+	Path   string
+	Source string
+}
+
+// resolveGPTScript finds the gptscript binary of the config, downloading it if a version is set, and makes it the binary that
+// processes are started with. If runs aren't executed on the host, then gptscript not being found isn't an error, since runs
+// don't need it.
+func resolveGPTScript(ctx context.Context, c GPTScriptConfig, host bool) (gptscriptBinary, error) {
+	switch {
+	case c.Bin != "":
+		if err := runner.SetCommand(c.Bin); err != nil {
+			return gptscriptBinary{}, err
+		}
+		path, err := runner.LookPath()
+		if err != nil {
+			return gptscriptBinary{}, fmt.Errorf("gptscript binary %q can't be run: %w", c.Bin, err)
+		}
+		return gptscriptBinary{Path: path, Source: gptscriptSourceBin}, nil
+
+	case c.Version != "":
+		dir := c.Dir
+		if dir == "" {
+			cacheDir, err := os.UserCacheDir()
+			if err != nil {
+				return gptscriptBinary{}, fmt.Errorf("failed to find directory to download gptscript to, so it must be set: %w", err)
+			}
+			dir = filepath.Join(cacheDir, "clicky-serves", "gptscript")
+		}
+
+		slog.Debug("downloading gptscript", "version", c.Version, "dir", dir)
+		path, err := runner.Download(ctx, runner.DownloadOptions{Version: c.Version, ReleaseURL: c.ReleaseURL, Checksum: c.Checksum, Dir: dir})
+		if err != nil {
+			return gptscriptBinary{}, fmt.Errorf("failed to download gptscript %s: %w", c.Version, err)
+		}
+		if err = runner.SetCommand(path); err != nil {
+			return gptscriptBinary{}, err
+		}
+		return gptscriptBinary{Path: path, Source: gptscriptSourceDownload}, nil
+	}
+
+	source := gptscriptSourcePath
+	if os.Getenv("GPTSCRIPT_BIN") != "" {
+		source = gptscriptSourceEnv
+	}
+	path, err := runner.LookPath()
+	if err != nil {
+		if host {
+			return gptscriptBinary{}, fmt.Errorf("gptscript can't be found, so set the gptscript binary, or a version of gptscript to download: %w", err)
+		}
+		slog.Warn("The gptscript binary can't be found, so only runs that aren't executed on the host will work", "error", err)
+	}
+	return gptscriptBinary{Path: path, Source: source}, nil
+}
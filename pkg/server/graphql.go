@@ -0,0 +1,846 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/events"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+const (
+	// graphQLMaxDepth is how deeply the fields of a GraphQL query can be nested.
+	graphQLMaxDepth = 10
+	// graphQLSubscriptionError is the error of the GraphQL library for a subscription that is executed as a query, which is replaced
+	// with one that tells the client how to subscribe.
+	graphQLSubscriptionError = "graphql-ws protocol header is missing"
+)
+
+// graphQLSchema is the schema of the GraphQL API. It is a view of the HTTP API: each field is resolved with a request to the HTTP
+// endpoint that returns it, as the caller of the GraphQL request, so that authentication, scopes, and tenants are the same. The
+// fields of the query can be null, so that a field that the caller isn't allowed to see doesn't take the others with it.
+const graphQLSchema = `
+schema {
+	query: Query
+	subscription: Subscription
+}
+
+"Any JSON value, like the input of a run or the data of an event."
+scalar JSON
+"A 64-bit integer, for counts of tokens and runs."
+scalar Long
+scalar Time
+
+type Query {
+	"Get a run of the run history."
+	run(id: ID!): Run
+	"List the runs in the run history, which needs the admin scope."
+	runs(status: String, since: String): [Run!]
+	"List the latest version of every registered tool."
+	registeredTools: [RegisteredTool!]
+	"Get a registered tool, at its latest version unless the version is given."
+	registeredTool(name: String!, version: Int): RegisteredTool
+	"Get the session of the X-Session-Token header, if the request has one."
+	session: Session
+	"Get the token usage of runs by client and day, which is only the caller's own unless the caller is an admin."
+	usage(since: String, client: String): Usage
+}
+
+type Subscription {
+	"Get the events of a run after the given event ID, following the run until it ends."
+	runEvents(id: ID!, after: Int): RunEvent!
+}
+
+type Run {
+	id: ID!
+	type: String!
+	state: String!
+	error: String
+	input: JSON
+	output: String
+	startTime: Time!
+	endTime: Time
+	scheduleID: String
+	client: String
+	usage: TokenUsage
+	"The events that were written to the client of the run, after the given event ID."
+	events(after: Int): [RunEvent!]!
+}
+
+type RunEvent {
+	id: String
+	seq: Int!
+	runID: ID
+	requestID: String
+	type: String!
+	time: Time!
+	data: JSON
+}
+
+type TokenUsage {
+	promptTokens: Long!
+	completionTokens: Long!
+	totalTokens: Long!
+	cost: Float!
+}
+
+type RegisteredTool {
+	name: String!
+	version: Int!
+	description: String
+	content: String!
+	owner: String
+	createdAt: Time!
+	"Every version of the tool, oldest first."
+	versions: [RegisteredTool!]!
+}
+
+type Session {
+	credentials: [String!]!
+	chatID: ID
+	createdAt: Time!
+	expiresAt: Time!
+}
+
+type Usage {
+	since: Time!
+	clients: [ClientUsage!]!
+}
+
+type ClientUsage {
+	client: String!
+	runs: Long!
+	usage: TokenUsage!
+	quota: JSON
+	days: [DailyUsage!]!
+}
+
+type DailyUsage {
+	day: Time!
+	runs: Long!
+	usage: TokenUsage!
+}
+`
+
+// graphQLRequest is the body of a GraphQL request.
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+func (g *graphQLRequest) validate() error {
+	if g.Query == "" {
+		return missingField("query", "query is required")
+	}
+	return nil
+}
+
+func newGraphQLSchema(s *server) *graphql.Schema {
+	return graphql.MustParseSchema(graphQLSchema, &graphQLResolver{s: s}, graphql.MaxDepth(graphQLMaxDepth))
+}
+
+// graphql serves the GraphQL API. Queries are answered with JSON, and subscriptions are streamed as server sent events in the
+// distinct connections mode of the GraphQL over SSE protocol, for requests that accept text/event-stream. The response of a query
+// is a 200 even if it has errors, as GraphQL clients expect, and the errors have the code and status of the HTTP API in their
+// extensions.
+func (s *server) graphql(w http.ResponseWriter, r *http.Request) {
+	if !s.current().config.GraphQL {
+		writeError(w, http.StatusNotFound, errors.New("the GraphQL API is disabled"))
+		return
+	}
+
+	req := new(graphQLRequest)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	l := ccontext.GetLogger(r.Context())
+	l.Debug("executing GraphQL request", "operation", req.OperationName)
+
+	ctx := context.WithValue(r.Context(), graphQLCallerKey{}, r)
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.subscribeGraphQL(ctx, l, w, req)
+		return
+	}
+
+	resp := s.graphQL.Exec(ctx, req.Query, req.OperationName, req.Variables)
+	for _, e := range resp.Errors {
+		if e.Message == graphQLSubscriptionError {
+			e.Message = "subscriptions are streamed as server sent events, to requests with the Accept header text/event-stream"
+		}
+	}
+	writeResponse(w, resp)
+}
+
+// subscribeGraphQL streams the responses of the operation as server sent events: a next event for each response, and a complete
+// event once there are no more. Queries can be streamed too, as a single next event.
+func (s *server) subscribeGraphQL(ctx context.Context, l *slog.Logger, w http.ResponseWriter, req *graphQLRequest) {
+	responses, err := s.graphQL.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	setStreamingHeaders(w)
+	write := func(event string, data []byte) {
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			l.Debug("failed to write GraphQL event", "error", err)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	for resp := range responses {
+		data, err := json.Marshal(resp)
+		if err != nil {
+			l.Warn("Failed to marshal GraphQL response", "error", err)
+			continue
+		}
+		write("next", data)
+	}
+	write("complete", nil)
+}
+
+type graphQLCallerKey struct{}
+
+// graphQLError is the error of a field whose HTTP request failed, with the code and status of the error of the HTTP API in its
+// extensions.
+type graphQLError struct {
+	msg    string
+	code   errorCode
+	status int
+}
+
+func (e *graphQLError) Error() string {
+	return e.msg
+}
+
+func (e *graphQLError) Extensions() map[string]any {
+	return map[string]any{"code": e.code, "status": e.status}
+}
+
+// graphQLResolver resolves the queries and subscriptions of the GraphQL API.
+type graphQLResolver struct {
+	s *server
+}
+
+// get makes a GET request to the HTTP endpoint at the path, as the caller of the GraphQL request, and decodes its response into v.
+func (g *graphQLResolver) get(ctx context.Context, path string, query url.Values, v any) error {
+	w := newGraphQLResponseWriter(nil)
+	g.s.handler.ServeHTTP(w, newGraphQLRequest(ctx, path, query))
+	if err := w.err(); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(w.body.Bytes(), v); err != nil {
+		return fmt.Errorf("failed to decode response of %s: %w", path, err)
+	}
+	return nil
+}
+
+// newGraphQLRequest creates the HTTP request for a field of a GraphQL request, with the credentials and the session of the caller.
+func newGraphQLRequest(ctx context.Context, path string, query url.Values) *http.Request {
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	r.Header.Set("Accept", ndjsonContentType)
+
+	if caller, ok := ctx.Value(graphQLCallerKey{}).(*http.Request); ok {
+		for _, key := range []string{"Authorization", "Cookie", sessionHeader, requestIDHeader} {
+			if v := caller.Header.Get(key); v != "" {
+				r.Header.Set(key, v)
+			}
+		}
+		r.RemoteAddr = caller.RemoteAddr
+		r.TLS = caller.TLS
+	}
+
+	return r
+}
+
+func isNotFound(err error) bool {
+	var gErr *graphQLError
+	return errors.As(err, &gErr) && gErr.status == http.StatusNotFound
+}
+
+func (g *graphQLResolver) Run(ctx context.Context, args struct{ ID graphql.ID }) (*graphQLRun, error) {
+	details := new(runDetails)
+	if err := g.get(ctx, "/runs/"+url.PathEscape(string(args.ID)), nil, details); isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &graphQLRun{g: g, run: details.Run, events: details.Events, loaded: true}, nil
+}
+
+func (g *graphQLResolver) Runs(ctx context.Context, args struct{ Status, Since *string }) (*[]*graphQLRun, error) {
+	query := url.Values{}
+	if args.Status != nil {
+		query.Set("status", *args.Status)
+	}
+	if args.Since != nil {
+		query.Set("since", *args.Since)
+	}
+
+	var resp struct {
+		Runs []store.Run `json:"runs"`
+	}
+	if err := g.get(ctx, "/runs", query, &resp); err != nil {
+		return nil, err
+	}
+
+	runs := make([]*graphQLRun, 0, len(resp.Runs))
+	for _, run := range resp.Runs {
+		runs = append(runs, &graphQLRun{g: g, run: run})
+	}
+	return &runs, nil
+}
+
+func (g *graphQLResolver) RegisteredTools(ctx context.Context) (*[]*graphQLTool, error) {
+	var resp struct {
+		Tools []store.Tool `json:"tools"`
+	}
+	if err := g.get(ctx, "/registry", nil, &resp); err != nil {
+		return nil, err
+	}
+	tools := g.tools(resp.Tools)
+	return &tools, nil
+}
+
+func (g *graphQLResolver) RegisteredTool(ctx context.Context, args struct {
+	Name    string
+	Version *int32
+}) (*graphQLTool, error) {
+	query := url.Values{}
+	if args.Version != nil {
+		query.Set("version", strconv.Itoa(int(*args.Version)))
+	}
+
+	tool := new(store.Tool)
+	if err := g.get(ctx, "/registry/"+url.PathEscape(args.Name), query, tool); isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &graphQLTool{g: g, tool: *tool}, nil
+}
+
+func (g *graphQLResolver) tools(tools []store.Tool) []*graphQLTool {
+	resolvers := make([]*graphQLTool, 0, len(tools))
+	for _, t := range tools {
+		resolvers = append(resolvers, &graphQLTool{g: g, tool: t})
+	}
+	return resolvers
+}
+
+func (g *graphQLResolver) Session(ctx context.Context) (*graphQLSession, error) {
+	if caller, ok := ctx.Value(graphQLCallerKey{}).(*http.Request); !ok || caller.Header.Get(sessionHeader) == "" {
+		return nil, nil
+	}
+
+	info := new(sessionInfo)
+	if err := g.get(ctx, "/sessions/current", nil, info); isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &graphQLSession{info: *info}, nil
+}
+
+func (g *graphQLResolver) Usage(ctx context.Context, args struct{ Since, Client *string }) (*graphQLUsage, error) {
+	query := url.Values{}
+	if args.Since != nil {
+		query.Set("since", *args.Since)
+	}
+	if args.Client != nil {
+		query.Set("client", *args.Client)
+	}
+
+	resp := new(usageResponse)
+	if err := g.get(ctx, "/usage", query, resp); err != nil {
+		return nil, err
+	}
+	return &graphQLUsage{resp: *resp}, nil
+}
+
+// RunEvents streams the events of the run from the run events endpoint, which follows the run until it ends. The heartbeats of
+// the endpoint aren't events of the run, so they are left out.
+func (g *graphQLResolver) RunEvents(ctx context.Context, args struct {
+	ID    graphql.ID
+	After *int32
+}) (<-chan *graphQLEvent, error) {
+	if args.ID == "" {
+		return nil, &graphQLError{msg: "id is required", code: errorCodeMissingField, status: http.StatusBadRequest}
+	}
+
+	query := url.Values{}
+	if args.After != nil {
+		query.Set("after", strconv.Itoa(int(*args.After)))
+	}
+
+	var (
+		stream  = make(chan *graphQLEvent)
+		started = make(chan struct{})
+		done    = make(chan struct{})
+	)
+	w := newGraphQLResponseWriter(func(line []byte) {
+		e := new(graphQLEvent)
+		if err := json.Unmarshal(line, &e.envelope); err != nil || e.envelope.Type == events.TypePing {
+			return
+		}
+		select {
+		case stream <- e:
+		case <-ctx.Done():
+		}
+	})
+	w.started = started
+
+	go func() {
+		defer close(done)
+		defer close(stream)
+		g.s.handler.ServeHTTP(w, newGraphQLRequest(ctx, "/runs/"+url.PathEscape(string(args.ID))+"/events", query))
+	}()
+
+	// The response has started once its status is known, which for a run that can't be streamed is an error.
+	select {
+	case <-started:
+	case <-done:
+	}
+	if w.code != 0 && w.code != http.StatusOK {
+		<-done
+		return nil, w.err()
+	}
+	return stream, nil
+}
+
+// graphQLRun resolves a run. The events of the run are fetched when they are asked for, unless they came with the run.
+type graphQLRun struct {
+	g      *graphQLResolver
+	run    store.Run
+	events []store.Event
+	loaded bool
+}
+
+func (r *graphQLRun) ID() graphql.ID {
+	return graphql.ID(r.run.ID)
+}
+
+func (r *graphQLRun) Type() string {
+	return r.run.Type
+}
+
+func (r *graphQLRun) State() string {
+	return r.run.State
+}
+
+func (r *graphQLRun) Error() *string {
+	return optionalString(r.run.Error)
+}
+
+func (r *graphQLRun) Input() *graphQLJSON {
+	if len(r.run.Input) == 0 {
+		return nil
+	}
+	j := graphQLJSON(r.run.Input)
+	return &j
+}
+
+func (r *graphQLRun) Output() *string {
+	return optionalString(r.run.Output)
+}
+
+func (r *graphQLRun) StartTime() graphql.Time {
+	return graphql.Time{Time: r.run.StartTime}
+}
+
+func (r *graphQLRun) EndTime() *graphql.Time {
+	if r.run.EndTime == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *r.run.EndTime}
+}
+
+func (r *graphQLRun) ScheduleID() *string {
+	return optionalString(r.run.ScheduleID)
+}
+
+func (r *graphQLRun) Client() *string {
+	return optionalString(r.run.Client)
+}
+
+func (r *graphQLRun) Usage() *graphQLTokenUsage {
+	if r.run.Usage == nil {
+		return nil
+	}
+	return &graphQLTokenUsage{usage: *r.run.Usage}
+}
+
+func (r *graphQLRun) Events(ctx context.Context, args struct{ After *int32 }) ([]*graphQLEvent, error) {
+	if !r.loaded {
+		details := new(runDetails)
+		if err := r.g.get(ctx, "/runs/"+url.PathEscape(r.run.ID), nil, details); err != nil {
+			return nil, err
+		}
+		r.events, r.loaded = details.Events, true
+	}
+
+	events := make([]*graphQLEvent, 0, len(r.events))
+	for _, e := range r.events {
+		if args.After != nil && e.ID <= int64(*args.After) {
+			continue
+		}
+
+		ev := new(graphQLEvent)
+		if err := json.Unmarshal(e.Data, &ev.envelope); err != nil {
+			return nil, fmt.Errorf("failed to decode event %d of run %q: %w", e.ID, r.run.ID, err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// graphQLEvent resolves an event of a run, from its envelope.
+type graphQLEvent struct {
+	envelope struct {
+		ID        string          `json:"id"`
+		RunID     string          `json:"runID"`
+		RequestID string          `json:"requestID"`
+		Seq       int64           `json:"seq"`
+		Type      string          `json:"type"`
+		Time      time.Time       `json:"time"`
+		Data      json.RawMessage `json:"data"`
+	}
+}
+
+func (e *graphQLEvent) ID() *string {
+	return optionalString(e.envelope.ID)
+}
+
+func (e *graphQLEvent) Seq() int32 {
+	return int32(e.envelope.Seq)
+}
+
+func (e *graphQLEvent) RunID() *graphql.ID {
+	if e.envelope.RunID == "" {
+		return nil
+	}
+	id := graphql.ID(e.envelope.RunID)
+	return &id
+}
+
+func (e *graphQLEvent) RequestID() *string {
+	return optionalString(e.envelope.RequestID)
+}
+
+func (e *graphQLEvent) Type() string {
+	return e.envelope.Type
+}
+
+func (e *graphQLEvent) Time() graphql.Time {
+	return graphql.Time{Time: e.envelope.Time}
+}
+
+func (e *graphQLEvent) Data() *graphQLJSON {
+	if len(e.envelope.Data) == 0 {
+		return nil
+	}
+	j := graphQLJSON(e.envelope.Data)
+	return &j
+}
+
+type graphQLTokenUsage struct {
+	usage store.Usage
+}
+
+func (u *graphQLTokenUsage) PromptTokens() graphQLLong {
+	return graphQLLong(u.usage.PromptTokens)
+}
+
+func (u *graphQLTokenUsage) CompletionTokens() graphQLLong {
+	return graphQLLong(u.usage.CompletionTokens)
+}
+
+func (u *graphQLTokenUsage) TotalTokens() graphQLLong {
+	return graphQLLong(u.usage.TotalTokens)
+}
+
+func (u *graphQLTokenUsage) Cost() float64 {
+	return u.usage.Cost
+}
+
+// graphQLTool resolves a version of a registered tool.
+type graphQLTool struct {
+	g    *graphQLResolver
+	tool store.Tool
+}
+
+func (t *graphQLTool) Name() string {
+	return t.tool.Name
+}
+
+func (t *graphQLTool) Version() int32 {
+	return int32(t.tool.Version)
+}
+
+func (t *graphQLTool) Description() *string {
+	return optionalString(t.tool.Description)
+}
+
+func (t *graphQLTool) Content() string {
+	return t.tool.Content
+}
+
+func (t *graphQLTool) Owner() *string {
+	return optionalString(t.tool.Owner)
+}
+
+func (t *graphQLTool) CreatedAt() graphql.Time {
+	return graphql.Time{Time: t.tool.CreatedAt}
+}
+
+func (t *graphQLTool) Versions(ctx context.Context) ([]*graphQLTool, error) {
+	var resp struct {
+		Versions []store.Tool `json:"versions"`
+	}
+	if err := t.g.get(ctx, "/registry/"+url.PathEscape(t.tool.Name)+"/versions", nil, &resp); err != nil {
+		return nil, err
+	}
+	return t.g.tools(resp.Versions), nil
+}
+
+type graphQLSession struct {
+	info sessionInfo
+}
+
+func (s *graphQLSession) Credentials() []string {
+	return s.info.Credentials
+}
+
+func (s *graphQLSession) ChatID() *graphql.ID {
+	if s.info.ChatID == "" {
+		return nil
+	}
+	id := graphql.ID(s.info.ChatID)
+	return &id
+}
+
+func (s *graphQLSession) CreatedAt() graphql.Time {
+	return graphql.Time{Time: s.info.CreatedAt}
+}
+
+func (s *graphQLSession) ExpiresAt() graphql.Time {
+	return graphql.Time{Time: s.info.ExpiresAt}
+}
+
+type graphQLUsage struct {
+	resp usageResponse
+}
+
+func (u *graphQLUsage) Since() graphql.Time {
+	return graphql.Time{Time: u.resp.Since}
+}
+
+func (u *graphQLUsage) Clients() []*graphQLClientUsage {
+	clients := make([]*graphQLClientUsage, 0, len(u.resp.Clients))
+	for _, c := range u.resp.Clients {
+		clients = append(clients, &graphQLClientUsage{usage: c})
+	}
+	return clients
+}
+
+type graphQLClientUsage struct {
+	usage clientUsage
+}
+
+func (c *graphQLClientUsage) Client() string {
+	return c.usage.Client
+}
+
+func (c *graphQLClientUsage) Runs() graphQLLong {
+	return graphQLLong(c.usage.Runs)
+}
+
+func (c *graphQLClientUsage) Usage() *graphQLTokenUsage {
+	return &graphQLTokenUsage{usage: c.usage.Usage}
+}
+
+func (c *graphQLClientUsage) Quota() (*graphQLJSON, error) {
+	if c.usage.Quota == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(c.usage.Quota)
+	if err != nil {
+		return nil, err
+	}
+	j := graphQLJSON(b)
+	return &j, nil
+}
+
+func (c *graphQLClientUsage) Days() []*graphQLDailyUsage {
+	days := make([]*graphQLDailyUsage, 0, len(c.usage.Days))
+	for _, d := range c.usage.Days {
+		days = append(days, &graphQLDailyUsage{record: d})
+	}
+	return days
+}
+
+type graphQLDailyUsage struct {
+	record store.UsageRecord
+}
+
+func (d *graphQLDailyUsage) Day() graphql.Time {
+	return graphql.Time{Time: d.record.Day}
+}
+
+func (d *graphQLDailyUsage) Runs() graphQLLong {
+	return graphQLLong(d.record.Runs)
+}
+
+func (d *graphQLDailyUsage) Usage() *graphQLTokenUsage {
+	return &graphQLTokenUsage{usage: d.record.Usage}
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// graphQLJSON is the JSON scalar, for values whose shape is up to gptscript or the request, like the data of events.
+type graphQLJSON json.RawMessage
+
+func (graphQLJSON) ImplementsGraphQLType(name string) bool {
+	return name == "JSON"
+}
+
+func (j *graphQLJSON) UnmarshalGraphQL(input any) error {
+	b, err := json.Marshal(input)
+	*j = b
+	return err
+}
+
+func (j graphQLJSON) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	return j, nil
+}
+
+// graphQLLong is the Long scalar, for the integers that can be larger than the 32 bits of the Int of GraphQL.
+type graphQLLong int64
+
+func (graphQLLong) ImplementsGraphQLType(name string) bool {
+	return name == "Long"
+}
+
+func (l *graphQLLong) UnmarshalGraphQL(input any) error {
+	switch v := input.(type) {
+	case int32:
+		*l = graphQLLong(v)
+	case int64:
+		*l = graphQLLong(v)
+	case float64:
+		*l = graphQLLong(v)
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid Long %q: %w", v, err)
+		}
+		*l = graphQLLong(n)
+	default:
+		return fmt.Errorf("invalid Long %v", input)
+	}
+	return nil
+}
+
+func (l graphQLLong) MarshalJSON() ([]byte, error) {
+	return strconv.AppendInt(nil, int64(l), 10), nil
+}
+
+// graphQLResponseWriter is an http.ResponseWriter that collects the response of an HTTP handler for a field of a GraphQL request.
+// If it has an onEvent function, then the newline-delimited JSON events of a successful response are passed to it as they are
+// written, instead of being collected.
+type graphQLResponseWriter struct {
+	header  http.Header
+	code    int
+	body    bytes.Buffer
+	onEvent func(line []byte)
+	// started is closed once the status of the response is known, if it is set.
+	started chan struct{}
+}
+
+func newGraphQLResponseWriter(onEvent func(line []byte)) *graphQLResponseWriter {
+	return &graphQLResponseWriter{header: make(http.Header), onEvent: onEvent}
+}
+
+func (g *graphQLResponseWriter) Header() http.Header {
+	return g.header
+}
+
+func (g *graphQLResponseWriter) WriteHeader(code int) {
+	if g.code != 0 {
+		return
+	}
+	g.code = code
+	if g.started != nil {
+		close(g.started)
+	}
+}
+
+func (g *graphQLResponseWriter) Write(b []byte) (int, error) {
+	g.WriteHeader(http.StatusOK)
+	g.body.Write(b)
+	if g.onEvent == nil || g.code != http.StatusOK {
+		return len(b), nil
+	}
+
+	// Events can be split across writes, so only the lines that are complete are passed on.
+	for {
+		line, err := g.body.ReadBytes('\n')
+		if err != nil {
+			g.body.Reset()
+			g.body.Write(line)
+			break
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			g.onEvent(line)
+		}
+	}
+	return len(b), nil
+}
+
+// Flush is a no-op, because events are passed on as they are written.
+func (g *graphQLResponseWriter) Flush() {}
+
+// err returns the error of the response of the HTTP handler, or nil if it succeeded.
+func (g *graphQLResponseWriter) err() error {
+	if g.code == 0 || g.code == http.StatusOK || g.code == http.StatusCreated {
+		return nil
+	}
+
+	var resp errorResponse
+	if err := json.Unmarshal(g.body.Bytes(), &resp); err != nil || resp.Error == "" {
+		resp.Error = strings.TrimSpace(g.body.String())
+	}
+	if resp.Code == "" {
+		resp.Code = statusErrorCode(g.code)
+	}
+	return &graphQLError{msg: resp.Error, code: resp.Code, status: g.code}
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// grpcService serves the RPCs described in proto/clicky_serves.proto. Each RPC is turned into a request to the HTTP handler
+// of the equivalent endpoint, so that authentication, limits, and the run registry are shared with the HTTP API.
+type grpcService struct {
+	handler http.Handler
+}
+
+// grpcExecRequest is the request of the Exec and ExecStream RPCs.
+type grpcExecRequest struct {
+	Tool   json.RawMessage `json:"tool,omitempty"`
+	File   json.RawMessage `json:"file,omitempty"`
+	Events bool            `json:"events,omitempty"`
+}
+
+const grpcServiceName = "clickyserves.v1.ClickyServes"
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Parse", Handler: grpcUnaryHandler("Parse", (*grpcService).parse)},
+		{MethodName: "Exec", Handler: grpcUnaryHandler("Exec", (*grpcService).exec)},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "ExecStream", Handler: grpcExecStream, ServerStreams: true},
+	},
+	Metadata: "proto/clicky_serves.proto",
+}
+
+func newGRPCServer(handler http.Handler) *grpc.Server {
+	gs := grpc.NewServer()
+	gs.RegisterService(&grpcServiceDesc, &grpcService{handler: handler})
+	return gs
+}
+
+func grpcUnaryHandler(method string, call func(*grpcService, context.Context, *structpb.Struct) (*structpb.Struct, error)) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		in := new(structpb.Struct)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+
+		handler := func(ctx context.Context, req any) (any, error) {
+			return call(srv.(*grpcService), ctx, req.(*structpb.Struct))
+		}
+		if interceptor == nil {
+			return handler(ctx, in)
+		}
+		return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/" + method}, handler)
+	}
+}
+
+func (g *grpcService) parse(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error) {
+	body, err := in.MarshalJSON()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return g.call(ctx, "/parse", body)
+}
+
+func (g *grpcService) exec(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error) {
+	path, body, err := grpcExecPath(in, "/run-tool", "/run-file")
+	if err != nil {
+		return nil, err
+	}
+
+	return g.call(ctx, path, body)
+}
+
+func grpcExecStream(srv any, stream grpc.ServerStream) error {
+	in := new(structpb.Struct)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+
+	path, body, err := grpcExecPath(in, "/run-tool-stream", "/run-file-stream")
+	if err != nil {
+		return err
+	}
+	if in.Fields["events"].GetBoolValue() {
+		path += "-with-events"
+	}
+
+	w := newGRPCResponseWriter(stream)
+	srv.(*grpcService).handler.ServeHTTP(w, newGRPCRequest(stream.Context(), path, body))
+	return w.err()
+}
+
+// grpcExecPath returns the path of the HTTP endpoint for an exec request, and the body to send to it.
+func grpcExecPath(in *structpb.Struct, toolPath, filePath string) (string, []byte, error) {
+	b, err := in.MarshalJSON()
+	if err != nil {
+		return "", nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	req := new(grpcExecRequest)
+	if err = json.Unmarshal(b, req); err != nil {
+		return "", nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	switch {
+	case len(req.Tool) > 0 && len(req.File) == 0:
+		return toolPath, req.Tool, nil
+	case len(req.File) > 0 && len(req.Tool) == 0:
+		return filePath, req.File, nil
+	default:
+		return "", nil, status.Error(codes.InvalidArgument, "exactly one of tool or file is required")
+	}
+}
+
+// call sends the body to the HTTP endpoint at the path, and returns its response.
+func (g *grpcService) call(ctx context.Context, path string, body []byte) (*structpb.Struct, error) {
+	w := newGRPCResponseWriter(nil)
+	g.handler.ServeHTTP(w, newGRPCRequest(ctx, path, body))
+	if err := w.err(); err != nil {
+		return nil, err
+	}
+
+	_ = grpc.SetHeader(ctx, responseMetadata(w.Header()))
+
+	out := new(structpb.Struct)
+	if err := out.UnmarshalJSON(w.body.Bytes()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	}
+	return out, nil
+}
+
+// responseMetadata returns the metadata of the response to an RPC, which has the IDs of the run and the request from the headers
+// of the HTTP response, if they are set.
+func responseMetadata(h http.Header) metadata.MD {
+	md := metadata.MD{}
+	for _, key := range []string{runIDHeader, requestIDHeader} {
+		if v := h.Get(key); v != "" {
+			md.Set(strings.ToLower(key), v)
+		}
+	}
+	return md
+}
+
+// newGRPCRequest creates the HTTP request for an RPC. The authorization metadata of the RPC is used as the Authorization header.
+func newGRPCRequest(ctx context.Context, path string, body []byte) *http.Request {
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", ndjsonContentType)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		r.Header.Set("Authorization", auth[0])
+	}
+	if id := md.Get("x-request-id"); len(id) > 0 {
+		r.Header.Set("X-Request-ID", id[0])
+	}
+
+	return r
+}
+
+// grpcResponseWriter is an http.ResponseWriter that collects the response of an HTTP handler for an RPC. If it has a stream,
+// then the newline-delimited JSON events that the handler writes are sent as messages on the stream.
+type grpcResponseWriter struct {
+	header     http.Header
+	code       int
+	body       bytes.Buffer
+	stream     grpc.ServerStream
+	sentHeader bool
+	sendErr    error
+}
+
+func newGRPCResponseWriter(stream grpc.ServerStream) *grpcResponseWriter {
+	return &grpcResponseWriter{header: make(http.Header), stream: stream}
+}
+
+func (g *grpcResponseWriter) Header() http.Header {
+	return g.header
+}
+
+func (g *grpcResponseWriter) WriteHeader(code int) {
+	if g.code == 0 {
+		g.code = code
+	}
+}
+
+func (g *grpcResponseWriter) Write(b []byte) (int, error) {
+	g.WriteHeader(http.StatusOK)
+	if g.stream == nil || g.code != http.StatusOK || g.header.Get("Content-Type") != ndjsonContentType {
+		return g.body.Write(b)
+	}
+
+	if g.sendErr != nil {
+		return 0, g.sendErr
+	}
+
+	if !g.sentHeader {
+		g.sentHeader = true
+		_ = g.stream.SendHeader(responseMetadata(g.header))
+	}
+
+	for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		ev := new(structpb.Struct)
+		if err := ev.UnmarshalJSON(line); err != nil {
+			g.sendErr = fmt.Errorf("failed to decode event: %w", err)
+			return 0, g.sendErr
+		}
+		if err := g.stream.SendMsg(ev); err != nil {
+			g.sendErr = err
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Flush is a no-op, because events are sent as they are written.
+func (g *grpcResponseWriter) Flush() {}
+
+// err returns the gRPC status for the response of the HTTP handler, or nil if it succeeded.
+func (g *grpcResponseWriter) err() error {
+	if g.sendErr != nil {
+		return g.sendErr
+	}
+	if g.code == 0 || g.code == http.StatusOK || g.code == http.StatusCreated {
+		return nil
+	}
+
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(g.body.Bytes(), &resp); err != nil || resp.Error == "" {
+		resp.Error = strings.TrimSpace(g.body.String())
+	}
+
+	return status.Error(grpcCode(g.code), resp.Error)
+}
+
+// grpcCode returns the gRPC status code that corresponds to the HTTP status code.
+func grpcCode(code int) codes.Code {
+	switch code {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.FailedPrecondition
+	case http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
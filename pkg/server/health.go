@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+const (
+	checkStatusOK   = "ok"
+	checkStatusFail = "unavailable"
+
+	// modelCheckInterval is how long the result of checking a model endpoint is reused, so that probes don't hit the endpoint every time.
+	modelCheckInterval = 30 * time.Second
+	modelCheckTimeout  = 5 * time.Second
+)
+
+// readiness is the response of the readiness endpoint.
+type readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+type checkResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// modelCheck checks whether the model endpoints that gptscript uses are reachable, caching the result of each endpoint.
+type modelCheck struct {
+	lock sync.Mutex
+	// url is the endpoint of the provider of the server, which runs use unless their model is routed to another endpoint.
+	url       string
+	client    *http.Client
+	endpoints map[string]*endpointCheck
+}
+
+// endpointCheck is the last result of checking a model endpoint.
+type endpointCheck struct {
+	lock      sync.Mutex
+	result    checkResult
+	checkedAt time.Time
+}
+
+func newModelCheck() *modelCheck {
+	url := os.Getenv("OPENAI_BASE_URL")
+	if url == "" {
+		url = "https://api.openai.com/v1"
+	}
+
+	return &modelCheck{
+		url:       url,
+		client:    &http.Client{Timeout: modelCheckTimeout},
+		endpoints: make(map[string]*endpointCheck),
+	}
+}
+
+// modelEndpoints returns the model endpoints that runs can be sent to, by the name of their check. The endpoint of the provider
+// of the server is the model check, and it is only checked if a run can use it. Routes with their own endpoint are checked as
+// model/ followed by the name of the route.
+func (m *modelCheck) modelEndpoints(models map[string]ModelRoute) map[string]string {
+	endpoints := make(map[string]string, len(models)+1)
+	if len(models) == 0 {
+		endpoints["model"] = m.url
+	}
+	for name, route := range models {
+		if route.BaseURL == "" {
+			endpoints["model"] = m.url
+		} else {
+			endpoints["model/"+name] = strings.TrimSuffix(route.BaseURL, "/")
+		}
+	}
+	return endpoints
+}
+
+// check reports whether each of the model endpoints of the routes is reachable, by the name of its check. The endpoints are
+// checked at the same time, and each on a context of its own, so that a probe that is canceled doesn't fail the check until the
+// result is checked again.
+func (m *modelCheck) check(ctx context.Context, models map[string]ModelRoute) map[string]checkResult {
+	endpoints := m.modelEndpoints(models)
+
+	m.lock.Lock()
+	checks := make(map[string]*endpointCheck, len(endpoints))
+	for _, url := range endpoints {
+		if checks[url] = m.endpoints[url]; checks[url] == nil {
+			checks[url] = new(endpointCheck)
+		}
+	}
+	// The endpoints of routes that were removed when the config was reloaded are forgotten.
+	m.endpoints = checks
+	m.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), modelCheckTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for url, e := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.check(ctx, m.client, url)
+		}()
+	}
+	wg.Wait()
+
+	results := make(map[string]checkResult, len(endpoints))
+	for name, url := range endpoints {
+		results[name] = checks[url].result
+	}
+	return results
+}
+
+// check checks whether the endpoint is reachable, unless it was checked recently. Any HTTP response means it is, regardless of
+// the status code.
+func (e *endpointCheck) check(ctx context.Context, client *http.Client, url string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if time.Since(e.checkedAt) < modelCheckInterval {
+		return
+	}
+
+	e.result = checkResult{Status: checkStatusOK}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/models", nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = client.Do(req); err == nil {
+			_ = resp.Body.Close()
+		}
+	}
+	if err != nil {
+		e.result = checkResult{Status: checkStatusFail, Message: fmt.Sprintf("model endpoint %s is not reachable: %v", url, err)}
+	}
+
+	e.checkedAt = time.Now()
+}
+
+// health just provides an endpoint for checking whether the server is running and accessible.
+func health(w http.ResponseWriter, _ *http.Request) {
+	writeResponse(w, map[string]string{"status": checkStatusOK})
+}
+
+// ready checks whether the server can accept runs: the model endpoints are reachable, the backend can start processes, the server
+// isn't draining, and the run queue isn't full. The backend can start processes if the gptscript binary can be found for the host
+// backend, the container runtime can be found for the sandbox, and the API server is reachable for Kubernetes. If any check
+// fails, then the response has a 503 status code.
+func (s *server) ready(w http.ResponseWriter, r *http.Request) {
+	checks := s.modelCheck.check(r.Context(), s.current().config.Models)
+	checks["queue"] = checkResult{Status: checkStatusOK}
+
+	// Only the host backend runs the gptscript binary of the server. The other backends run the gptscript of their image.
+	switch b := s.backend().(type) {
+	case runner.Host:
+		if path, err := runner.LookPath(); err != nil {
+			checks["gptscript"] = checkResult{Status: checkStatusFail, Message: err.Error()}
+		} else {
+			checks["gptscript"] = checkResult{Status: checkStatusOK, Message: path}
+		}
+	case runner.Container:
+		if path, err := exec.LookPath(b.Runtime); err != nil {
+			checks["sandbox"] = checkResult{Status: checkStatusFail, Message: err.Error()}
+		} else {
+			checks["sandbox"] = checkResult{Status: checkStatusOK, Message: path}
+		}
+	case *runner.Kubernetes:
+		ctx, cancel := context.WithTimeout(r.Context(), modelCheckTimeout)
+		if err := b.Ping(ctx); err != nil {
+			checks["kubernetes"] = checkResult{Status: checkStatusFail, Message: err.Error()}
+		} else {
+			checks["kubernetes"] = checkResult{Status: checkStatusOK}
+		}
+		cancel()
+	}
+
+	if s.draining.Load() {
+		checks["drain"] = checkResult{Status: checkStatusFail, Message: errDraining.Error()}
+	}
+
+	if s.limiter.saturated() {
+		checks["queue"] = checkResult{Status: checkStatusFail, Message: "the run queue is full"}
+	}
+
+	status := checkStatusOK
+	for _, c := range checks {
+		if c.Status != checkStatusOK {
+			status = checkStatusFail
+			w.WriteHeader(http.StatusServiceUnavailable)
+			break
+		}
+	}
+
+	writeResponse(w, readiness{
+		Status: status,
+		Checks: checks,
+	})
+}
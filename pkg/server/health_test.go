@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+func TestModelCheck(t *testing.T) {
+	var probes int
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		if r.URL.Path != "/v1/models" {
+			t.Errorf("got probe of %s, want /v1/models", r.URL.Path)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer up.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	m := newModelCheck()
+	m.url = up.URL + "/v1"
+
+	tests := []struct {
+		name   string
+		models map[string]ModelRoute
+		want   map[string]string
+	}{
+		{
+			name: "provider of the server",
+			want: map[string]string{"model": checkStatusOK},
+		},
+		{
+			name: "routes with their own endpoints",
+			models: map[string]ModelRoute{
+				"gpt-4o": {},
+				"local":  {Provider: providerLocal, BaseURL: up.URL + "/v1/"},
+				"azure":  {Provider: providerAzure, BaseURL: down.URL},
+			},
+			want: map[string]string{"model": checkStatusOK, "model/local": checkStatusOK, "model/azure": checkStatusFail},
+		},
+		{
+			name:   "no route uses the provider of the server",
+			models: map[string]ModelRoute{"local": {Provider: providerLocal, BaseURL: up.URL + "/v1"}},
+			want:   map[string]string{"model/local": checkStatusOK},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := m.check(context.Background(), tt.models)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got checks %v, want %v", got, tt.want)
+			}
+			for name, status := range tt.want {
+				if got[name].Status != status {
+					t.Errorf("got %s check %v, want %s", name, got[name], status)
+				}
+			}
+		})
+	}
+
+	// The endpoint of the server and the local route are the same, so it is only probed once until the result expires.
+	if probes != 1 {
+		t.Errorf("got %d probes, want 1", probes)
+	}
+}
+
+func TestModelCheckCanceledProbe(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	m := newModelCheck()
+	m.url = up.URL
+
+	// A probe that is canceled, like one that the kubelet gave up on, still checks the endpoint.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := m.check(ctx, nil)["model"]; got.Status != checkStatusOK {
+		t.Fatalf("got %v for a canceled probe, want %s", got, checkStatusOK)
+	}
+}
+
+func TestReadyKubernetes(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   string
+	}{
+		{name: "reachable", status: http.StatusOK, want: checkStatusOK},
+		{name: "forbidden", status: http.StatusForbidden, want: checkStatusFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/apis/batch/v1/namespaces/runs/jobs" {
+					// The model endpoint is probed too.
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte("{}"))
+			}))
+			defer api.Close()
+
+			backend, err := runner.NewKubernetes(runner.KubernetesConfig{Image: "gptscript", APIServer: api.URL, Namespace: "runs"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := &server{limiter: newRunLimiter(0, 0), modelCheck: newModelCheck()}
+			s.modelCheck.url = api.URL
+			s.settings.Store(&settings{backend: backend})
+
+			rec := httptest.NewRecorder()
+			s.ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			var got readiness
+			if err = json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Checks["kubernetes"].Status != tt.want {
+				t.Errorf("got kubernetes check %v, want %s", got.Checks["kubernetes"], tt.want)
+			}
+			if _, ok := got.Checks["gptscript"]; ok {
+				t.Error("the gptscript binary of the host was checked for the kubernetes backend")
+			}
+		})
+	}
+}
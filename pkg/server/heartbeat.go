@@ -0,0 +1,100 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+// heartbeatEvent is the heartbeat of the transports that can't write something that isn't an event.
+func heartbeatEvent() events.Envelope {
+	return events.Envelope{Version: events.Version, Type: events.TypePing, Time: time.Now()}
+}
+
+// heartbeatWriter is a streamWriter that writes a heartbeat whenever nothing has been written to the stream for the heartbeat
+// interval, so that proxies and load balancers don't close the connection while a run is waiting on a long model call.
+type heartbeatWriter struct {
+	streamWriter
+
+	// lock ensures that heartbeats aren't written at the same time as events, or after the heartbeats are stopped.
+	lock     sync.Mutex
+	interval time.Duration
+	timer    *time.Timer
+	stopped  bool
+}
+
+// withHeartbeat wraps the stream so that heartbeats are written to it while it is idle. The returned function stops the heartbeats,
+// and must be called before the handler that owns the stream returns.
+// The stream is counted as open until then.
+func (s *server) withHeartbeat(w streamWriter) (streamWriter, func()) {
+	s.openStreams.Add(1)
+	var closed sync.Once
+	closeStream := func() {
+		closed.Do(func() {
+			s.openStreams.Add(-1)
+		})
+	}
+
+	interval := s.current().config.HeartbeatInterval
+	if interval <= 0 {
+		return w, closeStream
+	}
+
+	hw := &heartbeatWriter{streamWriter: w, interval: interval}
+	hw.timer = time.AfterFunc(hw.interval, hw.beat)
+
+	return hw, func() {
+		hw.stop()
+		closeStream()
+	}
+}
+
+func (h *heartbeatWriter) writeEvent(event any) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.streamWriter.writeEvent(event)
+	h.resetTimer()
+}
+
+func (h *heartbeatWriter) writeEncodedEvent(id string, ev []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.streamWriter.writeEncodedEvent(id, ev)
+	h.resetTimer()
+}
+
+// finish stops the heartbeats before finishing the stream, since nothing can be written to the stream after it is finished.
+func (h *heartbeatWriter) finish() {
+	h.stop()
+	h.streamWriter.finish()
+}
+
+func (h *heartbeatWriter) beat() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.stopped {
+		return
+	}
+
+	h.streamWriter.writeHeartbeat()
+	h.resetTimer()
+}
+
+// resetTimer restarts the wait for the next heartbeat, unless the heartbeats are stopped. The lock must be held by the caller.
+func (h *heartbeatWriter) resetTimer() {
+	if !h.stopped {
+		h.timer.Reset(h.interval)
+	}
+}
+
+func (h *heartbeatWriter) stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.stopped = true
+	h.timer.Stop()
+}
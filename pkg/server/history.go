@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+// historyWriter is an eventWriter that numbers the events of a run and wraps them in envelopes, then adds them to the run history
+// before writing them to the client.
+type historyWriter struct {
+	eventWriter
+	l        *slog.Logger
+	store    store.Store
+	notifier *eventNotifier
+	runID    string
+	// publisher publishes the events to the brokers, as the events of the run of the tenant.
+	publisher *eventPublisher
+	tenant    string
+	// requestID is the ID of the request that started the run.
+	requestID string
+
+	// lock ensures that the events are numbered in the order that they are written.
+	lock sync.Mutex
+	seq  int64
+}
+
+func (h *historyWriter) writeEvent(event any) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.seq++
+	e := newEventEnvelope(h.runID, h.seq, event)
+	e.RequestID = h.requestID
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		h.l.Warn("failed to marshal event for run history", "error", err)
+	} else {
+		if err = h.store.AddEvent(context.Background(), h.runID, store.Event{ID: h.seq, Time: e.Time, Data: data}); err != nil {
+			h.l.Warn("failed to add event to run history", "error", err)
+		}
+		h.notifier.notify(h.runID)
+		h.publisher.publish(h.tenant, h.runID, e.Type, data)
+	}
+
+	h.eventWriter.writeEvent(e)
+}
+
+// finish writes the done event, which is the last event of the run, before finishing the stream.
+func (h *historyWriter) finish() {
+	h.writeEvent(events.Done{Time: time.Now(), Done: true})
+	h.eventWriter.finish()
+}
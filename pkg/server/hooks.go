@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+// hookTimeout is how long a hook can take before it is given up on.
+const hookTimeout = 30 * time.Second
+
+// Hook is called before and after each run, like to enforce policies on what is run, or to redact the input of runs before it
+// reaches the model.
+type Hook interface {
+	// BeforeRun is called before the run is recorded and started. It returns the request of the run, which it can change, or an
+	// error to reject the run with. The options that the server handles, like the timeout and the environment, have already been
+	// checked, so changing them has no effect.
+	BeforeRun(ctx context.Context, run HookRun) (json.RawMessage, error)
+	// AfterRun is called once the run has ended, with its output and the error that it failed with. It doesn't hold up the
+	// response of the run.
+	AfterRun(ctx context.Context, run HookRun, output string, runErr error) error
+}
+
+// HookRun is a run as it is given to hooks.
+type HookRun struct {
+	// ID is the ID of the run, which is empty before the run is recorded.
+	ID string `json:"id,omitempty"`
+	// Type is the type of the run, which is tool, file, or chat.
+	Type string `json:"type"`
+	// Caller is the name of the client that started the run, which is empty if authentication is disabled.
+	Caller string `json:"caller,omitempty"`
+	// Tenant is the tenant of the client, which is empty for the default tenant.
+	Tenant string `json:"tenant,omitempty"`
+	// Request is the request of the run, as it is recorded: the tool or file with its options and input, or the message of a chat.
+	Request json.RawMessage `json:"request"`
+}
+
+var (
+	registeredHooksLock sync.RWMutex
+	registeredHooks     = map[string]Hook{}
+)
+
+// RegisterHook makes a hook available to be chosen by Config.Hooks. A hook that is registered with the name of another replaces it.
+// Hooks should be registered before the server is started.
+func RegisterHook(name string, h Hook) {
+	registeredHooksLock.Lock()
+	defer registeredHooksLock.Unlock()
+
+	registeredHooks[name] = h
+}
+
+// namedHook is a hook with the name that it was configured by.
+type namedHook struct {
+	Hook
+	name string
+}
+
+// hookRejection is the error of a run that a hook rejected.
+type hookRejection struct {
+	hook string
+	err  error
+}
+
+func (h *hookRejection) Error() string {
+	return fmt.Sprintf("run rejected by hook %s: %v", h.hook, h.err)
+}
+
+func (h *hookRejection) Unwrap() error {
+	return h.err
+}
+
+// newHooks returns the hooks of the config, in the order that they are called. Each one is either the name of a registered hook,
+// or the path of an executable.
+func newHooks(names []string) ([]namedHook, error) {
+	registeredHooksLock.RLock()
+	defer registeredHooksLock.RUnlock()
+
+	hooks := make([]namedHook, 0, len(names))
+	for _, name := range names {
+		if h, ok := registeredHooks[name]; ok {
+			hooks = append(hooks, namedHook{Hook: h, name: name})
+			continue
+		}
+
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, fmt.Errorf("hook %q is neither a registered hook nor an executable: %w", name, err)
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("hook %q is a directory", name)
+		}
+		hooks = append(hooks, namedHook{Hook: execHook{path: name}, name: name})
+	}
+	return hooks, nil
+}
+
+// beforeRun calls the hooks before a run, with the request of the run that each hook before it returned. The request that the
+// last hook returned is decoded back into the input, which must be a pointer for a hook to change it, and is returned as JSON.
+func beforeRun(ctx context.Context, hooks []namedHook, t runType, input any) ([]byte, error) {
+	in, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal run input: %w", err)
+	}
+	if len(hooks) == 0 {
+		return in, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	l := ccontext.GetLogger(ctx)
+	run := HookRun{Type: string(t), Caller: usageClient(ctx), Tenant: tenantOf(ctx), Request: in}
+	for _, h := range hooks {
+		l.Debug("calling hook before run", "hook", h.name)
+		if run.Request, err = h.BeforeRun(ctx, run); err != nil {
+			return nil, &hookRejection{hook: h.name, err: err}
+		}
+	}
+
+	if bytes.Equal(run.Request, in) {
+		return in, nil
+	}
+
+	// The input is replaced instead of being decoded into, so that the fields that the hooks removed are removed from it too.
+	v := reflect.ValueOf(input)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return nil, fmt.Errorf("the hooks changed a request that can't be changed")
+	}
+	changed := reflect.New(v.Elem().Type())
+	if err = json.Unmarshal(run.Request, changed.Interface()); err != nil {
+		return nil, fmt.Errorf("the hooks returned an invalid request: %w", err)
+	}
+	v.Elem().Set(changed.Elem())
+
+	return json.Marshal(input)
+}
+
+// afterRun calls the hooks after a run in the background, so that they don't hold up the response of the run. The hooks that fail
+// are logged.
+func afterRun(ctx context.Context, hooks []namedHook, run HookRun, output string, runErr error) {
+	if len(hooks) == 0 {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+		defer cancel()
+
+		l := ccontext.GetLogger(ctx)
+		for _, h := range hooks {
+			l.Debug("calling hook after run", "hook", h.name)
+			if err := h.AfterRun(ctx, run, output, runErr); err != nil {
+				l.Warn("Hook failed after run", "hook", h.name, "error", err)
+			}
+		}
+	}()
+}
+
+// execHook is a hook that is an executable. It is run with "before" or "after" as its only argument, and is given the run as JSON
+// on its stdin, along with the output and error of the run after it. Before a run, what it writes to its stdout is the request of
+// the run, which is left as it is if nothing is written, and it rejects the run by exiting with an error, with what it wrote to
+// its stderr as the reason.
+type execHook struct {
+	path string
+}
+
+func (h execHook) BeforeRun(ctx context.Context, run HookRun) (json.RawMessage, error) {
+	out, err := h.exec(ctx, "before", run)
+	if err != nil {
+		return nil, err
+	}
+
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return run.Request, nil
+	}
+	if !json.Valid(out) {
+		return nil, errors.New("the hook didn't write JSON")
+	}
+	return out, nil
+}
+
+func (h execHook) AfterRun(ctx context.Context, run HookRun, output string, runErr error) error {
+	ended := struct {
+		HookRun
+		Output string `json:"output"`
+		Error  string `json:"error,omitempty"`
+	}{HookRun: run, Output: output}
+	if runErr != nil {
+		ended.Error = runErr.Error()
+	}
+
+	_, err := h.exec(ctx, "after", ended)
+	return err
+}
+
+// exec runs the executable with the event as its argument and the payload on its stdin, and returns what it writes to its stdout.
+func (h execHook) exec(ctx context.Context, event string, payload any) ([]byte, error) {
+	in, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.path, event)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if reason := strings.TrimSpace(stderr.String()); reason != "" {
+			return nil, errors.New(reason)
+		}
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gptscript-ai/go-gptscript"
+)
+
+// checkArgs returns an error listing the arguments that aren't declared by the tool and the required arguments of the tool that
+// are missing, if there are any.
+func checkArgs(t gptscript.Tool, args map[string]json.RawMessage) error {
+	if t.Arguments == nil || len(t.Arguments.Properties) == 0 {
+		return nil
+	}
+
+	var unknown, missing []string
+	for name := range args {
+		if _, ok := t.Arguments.Properties[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	for _, name := range t.Arguments.Required {
+		if _, ok := args[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(unknown) == 0 && len(missing) == 0 {
+		return nil
+	}
+
+	declared := make([]string, 0, len(t.Arguments.Properties))
+	for name := range t.Arguments.Properties {
+		declared = append(declared, name)
+	}
+	slices.Sort(declared)
+	slices.Sort(unknown)
+
+	var problems []string
+	if len(unknown) > 0 {
+		problems = append(problems, "unknown arguments "+strings.Join(unknown, ", "))
+	}
+	if len(missing) > 0 {
+		problems = append(problems, "missing arguments "+strings.Join(missing, ", "))
+	}
+	return invalidField("input", fmt.Sprintf("%s for tool %q, which takes %s", strings.Join(problems, " and "), t.Name, strings.Join(declared, ", ")))
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// newInternalRequest creates a request that the server makes to its own HTTP handler, for the APIs that are a view of the HTTP
+// API. The request has the credentials, the session, and the address of the caller, if there is one, so that authentication,
+// scopes, and tenants are the same as if the caller had made it.
+func newInternalRequest(ctx context.Context, caller *http.Request, method, path string, body []byte) *http.Request {
+	r, _ := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", ndjsonContentType)
+
+	if caller != nil {
+		for _, key := range []string{"Authorization", "Cookie", sessionHeader, requestIDHeader} {
+			if v := caller.Header.Get(key); v != "" {
+				r.Header.Set(key, v)
+			}
+		}
+		r.RemoteAddr = caller.RemoteAddr
+		r.TLS = caller.TLS
+	}
+
+	return r
+}
+
+// internalResponseWriter is an http.ResponseWriter that collects the response of an internal request. If it has an onEvent
+// function, then the newline-delimited JSON events of a successful response are passed to it as they are written, instead of
+// being collected.
+type internalResponseWriter struct {
+	header  http.Header
+	code    int
+	body    bytes.Buffer
+	onEvent func(line []byte)
+}
+
+func newInternalResponseWriter(onEvent func(line []byte)) *internalResponseWriter {
+	return &internalResponseWriter{header: make(http.Header), onEvent: onEvent}
+}
+
+func (i *internalResponseWriter) Header() http.Header {
+	return i.header
+}
+
+func (i *internalResponseWriter) WriteHeader(code int) {
+	if i.code == 0 {
+		i.code = code
+	}
+}
+
+func (i *internalResponseWriter) Write(b []byte) (int, error) {
+	i.WriteHeader(http.StatusOK)
+	i.body.Write(b)
+	if i.onEvent == nil || i.code != http.StatusOK {
+		return len(b), nil
+	}
+
+	// Events can be split across writes, so only the lines that are complete are passed on.
+	for {
+		line, err := i.body.ReadBytes('\n')
+		if err != nil {
+			i.body.Reset()
+			i.body.Write(line)
+			break
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			i.onEvent(line)
+		}
+	}
+	return len(b), nil
+}
+
+// Flush is a no-op, because events are passed on as they are written.
+func (i *internalResponseWriter) Flush() {}
+
+// failed reports whether the handler failed, and returns the error that it responded with, with the code of its status if the
+// response has none.
+func (i *internalResponseWriter) failed() (errorResponse, bool) {
+	if i.code == 0 || i.code == http.StatusOK || i.code == http.StatusCreated {
+		return errorResponse{}, false
+	}
+
+	var resp errorResponse
+	if err := json.Unmarshal(i.body.Bytes(), &resp); err != nil || resp.Error == "" {
+		resp.Error = strings.TrimSpace(i.body.String())
+	}
+	if resp.Code == "" {
+		resp.Code = statusErrorCode(i.code)
+	}
+	return resp, true
+}
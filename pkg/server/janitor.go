@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	cleanupCache      = "cache"
+	cleanupUploads    = "uploads"
+	cleanupTools      = "tools"
+	cleanupWorkspaces = "workspaces"
+
+	// janitorIdleCheck is how often the janitor checks whether it was enabled by a reload of the config while it is disabled.
+	janitorIdleCheck = time.Minute
+)
+
+// JanitorConfig configures the janitor, which removes what the server keeps on disk once it is too old, or once there is too much of
+// it, so that a server that runs for a long time doesn't fill its disk. The oldest files are removed first. The limits that are 0
+// aren't enforced.
+type JanitorConfig struct {
+	// Interval is how often the janitor runs. It doesn't run on its own if it is 0, but it can still be run through the admin API.
+	Interval time.Duration
+	// CacheTTL is how long the entries of the cache directories of gptscript are kept after they last changed, and CacheMaxSize is
+	// the size in bytes that they can take up together. Only the cache directories that are set in the default options or in the
+	// options of clients are cleaned up.
+	CacheTTL     time.Duration
+	CacheMaxSize int64
+	// UploadTTL is how long uploaded files are kept, and UploadMaxSize is the size in bytes that they can take up together.
+	UploadTTL     time.Duration
+	UploadMaxSize int64
+	// WorkspaceMaxSize is the size in bytes that the workspaces of sessions can take up together. Once they take up more, the
+	// sessions that were used least recently are removed with their workspaces, except those that were used within the max run
+	// timeout, since they might have runs in progress.
+	WorkspaceMaxSize int64
+}
+
+func (c JanitorConfig) validate() error {
+	if c.Interval < 0 || c.CacheTTL < 0 || c.CacheMaxSize < 0 || c.UploadTTL < 0 || c.UploadMaxSize < 0 || c.WorkspaceMaxSize < 0 {
+		return errors.New("interval, TTLs, and max sizes must not be negative")
+	}
+	return nil
+}
+
+// cleanupReport is what a cleanup removed from an area of the disk, and how much of the disk the area takes up afterward.
+type cleanupReport struct {
+	Area         string `json:"area"`
+	Size         int64  `json:"size"`
+	Removed      int    `json:"removed"`
+	RemovedBytes int64  `json:"removedBytes"`
+}
+
+// diskEntry is a file or directory that the janitor can remove, with its size and when it was last changed or used.
+type diskEntry struct {
+	key     string
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// runJanitor cleans up the disk every interval of the janitor until the context is done. The interval is read again after each
+// cleanup, so that reloading the config changes it.
+func (s *server) runJanitor(ctx context.Context) {
+	for {
+		wait := s.current().config.Janitor.Interval
+		if wait <= 0 {
+			wait = janitorIdleCheck
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if s.current().config.Janitor.Interval > 0 {
+			s.cleanup()
+		}
+	}
+}
+
+// cleanup removes what is too old, and then the oldest of what is left until each area is within its max size, and returns what it
+// removed. Only one cleanup runs at a time.
+func (s *server) cleanup() []cleanupReport {
+	s.janitorLock.Lock()
+	defer s.janitorLock.Unlock()
+
+	config := s.current().config
+	reports := []cleanupReport{
+		evictEntries(cleanupCache, cacheEntries(config), config.Janitor.CacheTTL, config.Janitor.CacheMaxSize, removeEntry),
+		evictEntries(cleanupUploads, s.uploads.entries(), config.Janitor.UploadTTL, config.Janitor.UploadMaxSize, removeEntry),
+		s.tools.prune(),
+		s.cleanupWorkspaces(config),
+	}
+
+	for _, r := range reports {
+		diskUsage.WithLabelValues(r.Area).Set(float64(r.Size))
+		cleanupRemoved.WithLabelValues(r.Area).Add(float64(r.Removed))
+		cleanupRemovedBytes.WithLabelValues(r.Area).Add(float64(r.RemovedBytes))
+		if r.Removed > 0 {
+			slog.Info("Cleaned up disk", "area", r.Area, "removed", r.Removed, "removedBytes", r.RemovedBytes, "size", r.Size)
+		}
+	}
+	return reports
+}
+
+// cleanupWorkspaces removes the workspaces of the sessions that expired or that are over the max size, and the workspaces of runs
+// that were left behind by runs that have ended.
+func (s *server) cleanupWorkspaces(config Config) cleanupReport {
+	r := s.sessions.evict(config.Janitor.WorkspaceMaxSize, config.MaxRunTimeout)
+
+	// The workspaces are listed before the active runs, so that the run of each workspace that is listed is known if it is active.
+	entries := dirEntries(s.workspaces, nil)
+	active := make(map[string]bool)
+	for _, run := range s.runs.active() {
+		active[run.ID] = true
+	}
+
+	for _, e := range entries {
+		if active[e.key] {
+			r.Size += e.size
+		} else if removeEntry(e) {
+			r.Removed++
+			r.RemovedBytes += e.size
+		}
+	}
+	return r
+}
+
+// evictEntries removes the entries that were last changed longer than the TTL ago, and then the oldest of the others until they take
+// up at most the max size, with the remove function, which returns whether the entry was removed.
+func evictEntries(area string, entries []diskEntry, ttl time.Duration, maxSize int64, remove func(diskEntry) bool) cleanupReport {
+	slices.SortFunc(entries, func(a, b diskEntry) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	r := cleanupReport{Area: area}
+	for _, e := range entries {
+		r.Size += e.size
+	}
+
+	for _, e := range entries {
+		expired := ttl > 0 && time.Since(e.modTime) > ttl
+		if !expired && (maxSize == 0 || r.Size <= maxSize) {
+			continue
+		}
+		if remove(e) {
+			r.Size -= e.size
+			r.Removed++
+			r.RemovedBytes += e.size
+		}
+	}
+	return r
+}
+
+func removeEntry(e diskEntry) bool {
+	if err := os.RemoveAll(e.path); err != nil {
+		slog.Error("Failed to clean up disk", "path", e.path, "error", err)
+		return false
+	}
+	return true
+}
+
+// cacheEntries returns the entries of the cache directories of gptscript that are set in the default options and in the options of
+// clients, or of the cache directories of every tenant under the cache root if there is one.
+func cacheEntries(config Config) []diskEntry {
+	var dirs []string
+	if config.CacheRoot != "" {
+		dirs = cacheRootDirs(config.CacheRoot)
+	} else {
+		dirs = append(dirs, config.DefaultOpts.CacheDir)
+		for _, opts := range config.ClientOpts {
+			dirs = append(dirs, opts.CacheDir)
+		}
+	}
+	slices.Sort(dirs)
+
+	var entries []diskEntry
+	for _, dir := range slices.Compact(dirs) {
+		if dir != "" {
+			entries = append(entries, dirEntries(dir, nil)...)
+		}
+	}
+	return entries
+}
+
+// dirEntries returns the entries of the directory, except those that skip returns true for, with the size of each and the last
+// time that anything in it changed. A directory that doesn't exist has no entries.
+func dirEntries(dir string, skip func(name string) bool) []diskEntry {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Failed to read directory to clean up", "dir", dir, "error", err)
+		}
+		return nil
+	}
+
+	entries := make([]diskEntry, 0, len(des))
+	for _, de := range des {
+		if skip != nil && skip(de.Name()) {
+			continue
+		}
+		e := diskEntry{key: de.Name(), path: filepath.Join(dir, de.Name())}
+		e.size, e.modTime = diskUsageOf(e.path)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// diskUsageOf returns the size in bytes of the files in the path, and the last time that any of them changed.
+func diskUsageOf(path string) (int64, time.Time) {
+	var (
+		size    int64
+		modTime time.Time
+	)
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The files that can't be read, or that were removed while walking, are left out.
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		return nil
+	})
+	return size, modTime
+}
+
+// hiddenEntry is true for the entries whose names start with a dot, like the directories that the server keeps in the upload
+// directory, and the files that are still being uploaded.
+func hiddenEntry(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// cleanupDisk runs the janitor right away, and returns what it removed.
+func (s *server) cleanupDisk(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, map[string][]cleanupReport{"areas": s.cleanup()})
+}
@@ -0,0 +1,554 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+const (
+	jsonRPCVersion = "2.0"
+
+	// The codes of the errors that JSON-RPC 2.0 defines. Errors of the HTTP API have the server error code, with their status and
+	// code in the data of the error.
+	jsonRPCParseError     = -32700
+	jsonRPCInvalidRequest = -32600
+	jsonRPCMethodNotFound = -32601
+	jsonRPCInvalidParams  = -32602
+	jsonRPCInternalError  = -32603
+	jsonRPCServerError    = -32000
+	// jsonRPCRequestCanceled is the code of the error of a request that was canceled, which is the code of the Language Server
+	// Protocol, so that editors recognize it.
+	jsonRPCRequestCanceled = -32800
+
+	// jsonRPCEventMethod is the method of the notifications with the events of a stream.
+	jsonRPCEventMethod = "event"
+
+	// jsonRPCStdioRemoteAddr is the remote address of the requests that come in on stdio.
+	jsonRPCStdioRemoteAddr = "stdio"
+)
+
+// jsonRPCNull is the ID of the responses to requests whose ID couldn't be read.
+var jsonRPCNull = json.RawMessage("null")
+
+// jsonRPCRequest is a request or, if it has no ID, a notification of JSON-RPC 2.0.
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// Result and Error are set if the message is a response to a request of the server instead of a request. The server doesn't
+	// send requests, so responses are ignored.
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+func (j *jsonRPCRequest) isNotification() bool {
+	return len(j.ID) == 0
+}
+
+func (j *jsonRPCRequest) isResponse() bool {
+	return j.Method == "" && (len(j.Result) > 0 || len(j.Error) > 0)
+}
+
+func (j *jsonRPCRequest) validate() *jsonRPCError {
+	if j.isResponse() {
+		return nil
+	}
+	if j.JSONRPC != jsonRPCVersion {
+		return &jsonRPCError{Code: jsonRPCInvalidRequest, Message: `jsonrpc must be "2.0"`}
+	}
+	if j.Method == "" {
+		return &jsonRPCError{Code: jsonRPCInvalidRequest, Message: "method is required"}
+	}
+	if id := bytes.TrimSpace(j.ID); len(id) > 0 && id[0] != '"' && id[0] != '-' && (id[0] < '0' || id[0] > '9') && !bytes.Equal(id, jsonRPCNull) {
+		return &jsonRPCError{Code: jsonRPCInvalidRequest, Message: "id must be a string, a number, or null"}
+	}
+	return nil
+}
+
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+}
+
+type jsonRPCError struct {
+	Code    int               `json:"code"`
+	Message string            `json:"message"`
+	Data    *jsonRPCErrorData `json:"data,omitempty"`
+}
+
+func (e *jsonRPCError) Error() string {
+	return e.Message
+}
+
+// jsonRPCErrorData is the data of an error of the HTTP API, with the status and the code that the HTTP API responded with.
+type jsonRPCErrorData struct {
+	Status    int       `json:"status"`
+	Code      errorCode `json:"code"`
+	Field     string    `json:"field,omitempty"`
+	RequestID string    `json:"requestID,omitempty"`
+}
+
+type jsonRPCNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+// jsonRPCEvent is the params of a notification with an event of a stream. RequestID is the ID of the stream request that the
+// event is for, so that the events of concurrent streams can be told apart.
+type jsonRPCEvent struct {
+	RequestID json.RawMessage `json:"requestId,omitempty"`
+	RunID     string          `json:"runId,omitempty"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// jsonRPCExecParams is the params of the exec and stream methods, with the body of a request to run either a tool or a file.
+// Events streams the events of the run as well as its output.
+type jsonRPCExecParams struct {
+	Tool   json.RawMessage `json:"tool,omitempty"`
+	File   json.RawMessage `json:"file,omitempty"`
+	Events bool            `json:"events,omitempty"`
+}
+
+// jsonRPCCancelParams is the params of the cancel method, with either the ID of a run to cancel, or the ID of a request of the
+// same connection that is in progress, whose run is canceled with it.
+type jsonRPCCancelParams struct {
+	RunID     string          `json:"runId,omitempty"`
+	RequestID json.RawMessage `json:"requestId,omitempty"`
+}
+
+// jsonRPCStreamResult is the result of the stream method, which is sent once the stream has ended.
+type jsonRPCStreamResult struct {
+	RunID string `json:"runId,omitempty"`
+}
+
+// jsonRPCConn is a connection that JSON-RPC messages come in on: an HTTP request or stdio. The methods are turned into requests to
+// the HTTP handler of the equivalent endpoints, like the RPCs of the gRPC server, so that authentication, limits, and the run
+// registry are shared with the HTTP API.
+type jsonRPCConn struct {
+	s *server
+	// caller is the HTTP request that the messages came in, whose credentials and session are used. It is nil for stdio.
+	caller *http.Request
+	// apiKey is the API key that the requests of a connection without a caller are authenticated with, if it is set.
+	apiKey string
+	// send sends a message to the client. It is safe to call concurrently.
+	send func(v any)
+	// batchStreams is true if streams can be in a batch, which they can't over HTTP, since the response to a batch is a single
+	// JSON array.
+	batchStreams bool
+	// rpc is true if the connection serves the parse, exec, stream, and cancel methods, and mcp is true if it serves the methods of
+	// MCP while MCP is enabled.
+	rpc bool
+	mcp bool
+
+	lock sync.Mutex
+	// inFlight are the cancel functions of the requests that are in progress, by their ID.
+	inFlight map[string]context.CancelFunc
+}
+
+func newJSONRPCConn(s *server, caller *http.Request, apiKey string, send func(v any)) *jsonRPCConn {
+	return &jsonRPCConn{s: s, caller: caller, apiKey: apiKey, send: send, inFlight: make(map[string]context.CancelFunc)}
+}
+
+// serve handles a message, which is either a request or a batch of them, and returns the response to send, or nil if there is
+// none because the message only had notifications.
+func (c *jsonRPCConn) serve(ctx context.Context, msg []byte) any {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) == 0 || msg[0] != '[' {
+		req, jErr := decodeJSONRPCRequest(msg)
+		if jErr != nil {
+			return &jsonRPCResponse{JSONRPC: jsonRPCVersion, ID: jsonRPCNull, Error: jErr}
+		}
+		if resp := c.handle(ctx, req, false); resp != nil {
+			return resp
+		}
+		return nil
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(msg, &batch); err != nil {
+		return &jsonRPCResponse{JSONRPC: jsonRPCVersion, ID: jsonRPCNull, Error: &jsonRPCError{Code: jsonRPCParseError, Message: err.Error()}}
+	}
+	if len(batch) == 0 {
+		return &jsonRPCResponse{JSONRPC: jsonRPCVersion, ID: jsonRPCNull, Error: &jsonRPCError{Code: jsonRPCInvalidRequest, Message: "batch must not be empty"}}
+	}
+
+	// The requests of a batch are handled concurrently, and their responses are in the order of the requests.
+	var (
+		wg        sync.WaitGroup
+		responses = make([]*jsonRPCResponse, len(batch))
+	)
+	for i, raw := range batch {
+		req, jErr := decodeJSONRPCRequest(raw)
+		if jErr != nil {
+			responses[i] = &jsonRPCResponse{JSONRPC: jsonRPCVersion, ID: jsonRPCNull, Error: jErr}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = c.handle(ctx, req, true)
+		}()
+	}
+	wg.Wait()
+
+	result := make([]*jsonRPCResponse, 0, len(responses))
+	for _, resp := range responses {
+		if resp != nil {
+			result = append(result, resp)
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func decodeJSONRPCRequest(msg []byte) (*jsonRPCRequest, *jsonRPCError) {
+	if !json.Valid(msg) {
+		return nil, &jsonRPCError{Code: jsonRPCParseError, Message: "message is not valid JSON"}
+	}
+
+	req := new(jsonRPCRequest)
+	if err := json.Unmarshal(msg, req); err != nil {
+		return nil, &jsonRPCError{Code: jsonRPCInvalidRequest, Message: err.Error()}
+	}
+	if jErr := req.validate(); jErr != nil {
+		return nil, jErr
+	}
+	return req, nil
+}
+
+// handle calls the method of the request, and returns its response, or nil if the request is a notification or a response.
+func (c *jsonRPCConn) handle(ctx context.Context, req *jsonRPCRequest, inBatch bool) *jsonRPCResponse {
+	if req.isResponse() {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if !req.isNotification() {
+		id := string(bytes.TrimSpace(req.ID))
+		c.lock.Lock()
+		c.inFlight[id] = cancel
+		c.lock.Unlock()
+
+		defer func() {
+			c.lock.Lock()
+			delete(c.inFlight, id)
+			c.lock.Unlock()
+		}()
+	}
+
+	var (
+		result json.RawMessage
+		err    error
+	)
+	if inBatch && req.Method == "stream" && !c.batchStreams {
+		err = &jsonRPCError{Code: jsonRPCInvalidRequest, Message: "streams can't be in a batch over HTTP"}
+	} else {
+		result, err = c.call(ctx, req)
+	}
+	if ctx.Err() != nil {
+		err = &jsonRPCError{Code: jsonRPCRequestCanceled, Message: "request was canceled"}
+	}
+
+	if req.isNotification() {
+		if err != nil {
+			ccontext.GetLogger(ctx).Debug("JSON-RPC notification failed", "method", req.Method, "error", err)
+		}
+		return nil
+	}
+
+	resp := &jsonRPCResponse{JSONRPC: jsonRPCVersion, ID: req.ID, Result: result}
+	if err != nil {
+		resp.Result = nil
+		if !errors.As(err, &resp.Error) {
+			resp.Error = &jsonRPCError{Code: jsonRPCInternalError, Message: err.Error()}
+		}
+	}
+	return resp
+}
+
+// call calls the method of the request, and returns its result.
+func (c *jsonRPCConn) call(ctx context.Context, req *jsonRPCRequest) (json.RawMessage, error) {
+	if c.mcp && c.s.current().config.MCP {
+		if result, ok, err := c.callMCP(ctx, req); ok {
+			return result, err
+		}
+	}
+	if !c.rpc {
+		return nil, &jsonRPCError{Code: jsonRPCMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)}
+	}
+
+	switch req.Method {
+	case "parse":
+		if !isJSONObject(req.Params) {
+			return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: "params must be the body of a parse request"}
+		}
+		return c.do(ctx, http.MethodPost, "/parse", req.Params)
+	case "exec":
+		path, body, err := jsonRPCExecPath(req.Params, "/run-tool", "/run-file")
+		if err != nil {
+			return nil, err
+		}
+		return c.do(ctx, http.MethodPost, path, body)
+	case "stream":
+		path, body, err := jsonRPCExecPath(req.Params, "/run-tool-stream", "/run-file-stream")
+		if err != nil {
+			return nil, err
+		}
+		return c.stream(ctx, req.ID, path, body)
+	case "cancel":
+		return c.cancel(ctx, req.Params)
+	default:
+		return nil, &jsonRPCError{Code: jsonRPCMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)}
+	}
+}
+
+// jsonRPCExecPath returns the path of the HTTP endpoint for the params of an exec or stream request, and the body to send to it.
+func jsonRPCExecPath(params json.RawMessage, toolPath, filePath string) (string, []byte, error) {
+	p := new(jsonRPCExecParams)
+	if err := json.Unmarshal(params, p); err != nil || !isJSONObject(params) {
+		return "", nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: "params must be an object with a tool or a file"}
+	}
+
+	var (
+		path string
+		body []byte
+	)
+	switch {
+	case len(p.Tool) > 0 && len(p.File) == 0:
+		path, body = toolPath, p.Tool
+	case len(p.File) > 0 && len(p.Tool) == 0:
+		path, body = filePath, p.File
+	default:
+		return "", nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: "exactly one of tool or file is required"}
+	}
+	if p.Events && strings.HasSuffix(path, "-stream") {
+		path += "-with-events"
+	}
+	return path, body, nil
+}
+
+// stream runs the stream at the path, sending each of its events to the client as a notification, and returns the ID of the run
+// once the stream has ended.
+func (c *jsonRPCConn) stream(ctx context.Context, id json.RawMessage, path string, body []byte) (json.RawMessage, error) {
+	var w *internalResponseWriter
+	w = newInternalResponseWriter(func(line []byte) {
+		c.send(jsonRPCNotification{
+			JSONRPC: jsonRPCVersion,
+			Method:  jsonRPCEventMethod,
+			Params:  jsonRPCEvent{RequestID: id, RunID: w.header.Get(runIDHeader), Event: line},
+		})
+	})
+
+	c.s.handler.ServeHTTP(w, c.newRequest(ctx, http.MethodPost, path, body))
+	if err := jsonRPCErr(w); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonRPCStreamResult{RunID: w.header.Get(runIDHeader)})
+}
+
+// cancel cancels a run by its ID, or a request of the connection, which cancels its run too.
+func (c *jsonRPCConn) cancel(ctx context.Context, params json.RawMessage) (json.RawMessage, error) {
+	p := new(jsonRPCCancelParams)
+	if err := json.Unmarshal(params, p); err != nil || (p.RunID == "") == (len(p.RequestID) == 0) {
+		return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: "exactly one of runId or requestId is required"}
+	}
+
+	if p.RunID != "" {
+		return c.do(ctx, http.MethodDelete, "/runs/"+url.PathEscape(p.RunID), nil)
+	}
+
+	if !c.cancelRequest(p.RequestID) {
+		return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: fmt.Sprintf("request %s is not in progress", p.RequestID)}
+	}
+	return json.Marshal(map[string]string{"status": "ok"})
+}
+
+// cancelRequest cancels the request of the connection with the ID, and reports whether it was in progress.
+func (c *jsonRPCConn) cancelRequest(id json.RawMessage) bool {
+	c.lock.Lock()
+	cancel, ok := c.inFlight[string(bytes.TrimSpace(id))]
+	c.lock.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// do sends the body to the HTTP endpoint at the path, and returns its response.
+func (c *jsonRPCConn) do(ctx context.Context, method, path string, body []byte) (json.RawMessage, error) {
+	w := newInternalResponseWriter(nil)
+	c.s.handler.ServeHTTP(w, c.newRequest(ctx, method, path, body))
+	if err := jsonRPCErr(w); err != nil {
+		return nil, err
+	}
+
+	if !json.Valid(w.body.Bytes()) {
+		return nil, &jsonRPCError{Code: jsonRPCInternalError, Message: fmt.Sprintf("response of %s is not valid JSON", path)}
+	}
+	return bytes.TrimSpace(w.body.Bytes()), nil
+}
+
+// newRequest creates the HTTP request for a method, with the credentials and the session of the caller, or with the API key of
+// the connection if it has no caller.
+func (c *jsonRPCConn) newRequest(ctx context.Context, method, path string, body []byte) *http.Request {
+	r := newInternalRequest(ctx, c.caller, method, path, body)
+	if c.caller == nil {
+		if c.apiKey != "" {
+			r.Header.Set("Authorization", "Bearer "+c.apiKey)
+		}
+		r.RemoteAddr = jsonRPCStdioRemoteAddr
+	}
+	return r
+}
+
+func isJSONObject(b json.RawMessage) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) > 0 && b[0] == '{'
+}
+
+// jsonrpc serves JSON-RPC 2.0 over HTTP. The response to a stream is newline-delimited JSON, with a notification for each event
+// of the stream and the response to the request last. Other requests and batches are answered with a single JSON response, or
+// with status 204 if they only had notifications.
+func (s *server) jsonrpc(w http.ResponseWriter, r *http.Request) {
+	if !s.current().config.JSONRPC {
+		writeError(w, http.StatusNotFound, errors.New("the JSON-RPC API is disabled"))
+		return
+	}
+
+	msg, ok := readJSONRPCMessage(w, r)
+	if !ok {
+		return
+	}
+
+	var (
+		l         = ccontext.GetLogger(r.Context())
+		lock      sync.Mutex
+		streaming bool
+	)
+	send := func(v any) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if !streaming {
+			streaming = true
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Accel-Buffering", "no")
+		}
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			l.Debug("failed to write JSON-RPC message", "error", err)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	c := newJSONRPCConn(s, r, "", send)
+	c.rpc = true
+
+	resp := c.serve(r.Context(), msg)
+	switch {
+	case streaming:
+		if resp != nil {
+			send(resp)
+		}
+	case resp == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeResponse(w, resp)
+	}
+}
+
+// readJSONRPCMessage reads the message in the body of the request. If it can't be read, then the error is written, and false is
+// returned.
+func readJSONRPCMessage(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	msg, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body must be at most %d bytes", maxErr.Limit))
+		} else {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to read request: %w", err))
+		}
+		return nil, false
+	}
+	return msg, true
+}
+
+// serveJSONRPCStdio serves JSON-RPC 2.0 on r and w, one message per line, until r is closed or the context is done. The methods of
+// MCP are served too while MCP is enabled, so that the server can be started as an MCP server by MCP clients. Messages are handled
+// concurrently, so that a stream can be canceled while it is in progress. The requests that are in progress when r is closed are
+// answered before it returns, so that clients can write their requests and close stdin right away.
+func (s *server) serveJSONRPCStdio(ctx context.Context, r io.Reader, w io.Writer, apiKey string) {
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+		enc  = json.NewEncoder(w)
+	)
+	c := newJSONRPCConn(s, nil, apiKey, func(v any) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if err := enc.Encode(v); err != nil {
+			slog.Debug("failed to write JSON-RPC message to stdout", "error", err)
+		}
+	})
+	c.batchStreams, c.rpc, c.mcp = true, true, true
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), int(s.limits().bodyLimit(bodyJSON)))
+	for scanner.Scan() {
+		msg := bytes.Clone(scanner.Bytes())
+		if len(bytes.TrimSpace(msg)) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := c.serve(ctx, msg); resp != nil {
+				c.send(resp)
+			}
+		}()
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("Failed to read JSON-RPC messages from stdin", "error", err)
+	}
+
+	wg.Wait()
+}
+
+// jsonRPCErr returns the error of the response to an internal request, or nil if it succeeded.
+func jsonRPCErr(w *internalResponseWriter) error {
+	resp, failed := w.failed()
+	if !failed {
+		return nil
+	}
+	return &jsonRPCError{
+		Code:    jsonRPCServerError,
+		Message: resp.Error,
+		Data:    &jsonRPCErrorData{Status: w.code, Code: resp.Code, Field: resp.Field, RequestID: resp.RequestID},
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+const (
+	defaultJWTScopeClaim     = "scope"
+	defaultJWTToolPathsClaim = "tool_paths"
+	defaultJWTTenantClaim    = "tenant"
+)
+
+// JWTConfig configures the validation of JWTs passed as bearer tokens, and how their claims map to what the caller can do.
+type JWTConfig struct {
+	// Secret is the shared secret for HMAC signed tokens, and JWKSURL is the URL of the keys for tokens signed with public key algorithms.
+	Secret  string
+	JWKSURL string
+
+	// Issuer and Audience, if set, must match the claims of the token.
+	Issuer   string
+	Audience string
+
+	// ScopeClaim is the claim with the space-separated scopes of the caller, and the highest known scope is granted.
+	// ToolPathsClaim is the claim with the list of file path patterns the caller is allowed to run. If the claim is not in the
+	// token, then the caller can run any tool.
+	// TenantClaim is the claim with the tenant of the caller. If the claim is not in the token, then the caller is in the default
+	// tenant.
+	ScopeClaim     string
+	ToolPathsClaim string
+	TenantClaim    string
+}
+
+// jwtAuthenticator authenticates requests with JWTs passed as bearer tokens.
+type jwtAuthenticator struct {
+	secret         []byte
+	jwks           keyfunc.Keyfunc
+	parser         *jwt.Parser
+	scopeClaim     string
+	toolPathsClaim string
+	tenantClaim    string
+}
+
+// newJWTAuthenticator creates an authenticator from the config. The JWKS, if configured, is refreshed in the background until the context is canceled.
+func newJWTAuthenticator(ctx context.Context, config JWTConfig) (*jwtAuthenticator, error) {
+	a := &jwtAuthenticator{
+		secret:         []byte(config.Secret),
+		scopeClaim:     config.ScopeClaim,
+		toolPathsClaim: config.ToolPathsClaim,
+		tenantClaim:    config.TenantClaim,
+	}
+
+	if a.scopeClaim == "" {
+		a.scopeClaim = defaultJWTScopeClaim
+	}
+	if a.toolPathsClaim == "" {
+		a.toolPathsClaim = defaultJWTToolPathsClaim
+	}
+	if a.tenantClaim == "" {
+		a.tenantClaim = defaultJWTTenantClaim
+	}
+
+	var methods []string
+	if config.Secret != "" {
+		methods = append(methods, "HS256", "HS384", "HS512")
+	}
+	if config.JWKSURL != "" {
+		jwks, err := keyfunc.NewDefaultCtx(ctx, []string{config.JWKSURL})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get JWKS: %w", err)
+		}
+
+		a.jwks = jwks
+		methods = append(methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA")
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired()}
+	if config.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		opts = append(opts, jwt.WithAudience(config.Audience))
+	}
+	a.parser = jwt.NewParser(opts...)
+
+	return a, nil
+}
+
+func (a *jwtAuthenticator) authenticate(r *http.Request) (*ccontext.Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil
+	}
+
+	// Only tokens that have the shape of a JWT are meant for this authenticator.
+	if strings.Count(token, ".") != 2 {
+		return nil, errUnrecognizedCredentials
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.key); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+
+	id := &ccontext.Identity{
+		Scope: scopeNone.String(),
+	}
+	id.Name, _ = claims.GetSubject()
+
+	if scopes, ok := claims[a.scopeClaim].(string); ok {
+		var granted scope
+		for _, s := range strings.Fields(scopes) {
+			if parsed, err := parseScope(s); err == nil && parsed > granted {
+				granted = parsed
+			}
+		}
+		id.Scope = granted.String()
+	}
+
+	if paths, ok := claims[a.toolPathsClaim]; ok {
+		list, ok := paths.([]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid token: %s claim must be a list", a.toolPathsClaim)
+		}
+
+		id.AllowedToolPaths = make([]string, 0, len(list))
+		for _, p := range list {
+			id.AllowedToolPaths = append(id.AllowedToolPaths, fmt.Sprint(p))
+		}
+	}
+
+	if tenant, ok := claims[a.tenantClaim]; ok {
+		id.Tenant, ok = tenant.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid token: %s claim must be a string", a.tenantClaim)
+		}
+		if err := validateTenant(id.Tenant); err != nil {
+			return nil, fmt.Errorf("invalid token: %w", err)
+		}
+	}
+
+	return id, nil
+}
+
+// key returns the key to verify the token with, based on its signing method.
+func (a *jwtAuthenticator) key(token *jwt.Token) (any, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return a.secret, nil
+	}
+
+	if a.jwks == nil {
+		return nil, errors.New("no JWKS configured")
+	}
+	return a.jwks.Keyfunc(token)
+}
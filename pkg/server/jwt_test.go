@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testJWTSecret = "test-secret"
+
+func TestJWTAuthenticate(t *testing.T) {
+	a, err := newJWTAuthenticator(context.Background(), JWTConfig{Secret: testJWTSecret, Issuer: "issuer", Audience: "clicky"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func(extra jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{"sub": "alice", "iss": "issuer", "aud": "clicky", "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range extra {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name          string
+		token         string
+		wantScope     string
+		wantTenant    string
+		wantToolPaths []string
+		wantErr       bool
+	}{
+		{
+			name:      "no scope claim",
+			token:     signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(nil)),
+			wantScope: "none",
+		},
+		{
+			name:      "highest known scope is granted",
+			token:     signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(jwt.MapClaims{"scope": "openid parse admin exec"})),
+			wantScope: "admin",
+		},
+		{
+			name:      "unknown scopes are ignored",
+			token:     signHMAC(t, jwt.SigningMethodHS384, testJWTSecret, valid(jwt.MapClaims{"scope": "root parse"})),
+			wantScope: "parse",
+		},
+		{
+			name:          "tool paths and tenant",
+			token:         signHMAC(t, jwt.SigningMethodHS512, testJWTSecret, valid(jwt.MapClaims{"scope": "exec", "tool_paths": []string{"/tools/*"}, "tenant": "acme"})),
+			wantScope:     "exec",
+			wantTenant:    "acme",
+			wantToolPaths: []string{"/tools/*"},
+		},
+		{
+			name:    "tool paths that aren't a list",
+			token:   signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(jwt.MapClaims{"tool_paths": "/tools/*"})),
+			wantErr: true,
+		},
+		{
+			name:    "tenant that isn't a string",
+			token:   signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(jwt.MapClaims{"tenant": 1})),
+			wantErr: true,
+		},
+		{
+			name:    "invalid tenant",
+			token:   signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(jwt.MapClaims{"tenant": "../other"})),
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			token:   signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})),
+			wantErr: true,
+		},
+		{
+			name:    "no expiry",
+			token:   signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(jwt.MapClaims{"exp": nil})),
+			wantErr: true,
+		},
+		{
+			name:    "not valid yet",
+			token:   signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()})),
+			wantErr: true,
+		},
+		{
+			name:    "wrong issuer",
+			token:   signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(jwt.MapClaims{"iss": "other"})),
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			token:   signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(jwt.MapClaims{"aud": "other"})),
+			wantErr: true,
+		},
+		{
+			name:    "wrong secret",
+			token:   signHMAC(t, jwt.SigningMethodHS256, "other-secret", valid(nil)),
+			wantErr: true,
+		},
+		{
+			name:    "unsigned",
+			token:   signNone(t, valid(jwt.MapClaims{"scope": "admin"})),
+			wantErr: true,
+		},
+		{
+			name:    "public key algorithm without a JWKS",
+			token:   signRSA(t, newRSAKey(t), "", valid(jwt.MapClaims{"scope": "admin"})),
+			wantErr: true,
+		},
+		{
+			name:    "tampered claims",
+			token:   tamper(t, signHMAC(t, jwt.SigningMethodHS256, testJWTSecret, valid(jwt.MapClaims{"scope": "parse"})), jwt.MapClaims{"scope": "admin"}),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.authenticate(requestWithToken(tt.token))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got identity %v", id)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if id.Name != "alice" {
+				t.Errorf("got name %q, want alice", id.Name)
+			}
+			if id.Scope != tt.wantScope {
+				t.Errorf("got scope %q, want %q", id.Scope, tt.wantScope)
+			}
+			if id.Tenant != tt.wantTenant {
+				t.Errorf("got tenant %q, want %q", id.Tenant, tt.wantTenant)
+			}
+			if !slices.Equal(id.AllowedToolPaths, tt.wantToolPaths) {
+				t.Errorf("got tool paths %v, want %v", id.AllowedToolPaths, tt.wantToolPaths)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticateUnrecognized(t *testing.T) {
+	a, err := newJWTAuthenticator(context.Background(), JWTConfig{Secret: testJWTSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := a.authenticate(requestWithToken("")); id != nil || err != nil {
+		t.Errorf("got identity %v and error %v for a request without credentials, want neither", id, err)
+	}
+	// API keys don't look like JWTs, so they are left to the other authenticators.
+	if _, err = a.authenticate(requestWithToken("an-api-key")); err != errUnrecognizedCredentials {
+		t.Errorf("got error %v for an API key, want %v", err, errUnrecognizedCredentials)
+	}
+}
+
+func TestJWTAuthenticateJWKS(t *testing.T) {
+	key := newRSAKey(t)
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, err := newJWTAuthenticator(ctx, JWTConfig{JWKSURL: jwks.URL, ScopeClaim: "roles", TenantClaim: "org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := jwt.MapClaims{"sub": "bob", "roles": "exec", "org": "acme", "exp": time.Now().Add(time.Hour).Unix()}
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "signed with the key", token: signRSA(t, key, "test", claims)},
+		{name: "signed with another key", token: signRSA(t, newRSAKey(t), "test", claims), wantErr: true},
+		{name: "unknown key ID", token: signRSA(t, key, "other", claims), wantErr: true},
+		// Without a secret, HMAC tokens aren't accepted, even if they are signed with the public key of the JWKS.
+		{name: "HMAC with the public key", token: signHMAC(t, jwt.SigningMethodHS256, string(key.N.Bytes()), claims), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.authenticate(requestWithToken(tt.token))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got identity %v", id)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if id.Name != "bob" || id.Scope != "exec" || id.Tenant != "acme" {
+				t.Errorf("got identity %+v, want bob with the exec scope in acme", id)
+			}
+		})
+	}
+}
+
+func signHMAC(t *testing.T, method jwt.SigningMethod, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func signRSA(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func signNone(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// tamper replaces the claims of the token with the changes applied, keeping its header and signature.
+func tamper(t *testing.T, token string, changes jwt.MapClaims) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := jwt.MapClaims{}
+	if err = json.Unmarshal(b, &claims); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range changes {
+		claims[k] = v
+	}
+
+	if b, err = json.Marshal(claims); err != nil {
+		t.Fatal(err)
+	}
+	parts[1] = base64.RawURLEncoding.EncodeToString(b)
+	return strings.Join(parts, ".")
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
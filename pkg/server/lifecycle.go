@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+// lifecycleEvent returns the event of a run entering the state.
+func lifecycleEvent(state events.LifecycleState) events.Lifecycle {
+	return events.Lifecycle{Time: time.Now(), Lifecycle: state}
+}
+
+// lifecycleWriter is an eventWriter that writes a lifecycle event whenever the run enters another state: started when the run
+// starts streaming, modelCalling and toolCalling as gptscript calls the model and the tools that the model asked for, and
+// finished, canceled, or errored when the run ends. The events are written like the events of the run, so they are kept in the
+// run history too. The writes must not be concurrent, like the writes of the other event writers.
+type lifecycleWriter struct {
+	eventWriter
+	ctx    context.Context
+	state  events.LifecycleState
+	failed bool
+}
+
+func newLifecycleWriter(ctx context.Context, w eventWriter) *lifecycleWriter {
+	l := &lifecycleWriter{eventWriter: w, ctx: ctx}
+	l.enter(events.LifecycleStarted)
+	return l
+}
+
+func (l *lifecycleWriter) writeEvent(event any) {
+	switch e := event.(type) {
+	case events.Call:
+		switch e.Type {
+		case events.TypeCallChat, events.TypeCallContinue:
+			l.enter(events.LifecycleModelCalling)
+		case events.TypeCallSubCalls:
+			l.enter(events.LifecycleToolCalling)
+		}
+	case events.Error:
+		l.failed = true
+	}
+
+	l.eventWriter.writeEvent(event)
+}
+
+// finish writes the state that the run ended in before finishing the stream. A run whose context was canceled was canceled, even
+// though the error that its process exited with was written too.
+func (l *lifecycleWriter) finish() {
+	switch {
+	case errors.Is(l.ctx.Err(), context.Canceled):
+		l.enter(events.LifecycleCanceled)
+	case l.failed:
+		l.enter(events.LifecycleErrored)
+	default:
+		l.enter(events.LifecycleFinished)
+	}
+
+	l.eventWriter.finish()
+}
+
+func (l *lifecycleWriter) enter(state events.LifecycleState) {
+	if l.state == state {
+		return
+	}
+
+	l.state = state
+	l.eventWriter.writeEvent(lifecycleEvent(state))
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// queueRetryAfter is the number of seconds a client is asked to wait before retrying when the run queue is full.
+const queueRetryAfter = "10"
+
+var (
+	errQueueFull = errors.New("too many runs in progress, try again later")
+	errPreempted = errors.New("the run was preempted by a run with a higher priority")
+)
+
+// QueueConfig configures how the slots of the run limiter are shared between clients and tenants, so that one that queues many runs
+// can't starve the others.
+type QueueConfig struct {
+	// ClientWeights are the weights of clients, by the name of the client, which default to 1. Queued runs of the same priority are
+	// started in turns between their clients, with each client getting turns in proportion to its weight, instead of in the order
+	// that they were queued.
+	ClientWeights map[string]int
+	// TenantMaxConcurrentRuns is the number of runs of each tenant that can execute at the same time, with 0 meaning no limit, and
+	// TenantLimits are the limits of tenants that have limits of their own, by the name of the tenant. The runs of a tenant that is
+	// at its limit wait in the queue, even if there are free slots.
+	TenantMaxConcurrentRuns int
+	TenantLimits            map[string]int
+}
+
+func (c QueueConfig) validate() error {
+	for client, weight := range c.ClientWeights {
+		if weight < 1 {
+			return fmt.Errorf("weight of client %q must be at least 1", client)
+		}
+	}
+	if c.TenantMaxConcurrentRuns < 0 {
+		return errors.New("tenant max concurrent runs must not be negative")
+	}
+	for tenant, limit := range c.TenantLimits {
+		if err := validateTenant(tenant); err != nil {
+			return err
+		}
+		if limit < 0 {
+			return fmt.Errorf("limit of tenant %q must not be negative", tenant)
+		}
+	}
+	return nil
+}
+
+// runLimiter limits the number of runs that are executed at the same time, in total and for each tenant. Runs that exceed a limit
+// wait in a bounded queue, ordered by their priority, so that runs with a higher priority start first. Runs of the same priority
+// are ordered by start-time fair queuing between their clients: each run is tagged with the virtual time at which its client's
+// turn comes, which advances by the inverse of the weight of the client with each of its runs, so that a client that queues many
+// runs only gets its share of the turns.
+type runLimiter struct {
+	lock     sync.Mutex
+	max      int
+	maxQueue int
+	// preempt means that a queued run cancels a running run with a lower priority, so that it gets its slot.
+	preempt bool
+	// running are the runs that hold a slot, in the order that they started, and tenantRunning are how many of them each tenant
+	// has.
+	running       []*limitedRun
+	tenantRunning map[string]int
+	queue         []*limitedRun
+	// vtime is the virtual time, which is the tag of the latest run to start, and finish are the virtual times at which the next
+	// turn of each client comes. Clients whose next turn has come are removed from finish.
+	vtime  float64
+	finish map[string]float64
+}
+
+// limitedRun is a run that waits in the queue of the limiter, and then holds a slot.
+type limitedRun struct {
+	priority int
+	// client is who the run is queued for, weight is the weight of the client, and tag is the virtual time of the turn of the run.
+	client string
+	weight int
+	tag    float64
+	// tenant is the tenant of the run, and tenantMax is the number of runs of the tenant that can run at once, 0 meaning no limit.
+	tenant    string
+	tenantMax int
+	// ready is closed when the run can start.
+	ready chan struct{}
+	// position receives the position of the run in the queue, starting at 1, whenever it changes.
+	position chan int
+	// preempt cancels the run, so that its slot is given to a run with a higher priority. The run releases its slot once it has
+	// ended. preempted is set once it has been called.
+	preempt   func()
+	preempted bool
+}
+
+// newRunLimiter creates a limiter that allows max concurrent runs and maxQueue waiting runs. If max is 0, then runs are only
+// limited by the limits of their tenants.
+func newRunLimiter(max, maxQueue int) *runLimiter {
+	return &runLimiter{max: max, maxQueue: maxQueue, tenantRunning: make(map[string]int), finish: make(map[string]float64)}
+}
+
+// acquire waits until the run can start, calling onQueued with the position of the run in the queue whenever it changes. The run
+// has the priority, client, weight, tenant, tenant limit, and preempt function of the run; the rest is set by the limiter. If
+// preemption is enabled, then preempt is called to cancel the run once a run with a higher priority needs its slot.
+// The returned function must be called when the run has finished. If the queue is full, then errQueueFull is returned immediately.
+func (rl *runLimiter) acquire(ctx context.Context, q *limitedRun, onQueued func(position int)) (func(), error) {
+	rl.lock.Lock()
+	if rl.max <= 0 && q.tenantMax <= 0 {
+		rl.lock.Unlock()
+		return func() {}, nil
+	}
+
+	release := func() {
+		rl.release(q)
+	}
+
+	// Every run takes a turn of its client, even if it starts right away, so that the clients that have had the most runs wait the
+	// longest once runs are queued.
+	q.tag = max(rl.vtime, rl.finish[q.client])
+	rl.finish[q.client] = q.tag + 1/float64(max(q.weight, 1))
+
+	// A run only starts right away if there is a free slot for it, which means that every queued run is waiting for its tenant.
+	if rl.free() && !rl.tenantFull(q) {
+		rl.start(q)
+		rl.lock.Unlock()
+		return release, nil
+	}
+
+	if len(rl.queue) >= rl.maxQueue {
+		rl.lock.Unlock()
+		return nil, errQueueFull
+	}
+
+	q.ready, q.position = make(chan struct{}), make(chan int, 1)
+	i := slices.IndexFunc(rl.queue, func(other *limitedRun) bool {
+		return other.priority < q.priority || (other.priority == q.priority && other.tag > q.tag)
+	})
+	if i < 0 {
+		i = len(rl.queue)
+	}
+	rl.queue = slices.Insert(rl.queue, i, q)
+	rl.notify(i)
+	victim := rl.victim(i)
+	rl.lock.Unlock()
+
+	if victim != nil {
+		victim.preempt()
+	}
+
+	for {
+		select {
+		case <-q.ready:
+			return release, nil
+		case p := <-q.position:
+			if onQueued != nil {
+				onQueued(p)
+			}
+		case <-ctx.Done():
+			rl.lock.Lock()
+			defer rl.lock.Unlock()
+
+			select {
+			case <-q.ready:
+				// The run was given a slot at the same time as the context was canceled, so give it back.
+				rl.releaseLocked(q)
+			default:
+				rl.remove(q)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// free reports whether a slot is free. The lock must be held by the caller.
+func (rl *runLimiter) free() bool {
+	return rl.max <= 0 || len(rl.running) < rl.max
+}
+
+// tenantFull reports whether the tenant of the run is at its limit. The lock must be held by the caller.
+func (rl *runLimiter) tenantFull(q *limitedRun) bool {
+	return q.tenantMax > 0 && rl.tenantRunning[q.tenant] >= q.tenantMax
+}
+
+// victim returns the running run that the queued run at index i preempts, which is the running run with the lowest priority that
+// is lower than the priority of the queued run, and the latest to start of those, so that the least work is lost. Nothing is
+// preempted if preemption is disabled, if the runs that were already preempted free up enough slots for the runs up to the queued
+// run, or if the tenant of the queued run is at its limit, so that a free slot wouldn't start it. The victim is marked as
+// preempted, and must be preempted once the lock is released. The lock must be held by the caller.
+func (rl *runLimiter) victim(i int) *limitedRun {
+	if !rl.preempt {
+		return nil
+	}
+
+	var (
+		victim    *limitedRun
+		preempted int
+	)
+	for j := len(rl.running) - 1; j >= 0; j-- {
+		if r := rl.running[j]; r.preempted {
+			preempted++
+		} else if r.preempt != nil && r.priority < rl.queue[i].priority && (victim == nil || r.priority < victim.priority) {
+			victim = r
+		}
+	}
+	if victim == nil || preempted > i || rl.tenantFull(rl.queue[i]) {
+		return nil
+	}
+
+	victim.preempted = true
+	return victim
+}
+
+// queueStats are the limits of the run limiter, and how much of them is in use.
+type queueStats struct {
+	// Active is the number of runs that hold a slot, and Queued is the number of runs waiting for one.
+	Active        int `json:"active"`
+	Queued        int `json:"queued"`
+	MaxConcurrent int `json:"maxConcurrent"`
+	MaxQueued     int `json:"maxQueued"`
+	// TenantActive is the number of runs of each tenant that hold a slot.
+	TenantActive map[string]int `json:"tenantActive,omitempty"`
+}
+
+func (rl *runLimiter) stats() queueStats {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return queueStats{Active: len(rl.running), Queued: len(rl.queue), MaxConcurrent: rl.max, MaxQueued: rl.maxQueue, TenantActive: maps.Clone(rl.tenantRunning)}
+}
+
+// saturated reports whether the queue is full, so that new runs would be rejected.
+func (rl *runLimiter) saturated() bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.max > 0 && len(rl.running) >= rl.max && len(rl.queue) >= rl.maxQueue
+}
+
+// setLimits changes the limits, starting as many queued runs as the new limit allows. Runs that are queued beyond the new queue
+// size keep waiting, and runs that started while runs were not limited are not counted against a new limit.
+func (rl *runLimiter) setLimits(max, maxQueue int, preempt bool) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	rl.max, rl.maxQueue, rl.preempt = max, maxQueue, preempt
+	rl.dispatch()
+}
+
+func (rl *runLimiter) release(q *limitedRun) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.releaseLocked(q)
+}
+
+// releaseLocked gives the slot of a finished run to the queued runs. The lock must be held by the caller.
+// If the limit was lowered while runs were active, then the slot is only given away once the active runs are within the limit.
+func (rl *runLimiter) releaseLocked(q *limitedRun) {
+	i := slices.Index(rl.running, q)
+	if i < 0 {
+		return
+	}
+
+	rl.running = slices.Delete(rl.running, i, i+1)
+	if rl.tenantRunning[q.tenant]--; rl.tenantRunning[q.tenant] <= 0 {
+		delete(rl.tenantRunning, q.tenant)
+	}
+	rl.dispatch()
+}
+
+// dispatch starts the queued runs, in the order of the queue, while there are free slots, skipping the runs whose tenants are at
+// their limits. The lock must be held by the caller.
+func (rl *runLimiter) dispatch() {
+	for i := 0; i < len(rl.queue) && rl.free(); {
+		if q := rl.queue[i]; rl.tenantFull(q) {
+			i++
+		} else {
+			close(q.ready)
+			rl.remove(q)
+			rl.start(q)
+		}
+	}
+}
+
+// start gives a slot to the run, and advances the virtual time to its turn. The lock must be held by the caller.
+func (rl *runLimiter) start(q *limitedRun) {
+	rl.running = append(rl.running, q)
+	rl.tenantRunning[q.tenant]++
+
+	rl.vtime = max(rl.vtime, q.tag)
+	for client, finish := range rl.finish {
+		if finish <= rl.vtime {
+			delete(rl.finish, client)
+		}
+	}
+}
+
+// remove removes the run from the queue and notifies the runs behind it of their new positions. The lock must be held by the caller.
+func (rl *runLimiter) remove(q *limitedRun) {
+	i := slices.Index(rl.queue, q)
+	if i < 0 {
+		return
+	}
+
+	rl.queue = slices.Delete(rl.queue, i, i+1)
+	rl.notify(i)
+}
+
+// notify notifies the runs of the queue from index i of their positions. The lock must be held by the caller.
+func (rl *runLimiter) notify(i int) {
+	for j := i; j < len(rl.queue); j++ {
+		// Only the latest position matters, so replace any position that hasn't been received yet.
+		select {
+		case <-rl.queue[j].position:
+		default:
+		}
+		rl.queue[j].position <- j + 1
+	}
+}
+
+type runPriorityKey struct{}
+
+// withRunPriority sets the priority that the run asked for.
+func withRunPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, runPriorityKey{}, priority)
+}
+
+// limitedRun returns how the run of the context, of the tenant, is queued by the run limiter.
+func (s *server) limitedRun(ctx context.Context, tenant string) *limitedRun {
+	config := s.current().config
+	client := usageClient(ctx)
+
+	weight, ok := config.Queue.ClientWeights[client]
+	if !ok {
+		weight = 1
+	}
+	tenantMax, ok := config.Queue.TenantLimits[tenant]
+	if !ok {
+		tenantMax = config.Queue.TenantMaxConcurrentRuns
+	}
+
+	return &limitedRun{priority: s.runPriority(ctx), client: client, weight: weight, tenant: tenant, tenantMax: tenantMax}
+}
+
+// runPriority returns the priority of the run of the context in the run queue, which is the priority of its client, or the
+// priority that the run asked for if it is lower.
+func (s *server) runPriority(ctx context.Context) int {
+	config := s.current().config
+	priority := config.RunPriority
+	if p, ok := config.ClientRunPriorities[usageClient(ctx)]; ok {
+		priority = p
+	}
+	if requested, ok := ctx.Value(runPriorityKey{}).(int); ok {
+		return min(requested, priority)
+	}
+	return priority
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acquireResult is the outcome of acquiring a slot of a run limiter in the background.
+type acquireResult struct {
+	release func()
+	err     error
+}
+
+// acquireQueued acquires a slot for the run in the background, and waits until the run holds a slot or is queued.
+func acquireQueued(t *testing.T, ctx context.Context, rl *runLimiter, q *limitedRun, onQueued func(int)) <-chan acquireResult {
+	t.Helper()
+
+	result := make(chan acquireResult, 1)
+	go func() {
+		release, err := rl.acquire(ctx, q, onQueued)
+		result <- acquireResult{release: release, err: err}
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		rl.lock.Lock()
+		waiting := slices.Contains(rl.queue, q) || slices.Contains(rl.running, q)
+		rl.lock.Unlock()
+		if waiting {
+			return result
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("run of %s was neither started nor queued", q.client)
+		}
+	}
+}
+
+// mustAcquire acquires a slot for the run, which must start right away.
+func mustAcquire(t *testing.T, rl *runLimiter, q *limitedRun) func() {
+	t.Helper()
+
+	release, err := rl.acquire(context.Background(), q, nil)
+	if err != nil {
+		t.Fatalf("run of %s didn't start: %v", q.client, err)
+	}
+	return release
+}
+
+// waitStarted waits until the run that was queued has a slot.
+func waitStarted(t *testing.T, result <-chan acquireResult) func() {
+	t.Helper()
+
+	select {
+	case r := <-result:
+		if r.err != nil {
+			t.Fatalf("run didn't start: %v", r.err)
+		}
+		return r.release
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't start")
+		return nil
+	}
+}
+
+// assertWaiting fails if the run that was queued has a slot, or failed to get one.
+func assertWaiting(t *testing.T, result <-chan acquireResult) {
+	t.Helper()
+
+	select {
+	case r := <-result:
+		t.Fatalf("run stopped waiting, with error %v", r.err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRunLimiterFairness(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		// queued are the clients of the runs in the order that they are queued, while a run of heavy holds the only slot.
+		queued []string
+		want   []string
+	}{
+		{
+			name:   "light client queued last starts first",
+			queued: []string{"heavy", "heavy", "heavy", "heavy", "light"},
+			want:   []string{"light", "heavy", "heavy", "heavy", "heavy"},
+		},
+		{
+			name:   "equal weights take turns",
+			queued: []string{"heavy", "heavy", "heavy", "heavy", "light", "light"},
+			want:   []string{"light", "heavy", "light", "heavy", "heavy", "heavy"},
+		},
+		{
+			name:    "weights share turns in proportion",
+			weights: map[string]int{"heavy": 2},
+			queued:  []string{"heavy", "heavy", "heavy", "heavy", "light", "light"},
+			want:    []string{"light", "heavy", "heavy", "light", "heavy", "heavy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := newRunLimiter(1, len(tt.queued))
+			run := func(client string) *limitedRun {
+				return &limitedRun{client: client, weight: max(tt.weights[client], 1)}
+			}
+
+			release := mustAcquire(t, rl, run("heavy"))
+
+			// Each run reports that it started, and then releases its slot, so that the runs start one at a time in the order of the
+			// queue.
+			started := make(chan string)
+			for _, client := range tt.queued {
+				result := acquireQueued(t, context.Background(), rl, run(client), nil)
+				go func() {
+					r := <-result
+					if r.err == nil {
+						started <- client
+						r.release()
+					}
+				}()
+			}
+			release()
+
+			var got []string
+			for range tt.queued {
+				select {
+				case client := <-started:
+					got = append(got, client)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("only %v started", got)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("runs started in the order %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunLimiterTenantLimitWithoutMax(t *testing.T) {
+	rl := newRunLimiter(0, 10)
+
+	releaseA := mustAcquire(t, rl, &limitedRun{client: "a1", tenant: "a", tenantMax: 1})
+	queuedA := acquireQueued(t, context.Background(), rl, &limitedRun{client: "a2", tenant: "a", tenantMax: 1}, nil)
+	// Other tenants aren't held back by the tenant that is at its limit, and tenants without a limit aren't limited at all.
+	releaseB := mustAcquire(t, rl, &limitedRun{client: "b1", tenant: "b", tenantMax: 1})
+	releaseC := mustAcquire(t, rl, &limitedRun{client: "c1", tenant: "c"})
+	assertWaiting(t, queuedA)
+
+	if stats := rl.stats(); stats.Active != 2 || stats.Queued != 1 || stats.TenantActive["a"] != 1 || stats.TenantActive["b"] != 1 {
+		t.Errorf("stats are %+v, want 2 active, 1 queued, and 1 active of tenants a and b", stats)
+	}
+
+	releaseA()
+	waitStarted(t, queuedA)()
+	releaseB()
+	releaseC()
+
+	if stats := rl.stats(); stats.Active != 0 || stats.Queued != 0 {
+		t.Errorf("stats are %+v, want nothing active or queued", stats)
+	}
+}
+
+func TestRunLimiterQueueFull(t *testing.T) {
+	rl := newRunLimiter(1, 1)
+
+	release := mustAcquire(t, rl, &limitedRun{client: "first"})
+	queued := acquireQueued(t, context.Background(), rl, &limitedRun{client: "second"}, nil)
+	if !rl.saturated() {
+		t.Error("limiter isn't saturated with a full queue")
+	}
+
+	if _, err := rl.acquire(context.Background(), &limitedRun{client: "third"}, nil); !errors.Is(err, errQueueFull) {
+		t.Errorf("error is %v, want %v", err, errQueueFull)
+	}
+
+	release()
+	waitStarted(t, queued)()
+	if rl.saturated() {
+		t.Error("limiter is saturated once the queue is empty")
+	}
+}
+
+func TestRunLimiterCancelQueued(t *testing.T) {
+	rl := newRunLimiter(1, 10)
+	release := mustAcquire(t, rl, &limitedRun{client: "running"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := acquireQueued(t, ctx, rl, &limitedRun{client: "canceled"}, nil)
+
+	var (
+		lock      sync.Mutex
+		positions []int
+	)
+	behind := acquireQueued(t, context.Background(), rl, &limitedRun{client: "behind"}, func(p int) {
+		lock.Lock()
+		defer lock.Unlock()
+		positions = append(positions, p)
+	})
+
+	cancel()
+	select {
+	case r := <-canceled:
+		if !errors.Is(r.err, context.Canceled) {
+			t.Fatalf("error is %v, want %v", r.err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled run kept waiting")
+	}
+
+	// The run behind the canceled run moves up, and gets the slot once it is released. Only the latest position is received, so
+	// its position of 2 may have been replaced before it was received.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		lock.Lock()
+		got := slices.Clone(positions)
+		lock.Unlock()
+		if len(got) > 0 && got[len(got)-1] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("positions of the run behind are %v, want them to end with 1", got)
+		}
+	}
+	if stats := rl.stats(); stats.Queued != 1 {
+		t.Errorf("%d runs are queued, want 1", stats.Queued)
+	}
+
+	release()
+	waitStarted(t, behind)()
+}
+
+func TestRunLimiterPreemptVictimOnce(t *testing.T) {
+	rl := newRunLimiter(2, 10)
+	rl.preempt = true
+
+	var (
+		lock      sync.Mutex
+		preempted []string
+	)
+	run := func(client string, priority int) *limitedRun {
+		q := &limitedRun{client: client, priority: priority}
+		q.preempt = func() {
+			lock.Lock()
+			defer lock.Unlock()
+			preempted = append(preempted, client)
+		}
+		return q
+	}
+	// The victim is preempted once the queued run has released the lock of the limiter, so it is waited for.
+	assertPreempted := func(want ...string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			lock.Lock()
+			got := slices.Clone(preempted)
+			lock.Unlock()
+			if slices.Equal(got, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("preempted runs are %v, want %v", got, want)
+			}
+		}
+	}
+
+	releaseLow1 := mustAcquire(t, rl, run("low1", 0))
+	releaseLow2 := mustAcquire(t, rl, run("low2", 0))
+
+	// The run that started last is preempted for the first run with a higher priority.
+	high := acquireQueued(t, context.Background(), rl, run("high", 1), nil)
+	assertPreempted("low2")
+
+	// A run ahead of it in the queue gets the slot that is already being freed, so nothing else is preempted for it.
+	higher := acquireQueued(t, context.Background(), rl, run("higher", 2), nil)
+	assertPreempted("low2")
+
+	// Once the run ahead has the slot of the preempted run, no slot is being freed for the queue, so the next run with a higher
+	// priority preempts the other low run.
+	releaseLow2()
+	releaseHigher := waitStarted(t, higher)
+	assertWaiting(t, high)
+
+	other := acquireQueued(t, context.Background(), rl, run("other", 1), nil)
+	assertPreempted("low2", "low1")
+
+	// A run that was preempted is counted as a slot that is being freed, and isn't preempted again.
+	another := acquireQueued(t, context.Background(), rl, run("another", 1), nil)
+	assertPreempted("low2", "low1")
+
+	releaseLow1()
+	waitStarted(t, high)()
+	releaseHigher()
+	waitStarted(t, other)()
+	waitStarted(t, another)()
+}
+
+func TestRunLimiterLowerLimitWhileActive(t *testing.T) {
+	rl := newRunLimiter(3, 10)
+
+	releases := []func(){
+		mustAcquire(t, rl, &limitedRun{client: "a"}),
+		mustAcquire(t, rl, &limitedRun{client: "b"}),
+		mustAcquire(t, rl, &limitedRun{client: "c"}),
+	}
+	queued := acquireQueued(t, context.Background(), rl, &limitedRun{client: "d"}, nil)
+
+	rl.setLimits(1, 10, false)
+	if stats := rl.stats(); stats.Active != 3 || stats.MaxConcurrent != 1 {
+		t.Errorf("stats are %+v, want 3 active with a limit of 1", stats)
+	}
+
+	// Slots are only given away once the active runs are within the new limit.
+	releases[0]()
+	assertWaiting(t, queued)
+	releases[1]()
+	assertWaiting(t, queued)
+	releases[2]()
+	waitStarted(t, queued)()
+
+	if stats := rl.stats(); stats.Active != 0 || stats.Queued != 0 {
+		t.Errorf("stats are %+v, want nothing active or queued", stats)
+	}
+}
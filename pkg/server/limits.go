@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultBodyLimit    = 32 << 20
+	defaultContentLimit = 1 << 20
+	defaultInputLimit   = 16 << 20
+	defaultUploadLimit  = 10 << 20
+	defaultParseTimeout = 30 * time.Second
+)
+
+// errParseTimeout is the error of parses that took longer than the parse timeout of the server.
+var errParseTimeout = errors.New("parsing took too long, which usually means that the content is too large or too deeply nested")
+
+// LimitsConfig configures the sizes of the requests that the server accepts. Requests that are larger are rejected with a 413
+// response before more of them is read, so that a large request can't make the server run out of memory.
+type LimitsConfig struct {
+	// Body is the size in bytes of the largest JSON request body, and of the largest message of a websocket. It defaults to 32MiB.
+	Body int64
+	// Content is the size in bytes of the largest tool content, whether it is run, parsed, or registered. It defaults to 1MiB.
+	Content int64
+	// Input is the size in bytes of the largest input of a run or message of a chat, including inputs that are streamed to the
+	// standard input of a run. It defaults to 16MiB.
+	Input int64
+	// Upload is the size in bytes of the largest uploaded file. It defaults to 10MiB.
+	Upload int64
+	// ParseTimeout is how long parsing a file or tool content can take before it is aborted. It defaults to 30s.
+	ParseTimeout time.Duration
+}
+
+func (c LimitsConfig) validate() error {
+	if c.Body < 0 || c.Content < 0 || c.Input < 0 || c.Upload < 0 || c.ParseTimeout < 0 {
+		return errors.New("body, content, input, upload, and parse timeout must not be negative")
+	}
+	return nil
+}
+
+func (c LimitsConfig) withDefaults() LimitsConfig {
+	if c.Body == 0 {
+		c.Body = defaultBodyLimit
+	}
+	if c.Content == 0 {
+		c.Content = defaultContentLimit
+	}
+	if c.Input == 0 {
+		c.Input = defaultInputLimit
+	}
+	if c.Upload == 0 {
+		c.Upload = defaultUploadLimit
+	}
+	if c.ParseTimeout == 0 {
+		c.ParseTimeout = defaultParseTimeout
+	}
+	return c
+}
+
+// bodyKind is the kind of the body of the requests of a route, which decides how large it can be.
+type bodyKind int
+
+const (
+	bodyJSON bodyKind = iota
+	// bodyUpload is a multipart form with a file that is uploaded.
+	bodyUpload
+	// bodyStdin is a multipart form with a request and an input that is streamed to the standard input of a run.
+	bodyStdin
+)
+
+// bodyLimit returns the size in bytes of the largest body of the kind.
+func (c LimitsConfig) bodyLimit(kind bodyKind) int64 {
+	switch kind {
+	case bodyUpload:
+		return c.Upload
+	case bodyStdin:
+		return c.Body + c.Input
+	default:
+		return c.Body
+	}
+}
+
+// check returns a requestError if the content of the tool or the input of the file is larger than the limits.
+func (c LimitsConfig) check(item toolOrFile) error {
+	if item.Tool != nil {
+		if err := c.checkContent("content", item.Tool.tool().String()); err != nil {
+			return err
+		}
+	}
+	if item.File != nil {
+		return c.checkInput("input", item.File.Input)
+	}
+	return nil
+}
+
+func (c LimitsConfig) checkContent(field, content string) error {
+	if int64(len(content)) > c.Content {
+		return tooLarge(field, fmt.Sprintf("tool content must be at most %d bytes", c.Content))
+	}
+	return nil
+}
+
+func (c LimitsConfig) checkInput(field, input string) error {
+	if int64(len(input)) > c.Input {
+		return tooLarge(field, fmt.Sprintf("input must be at most %d bytes", c.Input))
+	}
+	return nil
+}
+
+// limits returns the limits that are in effect, with the defaults filling in those that aren't set.
+func (s *server) limits() LimitsConfig {
+	return s.current().config.Limits.withDefaults()
+}
+
+// limitBody rejects requests whose body is larger than the limit of its kind. Requests that say how large their body is are
+// rejected right away, and the bodies of the others are cut off once they reach the limit, which decodeRequest reports.
+func (s *server) limitBody(kind bodyKind, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := s.limits().bodyLimit(kind)
+		if r.ContentLength > limit {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body must be at most %d bytes", limit))
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next(w, r)
+	}
+}
+
+// parseContext returns the context of parsing a file or tool content, which is aborted after the parse timeout.
+func (s *server) parseContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeoutCause(ctx, s.limits().ParseTimeout, errParseTimeout)
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gptscript-ai/go-gptscript"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/store"
+	"github.com/thedadams/clicky-serves/pkg/version"
+)
+
+const (
+	// mcpProtocolVersion is the latest version of MCP that the server speaks, which it answers clients that ask for a version that
+	// it doesn't speak with.
+	mcpProtocolVersion = "2025-06-18"
+	mcpServerName      = "clicky-serves"
+)
+
+var (
+	// mcpProtocolVersions are the versions of MCP that the server speaks.
+	mcpProtocolVersions = []string{"2024-11-05", "2025-03-26", mcpProtocolVersion}
+	// mcpDefaultInputSchema is the input schema of the tools whose arguments can't be found, which takes any arguments.
+	mcpDefaultInputSchema = json.RawMessage(`{"type":"object"}`)
+)
+
+type mcpInitializeParams struct {
+	ProtocolVersion string `json:"protocolVersion"`
+}
+
+type mcpInitializeResult struct {
+	ProtocolVersion string         `json:"protocolVersion"`
+	Capabilities    map[string]any `json:"capabilities"`
+	ServerInfo      mcpServerInfo  `json:"serverInfo"`
+}
+
+type mcpServerInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// mcpTool is a registered tool as it is listed to MCP clients, with the arguments of the tool that it runs as its input schema.
+type mcpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+type mcpCallParams struct {
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments,omitempty"`
+}
+
+type mcpCallResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+// mcpContent is text, or an embedded resource for output that isn't valid UTF-8.
+type mcpContent struct {
+	Type     string       `json:"type"`
+	Text     string       `json:"text,omitempty"`
+	Resource *mcpResource `json:"resource,omitempty"`
+}
+
+type mcpResource struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType"`
+	Blob     string `json:"blob"`
+}
+
+type mcpCancelledParams struct {
+	RequestID json.RawMessage `json:"requestId"`
+}
+
+// callMCP calls the MCP method of the request, and returns its result. It reports whether the method is a method of MCP, so that
+// the other methods can be called instead.
+func (c *jsonRPCConn) callMCP(ctx context.Context, req *jsonRPCRequest) (json.RawMessage, bool, error) {
+	var (
+		result any
+		err    error
+	)
+	switch req.Method {
+	case "initialize":
+		result, err = mcpInitialize(req.Params)
+	case "ping":
+		result = struct{}{}
+	case "tools/list":
+		result, err = c.mcpListTools(ctx)
+	case "tools/call":
+		result, err = c.mcpCallTool(ctx, req.Params)
+	case "notifications/cancelled":
+		p := new(mcpCancelledParams)
+		if json.Unmarshal(req.Params, p) == nil && len(p.RequestID) > 0 {
+			c.cancelRequest(p.RequestID)
+		}
+		return nil, true, nil
+	default:
+		// The other notifications, like the one that the client sends once it is initialized, need nothing to be done.
+		return nil, strings.HasPrefix(req.Method, "notifications/"), nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+
+	b, err := json.Marshal(result)
+	return b, true, err
+}
+
+// mcpInitialize answers the initialize request of a client, with the version of MCP that the client asked for if the server speaks
+// it, and the latest version that the server speaks otherwise.
+func mcpInitialize(params json.RawMessage) (*mcpInitializeResult, error) {
+	p := new(mcpInitializeParams)
+	if err := json.Unmarshal(params, p); err != nil {
+		return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: "params must be an object with a protocolVersion"}
+	}
+
+	protocolVersion := mcpProtocolVersion
+	if slices.Contains(mcpProtocolVersions, p.ProtocolVersion) {
+		protocolVersion = p.ProtocolVersion
+	}
+
+	return &mcpInitializeResult{
+		ProtocolVersion: protocolVersion,
+		Capabilities:    map[string]any{"tools": map[string]bool{"listChanged": false}},
+		ServerInfo:      mcpServerInfo{Name: mcpServerName, Version: version.Get()},
+	}, nil
+}
+
+// mcpListTools lists the latest version of every registered tool of the caller.
+func (c *jsonRPCConn) mcpListTools(ctx context.Context) (map[string][]mcpTool, error) {
+	out, err := c.do(ctx, http.MethodGet, "/registry", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Tools []store.Tool `json:"tools"`
+	}
+	if err = json.Unmarshal(out, &resp); err != nil {
+		return nil, &jsonRPCError{Code: jsonRPCInternalError, Message: "failed to decode registered tools: " + err.Error()}
+	}
+
+	tools := make([]mcpTool, 0, len(resp.Tools))
+	for _, t := range resp.Tools {
+		tools = append(tools, c.mcpTool(ctx, t))
+	}
+	return map[string][]mcpTool{"tools": tools}, nil
+}
+
+// mcpTool returns the registered tool as an MCP tool. The content of the tool is parsed for the arguments of the tool that it
+// runs, and a tool whose content can't be parsed takes any arguments.
+func (c *jsonRPCConn) mcpTool(ctx context.Context, t store.Tool) mcpTool {
+	tool := mcpTool{Name: t.Name, Description: t.Description, InputSchema: mcpDefaultInputSchema}
+
+	body, err := json.Marshal(map[string]string{"input": t.Content})
+	if err != nil {
+		return tool
+	}
+	out, err := c.do(ctx, http.MethodPost, "/parse", body)
+	if err != nil {
+		ccontext.GetLogger(ctx).Debug("failed to parse registered tool for its arguments", "tool", t.Name, "error", err)
+		return tool
+	}
+
+	var parsed struct {
+		Stdout struct {
+			Nodes []gptscript.Node `json:"nodes"`
+		} `json:"stdout"`
+	}
+	if err = json.Unmarshal(out, &parsed); err != nil {
+		return tool
+	}
+	entry, _, err := entryTool(parsed.Stdout.Nodes, "")
+	if err != nil {
+		return tool
+	}
+
+	if tool.Description == "" {
+		tool.Description = entry.Description
+	}
+	if entry.Arguments != nil {
+		if schema, err := json.Marshal(entry.Arguments); err == nil {
+			tool.InputSchema = schema
+		}
+	}
+	return tool
+}
+
+// mcpCallTool runs the latest version of the registered tool with the arguments as its input. Errors of the run are in the result
+// as MCP asks, so that the model that called the tool sees them, while errors of the caller, like a tool that isn't registered,
+// are errors of the request.
+func (c *jsonRPCConn) mcpCallTool(ctx context.Context, params json.RawMessage) (*mcpCallResult, error) {
+	p := new(mcpCallParams)
+	if err := json.Unmarshal(params, p); err != nil || p.Name == "" {
+		return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: "params must be an object with the name of a tool"}
+	}
+
+	var input string
+	if len(p.Arguments) > 0 {
+		b, err := json.Marshal(p.Arguments)
+		if err != nil {
+			return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: "invalid arguments: " + err.Error()}
+		}
+		input = string(b)
+	}
+
+	body, err := json.Marshal(map[string]string{"input": input})
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.do(ctx, http.MethodPost, "/registry/"+url.PathEscape(p.Name)+"/run", body)
+	if err != nil {
+		var jErr *jsonRPCError
+		if !errors.As(err, &jErr) || jErr.Data == nil {
+			return nil, err
+		}
+
+		switch jErr.Data.Status {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+			return nil, err
+		case http.StatusNotFound:
+			return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: jErr.Message, Data: jErr.Data}
+		default:
+			return &mcpCallResult{Content: []mcpContent{{Type: "text", Text: jErr.Message}}, IsError: true}, nil
+		}
+	}
+
+	var resp struct {
+		Stdout   string `json:"stdout"`
+		Encoding string `json:"encoding"`
+	}
+	if err = json.Unmarshal(out, &resp); err != nil {
+		return nil, &jsonRPCError{Code: jsonRPCInternalError, Message: "failed to decode output: " + err.Error()}
+	}
+
+	if resp.Encoding == encodingBase64 {
+		return &mcpCallResult{Content: []mcpContent{{
+			Type:     "resource",
+			Resource: &mcpResource{URI: registryScheme + p.Name, MimeType: "application/octet-stream", Blob: resp.Stdout},
+		}}}, nil
+	}
+	return &mcpCallResult{Content: []mcpContent{{Type: "text", Text: resp.Stdout}}}, nil
+}
+
+// mcp serves MCP with its Streamable HTTP transport. The server doesn't send requests or notifications of its own, so every
+// response is JSON, and messages that need no response, like notifications, are answered with status 202.
+func (s *server) mcp(w http.ResponseWriter, r *http.Request) {
+	if !s.current().config.MCP {
+		writeError(w, http.StatusNotFound, errors.New("MCP is disabled"))
+		return
+	}
+
+	msg, ok := readJSONRPCMessage(w, r)
+	if !ok {
+		return
+	}
+
+	c := newJSONRPCConn(s, r, "", func(any) {})
+	c.mcp = true
+
+	resp := c.serve(r.Context(), msg)
+	if resp == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	writeResponse(w, resp)
+}
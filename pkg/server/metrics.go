@@ -0,0 +1,154 @@
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "clicky_serves"
+
+var (
+	runsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "runs_started_total",
+		Help:      "Number of runs that have left the run queue and started executing, by tenant.",
+	}, []string{"type", "tenant"})
+
+	runsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "runs_completed_total",
+		Help:      "Number of runs that have ended, by their final state and tenant.",
+	}, []string{"type", "state", "tenant"})
+
+	runDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_duration_seconds",
+		Help:      "Duration of runs from when they were received until they ended, by their final state and tenant.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 900},
+	}, []string{"type", "state", "tenant"})
+
+	activeRuns = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_runs",
+		Help:      "Number of runs that are currently executing.",
+	})
+
+	runsPreempted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "runs_preempted_total",
+		Help:      "Number of runs that were canceled to give their slot to a run with a higher priority.",
+	})
+
+	eventsWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_written_total",
+		Help:      "Number of events written to streaming clients, by transport.",
+	}, []string{"transport"})
+
+	rateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of requests that were rejected because the client exceeded its rate limit, by endpoint class.",
+	}, []string{"class"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "result_cache_lookups_total",
+		Help:      "Number of runs that were looked up in the result cache, by whether they were found.",
+	}, []string{"result"})
+
+	parseCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "parse_cache_lookups_total",
+		Help:      "Number of parses that were looked up in the parse cache, by whether they were found.",
+	}, []string{"result"})
+
+	callbackDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "callback_deliveries_total",
+		Help:      "Number of run callbacks that were sent, by whether they were delivered.",
+	}, []string{"result"})
+
+	notificationsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "notifications_sent_total",
+		Help:      "Number of notifications of the outcomes of runs that were sent, by the type of their sink and whether they were delivered.",
+	}, []string{"type", "result"})
+
+	brokerEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "broker_events_total",
+		Help:      "Number of events of runs that were queued to be published to brokers, by the type of the broker and whether they were published, failed, or were dropped because the queue was full.",
+	}, []string{"type", "result"})
+
+	streamEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_events_dropped_total",
+		Help:      "Number of events that weren't written to streaming clients because they were too slow to read them.",
+	})
+
+	registeredToolUses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registered_tool_uses_total",
+		Help:      "Number of times that registered tools were used as the file of a run or a parse, by tenant and tool.",
+	}, []string{"tenant", "tool"})
+
+	runRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_retries_total",
+		Help:      "Number of times that runs were retried after a transient error of the model, by the status code of the error, or because their output didn't conform to their output schema, with the status output_schema.",
+	}, []string{"status"})
+
+	circuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_state",
+		Help:      "State of the circuit breaker of each provider of models: 0 is closed, 1 is open, and 2 is half-open.",
+	}, []string{"provider"})
+
+	diskUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "disk_usage_bytes",
+		Help:      "Size in bytes of what the server keeps on disk as of the last cleanup, by area: cache, uploads, tools, or workspaces.",
+	}, []string{"area"})
+
+	cleanupRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cleanup_removed_total",
+		Help:      "Number of files and directories that the janitor removed from the disk, by area.",
+	}, []string{"area"})
+
+	cleanupRemovedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cleanup_removed_bytes_total",
+		Help:      "Number of bytes that the janitor removed from the disk, by area.",
+	}, []string{"area"})
+
+	processLimitKills = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "process_limit_kills_total",
+		Help:      "Number of runs that were killed because they exceeded a process limit, by resource.",
+	}, []string{"resource"})
+
+	outputTruncated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "output_truncated_total",
+		Help:      "Number of streamed runs that were stopped because their output exceeded the max output size.",
+	})
+
+	bytesStreamed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "streamed_bytes_total",
+		Help:      "Number of bytes written to streaming clients, by transport.",
+	}, []string{"transport"})
+)
+
+const (
+	transportSSE       = "sse"
+	transportNDJSON    = "ndjson"
+	transportWebsocket = "websocket"
+)
+
+const (
+	cacheResultHit  = "hit"
+	cacheResultMiss = "miss"
+)
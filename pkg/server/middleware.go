@@ -46,12 +46,40 @@ func logRequest(h http.Handler) http.Handler {
 	})
 }
 
+// requestIDHeader is the header that a client can set the ID of its request with, and that the ID of each request is returned in.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the length of the longest request ID that is accepted from a client.
+const maxRequestIDLength = 128
+
+// addRequestID gives the request the ID from its X-Request-ID header, or a new one if it has none or it isn't valid, and returns
+// the ID in the X-Request-ID header of the response.
 func addRequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		next.ServeHTTP(w, r.WithContext(context.WithNewRequestID(r.Context())))
+		ctx := context.WithNewRequestID(r.Context())
+		if id := r.Header.Get(requestIDHeader); validRequestID(id) {
+			ctx = context.WithRequestID(r.Context(), id)
+		}
+
+		w.Header().Set(requestIDHeader, context.GetRequestID(ctx))
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// validRequestID reports whether the request ID from a client can be used, which it can if it isn't too long and is only made
+// of printable ASCII characters other than spaces, so that it is safe to log and return in a header.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 func addLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		next.ServeHTTP(
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	providerOpenAI = "openai"
+	providerAzure  = "azure"
+	providerLocal  = "local"
+)
+
+// ModelRoute is where the runs that request a model are sent. The route is applied by setting the environment of the gptscript
+// process, so it is the default model of the run, and tools of files that name another model are not routed.
+type ModelRoute struct {
+	// Provider is one of openai, azure, or local, which is any server with an OpenAI compatible API. It defaults to openai.
+	Provider string
+	// Model is the name of the model at the provider, or the name of the deployment for Azure. It defaults to the requested name.
+	Model string
+	// BaseURL is the URL of the API of the provider. It is required for Azure and local providers.
+	BaseURL string
+	// APIKey is the key for the provider. OpenAI routes without a key use the key of the server, but other providers are never
+	// given the key of the server.
+	APIKey string
+	// APIVersion is the version of the Azure OpenAI API.
+	APIVersion string
+	// PromptPrice and CompletionPrice are the prices of a million prompt and completion tokens of the model, in US dollars, which
+	// the cost of runs is estimated from.
+	PromptPrice     float64
+	CompletionPrice float64
+}
+
+func (m ModelRoute) validate() error {
+	switch m.Provider {
+	case "", providerOpenAI:
+	case providerAzure, providerLocal:
+		if m.BaseURL == "" {
+			return fmt.Errorf("the %s provider requires a base URL", m.Provider)
+		}
+	default:
+		return fmt.Errorf("unknown provider %q, must be one of openai, azure, or local", m.Provider)
+	}
+
+	if m.PromptPrice < 0 || m.CompletionPrice < 0 {
+		return errors.New("prices can't be negative")
+	}
+	return nil
+}
+
+// env returns the environment variables that send the run to the provider of the route.
+func (m ModelRoute) env(name string) []string {
+	model := m.Model
+	if model == "" {
+		model = name
+	}
+
+	env := []string{"GPTSCRIPT_DEFAULT_MODEL=" + model}
+	if m.BaseURL != "" {
+		env = append(env, "OPENAI_BASE_URL="+m.BaseURL)
+	}
+	if m.APIKey != "" || (m.Provider != "" && m.Provider != providerOpenAI) {
+		env = append(env, "OPENAI_API_KEY="+m.APIKey)
+	}
+	if m.Provider == providerAzure {
+		env = append(env, "OPENAI_API_TYPE=AZURE")
+		if m.APIVersion != "" {
+			env = append(env, "OPENAI_API_VERSION="+m.APIVersion)
+		}
+	}
+	return env
+}
+
+// modelList is the response of the models endpoint.
+type modelList struct {
+	Models []string `json:"models"`
+	// Default is the model of runs that don't request one, if the server has a default model.
+	Default string `json:"default,omitempty"`
+	// Routed is whether the models are the models that the server routes, rather than those that gptscript lists.
+	Routed bool `json:"routed"`
+}
+
+// validateModels checks the model routes, and that the default model is one of them.
+func validateModels(models map[string]ModelRoute, defaultModel string) error {
+	for name, m := range models {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("invalid route of model %q: %w", name, err)
+		}
+	}
+
+	if _, ok := models[defaultModel]; defaultModel != "" && !ok {
+		return fmt.Errorf("default model %q is not one of the models", defaultModel)
+	}
+	return nil
+}
+
+// modelEnv returns the environment variables of the model of a run. If no models are configured, then the requested model is the
+// default model of the run as is, and the provider of the server is used. Otherwise, the requested model must be one of the
+// models, and runs that don't request one use the default model if there is one.
+func (s *server) modelEnv(requested string) ([]string, error) {
+	config := s.current().config
+	if len(config.Models) == 0 {
+		if requested == "" {
+			return nil, nil
+		}
+		return []string{"GPTSCRIPT_DEFAULT_MODEL=" + requested}, nil
+	}
+
+	if requested == "" {
+		requested = config.DefaultModel
+		if requested == "" {
+			return nil, nil
+		}
+	}
+
+	route, ok := config.Models[requested]
+	if !ok {
+		names := make([]string, 0, len(config.Models))
+		for name := range config.Models {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return nil, invalidField("model", fmt.Sprintf("model %q is not allowed, must be one of %s", requested, strings.Join(names, ", ")))
+	}
+
+	return route.env(requested), nil
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	notificationSMTP    = "smtp"
+	notificationSlack   = "slack"
+	notificationWebhook = "webhook"
+)
+
+// NotificationSink is where a notification is sent when a run ends, if the run matches the filters of the sink. Notifications are
+// also sent when a scheduled run fails to start, so that scheduled runs don't fail silently.
+type NotificationSink struct {
+	// Type is smtp, which emails the notification, slack, which posts it to an incoming webhook of Slack, or webhook, which posts it
+	// as JSON, signed like callbacks.
+	Type string
+	// URL is the URL of the incoming webhook of Slack or of the webhook.
+	URL string
+	// SMTP is the mail server that emails are sent with.
+	SMTP SMTPConfig
+
+	// Tools are patterns, as matched by filepath.Match, of the names of the registered tools, the paths of the files, or the names
+	// of the tools of the runs that are notified about. States are the states of the runs, which are finished, failed, or canceled,
+	// and Tenants are their tenants, where the empty name is the default tenant. Runs of every tool, state, or tenant are notified
+	// about if the filter is empty.
+	Tools   []string
+	States  []string
+	Tenants []string
+}
+
+// SMTPConfig configures the mail server that notifications are emailed with.
+type SMTPConfig struct {
+	// Addr is the host and port of the mail server. Username and Password, if set, are used to authenticate with PLAIN auth, which
+	// the mail server only accepts over TLS or on localhost.
+	Addr     string
+	Username string
+	Password string
+	// From is the address that emails are sent from, and To are the addresses that they are sent to.
+	From string
+	To   []string
+}
+
+func (n NotificationSink) validate() error {
+	switch n.Type {
+	case notificationSMTP:
+		if _, _, err := net.SplitHostPort(n.SMTP.Addr); err != nil {
+			return fmt.Errorf("invalid SMTP address %q: %w", n.SMTP.Addr, err)
+		}
+		if n.SMTP.From == "" || len(n.SMTP.To) == 0 {
+			return errors.New("the from and to addresses of emails are required")
+		}
+	case notificationSlack, notificationWebhook:
+		if u, err := url.Parse(n.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("the URL must be an absolute http or https URL")
+		}
+	default:
+		return fmt.Errorf("unknown type %q, must be smtp, slack, or webhook", n.Type)
+	}
+
+	for _, pattern := range n.Tools {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid tool pattern %q: %w", pattern, err)
+		}
+	}
+	for _, state := range n.States {
+		switch runState(state) {
+		case runStateFinished, runStateFailed, runStateCanceled:
+		default:
+			return fmt.Errorf("invalid state %q, must be finished, failed, or canceled", state)
+		}
+	}
+	for _, tenant := range n.Tenants {
+		if err := validateTenant(tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether the notification passes the filters of the sink.
+func (n NotificationSink) matches(no notification) bool {
+	if len(n.States) > 0 && !slices.Contains(n.States, no.State) {
+		return false
+	}
+	if len(n.Tenants) > 0 && !slices.Contains(n.Tenants, no.Tenant) {
+		return false
+	}
+	if len(n.Tools) == 0 {
+		return true
+	}
+	for _, pattern := range n.Tools {
+		if ok, _ := filepath.Match(pattern, no.Tool); ok && no.Tool != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// notification is the outcome of a run that is sent to the notification sinks, and the body of the notifications of webhooks.
+type notification struct {
+	// RunID is empty if the notification is about a scheduled run that failed to start.
+	RunID string `json:"runID,omitempty"`
+	// Tool is the name of the registered tool, the path of the file, or the name of the tool of the run.
+	Tool       string     `json:"tool,omitempty"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	Tenant     string     `json:"tenant,omitempty"`
+	Client     string     `json:"client,omitempty"`
+	ScheduleID string     `json:"scheduleID,omitempty"`
+	StartTime  *time.Time `json:"startTime,omitempty"`
+	EndTime    *time.Time `json:"endTime,omitempty"`
+}
+
+// subject returns a line that summarizes the notification.
+func (no notification) subject() string {
+	what := "Run " + no.RunID
+	if no.RunID == "" {
+		what = "Scheduled run"
+	}
+	if no.Tool != "" {
+		what += " of " + no.Tool
+	}
+
+	if no.RunID == "" {
+		return what + " failed to start (schedule " + no.ScheduleID + ")"
+	} else if no.ScheduleID != "" {
+		return what + " " + no.State + " (schedule " + no.ScheduleID + ")"
+	}
+	return what + " " + no.State
+}
+
+// text returns the notification as the lines of a message.
+func (no notification) text() string {
+	var b strings.Builder
+	b.WriteString(no.subject() + "\n")
+	if no.Error != "" {
+		b.WriteString("\nError: " + no.Error + "\n")
+	}
+	if no.Tenant != "" {
+		b.WriteString("Tenant: " + no.Tenant + "\n")
+	}
+	if no.Client != "" {
+		b.WriteString("Client: " + no.Client + "\n")
+	}
+	if no.StartTime != nil && no.EndTime != nil {
+		b.WriteString("Duration: " + no.EndTime.Sub(*no.StartTime).Round(time.Millisecond).String() + "\n")
+	}
+	return b.String()
+}
+
+// recordedTool returns the name of the tool of the recorded request of a run: the name of the registered tool or the path of the
+// file of a file run, or the name of the tool of a tool run.
+func recordedTool(input json.RawMessage) string {
+	var req struct {
+		File string `json:"file"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(input, &req); err != nil {
+		return ""
+	}
+	return toolName(req.File, req.Name)
+}
+
+func toolName(file, name string) string {
+	if file == "" {
+		return name
+	}
+	if handle, ok := strings.CutPrefix(file, registryScheme); ok {
+		name, _, _ = strings.Cut(handle, "@")
+		return name
+	}
+	return file
+}
+
+// notifyRun sends a notification of the outcome of the run to the sinks that it matches, in the background.
+func (s *server) notifyRun(l *slog.Logger, tenant, runID string) {
+	if len(s.current().config.Notifications) == 0 {
+		return
+	}
+
+	r, err := s.store.GetRun(context.Background(), tenant, runID)
+	if err != nil {
+		l.Error("Failed to get run to notify about", "error", err)
+		return
+	}
+
+	s.notify(l, notification{
+		RunID:      r.ID,
+		Tool:       recordedTool(r.Input),
+		State:      r.State,
+		Error:      r.Error,
+		Tenant:     r.Tenant,
+		Client:     r.Client,
+		ScheduleID: r.ScheduleID,
+		StartTime:  &r.StartTime,
+		EndTime:    r.EndTime,
+	})
+}
+
+// notify sends the notification to each sink that it matches, each in its own goroutine.
+func (s *server) notify(l *slog.Logger, no notification) {
+	for _, sink := range s.current().config.Notifications {
+		if sink.matches(no) {
+			go s.sendNotification(l, sink, no)
+		}
+	}
+}
+
+// sendNotification sends the notification to the sink, retrying with backoff like callbacks if the sink can't be reached or
+// responds with an error that may be temporary.
+func (s *server) sendNotification(l *slog.Logger, sink NotificationSink, no notification) {
+	l = l.With("notification_type", sink.Type)
+
+	backoff := callbackBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.deliverNotification(sink, no)
+		if err == nil {
+			l.Debug("sent notification", "attempt", attempt)
+			notificationsSent.WithLabelValues(sink.Type, callbackResultDelivered).Inc()
+			return
+		}
+
+		if !retry || attempt == callbackAttempts {
+			l.Warn("Failed to send notification", "attempt", attempt, "error", err)
+			notificationsSent.WithLabelValues(sink.Type, callbackResultFailed).Inc()
+			return
+		}
+
+		l.Debug("retrying notification", "attempt", attempt, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// deliverNotification makes one attempt to send the notification to the sink. If it fails, then the returned bool is whether it
+// is worth retrying.
+func (s *server) deliverNotification(sink NotificationSink, no notification) (bool, error) {
+	switch sink.Type {
+	case notificationSMTP:
+		return sendEmail(sink.SMTP, no)
+	case notificationSlack:
+		body, err := json.Marshal(map[string]string{"text": no.text()})
+		if err != nil {
+			return false, err
+		}
+		return s.postNotification(sink.URL, body, false)
+	default:
+		body, err := json.Marshal(no)
+		if err != nil {
+			return false, err
+		}
+		return s.postNotification(sink.URL, body, true)
+	}
+}
+
+// postNotification posts the body to the URL, signing it like callbacks if sign is true and there is a callback secret.
+func (s *server) postNotification(u string, body []byte, sign bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if secret := s.current().config.CallbackSecret; sign && secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(callbackTimestampHeader, timestamp)
+		req.Header.Set(callbackSignatureHeader, "sha256="+signCallback(secret, timestamp, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("notification URL responded with %s", resp.Status)
+}
+
+// sendEmail emails the notification with the mail server. Errors other than permanent rejections by the mail server are worth
+// retrying.
+func sendEmail(c SMTPConfig, no notification) (bool, error) {
+	var auth smtp.Auth
+	if c.Username != "" {
+		host, _, _ := net.SplitHostPort(c.Addr)
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	// The subject has the name of the tool, which mustn't be able to add headers to the email.
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(no.subject()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(no.text(), "\n", "\r\n"))
+
+	err := smtp.SendMail(c.Addr, auth, c.From, c.To, msg.Bytes())
+	if err == nil {
+		return false, nil
+	}
+
+	var protoErr *textproto.Error
+	return !errors.As(err, &protoErr) || protoErr.Code < 500, err
+}
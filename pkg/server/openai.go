@@ -0,0 +1,530 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+const (
+	openAIChatCompletion      = "chat.completion"
+	openAIChatCompletionChunk = "chat.completion.chunk"
+	openAIFinishReasonStop    = "stop"
+)
+
+// openAIChatRequest is the body of a request to the chat completions API. Only the model, the messages, and whether to stream are
+// used. The other fields of the API, like the temperature, are up to the chat tool, so they are accepted and ignored.
+type openAIChatRequest struct {
+	Model         string               `json:"model"`
+	Messages      []openAIMessage      `json:"messages"`
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+func (o *openAIChatRequest) validate() error {
+	if o.Model == "" {
+		return missingField("model", "model is required")
+	}
+	if len(o.Messages) == 0 {
+		return missingField("messages", "messages are required")
+	}
+	if o.Messages[len(o.Messages)-1].Role != "user" {
+		return invalidField("messages", "the last message must be a message of the user")
+	}
+	return nil
+}
+
+// openAIMessage is a message of a conversation. Its content is a string, or a list of parts, of which only the text is used.
+type openAIMessage struct {
+	Role    string        `json:"role"`
+	Content openAIContent `json:"content"`
+}
+
+type openAIContent string
+
+func (o *openAIContent) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*o = openAIContent(s)
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(b, &parts); err != nil {
+		return errors.New("content must be a string or a list of parts")
+	}
+
+	var texts []string
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	*o = openAIContent(strings.Join(texts, "\n"))
+	return nil
+}
+
+// openAIChatCompletionResponse is a chat completion, or a chunk of one if the request streams.
+type openAIChatCompletionResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+// openAIChoice is the reply of a chat completion. Message is the reply of a chat completion, and Delta is the part of the reply of a
+// chunk, which is empty for the last chunk.
+type openAIChoice struct {
+	Index        int            `json:"index"`
+	Message      *openAIMessage `json:"message,omitempty"`
+	Delta        *openAIDelta   `json:"delta,omitempty"`
+	FinishReason *string        `json:"finish_reason"`
+}
+
+type openAIDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type openAIModels struct {
+	Object string        `json:"object"`
+	Data   []openAIModel `json:"data"`
+}
+
+// openAIErrorResponse is the body of the errors of the API, in the form of the errors of OpenAI, so that its clients can show them.
+type openAIErrorResponse struct {
+	Error openAIError `json:"error"`
+}
+
+type openAIError struct {
+	Message string    `json:"message"`
+	Type    string    `json:"type"`
+	Param   *string   `json:"param"`
+	Code    errorCode `json:"code"`
+}
+
+// newOpenAIError returns the error as an error of OpenAI, whose type is the type that OpenAI has for errors with the status.
+func newOpenAIError(status int, resp errorResponse) openAIErrorResponse {
+	errType := "invalid_request_error"
+	switch {
+	case status == http.StatusUnauthorized:
+		errType = "authentication_error"
+	case status == http.StatusForbidden:
+		errType = "permission_error"
+	case status == http.StatusNotFound:
+		errType = "not_found_error"
+	case status == http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	case status >= http.StatusInternalServerError:
+		errType = "server_error"
+	}
+
+	e := openAIError{Message: resp.Error, Type: errType, Code: resp.Code}
+	if resp.Field != "" {
+		e.Param = &resp.Field
+	}
+	return openAIErrorResponse{Error: e}
+}
+
+// writeOpenAIError responds with the error in the form of the errors of OpenAI.
+func writeOpenAIError(w http.ResponseWriter, status int, err error) {
+	resp := errorResponse{Error: err.Error(), Code: statusErrorCode(status)}
+
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		resp.Code = reqErr.code
+		resp.Field = reqErr.field
+	}
+
+	w.WriteHeader(status)
+	writeResponse(w, newOpenAIError(status, resp))
+}
+
+// openAIConversations maps the conversations of the chat completions API to the chats that they are continued with. Clients send
+// the whole conversation with each request, while the state of a chat is kept by the server, so the chat of a conversation is
+// found by a hash of the messages of the conversation.
+type openAIConversations struct {
+	lock  sync.Mutex
+	chats map[string]openAIConversation
+}
+
+type openAIConversation struct {
+	chatID  string
+	updated time.Time
+}
+
+func newOpenAIConversations() *openAIConversations {
+	return &openAIConversations{chats: make(map[string]openAIConversation)}
+}
+
+// take returns the chat of the conversation, and forgets it, because the next turn of the chat makes it the chat of a longer
+// conversation.
+func (o *openAIConversations) take(key string) (string, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	c, ok := o.chats[key]
+	if !ok || time.Since(c.updated) > chatRetention {
+		return "", false
+	}
+	delete(o.chats, key)
+	return c.chatID, true
+}
+
+func (o *openAIConversations) put(key, chatID string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	// Chats are removed after chatRetention without a turn, so the conversations of the chats that were removed are too.
+	for k, c := range o.chats {
+		if time.Since(c.updated) > chatRetention {
+			delete(o.chats, k)
+		}
+	}
+	o.chats[key] = openAIConversation{chatID: chatID, updated: time.Now()}
+}
+
+// openAIConversationKey returns the key of the conversation of the caller with the messages. The tool and the model are part of the
+// key, so that a conversation isn't continued with the chat of another tool.
+func openAIConversationKey(caller chatCaller, tool, model string, messages []openAIMessage) string {
+	h := sha256.New()
+	for _, part := range []string{caller.tenant, caller.name, tool, model} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	for _, m := range messages {
+		h.Write([]byte(m.Role))
+		h.Write([]byte{0})
+		h.Write([]byte(m.Content))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// openAITranscript returns the messages of a conversation that isn't continued from a chat as the first message of a chat, so that
+// the chat tool knows what was said before.
+func openAITranscript(messages []openAIMessage) string {
+	var sb strings.Builder
+	sb.WriteString("This is the conversation so far. Reply to the last message.\n\n")
+	for _, m := range messages {
+		fmt.Fprintf(&sb, "%s: %s\n\n", m.Role, m.Content)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// listOpenAIModels lists the chat tool as the only model of the chat completions API, so that clients that pick a model from the
+// list can use it.
+func (s *server) listOpenAIModels(w http.ResponseWriter, _ *http.Request) {
+	tool := s.current().config.ChatCompletionsTool
+	if tool == "" {
+		writeOpenAIError(w, http.StatusNotFound, errors.New("the chat completions API is disabled"))
+		return
+	}
+
+	writeResponse(w, openAIModels{
+		Object: "list",
+		Data:   []openAIModel{{ID: tool, Object: "model", Created: s.started.Unix(), OwnedBy: mcpServerName}},
+	})
+}
+
+// chatCompletions serves the chat completions API of OpenAI with the chat tool of the config. Each conversation is a chat of the
+// HTTP API: a conversation that the server replied to before is continued with the chat that it replied with, and other
+// conversations start a chat, whose first message is a transcript of the conversation if it has more than one message. Any model
+// can be asked for, because the chat tool picks its own.
+func (s *server) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	tool := s.current().config.ChatCompletionsTool
+	if tool == "" {
+		writeOpenAIError(w, http.StatusNotFound, errors.New("the chat completions API is disabled"))
+		return
+	}
+
+	// Clients of OpenAI send fields that the server has no use for, so unknown fields aren't rejected like they are by decodeRequest.
+	req := new(openAIChatRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, &requestError{code: errorCodeInvalidJSON, msg: "invalid request body: " + err.Error()})
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var (
+		l       = ccontext.GetLogger(r.Context())
+		caller  = chatCallerOf(r)
+		last    = len(req.Messages) - 1
+		key     = openAIConversationKey(caller, tool, req.Model, req.Messages[:last])
+		message = string(req.Messages[last].Content)
+	)
+
+	chatID, continued := s.openAI.take(key)
+	if !continued {
+		var (
+			resp   errorResponse
+			status int
+		)
+		if chatID, status, resp = s.createOpenAIChat(r, tool); chatID == "" {
+			w.WriteHeader(status)
+			writeResponse(w, newOpenAIError(status, resp))
+			return
+		}
+		if last > 0 {
+			message = openAITranscript(req.Messages)
+		}
+	}
+
+	body, err := json.Marshal(chatMessage{Message: message})
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	c := &openAICompletion{
+		w:       w,
+		l:       l,
+		model:   req.Model,
+		created: time.Now().Unix(),
+		stream:  req.Stream,
+		usage:   req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+	}
+	iw := newInternalResponseWriter(c.writeEvent)
+	c.header = iw.Header()
+
+	s.handler.ServeHTTP(iw, newInternalRequest(r.Context(), r, http.MethodPost, "/chat/"+url.PathEscape(chatID)+"/messages", body))
+
+	resp, failed := iw.failed()
+	if !failed && c.err != "" {
+		resp, failed = errorResponse{Error: c.err, Code: errorCodeEngineError}, true
+		iw.code = http.StatusBadGateway
+	}
+	if failed {
+		// The state of a chat doesn't change with a turn that failed, so the conversation can be continued with it again.
+		if continued && iw.code != http.StatusNotFound {
+			s.openAI.put(key, chatID)
+		}
+		c.fail(iw.code, resp)
+		return
+	}
+
+	if !c.done {
+		reply := append(req.Messages[:len(req.Messages):len(req.Messages)], openAIMessage{Role: "assistant", Content: openAIContent(c.reply)})
+		s.openAI.put(openAIConversationKey(caller, tool, req.Model, reply), chatID)
+	}
+	c.finish()
+}
+
+// createOpenAIChat creates a chat with the chat tool, and returns its ID, or the status and the error that creating it failed with.
+func (s *server) createOpenAIChat(r *http.Request, tool string) (string, int, errorResponse) {
+	body, err := json.Marshal(chatRequest{File: &fileRequest{File: tool}})
+	if err != nil {
+		return "", http.StatusInternalServerError, errorResponse{Error: err.Error(), Code: errorCodeInternal}
+	}
+
+	iw := newInternalResponseWriter(nil)
+	s.handler.ServeHTTP(iw, newInternalRequest(r.Context(), r, http.MethodPost, "/chat", body))
+	if resp, failed := iw.failed(); failed {
+		return "", iw.code, resp
+	}
+
+	var c chatSession
+	if err = json.Unmarshal(iw.body.Bytes(), &c); err != nil || c.ID == "" {
+		return "", http.StatusInternalServerError, errorResponse{Error: "failed to decode chat", Code: errorCodeInternal}
+	}
+	return c.ID, 0, errorResponse{}
+}
+
+// openAICompletion translates the events of a turn of a chat to a chat completion. If the request streams, then the content of the
+// root call of the turn is streamed as chunks as the model writes it, and the rest of the reply is sent once the turn is done.
+type openAICompletion struct {
+	w       http.ResponseWriter
+	l       *slog.Logger
+	header  http.Header
+	model   string
+	created int64
+	stream  bool
+	// usage is true if the usage of the turn is sent as the last chunk of a stream.
+	usage bool
+
+	id      string
+	started bool
+	// sent is the content that has been streamed.
+	sent   string
+	reply  string
+	done   bool
+	err    string
+	tokens openAIUsage
+}
+
+// writeEvent handles an event of the turn, as it is written by the handler of the turn.
+func (o *openAICompletion) writeEvent(line []byte) {
+	var e events.Envelope
+	if err := json.Unmarshal(line, &e); err != nil {
+		o.l.Debug("failed to decode event of chat turn", "error", err)
+		return
+	}
+
+	switch d := e.Data.(type) {
+	case events.Call:
+		// Only the progress of the call of the chat tool is the reply, and not the progress of the tools that it calls.
+		if d.Type != events.TypeCallProgress || d.CallContext == nil || d.CallContext.ParentID != "" {
+			return
+		}
+		if strings.HasPrefix(d.Content, o.sent) {
+			o.send(d.Content[len(o.sent):])
+		}
+	case events.Stdout:
+		o.reply, o.done = d.Stdout, d.Done != nil && *d.Done
+	case events.Usage:
+		// The usage of each usage event is the usage of the turn so far.
+		o.tokens = openAIUsage{
+			PromptTokens:     int(d.Usage.PromptTokens),
+			CompletionTokens: int(d.Usage.CompletionTokens),
+			TotalTokens:      int(d.Usage.TotalTokens),
+		}
+	case events.Error:
+		o.err = d.Err
+	}
+}
+
+// send streams the content as a chunk, starting the stream if it hasn't started.
+func (o *openAICompletion) send(content string) {
+	if !o.stream || content == "" {
+		return
+	}
+
+	delta := &openAIDelta{Content: content}
+	if !o.started {
+		o.start()
+		delta.Role = "assistant"
+	}
+	o.sent += content
+	o.writeChunk(openAIChoice{Delta: delta}, nil)
+}
+
+func (o *openAICompletion) start() {
+	o.started = true
+	o.w.Header().Set(runIDHeader, o.header.Get(runIDHeader))
+	setStreamingHeaders(o.w)
+	o.w.WriteHeader(http.StatusOK)
+}
+
+func (o *openAICompletion) completionID() string {
+	if o.id == "" {
+		o.id = "chatcmpl-" + o.header.Get(runIDHeader)
+	}
+	return o.id
+}
+
+func (o *openAICompletion) writeChunk(choice openAIChoice, usage *openAIUsage) {
+	chunk := openAIChatCompletionResponse{
+		ID:      o.completionID(),
+		Object:  openAIChatCompletionChunk,
+		Created: o.created,
+		Model:   o.model,
+		Choices: []openAIChoice{},
+		Usage:   usage,
+	}
+	if usage == nil {
+		chunk.Choices = append(chunk.Choices, choice)
+	}
+	o.writeData(chunk)
+}
+
+func (o *openAICompletion) writeData(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		o.l.Error("Failed to marshal chunk of chat completion", "error", err)
+		return
+	}
+
+	_, _ = fmt.Fprintf(o.w, "data: %s\n\n", b)
+	if f, ok := o.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish responds with the chat completion, or ends the stream with the rest of the reply.
+func (o *openAICompletion) finish() {
+	stop := openAIFinishReasonStop
+	if !o.stream {
+		o.w.Header().Set(runIDHeader, o.header.Get(runIDHeader))
+		writeResponse(o.w, openAIChatCompletionResponse{
+			ID:      o.completionID(),
+			Object:  openAIChatCompletion,
+			Created: o.created,
+			Model:   o.model,
+			Choices: []openAIChoice{{
+				Message:      &openAIMessage{Role: "assistant", Content: openAIContent(o.reply)},
+				FinishReason: &stop,
+			}},
+			Usage: &o.tokens,
+		})
+		return
+	}
+
+	// The reply is the content of the root call, unless the chat tool changed it, in which case the streamed content is left as is.
+	if strings.HasPrefix(o.reply, o.sent) {
+		o.send(o.reply[len(o.sent):])
+	}
+	if !o.started {
+		o.start()
+		o.writeChunk(openAIChoice{Delta: &openAIDelta{Role: "assistant"}}, nil)
+	}
+	o.writeChunk(openAIChoice{Delta: &openAIDelta{}, FinishReason: &stop}, nil)
+	if o.usage {
+		o.writeChunk(openAIChoice{}, &o.tokens)
+	}
+	o.writeDone()
+}
+
+// fail responds with the error, or sends it as the last event of the stream if the stream has started.
+func (o *openAICompletion) fail(status int, resp errorResponse) {
+	if !o.started {
+		o.w.WriteHeader(status)
+		writeResponse(o.w, newOpenAIError(status, resp))
+		return
+	}
+
+	o.writeData(newOpenAIError(status, resp))
+	o.writeDone()
+}
+
+func (o *openAICompletion) writeDone() {
+	_, _ = fmt.Fprint(o.w, "data: [DONE]\n\n")
+	if f, ok := o.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
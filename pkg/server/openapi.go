@@ -0,0 +1,307 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	pathParamPattern = regexp.MustCompile(`{([^}]+)}`)
+
+	timeType      = reflect.TypeFor[time.Time]()
+	marshalerType = reflect.TypeFor[json.Marshaler]()
+)
+
+// docsPage serves Swagger UI from a CDN, pointed at the spec of the server.
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>clicky-serves API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+    };
+  </script>
+</body>
+</html>
+`
+
+// openAPISpec returns the OpenAPI spec of the server, which is generated from the route table. It is generated for each request,
+// because whether authentication is enabled can change when the config is reloaded.
+func (s *server) openAPISpec(w http.ResponseWriter, _ *http.Request) {
+	writeResponse(w, newOpenAPISpec(s.routes(), s.current().authEnabled()))
+}
+
+// docs serves Swagger UI for browsing the OpenAPI spec.
+func docs(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(docsPage))
+}
+
+// newOpenAPISpec generates an OpenAPI 3 document from the routes. The schemas of the request and response bodies are generated
+// from their Go types, following the rules of encoding/json.
+func newOpenAPISpec(routes []route, authEnabled bool) map[string]any {
+	sg := newSchemaGenerator("#/components/schemas/")
+
+	errResponse := map[string]any{
+		"description": "An error",
+		"content":     jsonContent(sg.schema(reflect.TypeFor[errorResponse]())),
+	}
+
+	paths := make(map[string]map[string]any)
+	for _, rt := range routes {
+		op := map[string]any{
+			"summary":     rt.summary,
+			"operationId": operationID(rt.method, rt.path),
+		}
+
+		var params []any
+		for _, m := range pathParamPattern.FindAllStringSubmatch(rt.path, -1) {
+			params = append(params, map[string]any{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		query := make([]string, 0, len(rt.query))
+		for name := range rt.query {
+			query = append(query, name)
+		}
+		slices.Sort(query)
+		for _, name := range query {
+			params = append(params, map[string]any{
+				"name":        name,
+				"in":          "query",
+				"description": rt.query[name],
+				"schema":      map[string]any{"type": "string"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if rt.request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(sg.schema(reflect.TypeOf(rt.request))),
+			}
+		}
+
+		ok := map[string]any{"description": "Success"}
+		switch {
+		case rt.stream:
+			ok["content"] = map[string]any{
+				"text/event-stream": map[string]any{"schema": map[string]any{"type": "string"}},
+				ndjsonContentType:   map[string]any{"schema": map[string]any{"type": "string"}},
+			}
+		case rt.response != nil:
+			ok["content"] = jsonContent(sg.schema(reflect.TypeOf(rt.response)))
+		}
+
+		op["responses"] = map[string]any{
+			"200":     ok,
+			"default": errResponse,
+		}
+
+		if rt.scope != scopeNone && authEnabled {
+			op["security"] = []any{map[string]any{"bearerAuth": []string{rt.scope.String()}}}
+		}
+
+		if paths[rt.path] == nil {
+			paths[rt.path] = make(map[string]any)
+		}
+		paths[rt.path][strings.ToLower(rt.method)] = op
+	}
+
+	components := map[string]any{"schemas": sg.schemas}
+	if authEnabled {
+		components["securitySchemes"] = map[string]any{
+			"bearerAuth": map[string]any{
+				"type":        "http",
+				"scheme":      "bearer",
+				"description": "An API key or a JWT",
+			},
+		}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "clicky-serves",
+			"description": "A REST API for running gptscript",
+			"version":     "v1",
+		},
+		"paths":      paths,
+		"components": components,
+	}
+}
+
+// operationID returns an ID for the operation, like getRunsId for GET /runs/{id}.
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		r, size := utf8.DecodeRuneInString(part)
+		id += string(unicode.ToUpper(r)) + part[size:]
+	}
+	return id
+}
+
+func jsonContent(schema any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// schemaGenerator generates the JSON schemas of Go types. Named struct types are added to the schemas of the components
+// and referenced, so that recursive types can be described.
+type schemaGenerator struct {
+	names   map[reflect.Type]string
+	schemas map[string]any
+	// ref is the prefix of the references to the schemas of named struct types, which is where the schemas are put in the document.
+	ref string
+}
+
+func newSchemaGenerator(ref string) *schemaGenerator {
+	return &schemaGenerator{names: make(map[reflect.Type]string), schemas: make(map[string]any), ref: ref}
+}
+
+func (sg *schemaGenerator) schema(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType):
+		// The JSON of a type with a custom encoding can't be known, so it can be anything.
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return sg.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": sg.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": sg.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sg.structSchema(t)
+		}
+		return map[string]any{"$ref": sg.ref + sg.name(t)}
+	default:
+		return map[string]any{}
+	}
+}
+
+// name returns the name of the named struct type in the schemas of the components, generating its schema the first time.
+func (sg *schemaGenerator) name(t reflect.Type) string {
+	if name, ok := sg.names[t]; ok {
+		return name
+	}
+
+	r, size := utf8.DecodeRuneInString(t.Name())
+	name := string(unicode.ToUpper(r)) + t.Name()[size:]
+	if _, ok := sg.schemas[name]; ok {
+		// Another package has a type with the same name.
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		r, size = utf8.DecodeRuneInString(pkg)
+		name = string(unicode.ToUpper(r)) + pkg[size:] + name
+	}
+
+	sg.names[t] = name
+	// Reserve the name before generating the schema, in case the type refers to itself.
+	sg.schemas[name] = nil
+	sg.schemas[name] = sg.structSchema(t)
+
+	return name
+}
+
+func (sg *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	for _, f := range jsonFields(t) {
+		properties[f.name] = sg.schema(f.typ)
+	}
+
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+type jsonField struct {
+	name  string
+	typ   reflect.Type
+	depth int
+}
+
+// jsonFields returns the fields of the struct type as encoding/json sees them: embedded structs without a name in their tag
+// are flattened, and a field that is less deeply embedded takes precedence over fields with the same name.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	seen := make(map[string]int)
+
+	add := func(f jsonField) {
+		if i, ok := seen[f.name]; ok {
+			if fields[i].depth > f.depth {
+				fields[i] = f
+			}
+			return
+		}
+		seen[f.name] = len(fields)
+		fields = append(fields, f)
+	}
+
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+		ft := sf.Type
+		if sf.Anonymous && name == "" {
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct && ft != timeType {
+				for _, ef := range jsonFields(ft) {
+					ef.depth++
+					add(ef)
+				}
+				continue
+			}
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		add(jsonField{name: name, typ: sf.Type})
+	}
+
+	return fields
+}
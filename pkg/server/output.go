@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+// encodingBase64 is the encoding of output that isn't valid UTF-8, like the images and archives that some tools emit, which would
+// be corrupted if it were written as a JSON string.
+const encodingBase64 = "base64"
+
+// encodeOutput returns the output as it is written in responses and events, and its encoding. Output that is valid UTF-8 is
+// returned as it is, with no encoding, and output that isn't is base64 encoded.
+func encodeOutput(out string) (string, string) {
+	if utf8.ValidString(out) {
+		return out, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(out)), encodingBase64
+}
+
+// outputResponse returns the response with the output under the key, and the encoding of the output if it is encoded.
+func outputResponse(key, out string) map[string]string {
+	out, encoding := encodeOutput(out)
+	if encoding == "" {
+		return map[string]string{key: out}
+	}
+	return map[string]string{key: out, "encoding": encoding}
+}
+
+// outputEvent returns the stdout or stderr event of the output, with the encoding of the output if it is encoded.
+func outputEvent(eventType, out string) events.Event {
+	out, encoding := encodeOutput(out)
+	if eventType == events.TypeStderr {
+		return events.Stderr{Time: time.Now(), Stderr: out, Encoding: encoding}
+	}
+	return events.Stdout{Time: time.Now(), Stdout: out, Encoding: encoding}
+}
+
+// getRunRawOutput returns the stdout of the run as it was written, without encoding it, so that binary output can be downloaded as
+// it is. The content type is detected from the output. The status is 202 with no body while the run hasn't ended.
+func (s *server) getRunRawOutput(w http.ResponseWriter, r *http.Request) {
+	run, err := s.store.GetRun(r.Context(), tenantOf(r.Context()), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("run %q not found", r.PathValue("id")))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get run: %w", err))
+		return
+	}
+
+	if run.EndTime == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType([]byte(run.Output)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(run.Output)))
+	_, _ = w.Write([]byte(run.Output))
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+const (
+	// maxOutputSchemaRetries is the most times that a run whose stdout doesn't conform to its output schema can be run again.
+	maxOutputSchemaRetries = 5
+	// maxOutputSchemaDiagnostics is the most problems with the stdout of a run that its error lists.
+	maxOutputSchemaDiagnostics = 10
+	// outputSchemaRetryStatus is the status of the retries of runs whose stdout didn't conform to their output schema, in place of
+	// the status code of an error of the model.
+	outputSchemaRetryStatus = "output_schema"
+)
+
+// compileSchema compiles a JSON schema that runs are validated with, like an output schema. Schemas can only refer to themselves,
+// so that a schema can't make the server read its files or fetch URLs.
+func compileSchema(schema json.RawMessage) (*jsonschema.Schema, error) {
+	c := jsonschema.NewCompiler()
+	c.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("can't load %s, schemas can only refer to themselves", url)
+	}
+	if err := c.AddResource("mem://schema.json", bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	return c.Compile("mem://schema.json")
+}
+
+// validateOutputSchema checks the output schema and the retries of the field of a request.
+func validateOutputSchema(field string, schema json.RawMessage, retries int) error {
+	if len(schema) > 0 {
+		if _, err := compileSchema(schema); err != nil {
+			return invalidField(field, fmt.Sprintf("invalid output schema: %v", err))
+		}
+	}
+	if retries < 0 || retries > maxOutputSchemaRetries {
+		return invalidField(field+"Retries", fmt.Sprintf("output schema retries must be between 0 and %d", maxOutputSchemaRetries))
+	}
+	return nil
+}
+
+// outputSchema is what the stdout of a run is held to: the output schema of the run and the output schema of its registered tool,
+// both of which it must conform to, and how many times the run is run again when it doesn't. A nil outputSchema is of a run
+// whose stdout can be anything.
+type outputSchema struct {
+	schemas []*jsonschema.Schema
+	retries int
+}
+
+// outputSchemaError is the error of a run whose stdout doesn't conform to its output schema. The run fails with it, so that
+// automation that reads the output doesn't get output that it can't handle.
+type outputSchemaError struct {
+	diagnostics []string
+}
+
+func (e *outputSchemaError) Error() string {
+	return "the stdout of the run does not conform to the output schema: " + strings.Join(e.diagnostics, "; ")
+}
+
+type outputSchemaKey struct{}
+
+// withOutputSchema adds the schema to the output schema of the run. The retries of the run are the first that are set, so that the
+// retries of the options of a run take the place of the retries of its registered tool.
+func withOutputSchema(ctx context.Context, schema *jsonschema.Schema, retries int) context.Context {
+	o := &outputSchema{retries: retries}
+	if existing := runOutputSchema(ctx); existing != nil {
+		o.schemas = existing.schemas
+		if existing.retries > 0 {
+			o.retries = existing.retries
+		}
+	}
+	if schema != nil {
+		o.schemas = append(o.schemas[:len(o.schemas):len(o.schemas)], schema)
+	}
+	return context.WithValue(ctx, outputSchemaKey{}, o)
+}
+
+func runOutputSchema(ctx context.Context) *outputSchema {
+	o, _ := ctx.Value(outputSchemaKey{}).(*outputSchema)
+	return o
+}
+
+// retriesLeft reports whether the run can be run again after the given number of retries because its stdout didn't conform.
+func (o *outputSchema) retriesLeft(retries int) bool {
+	return o != nil && len(o.schemas) > 0 && retries < o.retries
+}
+
+// check returns an outputSchemaError if the stdout isn't JSON that conforms to the schemas.
+func (o *outputSchema) check(stdout string) error {
+	if o == nil || len(o.schemas) == 0 {
+		return nil
+	}
+
+	d := json.NewDecoder(strings.NewReader(stdout))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return &outputSchemaError{diagnostics: []string{fmt.Sprintf("the stdout is not valid JSON: %v", err)}}
+	} else if _, err = d.Token(); err != io.EOF {
+		return &outputSchemaError{diagnostics: []string{"the stdout is not valid JSON: there is more than one value"}}
+	}
+
+	var diagnostics []string
+	for _, s := range o.schemas {
+		var validationErr *jsonschema.ValidationError
+		if err := s.Validate(v); errors.As(err, &validationErr) {
+			diagnostics = append(diagnostics, schemaDiagnostics(validationErr)...)
+		} else if err != nil {
+			diagnostics = append(diagnostics, err.Error())
+		}
+	}
+	if len(diagnostics) == 0 {
+		return nil
+	}
+	if len(diagnostics) > maxOutputSchemaDiagnostics {
+		diagnostics = append(diagnostics[:maxOutputSchemaDiagnostics], fmt.Sprintf("and %d more", len(diagnostics)-maxOutputSchemaDiagnostics))
+	}
+	return &outputSchemaError{diagnostics: diagnostics}
+}
+
+// schemaDiagnostics returns the problems that the validation error is made of, each with the location in the stdout that it is
+// about, like "/items/0: missing properties: 'name'".
+func schemaDiagnostics(err *jsonschema.ValidationError) []string {
+	if len(err.Causes) == 0 {
+		location := err.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		return []string{location + ": " + err.Message}
+	}
+
+	var diagnostics []string
+	for _, cause := range err.Causes {
+		diagnostics = append(diagnostics, schemaDiagnostics(cause)...)
+	}
+	return diagnostics
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// parseCacheKey returns the key of the parse of the file, or of the tool content of the input, which is made from the content that
+// is parsed, so that the same content parses to the same key wherever it comes from. If the content of the file can't be read,
+// like when it is a URL, then there is no key and the parse isn't cached.
+func parseCacheKey(ctx context.Context, opts requestOpts, path, input string) (string, bool) {
+	content := input
+	if content == "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", false
+		}
+		content = string(b)
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	key, err := cacheKey(ctx, opts, "parse", hex.EncodeToString(sum[:]))
+	return key, err == nil
+}
+
+// cachedParse returns the response of the parse from the parse cache if it is there. Otherwise, it parses and caches the response if
+// the parse succeeds. If the parse fails, then its error has already been written to the response.
+func (s *server) cachedParse(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string, parse func() ([]byte, error)) ([]byte, error) {
+	if s.parseCache == nil {
+		return parse()
+	}
+
+	key, ok := parseCacheKey(ctx, opts, path, input)
+	if !ok {
+		return parse()
+	}
+
+	if body, ok := s.parseCache.get(key); ok {
+		parseCacheLookups.WithLabelValues(cacheResultHit).Inc()
+		l.Debug("serving parse from the parse cache")
+		w.Header().Set(cacheHeader, "HIT")
+		return []byte(body), nil
+	}
+
+	parseCacheLookups.WithLabelValues(cacheResultMiss).Inc()
+	w.Header().Set(cacheHeader, "MISS")
+
+	body, err := parse()
+	if err == nil {
+		s.parseCache.set(key, string(body))
+	}
+	return body, err
+}
+
+// writeConditional writes the body with an ETag of its content. If the request has the ETag in If-None-Match, because the client
+// already has the body, then the response is a 304 without the body.
+func writeConditional(w http.ResponseWriter, r *http.Request, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	_, _ = w.Write(body)
+}
+
+// etagMatches returns whether the If-None-Match header has the ETag, comparing them weakly as RFC 9110 says to for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gptscript-ai/go-gptscript"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+// runPlan is what a run would do, as it is returned instead of running in dry-run mode.
+type runPlan struct {
+	// Entry is the name of the tool that the run would start with.
+	Entry string `json:"entry"`
+	// Tools are the tools of the document that the run could call, starting with the entry tool.
+	Tools []plannedTool `json:"tools"`
+	// Models are the models that the tools would use. A tool without a model uses the model of the run, and if the run has no
+	// model either, then it uses the default model of gptscript, which isn't listed.
+	Models []string `json:"models"`
+	// External are the tools that the tools reference but that aren't in the document, like system tools and tools from other
+	// files or repositories, which gptscript would load when the run calls them.
+	External []string `json:"external,omitempty"`
+}
+
+// plannedTool is a tool that a run could call.
+type plannedTool struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Args        []string `json:"args,omitempty"`
+	// Tools are the references of the tool to the tools that it can call, to its context, and to its credentials.
+	Tools       []string `json:"tools,omitempty"`
+	Context     []string `json:"context,omitempty"`
+	Credentials []string `json:"credentials,omitempty"`
+	Location    string   `json:"location,omitempty"`
+}
+
+// parseFunc parses the tool or file of a run.
+type parseFunc func(ctx context.Context, opts runner.Options) ([]gptscript.Node, error)
+
+// writePlan parses the tool or file of a run, and writes the plan of the run without running it, so that nothing is spent on the
+// model. The options of the run are checked before this, like they are for a run.
+func (s *server) writePlan(w http.ResponseWriter, r *http.Request, o runOptions, opts requestOpts, env []string, parse parseFunc) {
+	ctx, cancel := s.commandContext(o.context(r.Context(), env))
+	defer cancel()
+
+	l := ccontext.GetLogger(ctx)
+	l.Debug("planning run", "options", o)
+
+	nodes, err := parse(ctx, runnerOptions(ctx, opts))
+	if err != nil {
+		l.Error("Failed to parse tool for dry run", "error", err)
+		writeEngineError(ctx, w, err, "failed to parse tool")
+		return
+	}
+
+	model := o.Model
+	if model == "" {
+		model = s.current().config.DefaultModel
+	}
+
+	plan, err := newRunPlan(nodes, applyDefaultOpts(ctx, opts).SubTool, model)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeResponse(w, plan)
+}
+
+// newRunPlan returns the plan of a run of the parsed tools. The tools that the run could call are found by following the references
+// of the tools from the entry tool.
+func newRunPlan(nodes []gptscript.Node, subTool, model string) (runPlan, error) {
+	entry, byName, err := entryTool(nodes, subTool)
+	if err != nil {
+		return runPlan{}, err
+	}
+
+	plan := runPlan{Entry: entry.Name, Tools: make([]plannedTool, 0), Models: make([]string, 0)}
+	seen := map[string]bool{strings.ToLower(entry.Name): true}
+	for queue := []gptscript.Tool{entry}; len(queue) > 0; queue = queue[1:] {
+		t := queue[0]
+
+		pt := plannedTool{
+			Name:        t.Name,
+			Description: t.Description,
+			Model:       t.ModelName,
+			Tools:       t.Tools,
+			Context:     t.Context,
+			Credentials: t.Credentials,
+		}
+		if pt.Model == "" {
+			pt.Model = model
+		}
+		if pt.Model != "" && !slices.Contains(plan.Models, pt.Model) {
+			plan.Models = append(plan.Models, pt.Model)
+		}
+		if t.Arguments != nil {
+			for name := range t.Arguments.Properties {
+				pt.Args = append(pt.Args, name)
+			}
+			slices.Sort(pt.Args)
+		}
+		if t.Source.Location != "" {
+			pt.Location = fmt.Sprintf("%s:%d", t.Source.Location, t.Source.LineNo)
+		}
+		plan.Tools = append(plan.Tools, pt)
+
+		for _, ref := range slices.Concat(t.Tools, t.GlobalTools, t.Context, t.ExportContext, t.Export, t.Credentials) {
+			name := referencedTool(ref)
+			if local, ok := byName[strings.ToLower(name)]; ok {
+				if !seen[strings.ToLower(name)] {
+					seen[strings.ToLower(name)] = true
+					queue = append(queue, local)
+				}
+			} else if !slices.Contains(plan.External, name) {
+				plan.External = append(plan.External, name)
+			}
+		}
+	}
+
+	slices.Sort(plan.Models)
+	slices.Sort(plan.External)
+	return plan, nil
+}
+
+// entryTool returns the tool that a run of the parsed tools starts with, which is the sub tool if it is set, and the first tool
+// otherwise. The tools are also returned by their names in lower case, since gptscript doesn't match names by case.
+func entryTool(nodes []gptscript.Node, subTool string) (gptscript.Tool, map[string]gptscript.Tool, error) {
+	var tools []gptscript.Tool
+	for _, n := range nodes {
+		if n.ToolNode != nil {
+			tools = append(tools, n.ToolNode.Tool)
+		}
+	}
+	if len(tools) == 0 {
+		return gptscript.Tool{}, nil, fmt.Errorf("there are no tools to run")
+	}
+
+	byName := make(map[string]gptscript.Tool, len(tools))
+	for _, t := range tools {
+		byName[strings.ToLower(t.Name)] = t
+	}
+
+	if subTool == "" {
+		return tools[0], byName, nil
+	}
+
+	t, ok := byName[strings.ToLower(subTool)]
+	if !ok {
+		names := make([]string, 0, len(tools))
+		for _, t := range tools {
+			if t.Name != "" {
+				names = append(names, t.Name)
+			}
+		}
+		return gptscript.Tool{}, nil, invalidField("subTool", fmt.Sprintf("there is no tool named %q, the tools are %s", subTool, strings.Join(names, ", ")))
+	}
+	return t, byName, nil
+}
+
+// referencedTool returns the tool of a reference of a tool to another tool, without its alias or the arguments that it is given,
+// like "search" for "search as find" or "github.com/org/tool" for "github.com/org/tool with query as q".
+func referencedTool(ref string) string {
+	name, _, _ := strings.Cut(ref, " with ")
+	name, _, _ = strings.Cut(name, " as ")
+	return strings.TrimSpace(name)
+}
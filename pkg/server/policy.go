@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gptscript-ai/go-gptscript"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+// ToolPolicy restricts what clients can run. Each restriction only applies if it is set, so the zero policy allows everything.
+type ToolPolicy struct {
+	// FilePaths are patterns, in the syntax of filepath.Match, of the local files that can be run, which include the handles of
+	// uploaded files and registered tools, like registry://search*. If there are none, then any file can be run.
+	FilePaths []string
+	// RemoteTools are patterns, in the syntax of path.Match, of the remote tools that can be run or referenced, like
+	// github.com/gptscript-ai/*. A tool is remote if it is a URL, or a path that starts with a host, like github.com/org/tool. If
+	// there are none, then any remote tool can be run, and a pattern that matches no tool, like "none", denies them all.
+	RemoteTools []string
+	// DeniedInstructions are regular expressions, in the syntax of the regexp package, of the instructions that tools can't have.
+	DeniedInstructions []string
+}
+
+func (p ToolPolicy) validate() error {
+	for _, pattern := range p.FilePaths {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid file path pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range p.RemoteTools {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid remote tool pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range p.DeniedInstructions {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid instructions pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// inspectsTools reports whether the policy restricts what the tools of a run reference or instruct, which can only be checked by
+// parsing them.
+func (p ToolPolicy) inspectsTools() bool {
+	return len(p.RemoteTools) > 0 || len(p.DeniedInstructions) > 0
+}
+
+// policy returns the policy of the client, which is its own policy if it has one, and the policy of every client otherwise.
+func (s *server) policy(client string) ToolPolicy {
+	config := s.current().config
+	if p, ok := config.ClientPolicies[client]; ok {
+		return p
+	}
+	return config.Policy
+}
+
+// policyDenied returns the error of a run that the policy of its client doesn't allow.
+func policyDenied(format string, args ...any) error {
+	return &requestError{code: errorCodePolicyDenied, msg: "denied by policy: " + fmt.Sprintf(format, args...)}
+}
+
+// checkRun checks the options of a run against the locked options and the directories that its tenant can use, the tool or file
+// of a run against the policy of the client of the context, and the input of a file against the arguments of the tool that the
+// run starts with, so that runs that would be denied or fail are rejected before they start. The tool or file is only parsed if
+// the policy restricts what its tools reference or instruct, if the input of the file is a JSON object, or if the run asks for a
+// subTool. The returned status code is the status of the error.
+func (s *server) checkRun(ctx context.Context, item toolOrFile, env []string, path string) (int, error) {
+	client := usageClient(ctx)
+	policy := s.policy(client)
+	l := ccontext.GetLogger(ctx)
+
+	if err := s.limits().check(item); err != nil {
+		return http.StatusRequestEntityTooLarge, err
+	}
+
+	if err := s.checkLockedOpts(client, item.gptscriptOpts()); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := s.checkCacheDir(item.gptscriptOpts().CacheDir); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := s.checkChdir(ctx, item.gptscriptOpts().Chdir); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if item.File != nil {
+		if err := policy.checkFile(item.File.File); err != nil {
+			l.Warn("Denied run by policy", "client", client, "file", item.File.File, "reason", err)
+			return http.StatusForbidden, err
+		}
+	}
+
+	var args map[string]json.RawMessage
+	if item.File != nil && (json.Unmarshal([]byte(item.File.Input), &args) != nil || len(args) == 0) {
+		args = nil
+	}
+	// The subTool of the request is checked, so that a run of a tool that the file doesn't have is rejected with the tools that
+	// it has, instead of failing once it has started.
+	subTool := item.gptscriptOpts().SubTool
+	if !policy.inspectsTools() && args == nil && subTool == "" {
+		return 0, nil
+	}
+
+	ctx, cancel := s.commandContext(item.options().context(ctx, env))
+	defer cancel()
+
+	opts := runnerOptions(ctx, item.gptscriptOpts())
+	var (
+		nodes []gptscript.Node
+		err   error
+	)
+	if item.File != nil {
+		nodes, err = runner.Parse(ctx, path, opts)
+	} else {
+		nodes, err = runner.ParseTool(ctx, item.Tool.tool().String(), opts)
+	}
+	if err != nil {
+		if policy.inspectsTools() {
+			// The tools can't be checked, so the run isn't allowed.
+			return engineError(ctx, err, "failed to parse tool for its policy")
+		}
+		l.Debug("not validating input because the file failed to parse", "error", err)
+		return 0, nil
+	}
+
+	if subTool != "" {
+		if _, _, err = entryTool(nodes, subTool); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	if err = policy.checkTools(nodes); err != nil {
+		l.Warn("Denied run by policy", "client", client, "reason", err)
+		return http.StatusForbidden, err
+	}
+
+	if args != nil {
+		entry, _, err := entryTool(nodes, applyDefaultOpts(ctx, item.gptscriptOpts()).SubTool)
+		if err != nil {
+			l.Debug("not validating input because the entry tool wasn't found", "error", err)
+			return 0, nil
+		}
+		if err = checkArgs(entry, args); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	return 0, nil
+}
+
+// checkFile checks that the file can be run. A remote file must match the remote tools, and a local file the file paths.
+func (p ToolPolicy) checkFile(file string) error {
+	if source, ok := remoteTool(file); ok {
+		if !p.allowsRemoteTool(source) {
+			return policyDenied("remote tool %s is not allowed", source)
+		}
+		return nil
+	}
+
+	if len(p.FilePaths) == 0 {
+		return nil
+	}
+	for _, pattern := range p.FilePaths {
+		if ok, _ := filepath.Match(pattern, file); ok {
+			return nil
+		}
+	}
+	return policyDenied("file %s is not allowed", file)
+}
+
+// checkTools checks the references and the instructions of the parsed tools. Remote tools are loaded by gptscript while the run
+// runs, so only the references of the tools that are parsed are checked, not the references of the remote tools themselves.
+func (p ToolPolicy) checkTools(nodes []gptscript.Node) error {
+	denied := make([]*regexp.Regexp, 0, len(p.DeniedInstructions))
+	for _, pattern := range p.DeniedInstructions {
+		// The patterns were checked when the config was loaded.
+		denied = append(denied, regexp.MustCompile(pattern))
+	}
+
+	for _, n := range nodes {
+		if n.ToolNode == nil {
+			continue
+		}
+		t := n.ToolNode.Tool
+
+		for _, re := range denied {
+			if re.MatchString(t.Instructions) {
+				return policyDenied("the instructions of tool %q are not allowed", t.Name)
+			}
+		}
+
+		for _, ref := range slices.Concat(t.Tools, t.GlobalTools, t.Context, t.ExportContext, t.Export, t.Credentials) {
+			if source, ok := remoteTool(referencedTool(ref)); ok && !p.allowsRemoteTool(source) {
+				return policyDenied("tool %q references remote tool %s, which is not allowed", t.Name, source)
+			}
+		}
+	}
+	return nil
+}
+
+// allowsRemoteTool reports whether the remote tool matches the remote tools of the policy, without the version that it is pinned
+// to, like the @v1 of github.com/org/tool@v1.
+func (p ToolPolicy) allowsRemoteTool(name string) bool {
+	if len(p.RemoteTools) == 0 {
+		return true
+	}
+
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "https://"), "http://")
+	if i := strings.LastIndex(name, "@"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	for _, pattern := range p.RemoteTools {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteTool returns where the tool is loaded from, and whether that is somewhere else that gptscript loads it from, which it is if
+// it is a URL, or a path that starts with a host, like github.com/org/tool. The source of a tool that is named from another
+// file, like "search from github.com/org/tools", is that file.
+func remoteTool(name string) (string, bool) {
+	if _, source, ok := strings.Cut(name, " from "); ok {
+		name = strings.TrimSpace(source)
+	}
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		return name, true
+	}
+
+	host, _, ok := strings.Cut(name, "/")
+	return name, ok && strings.Contains(host, ".") && !strings.HasPrefix(host, ".")
+}
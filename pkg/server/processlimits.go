@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+// ProcessLimits limit the resources that the gptscript process of a run, together with the processes of the tools that it starts,
+// can use on the host. A run that exceeds a limit is killed and fails with an error that names the limit. A limit of 0 means no
+// limit. The limits are only enforced for runs that are executed on the host, and only on Linux; the sandbox and Kubernetes
+// backends have limits of their own.
+type ProcessLimits struct {
+	// CPUTime is the CPU time that the processes of a run can use together.
+	CPUTime time.Duration
+	// Memory is the resident memory in bytes that the processes of a run can use together.
+	Memory int64
+	// Processes is the number of processes that a run can have at once, including gptscript.
+	Processes int
+}
+
+func (l ProcessLimits) validate() error {
+	if l.CPUTime < 0 || l.Memory < 0 || l.Processes < 0 {
+		return errors.New("CPU time, memory, and processes must not be negative")
+	}
+	return nil
+}
+
+func (l ProcessLimits) enabled() bool {
+	return l.CPUTime > 0 || l.Memory > 0 || l.Processes > 0
+}
+
+// processLimits returns the process limits of the client, which are its own if it has them, and those of the config otherwise.
+func (s *server) processLimits(client string) ProcessLimits {
+	config := s.current().config
+	if l, ok := config.ClientProcessLimits[client]; ok {
+		return l
+	}
+	return config.ProcessLimits
+}
+
+// warnProcessLimits warns when process limits are set but won't be enforced, because the server doesn't run on Linux, or because
+// runs aren't executed on the host.
+func warnProcessLimits(config Config, host bool) {
+	enabled := config.ProcessLimits.enabled()
+	for _, l := range config.ClientProcessLimits {
+		enabled = enabled || l.enabled()
+	}
+
+	switch {
+	case !enabled:
+	case !runner.LimitsSupported:
+		slog.Warn("Process limits are only enforced on Linux, so they are ignored")
+	case !host:
+		slog.Warn("Process limits are only enforced for runs on the host, so the limits of the backend apply instead")
+	}
+}
+
+type processLimitsKey struct{}
+
+// withProcessLimits sets the limits of the gptscript processes of a run.
+func withProcessLimits(ctx context.Context, l ProcessLimits) context.Context {
+	return context.WithValue(ctx, processLimitsKey{}, l)
+}
+
+// runLimits returns the limits of the gptscript processes of the run of the context.
+func runLimits(ctx context.Context) runner.Limits {
+	l, _ := ctx.Value(processLimitsKey{}).(ProcessLimits)
+	return runner.Limits(l)
+}
+
+// reportLimitExceeded logs and counts a run that was killed because it exceeded one of its process limits, if it was.
+func reportLimitExceeded(l *slog.Logger, err error) {
+	if le := new(runner.LimitError); errors.As(err, &le) {
+		l.Warn("Killed run because it exceeded a process limit", "resource", le.Resource, "limit", le.Limit)
+		processLimitKills.WithLabelValues(le.Resource).Inc()
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+// progressWriter is an eventWriter that writes a progress event whenever a call of the run starts or finishes, so that clients can
+// show how far along a run is without counting the calls themselves.
+type progressWriter struct {
+	eventWriter
+	// calls are the calls that have started, by their ID, and whether they have finished.
+	calls     map[string]bool
+	completed int
+}
+
+func (p *progressWriter) writeEvent(event any) {
+	p.eventWriter.writeEvent(event)
+
+	e, ok := event.(events.Call)
+	if !ok || (e.Type != events.TypeCallStart && e.Type != events.TypeCallFinish) || e.CallContext == nil {
+		return
+	}
+
+	if p.calls == nil {
+		p.calls = make(map[string]bool)
+	}
+
+	id := e.CallContext.ID
+	finished, started := p.calls[id]
+	switch {
+	case e.Type == events.TypeCallStart && !started:
+		p.calls[id] = false
+	case e.Type == events.TypeCallFinish && !finished:
+		// A call may finish without its start, if the start was not written, so it is counted then.
+		p.calls[id] = true
+		p.completed++
+	default:
+		return
+	}
+
+	p.eventWriter.writeEvent(events.Progress{Time: time.Now(), Progress: events.RunProgress{Completed: p.completed, Total: len(p.calls)}})
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdleTime is how long the limiter of a client is kept after its bucket has refilled.
+const rateLimiterIdleTime = 10 * time.Minute
+
+// RateLimit allows a client to make Requests requests in every Per duration, with bursts of up to Requests requests.
+// The zero value means that requests are not limited.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseRateLimit parses a rate limit in the form "requests/duration", like "10/1m". An empty string means no limit.
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "" {
+		return RateLimit{}, nil
+	}
+
+	requests, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("%q is not in the form requests/duration", s)
+	}
+
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("number of requests must be a positive integer: %q", requests)
+	}
+
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("duration must be positive: %q", per)
+	}
+
+	return RateLimit{Requests: n, Per: d}, nil
+}
+
+// String returns the rate limit in the form that ParseRateLimit parses.
+func (rl RateLimit) String() string {
+	if !rl.enabled() {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s", rl.Requests, rl.Per)
+}
+
+func (rl RateLimit) enabled() bool {
+	return rl.Requests > 0 && rl.Per > 0
+}
+
+// clientRateLimiter limits the rate of requests of each client with a token bucket. Clients are identified by their identity if
+// they are authenticated, and by their IP address otherwise. The limiters are kept by the server rather than by its settings, so
+// that the buckets of the clients are kept when the config is reloaded, even when the limit changes.
+type clientRateLimiter struct {
+	lock      sync.Mutex
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*clientBucket
+	lastPrune time.Time
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientRateLimiter(rl RateLimit) *clientRateLimiter {
+	c := &clientRateLimiter{clients: make(map[string]*clientBucket)}
+	c.setLimit(rl)
+	return c
+}
+
+// setLimit changes the rate limit of every client. The buckets of the clients keep their tokens, so that a client that used up its
+// bucket doesn't get a full one because the limit changed. If the rate limit isn't enabled, then requests are no longer limited.
+func (c *clientRateLimiter) setLimit(rl RateLimit) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !rl.enabled() {
+		c.limit, c.burst = 0, 0
+		clear(c.clients)
+		return
+	}
+
+	limit := rate.Limit(float64(rl.Requests) / rl.Per.Seconds())
+	if limit == c.limit && rl.Requests == c.burst {
+		return
+	}
+
+	now := time.Now()
+	c.limit, c.burst = limit, rl.Requests
+	for _, b := range c.clients {
+		b.limiter.SetLimitAt(now, c.limit)
+		b.limiter.SetBurstAt(now, c.burst)
+	}
+}
+
+// allow takes a token from the bucket of the client. It returns the number of requests in a full bucket, whether the request is
+// allowed, the number of requests that remain, and how long it is until the bucket is full again, or until the next request is
+// allowed if it isn't. If requests aren't limited, then the number of requests in a full bucket is 0 and the request is allowed.
+func (c *clientRateLimiter) allow(client string) (int, bool, int, time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.burst == 0 {
+		return 0, true, 0, 0
+	}
+
+	now := time.Now()
+	c.prune(now)
+
+	b, ok := c.clients[client]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(c.limit, c.burst)}
+		c.clients[client] = b
+	}
+	b.lastSeen = now
+
+	allowed := b.limiter.AllowN(now, 1)
+	tokens := b.limiter.TokensAt(now)
+	if !allowed {
+		return c.burst, false, 0, c.refillTime(1 - tokens)
+	}
+	return c.burst, true, int(tokens), c.refillTime(float64(c.burst) - tokens)
+}
+
+// refillTime returns how long it takes to refill the given number of tokens.
+func (c *clientRateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens / float64(c.limit) * float64(time.Second))
+}
+
+// prune removes the buckets of the clients that haven't made a request for a while. The lock must be held by the caller.
+func (c *clientRateLimiter) prune(now time.Time) {
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = now
+
+	for client, b := range c.clients {
+		if now.Sub(b.lastSeen) > rateLimiterIdleTime {
+			delete(c.clients, client)
+		}
+	}
+}
+
+// rateLimit wraps the handler so that the rate of requests of each client is limited by the limiter of the endpoint class,
+// which is the scope of the endpoint. The RateLimit-* headers are set on every response, and requests over the limit get a 429.
+func (s *server) rateLimit(class scope, h http.HandlerFunc) http.HandlerFunc {
+	if class != scopeParse && class != scopeExec {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, allowed, remaining, reset := s.rateLimiters[class].allow(rateLimitClient(r))
+		if limit == 0 {
+			h(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+
+		if !allowed {
+			rateLimitedRequests.WithLabelValues(class.String()).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded for %s requests, try again later", class))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// rateLimitClient returns the key that the rate of requests of the client is limited by. Identities are only unique within their
+// tenant, and callers whose identity has no name, like those with JWTs without a subject, are limited by their IP address.
+func rateLimitClient(r *http.Request) string {
+	if id := ccontext.GetIdentity(r.Context()); id != nil && id.Name != "" {
+		return "id:" + id.Tenant + "/" + id.Name
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
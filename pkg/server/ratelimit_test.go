@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+func TestRateLimitClient(t *testing.T) {
+	tests := []struct {
+		name string
+		id   *ccontext.Identity
+		want string
+	}{
+		{name: "unauthenticated", want: "ip:192.0.2.1"},
+		{name: "identity", id: &ccontext.Identity{Name: "alice"}, want: "id:/alice"},
+		{name: "identity of a tenant", id: &ccontext.Identity{Name: "alice", Tenant: "acme"}, want: "id:acme/alice"},
+		{name: "identity without a name", id: &ccontext.Identity{Tenant: "acme"}, want: "ip:192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tt.id != nil {
+				r = r.WithContext(ccontext.WithIdentity(r.Context(), tt.id))
+			}
+
+			if got := rateLimitClient(r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientRateLimiterSetLimit(t *testing.T) {
+	c := newClientRateLimiter(RateLimit{Requests: 2, Per: time.Hour})
+	for i := range 2 {
+		if _, allowed, _, _ := c.allow("a"); !allowed {
+			t.Fatalf("request %d was not allowed", i+1)
+		}
+	}
+	if _, allowed, _, _ := c.allow("a"); allowed {
+		t.Fatal("request over the limit was allowed")
+	}
+
+	// Changing the limit doesn't give the client a full bucket.
+	c.setLimit(RateLimit{Requests: 3, Per: time.Hour})
+	if limit, allowed, _, _ := c.allow("a"); allowed || limit != 3 {
+		t.Fatalf("got limit %d and allowed %v after the limit changed, want 3 and false", limit, allowed)
+	}
+	if _, allowed, _, _ := c.allow("b"); !allowed {
+		t.Fatal("request of another client was not allowed")
+	}
+
+	// Requests aren't limited once the limit is disabled.
+	c.setLimit(RateLimit{})
+	if limit, allowed, _, _ := c.allow("a"); !allowed || limit != 0 {
+		t.Fatalf("got limit %d and allowed %v without a limit, want 0 and true", limit, allowed)
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+)
+
+// defaultRedactionReplacement is what redacted text is replaced with if the replacement isn't configured.
+const defaultRedactionReplacement = "[REDACTED]"
+
+// redactionPatterns are the patterns that can be turned on by name, for the secrets and personal data that tools commonly echo.
+var redactionPatterns = map[string]string{
+	"aws-access-key": `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	"aws-secret-key": `(?i)\baws_secret_access_key\b["']?\s*[:=]\s*["']?[0-9A-Za-z/+]{40}\b`,
+	"github-token":   `\b(?:gh[pousr]_[0-9A-Za-z]{36,}|github_pat_[0-9A-Za-z_]{22,})\b`,
+	"openai-key":     `\bsk-[0-9A-Za-z_-]{20,}\b`,
+	"bearer-token":   `(?i)\bbearer\s+[0-9A-Za-z._~+/-]+=*`,
+	"private-key":    `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+	"email":          `\b[0-9A-Za-z._%+-]+@[0-9A-Za-z.-]+\.[A-Za-z]{2,}\b`,
+}
+
+// RedactionConfig configures the redaction of the streams of runs. Text that matches a pattern is replaced in the stdout, stderr,
+// and events of runs before they are streamed to clients or kept in the run history, and the events that had text replaced are
+// marked with "redacted": true.
+type RedactionConfig struct {
+	// Patterns are regular expressions, in the syntax of the regexp package, of the text to redact.
+	Patterns []string
+	// NamedPatterns are the names of built-in patterns of the text to redact: aws-access-key, aws-secret-key, github-token,
+	// openai-key, bearer-token, private-key, and email.
+	NamedPatterns []string
+	// Replacement is what redacted text is replaced with. It defaults to "[REDACTED]".
+	Replacement string
+}
+
+// redactor replaces the text that matches its patterns.
+type redactor struct {
+	patterns    []*regexp.Regexp
+	replacement string
+}
+
+// newRedactor returns the redactor of the config, which is nil if the config has no patterns.
+func newRedactor(config RedactionConfig) (*redactor, error) {
+	if len(config.Patterns) == 0 && len(config.NamedPatterns) == 0 {
+		return nil, nil
+	}
+
+	r := &redactor{replacement: config.Replacement}
+	if r.replacement == "" {
+		r.replacement = defaultRedactionReplacement
+	}
+
+	for _, name := range config.NamedPatterns {
+		pattern, ok := redactionPatterns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown named pattern %q, must be one of %v", name, redactionPatternNames())
+		}
+		r.patterns = append(r.patterns, regexp.MustCompile(pattern))
+	}
+	for _, pattern := range config.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// redactionPatternNames returns the names of the built-in patterns, sorted.
+func redactionPatternNames() []string {
+	names := make([]string, 0, len(redactionPatterns))
+	for name := range redactionPatterns {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// redactString returns the string with the text that matches the patterns replaced, and whether any was.
+func (r *redactor) redactString(s string) (string, bool) {
+	redacted := false
+	for _, re := range r.patterns {
+		if re.MatchString(s) {
+			s, redacted = re.ReplaceAllLiteralString(s, r.replacement), true
+		}
+	}
+	return s, redacted
+}
+
+// redactValue redacts the strings in a value that was decoded from JSON, and returns whether any were.
+func (r *redactor) redactValue(v any) (any, bool) {
+	switch v := v.(type) {
+	case string:
+		return r.redactString(v)
+	case map[string]any:
+		redacted := false
+		for k, e := range v {
+			if e, ok := r.redactValue(e); ok {
+				v[k], redacted = e, true
+			}
+		}
+		return v, redacted
+	case []any:
+		redacted := false
+		for i, e := range v {
+			if e, ok := r.redactValue(e); ok {
+				v[i], redacted = e, true
+			}
+		}
+		return v, redacted
+	default:
+		return v, false
+	}
+}
+
+// redactEvent returns the event with its text redacted, and marked as redacted if any was. Typed events, like the events of the
+// events package, are redacted in their JSON form and decoded back into their type, so that the writers after the redaction still
+// see the type of the event.
+func (r *redactor) redactEvent(event any) any {
+	if e, ok := event.(map[string]any); ok {
+		if _, redacted := r.redactValue(e); redacted {
+			e["redacted"] = true
+		}
+		return e
+	}
+
+	var e map[string]any
+	b, err := json.Marshal(event)
+	if err != nil || json.Unmarshal(b, &e) != nil || e == nil {
+		return event
+	}
+	if _, redacted := r.redactValue(e); !redacted {
+		return event
+	}
+	e["redacted"] = true
+
+	typed := reflect.New(reflect.TypeOf(event))
+	if b, err = json.Marshal(e); err != nil || json.Unmarshal(b, typed.Interface()) != nil {
+		return e
+	}
+	return typed.Elem().Interface()
+}
+
+// redactWriter is an eventWriter that redacts the events of a run before they are written.
+type redactWriter struct {
+	eventWriter
+	redactor *redactor
+}
+
+// withRedaction returns the event writer with the events redacted by the redactor, or the event writer as it is if the redactor
+// is nil.
+func withRedaction(w eventWriter, r *redactor) eventWriter {
+	if r == nil {
+		return w
+	}
+	return &redactWriter{eventWriter: w, redactor: r}
+}
+
+func (r *redactWriter) writeEvent(event any) {
+	r.eventWriter.writeEvent(r.redactor.redactEvent(event))
+}
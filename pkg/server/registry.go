@@ -0,0 +1,475 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/runner"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+// registryScheme is the prefix of the handles of registered tools, like registry://search or registry://search@2 for a version,
+// which can be used as the file of a run.
+const registryScheme = "registry://"
+
+// toolNamePattern is what the names of registered tools must look like, so that they can be used in paths and handles.
+var toolNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// toolRegistration is a new version of a registered tool.
+type toolRegistration struct {
+	Description string `json:"description,omitempty"`
+	// Content is the gptscript text of the tool, which can define several tools, of which the first is the one that is run.
+	Content string `json:"content"`
+	// Limits are what runs of the tool are held to, whatever the options of the run are.
+	Limits *store.ToolLimits `json:"limits,omitempty"`
+}
+
+func (t *toolRegistration) validate() error {
+	if t.Content == "" {
+		return missingField("content", "content is required")
+	}
+	if t.Limits == nil {
+		return nil
+	}
+
+	if t.Limits.Timeout != "" {
+		if timeout, err := time.ParseDuration(t.Limits.Timeout); err != nil {
+			return invalidField("limits.timeout", fmt.Sprintf("invalid timeout: %v", err))
+		} else if timeout <= 0 {
+			return invalidField("limits.timeout", "timeout must be greater than 0")
+		}
+	}
+	if t.Limits.MaxOutputSize < 0 {
+		return invalidField("limits.maxOutputSize", "max output size can't be negative")
+	}
+	if slices.Contains(t.Limits.Models, "") {
+		return invalidField("limits.models", "models can't be empty")
+	}
+	return validateOutputSchema("limits.outputSchema", t.Limits.OutputSchema, t.Limits.OutputSchemaRetries)
+}
+
+// toolRollback makes a version of a registered tool its latest version again.
+type toolRollback struct {
+	Version int `json:"version"`
+}
+
+func (t *toolRollback) validate() error {
+	if t.Version == 0 {
+		return missingField("version", "version is required")
+	}
+	if t.Version < 0 {
+		return invalidField("version", "version must be positive")
+	}
+	return nil
+}
+
+// toolVersion is a version of a registered tool as it is listed, with how its content differs from the version before it.
+type toolVersion struct {
+	store.Tool
+	// Diff is the unified diff of the content of the version before this one and the content of this one, which is only set if
+	// the diff was asked for. It is empty for the first version, and for a version whose content didn't change.
+	Diff string `json:"diff,omitempty"`
+}
+
+// registryRunRequest runs a registered tool, with the options and input of a file run.
+type registryRunRequest struct {
+	fileRequest `json:",inline"`
+	// Version is the version of the tool to run, or 0 for its latest version.
+	Version int `json:"version,omitempty"`
+}
+
+func (r *registryRunRequest) validate() error {
+	if r.File != "" {
+		return invalidField("file", "the file of a registered tool can't be given")
+	}
+	if r.Version < 0 {
+		return invalidField("version", "version must be positive")
+	}
+	return nil
+}
+
+// toolRegistry writes the registered tools to files, so that they can be run like any other file. Each file is named after the
+// hash of its content, so that a file is never changed once it is written, even if a tool is deleted and registered again.
+type toolRegistry struct {
+	dir string
+}
+
+// newToolRegistry returns a registry that writes registered tools to a directory of the upload directory, so that backends can
+// make them available like uploaded files.
+func newToolRegistry(uploadDir string) (*toolRegistry, error) {
+	dir := filepath.Join(uploadDir, ".registry")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create tool registry: %w", err)
+	}
+	return &toolRegistry{dir: dir}, nil
+}
+
+// write writes the content of the tool to its file, if it hasn't been written already, and returns the path of the file.
+func (t *toolRegistry) write(tool store.Tool) (string, error) {
+	sum := sha256.Sum256([]byte(tool.Content))
+	path := filepath.Join(t.dir, hex.EncodeToString(sum[:])+".gpt")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	// The file is written to a temporary name first, so that a partial file can't be run.
+	f, err := os.CreateTemp(t.dir, ".tool-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(tool.Content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, os.Rename(f.Name(), path)
+}
+
+// toolLimits are the limits of a registered tool as they are enforced on its runs. Callers can only tighten them with the options
+// of a run, never loosen them. A nil toolLimits is of a run that isn't of a registered tool, which is only held to the limits of
+// the server.
+type toolLimits struct {
+	timeout       time.Duration
+	maxOutputSize int64
+	models        []string
+	outputSchema  *jsonschema.Schema
+	outputRetries int
+}
+
+// newToolLimits returns the limits of the registered tool, or nil if it has none.
+func newToolLimits(tool store.Tool) (*toolLimits, error) {
+	if tool.Limits == nil {
+		return nil, nil
+	}
+
+	l := &toolLimits{maxOutputSize: tool.Limits.MaxOutputSize, models: tool.Limits.Models, outputRetries: tool.Limits.OutputSchemaRetries}
+	var err error
+	if tool.Limits.Timeout != "" {
+		if l.timeout, err = time.ParseDuration(tool.Limits.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout of registered tool %s: %w", tool.Name, err)
+		}
+	}
+	if len(tool.Limits.OutputSchema) > 0 {
+		if l.outputSchema, err = compileSchema(tool.Limits.OutputSchema); err != nil {
+			return nil, fmt.Errorf("invalid output schema of registered tool %s: %w", tool.Name, err)
+		}
+	}
+	return l, nil
+}
+
+// options returns the options of the run with the model held to the models of the tool. A run that doesn't request a model gets
+// the default model of the server if the tool allows it, or else the first model that the tool allows.
+func (l *toolLimits) options(o runOptions, defaultModel string) (runOptions, error) {
+	if l == nil || len(l.models) == 0 {
+		return o, nil
+	}
+
+	if o.Model == "" {
+		if !slices.Contains(l.models, defaultModel) {
+			o.Model = l.models[0]
+		}
+	} else if !slices.Contains(l.models, o.Model) {
+		return o, invalidField("model", fmt.Sprintf("model %q is not allowed by the tool, must be one of %s", o.Model, strings.Join(l.models, ", ")))
+	}
+	return o, nil
+}
+
+// runTimeout returns the timeout of the run, held to the timeout of the tool.
+func (l *toolLimits) runTimeout(timeout time.Duration) time.Duration {
+	if l == nil || l.timeout == 0 {
+		return timeout
+	}
+	return min(timeout, l.timeout)
+}
+
+// context returns the context of the run with the max output size of the tool, which beginRun holds the max output size of the
+// server to, and with the output schema of the tool.
+func (l *toolLimits) context(ctx context.Context) context.Context {
+	if l == nil {
+		return ctx
+	}
+	if l.maxOutputSize != 0 {
+		ctx = withMaxOutput(ctx, l.maxOutputSize)
+	}
+	if l.outputSchema != nil {
+		ctx = withOutputSchema(ctx, l.outputSchema, l.outputRetries)
+	}
+	return ctx
+}
+
+// registryHandle returns the handle of the version of the registered tool.
+func registryHandle(name string, version int) string {
+	return registryScheme + name + "@" + strconv.Itoa(version)
+}
+
+// resolveRegisteredTool returns the path of the file of the registered tool of the handle, which is its latest version unless the
+// handle has a version, and the limits of that version. It reports whether the file is a handle of a registered tool.
+func (s *server) resolveRegisteredTool(ctx context.Context, file string) (string, *toolLimits, bool, error) {
+	handle, ok := strings.CutPrefix(file, registryScheme)
+	if !ok {
+		return file, nil, false, nil
+	}
+
+	name, version := handle, 0
+	if n, v, ok := strings.Cut(handle, "@"); ok {
+		var err error
+		name = n
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			return "", nil, true, invalidField("file", fmt.Sprintf("invalid version of registered tool %q", file))
+		}
+	}
+
+	tool, err := s.store.GetTool(ctx, tenantOf(ctx), name, version)
+	if errors.Is(err, store.ErrNotFound) {
+		return "", nil, true, invalidField("file", fmt.Sprintf("registered tool %q not found", file))
+	} else if err != nil {
+		return "", nil, true, fmt.Errorf("failed to get registered tool: %w", err)
+	}
+
+	path, err := s.registry.write(tool)
+	if err != nil {
+		return "", nil, true, fmt.Errorf("failed to write registered tool: %w", err)
+	}
+
+	limits, err := newToolLimits(tool)
+	if err != nil {
+		return "", nil, true, err
+	}
+
+	registeredToolUses.WithLabelValues(tool.Tenant, tool.Name).Inc()
+	return path, limits, true, nil
+}
+
+// getRegisteredTool returns the version of the registered tool of the path, or its latest version if the version is 0, and the
+// status code of the error if there is one.
+func (s *server) getRegisteredTool(r *http.Request, version int) (store.Tool, int, error) {
+	tool, err := s.store.GetTool(r.Context(), tenantOf(r.Context()), r.PathValue("name"), version)
+	if errors.Is(err, store.ErrNotFound) {
+		if version == 0 {
+			return store.Tool{}, http.StatusNotFound, fmt.Errorf("tool %q not found", r.PathValue("name"))
+		}
+		return store.Tool{}, http.StatusNotFound, fmt.Errorf("version %d of tool %q not found", version, r.PathValue("name"))
+	} else if err != nil {
+		return store.Tool{}, http.StatusInternalServerError, fmt.Errorf("failed to get tool: %w", err)
+	}
+	return tool, 0, nil
+}
+
+// registerTool adds a new version of the tool of the path, once its content parses.
+func (s *server) registerTool(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !toolNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, invalidField("name", fmt.Sprintf("invalid tool name %q, which must be letters, digits, '.', '_', and '-'", name)))
+		return
+	}
+
+	req := new(toolRegistration)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := s.limits().checkContent("content", req.Content); err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	// The models of the limits must be models of the server, or else no run of the tool could use them.
+	if req.Limits != nil {
+		for _, model := range req.Limits.Models {
+			if _, err := s.modelEnv(model); err != nil {
+				writeError(w, http.StatusBadRequest, invalidField("limits.models", err.Error()))
+				return
+			}
+		}
+	}
+
+	ctx, cancel := s.commandContext(r.Context())
+	defer cancel()
+	ctx, cancel = s.parseContext(ctx)
+	defer cancel()
+
+	if _, err := runner.ParseTool(ctx, req.Content, runnerOptions(ctx, requestOpts{})); errors.Is(context.Cause(ctx), errParseTimeout) {
+		writeError(w, http.StatusBadRequest, invalidField("content", errParseTimeout.Error()))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, invalidField("content", fmt.Sprintf("failed to parse tool: %v", err)))
+		return
+	}
+
+	s.addToolVersion(w, r, store.Tool{Name: name, Description: req.Description, Content: req.Content, Limits: req.Limits})
+}
+
+// rollbackTool adds a new version of the registered tool with the content, description, and limits of the version of the request,
+// so that runs of its latest version run that version again. The versions after it are kept, so that the rollback can be undone.
+func (s *server) rollbackTool(w http.ResponseWriter, r *http.Request) {
+	req := new(toolRollback)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tool, code, err := s.getRegisteredTool(r, req.Version)
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	ccontext.GetLogger(r.Context()).Info("Rolling back registered tool", "tool", tool.Name, "version", tool.Version)
+	s.addToolVersion(w, r, store.Tool{Name: tool.Name, Description: tool.Description, Content: tool.Content, Limits: tool.Limits})
+}
+
+// addToolVersion adds the tool as the latest version of the tool of the tenant of the caller with its name, owned by the caller,
+// and writes it to the response.
+func (s *server) addToolVersion(w http.ResponseWriter, r *http.Request, tool store.Tool) {
+	tool.Tenant, tool.Owner, tool.CreatedAt = tenantOf(r.Context()), chatOwner(r), time.Now()
+
+	tool, err := s.store.AddTool(r.Context(), tool)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to register tool: %w", err))
+		return
+	}
+
+	ccontext.GetLogger(r.Context()).Info("Registered tool", "tool", tool.Name, "version", tool.Version)
+
+	w.WriteHeader(http.StatusCreated)
+	writeResponse(w, tool)
+}
+
+// listRegisteredTools lists the latest version of every registered tool of the tenant of the caller, by name.
+func (s *server) listRegisteredTools(w http.ResponseWriter, r *http.Request) {
+	tools, err := s.store.ListTools(r.Context(), tenantOf(r.Context()))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to list tools: %w", err))
+		return
+	}
+
+	writeResponse(w, map[string][]store.Tool{"tools": tools})
+}
+
+// getRegisteredToolHandler gets the version of the registered tool of the version query parameter, or its latest version.
+func (s *server) getRegisteredToolHandler(w http.ResponseWriter, r *http.Request) {
+	var version int
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			writeError(w, http.StatusBadRequest, invalidField("version", "version must be a positive number"))
+			return
+		}
+	}
+
+	tool, code, err := s.getRegisteredTool(r, version)
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	writeResponse(w, tool)
+}
+
+// listRegisteredToolVersions lists every version of the registered tool, oldest first, with the diff of each version against the
+// version before it if the diff query parameter is true.
+func (s *server) listRegisteredToolVersions(w http.ResponseWriter, r *http.Request) {
+	var withDiff bool
+	if v := r.URL.Query().Get("diff"); v != "" {
+		var err error
+		if withDiff, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, invalidField("diff", fmt.Sprintf("invalid diff %q, must be true or false", v)))
+			return
+		}
+	}
+
+	tools, err := s.store.ListToolVersions(r.Context(), tenantOf(r.Context()), r.PathValue("name"))
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("tool %q not found", r.PathValue("name")))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to list versions: %w", err))
+		return
+	}
+
+	versions := make([]toolVersion, 0, len(tools))
+	for i, t := range tools {
+		v := toolVersion{Tool: t}
+		if withDiff && i > 0 {
+			if v.Diff, err = diffVersions(tools[i-1], t); err != nil {
+				writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to diff versions: %w", err))
+				return
+			}
+		}
+		versions = append(versions, v)
+	}
+
+	writeResponse(w, map[string][]toolVersion{"versions": versions})
+}
+
+// diffVersions returns the unified diff of the content of two versions of a tool.
+func diffVersions(from, to store.Tool) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(from.Content),
+		B:        difflib.SplitLines(to.Content),
+		FromFile: registryHandle(from.Name, from.Version),
+		ToFile:   registryHandle(to.Name, to.Version),
+		Context:  3,
+	})
+}
+
+// deleteRegisteredTool deletes every version of the registered tool. Runs of it that are in progress carry on.
+func (s *server) deleteRegisteredTool(w http.ResponseWriter, r *http.Request) {
+	err := s.store.DeleteTool(r.Context(), tenantOf(r.Context()), r.PathValue("name"))
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("tool %q not found", r.PathValue("name")))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to delete tool: %w", err))
+		return
+	}
+
+	ccontext.GetLogger(r.Context()).Info("Deleted registered tool", "tool", r.PathValue("name"))
+	writeResponse(w, map[string]string{"status": "ok"})
+}
+
+// runRegisteredTool runs the registered tool as a file, at the version of the request or its latest version. The run is recorded
+// with the handle of the version that ran, so that it can be told which version that was.
+func (s *server) runRegisteredTool(w http.ResponseWriter, r *http.Request) {
+	req := new(registryRunRequest)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tool, code, err := s.getRegisteredTool(r, req.Version)
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	req.File = registryHandle(tool.Name, tool.Version)
+	if err = req.fileRequest.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.runFile(w, r, &req.fileRequest, true, s.cachedFile(execFile), nil)
+}
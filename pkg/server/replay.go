@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+// lastEventIDHeader is sent by clients that reconnect to an event stream, with the ID of the last event they received.
+const lastEventIDHeader = "Last-Event-ID"
+
+// eventNotifier notifies the clients that are following the events of a run when the run has new events, or has ended.
+type eventNotifier struct {
+	lock sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+func newEventNotifier() *eventNotifier {
+	return &eventNotifier{subs: make(map[string]map[chan struct{}]struct{})}
+}
+
+// subscribe returns a channel that receives a value when the run changes. The returned function must be called once the
+// caller is no longer interested in the run.
+func (n *eventNotifier) subscribe(runID string) (<-chan struct{}, func()) {
+	// Only whether there has been a change since the last receive matters, so a single buffered value is enough.
+	c := make(chan struct{}, 1)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.subs[runID] == nil {
+		n.subs[runID] = make(map[chan struct{}]struct{})
+	}
+	n.subs[runID][c] = struct{}{}
+
+	return c, func() {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+
+		delete(n.subs[runID], c)
+		if len(n.subs[runID]) == 0 {
+			delete(n.subs, runID)
+		}
+	}
+}
+
+func (n *eventNotifier) notify(runID string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for c := range n.subs[runID] {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// resumeRun wraps the handler of an endpoint that streams the events of a run, so that a client that reconnects to it with the
+// Last-Event-ID header and the X-Run-ID header that the stream responded with is redirected to the events of the run after that ID,
+// instead of the run being started again. GET /runs/{id}/events is the way to resume a stream, and the redirect is only for clients
+// that reconnect to the endpoint that they started the run with. Since the IDs of the events of a stream are only unique within the
+// run, a request without the X-Run-ID header can't be resumed, so it starts a new run like any other request.
+func (s *server) resumeRun(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lastID, runID := r.Header.Get(lastEventIDHeader), r.Header.Get(runIDHeader)
+		if lastID == "" || runID == "" {
+			next(w, r)
+			return
+		}
+
+		ccontext.GetLogger(r.Context()).Debug("redirecting stream of run to its events", "run_id", runID, "last_event_id", lastID)
+		// The event ID is also set in the query, since clients don't always send the headers of a request again after a redirect.
+		q := url.Values{"after": {lastID}}
+		for _, key := range []string{"format", "events"} {
+			if v := r.URL.Query().Get(key); v != "" {
+				q.Set(key, v)
+			}
+		}
+		// See Other has the client get the events with GET, whatever the method of the request was.
+		http.Redirect(w, r, "/runs/"+url.PathEscape(runID)+"/events?"+q.Encode(), http.StatusSeeOther)
+	}
+}
+
+// runEvents streams the events of a run as server sent events or newline-delimited JSON, starting after the event ID in the Last-Event-ID header or the
+// after query parameter. The ID of an event is its position in the stream of the run, starting at 1. If the run is still in
+// progress, then new events are streamed as they are written until the run ends. This lets a client that was disconnected
+// from a streaming endpoint pick up where it left off.
+func (s *server) runEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	after := r.Header.Get(lastEventIDHeader)
+	if after == "" {
+		after = r.URL.Query().Get("after")
+	}
+
+	var (
+		lastID int64
+		err    error
+	)
+	if after != "" {
+		if lastID, err = strconv.ParseInt(after, 10, 64); err != nil || lastID < 0 {
+			writeError(w, http.StatusBadRequest, invalidField("after", fmt.Sprintf("invalid event ID %q", after)))
+			return
+		}
+	}
+
+	// Subscribe before reading the run, so that no change is missed between reading the run and waiting for a change.
+	changed, unsubscribe := s.notifier.subscribe(id)
+	defer unsubscribe()
+
+	run, err := s.store.GetRun(r.Context(), tenantOf(r.Context()), id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("run %q not found", id))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get run: %w", err))
+		return
+	}
+
+	l := ccontext.GetLogger(r.Context()).With("run_id", id)
+	// Only following the run stops when the client disconnects, not the run itself.
+	sw, closeStream := s.openStream(l, w, r)
+	defer closeStream()
+	sw = filterEvents(r, sw)
+
+	for {
+		// The run is read before its events. Every event is stored before the run ends, so if the run had ended, then the
+		// events that are read next are all the events of the run.
+		if run, err = s.store.GetRun(r.Context(), tenantOf(r.Context()), id); err != nil {
+			l.Error("failed to get run", "error", err)
+			return
+		}
+
+		events, err := s.store.ListEvents(r.Context(), id, lastID)
+		if err != nil {
+			l.Error("failed to list events of run", "error", err)
+			return
+		}
+
+		for _, e := range events {
+			sw.writeEncodedEvent(strconv.FormatInt(e.ID, 10), e.Data)
+			lastID = e.ID
+		}
+
+		if run.EndTime != nil {
+			sw.finish()
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
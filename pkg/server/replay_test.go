@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResumeRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		header   map[string]string
+		status   int
+		location string
+	}{
+		{name: "new run", target: "/run-tool-stream", status: http.StatusOK},
+		{name: "no last event ID", target: "/run-tool-stream", header: map[string]string{runIDHeader: "r1"}, status: http.StatusOK},
+		{name: "no run ID", target: "/run-tool-stream", header: map[string]string{lastEventIDHeader: "3"}, status: http.StatusOK},
+		{
+			name:     "resume",
+			target:   "/run-tool-stream",
+			header:   map[string]string{lastEventIDHeader: "3", runIDHeader: "r1"},
+			status:   http.StatusSeeOther,
+			location: "/runs/r1/events?after=3",
+		},
+		{
+			name:     "resume with query",
+			target:   "/run-tool-stream?format=ndjson&events=stdout&input=x",
+			header:   map[string]string{lastEventIDHeader: "3", runIDHeader: "r/1"},
+			status:   http.StatusSeeOther,
+			location: "/runs/r%2F1/events?after=3&events=stdout&format=ndjson",
+		},
+	}
+
+	s := new(server)
+	h := s.resumeRun(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.target, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status is %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("location is %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
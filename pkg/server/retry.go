@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+const (
+	// defaultRetryBackoff is the delay before the first retry of a run if the backoff isn't configured.
+	defaultRetryBackoff = time.Second
+	// defaultRetryMaxBackoff is the longest delay between the attempts of a run if the maximum backoff isn't configured.
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+// defaultRetryOn are the errors of the model that runs are retried on if the errors aren't configured: rate limits and errors of
+// the provider.
+var defaultRetryOn = []string{"429", "5xx"}
+
+// retryStatusPattern finds the status code of the response of the model in the error output of gptscript, like "status code: 429"
+// in the errors of OpenAI compatible providers.
+var retryStatusPattern = regexp.MustCompile(`(?i)status(?: code)?:?\s*(\d{3})\b`)
+
+// RetryConfig configures the retries of runs that fail with transient errors of the model, so that clients don't each need their
+// own retry logic.
+type RetryConfig struct {
+	// MaxAttempts is the number of times that a run is attempted, including the first attempt. Runs are not retried if it is 0 or 1.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, which doubles with each retry up to MaxBackoff. They default to 1s and 30s.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// On are the status codes of the errors of the model that runs are retried on, either a code like 429 or a class like 5xx. They
+	// default to 429 and 5xx.
+	On []string
+}
+
+func (c RetryConfig) validate() error {
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("max attempts must not be negative")
+	}
+	if c.Backoff < 0 || c.MaxBackoff < 0 {
+		return fmt.Errorf("backoff must not be negative")
+	}
+	for _, on := range c.On {
+		if len(on) != 3 || on[0] < '1' || on[0] > '5' || (on[1:] != "xx" && strings.Trim(on[1:], "0123456789") != "") {
+			return fmt.Errorf("invalid status %q, must be a status code like 429 or a class like 5xx", on)
+		}
+	}
+	return nil
+}
+
+// retryable returns the status code of the error of the model that the run failed with, if the run should be retried because of it.
+func (c RetryConfig) retryable(err error) (string, bool) {
+	if errors.As(err, new(*runner.LimitError)) || errors.As(err, new(*runner.OutputLimitError)) {
+		// A run that exceeded a process limit or the max output size would most likely exceed it again.
+		return "", false
+	}
+
+	m := retryStatusPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return "", false
+	}
+
+	on := c.On
+	if len(on) == 0 {
+		on = defaultRetryOn
+	}
+
+	status := m[1]
+	for _, o := range on {
+		if o == status || (strings.HasSuffix(o, "xx") && o[0] == status[0]) {
+			return status, true
+		}
+	}
+	return "", false
+}
+
+// delay returns how long to wait before the retry that follows the given attempt, starting at 1.
+func (c RetryConfig) delay(attempt int) time.Duration {
+	backoff, maxBackoff := c.Backoff, c.MaxBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	d := backoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxBackoff)
+}
+
+type retryKey struct{}
+
+func withRetry(ctx context.Context, c RetryConfig) context.Context {
+	return context.WithValue(ctx, retryKey{}, c)
+}
+
+// retryRun calls attempt until it succeeds, fails with an error that isn't retried, or has been called as many times as the retry
+// config of the context allows. An attempt whose output doesn't conform to the output schema of the context fails, and is retried
+// as many times as the output schema allows, separately from the retries of errors of the model. The attempts of a stream write to
+// w, which holds back the error and the end of the stream of each attempt until it is known whether the run is retried, and writes
+// a retry event in their place if it is. The attempts of runs that aren't streamed are given a nil writer.
+func retryRun(ctx context.Context, l *slog.Logger, w eventWriter, attempt func(w eventWriter) (string, error)) (string, error) {
+	c, _ := ctx.Value(retryKey{}).(RetryConfig)
+	schema := runOutputSchema(ctx)
+	// An input that is streamed to the run can't be read again.
+	if (c.MaxAttempts <= 1 && !schema.retriesLeft(0)) || runStdin(ctx) != nil {
+		out, err := attempt(w)
+		if err == nil {
+			err = schema.check(out)
+		}
+		return out, err
+	}
+
+	for n, invalid := 1, 0; ; {
+		var rw *retryWriter
+		if w != nil {
+			rw = &retryWriter{eventWriter: w}
+		}
+
+		out, err := attempt(rw.writer())
+		if err == nil {
+			if err = schema.check(out); err != nil && schema.retriesLeft(invalid) && ctx.Err() == nil {
+				invalid++
+				l.Warn("Retrying run whose output does not conform to its output schema", "attempt", invalid, "error", err)
+				runRetries.WithLabelValues(outputSchemaRetryStatus).Inc()
+				if w != nil {
+					w.writeEvent(events.Retry{Time: time.Now(), Retry: events.RetryAttempt{
+						Attempt:     invalid + 1,
+						MaxAttempts: schema.retries + 1,
+						Status:      outputSchemaRetryStatus,
+						Error:       err.Error(),
+						Delay:       "0s",
+					}})
+				}
+				continue
+			}
+			rw.release()
+			return out, err
+		}
+		if n >= c.MaxAttempts || ctx.Err() != nil {
+			rw.release()
+			return out, err
+		}
+
+		status, ok := c.retryable(err)
+		if !ok {
+			rw.release()
+			return out, err
+		}
+
+		d := c.delay(n)
+		l.Warn("Retrying run after an error of the model", "status", status, "attempt", n, "delay", d)
+		runRetries.WithLabelValues(status).Inc()
+		if w != nil {
+			w.writeEvent(events.Retry{Time: time.Now(), Retry: events.RetryAttempt{
+				Attempt:     n + 1,
+				MaxAttempts: c.MaxAttempts,
+				Status:      status,
+				Error:       err.Error(),
+				Delay:       d.String(),
+			}})
+		}
+
+		select {
+		case <-ctx.Done():
+			// The run was canceled while waiting to retry it, so the attempt was the last.
+			rw.release()
+			return out, err
+		case <-time.After(d):
+		}
+		n++
+	}
+}
+
+// retryWriter is an eventWriter that holds back the errors and the end of the stream of an attempt of a run, which are only
+// written if the run isn't retried.
+type retryWriter struct {
+	eventWriter
+	errors   []any
+	finished bool
+}
+
+// writer returns the retry writer as an eventWriter, which is nil if the retry writer is.
+func (r *retryWriter) writer() eventWriter {
+	if r == nil {
+		return nil
+	}
+	return r
+}
+
+func (r *retryWriter) writeEvent(event any) {
+	if _, ok := event.(events.Error); ok {
+		r.errors = append(r.errors, event)
+		return
+	}
+
+	r.eventWriter.writeEvent(event)
+}
+
+func (r *retryWriter) finish() {
+	r.finished = true
+}
+
+// release writes what was held back, because the attempt was the last.
+func (r *retryWriter) release() {
+	if r == nil {
+		return
+	}
+
+	for _, e := range r.errors {
+		r.eventWriter.writeEvent(e)
+	}
+	if r.finished {
+		r.eventWriter.finish()
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+// recordWriter is an eventWriter that records the types of the events written to it, and calls onEvent with each of them.
+type recordWriter struct {
+	types    []string
+	finished bool
+	onEvent  func(event any)
+}
+
+func (r *recordWriter) writeEvent(event any) {
+	switch event.(type) {
+	case events.Error:
+		r.types = append(r.types, "error")
+	case events.Retry:
+		r.types = append(r.types, "retry")
+	default:
+		r.types = append(r.types, "other")
+	}
+	if r.onEvent != nil {
+		r.onEvent(event)
+	}
+}
+
+func (r *recordWriter) finish() {
+	r.finished = true
+}
+
+func TestRetryRunCanceledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(withRetry(context.Background(), RetryConfig{MaxAttempts: 3, Backoff: time.Minute}))
+	defer cancel()
+
+	// The run is canceled once the retry is announced, so that it is canceled while waiting to retry.
+	w := &recordWriter{onEvent: func(event any) {
+		if _, ok := event.(events.Retry); ok {
+			cancel()
+		}
+	}}
+
+	var attempts int
+	_, err := retryRun(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), w, func(w eventWriter) (string, error) {
+		attempts++
+		w.writeEvent(events.Error{Time: time.Now(), Err: "model error"})
+		w.finish()
+		return "", errors.New("error, status code: 503")
+	})
+
+	if err == nil {
+		t.Fatal("expected the error of the attempt")
+	}
+	if attempts != 1 {
+		t.Errorf("run was attempted %d times, want 1", attempts)
+	}
+	if want := []string{"retry", "error"}; len(w.types) != len(want) || w.types[0] != want[0] || w.types[1] != want[1] {
+		t.Errorf("events are %v, want %v", w.types, want)
+	}
+	if !w.finished {
+		t.Error("stream was not finished")
+	}
+}
@@ -2,52 +2,210 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/gptscript-ai/go-gptscript"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/thedadams/clicky-serves/pkg/artifacts"
 	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/runner"
+	"github.com/thedadams/clicky-serves/pkg/store"
 )
 
+// toolRunTimeout is the default for the maximum time a request can take.
 const toolRunTimeout = 15 * time.Minute
 
-func addRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("GET /healthz", health)
+// route is an endpoint of the server. The summary and the types of the bodies describe the endpoint in the OpenAPI spec.
+type route struct {
+	method  string
+	path    string
+	scope   scope
+	handler http.HandlerFunc
 
-	mux.HandleFunc("GET /version", version)
-	mux.HandleFunc("GET /list-tools", listTools)
-	mux.HandleFunc("GET /list-models", listModels)
+	summary string
+	// query describes the query parameters of the endpoint, by name.
+	query map[string]string
+	// request and response are values of the types of the request and response bodies, or nil if there is no body.
+	request  any
+	response any
+	// stream is true if the response is a stream of events, as server sent events or newline-delimited JSON.
+	stream bool
+	// resumable is true if the endpoint streams the events of a single run, so that a client that reconnects to it with the
+	// Last-Event-ID and X-Run-ID headers is redirected to the rest of the events of the run instead of starting it again.
+	resumable bool
+	// routed is true if the endpoint is about the run of the {id} of its path, so that it is forwarded to the replica that runs the
+	// run in cluster mode.
+	routed bool
+	// body is the kind of the request body, which decides how large it can be.
+	body bodyKind
+}
 
-	mux.HandleFunc("POST /run-tool", execToolHandler(execTool))
-	mux.HandleFunc("POST /run-tool-stream", execToolHandler(execToolStream))
-	mux.HandleFunc("POST /run-tool-stream-with-events", execToolHandler(execToolStreamWithEvents))
+var (
+	stdoutResponse = map[string]string{"stdout": ""}
+	// stdoutEncodedResponse is the response of runs, whose stdout is base64 encoded, with its encoding, if it isn't valid UTF-8.
+	stdoutEncodedResponse = map[string]string{"stdout": "", "encoding": ""}
+	statusResponse        = map[string]string{"status": ""}
+	streamQuery           = map[string]string{
+		"format": "Set to ndjson to stream newline-delimited JSON instead of server sent events",
+		"events": "Only stream events of these comma-separated types, like callStart,callFinish,stderr. Errors are always streamed",
+	}
+)
 
-	mux.HandleFunc("POST /run-file", execFileHandler(execFile))
-	mux.HandleFunc("POST /run-file-stream", execFileHandler(execFileStream))
-	mux.HandleFunc("POST /run-file-stream-with-events", execFileHandler(execFileStreamWithEvents))
+func (s *server) routes() []route {
+	return []route{
+		{method: http.MethodGet, path: "/healthz", handler: health, summary: "Check whether the server is running", response: statusResponse},
+		{method: http.MethodGet, path: "/readyz", handler: s.ready, summary: "Check whether the server can accept runs", response: readiness{}},
+		{method: http.MethodGet, path: "/metrics", scope: scopeAdmin, handler: promhttp.Handler().ServeHTTP, summary: "Get the Prometheus metrics of the server"},
+		{method: http.MethodGet, path: "/config", scope: scopeAdmin, handler: s.getConfig, summary: "Get the config that is in effect, with secrets redacted", response: fileConfig{}},
+		{method: http.MethodGet, path: "/openapi.json", handler: s.openAPISpec, summary: "Get the OpenAPI spec of the server"},
+		{method: http.MethodGet, path: "/docs", handler: docs, summary: "Browse the API documentation"},
+		{method: http.MethodGet, path: "/events/schema", handler: eventsSchema, summary: "Get the JSON schemas of the events that are streamed for runs"},
+		{method: http.MethodGet, path: "/ui/{file...}", handler: uiHandler(), summary: "Open the playground, a web UI for running pasted or registered tools and watching their calls"},
 
-	mux.HandleFunc("POST /parse", execFileHandler(parse))
-	mux.HandleFunc("POST /fmt", fmtDocument)
-}
+		{method: http.MethodGet, path: "/version", scope: scopeParse, handler: s.getVersion, summary: "Get the versions of the server, the gptscript SDK, and the gptscript that runs are executed with", response: versionInfo{}},
+		{method: http.MethodGet, path: "/list-tools", scope: scopeParse, handler: listTools, summary: "List the built-in tools of gptscript", response: stdoutResponse},
+		{method: http.MethodGet, path: "/list-models", scope: scopeParse, handler: listModels, summary: "List the models that gptscript can use", response: stdoutResponse},
+		{method: http.MethodGet, path: "/tools", scope: scopeParse, handler: s.getTools, summary: "List the built-in tools of the gptscript that runs are executed with, using the default options of the server", response: stdoutResponse},
+		{method: http.MethodGet, path: "/models", scope: scopeParse, handler: s.getModels, summary: "List the models that runs can request, which are the routed models if the server has any, and otherwise those that gptscript can use", response: modelList{}},
 
-// health just provides an endpoint for checking whether the server is running and accessible.
-func health(w http.ResponseWriter, _ *http.Request) {
-	writeResponse(w, map[string]string{"status": "ok"})
-}
+		{method: http.MethodPost, path: "/run-tool", scope: scopeExec, handler: s.execToolHandler(s.cachedTool(execTool), nil), summary: "Run a tool", request: toolRequest{}, response: stdoutEncodedResponse},
+		{method: http.MethodPost, path: "/run-tool-stream", scope: scopeExec, handler: s.streamToolHandler(execToolStream), summary: "Run a tool, streaming its output", query: streamQuery, request: toolRequest{}, stream: true, resumable: true},
+		{method: http.MethodPost, path: "/run-tool-stream-with-events", scope: scopeExec, handler: s.streamToolHandler(execToolStreamWithEvents), summary: "Run a tool, streaming the events of the engine", query: streamQuery, request: toolRequest{}, stream: true, resumable: true},
 
-// version will return the output of `gptscript --version`
-func version(w http.ResponseWriter, r *http.Request) {
-	out, err := gptscript.Version(r.Context())
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get version: %w", err))
-		return
+		{method: http.MethodPost, path: "/run-file", scope: scopeExec, handler: s.execFileHandler(s.cachedFile(execFile), nil), summary: "Run a file", request: fileRequest{}, response: stdoutEncodedResponse},
+		{method: http.MethodPost, path: "/run-file-stream", scope: scopeExec, handler: s.streamFileHandler(execFileStream), summary: "Run a file, streaming its output", query: streamQuery, request: fileRequest{}, stream: true, resumable: true},
+		{method: http.MethodPost, path: "/run-file-stdin", scope: scopeExec, handler: s.stdinFileHandler(execFile, nil), body: bodyStdin, summary: "Run a file, streaming its input from the input part of a multipart form whose request part is the file request", response: stdoutEncodedResponse},
+		{method: http.MethodPost, path: "/run-file-stdin-stream", scope: scopeExec, handler: s.streamStdinFileHandler(execFileStream), body: bodyStdin, summary: "Run a file, streaming its input from the input part of a multipart form and its output to the response", query: streamQuery, stream: true, resumable: true},
+		{method: http.MethodPost, path: "/run-file-stream-with-events", scope: scopeExec, handler: s.streamFileHandler(execFileStreamWithEvents), summary: "Run a file, streaming the events of the engine", query: streamQuery, request: fileRequest{}, stream: true, resumable: true},
+
+		{method: http.MethodGet, path: "/ws", scope: scopeExec, handler: s.websocketHandler, summary: "Run a tool or file over a websocket"},
+
+		{method: http.MethodPost, path: "/batch", scope: scopeExec, handler: s.batch, summary: "Run a batch of tools and files, returning all of their outputs", request: batchRequest{}, response: batchResponse{}},
+		{method: http.MethodPost, path: "/batch-stream", scope: scopeExec, handler: s.batchStream, summary: "Run a batch of tools and files, streaming their interleaved events", query: streamQuery, request: batchRequest{}, stream: true},
+
+		{method: http.MethodPost, path: "/schedules", scope: scopeExec, handler: s.createSchedule, summary: "Create a schedule that runs a tool or file on a cron expression", request: scheduleRequest{}, response: schedule{}},
+		{method: http.MethodGet, path: "/schedules", scope: scopeExec, handler: s.listSchedules, summary: "List the schedules of the caller", response: map[string][]schedule{"schedules": nil}},
+		{method: http.MethodGet, path: "/schedules/{id}", scope: scopeExec, handler: s.getSchedule, summary: "Get a schedule", response: schedule{}},
+		{method: http.MethodPut, path: "/schedules/{id}", scope: scopeExec, handler: s.updateSchedule, summary: "Replace the cron expression and the tool or file of a schedule", request: scheduleRequest{}, response: schedule{}},
+		{method: http.MethodDelete, path: "/schedules/{id}", scope: scopeExec, handler: s.deleteSchedule, summary: "Delete a schedule", response: statusResponse},
+		{method: http.MethodGet, path: "/schedules/{id}/runs", scope: scopeExec, handler: s.scheduleRuns, summary: "List the runs that a schedule started", response: map[string][]store.Run{"runs": nil}},
+
+		{method: http.MethodPost, path: "/chat", scope: scopeExec, handler: s.createChat, summary: "Create a chat with a chat-enabled tool or file", request: chatRequest{}, response: chatSession{}},
+		{method: http.MethodGet, path: "/chat/{id}", scope: scopeExec, handler: s.getChat, summary: "Get a chat", response: chatSession{}},
+		{method: http.MethodDelete, path: "/chat/{id}", scope: scopeExec, handler: s.deleteChat, summary: "Delete a chat", response: statusResponse},
+		{method: http.MethodPost, path: "/chat/{id}/messages", scope: scopeExec, handler: s.sendChatMessage, summary: "Send a message to a chat, streaming the events of the turn", query: streamQuery, request: chatMessage{}, stream: true, resumable: true},
+
+		{method: http.MethodPost, path: "/sessions", scope: scopeExec, handler: s.createSession, summary: "Create a session, whose token can be passed in the X-Session-Token header of runs and chats so that they share a workspace, credentials, and a chat", request: sessionRequest{}, response: sessionInfo{}},
+		{method: http.MethodGet, path: "/sessions/current", scope: scopeExec, handler: s.getSession, summary: "Get the session of the X-Session-Token header", response: sessionInfo{}},
+		{method: http.MethodDelete, path: "/sessions/current", scope: scopeExec, handler: s.deleteSession, summary: "Delete the session of the X-Session-Token header, along with its workspace", response: statusResponse},
+		{method: http.MethodPost, path: "/sessions/current/messages", scope: scopeExec, handler: s.sendSessionMessage, summary: "Send a message to the last chat that was created with the session of the X-Session-Token header, streaming the events of the turn", query: streamQuery, request: chatMessage{}, stream: true, resumable: true},
+
+		{method: http.MethodGet, path: "/usage", scope: scopeExec, handler: s.getUsage, summary: "Get the token usage and estimated cost of runs by client and day, which is only the caller's own unless the caller is an admin", query: map[string]string{
+			"since":  "Only include the usage on or after this date, RFC 3339 timestamp, or this long ago. Defaults to the start of the month",
+			"client": "Only include the usage of this client, for admins",
+		}, response: usageResponse{}},
+		{method: http.MethodGet, path: "/runs", scope: scopeExec, handler: s.listRuns, summary: "List the runs of the tenant of the caller in the run history", query: map[string]string{
+			"status": "Only list runs in this state",
+			"since":  "Only list runs that started after this RFC 3339 timestamp, or this long ago",
+		}, response: map[string][]store.Run{"runs": nil}},
+		{method: http.MethodPost, path: "/runs", scope: scopeExec, handler: s.submitRun, summary: "Run a tool or file, returning its output or, in async mode, its run ID right away", query: map[string]string{
+			"async": "Set to true to start the run in the background and respond with 202 and the run ID without waiting for it to finish",
+		}, request: toolOrFile{}, response: runResult{}},
+		{method: http.MethodGet, path: "/runs/{id}", scope: scopeExec, handler: s.getRun, routed: true, summary: "Get a run and its events", response: runDetails{}},
+		{method: http.MethodGet, path: "/runs/{id}/events", scope: scopeExec, handler: s.runEvents, routed: true, summary: "Stream the events of a run, following it until it ends. A client that was disconnected from a stream of a run resumes it here with the Last-Event-ID header", query: map[string]string{
+			"after":  "Only stream the events after this event ID, unless the Last-Event-ID header is set",
+			"format": streamQuery["format"],
+			"events": streamQuery["events"],
+		}, stream: true},
+		{method: http.MethodGet, path: "/runs/{id}/logs", scope: scopeAdmin, handler: s.getRunLogs, routed: true, summary: "Get the lines that the server logged about a run, at every level", response: map[string][]store.Log{"logs": nil}},
+		{method: http.MethodGet, path: "/runs/{id}/output", scope: scopeExec, handler: s.getRunOutput, routed: true, summary: "Get the outcome of a run, with status 202 until it ends", query: map[string]string{
+			"jmespath": "Transform the JSON stdout of a run that finished with this JMESPath expression, responding with 422 if the stdout isn't JSON",
+			"jq":       "Transform the JSON stdout of a run that finished with this jq filter, responding with 422 if the stdout isn't JSON",
+		}, response: runOutput{}},
+		{method: http.MethodGet, path: "/runs/{id}/output/raw", scope: scopeExec, handler: s.getRunRawOutput, routed: true, summary: "Download the stdout of a run as it was written, with status 202 until it ends"},
+		{method: http.MethodGet, path: "/runs/{id}/artifacts", scope: scopeExec, handler: s.listArtifacts, routed: true, summary: "List the files that a run wrote to its workspace, with status 202 until it ends", response: map[string][]artifacts.Artifact{"artifacts": nil}},
+		{method: http.MethodGet, path: "/runs/{id}/artifacts/{name...}", scope: scopeExec, handler: s.getArtifact, routed: true, summary: "Download a file that a run wrote to its workspace, by its path in the workspace"},
+		{method: http.MethodPost, path: "/runs/{id}/signed-urls", scope: scopeExec, handler: s.createSignedURL, routed: true, summary: "Sign a URL of the output or an artifact of a run, which can be gotten without credentials until it expires, if signed URLs are enabled", request: signedURLRequest{}, response: signedURL{}},
+		{method: http.MethodDelete, path: "/runs/{id}", scope: scopeExec, handler: s.cancelRun, routed: true, summary: "Cancel a run, with all of its calls", response: run{}},
+
+		{method: http.MethodGet, path: "/admin/runs", scope: scopeAdmin, handler: s.listActiveRuns, summary: "List the runs that are queued or running, with how long they have been going and the PIDs of their processes", response: map[string][]activeRun{"runs": nil}},
+		{method: http.MethodGet, path: "/admin/pprof/{name}", scope: scopeAdmin, handler: profile, summary: "Get a runtime profile of the server, like goroutine or heap, in the format of pprof", query: map[string]string{
+			"debug": "Give the profile as text instead, with 1 or 2 for more detail",
+		}},
+		{method: http.MethodGet, path: "/admin/log-level", scope: scopeAdmin, handler: getLogLevel, summary: "Get the minimum level of the logs of the server", response: logLevel{}},
+		{method: http.MethodPut, path: "/admin/log-level", scope: scopeAdmin, handler: setLogLevel, summary: "Change the minimum level of the logs of the server until it restarts or its config is reloaded", request: logLevel{}, response: logLevel{}},
+		{method: http.MethodGet, path: "/admin/drain", scope: scopeAdmin, handler: s.getDrain, summary: "Get whether the server is draining, and how many runs are in progress", response: drainState{}},
+		{method: http.MethodPut, path: "/admin/drain", scope: scopeAdmin, handler: s.setDrain, summary: "Start or stop draining the server, which rejects new runs while the runs in progress carry on", request: drainState{}, response: drainState{}},
+		{method: http.MethodGet, path: "/admin/replicas", scope: scopeAdmin, handler: s.listReplicas, summary: "List the replicas of the server in cluster mode, and whether each is available", response: map[string][]replicaInfo{"replicas": nil}},
+		{method: http.MethodGet, path: "/admin/read-only", scope: scopeAdmin, handler: s.getReadOnly, summary: "Get whether the server is in read-only mode", response: readOnlyState{}},
+		{method: http.MethodPut, path: "/admin/read-only", scope: scopeAdmin, handler: s.setReadOnly, summary: "Turn read-only mode on or off, in which the server only allows parsing, formatting, and listing, and rejects the requests that run something with a 403", request: readOnlyState{}, response: readOnlyState{}},
+		{method: http.MethodPost, path: "/admin/cleanup", scope: scopeAdmin, handler: s.cleanupDisk, summary: "Run the janitor right away, which removes the cache entries, uploaded files, cached tools, and workspaces that are too old or over their max size", response: map[string][]cleanupReport{"areas": nil}},
+
+		{method: http.MethodPut, path: "/credentials/{name}", scope: scopeAdmin, handler: s.putCredential, summary: "Create or replace a credential, which runs can use by listing its name in their credentials", request: credentialRequest{}, response: credential{}},
+		{method: http.MethodGet, path: "/credentials", scope: scopeAdmin, handler: s.listCredentials, summary: "List the credentials, without the values of their environment variables", response: map[string][]credential{"credentials": nil}},
+		{method: http.MethodGet, path: "/credentials/{name}", scope: scopeAdmin, handler: s.getCredential, summary: "Get a credential, without the values of its environment variables", response: credential{}},
+		{method: http.MethodDelete, path: "/credentials/{name}", scope: scopeAdmin, handler: s.deleteCredential, summary: "Delete a credential", response: statusResponse},
+
+		{method: http.MethodPost, path: "/files", scope: scopeExec, handler: s.uploadFile, body: bodyUpload, summary: "Upload a gptscript file as the file field of a multipart form, which can then be run by using the returned handle as the file", response: uploadedFile{}},
+		{method: http.MethodDelete, path: "/files/{id}", scope: scopeExec, handler: s.deleteFile, summary: "Delete an uploaded file", response: statusResponse},
+		{method: http.MethodPut, path: "/registry/{name}", scope: scopeAdmin, handler: s.registerTool, summary: "Register a new version of a named tool, which can then be run by name, or with registry://name or registry://name@version as the file of a run", request: toolRegistration{}, response: store.Tool{}},
+		{method: http.MethodGet, path: "/registry", scope: scopeExec, handler: s.listRegisteredTools, summary: "List the latest version of every registered tool", response: map[string][]store.Tool{"tools": nil}},
+		{method: http.MethodGet, path: "/registry/{name}", scope: scopeExec, handler: s.getRegisteredToolHandler, summary: "Get a registered tool", query: map[string]string{
+			"version": "The version to get. Defaults to the latest version",
+		}, response: store.Tool{}},
+		{method: http.MethodGet, path: "/registry/{name}/versions", scope: scopeExec, handler: s.listRegisteredToolVersions, summary: "List every version of a registered tool, oldest first", query: map[string]string{
+			"diff": "Set to true to include the unified diff of each version against the version before it",
+		}, response: map[string][]toolVersion{"versions": nil}},
+		{method: http.MethodPost, path: "/registry/{name}/rollback", scope: scopeAdmin, handler: s.rollbackTool, summary: "Roll a registered tool back to a version, by adding a new version with the content of that version", request: toolRollback{}, response: store.Tool{}},
+		{method: http.MethodDelete, path: "/registry/{name}", scope: scopeAdmin, handler: s.deleteRegisteredTool, summary: "Delete every version of a registered tool", response: statusResponse},
+		{method: http.MethodPost, path: "/registry/{name}/run", scope: scopeExec, handler: s.runRegisteredTool, summary: "Run a registered tool with only its input and options, at its latest version unless a version is given", request: registryRunRequest{}, response: stdoutEncodedResponse},
+		{method: http.MethodPost, path: "/call/{name}", scope: scopeExec, handler: s.callRegisteredTool, summary: "Call a registered tool like a function, with typed JSON arguments that are checked against the arguments of the tool, returning its output as JSON", request: callRequest{}, response: callResponse{}},
+		{method: http.MethodPost, path: "/cache/refresh", scope: scopeAdmin, handler: s.refreshTools, summary: "Fetch a cached remote tool again, or every cached remote tool the next time that it is run if no tool is given", query: map[string]string{
+			"tool": "The remote tool to fetch again, like github.com/org/repo/tool.gpt@v1",
+		}, response: map[string][]string{"refreshed": nil}},
+
+		{method: http.MethodPost, path: "/workers/jobs", scope: scopeAdmin, handler: s.claimJob, summary: "Claim the next job of the runs for a worker to run, with status 204 if there is none after a while", response: workerJob{}},
+		{method: http.MethodPost, path: "/workers/jobs/{id}", scope: scopeAdmin, handler: s.streamJob, summary: "Stream the output of a job that the worker claimed as newline-delimited JSON frames, until the job exits or its run is done", request: workerFrame{}, response: statusResponse},
+
+		{method: http.MethodPost, path: "/parse", scope: scopeParse, handler: s.parseHandler, summary: "Parse a file, or tool content given as the input", request: parseRequest{}, response: map[string]map[string][]gptscript.Node{"stdout": nil}},
+		{method: http.MethodPost, path: "/graphql", scope: scopeExec, handler: s.graphql, summary: "Query runs, registered tools, sessions, and usage with GraphQL, or subscribe to the events of a run with Accept: text/event-stream, if the GraphQL API is enabled", request: graphQLRequest{}, stream: true},
+		{method: http.MethodPost, path: "/jsonrpc", scope: scopeParse, handler: s.jsonrpc, summary: "Call the parse, exec, stream, and cancel methods with JSON-RPC 2.0, with the events of streams as notifications in a newline-delimited JSON response, if the JSON-RPC API is enabled", request: jsonRPCRequest{}, stream: true},
+		{method: http.MethodPost, path: "/mcp", scope: scopeParse, handler: s.mcp, summary: "List and call the registered tools as the tools of an MCP server, with the Streamable HTTP transport of MCP, if MCP is enabled", request: jsonRPCRequest{}},
+		{method: http.MethodGet, path: "/v1/models", scope: scopeExec, handler: s.listOpenAIModels, summary: "List the chat tool of the OpenAI compatible chat completions API as its only model, if the API is enabled", response: openAIModels{}},
+		{method: http.MethodPost, path: "/v1/chat/completions", scope: scopeExec, handler: s.chatCompletions, summary: "Chat with the chat tool of the config through the chat completions API of OpenAI, with chunks as server sent events if the request streams, if the API is enabled", request: openAIChatRequest{}, response: openAIChatCompletionResponse{}, stream: true},
+		{method: http.MethodPost, path: "/diagnose", scope: scopeParse, handler: s.diagnose, summary: "Find the syntax errors, unknown directives, and unresolved tool references of tool content, with their positions", request: diagnoseRequest{}, response: diagnoseResponse{}},
+		{method: http.MethodPost, path: "/fmt", scope: scopeParse, handler: s.fmtDocument, summary: "Format the nodes returned by /parse as the canonical gptscript text", request: documentRequest{}, response: stdoutResponse},
 	}
+}
 
-	writeResponse(w, map[string]any{"stdout": out})
+func (s *server) addRoutes(mux *http.ServeMux) {
+	for _, rt := range s.routes() {
+		handler := s.limitBody(rt.body, rt.handler)
+		if rt.executes() {
+			handler = s.rejectReadOnly(handler)
+		}
+		if rt.scope == scopeExec {
+			// Every endpoint that runs something can be called with a session.
+			handler = s.withSessionToken(handler)
+		}
+		if rt.resumable {
+			handler = s.resumeRun(handler)
+		}
+		h := s.requireScope(rt.scope, s.rateLimit(rt.scope, handler))
+		if rt.scope == scopeParse || rt.scope == scopeExec {
+			h = s.audit(h)
+		}
+		if rt.routed {
+			h = s.routeRun(h)
+		}
+		mux.HandleFunc(rt.method+" "+rt.path, h)
+	}
 }
 
 // listTools will return the output of `gptscript --list-tools`
@@ -72,56 +230,239 @@ func listModels(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, map[string]any{"stdout": strings.Join(out, "\n")})
 }
 
+// getTools returns the built-in tools of gptscript, from the gptscript that runs are executed with and with the default options
+// of the server.
+func (s *server) getTools(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.commandContext(r.Context())
+	defer cancel()
+
+	out, err := runner.ListTools(ctx, runnerOptions(ctx, requestOpts{}))
+	if err != nil {
+		writeEngineError(ctx, w, err, "failed to list tools")
+		return
+	}
+
+	writeResponse(w, map[string]string{"stdout": out})
+}
+
+// getModels returns the models that runs can request. If the server routes models, then those are the only models that runs can
+// request. Otherwise, they are the models that gptscript can use with the provider of the server.
+func (s *server) getModels(w http.ResponseWriter, r *http.Request) {
+	config := s.current().config
+	if len(config.Models) > 0 {
+		names := make([]string, 0, len(config.Models))
+		for name := range config.Models {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		writeResponse(w, modelList{Models: names, Default: config.DefaultModel, Routed: true})
+		return
+	}
+
+	ctx, cancel := s.commandContext(r.Context())
+	defer cancel()
+
+	models, err := runner.ListModels(ctx, runnerOptions(ctx, requestOpts{}))
+	if err != nil {
+		writeEngineError(ctx, w, err, "failed to list models")
+		return
+	}
+
+	writeResponse(w, modelList{Models: models})
+}
+
+// commandContext returns the context of a gptscript process that isn't a run, like one that lists what runs can use, so that it is
+// started with the backend, the default options, and the process limits of its client, like the process of a run.
+func (s *server) commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = withBackend(withDefaultOpts(ctx, s.defaultOpts(usageClient(ctx))), s.backend())
+	ctx = withCacheRoot(ctx, s.current().config.CacheRoot)
+	ctx = withProcessLimits(ctx, s.processLimits(usageClient(ctx)))
+	return context.WithTimeout(ctx, s.current().config.MaxRunTimeout)
+}
+
 // execToolHandler is a general handler for executing tools with gptscript. This is mainly responsible for parsing the request body.
-// Then the options and tool are passed to the process function.
-func execToolHandler(process func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts gptscript.Opts, tool fmt.Stringer)) http.HandlerFunc {
+// Then the options and tool are passed to the process function. If queued is not nil, then it is called with the position
+// of the run while it waits in the run queue.
+func (s *server) execToolHandler(process func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, tool fmt.Stringer) (string, error), queued queueNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		reqObject := new(toolRequest)
-		if err := json.NewDecoder(r.Body).Decode(reqObject); err != nil {
-			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		if err := decodeRequest(r.Body, reqObject); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if !allowedToolPath(ccontext.GetIdentity(r.Context()), "") {
+			writeError(w, http.StatusForbidden, errors.New("not allowed to run tools that are not files"))
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(r.Context(), toolRunTimeout)
-		defer cancel()
+		timeout, err := s.runTimeout(reqObject.Timeout)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
 
-		l := ccontext.GetLogger(r.Context())
+		env, err := s.runEnv(r.Context(), reqObject.runOptions)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
 
-		l.Debug("executing tool", "tool", reqObject)
-		if reqObject.Content != "" {
-			process(ctx, l, w, reqObject.Opts, &reqObject.FreeForm)
-		} else {
-			process(ctx, l, w, reqObject.Opts, &reqObject.SimpleTool)
+		if code, err := s.checkRun(r.Context(), toolOrFile{Tool: reqObject}, env, ""); err != nil {
+			writeError(w, code, err)
+			return
 		}
+
+		if reqObject.DryRun {
+			s.writePlan(w, r, reqObject.runOptions, reqObject.requestOpts, env, func(ctx context.Context, opts runner.Options) ([]gptscript.Node, error) {
+				return runner.ParseTool(ctx, reqObject.tool().String(), opts)
+			})
+			return
+		}
+
+		ctx, l, end, err := s.beginRun(reqObject.context(r.Context(), env), runTypeTool, reqObject, timeout, w, queued)
+		if err != nil {
+			writeRunError(w, err)
+			return
+		}
+
+		l.Debug("executing tool", "tool", reqObject)
+		end(process(ctx, l, w, reqObject.requestOpts, reqObject.tool()))
 	}
 }
 
 // execFileHandler is a general handler for executing files with gptscript. This is mainly responsible for parsing the request body.
-// Then the options, path, and input are passed to the process function.
-func execFileHandler(process func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts gptscript.Opts, path, input string)) http.HandlerFunc {
+// Then the options, path, and input are passed to the process function. If queued is not nil, then it is called with the position
+// of the run while it waits in the run queue.
+func (s *server) execFileHandler(process func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error), queued queueNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		reqObject := new(fileRequest)
-		if err := json.NewDecoder(r.Body).Decode(reqObject); err != nil {
-			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		if err := decodeRequest(r.Body, reqObject); err != nil {
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
 
-		l := ccontext.GetLogger(r.Context())
+		s.runFile(w, r, reqObject, true, process, queued)
+	}
+}
+
+// parseHandler is an execFileHandler for parsing, where the content to parse can be given as the input instead of a file.
+func (s *server) parseHandler(w http.ResponseWriter, r *http.Request) {
+	reqObject := new(parseRequest)
+	if err := decodeRequest(r.Body, reqObject); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := s.limits().checkContent("input", reqObject.Input); err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	s.runFile(w, r, (*fileRequest)(reqObject), false, s.parse(r), nil)
+}
 
-		l.Debug("executing file", "file", reqObject)
+// runFile runs the process function for the file request, once the caller is allowed to and the run has left the run queue. If
+// check is true, then the file and its input are checked with checkRun before it runs.
+func (s *server) runFile(w http.ResponseWriter, r *http.Request, reqObject *fileRequest, check bool, process func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error), queued queueNotifier) {
+	if reqObject.File != "" && !allowedToolPath(ccontext.GetIdentity(r.Context()), reqObject.File) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("not allowed to run %s", reqObject.File))
+		return
+	}
 
-		ctx, cancel := context.WithTimeout(r.Context(), toolRunTimeout)
-		defer cancel()
+	path, limits, code, err := s.resolveFile(r.Context(), reqObject.File)
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
 
-		process(ctx, l, w, reqObject.Opts, reqObject.File, reqObject.Input)
+	if reqObject.runOptions, err = limits.options(reqObject.runOptions, s.current().config.DefaultModel); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
 	}
+
+	timeout, err := s.runTimeout(reqObject.Timeout)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	timeout = limits.runTimeout(timeout)
+
+	env, err := s.runEnv(r.Context(), reqObject.runOptions)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if check {
+		if code, err := s.checkRun(r.Context(), toolOrFile{File: reqObject}, env, path); err != nil {
+			writeError(w, code, err)
+			return
+		}
+	} else if err = s.checkChdir(r.Context(), reqObject.requestOpts.Chdir); err != nil {
+		// Parses aren't checked like runs, but they still read the files that the file references from the directory.
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if reqObject.DryRun {
+		s.writePlan(w, r, reqObject.runOptions, reqObject.requestOpts, env, func(ctx context.Context, opts runner.Options) ([]gptscript.Node, error) {
+			return runner.Parse(ctx, path, opts)
+		})
+		return
+	}
+
+	ctx, l, end, err := s.beginRun(limits.context(reqObject.context(r.Context(), env)), runTypeFile, reqObject, timeout, w, queued)
+	if err != nil {
+		writeRunError(w, err)
+		return
+	}
+
+	l.Debug("executing file", "file", reqObject)
+	end(process(ctx, l, w, reqObject.requestOpts, path, reqObject.Input))
 }
 
-// fmtDocument will produce a string representation of the document.
-func fmtDocument(w http.ResponseWriter, r *http.Request) {
-	doc := new(gptscript.Document)
-	if err := json.NewDecoder(r.Body).Decode(doc); err != nil {
-		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+// streamToolHandler is an execToolHandler whose process function streams its output to the response, as server sent events
+// or newline-delimited JSON depending on the request.
+func (s *server) streamToolHandler(process func(ctx context.Context, l *slog.Logger, w eventWriter, opts requestOpts, tool fmt.Stringer) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.execToolHandler(func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, tool fmt.Stringer) (string, error) {
+			sw, closeStream := s.openStream(l, w, r)
+			defer closeStream()
+			sw = filterEvents(r, sw)
+
+			return process(ctx, l, s.runEventWriter(ctx, l, sw), opts, tool)
+		}, queuePositionWriter(r))(w, r)
+	}
+}
+
+// streamFileHandler is an execFileHandler whose process function streams its output to the response, as server sent events
+// or newline-delimited JSON depending on the request.
+func (s *server) streamFileHandler(process func(ctx context.Context, l *slog.Logger, w eventWriter, opts requestOpts, path, input string) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.execFileHandler(s.streamFileProcess(r, process), queuePositionWriter(r))(w, r)
+	}
+}
+
+// streamFileProcess returns the process function of an execFileHandler that opens the stream of the request, and runs the process
+// function with it.
+func (s *server) streamFileProcess(r *http.Request, process func(ctx context.Context, l *slog.Logger, w eventWriter, opts requestOpts, path, input string) (string, error)) func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error) {
+	return func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error) {
+		sw, closeStream := s.openStream(l, w, r)
+		defer closeStream()
+		sw = filterEvents(r, sw)
+
+		return process(ctx, l, s.runEventWriter(ctx, l, sw), opts, path, input)
+	}
+}
+
+// fmtDocument formats the nodes of the document as the canonical gptscript text, so that a document that was parsed and edited can
+// be run again. The gptscript process is started with the backend of the server, like the process of a run.
+func (s *server) fmtDocument(w http.ResponseWriter, r *http.Request) {
+	doc := new(documentRequest)
+	if err := decodeRequest(r.Body, doc); err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
@@ -129,12 +470,13 @@ func fmtDocument(w http.ResponseWriter, r *http.Request) {
 
 	l.Debug("formatting document", "document", doc)
 
-	ctx, cancel := context.WithTimeout(r.Context(), toolRunTimeout)
+	ctx, cancel := s.commandContext(r.Context())
 	defer cancel()
 
-	out, err := gptscript.Fmt(ctx, doc.Nodes)
+	out, err := runner.Fmt(ctx, doc.Nodes, runnerOptions(ctx, doc.requestOpts))
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to format document: %w", err))
+		writeEngineError(ctx, w, err, "failed to format document")
+		return
 	}
 
 	writeResponse(w, map[string]string{"stdout": out})
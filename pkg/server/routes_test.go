@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRunRoutesScope(t *testing.T) {
+	// A client that can start runs can also list, get, and cancel them, since they are limited to its tenant.
+	want := map[string]bool{
+		http.MethodGet + " /runs":         true,
+		http.MethodPost + " /runs":        true,
+		http.MethodGet + " /runs/{id}":    true,
+		http.MethodDelete + " /runs/{id}": true,
+	}
+
+	for _, rt := range new(server).routes() {
+		key := rt.method + " " + rt.path
+		if !want[key] {
+			continue
+		}
+		delete(want, key)
+		if rt.scope != scopeExec {
+			t.Errorf("%s requires the %s scope, want %s", key, rt.scope, scopeExec)
+		}
+	}
+	for key := range want {
+		t.Errorf("%s isn't a route", key)
+	}
+}
@@ -10,94 +10,168 @@ import (
 	"log/slog"
 	"net/http"
 	"os/exec"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gptscript-ai/go-gptscript"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/events"
+	"github.com/thedadams/clicky-serves/pkg/runner"
 )
 
-const callTypeConfirm = "callConfirm"
+// parse returns the function that parses the file, or the tool content of the input, and writes the resulting document to the
+// response of the request. The response has an ETag, so that a client that parses the same content again gets a 304 instead of the
+// document, which is served from the parse cache if it is there.
+func (s *server) parse(r *http.Request) func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error) {
+	return func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error) {
+		body, err := s.cachedParse(ctx, l, w, opts, path, input, func() ([]byte, error) {
+			return s.parseDocument(ctx, l, w, opts, path, input)
+		})
+		if err != nil {
+			return "", err
+		}
+
+		writeConditional(w, r, body)
+		return "", nil
+	}
+}
 
-// parse will parse the file and return the corresponding Document.
-func parse(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts gptscript.Opts, path, input string) {
+// parseDocument parses the file, or the tool content of the input, and returns the response of the corresponding Document. If the
+// parse fails, then its error is written to the response.
+func (s *server) parseDocument(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) ([]byte, error) {
 	l.Debug("parsing file", "file", path, "input", input)
 	var (
 		out []gptscript.Node
 		err error
 	)
 
+	// Content that takes too long to parse is rejected, so that it can't keep a process of the server busy for the whole timeout of
+	// the run.
+	ctx, cancel := s.parseContext(ctx)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, "parse")
 	if input != "" {
-		out, err = gptscript.ParseTool(ctx, input)
+		out, err = runner.ParseTool(ctx, input, runnerOptions(ctx, opts))
 	} else {
-		out, err = gptscript.Parse(ctx, path, opts)
+		out, err = runner.Parse(ctx, path, runnerOptions(ctx, opts))
 	}
-	if err != nil {
+	if err = endSpan(span, err); errors.Is(context.Cause(ctx), errParseTimeout) {
+		l.Warn("Parsing took too long", "timeout", s.limits().ParseTimeout)
+		writeError(w, http.StatusBadRequest, &requestError{code: errorCodeInvalidRequest, msg: errParseTimeout.Error()})
+		return nil, errParseTimeout
+	} else if err != nil {
 		l.Error("failed to parse file", "error", err)
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to parse file: %w", err))
-		return
+		writeEngineError(ctx, w, err, "failed to parse file")
+		return nil, err
 	}
 
-	writeResponse(w, map[string]any{"stdout": map[string]any{"nodes": out}})
+	body, err := json.Marshal(map[string]any{"stdout": map[string]any{"nodes": out}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal response: %w", err))
+		return nil, err
+	}
+	return body, nil
 }
 
-// execTool runs the tool with the given options, and writes the output to the response.
-func execTool(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts gptscript.Opts, tool fmt.Stringer) {
-	out, err := gptscript.ExecTool(ctx, opts, tool)
-	if err != nil {
+// runnerOptions returns the options for the gptscript process of a run, with the default options filling in those that aren't set.
+// Its environment includes the trace context and the environment variables that were requested for the run, and it is started
+// with the backend of the run, which reports the PIDs of its processes to the run registry. If the request of the run streams the
+// input of its file, then the process reads it from its standard input.
+func runnerOptions(ctx context.Context, opts requestOpts) runner.Options {
+	return runner.Options{
+		Opts:      applyDefaultOpts(ctx, opts),
+		Env:       append(traceEnv(ctx), ccontext.GetRunEnv(ctx)...),
+		Backend:   runBackend(ctx),
+		Started:   processStarted(ctx),
+		Limits:    runLimits(ctx),
+		MaxOutput: runMaxOutput(ctx),
+		Stdin:     runStdin(ctx),
+	}
+}
+
+// execTool runs the tool with the given options, and writes the output to the response. The output is also returned.
+func execTool(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, tool fmt.Stringer) (string, error) {
+	ctx, span := startSpan(ctx, "exec")
+	out, err := retryRun(ctx, l, nil, func(eventWriter) (string, error) {
+		return runner.ExecTool(ctx, runnerOptions(ctx, opts), tool)
+	})
+	if err = endSpan(span, err); err != nil {
 		l.Error("failed to execute tool", "error", err)
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to execute tool: %w", err))
-		return
+		writeEngineError(ctx, w, err, "failed to execute tool")
+		return "", err
 	}
 
-	writeResponse(w, map[string]string{"stdout": out})
+	writeOutput(ctx, w, out)
+	return out, nil
 }
 
-// execFile runs the file with the given options, and writes the output to the response.
-func execFile(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts gptscript.Opts, path, input string) {
-	out, err := gptscript.ExecFile(ctx, path, input, opts)
-	if err != nil {
+// execFile runs the file with the given options, and writes the output to the response. The output is also returned.
+func execFile(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error) {
+	ctx, span := startSpan(ctx, "exec")
+	out, err := retryRun(ctx, l, nil, func(eventWriter) (string, error) {
+		return runner.ExecFile(ctx, path, input, runnerOptions(ctx, opts))
+	})
+	if err = endSpan(span, err); err != nil {
 		l.Error("failed to execute file", "error", err)
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to execute file: %w", err))
-		return
+		writeEngineError(ctx, w, err, "failed to execute file")
+		return "", err
 	}
 
-	writeResponse(w, map[string]string{"stdout": out})
+	writeOutput(ctx, w, out)
+	return out, nil
 }
 
-// execToolStream runs the tool with the given options, and streams the stdout and stderr of the tool to the response as server sent events.
-func execToolStream(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts gptscript.Opts, tool fmt.Stringer) {
-	stdout, stderr, wait := gptscript.StreamExecTool(ctx, opts, tool)
-	processOutputStream(l, w, stdout, stderr, wait)
+// execToolStream runs the tool with the given options, and streams the stdout and stderr of the tool to the event writer.
+func execToolStream(ctx context.Context, l *slog.Logger, w eventWriter, opts requestOpts, tool fmt.Stringer) (string, error) {
+	ctx, span := startSpan(ctx, "stream")
+	out, err := retryRun(ctx, l, w, func(w eventWriter) (string, error) {
+		stdout, stderr, wait := runner.StreamExecTool(ctx, runnerOptions(ctx, opts), tool)
+		return processOutputStream(ctx, l, w, stdout, stderr, wait)
+	})
+	return out, endSpan(span, err)
 }
 
-// execFile runs the file with the given options, and streams the stdout and stderr of the file to the response as server sent events.
-func execFileStream(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts gptscript.Opts, path, input string) {
-	stdout, stderr, wait := gptscript.StreamExecFile(ctx, path, input, opts)
-	processOutputStream(l, w, stdout, stderr, wait)
+// execFileStream runs the file with the given options, and streams the stdout and stderr of the file to the event writer.
+func execFileStream(ctx context.Context, l *slog.Logger, w eventWriter, opts requestOpts, path, input string) (string, error) {
+	ctx, span := startSpan(ctx, "stream")
+	out, err := retryRun(ctx, l, w, func(w eventWriter) (string, error) {
+		stdout, stderr, wait := runner.StreamExecFile(ctx, path, input, runnerOptions(ctx, opts))
+		return processOutputStream(ctx, l, w, stdout, stderr, wait)
+	})
+	return out, endSpan(span, err)
 }
 
-// execToolStreamWithEvents runs the tool with the given options, and streams the events to the response as server sent events.
-func execToolStreamWithEvents(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts gptscript.Opts, tool fmt.Stringer) {
-	stdout, stderr, events, wait := gptscript.StreamExecToolWithEvents(ctx, opts, tool)
-	processEventStreamOutput(l, w, stdout, stderr, events, wait)
+// execToolStreamWithEvents runs the tool with the given options, and streams the events to the event writer.
+func execToolStreamWithEvents(ctx context.Context, l *slog.Logger, w eventWriter, opts requestOpts, tool fmt.Stringer) (string, error) {
+	ctx, span := startSpan(ctx, "stream")
+	out, err := retryRun(ctx, l, w, func(w eventWriter) (string, error) {
+		stdout, stderr, events, wait := runner.StreamExecToolWithEvents(ctx, runnerOptions(ctx, opts), tool)
+		return processEventStreamOutput(ctx, l, w, stdout, stderr, events, wait)
+	})
+	return out, endSpan(span, err)
 }
 
-// execFileStreamWithEvents runs the file with the given options, and streams the events to the response as server sent events.
-func execFileStreamWithEvents(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts gptscript.Opts, path, input string) {
-	stdout, stderr, events, wait := gptscript.StreamExecFileWithEvents(ctx, path, input, opts)
-	processEventStreamOutput(l, w, stdout, stderr, events, wait)
+// execFileStreamWithEvents runs the file with the given options, and streams the events to the event writer.
+func execFileStreamWithEvents(ctx context.Context, l *slog.Logger, w eventWriter, opts requestOpts, path, input string) (string, error) {
+	ctx, span := startSpan(ctx, "stream")
+	out, err := retryRun(ctx, l, w, func(w eventWriter) (string, error) {
+		stdout, stderr, events, wait := runner.StreamExecFileWithEvents(ctx, path, input, runnerOptions(ctx, opts))
+		return processEventStreamOutput(ctx, l, w, stdout, stderr, events, wait)
+	})
+	return out, endSpan(span, err)
 }
 
-// processOutputStream will stream the stdout and stderr of the tool to the response as server sent events.
-func processOutputStream(l *slog.Logger, w http.ResponseWriter, stdout, stderr io.Reader, wait func() error) {
-	setStreamingHeaders(w)
-
+// processOutputStream will stream the stdout and stderr of the tool to the event writer. The whole stdout is returned.
+func processOutputStream(ctx context.Context, l *slog.Logger, w eventWriter, stdout, stderr io.Reader, wait func() error) (string, error) {
+	var out string
 	lock := new(sync.Mutex)
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		streamOutput(lock, l, w, stdout, "stdout")
+		out = streamOutput(lock, l, w, stdout, "stdout")
 	}()
 
 	go func() {
@@ -105,14 +179,16 @@ func processOutputStream(l *slog.Logger, w http.ResponseWriter, stdout, stderr i
 		streamOutput(lock, l, w, stderr, "stderr")
 	}()
 
-	waitAndFinishStream(l, w, "", func() error {
+	err := waitAndFinishStream(ctx, l, w, "", func() error {
 		wg.Wait()
 		return wait()
 	})
+	return out, err
 }
 
-// streamOutput will stream the output of the tool to the response as server sent events.
-func streamOutput(lock *sync.Mutex, l *slog.Logger, w http.ResponseWriter, stream io.Reader, key string) {
+// streamOutput will stream the output of the tool to the event writer, and returns everything that was read from the stream.
+func streamOutput(lock *sync.Mutex, l *slog.Logger, w eventWriter, stream io.Reader, key string) string {
+	var out strings.Builder
 	s := bufio.NewScanner(stream)
 	s.Split(scan)
 	for s.Scan() {
@@ -122,52 +198,48 @@ func streamOutput(lock *sync.Mutex, l *slog.Logger, w http.ResponseWriter, strea
 
 		// Lock the mutex and write the event to ensure that only one event is written at a time.
 		lock.Lock()
-		writeServerSentEvent(l, w, map[string]string{key: s.Text()})
+		w.writeEvent(outputEvent(key, s.Text()))
 		lock.Unlock()
 
+		out.WriteString(s.Text())
 		l.Debug("wrote event", "event", s.Text(), "key", key)
 	}
+
+	return out.String()
 }
 
-// processEventStreamOutput will stream the events of the tool to the response as server sent events.
+// processEventStreamOutput will stream the events of the tool to the event writer, and returns the stdout of the tool.
 // If an error occurs, then an event with the error will also be sent.
-func processEventStreamOutput(l *slog.Logger, w http.ResponseWriter, stdout, stderr, events io.Reader, wait func() error) {
-	setStreamingHeaders(w)
-
-	streamEvents(l, w, events)
+func processEventStreamOutput(ctx context.Context, l *slog.Logger, w eventWriter, stdout, stderr, eventStream io.Reader, wait func() error) (string, error) {
+	streamEvents(l, w, eventStream)
 
 	// Read the output of the script.
 	out, err := io.ReadAll(stdout)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to read stdout: %w", err))
-		return
+		w.writeEvent(events.Error{Time: time.Now(), Err: fmt.Sprintf("failed to read stdout: %v", err)})
+		return "", err
 	}
 
 	stdErr, err := io.ReadAll(stderr)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to read stderr: %w", err))
-		return
+		w.writeEvent(events.Error{Time: time.Now(), Err: fmt.Sprintf("failed to read stderr: %v", err)})
+		return "", err
 	}
 
-	writeServerSentEvent(l, w, map[string]any{
-		"time":   time.Now(),
-		"stderr": string(stdErr),
-	})
-	writeServerSentEvent(l, w, map[string]any{
-		"time":   time.Now(),
-		"stdout": string(out),
-	})
+	w.writeEvent(events.Stderr{Time: time.Now(), Stderr: string(stdErr)})
+	w.writeEvent(outputEvent(events.TypeStdout, string(out)))
 
-	waitAndFinishStream(l, w, string(stdErr), wait)
+	return string(out), waitAndFinishStream(ctx, l, w, string(stdErr), wait)
 }
 
-// streamEvents will stream the events of the tool to the response as server sent events.
-// This looks for and tries to handle confirm events as well. However, that currently is not implemented in the SDK.
-func streamEvents(l *slog.Logger, w http.ResponseWriter, events io.Reader) {
+// streamEvents will stream the events of the tool to the event writer.
+// Runs aren't started with confirmation, since the gptscript SDK can't send gptscript a decision, so there are no callConfirm
+// events to answer. Any that gptscript sends anyway are passed through after an event of the same run.
+func streamEvents(l *slog.Logger, w eventWriter, eventStream io.Reader) {
 	var (
 		lastRunID   string
-		eventBuffer []map[string]any
-		buffer      = bufio.NewScanner(events)
+		eventBuffer []events.Call
+		buffer      = bufio.NewScanner(eventStream)
 	)
 
 	l.Debug("receiving events")
@@ -177,7 +249,7 @@ func streamEvents(l *slog.Logger, w http.ResponseWriter, events io.Reader) {
 			continue
 		}
 
-		var e map[string]any
+		var e events.Call
 		err := json.Unmarshal(buffer.Bytes(), &e)
 		if err != nil {
 			l.Error("failed to unmarshal event", "error", err, "event", buffer.Text())
@@ -185,54 +257,80 @@ func streamEvents(l *slog.Logger, w http.ResponseWriter, events io.Reader) {
 		}
 
 		// Ensure that the callConfirm event is after an event with the same runID.
-		if (len(eventBuffer) > 0 || e["type"] == callTypeConfirm) && lastRunID != e["runID"] {
+		if (len(eventBuffer) > 0 || e.Type == events.TypeCallConfirm) && lastRunID != e.RunID {
 			eventBuffer = append(eventBuffer, e)
-			lastRunID = fmt.Sprint(e["runID"])
+			lastRunID = e.RunID
 			continue
 		}
 
 		for _, ev := range eventBuffer {
-			writeServerSentEvent(l, w, ev)
+			w.writeEvent(ev)
 		}
 
 		eventBuffer = nil
-		lastRunID = fmt.Sprint(e["runID"])
+		lastRunID = e.RunID
 
-		writeServerSentEvent(l, w, e)
+		w.writeEvent(e)
 	}
 
 	l.Debug("done receiving events")
 }
 
 // waitAndFinishStream will wait for the tool to finish running, and will send any error events, if necessary.
-// Finally, it will send the DONE event after everything has finished.
-func waitAndFinishStream(l *slog.Logger, w http.ResponseWriter, stdErr string, wait func() error) {
-	var execErrOutput string
+// Finally, it will send the DONE event after everything has finished. The returned error describes why the run failed, if it did.
+func waitAndFinishStream(ctx context.Context, l *slog.Logger, w eventWriter, stdErr string, wait func() error) error {
+	var (
+		execErrOutput string
+		cause         error
+		limitErr      *runner.LimitError
+		outputErr     *runner.OutputLimitError
+		// exitCode is the exit code of gptscript, if it exited with one, which is in the error event so that clients can exit with it.
+		exitCode int
+	)
 	err := wait()
-	if errors.Is(err, context.DeadlineExceeded) {
+	// The output limit is checked first, because the process is stopped by canceling its context when its output exceeds the limit.
+	if errors.As(err, &outputErr) {
+		l.Warn("Stopped run because its output exceeded the max output size", "limit", outputErr.Limit)
+		outputTruncated.Inc()
+		w.writeEvent(events.Truncated{Time: time.Now(), Truncated: events.Truncation{Limit: outputErr.Limit}})
+		execErrOutput = fmt.Sprintf("The output of the tool call exceeded the limit of %d bytes, so it was truncated and the tool call was stopped", outputErr.Limit)
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// When the context is done, the process is killed and the error is the exit error of the process, so check the context too.
 		execErrOutput = "The tool call took too long to complete, aborting"
+		cause = context.DeadlineExceeded
+	} else if errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled) {
+		execErrOutput = "The tool call was canceled"
+	} else if errors.As(err, &limitErr) {
+		execErrOutput = fmt.Sprintf("The tool call was killed because the run exceeded its %s limit of %s", limitErr.Resource, limitErr.Limit)
 	} else if execErr := new(exec.ExitError); errors.As(err, &execErr) {
-		execErrOutput = fmt.Sprintf("The tool call returned an exit code of %d with message %q and output %q", execErr.ExitCode(), execErr.String(), stdErr)
+		exitCode = execErr.ExitCode()
+		execErrOutput = fmt.Sprintf("The tool call returned an exit code of %d with message %q and output %q", exitCode, execErr.String(), stdErr)
+		cause = &runner.CommandError{Stderr: stdErr, Err: err}
 	} else if err != nil {
 		execErrOutput = fmt.Sprintf("failed to wait: %v, error output: %s", err, stdErr)
 	}
 
 	if execErrOutput != "" {
-		writeServerSentEvent(l, w, map[string]any{
-			"time": time.Now(),
-			"err":  execErrOutput,
-		})
+		w.writeEvent(events.Error{Time: time.Now(), Err: execErrOutput, ExitCode: exitCode})
 	}
 
 	// Now that we have received all events, send the DONE event.
-	_, err = w.Write([]byte("data: [DONE]\n\n"))
-	if err == nil {
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
-		}
-	}
+	w.finish()
 
 	l.Debug("wrote DONE event")
+
+	// The limit errors are returned as they are, so that the run is reported as having exceeded its limit, and isn't retried.
+	if outputErr != nil {
+		return outputErr
+	} else if limitErr != nil {
+		return limitErr
+	} else if execErrOutput != "" {
+		if cause == nil {
+			cause = err
+		}
+		return &runError{msg: execErrOutput, err: cause}
+	}
+	return nil
 }
 
 func writeResponse(w http.ResponseWriter, v any) {
@@ -245,44 +343,6 @@ func writeResponse(w http.ResponseWriter, v any) {
 	_, _ = w.Write(b)
 }
 
-func writeError(w http.ResponseWriter, code int, err error) {
-	w.WriteHeader(code)
-	resp := map[string]any{
-		"error": err.Error(),
-	}
-
-	b, err := json.Marshal(resp)
-	if err != nil {
-		_, _ = w.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
-		return
-	}
-
-	_, _ = w.Write(b)
-}
-
-func writeServerSentEvent(l *slog.Logger, w http.ResponseWriter, event any) {
-	ev, err := json.Marshal(event)
-	if err != nil {
-		l.Warn("failed to marshal event", "error", err)
-		return
-	}
-
-	_, err = w.Write([]byte(fmt.Sprintf("data: %s\n\n", ev)))
-	if err == nil {
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
-		}
-	}
-
-	l.Debug("wrote event", "event", string(ev))
-}
-
-func setStreamingHeaders(w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-}
-
 // scan is a split function for a bufio.Scanner that returns whatever data is in the buffer.
 func scan(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if atEOF && len(data) == 0 {
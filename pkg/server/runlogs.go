@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+// maxRunLogs is the number of lines that are kept of the logs of a run. The lines after them are still logged, but aren't kept.
+const maxRunLogs = 1000
+
+// runLogHandler keeps the lines that are logged about a run in the run history, at every level, before passing the lines that are
+// at the level of the logs of the server to them. That way, the debug logs of a run can be looked at without logging debug lines
+// for every run.
+type runLogHandler struct {
+	h     slog.Handler
+	store store.Store
+	runID string
+	// group is the prefix of the keys of the attributes, from the groups that the handler is in.
+	group string
+	attrs map[string]any
+	// lines is the number of lines of the run that have been kept, which is shared by the handlers of the run.
+	lines *atomic.Int64
+}
+
+// runLogger returns the logger of a run, which keeps what is logged with it in the run history.
+func (s *server) runLogger(l *slog.Logger, runID string) *slog.Logger {
+	return slog.New(&runLogHandler{h: l.Handler(), store: s.store, runID: runID, lines: new(atomic.Int64)})
+}
+
+func (h *runLogHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *runLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if h.lines.Add(1) <= maxRunLogs {
+		attrs := make(map[string]any, len(h.attrs)+record.NumAttrs())
+		for k, v := range h.attrs {
+			attrs[k] = v
+		}
+		record.Attrs(func(a slog.Attr) bool {
+			addLogAttr(attrs, h.group, a)
+			return true
+		})
+
+		// A line that can't be kept isn't worth failing the run over, and it is still logged below.
+		_ = h.store.AddLog(context.WithoutCancel(ctx), h.runID, store.Log{
+			Time:    record.Time,
+			Level:   record.Level.String(),
+			Message: record.Message,
+			Attrs:   attrs,
+		})
+	}
+
+	if !h.h.Enabled(ctx, record.Level) {
+		return nil
+	}
+	return h.h.Handle(ctx, record)
+}
+
+func (h *runLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.h = h.h.WithAttrs(attrs)
+	c.attrs = make(map[string]any, len(h.attrs)+len(attrs))
+	for k, v := range h.attrs {
+		c.attrs[k] = v
+	}
+	for _, a := range attrs {
+		addLogAttr(c.attrs, h.group, a)
+	}
+	return &c
+}
+
+func (h *runLogHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.h = h.h.WithGroup(name)
+	c.group = h.group + name + "."
+	return &c
+}
+
+// addLogAttr adds the attribute to the attributes of a line, flattening groups into keys joined by dots.
+func addLogAttr(attrs map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindGroup:
+		// The attributes of a group without a key are inlined.
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			addLogAttr(attrs, prefix, ga)
+		}
+		return
+	case slog.KindDuration:
+		attrs[prefix+a.Key] = v.Duration().String()
+		return
+	case slog.KindAny:
+		// Errors and other values that don't marshal to JSON are kept as their text.
+		if err, ok := v.Any().(error); ok {
+			attrs[prefix+a.Key] = err.Error()
+			return
+		}
+		if s, ok := v.Any().(fmt.Stringer); ok {
+			attrs[prefix+a.Key] = s.String()
+			return
+		}
+	}
+	if a.Key != "" {
+		attrs[prefix+a.Key] = v.Any()
+	}
+}
+
+// getRunLogs returns the lines that the server logged about a run, at every level, even those below the level of the logs of the
+// server.
+func (s *server) getRunLogs(w http.ResponseWriter, r *http.Request) {
+	run, err := s.store.GetRun(r.Context(), tenantOf(r.Context()), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("run %q not found", r.PathValue("id")))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get run: %w", err))
+		return
+	}
+
+	logs, err := s.store.ListLogs(r.Context(), run.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get logs of run: %w", err))
+		return
+	}
+
+	writeResponse(w, map[string][]store.Log{"logs": logs})
+}
@@ -0,0 +1,596 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/events"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+const (
+	runIDHeader = "X-Run-ID"
+
+	// runRetention is how long a run is kept in the registry after it has ended.
+	runRetention = time.Hour
+)
+
+type runType string
+
+const (
+	runTypeTool runType = "tool"
+	runTypeFile runType = "file"
+	runTypeChat runType = "chat"
+)
+
+type runState string
+
+const (
+	runStateQueued   runState = "queued"
+	runStateRunning  runState = "running"
+	runStateFinished runState = "finished"
+	runStateFailed   runState = "failed"
+	runStateCanceled runState = "canceled"
+)
+
+type run struct {
+	ID         string     `json:"id"`
+	Type       runType    `json:"type"`
+	State      runState   `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	StartTime  time.Time  `json:"startTime"`
+	EndTime    *time.Time `json:"endTime,omitempty"`
+	ScheduleID string     `json:"scheduleID,omitempty"`
+	// Client is the name of the caller that started the run, which its usage is accounted to, and Tenant is the tenant of the
+	// caller, which is the only tenant that can see the run.
+	Client string       `json:"client,omitempty"`
+	Tenant string       `json:"tenant,omitempty"`
+	Usage  *store.Usage `json:"usage,omitempty"`
+
+	// model is the default model of the run.
+	model string
+	// input is the request that started the run, and output is the stdout of the run once it has ended.
+	input  json.RawMessage
+	output string
+
+	cancel context.CancelFunc
+	// started is true once the run has left the queue.
+	started bool
+	// pids are the PIDs of the processes that the run started on the host.
+	pids []int
+}
+
+// record returns the run as it is kept in the run history.
+func (r *run) record() store.Run {
+	return store.Run{
+		ID:         r.ID,
+		Type:       string(r.Type),
+		State:      string(r.State),
+		Error:      r.Error,
+		Input:      r.input,
+		Output:     r.output,
+		StartTime:  r.StartTime,
+		EndTime:    r.EndTime,
+		ScheduleID: r.ScheduleID,
+		Client:     r.Client,
+		Tenant:     r.Tenant,
+		Usage:      r.Usage,
+	}
+}
+
+// runRegistry keeps track of the runs that are in progress, and the runs that have recently ended.
+// Every change to a run is also saved to the store, which keeps the history of runs.
+type runRegistry struct {
+	lock  sync.RWMutex
+	runs  map[string]*run
+	store store.Store
+}
+
+func newRunRegistry(s store.Store) *runRegistry {
+	return &runRegistry{runs: make(map[string]*run), store: s}
+}
+
+// start registers a new run in the queued state. The cancel function is called if the run is canceled through the registry.
+// If the run was started by a schedule, then scheduleID is the ID of the schedule.
+func (rr *runRegistry) start(ctx context.Context, t runType, input json.RawMessage, cancel context.CancelFunc) run {
+	// Runs that are started in the background are given their ID before they start, so that it can be returned to the client.
+	id := ccontext.GetRunID(ctx)
+	if id == "" {
+		id = uuid.NewString()
+	}
+
+	r := &run{
+		ID:         id,
+		Type:       t,
+		State:      runStateQueued,
+		StartTime:  time.Now(),
+		ScheduleID: scheduleID(ctx),
+		Client:     usageClient(ctx),
+		Tenant:     tenantOf(ctx),
+
+		model: runModel(ctx),
+
+		input:  input,
+		cancel: cancel,
+	}
+
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	rr.prune()
+	rr.runs[r.ID] = r
+	rr.save(r)
+
+	return *r
+}
+
+// running records that the run has left the queue and started running.
+func (rr *runRegistry) running(id string) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	if r, ok := rr.runs[id]; ok && r.State == runStateQueued {
+		r.State = runStateRunning
+		r.started = true
+		rr.save(r)
+
+		runsStarted.WithLabelValues(string(r.Type), r.Tenant).Inc()
+		activeRuns.Inc()
+	}
+}
+
+// finish records the outcome of the run. A canceled run stays canceled regardless of the error.
+func (rr *runRegistry) finish(id, output string, err error) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	r, ok := rr.runs[id]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	r.EndTime = &now
+	r.output = output
+	if r.State != runStateCanceled {
+		if err != nil {
+			r.State = runStateFailed
+			r.Error = err.Error()
+		} else {
+			r.State = runStateFinished
+		}
+	}
+
+	if r.started {
+		activeRuns.Dec()
+	}
+
+	var usage store.Usage
+	if r.Usage != nil {
+		usage = *r.Usage
+	}
+	if err := rr.store.AddUsage(context.Background(), r.Tenant, r.Client, startOfDay(now), usage); err != nil {
+		slog.Error("Failed to add usage of run", "run_id", r.ID, "error", err)
+	}
+	runsCompleted.WithLabelValues(string(r.Type), string(r.State), r.Tenant).Inc()
+	runDuration.WithLabelValues(string(r.Type), string(r.State), r.Tenant).Observe(now.Sub(r.StartTime).Seconds())
+
+	rr.save(r)
+}
+
+// addUsage adds the usage of a call of the run to the usage of the run, and returns the usage of the run so far.
+func (rr *runRegistry) addUsage(id string, usage store.Usage) store.Usage {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	r, ok := rr.runs[id]
+	if !ok {
+		return usage
+	}
+
+	if r.Usage == nil {
+		r.Usage = new(store.Usage)
+	}
+	r.Usage.Add(usage)
+	return *r.Usage
+}
+
+// addPID records that the run started a process on the host with the PID.
+func (rr *runRegistry) addPID(id string, pid int) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	if r, ok := rr.runs[id]; ok {
+		r.pids = append(r.pids, pid)
+	}
+}
+
+// active returns the runs that are queued or running, oldest first, along with the PIDs of their processes.
+func (rr *runRegistry) active() []activeRun {
+	return rr.activeOf(func(*run) bool { return true })
+}
+
+// activeOf returns the runs that are queued or running and that match, like active.
+func (rr *runRegistry) activeOf(match func(*run) bool) []activeRun {
+	rr.lock.RLock()
+	defer rr.lock.RUnlock()
+
+	now := time.Now()
+	runs := make([]activeRun, 0, len(rr.runs))
+	for _, r := range rr.runs {
+		if (r.State == runStateQueued || r.State == runStateRunning) && match(r) {
+			runs = append(runs, activeRun{run: *r, Elapsed: now.Sub(r.StartTime).Round(time.Millisecond).String(), PIDs: slices.Clone(r.pids)})
+		}
+	}
+
+	slices.SortFunc(runs, func(a, b activeRun) int {
+		return a.StartTime.Compare(b.StartTime)
+	})
+	return runs
+}
+
+// model returns the default model of the run with the given ID.
+func (rr *runRegistry) model(id string) string {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	if r, ok := rr.runs[id]; ok {
+		return r.model
+	}
+	return ""
+}
+
+// cancel cancels the run of the tenant with the given ID. The returned bool is false if there is no such run.
+func (rr *runRegistry) cancel(tenant, id string) (run, bool) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	r, ok := rr.runs[id]
+	if !ok || r.Tenant != tenant {
+		return run{}, false
+	}
+
+	if r.State == runStateQueued || r.State == runStateRunning {
+		r.State = runStateCanceled
+		r.cancel()
+		rr.save(r)
+	}
+
+	return *r, true
+}
+
+// preempt cancels the run to give its slot to a run with a higher priority, and records why it was canceled. It reports whether
+// the run was canceled, which it isn't if it has already ended.
+func (rr *runRegistry) preempt(id string) bool {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	r, ok := rr.runs[id]
+	if !ok || (r.State != runStateQueued && r.State != runStateRunning) {
+		return false
+	}
+
+	r.State = runStateCanceled
+	r.Error = errPreempted.Error()
+	r.cancel()
+	rr.save(r)
+	return true
+}
+
+// save saves the run to the store. The lock must be held by the caller.
+func (rr *runRegistry) save(r *run) {
+	if err := rr.store.SaveRun(context.Background(), r.record()); err != nil {
+		slog.Error("Failed to save run", "run_id", r.ID, "error", err)
+	}
+}
+
+// prune removes the runs that ended more than runRetention ago. The lock must be held by the caller.
+func (rr *runRegistry) prune() {
+	for id, r := range rr.runs {
+		if r.EndTime != nil && time.Since(*r.EndTime) > runRetention {
+			delete(rr.runs, id)
+		}
+	}
+}
+
+// queueNotifier is called with the position of a run, starting at 1, while it waits in the run queue.
+type queueNotifier func(l *slog.Logger, w http.ResponseWriter, position int)
+
+// beginRun registers a new run, sets its ID on the response, and waits until the limiter allows it to start.
+// The input is the request that started the run, which is kept in the run history. The timeout of the run starts once it has
+// left the queue. If the given context is done before the run has finished, which it is when the client of the request that started
+// the run disconnects, then the run is canceled, unless the config says to keep it. The returned function must be called with the
+// output and outcome of the run when it has finished.
+func (s *server) beginRun(ctx context.Context, t runType, input any, timeout time.Duration, w http.ResponseWriter, queued queueNotifier) (context.Context, *slog.Logger, func(string, error), error) {
+	// The run is canceled through the run registry instead of with the request, so that its state is recorded as canceled.
+	reqCtx := ctx
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	ctx = withDefaultOpts(ctx, s.defaultOpts(usageClient(ctx)))
+	ctx = withCacheRoot(ctx, s.current().config.CacheRoot)
+	ctx = withRetry(ctx, s.current().config.Retry)
+	// The context can already have the max output size of a registered tool, which the server can only make smaller.
+	ctx = withMaxOutput(ctx, minOutputSize(runMaxOutput(ctx), s.current().config.Stream.MaxOutputSize))
+	ctx = withBackend(ctx, s.backend())
+	ctx = withProcessLimits(ctx, s.processLimits(usageClient(ctx)))
+
+	if s.draining.Load() {
+		cancel()
+		return nil, nil, nil, errDraining
+	}
+
+	if err := s.checkQuota(ctx); err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+
+	// The circuit of the provider is checked before the run is registered, so that runs that are rejected right away while the
+	// provider is failing don't fill up the run history.
+	circuitDone, err := s.circuits.allow(runProvider(ctx), s.current().config.CircuitBreaker)
+	if err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+
+	hooks := s.current().hooks
+	in, err := beforeRun(ctx, hooks, t, input)
+	if err != nil {
+		circuitDone(err)
+		cancel()
+		return nil, nil, nil, err
+	}
+
+	if ccontext.GetRunID(ctx) == "" {
+		ctx = ccontext.WithRunID(ctx, s.cluster.newRunID())
+	}
+	run := s.runs.start(ctx, t, in, cancel)
+	ctx = ccontext.WithRunID(ctx, run.ID)
+	ctx = withProcessStarted(ctx, func(pid int) {
+		s.runs.addPID(run.ID, pid)
+	})
+	w.Header().Set(runIDHeader, run.ID)
+	if registered := runRegistered(ctx); registered != nil {
+		close(registered)
+	}
+
+	l := s.runLogger(ccontext.GetLogger(ctx).With("run_id", run.ID), run.ID)
+	ctx = ccontext.WithLogger(ctx, l)
+
+	ctx, rw, err := s.withRunWorkspace(ctx, run.ID)
+	if err != nil {
+		circuitDone(err)
+		cancel()
+		s.runs.finish(run.ID, "", err)
+		s.notifier.notify(run.ID)
+		s.callback(ctx, l, run.ID)
+		s.notifyRun(l, run.Tenant, run.ID)
+		return nil, nil, nil, err
+	}
+
+	stopWatching := func() bool { return false }
+	if !s.current().config.Stream.KeepRunsOnDisconnect {
+		stopWatching = context.AfterFunc(reqCtx, func() {
+			if r, ok := s.runs.cancel(run.Tenant, run.ID); ok && r.State == runStateCanceled {
+				l.Info("Canceled run because its client disconnected")
+			}
+		})
+	}
+
+	var onQueued func(int)
+	if queued != nil {
+		onQueued = func(position int) {
+			queued(l, w, position)
+		}
+	}
+
+	lr := s.limitedRun(ctx, run.Tenant)
+	lr.preempt = func() {
+		if s.runs.preempt(run.ID) {
+			l.Info("Preempted run for a run with a higher priority", "priority", lr.priority)
+			runsPreempted.Inc()
+		}
+	}
+
+	release, err := s.limiter.acquire(ctx, lr, onQueued)
+	if err != nil {
+		circuitDone(err)
+		stopWatching()
+		cancel()
+		s.endRunWorkspace(context.WithoutCancel(ctx), l, run.ID, rw)
+		s.runs.finish(run.ID, "", err)
+		s.notifier.notify(run.ID)
+		s.callback(ctx, l, run.ID)
+		s.notifyRun(l, run.Tenant, run.ID)
+		return nil, nil, nil, err
+	}
+
+	s.runs.running(run.ID)
+
+	ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	return ctx, l, func(output string, err error) {
+		stopWatching()
+		release()
+		cancelTimeout()
+		cancel()
+		circuitDone(err)
+		reportLimitExceeded(l, err)
+		// The artifacts are kept and the workspace is pushed before the run is finished, so that they are all there once the run has
+		// ended.
+		s.endRunWorkspace(context.WithoutCancel(ctx), l, run.ID, rw)
+		s.runs.finish(run.ID, output, err)
+		s.notifier.notify(run.ID)
+		s.callback(ctx, l, run.ID)
+		s.notifyRun(l, run.Tenant, run.ID)
+		afterRun(ctx, hooks, HookRun{ID: run.ID, Type: string(t), Caller: usageClient(ctx), Tenant: run.Tenant, Request: in}, output, err)
+	}, nil
+}
+
+// runTimeout returns the timeout for a run from the requested duration. If no duration was requested, then the maximum is used.
+func (s *server) runTimeout(requested string) (time.Duration, error) {
+	maxRunTimeout := s.current().config.MaxRunTimeout
+	if requested == "" {
+		return maxRunTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(requested)
+	if err != nil {
+		return 0, invalidField("timeout", fmt.Sprintf("invalid timeout: %v", err))
+	}
+
+	if timeout <= 0 || timeout > maxRunTimeout {
+		return 0, invalidField("timeout", fmt.Sprintf("timeout must be greater than 0 and at most %s", maxRunTimeout))
+	}
+
+	return timeout, nil
+}
+
+// queuePositionWriter returns a queueNotifier that writes the position of a queued run to the response as an event,
+// in the stream format that the request asked for.
+func queuePositionWriter(r *http.Request) queueNotifier {
+	return notifyQueue(func(l *slog.Logger, w http.ResponseWriter, event any) {
+		filterEvents(r, newStreamWriter(l, w, r)).writeEvent(event)
+	})
+}
+
+// notifyQueue returns a queueNotifier that writes the position of a queued run as an event with write, after the queued lifecycle
+// event of the run when the run is first queued.
+func notifyQueue(write func(l *slog.Logger, w http.ResponseWriter, event any)) queueNotifier {
+	var queued bool
+	return func(l *slog.Logger, w http.ResponseWriter, position int) {
+		runID := w.Header().Get(runIDHeader)
+		if !queued {
+			queued = true
+			write(l, w, newEventEnvelope(runID, 0, lifecycleEvent(events.LifecycleQueued)))
+		}
+		write(l, w, newEventEnvelope(runID, 0, events.QueuePosition{Time: time.Now(), QueuePosition: position}))
+	}
+}
+
+// writeRunError writes the reason that a run could not start to the response.
+func writeRunError(w http.ResponseWriter, err error) {
+	var quotaErr *quotaError
+	if errors.As(err, &quotaErr) {
+		writeQuotaError(w, quotaErr)
+		return
+	}
+
+	var circuitErr *circuitOpenError
+	if errors.As(err, &circuitErr) {
+		writeCircuitOpenError(w, circuitErr)
+		return
+	}
+
+	var rejection *hookRejection
+	if errors.As(err, &rejection) {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if errors.Is(err, errDraining) {
+		w.Header().Set("Retry-After", queueRetryAfter)
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	if errors.Is(err, errQueueFull) {
+		w.Header().Set("Retry-After", queueRetryAfter)
+		writeError(w, http.StatusTooManyRequests, err)
+		return
+	}
+
+	writeError(w, http.StatusServiceUnavailable, fmt.Errorf("run did not start: %w", err))
+}
+
+// runEventWriter wraps the event writer of a run so that the events are tracked in the registry, counted towards the usage of the
+// run, and kept in the run history, along with the lifecycle, progress, and usage events of the run.
+func (s *server) runEventWriter(ctx context.Context, l *slog.Logger, w eventWriter) eventWriter {
+	runID := ccontext.GetRunID(ctx)
+	// The events are redacted before they are kept in the run history, so that what is redacted is never stored.
+	w = withRedaction(&historyWriter{eventWriter: w, l: l, store: s.store, notifier: s.notifier, runID: runID, requestID: ccontext.GetRequestID(ctx), publisher: s.publisher, tenant: tenantOf(ctx)}, s.current().redactor)
+	w = &usageWriter{eventWriter: w, s: s, runID: runID, model: s.runs.model(runID)}
+	w = &progressWriter{eventWriter: w}
+	return newLifecycleWriter(ctx, w)
+}
+
+// listRuns returns the runs of the tenant of the caller in the run history, oldest first. The runs can be filtered by their state with the status query
+// parameter, and by their start time with the since query parameter, which is either a timestamp or a duration before now.
+func (s *server) listRuns(w http.ResponseWriter, r *http.Request) {
+	filter := store.Filter{Tenant: tenantOf(r.Context())}
+	if status := r.URL.Query().Get("status"); status != "" {
+		switch runState(status) {
+		case runStateQueued, runStateRunning, runStateFinished, runStateFailed, runStateCanceled:
+			filter.State = status
+		default:
+			writeError(w, http.StatusBadRequest, invalidField("status", fmt.Sprintf("unknown status %q", status)))
+			return
+		}
+	}
+
+	if since := r.URL.Query().Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			d, durErr := time.ParseDuration(since)
+			if durErr != nil {
+				writeError(w, http.StatusBadRequest, invalidField("since", fmt.Sprintf("since must be an RFC 3339 timestamp or a duration: %v", err)))
+				return
+			}
+			t = time.Now().Add(-d)
+		}
+		filter.Since = t
+	}
+
+	runs, err := s.store.ListRuns(r.Context(), filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to list runs: %w", err))
+		return
+	}
+
+	writeResponse(w, map[string]any{"runs": runs})
+}
+
+// runDetails is a run from the run history, along with its events.
+type runDetails struct {
+	store.Run `json:",inline"`
+	Events    []store.Event `json:"events"`
+}
+
+// getRun returns the run with the given ID from the run history, along with the events that were written to its client.
+func (s *server) getRun(w http.ResponseWriter, r *http.Request) {
+	run, err := s.store.GetRun(r.Context(), tenantOf(r.Context()), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("run %q not found", r.PathValue("id")))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get run: %w", err))
+		return
+	}
+
+	events, err := s.store.ListEvents(r.Context(), run.ID, 0)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get events of run: %w", err))
+		return
+	}
+
+	writeResponse(w, runDetails{Run: run, Events: events})
+}
+
+// cancelRun cancels the run with the given ID, which stops the underlying gptscript process. A single call of a run can't be aborted
+// on its own, since the gptscript SDK has no way to, so the whole run is canceled.
+func (s *server) cancelRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.runs.cancel(tenantOf(r.Context()), r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("run %q not found", r.PathValue("id")))
+		return
+	}
+
+	ccontext.GetLogger(r.Context()).Info("Canceled run", "run_id", run.ID)
+	writeResponse(w, run)
+}
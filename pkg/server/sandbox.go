@@ -0,0 +1,177 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+// defaultSandboxEnv are the patterns of the environment variables of the server that are passed to the sandbox if none are set,
+// which are those that gptscript needs to reach the model provider.
+var defaultSandboxEnv = []string{"OPENAI_*"}
+
+// SandboxConfig configures the containers that runs are executed in. If the image is set, then each gptscript process of a run is
+// started in a new container with Docker or Podman. Otherwise, runs are executed directly on the host. The timeout of the
+// processes is the timeout of their run.
+type SandboxConfig struct {
+	// Runtime is the command of the container runtime, like docker or podman. It defaults to docker.
+	Runtime string
+	// Image is the image of the containers, which must have gptscript on its PATH.
+	Image string
+	// Memory and CPUs are the limits of each container, like "512m" and "1.5". PidsLimit is the number of processes that can run
+	// in each container. A limit that isn't set means no limit.
+	Memory    string
+	CPUs      string
+	PidsLimit int
+	// Network is the network of the containers, which must be able to reach the model provider.
+	Network string
+	// SeccompProfile is the path of a seccomp profile that replaces the default profile of the runtime.
+	SeccompProfile string
+	// Mounts are the bind mounts of the containers, in the form "source:target[:options]". The working directory of the server and
+	// the upload directory are always mounted read-only at the same paths, and the default cache directory is mounted if it is set.
+	Mounts []string
+	// Env are patterns, in the syntax of path.Match, of the environment variables of the server that are passed to the
+	// containers. It defaults to OPENAI_*. The environment variables that runs set are always passed.
+	Env []string
+}
+
+func (c SandboxConfig) enabled() bool {
+	return c.Image != ""
+}
+
+func (c SandboxConfig) validate() error {
+	if !c.enabled() {
+		if c.Runtime != "" || c.Memory != "" || c.CPUs != "" || c.PidsLimit != 0 || c.Network != "" || c.SeccompProfile != "" || len(c.Mounts) > 0 || len(c.Env) > 0 {
+			return errors.New("the image is required")
+		}
+		return nil
+	}
+
+	if _, err := exec.LookPath(c.runtime()); err != nil {
+		return fmt.Errorf("container runtime not found: %w", err)
+	}
+	if c.CPUs != "" {
+		if cpus, err := strconv.ParseFloat(c.CPUs, 64); err != nil || cpus <= 0 {
+			return fmt.Errorf("invalid CPUs %q, must be a positive number", c.CPUs)
+		}
+	}
+	if c.PidsLimit < 0 {
+		return errors.New("the pids limit can't be negative")
+	}
+	for _, pattern := range c.Env {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid env pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (c SandboxConfig) runtime() string {
+	if c.Runtime == "" {
+		return "docker"
+	}
+	return c.Runtime
+}
+
+// KubernetesConfig configures the Kubernetes Jobs that runs are executed as. Each gptscript process of a run is a Job with the
+// image and resources of the config, whose output is streamed back from the logs of its pod.
+type KubernetesConfig struct {
+	// APIServer, TokenFile, and CAFile are how the API server is reached. If the API server isn't set, then the cluster that the
+	// server runs in is used.
+	APIServer string
+	TokenFile string
+	CAFile    string
+	// Namespace is the namespace of the Jobs. It defaults to the namespace of the server.
+	Namespace string
+	// Image is the image of gptscript, and HelperImage is the image of the containers that pass the output of gptscript back, which
+	// must have mkfifo and cat. It defaults to busybox.
+	Image       string
+	HelperImage string
+	// CPURequest, MemoryRequest, CPULimit, and MemoryLimit are the resources of gptscript, like "500m" and "512Mi".
+	CPURequest    string
+	MemoryRequest string
+	CPULimit      string
+	MemoryLimit   string
+	// ServiceAccount is the service account of the pods. If it isn't set, then the pods get no credentials for the cluster.
+	ServiceAccount string
+	// Env are patterns, in the syntax of path.Match, of the environment variables of the server that are passed to the pods.
+	// It defaults to OPENAI_*. The environment variables that runs set are always passed.
+	Env []string
+}
+
+func (c KubernetesConfig) enabled() bool {
+	return c.Image != ""
+}
+
+// newSandbox returns the backend that runs each gptscript process in a container, as configured by the sandbox of the config.
+func newSandbox(config Config) (ExecBackend, error) {
+	sandbox := config.Sandbox
+	if !sandbox.enabled() {
+		return nil, errors.New("the sandbox image is required")
+	}
+
+	c := runner.Container{
+		Runtime:        sandbox.runtime(),
+		Image:          sandbox.Image,
+		Memory:         sandbox.Memory,
+		CPUs:           sandbox.CPUs,
+		PidsLimit:      sandbox.PidsLimit,
+		Network:        sandbox.Network,
+		SeccompProfile: sandbox.SeccompProfile,
+		Mounts:         append(slices.Clone(sandbox.Mounts), bindMount(config.UploadDir, true)),
+		Env:            sandbox.Env,
+	}
+	// The workspaces of sessions and runs are in the upload directory, which is mounted read-only, and runs write to them.
+	c.Mounts = append(c.Mounts, bindMount(filepath.Join(config.UploadDir, ".sessions"), false), bindMount(filepath.Join(config.UploadDir, ".workspaces"), false))
+	if len(c.Env) == 0 {
+		c.Env = defaultSandboxEnv
+	}
+
+	// Files are run by their path on the host, so the working directory is mounted for relative paths to resolve the same way.
+	if wd, err := os.Getwd(); err == nil {
+		c.Mounts = append(c.Mounts, bindMount(wd, true))
+		c.Workdir = wd
+	}
+	if config.CacheRoot != "" {
+		c.Mounts = append(c.Mounts, bindMount(config.CacheRoot, false))
+		return c, nil
+	}
+	if cacheDir := config.DefaultOpts.CacheDir; cacheDir != "" {
+		c.Mounts = append(c.Mounts, bindMount(cacheDir, false))
+	}
+	for _, opts := range config.ClientOpts {
+		if opts.CacheDir != "" && opts.CacheDir != config.DefaultOpts.CacheDir {
+			c.Mounts = append(c.Mounts, bindMount(opts.CacheDir, false))
+		}
+	}
+	return c, nil
+}
+
+// newKubernetes returns the backend that runs each gptscript process as a Kubernetes Job, as configured by the Kubernetes of the
+// config.
+func newKubernetes(config Config) (ExecBackend, error) {
+	c := runner.KubernetesConfig(config.Kubernetes)
+	if len(c.Env) == 0 {
+		c.Env = defaultSandboxEnv
+	}
+	return runner.NewKubernetes(c)
+}
+
+// bindMount returns the mount of the directory of the host at the same path in a container.
+func bindMount(dir string, readOnly bool) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	if readOnly {
+		return dir + ":" + dir + ":ro"
+	}
+	return dir + ":" + dir
+}
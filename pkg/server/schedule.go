@@ -0,0 +1,370 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+var errScheduleNotFound = errors.New("schedule not found")
+
+// scheduleRequest creates or replaces a schedule, which runs the tool or file whenever the cron expression matches.
+// The expression has the five standard fields, or is a descriptor like @hourly or @every 10m.
+type scheduleRequest struct {
+	Cron string `json:"cron"`
+	toolOrFile
+}
+
+func (s *scheduleRequest) validate() error {
+	if s.Cron == "" {
+		return missingField("cron", "cron is required")
+	}
+	if _, err := cron.ParseStandard(s.Cron); err != nil {
+		return invalidField("cron", fmt.Sprintf("invalid cron expression: %v", err))
+	}
+	if err := s.toolOrFile.validate(); err != nil {
+		return err
+	}
+	return rejectDryRun(s.options(), "scheduled runs")
+}
+
+// schedule is a schedule as it is returned by the API.
+type schedule struct {
+	ID   string `json:"id"`
+	Cron string `json:"cron"`
+	toolOrFile
+	// NextRun is when the schedule runs next.
+	NextRun   *time.Time `json:"nextRun,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+// scheduler runs the schedules at the times of their cron expressions.
+type scheduler struct {
+	lock    sync.Mutex
+	cron    *cron.Cron
+	entries map[string]cron.EntryID
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{cron: cron.New(), entries: make(map[string]cron.EntryID)}
+}
+
+// add schedules the job with the cron expression, replacing the job of the schedule if there is one.
+func (sc *scheduler) add(id, spec string, job func()) error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	entry, err := sc.cron.AddFunc(spec, job)
+	if err != nil {
+		return err
+	}
+
+	if old, ok := sc.entries[id]; ok {
+		sc.cron.Remove(old)
+	}
+	sc.entries[id] = entry
+	return nil
+}
+
+func (sc *scheduler) remove(id string) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if entry, ok := sc.entries[id]; ok {
+		sc.cron.Remove(entry)
+		delete(sc.entries, id)
+	}
+}
+
+// next returns when the schedule runs next, or nil if it isn't scheduled.
+func (sc *scheduler) next(id string) *time.Time {
+	sc.lock.Lock()
+	entry, ok := sc.entries[id]
+	sc.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	next := sc.cron.Entry(entry).Next
+	if next.IsZero() {
+		// The scheduler sets the next time of an entry once it is running, so compute it for entries added before it started.
+		next = sc.cron.Entry(entry).Schedule.Next(time.Now())
+	}
+	return &next
+}
+
+// startSchedules schedules the schedules in the store and starts the scheduler. The returned function stops the scheduler, and
+// doesn't wait for the runs that it started.
+func (s *server) startSchedules(ctx context.Context) (func(), error) {
+	schedules, err := s.store.ListSchedules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schedules: %w", err)
+	}
+
+	for _, sc := range schedules {
+		if err = s.scheduler.add(sc.ID, sc.Cron, s.scheduledRun(sc.Tenant, sc.ID)); err != nil {
+			slog.Error("Failed to add schedule", "schedule_id", sc.ID, "error", err)
+		}
+	}
+
+	s.scheduler.cron.Start()
+	return func() {
+		s.scheduler.cron.Stop()
+	}, nil
+}
+
+// scheduledRun returns the job of the schedule of the tenant, which runs the tool or file of the schedule as it is when the job
+// runs.
+func (s *server) scheduledRun(tenant, id string) func() {
+	return func() {
+		l := slog.Default().With("schedule_id", id)
+
+		sc, err := s.store.GetSchedule(context.Background(), tenant, id)
+		if err != nil {
+			l.Error("Failed to get schedule", "error", err)
+			return
+		}
+
+		var req scheduleRequest
+		if err = json.Unmarshal(sc.Request, &req); err != nil {
+			l.Error("Failed to decode schedule", "error", err)
+			return
+		}
+
+		// The run is accounted to the owner of the schedule, in the tenant of the schedule.
+		ctx := ccontext.WithIdentity(withSchedule(ccontext.WithLogger(context.Background(), l), id), &ccontext.Identity{Name: sc.Owner, Tenant: sc.Tenant})
+
+		// Whether the owner can run the tool or file was checked when the schedule was saved.
+		pr, _, err := s.prepareRun(ctx, nil, req.toolOrFile)
+		if err != nil {
+			l.Error("Failed to start scheduled run", "error", err)
+			s.notifyScheduleFailed(l, sc, req.toolOrFile, err)
+			return
+		}
+		// The sinks are notified of the outcome of every run that is recorded, so they are only notified here if the run never was.
+		registered := make(chan struct{})
+		runID, _, err := s.runPrepared(withRunRegistered(ctx, registered), pr, discardEvents{}, nil)
+		if err != nil && runID == "" {
+			l.Error("Failed to start scheduled run", "error", err)
+			select {
+			case <-registered:
+			default:
+				s.notifyScheduleFailed(l, sc, req.toolOrFile, err)
+			}
+			return
+		} else if err != nil {
+			l.Warn("Scheduled run failed", "run_id", runID, "error", err)
+			return
+		}
+		l.Info("Scheduled run finished", "run_id", runID)
+	}
+}
+
+// notifyScheduleFailed notifies the sinks that the run of the schedule failed to start.
+func (s *server) notifyScheduleFailed(l *slog.Logger, sc store.Schedule, item toolOrFile, err error) {
+	s.notify(l, notification{
+		Tool:       item.name(),
+		State:      string(runStateFailed),
+		Error:      err.Error(),
+		Tenant:     sc.Tenant,
+		Client:     sc.Owner,
+		ScheduleID: sc.ID,
+	})
+}
+
+type scheduleKey struct{}
+
+// withSchedule records that the run is started by the schedule.
+func withSchedule(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, scheduleKey{}, id)
+}
+
+func scheduleID(ctx context.Context) string {
+	id, _ := ctx.Value(scheduleKey{}).(string)
+	return id
+}
+
+// newSchedule returns the schedule as it is returned by the API.
+func (s *server) newSchedule(sc store.Schedule) schedule {
+	var req scheduleRequest
+	if err := json.Unmarshal(sc.Request, &req); err != nil {
+		slog.Warn("Failed to decode schedule", "schedule_id", sc.ID, "error", err)
+	}
+
+	return schedule{
+		ID:         sc.ID,
+		Cron:       sc.Cron,
+		toolOrFile: req.toolOrFile,
+		NextRun:    s.scheduler.next(sc.ID),
+		CreatedAt:  sc.CreatedAt,
+		UpdatedAt:  sc.UpdatedAt,
+	}
+}
+
+// decodeSchedule decodes the schedule request, and checks that the caller is allowed to run its tool or file. If it returns nil,
+// then the error has been written to the response.
+func (s *server) decodeSchedule(w http.ResponseWriter, r *http.Request) *scheduleRequest {
+	req := new(scheduleRequest)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil
+	}
+
+	if _, code, err := s.prepareRun(r.Context(), ccontext.GetIdentity(r.Context()), req.toolOrFile); err != nil {
+		writeError(w, code, err)
+		return nil
+	}
+
+	return req
+}
+
+// saveSchedule sets the request of the schedule, then saves the schedule and schedules it.
+func (s *server) saveSchedule(ctx context.Context, sc *store.Schedule, req *scheduleRequest) error {
+	var err error
+	if sc.Request, err = json.Marshal(req); err != nil {
+		return fmt.Errorf("failed to marshal schedule: %w", err)
+	}
+
+	if err = s.store.SaveSchedule(ctx, *sc); err != nil {
+		return err
+	}
+
+	return s.scheduler.add(sc.ID, sc.Cron, s.scheduledRun(sc.Tenant, sc.ID))
+}
+
+// getOwnedSchedule returns the schedule of the path, if it is owned by the caller in its tenant.
+func (s *server) getOwnedSchedule(r *http.Request) (store.Schedule, error) {
+	sc, err := s.store.GetSchedule(r.Context(), tenantOf(r.Context()), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) || (err == nil && sc.Owner != chatOwner(r)) {
+		return store.Schedule{}, errScheduleNotFound
+	}
+	return sc, err
+}
+
+func (s *server) createSchedule(w http.ResponseWriter, r *http.Request) {
+	req := s.decodeSchedule(w, r)
+	if req == nil {
+		return
+	}
+
+	now := time.Now()
+	sc := store.Schedule{
+		ID:        uuid.NewString(),
+		Owner:     chatOwner(r),
+		Tenant:    tenantOf(r.Context()),
+		Cron:      req.Cron,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.saveSchedule(r.Context(), &sc, req); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to save schedule: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	writeResponse(w, s.newSchedule(sc))
+}
+
+// listSchedules lists the schedules of the caller in its tenant, oldest first.
+func (s *server) listSchedules(w http.ResponseWriter, r *http.Request) {
+	all, err := s.store.ListSchedules(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to list schedules: %w", err))
+		return
+	}
+
+	schedules := make([]schedule, 0, len(all))
+	for _, sc := range all {
+		if sc.Tenant == tenantOf(r.Context()) && sc.Owner == chatOwner(r) {
+			schedules = append(schedules, s.newSchedule(sc))
+		}
+	}
+
+	writeResponse(w, map[string][]schedule{"schedules": schedules})
+}
+
+func (s *server) getSchedule(w http.ResponseWriter, r *http.Request) {
+	sc, err := s.getOwnedSchedule(r)
+	if err != nil {
+		writeError(w, scheduleErrorCode(err), err)
+		return
+	}
+
+	writeResponse(w, s.newSchedule(sc))
+}
+
+// updateSchedule replaces the cron expression and the tool or file of the schedule. The runs that it already started are kept.
+func (s *server) updateSchedule(w http.ResponseWriter, r *http.Request) {
+	sc, err := s.getOwnedSchedule(r)
+	if err != nil {
+		writeError(w, scheduleErrorCode(err), err)
+		return
+	}
+
+	req := s.decodeSchedule(w, r)
+	if req == nil {
+		return
+	}
+
+	sc.Cron = req.Cron
+	sc.UpdatedAt = time.Now()
+	if err = s.saveSchedule(r.Context(), &sc, req); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to save schedule: %w", err))
+		return
+	}
+
+	writeResponse(w, s.newSchedule(sc))
+}
+
+// deleteSchedule deletes the schedule, so that it doesn't start any more runs. Runs that it already started are not canceled.
+func (s *server) deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	sc, err := s.getOwnedSchedule(r)
+	if err == nil {
+		err = s.store.DeleteSchedule(r.Context(), sc.Tenant, sc.ID)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		err = errScheduleNotFound
+	}
+	if err != nil {
+		writeError(w, scheduleErrorCode(err), err)
+		return
+	}
+
+	s.scheduler.remove(sc.ID)
+	writeResponse(w, map[string]string{"status": "ok"})
+}
+
+// scheduleRuns lists the runs that the schedule started, oldest first.
+func (s *server) scheduleRuns(w http.ResponseWriter, r *http.Request) {
+	sc, err := s.getOwnedSchedule(r)
+	if err != nil {
+		writeError(w, scheduleErrorCode(err), err)
+		return
+	}
+
+	runs, err := s.store.ListRuns(r.Context(), store.Filter{Tenant: sc.Tenant, ScheduleID: sc.ID})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to list runs: %w", err))
+		return
+	}
+
+	writeResponse(w, map[string][]store.Run{"runs": runs})
+}
+
+func scheduleErrorCode(err error) int {
+	if errors.Is(err, errScheduleNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
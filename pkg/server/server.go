@@ -5,38 +5,571 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/gptscript-ai/go-gptscript"
+	"github.com/graph-gophers/graphql-go"
 	"github.com/rs/cors"
+	"github.com/thedadams/clicky-serves/pkg/artifacts"
+	"github.com/thedadams/clicky-serves/pkg/objects"
+	"github.com/thedadams/clicky-serves/pkg/secrets"
+	"github.com/thedadams/clicky-serves/pkg/store"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type Config struct {
+	// File is the path of a YAML or JSON config file. The settings in the file override the rest of the config, and the file is
+	// loaded again when the server receives SIGHUP or the file changes.
+	File string
+
 	Port string
+
+	// GRPCPort is the port of the gRPC server. If it is not set, then the gRPC server is not started.
+	GRPCPort string
+
+	// DebugPort is the port of the debug server, which serves pprof and the runtime diagnostics of the server without
+	// authentication. If it is not set, then the debug server is not started.
+	DebugPort string
+
+	// HTTP2 serves HTTP/2 without TLS (h2c) on the server port, as well as HTTP/1.1, for clients and proxies that connect with it.
+	HTTP2 bool
+
+	// GraphQL serves the GraphQL API at /graphql, which exposes runs, registered tools, sessions, and usage as a graph, with a
+	// subscription to the events of runs.
+	GraphQL bool
+
+	// JSONRPC serves JSON-RPC 2.0 at /jsonrpc, with methods to parse, run, and stream tools and files, and to cancel runs.
+	JSONRPC bool
+	// JSONRPCStdio serves the same JSON-RPC methods on stdin and stdout, one message per line, for editors and agents that start the
+	// server as a subprocess. The server stops once stdin is closed. JSONRPCStdioAPIKey is the API key that the requests on stdin are
+	// authenticated with, which is needed if authentication is enabled.
+	JSONRPCStdio       bool
+	JSONRPCStdioAPIKey string
+
+	// MCP serves the registered tools as the tools of an MCP (Model Context Protocol) server at /mcp, and on stdio if JSON-RPC is
+	// served on stdio, so that MCP clients can list and call them.
+	MCP bool
+
+	// ChatCompletionsTool is the chat-enabled tool that the OpenAI compatible chat completions API at /v1/chat/completions chats
+	// with, as a file or the registry:// handle of a registered tool, so that clients of OpenAI can use it unchanged. If it is not
+	// set, then the API is disabled.
+	ChatCompletionsTool string
+
+	// LogLevel is the minimum level of the logs, one of debug, info, warn, or error. If it is not set, then the level isn't changed.
+	LogLevel string
+
+	// ReadOnly starts the server in read-only mode, in which it only allows parsing, formatting, and listing, and rejects the
+	// requests that run something with a 403 status code. Admins can turn it on and off while the server is running.
+	ReadOnly bool
+
+	// APIKeys are in the form "key:scope:tenant", where the tenant is optional, and APIKeysFile is a file with one such key per
+	// line. If neither is set, then authentication is disabled.
+	APIKeys     []string
+	APIKeysFile string
+
+	// JWT configures authentication with JWTs. It is enabled if either the secret or the JWKS URL is set.
+	JWT JWTConfig
+
+	// MaxConcurrentRuns is the number of runs that can execute at the same time, with 0 meaning no limit.
+	// MaxQueuedRuns is the number of runs that can wait for a slot before new runs are rejected.
+	MaxConcurrentRuns int
+	MaxQueuedRuns     int
+
+	// RunPriority is the priority of the runs of each client in the run queue, and ClientRunPriorities are the priorities of clients
+	// that have priorities of their own, by the name of the client. Queued runs with a higher priority start before runs with a
+	// lower one. Runs can ask for a lower priority than that of their client, but not a higher one. PreemptRuns means that a run
+	// that is queued because every slot is taken cancels the running run with the lowest priority, if it is lower than its own.
+	RunPriority         int
+	ClientRunPriorities map[string]int
+	PreemptRuns         bool
+	// Queue configures how the run queue is shared between clients and tenants.
+	Queue QueueConfig
+
+	// MaxRunTimeout is the longest a run can take, and the timeout of runs that don't request one. It defaults to 15 minutes.
+	MaxRunTimeout time.Duration
+
+	// RunHistoryDB is the path of a SQLite database that the history of runs is kept in.
+	// If it is not set, then the history is kept in memory, and runs are forgotten an hour after they have ended.
+	RunHistoryDB string
+
+	// EnvAllowlist and EnvDenylist are patterns, in the syntax of path.Match, of the environment variables that requests can set for
+	// the gptscript process of their run. A variable can be set if it matches the allowlist and doesn't match the denylist, so no
+	// variables can be set if the allowlist is empty. Variables that the server relies on, like OPENAI_API_KEY, can never be set.
+	EnvAllowlist []string
+	EnvDenylist  []string
+
+	// ParseRateLimit and ExecRateLimit limit the rate of requests of each client to the endpoints that require the parse and
+	// exec scopes, respectively. Clients are identified by their credentials, or by their IP address if authentication is disabled.
+	ParseRateLimit RateLimit
+	ExecRateLimit  RateLimit
+
+	// ResultCacheTTL is how long the output of a successful run is cached for, so that the same run returns it without running again.
+	// Only runs that aren't streamed are cached, and only if the TTL is positive. ResultCacheSize is the maximum number of cached
+	// results, with 0 meaning no limit.
+	ResultCacheTTL  time.Duration
+	ResultCacheSize int
+
+	// ParseCacheTTL is how long the result of parsing a file or tool content is cached for, by the content that was parsed, so that
+	// editors that parse the same content over and over don't start gptscript each time. Parses are only cached if the TTL is
+	// positive. ParseCacheSize is the maximum number of cached parses, with 0 meaning no limit.
+	ParseCacheTTL  time.Duration
+	ParseCacheSize int
+
+	// ToolCacheTTL is how long remote tools that are run as files, like github.com/org/repo/tool.gpt@v1 or a URL, are kept for
+	// after they are fetched by the server, which only fetches them if the TTL is positive. Otherwise, gptscript loads them for
+	// every run.
+	ToolCacheTTL time.Duration
+
+	// CORS configures the cross-origin requests that browsers are allowed to make.
+	CORS CORSConfig
+
+	// UploadDir is the directory that uploaded files are kept in. If it is not set, then a temporary directory is used, which is
+	// removed when the server stops.
+	UploadDir string
+
+	// HeartbeatInterval is how long a stream can be idle before a heartbeat is written to it. If it is 0, then no heartbeats are written.
+	HeartbeatInterval time.Duration
+
+	// Stream configures the streams of events to clients.
+	Stream StreamConfig
+	// Retry configures the retries of runs that fail with transient errors of the model.
+	Retry RetryConfig
+	// CircuitBreaker configures the circuit breakers that reject the runs of providers that are failing.
+	CircuitBreaker CircuitBreakerConfig
+
+	// Compression configures the compression of responses.
+	Compression CompressionConfig
+
+	// Limits configures the sizes of the request bodies, tool contents, inputs, and uploads that the server accepts, and how long
+	// parsing can take.
+	Limits LimitsConfig
+
+	// Janitor configures the cleanup of the cache directories of gptscript, the uploaded files, the tool cache, and the workspaces,
+	// so that the server doesn't fill its disk.
+	Janitor JanitorConfig
+
+	// DefaultOpts are the gptscript options of runs that don't set them, and ClientOpts are the default options of clients that
+	// have defaults of their own, by the name of the client, which are used over DefaultOpts. LockedOpts are the names of the
+	// options, like cacheDir, that runs can't set to anything but their default, so that the server decides them.
+	DefaultOpts gptscript.Opts
+	ClientOpts  map[string]ClientOpts
+	LockedOpts  []string
+
+	// CacheRoot is a directory that the server keeps the cache directories of gptscript under, each tenant with its own, so that
+	// tenants never share cached prompts and responses. If it is set, then the cacheDir of runs and of the default options is the
+	// name of a cache directory of the tenant of the run, which is "default" if it isn't set. Otherwise, the cacheDir is a path.
+	CacheRoot string
+
+	// ToolDirs are the directories of the local files that runs can run and the directories that they can run in, along with the
+	// uploaded files of their tenant and the workspace of their session. If there are none, then runs can use the working
+	// directory of the server.
+	ToolDirs []string
+
+	// Models are the models that runs can request, by the name that they are requested by. If there are none, then runs can
+	// request any model, and every run uses the provider of the server. DefaultModel is the model of runs that don't request one.
+	Models       map[string]ModelRoute
+	DefaultModel string
+
+	// CredentialsFile is the path of the file that credentials are kept in, encrypted with a key derived from CredentialsKey.
+	// If it is not set, then credentials are kept in memory and are lost when the server stops.
+	CredentialsFile string
+	CredentialsKey  string
+
+	// Artifacts configures where the files that runs write to their workspaces are kept once the runs have ended.
+	Artifacts ArtifactsConfig
+
+	// Storage is the bucket that the state that replicas of the server share is kept in: the workspaces and the records of
+	// sessions, the remote tools that the tool cache fetched, and artifacts if they are kept in it. If it is not set, then that
+	// state is only kept on the disk of each replica.
+	Storage objects.Config
+
+	// Cluster configures cluster mode, in which the requests about a run are forwarded to the replica of the server that runs it.
+	Cluster ClusterConfig
+
+	// Quota is the quota of each client, and ClientQuotas are the quotas of clients that have quotas of their own, by the name of
+	// the client. TenantQuotas limit the usage of all of the clients of a tenant together, by the name of the tenant, on top of the
+	// quotas of the clients. Usage is only known for runs whose events are streamed, because gptscript only reports it in its
+	// events.
+	Quota        Quota
+	ClientQuotas map[string]Quota
+	TenantQuotas map[string]Quota
+
+	// Backend is the name of the backend that runs are executed with, which is host, sandbox, kubernetes, or one that was
+	// registered with RegisterBackend. If it is not set, then the sandbox or Kubernetes is used if its image is set, and
+	// otherwise runs are executed on the host.
+	Backend string
+
+	// GPTScript configures the gptscript binary that runs on the host are executed with, which can be downloaded when the server
+	// starts.
+	GPTScript GPTScriptConfig
+
+	// ProcessLimits limit the resources of the gptscript processes of each run on the host, and ClientProcessLimits are the limits of
+	// clients that have limits of their own, by the name of the client, which replace the limits of the config.
+	ProcessLimits       ProcessLimits
+	ClientProcessLimits map[string]ProcessLimits
+
+	// Sandbox configures the containers that runs are executed in by the sandbox backend.
+	Sandbox SandboxConfig
+
+	// Kubernetes configures the Kubernetes Jobs that runs are executed as by the kubernetes backend.
+	Kubernetes KubernetesConfig
+
+	// CallbackSecret is the key that the callbacks of runs are signed with, using HMAC-SHA256. If it is not set, then callbacks
+	// aren't signed.
+	CallbackSecret string
+	// CallbackNetworks are the networks, as CIDRs or IP addresses, that callbacks can be sent to even though they aren't public.
+	// Callbacks to loopback, private, link-local, and other addresses that aren't public are refused otherwise, so that clients
+	// can't make the server post the outputs of runs to its own network.
+	CallbackNetworks []string
+
+	// SignedURLKey is the key that the signed URLs of the results of runs are signed with, using HMAC-SHA256, so that the results
+	// can be shared with systems that don't have credentials. Signed URLs are disabled if it is not set.
+	SignedURLKey string
+
+	// Notifications are where the outcomes of runs are sent when they end, like emails about the scheduled runs that failed.
+	Notifications []NotificationSink
+
+	// Brokers are the message brokers that the events of runs are published to, like for a data pipeline to consume them.
+	Brokers []BrokerConfig
+
+	// AuditLog is where a record of each request to parse or execute is written: the path of a file that the records are
+	// appended to as lines of JSON, "syslog:" or "syslog://host:port" for the local or a remote syslog, or an http or https URL
+	// that each record is posted to. If it is not set, then no records are written.
+	AuditLog string
+
+	// Hooks are called before and after each run, in order, like to enforce policies or to redact the input of runs. Each one is
+	// either the name of a hook that is registered with RegisterHook, or the path of an executable, as described by execHook.
+	Hooks []string
+
+	// Redaction configures the redaction of the streams of runs.
+	Redaction RedactionConfig
+
+	// Policy restricts what each client can run, and ClientPolicies are the policies of clients that have policies of their own, by
+	// the name of the client. Runs that are denied by a policy are rejected with a 403 and the policy_denied code.
+	Policy         ToolPolicy
+	ClientPolicies map[string]ToolPolicy
+}
+
+// ClientOpts are the default options of a client, which are layered over the default options of the server. DisableCache and
+// Quiet are pointers, so that a client that sets them to false overrides a default of true.
+type ClientOpts struct {
+	DisableCache *bool
+	CacheDir     string
+	Quiet        *bool
+	Chdir        string
+	SubTool      string
+}
+
+// server holds the state that is shared between the handlers.
+type server struct {
+	runs       *runRegistry
+	chats      *chatRegistry
+	openAI     *openAIConversations
+	sessions   *sessionRegistry
+	store      store.Store
+	notifier   *eventNotifier
+	limiter    *runLimiter
+	circuits   *circuitBreakers
+	modelCheck *modelCheck
+	uploads    *uploadStore
+	tools      *toolCache
+	registry   *toolRegistry
+	workers    *workerQueue
+	auditLog   auditSink
+	publisher  *eventPublisher
+	cache      *resultCache
+	parseCache *resultCache
+	cors       *cors.Cors
+	scheduler  *scheduler
+	secrets    secrets.Store
+	artifacts  artifacts.Store
+	// rateLimiters limit the rate of requests of each client to the endpoints of each class, which is the scope of the endpoint.
+	rateLimiters map[scope]*clientRateLimiter
+	// cluster is the replica of the server in cluster mode, or nil if cluster mode is disabled.
+	cluster *cluster
+	// graphQL is the schema of the GraphQL API, whose fields are resolved with requests to handler, which is the handler of the
+	// server with all of its middleware.
+	graphQL *graphql.Schema
+	handler http.Handler
+
+	// workspaces is the directory of the workspaces of the runs that don't have a session, when artifacts are kept.
+	workspaces string
+
+	// gptscript is the gptscript binary that was resolved when the server started.
+	gptscript gptscriptBinary
+
+	// started is when the server started.
+	started time.Time
+	// openStreams is the number of streams of events that are open.
+	openStreams atomic.Int64
+
+	// draining is true while the server isn't accepting new runs, so that it can be stopped once the runs in progress have ended.
+	draining atomic.Bool
+	// readOnly is true while the server only allows parsing, formatting, and listing.
+	readOnly atomic.Bool
+
+	// janitorLock is held while the janitor cleans up the disk, so that only one cleanup runs at a time.
+	janitorLock sync.Mutex
+
+	// settings are the parts of the config that can be reloaded while the server is running.
+	settings atomic.Pointer[settings]
 }
 
 func Start(ctx context.Context, config Config) error {
 	sigCtx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL)
 	defer cancel()
 
-	addRoutes(http.DefaultServeMux)
+	// The config from the flags is kept, so that settings that are removed from the config file go back to their value in it.
+	base := config
+	config, err := loadConfig(base)
+	if err != nil {
+		return err
+	}
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("Failed to shut down tracing", "error", err)
+		}
+	}()
+
+	var history store.Store = store.NewMemory(runRetention)
+	if config.RunHistoryDB != "" {
+		history, err = store.NewSQLite(ctx, config.RunHistoryDB)
+		if err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err := history.Close(); err != nil {
+			slog.Error("Failed to close run history", "error", err)
+		}
+	}()
+
+	uploads, removeUploads, err := newUploadStore(config.UploadDir)
+	if err != nil {
+		return err
+	}
+	defer removeUploads()
+	// The upload directory is set to the temporary directory, if one is used, so that backends can make uploaded files available.
+	config.UploadDir, base.UploadDir = uploads.dir, uploads.dir
+
+	storage, err := newStorage(config.Storage)
+	if err != nil {
+		return err
+	}
+
+	tools, err := newToolCache(uploads.dir, config.ToolCacheTTL, prefixedStorage(storage, storageTools))
+	if err != nil {
+		return err
+	}
+
+	registry, err := newToolRegistry(uploads.dir)
+	if err != nil {
+		return err
+	}
+
+	replicas, err := newCluster(config.Cluster, prefixedStorage(storage, storageCluster))
+	if err != nil {
+		return err
+	}
+
+	sessions, err := newSessionRegistry(uploads.dir, prefixedStorage(storage, storageSessions))
+	if err != nil {
+		return err
+	}
+
+	workspaces, err := newRunWorkspaces(uploads.dir)
+	if err != nil {
+		return err
+	}
+
+	auditLog, err := newAuditSink(config.AuditLog)
+	if err != nil {
+		return err
+	}
+
+	publisher, err := newEventPublisher(config.Brokers)
+	if err != nil {
+		return err
+	}
+
+	var credentials secrets.Store = secrets.NewMemory()
+	if config.CredentialsFile != "" {
+		credentials, err = secrets.NewFile(config.CredentialsFile, config.CredentialsKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	s := &server{
+		runs:       newRunRegistry(history),
+		chats:      newChatRegistry(),
+		openAI:     newOpenAIConversations(),
+		sessions:   sessions,
+		store:      history,
+		notifier:   newEventNotifier(),
+		limiter:    newRunLimiter(config.MaxConcurrentRuns, config.MaxQueuedRuns),
+		circuits:   newCircuitBreakers(),
+		modelCheck: newModelCheck(),
+		uploads:    uploads,
+		tools:      tools,
+		registry:   registry,
+		workers:    newWorkerQueue(),
+		auditLog:   auditLog,
+		publisher:  publisher,
+		cache:      newResultCache(config.ResultCacheTTL, config.ResultCacheSize),
+		parseCache: newResultCache(config.ParseCacheTTL, config.ParseCacheSize),
+		scheduler:  newScheduler(),
+		secrets:    credentials,
+		workspaces: workspaces,
+		cluster:    replicas,
+		started:    time.Now(),
+	}
+	s.rateLimiters = map[scope]*clientRateLimiter{
+		scopeParse: newClientRateLimiter(config.ParseRateLimit),
+		scopeExec:  newClientRateLimiter(config.ExecRateLimit),
+	}
+
+	s.cors, err = newCORS(config.CORS)
+	if err != nil {
+		return err
+	}
+
+	defer s.closeAuditLog()
+	defer s.publisher.close()
+
+	RegisterBackend(BackendWorkers, func(Config) (ExecBackend, error) {
+		return s.workers, nil
+	})
 
-	server := http.Server{
+	st, err := newSettings(sigCtx, config)
+	if err != nil {
+		return err
+	}
+	s.applySettings(st)
+
+	// The gptscript binary is resolved when the server starts, so that a server that can't run gptscript fails to start instead of
+	// failing its first run.
+	backend, _ := config.backendName()
+	s.gptscript, err = resolveGPTScript(sigCtx, config.GPTScript, backend == BackendHost)
+	if err != nil {
+		return err
+	}
+	slog.Info("Using gptscript", "path", s.gptscript.Path, "source", s.gptscript.Source)
+	warnProcessLimits(config, backend == BackendHost)
+
+	s.artifacts, err = newArtifactStore(config.Artifacts, storage)
+	if err != nil {
+		return fmt.Errorf("failed to create artifact store: %w", err)
+	}
+
+	go s.watchConfig(sigCtx, base)
+	go s.runJanitor(sigCtx)
+
+	stopSchedules, err := s.startSchedules(ctx)
+	if err != nil {
+		return err
+	}
+	defer stopSchedules()
+
+	leaveCluster, err := s.cluster.start(sigCtx)
+	if err != nil {
+		return err
+	}
+	defer leaveCluster()
+
+	s.graphQL = newGraphQLSchema(s)
+
+	mux := http.NewServeMux()
+	s.addRoutes(mux)
+
+	httpServer := http.Server{
 		Addr: ":" + config.Port,
-		Handler: apply(http.DefaultServeMux,
+		Handler: apply(mux,
+			traceRequest,
 			addRequestID,
 			addLogger,
 			logRequest,
-			cors.Default().Handler,
+			s.compress,
+			s.cors.Handler,
+			s.authenticate,
 			contentType("application/json"),
 		),
 	}
+	s.handler = httpServer.Handler
+
+	if config.GRPCPort != "" {
+		if config.GRPCPort == config.Port {
+			return errors.New("the gRPC port must be different from the server port")
+		}
+
+		lis, err := net.Listen("tcp", ":"+config.GRPCPort)
+		if err != nil {
+			return fmt.Errorf("failed to listen for gRPC: %w", err)
+		}
+
+		grpcServer := newGRPCServer(httpServer.Handler)
+		defer grpcServer.GracefulStop()
+
+		slog.Info("Starting gRPC server", "addr", lis.Addr())
+		go func() {
+			if err := grpcServer.Serve(lis); err != nil {
+				slog.Error("gRPC server stopped", "error", err)
+			}
+		}()
+	}
+
+	if config.DebugPort != "" {
+		if config.DebugPort == config.Port || config.DebugPort == config.GRPCPort {
+			return errors.New("the debug port must be different from the server and gRPC ports")
+		}
+
+		debugServer := &http.Server{Addr: ":" + config.DebugPort, Handler: s.debugHandler()}
+		defer debugServer.Close()
+
+		slog.Info("Starting debug server", "addr", debugServer.Addr)
+		go func() {
+			if err := debugServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Debug server stopped", "error", err)
+			}
+		}()
+	}
+
+	if config.HTTP2 {
+		// Registering the HTTP/2 server with the server lets it close the HTTP/2 connections gracefully when it shuts down.
+		h2s := &http2.Server{}
+		if err := http2.ConfigureServer(&httpServer, h2s); err != nil {
+			return fmt.Errorf("failed to configure HTTP/2: %w", err)
+		}
+		httpServer.Handler = h2c.NewHandler(httpServer.Handler, h2s)
+	}
+
+	// stdioDone is closed once stdin is closed, if JSON-RPC is served on stdio, which stops the server like a signal does.
+	stdioDone := make(chan struct{})
+	if config.JSONRPCStdio {
+		slog.Info("Serving JSON-RPC on stdio")
+		go func() {
+			defer close(stdioDone)
+			s.serveJSONRPCStdio(sigCtx, os.Stdin, os.Stdout, config.JSONRPCStdioAPIKey)
+		}()
+	}
 
-	slog.Info("Starting server", "addr", server.Addr)
+	slog.Info("Starting server", "addr", httpServer.Addr, "http2", config.HTTP2)
 	errChan := make(chan error)
 	go func() {
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			select {
 			case errChan <- fmt.Errorf("failed to start server: %w", err):
 			default:
@@ -46,12 +579,13 @@ func Start(ctx context.Context, config Config) error {
 
 	select {
 	case <-sigCtx.Done():
+	case <-stdioDone:
 	case err := <-errChan:
 		return err
 	}
 
 	slog.Info("Shutting down server")
-	if err := server.Shutdown(ctx); err != nil {
+	if err := httpServer.Shutdown(ctx); err != nil {
 		return fmt.Errorf("failed to shutdown server: %w", err)
 	}
 
@@ -0,0 +1,544 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/objects"
+)
+
+const (
+	// sessionHeader is the header that requests pass the token of a session in.
+	sessionHeader = "X-Session-Token"
+	// sessionRetention is how long a session is kept after it was last used.
+	sessionRetention = time.Hour
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// sessionRequest creates a session. The credentials are added to every run of the session, on top of the credentials that the
+// run lists.
+type sessionRequest struct {
+	Credentials []string `json:"credentials,omitempty"`
+}
+
+// sessionInfo is a session as it is returned by the API. The token is only returned when the session is created, since only the
+// hash of the token is kept.
+type sessionInfo struct {
+	Token       string    `json:"token,omitempty"`
+	Credentials []string  `json:"credentials"`
+	ChatID      string    `json:"chatID,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// session binds the context that a sequence of calls shares: the credentials that are added to each run, a workspace directory
+// that the files written by the runs are kept in, and the chat that messages sent to the session go to.
+type session struct {
+	// id is the hash of the token, so that the tokens themselves are not kept around.
+	id          string
+	owner       chatCaller
+	credentials []string
+	workspace   string
+	chatID      string
+	createdAt   time.Time
+	usedAt      time.Time
+	// synced is when the workspace was last pulled from or pushed to the storage of the server, if it has one.
+	synced time.Time
+}
+
+// sessionRecord is a session as it is kept in the storage of the server, so that the other replicas of the server can find it.
+type sessionRecord struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Credentials []string  `json:"credentials,omitempty"`
+	ChatID      string    `json:"chatID,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UsedAt      time.Time `json:"usedAt"`
+}
+
+func (s *session) info() sessionInfo {
+	return sessionInfo{
+		Credentials: slices.Clone(s.credentials),
+		ChatID:      s.chatID,
+		CreatedAt:   s.createdAt,
+		ExpiresAt:   s.usedAt.Add(sessionRetention),
+	}
+}
+
+// sessionRegistry keeps the sessions, and their workspaces in a directory of the upload directory, so that backends can make
+// them available like uploaded files. If the server has storage, then the sessions and their workspaces are kept in it too, so that
+// the sessions can be used through every replica of the server: a session that a replica doesn't know is loaded from the storage,
+// and the workspace of a session is pulled from the storage before each of its runs and pushed to it after. The chats of sessions
+// are only kept by the replica that they were created on.
+type sessionRegistry struct {
+	dir     string
+	storage objects.Store
+
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionRegistry(uploadDir string, storage objects.Store) (*sessionRegistry, error) {
+	dir := filepath.Join(uploadDir, ".sessions")
+	// Sessions are kept in memory, so the workspaces of the sessions from before the server restarted can't be used again. The
+	// sessions in the storage of the server are loaded into new workspaces.
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clear session workspaces: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create session workspaces: %w", err)
+	}
+	return &sessionRegistry{dir: dir, storage: storage, sessions: make(map[string]*session)}, nil
+}
+
+// create creates a session of the owner with a new workspace, and returns it with its token.
+func (sr *sessionRegistry) create(ctx context.Context, owner chatCaller, credentials []string) (sessionInfo, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return sessionInfo{}, err
+	}
+	token := hex.EncodeToString(b)
+
+	workspace, err := os.MkdirTemp(sr.dir, "session-")
+	if err != nil {
+		return sessionInfo{}, err
+	}
+
+	now := time.Now()
+	s := &session{
+		id:          hashKey(token),
+		owner:       owner,
+		credentials: slices.Clone(credentials),
+		workspace:   workspace,
+		createdAt:   now,
+		usedAt:      now,
+	}
+	if err = sr.save(ctx, s); err != nil {
+		_ = os.RemoveAll(workspace)
+		return sessionInfo{}, err
+	}
+
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	sr.prune()
+	sr.sessions[s.id] = s
+
+	info := s.info()
+	info.Token = token
+	return info, nil
+}
+
+// get returns the session of the token, if it is owned by the owner, and records that it was used.
+func (sr *sessionRegistry) get(ctx context.Context, token string, owner chatCaller) (*session, error) {
+	return sr.getByID(ctx, hashKey(token), owner)
+}
+
+// getByID returns the session with the ID, if it is owned by the owner, and records that it was used. A session that isn't known is
+// loaded from the storage of the server, if it has one.
+func (sr *sessionRegistry) getByID(ctx context.Context, id string, owner chatCaller) (*session, error) {
+	sr.lock.Lock()
+	sr.prune()
+	s, ok := sr.sessions[id]
+	sr.lock.Unlock()
+
+	if !ok {
+		var err error
+		if s, err = sr.load(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	if s.owner != owner {
+		return nil, errSessionNotFound
+	}
+
+	s.usedAt = time.Now()
+	return s, nil
+}
+
+// info returns the session of the token as it is returned by the API.
+func (sr *sessionRegistry) info(ctx context.Context, token string, owner chatCaller) (sessionInfo, error) {
+	s, err := sr.get(ctx, token, owner)
+	if err != nil {
+		return sessionInfo{}, err
+	}
+
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	return s.info(), nil
+}
+
+// bindChat makes the chat the chat of the session, which messages sent to the session go to.
+func (sr *sessionRegistry) bindChat(ctx context.Context, id, chatID string) {
+	sr.lock.Lock()
+	s, ok := sr.sessions[id]
+	if ok {
+		s.chatID = chatID
+	}
+	sr.lock.Unlock()
+
+	if ok {
+		if err := sr.save(ctx, s); err != nil {
+			ccontext.GetLogger(ctx).Error("Failed to save session", "error", err)
+		}
+	}
+}
+
+// chat returns the chat of the session.
+func (sr *sessionRegistry) chat(id string) string {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	if s, ok := sr.sessions[id]; ok {
+		return s.chatID
+	}
+	return ""
+}
+
+// delete deletes the session of the token and its workspace, from the storage of the server too. Runs of the session that are in
+// progress carry on, but the files that they write are lost.
+func (sr *sessionRegistry) delete(ctx context.Context, token string, owner chatCaller) error {
+	s, err := sr.get(ctx, token, owner)
+	if err != nil {
+		return err
+	}
+
+	sr.lock.Lock()
+	delete(sr.sessions, s.id)
+	sr.lock.Unlock()
+
+	if err = sr.forget(ctx, s.id); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.workspace)
+}
+
+// prune removes the sessions that haven't been used for sessionRetention, with their workspaces. They are left in the storage of
+// the server, where they expire once they are loaded, because another replica might have used them since. The lock must be held by
+// the caller.
+func (sr *sessionRegistry) prune() {
+	for id, s := range sr.sessions {
+		if time.Since(s.usedAt) > sessionRetention {
+			delete(sr.sessions, id)
+			_ = os.RemoveAll(s.workspace)
+		}
+	}
+}
+
+// evict removes the sessions that expired, and then the sessions that were used least recently, with their workspaces, until the
+// workspaces of the others take up at most maxSize bytes. The sessions that were used within idle aren't removed, since they might
+// have runs in progress. It returns what was removed, other than the sessions that expired.
+func (sr *sessionRegistry) evict(maxSize int64, idle time.Duration) cleanupReport {
+	sr.lock.Lock()
+	sr.prune()
+	entries := make([]diskEntry, 0, len(sr.sessions))
+	for id, s := range sr.sessions {
+		entries = append(entries, diskEntry{key: id, path: s.workspace, modTime: s.usedAt})
+	}
+	sr.lock.Unlock()
+
+	for i := range entries {
+		entries[i].size, _ = diskUsageOf(entries[i].path)
+	}
+
+	return evictEntries(cleanupWorkspaces, entries, 0, maxSize, func(e diskEntry) bool {
+		if time.Since(e.modTime) < idle {
+			return false
+		}
+
+		sr.lock.Lock()
+		s, ok := sr.sessions[e.key]
+		// The session isn't removed if it was used since it was listed.
+		ok = ok && s.usedAt.Equal(e.modTime)
+		if ok {
+			delete(sr.sessions, e.key)
+		}
+		sr.lock.Unlock()
+
+		return ok && removeEntry(e)
+	})
+}
+
+// save writes the session to the storage of the server, if it has one.
+func (sr *sessionRegistry) save(ctx context.Context, s *session) error {
+	if sr.storage == nil {
+		return nil
+	}
+
+	sr.lock.Lock()
+	record := sessionRecord{
+		ID:          s.id,
+		Tenant:      s.owner.tenant,
+		Owner:       s.owner.name,
+		Credentials: s.credentials,
+		ChatID:      s.chatID,
+		CreatedAt:   s.createdAt,
+		UsedAt:      s.usedAt,
+	}
+	b, err := json.Marshal(record)
+	sr.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return sr.storage.Put(ctx, objects.Object{Key: s.id + ".json", Size: int64(len(b))}, bytes.NewReader(b))
+}
+
+// load loads the session with the ID from the storage of the server into a new workspace, or returns errSessionNotFound if there is
+// no such session or it has expired, in which case it is deleted from the storage. The files of its workspace are pulled before its
+// runs.
+func (sr *sessionRegistry) load(ctx context.Context, id string) (*session, error) {
+	if sr.storage == nil {
+		return nil, errSessionNotFound
+	}
+
+	rc, _, err := sr.storage.Open(ctx, id+".json")
+	if errors.Is(err, objects.ErrNotFound) {
+		return nil, errSessionNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load session: %w", err)
+	}
+	defer rc.Close()
+
+	var record sessionRecord
+	if err = json.NewDecoder(rc).Decode(&record); err != nil {
+		return nil, fmt.Errorf("failed to load session: %w", err)
+	}
+	if time.Since(record.UsedAt) > sessionRetention {
+		if err = sr.forget(ctx, id); err != nil {
+			ccontext.GetLogger(ctx).Error("Failed to delete expired session", "error", err)
+		}
+		return nil, errSessionNotFound
+	}
+
+	workspace, err := os.MkdirTemp(sr.dir, "session-")
+	if err != nil {
+		return nil, err
+	}
+
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	// The session might have been loaded by another request in the meantime.
+	if s, ok := sr.sessions[id]; ok {
+		_ = os.RemoveAll(workspace)
+		return s, nil
+	}
+
+	s := &session{
+		id:          id,
+		owner:       chatCaller{tenant: record.Tenant, name: record.Owner},
+		credentials: record.Credentials,
+		workspace:   workspace,
+		chatID:      record.ChatID,
+		createdAt:   record.CreatedAt,
+		usedAt:      record.UsedAt,
+	}
+	sr.sessions[id] = s
+	return s, nil
+}
+
+// forget deletes the session with the ID and its workspace from the storage of the server, if it has one.
+func (sr *sessionRegistry) forget(ctx context.Context, id string) error {
+	if sr.storage == nil {
+		return nil
+	}
+
+	list, err := sr.storage.List(ctx, id+"/")
+	if err != nil {
+		return err
+	}
+	for _, o := range list {
+		if err = sr.storage.Delete(ctx, o.Key); err != nil {
+			return err
+		}
+	}
+	return sr.storage.Delete(ctx, id+".json")
+}
+
+// pull pulls the workspace of the session from the storage of the server, if it has one, so that a run of the session sees the
+// files that the runs of the session on the other replicas wrote.
+func (sr *sessionRegistry) pull(ctx context.Context, s *session) error {
+	if sr.storage == nil {
+		return nil
+	}
+
+	sr.lock.Lock()
+	since := s.synced
+	sr.lock.Unlock()
+
+	start := time.Now()
+	if err := objects.Pull(ctx, sr.storage, s.id+"/", s.workspace, since); err != nil {
+		return err
+	}
+
+	sr.lock.Lock()
+	s.synced = start
+	sr.lock.Unlock()
+	return nil
+}
+
+// push pushes the files of the workspace of the session that a run that started at the time wrote to the storage of the server, if
+// it has one, and records that the session was used.
+func (sr *sessionRegistry) push(ctx context.Context, s *session, since time.Time) error {
+	if sr.storage == nil {
+		return nil
+	}
+
+	start := time.Now()
+	if err := objects.Push(ctx, sr.storage, s.id+"/", s.workspace, since); err != nil {
+		return err
+	}
+
+	sr.lock.Lock()
+	s.synced, s.usedAt = start, time.Now()
+	sr.lock.Unlock()
+	return sr.save(ctx, s)
+}
+
+type sessionKey struct{}
+
+func withSession(ctx context.Context, s *session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// sessionOf returns the session of the request of the context, if it has one.
+func sessionOf(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
+}
+
+// withSessionToken wraps the handler so that the session of the token in the session header of the request, if there is one, is
+// added to the request context, where runs pick it up.
+func (s *server) withSessionToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(sessionHeader)
+		if token == "" {
+			h(w, r)
+			return
+		}
+
+		sess, err := s.sessions.get(r.Context(), token, chatCallerOf(r))
+		if errors.Is(err, errSessionNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		h(w, r.WithContext(withSession(r.Context(), sess)))
+	}
+}
+
+// sessionEnv returns the credentials of the run with the credentials of the session of the context added, and the environment
+// variables that make the workspace of the session the workspace of the run.
+func sessionEnv(ctx context.Context, credentials []string) ([]string, []string) {
+	sess := sessionOf(ctx)
+	if sess == nil {
+		return credentials, nil
+	}
+
+	credentials = slices.Clone(credentials)
+	for _, c := range sess.credentials {
+		if !slices.Contains(credentials, c) {
+			credentials = append(credentials, c)
+		}
+	}
+	return credentials, []string{"GPTSCRIPT_WORKSPACE=" + sess.workspace}
+}
+
+// createSession creates a session for the caller. The token of the session is passed in the X-Session-Token header of the requests
+// to run tools and files, and to chat, so that they share the session.
+func (s *server) createSession(w http.ResponseWriter, r *http.Request) {
+	req := new(sessionRequest)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// The credentials are checked now, so that a session isn't created that no run could use.
+	if _, err := s.credentialEnv(tenantOf(r.Context()), req.Credentials); err != nil {
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			writeError(w, http.StatusBadRequest, err)
+		} else {
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	info, err := s.sessions.create(r.Context(), chatCallerOf(r), req.Credentials)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create session: %w", err))
+		return
+	}
+
+	ccontext.GetLogger(r.Context()).Info("Created session", "credentials", len(info.Credentials))
+
+	w.WriteHeader(http.StatusCreated)
+	writeResponse(w, info)
+}
+
+// getSession returns the session of the token in the session header.
+func (s *server) getSession(w http.ResponseWriter, r *http.Request) {
+	info, err := s.sessions.info(r.Context(), r.Header.Get(sessionHeader), chatCallerOf(r))
+	if errors.Is(err, errSessionNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeResponse(w, info)
+}
+
+// deleteSession deletes the session of the token in the session header, along with its workspace.
+func (s *server) deleteSession(w http.ResponseWriter, r *http.Request) {
+	err := s.sessions.delete(r.Context(), r.Header.Get(sessionHeader), chatCallerOf(r))
+	if errors.Is(err, errSessionNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to delete workspace of session: %w", err))
+		return
+	}
+
+	writeResponse(w, map[string]string{"status": "ok"})
+}
+
+// sendSessionMessage sends the message to the chat of the session, which is the last chat that was created with the session.
+func (s *server) sendSessionMessage(w http.ResponseWriter, r *http.Request) {
+	sess := sessionOf(r.Context())
+	if sess == nil {
+		writeError(w, http.StatusBadRequest, errors.New("the "+sessionHeader+" header is required"))
+		return
+	}
+
+	chatID := s.sessions.chat(sess.id)
+	if chatID == "" {
+		writeError(w, http.StatusNotFound, errors.New("the session has no chat, create one with the session first"))
+		return
+	}
+
+	r.SetPathValue("id", chatID)
+	s.sendChatMessage(w, r)
+}
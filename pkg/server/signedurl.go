@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+const (
+	signedURLDefaultExpiry = time.Hour
+	signedURLMaxExpiry     = 7 * 24 * time.Hour
+)
+
+// signedURLRequest is the body of a request to sign a URL of the results of a run.
+type signedURLRequest struct {
+	// Path is what the URL gets, relative to the run: output, output/raw, or artifacts/ followed by the path of an artifact.
+	Path string `json:"path"`
+	// ExpiresIn is how long the URL can be gotten for, like 24h. It defaults to an hour and can be at most a week.
+	ExpiresIn string `json:"expiresIn,omitempty"`
+}
+
+func (r *signedURLRequest) validate() error {
+	switch name, artifact := strings.CutPrefix(r.Path, "artifacts/"); {
+	case r.Path == "output", r.Path == "output/raw":
+	case artifact && name != "":
+	default:
+		return invalidField("path", fmt.Sprintf("invalid path %q, must be output, output/raw, or artifacts/ followed by the path of an artifact", r.Path))
+	}
+
+	if r.ExpiresIn != "" {
+		d, err := time.ParseDuration(r.ExpiresIn)
+		if err != nil || d <= 0 || d > signedURLMaxExpiry {
+			return invalidField("expiresIn", fmt.Sprintf("invalid expiresIn %q, must be a positive duration of at most %s", r.ExpiresIn, signedURLMaxExpiry))
+		}
+	}
+	return nil
+}
+
+func (r *signedURLRequest) expiry() time.Duration {
+	if d, err := time.ParseDuration(r.ExpiresIn); err == nil {
+		return d
+	}
+	return signedURLDefaultExpiry
+}
+
+// signedURL is a URL of the results of a run that can be gotten without credentials until it expires.
+type signedURL struct {
+	// URL is the path and query of the URL, relative to the server.
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// createSignedURL signs a URL of the output or an artifact of a run of the tenant of the caller, so that it can be shared with
+// systems that don't have credentials, like in the emails of scheduled runs.
+func (s *server) createSignedURL(w http.ResponseWriter, r *http.Request) {
+	key := s.current().config.SignedURLKey
+	if key == "" {
+		writeError(w, http.StatusNotFound, errors.New("signed URLs are disabled"))
+		return
+	}
+
+	req := new(signedURLRequest)
+	if err := decodeRequest(r.Body, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tenant := tenantOf(r.Context())
+	run, err := s.store.GetRun(r.Context(), tenant, r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("run %q not found", r.PathValue("id")))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get run: %w", err))
+		return
+	}
+
+	// The signature covers the decoded path, and the URL has each of its segments escaped, so that it gets the same path back.
+	segments := append([]string{"", "runs", run.ID}, strings.Split(req.Path, "/")...)
+	escaped := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		escaped = append(escaped, url.PathEscape(segment))
+	}
+
+	expiresAt := time.Now().Add(req.expiry()).Truncate(time.Second)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	query := url.Values{"expires": {expires}}
+	if tenant != "" {
+		query.Set("tenant", tenant)
+	}
+	query.Set("signature", signURL([]byte(key), strings.Join(segments, "/"), tenant, expires))
+
+	context.GetLogger(r.Context()).Info("Signed URL of run", "run_id", run.ID, "path", req.Path, "expires_at", expiresAt)
+	writeResponse(w, signedURL{URL: strings.Join(escaped, "/") + "?" + query.Encode(), ExpiresAt: expiresAt})
+}
+
+// signURL returns the signature of a URL that gets the path as the tenant until the Unix time of expires.
+func signURL(key []byte, path, tenant, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(http.MethodGet + "\n" + path + "\n" + tenant + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedURLAuthenticator authenticates requests for signed URLs, which are granted the exec scope in the tenant they were signed
+// for, but only for the path they were signed for.
+type signedURLAuthenticator struct {
+	key []byte
+}
+
+func (a *signedURLAuthenticator) authenticate(r *http.Request) (*context.Identity, error) {
+	query := r.URL.Query()
+	signature := query.Get("signature")
+	if signature == "" || bearerToken(r) != "" {
+		return nil, nil
+	}
+	if r.Method != http.MethodGet {
+		return nil, errors.New("signed URLs can only be gotten")
+	}
+
+	tenant, expires := query.Get("tenant"), query.Get("expires")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid expiry of signed URL")
+	}
+	if !hmac.Equal([]byte(signature), []byte(signURL(a.key, r.URL.Path, tenant, expires))) {
+		return nil, errors.New("invalid signature of signed URL")
+	}
+	if time.Now().Unix() > unix {
+		return nil, errors.New("the signed URL has expired")
+	}
+
+	return &context.Identity{
+		Name:   "signed-url-" + signature[:8],
+		Scope:  scopeExec.String(),
+		Tenant: tenant,
+	}, nil
+}
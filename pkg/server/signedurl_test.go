@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+const testSignedURLKey = "signing-key"
+
+func TestSignedURLRequestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     signedURLRequest
+		wantErr bool
+	}{
+		{name: "output", req: signedURLRequest{Path: "output"}},
+		{name: "raw output", req: signedURLRequest{Path: "output/raw", ExpiresIn: "24h"}},
+		{name: "artifact", req: signedURLRequest{Path: "artifacts/out/report.txt", ExpiresIn: "168h"}},
+		{name: "no artifact", req: signedURLRequest{Path: "artifacts/"}, wantErr: true},
+		{name: "other path", req: signedURLRequest{Path: "events"}, wantErr: true},
+		{name: "invalid expiry", req: signedURLRequest{Path: "output", ExpiresIn: "soon"}, wantErr: true},
+		{name: "negative expiry", req: signedURLRequest{Path: "output", ExpiresIn: "-1h"}, wantErr: true},
+		{name: "expiry longer than a week", req: signedURLRequest{Path: "output", ExpiresIn: "169h"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.req.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignedURLAuthenticate(t *testing.T) {
+	a := &signedURLAuthenticator{key: []byte(testSignedURLKey)}
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+
+	signed := func(path, tenant, expires string) url.Values {
+		query := url.Values{"expires": {expires}, "signature": {signURL([]byte(testSignedURLKey), path, tenant, expires)}}
+		if tenant != "" {
+			query.Set("tenant", tenant)
+		}
+		return query
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		query      url.Values
+		token      string
+		wantID     bool
+		wantTenant string
+		wantErr    bool
+	}{
+		{name: "valid", path: "/runs/r1/output", query: signed("/runs/r1/output", "", future), wantID: true},
+		{name: "valid for a tenant", path: "/runs/r1/output", query: signed("/runs/r1/output", "acme", future), wantID: true, wantTenant: "acme"},
+		{name: "no signature", path: "/runs/r1/output", query: url.Values{"expires": {future}}},
+		{name: "bearer token takes precedence", path: "/runs/r1/output", query: signed("/runs/r1/output", "", future), token: "key"},
+		{name: "expired", path: "/runs/r1/output", query: signed("/runs/r1/output", "", past), wantErr: true},
+		{name: "other path", path: "/runs/r2/output", query: signed("/runs/r1/output", "", future), wantErr: true},
+		{name: "not a GET", method: http.MethodDelete, path: "/runs/r1/output", query: signed("/runs/r1/output", "", future), wantErr: true},
+		{name: "invalid expiry", path: "/runs/r1/output", query: url.Values{"expires": {"never"}, "signature": {"00"}}, wantErr: true},
+		{
+			name: "other tenant",
+			path: "/runs/r1/output",
+			query: func() url.Values {
+				q := signed("/runs/r1/output", "acme", future)
+				q.Set("tenant", "other")
+				return q
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "extended expiry",
+			path: "/runs/r1/output",
+			query: func() url.Values {
+				q := signed("/runs/r1/output", "", future)
+				q.Set("expires", strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10))
+				return q
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "signed with another key",
+			path: "/runs/r1/output",
+			query: url.Values{
+				"expires":   {future},
+				"signature": {signURL([]byte("other-key"), "/runs/r1/output", "", future)},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.path+"?"+tt.query.Encode(), nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			id, err := a.authenticate(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got identity %v", id)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if (id != nil) != tt.wantID {
+				t.Fatalf("got identity %v, want one: %v", id, tt.wantID)
+			}
+			if id != nil && (id.Scope != "exec" || id.Tenant != tt.wantTenant) {
+				t.Errorf("got scope %q and tenant %q, want exec and %q", id.Scope, id.Tenant, tt.wantTenant)
+			}
+		})
+	}
+}
+
+func TestCreateSignedURL(t *testing.T) {
+	st := store.NewMemory(time.Hour)
+	if err := st.SaveRun(context.Background(), store.Run{ID: "r1", Tenant: "acme", State: string(runStateFinished)}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{store: st}
+	s.settings.Store(&settings{config: Config{SignedURLKey: testSignedURLKey}})
+
+	create := func(tenant string, req signedURLRequest) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(req)
+		r := httptest.NewRequest(http.MethodPost, "/runs/r1/signed-urls", strings.NewReader(string(b)))
+		r.SetPathValue("id", "r1")
+		r = r.WithContext(ccontext.WithIdentity(r.Context(), &ccontext.Identity{Scope: "exec", Tenant: tenant}))
+		w := httptest.NewRecorder()
+		s.createSignedURL(w, r)
+		return w
+	}
+
+	// The path of the artifact has characters that are escaped in the URL, which must be signed the way the server gets it back.
+	w := create("acme", signedURLRequest{Path: "artifacts/out/report 1.txt", ExpiresIn: "1h"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var signed signedURL
+	if err := json.Unmarshal(w.Body.Bytes(), &signed); err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(signed.ExpiresAt); until <= 0 || until > time.Hour {
+		t.Errorf("got expiry in %s, want within an hour", until)
+	}
+
+	a := &signedURLAuthenticator{key: []byte(testSignedURLKey)}
+	id, err := a.authenticate(httptest.NewRequest(http.MethodGet, signed.URL, nil))
+	if err != nil {
+		t.Fatalf("the signed URL %s was not accepted: %v", signed.URL, err)
+	}
+	if id == nil || id.Tenant != "acme" {
+		t.Fatalf("got identity %v, want one in acme", id)
+	}
+
+	// Runs of other tenants can't be signed.
+	if w = create("other", signedURLRequest{Path: "output"}); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for the run of another tenant, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// Signed URLs are disabled without a key.
+	s.settings.Store(new(settings))
+	if w = create("acme", signedURLRequest{Path: "output"}); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d without a key, want %d", w.Code, http.StatusNotFound)
+	}
+}
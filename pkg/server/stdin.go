@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+type stdinKey struct{}
+
+// withStdin sets the standard input of the run of the context, which the input of the file of the run is read from.
+func withStdin(ctx context.Context, stdin io.Reader) context.Context {
+	return context.WithValue(ctx, stdinKey{}, stdin)
+}
+
+// runStdin returns the standard input of the run of the context, or nil if the input of the run is given in the request.
+func runStdin(ctx context.Context) io.Reader {
+	stdin, _ := ctx.Value(stdinKey{}).(io.Reader)
+	return stdin
+}
+
+// stdinFileHandler is an execFileHandler for files whose input is streamed in the request body, rather than given in the input
+// field, so that inputs that are too large for a JSON string can be run. The body is a multipart form with a request part, which
+// is the file request as JSON, followed by an input part, which is piped to the standard input of gptscript as it is read. Since
+// the input can only be read once, these runs are neither cached nor retried.
+func (s *server) stdinFileHandler(process func(ctx context.Context, l *slog.Logger, w http.ResponseWriter, opts requestOpts, path, input string) (string, error), queued queueNotifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The input is still being read while the output is written, which HTTP/1.1 only allows once it is enabled. HTTP/2 always
+		// allows it, so the error that it isn't supported there is ignored.
+		_ = http.NewResponseController(w).EnableFullDuplex()
+
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, &requestError{code: errorCodeInvalidRequest, msg: fmt.Sprintf("a multipart form with a request and an input part is required: %v", err)})
+			return
+		}
+
+		part, err := mr.NextPart()
+		if err != nil || part.FormName() != "request" {
+			writeError(w, http.StatusBadRequest, missingField("request", "the first part of the form must be the request"))
+			return
+		}
+
+		reqObject := new(fileRequest)
+		if err = decodeRequest(part, reqObject); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if reqObject.Input != "" {
+			writeError(w, http.StatusBadRequest, invalidField("input", "the input is streamed in the input part instead"))
+			return
+		}
+
+		part, err = mr.NextPart()
+		if err != nil || part.FormName() != "input" {
+			writeError(w, http.StatusBadRequest, missingField("input", "the second part of the form must be the input"))
+			return
+		}
+
+		// The input is cut off at the input limit, which fails the run, since the limit of the body can't tell it from the request.
+		stdin := http.MaxBytesReader(w, part, s.limits().Input)
+		s.runFile(w, r.WithContext(withStdin(r.Context(), stdin)), reqObject, true, process, queued)
+	}
+}
+
+// streamStdinFileHandler is a stdinFileHandler whose process function streams its output to the response, like
+// streamFileHandler.
+func (s *server) streamStdinFileHandler(process func(ctx context.Context, l *slog.Logger, w eventWriter, opts requestOpts, path, input string) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.stdinFileHandler(s.streamFileProcess(r, process), queuePositionWriter(r))(w, r)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/thedadams/clicky-serves/pkg/objects"
+)
+
+// The prefixes of the keys of the kinds of state that are kept in the storage of the server.
+const (
+	storageArtifacts = "artifacts/"
+	storageSessions  = "sessions/"
+	storageTools     = "tools/"
+	storageCluster   = "cluster/"
+)
+
+// newStorage returns the store of the bucket that the replicas of the server share, or nil if there is none.
+func newStorage(config objects.Config) (objects.Store, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+
+	store, err := objects.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+	return store, nil
+}
+
+// prefixedStorage returns the store of the kind of state with the prefix, or nil if the server has no storage.
+func prefixedStorage(store objects.Store, prefix string) objects.Store {
+	if store == nil {
+		return nil
+	}
+	return objects.Prefixed(store, prefix)
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// StreamBufferBlock makes the run wait for a slow client when the buffer of its stream is full.
+	StreamBufferBlock = "block"
+	// StreamBufferDropOldest drops the oldest events in the buffer of a stream when it is full, so that a slow client never holds
+	// up the run. The dropped events are still in the run history.
+	StreamBufferDropOldest = "drop-oldest"
+
+	// defaultStreamBufferSize is the number of writes that are buffered for each stream if the size isn't configured.
+	defaultStreamBufferSize = 256
+)
+
+// StreamConfig configures the streams of events to clients.
+type StreamConfig struct {
+	// BufferSize is the number of events that are buffered for each stream while the client reads them. It defaults to 256.
+	BufferSize int
+	// BufferPolicy is what happens when the buffer of a stream is full, either StreamBufferBlock, which is the default, or
+	// StreamBufferDropOldest.
+	BufferPolicy string
+	// KeepRunsOnDisconnect keeps a run going when the client of the request that started it disconnects, so that the client can
+	// follow the rest of the run from its events or fetch its output later. By default, the run is canceled.
+	KeepRunsOnDisconnect bool
+	// WriteTimeout is how long a write to a stream can take before the client is given up on, which happens when the client has
+	// stopped reading. If it is 0, then writes can take as long as they need.
+	WriteTimeout time.Duration
+	// FlushInterval is how often a stream is flushed to the client. If it is 0, which is the default, then each event is flushed as
+	// soon as it is written, so that proxies and TCP buffering don't hold it up. A positive interval sends the events of busy
+	// streams in fewer, bigger writes.
+	FlushInterval time.Duration
+	// MaxOutputSize is the number of bytes of output, events included, that the gptscript process of a streamed run can write before
+	// it is stopped. The stream then ends with a truncated event and an error, so that a tool that writes output forever can't
+	// exhaust the memory of the server or of the client. If it is 0, then the output isn't limited.
+	MaxOutputSize int64
+}
+
+func (c StreamConfig) validate() error {
+	if c.BufferSize < 0 {
+		return fmt.Errorf("buffer size must not be negative")
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("write timeout must not be negative")
+	}
+	if c.FlushInterval < 0 {
+		return fmt.Errorf("flush interval must not be negative")
+	}
+	if c.MaxOutputSize < 0 {
+		return fmt.Errorf("max output size must not be negative")
+	}
+
+	switch c.BufferPolicy {
+	case "", StreamBufferBlock, StreamBufferDropOldest:
+		return nil
+	default:
+		return fmt.Errorf("unknown buffer policy %q, must be %s or %s", c.BufferPolicy, StreamBufferBlock, StreamBufferDropOldest)
+	}
+}
+
+type maxOutputKey struct{}
+
+// withMaxOutput sets the max output size of the streamed processes of a run.
+func withMaxOutput(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, maxOutputKey{}, size)
+}
+
+// runMaxOutput returns the max output size of the streamed processes of the run of the context, which is 0 if it isn't limited.
+func runMaxOutput(ctx context.Context) int64 {
+	size, _ := ctx.Value(maxOutputKey{}).(int64)
+	return size
+}
+
+// minOutputSize returns the smaller of two max output sizes, where 0 isn't limited.
+func minOutputSize(a, b int64) int64 {
+	if a == 0 || b == 0 {
+		return max(a, b)
+	}
+	return min(a, b)
+}
+
+// openStream returns the stream of events to the client of the request, in the format that the request asked for. What is written
+// to the stream is buffered, so that a slow client doesn't hold up the run unless the buffer policy says to wait for it, and
+// heartbeats are written to the stream while it is idle. The returned function must be called before the handler returns.
+func (s *server) openStream(l *slog.Logger, w http.ResponseWriter, r *http.Request) (streamWriter, func()) {
+	config := s.current().config.Stream
+	resp := newStreamResponse(l, w, config)
+	bs := newBufferedStream(r.Context(), l, newStreamWriter(l, resp, r), resp, config)
+	hw, stopHeartbeat := s.withHeartbeat(bs)
+	return hw, func() {
+		stopHeartbeat()
+		bs.close()
+	}
+}
+
+// bufferedStream is a streamWriter that queues what is written to it, and writes it to the stream in the background. Once the
+// client has disconnected, everything that is written is dropped right away, so that nothing waits for a client that is gone.
+type bufferedStream struct {
+	l      *slog.Logger
+	policy string
+	resp   *streamResponse
+	// writes are the writes to the stream that haven't been made yet.
+	writes chan func(streamWriter)
+	// gone is done when the client has disconnected.
+	gone context.Context
+
+	lock    sync.Mutex
+	closed  bool
+	dropped int
+
+	// stop tells the background writer to make the queued writes and return, and done is closed once it has.
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBufferedStream(gone context.Context, l *slog.Logger, w streamWriter, resp *streamResponse, config StreamConfig) *bufferedStream {
+	size := config.BufferSize
+	if size <= 0 {
+		size = defaultStreamBufferSize
+	}
+
+	b := &bufferedStream{
+		l:      l,
+		policy: config.BufferPolicy,
+		resp:   resp,
+		writes: make(chan func(streamWriter), size),
+		gone:   gone,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go b.run(w)
+	return b
+}
+
+// run makes the queued writes until the stream is closed, or until the client disconnects. The flushes that are held back by the
+// flush interval are made on every tick of the interval.
+func (b *bufferedStream) run(w streamWriter) {
+	defer close(b.done)
+	defer b.resp.close()
+
+	var tick <-chan time.Time
+	if b.resp.flushInterval > 0 {
+		ticker := time.NewTicker(b.resp.flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case write := <-b.writes:
+			write(w)
+		case <-tick:
+			b.resp.flushPending()
+		case <-b.gone.Done():
+			b.l.Debug("client of stream disconnected")
+			return
+		case <-b.stop:
+			for {
+				select {
+				case write := <-b.writes:
+					write(w)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *bufferedStream) writeEvent(event any) {
+	b.queue(func(w streamWriter) {
+		w.writeEvent(event)
+	})
+}
+
+func (b *bufferedStream) writeEncodedEvent(id string, ev []byte) {
+	b.queue(func(w streamWriter) {
+		w.writeEncodedEvent(id, ev)
+	})
+}
+
+func (b *bufferedStream) writeHeartbeat() {
+	b.queue(func(w streamWriter) {
+		w.writeHeartbeat()
+	})
+}
+
+func (b *bufferedStream) finish() {
+	b.queue(func(w streamWriter) {
+		w.finish()
+	})
+}
+
+// queue queues the write. If the buffer is full, then it either waits for there to be room or drops the oldest write, depending on
+// the policy. The write is dropped if the stream is closed or the client has disconnected.
+func (b *bufferedStream) queue(write func(streamWriter)) {
+	b.lock.Lock()
+	closed := b.closed
+	b.lock.Unlock()
+	if closed || b.gone.Err() != nil {
+		return
+	}
+
+	if b.policy != StreamBufferDropOldest {
+		select {
+		case b.writes <- write:
+		case <-b.gone.Done():
+		case <-b.stop:
+		}
+		return
+	}
+
+	for {
+		select {
+		case b.writes <- write:
+			return
+		default:
+		}
+
+		select {
+		case <-b.writes:
+			b.lock.Lock()
+			b.dropped++
+			b.lock.Unlock()
+			streamEventsDropped.Inc()
+		default:
+		}
+	}
+}
+
+// close makes the writes that are still queued, unless the client has disconnected, and waits for the background writer to
+// return. Nothing is written to the stream after it is closed.
+func (b *bufferedStream) close() {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.closed = true
+	b.lock.Unlock()
+
+	close(b.stop)
+	<-b.done
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.dropped > 0 {
+		b.l.Warn("Dropped events of a slow client", "dropped", b.dropped)
+	}
+}
+
+// streamResponse is the response of a stream. It sets a deadline on each write, so that a client that has stopped reading is given
+// up on, and it holds flushes back, so that the stream is flushed at most once per flush interval. It is only used by the
+// background writer of its stream.
+type streamResponse struct {
+	http.ResponseWriter
+	l             *slog.Logger
+	rc            *http.ResponseController
+	writeTimeout  time.Duration
+	flushInterval time.Duration
+
+	lastFlush time.Time
+	pending   bool
+}
+
+func newStreamResponse(l *slog.Logger, w http.ResponseWriter, config StreamConfig) *streamResponse {
+	return &streamResponse{
+		ResponseWriter: w,
+		l:              l,
+		rc:             http.NewResponseController(w),
+		writeTimeout:   config.WriteTimeout,
+		flushInterval:  config.FlushInterval,
+	}
+}
+
+func (s *streamResponse) Write(b []byte) (int, error) {
+	if s.writeTimeout > 0 {
+		if err := s.rc.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			s.l.Debug("failed to set write deadline of stream", "error", err)
+		}
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush flushes the stream, unless it was flushed less than the flush interval ago, in which case the flush is left pending.
+func (s *streamResponse) Flush() {
+	if s.flushInterval > 0 && time.Since(s.lastFlush) < s.flushInterval {
+		s.pending = true
+		return
+	}
+	s.flush()
+}
+
+func (s *streamResponse) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// flushPending makes the flush that is pending, if there is one.
+func (s *streamResponse) flushPending() {
+	if s.pending {
+		s.flush()
+	}
+}
+
+func (s *streamResponse) flush() {
+	s.pending, s.lastFlush = false, time.Now()
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.l.Debug("failed to flush stream", "error", err)
+	}
+}
+
+// close makes the flush that is pending, and clears the write deadline, so that it doesn't apply to the next request on the
+// connection.
+func (s *streamResponse) close() {
+	s.flushPending()
+	if s.writeTimeout > 0 {
+		_ = s.rc.SetWriteDeadline(time.Time{})
+	}
+}
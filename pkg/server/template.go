@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// maxTemplateInputSize is the size in bytes of the largest input that a template can render.
+const maxTemplateInputSize = 1 << 20
+
+// templateFuncs are the functions of input templates, which are the sprig functions without the ones that read the environment of
+// the server or look up hosts, since the templates come from clients.
+var templateFuncs = func() template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	for _, name := range []string{"env", "expandenv", "getHostByName"} {
+		delete(funcs, name)
+	}
+	return funcs
+}()
+
+var errTemplateInputTooLarge = fmt.Errorf("the rendered input is larger than %d bytes", maxTemplateInputSize)
+
+// renderInput renders the template of an input with the variables. Variables that are missing are errors instead of empty
+// strings, so that a client finds out about a misspelled variable instead of running the tool with a broken prompt.
+func renderInput(text string, vars map[string]any) (string, error) {
+	tmpl, err := template.New("input").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b limitedBuilder
+	if err = tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// limitedBuilder is a strings.Builder that fails the writes that would make it larger than the largest input.
+type limitedBuilder struct {
+	strings.Builder
+}
+
+func (b *limitedBuilder) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxTemplateInputSize {
+		return 0, errTemplateInputTooLarge
+	}
+	return b.Builder.Write(p)
+}
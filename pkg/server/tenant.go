@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+// tenantPattern is the syntax of the names of tenants, which are part of the paths of their uploaded files.
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// validateTenant checks the name of a tenant. The empty name is the default tenant.
+func validateTenant(tenant string) error {
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		return fmt.Errorf("invalid tenant %q", tenant)
+	}
+	return nil
+}
+
+// tenantOf returns the tenant of the caller of the context, which is the default tenant if the caller doesn't have one or if
+// authentication is disabled. Everything that a caller can see, like runs, registered tools, uploaded files, credentials, and
+// usage, is scoped to its tenant.
+func tenantOf(ctx context.Context) string {
+	if id := ccontext.GetIdentity(ctx); id != nil {
+		return id.Tenant
+	}
+	return ""
+}
@@ -0,0 +1,461 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/objects"
+)
+
+const (
+	// toolFetchTimeout is how long fetching a remote tool can take.
+	toolFetchTimeout = 2 * time.Minute
+	// defaultToolFile is the file of a repository or directory that is run when a reference doesn't name a file, like gptscript does.
+	defaultToolFile = "tool.gpt"
+	// maxToolSize is the size in bytes of the largest tool that is downloaded, which is as large as an uploaded file can be by default.
+	maxToolSize = defaultUploadLimit
+)
+
+// toolCache fetches the remote tools that are run as files, and keeps them for the TTL, so that a remote tool isn't fetched for
+// every run. Tools that are URLs are downloaded, and the others, like github.com/org/repo/path@ref, are fetched from their git
+// repositories. The tools are kept in the upload directory, so that backends can make them available like uploaded files. If the
+// server has storage, then the tools that are fetched are pushed to it too, so that the other replicas pull them from it instead of
+// fetching them again.
+type toolCache struct {
+	dir     string
+	ttl     time.Duration
+	client  *http.Client
+	storage objects.Store
+
+	lock    sync.Mutex
+	entries map[string]*cachedTool
+}
+
+// cachedTool is a remote tool that was fetched. Its lock is held while it is fetched, so that it is only fetched once at a time.
+type cachedTool struct {
+	lock sync.Mutex
+	// path is the path of the file to run, in dir, which the tool was fetched into.
+	path    string
+	dir     string
+	fetched time.Time
+}
+
+// toolManifest is the record of a tool in the storage of the server. The files of the tool are kept next to it.
+type toolManifest struct {
+	Source string `json:"source"`
+	// File is the path of the file to run in the files of the tool, separated by slashes.
+	File    string    `json:"file"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// newToolCache returns a cache that keeps remote tools in a directory of the upload directory for the TTL, or nil if the TTL is
+// not positive, in which case remote tools are left to gptscript to load. The storage is nil if the server has none.
+func newToolCache(uploadDir string, ttl time.Duration, storage objects.Store) (*toolCache, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+
+	dir := filepath.Join(uploadDir, ".tools")
+	// The tools that were fetched before the server restarted aren't known, so they are fetched again.
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clear tool cache: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create tool cache: %w", err)
+	}
+
+	return &toolCache{
+		dir:     dir,
+		ttl:     ttl,
+		client:  &http.Client{Timeout: toolFetchTimeout},
+		storage: storage,
+		entries: make(map[string]*cachedTool),
+	}, nil
+}
+
+// resolve returns the path of the remote tool, fetching it if it hasn't been fetched in the TTL. Files that aren't remote tools
+// are returned as they are, as is every file if the cache is nil.
+func (c *toolCache) resolve(ctx context.Context, file string) (string, error) {
+	source, ok := remoteTool(file)
+	if c == nil || !ok {
+		return file, nil
+	}
+
+	t := c.entry(source)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.path != "" && time.Since(t.fetched) < c.ttl {
+		return t.path, nil
+	}
+	if c.pull(ctx, source, t) {
+		return t.path, nil
+	}
+	if err := c.fetch(ctx, source, t); err != nil {
+		return "", invalidField("file", err.Error())
+	}
+	return t.path, nil
+}
+
+// refresh fetches the remote tool again, or forgets every tool if the tool is empty, so that each is fetched again the next time
+// that it is run. It returns the tools that were refreshed.
+func (c *toolCache) refresh(ctx context.Context, tool string) ([]string, error) {
+	if tool != "" {
+		source, ok := remoteTool(tool)
+		if !ok {
+			return nil, invalidField("tool", fmt.Sprintf("%s is not a remote tool", tool))
+		}
+
+		t := c.entry(source)
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if err := c.fetch(ctx, source, t); err != nil {
+			return nil, err
+		}
+		return []string{source}, nil
+	}
+
+	if c.storage != nil {
+		// The other replicas fetch the tools again too, instead of pulling them from the storage.
+		manifests, err := c.storage.List(ctx, "manifests/")
+		if err != nil {
+			return nil, fmt.Errorf("failed to refresh tools in storage: %w", err)
+		}
+		for _, o := range manifests {
+			if err = c.storage.Delete(ctx, o.Key); err != nil {
+				return nil, fmt.Errorf("failed to refresh tools in storage: %w", err)
+			}
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	refreshed := make([]string, 0, len(c.entries))
+	for source, t := range c.entries {
+		t.lock.Lock()
+		if t.path != "" {
+			t.fetched = time.Time{}
+			refreshed = append(refreshed, source)
+		}
+		t.lock.Unlock()
+	}
+	slices.Sort(refreshed)
+	return refreshed, nil
+}
+
+// prune removes the tools that were fetched longer than the TTL ago, so that the tools that aren't run anymore don't stay on disk.
+// The tools that are being fetched are left alone.
+func (c *toolCache) prune() cleanupReport {
+	r := cleanupReport{Area: cleanupTools}
+	if c == nil {
+		return r
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for source, t := range c.entries {
+		if !t.lock.TryLock() {
+			continue
+		}
+		size, _ := diskUsageOf(t.dir)
+		if t.path == "" || time.Since(t.fetched) < c.ttl {
+			r.Size += size
+		} else if removeEntry(diskEntry{key: source, path: t.dir, size: size}) {
+			delete(c.entries, source)
+			r.Removed++
+			r.RemovedBytes += size
+		}
+		t.lock.Unlock()
+	}
+	return r
+}
+
+func (c *toolCache) entry(source string) *cachedTool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t, ok := c.entries[source]
+	if !ok {
+		t = new(cachedTool)
+		c.entries[source] = t
+	}
+	return t
+}
+
+// fetch fetches the tool into a new directory, and replaces the directory that it was fetched into before, if there is one. The
+// tool is pushed to the storage of the server, if it has one.
+func (c *toolCache) fetch(ctx context.Context, source string, t *cachedTool) error {
+	ctx, cancel := context.WithTimeout(ctx, toolFetchTimeout)
+	defer cancel()
+
+	start := time.Now()
+	dir, err := os.MkdirTemp(c.dir, "tool-")
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", source, err)
+	}
+
+	var file string
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		file, err = c.download(ctx, source, dir)
+	} else {
+		file, err = cloneTool(ctx, source, dir)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("failed to fetch %s: %w", source, err)
+	}
+
+	if t.dir != "" {
+		_ = os.RemoveAll(t.dir)
+	}
+	t.path, t.dir, t.fetched = file, dir, time.Now()
+
+	if err = c.push(ctx, source, t, start); err != nil {
+		// The tool was fetched, so the run doesn't fail because the other replicas have to fetch it too.
+		ccontext.GetLogger(ctx).Warn("Failed to push tool to storage", "tool", source, "error", err)
+	}
+	return nil
+}
+
+// push pushes the files of the tool, which was fetched at the time, to the storage of the server, and then its manifest, so that
+// the manifest never refers to files that weren't pushed.
+func (c *toolCache) push(ctx context.Context, source string, t *cachedTool, since time.Time) error {
+	if c.storage == nil {
+		return nil
+	}
+
+	// Only the files of the tool are needed to run it, not the repository that it was cloned from.
+	if err := os.RemoveAll(filepath.Join(t.dir, ".git")); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(t.dir, t.path)
+	if err != nil {
+		return err
+	}
+
+	key := toolKey(source)
+	if err = objects.Push(ctx, c.storage, "files/"+key+"/", t.dir, since); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(toolManifest{Source: source, File: filepath.ToSlash(rel), Fetched: t.fetched})
+	if err != nil {
+		return err
+	}
+	return c.storage.Put(ctx, objects.Object{Key: "manifests/" + key + ".json", Size: int64(len(b))}, bytes.NewReader(b))
+}
+
+// pull pulls the tool from the storage of the server into a new directory, if another replica fetched it in the TTL, and returns
+// whether it did. Errors are logged, so that the tool is fetched instead.
+func (c *toolCache) pull(ctx context.Context, source string, t *cachedTool) bool {
+	if c.storage == nil {
+		return false
+	}
+
+	l := ccontext.GetLogger(ctx)
+	key := toolKey(source)
+	rc, _, err := c.storage.Open(ctx, "manifests/"+key+".json")
+	if errors.Is(err, objects.ErrNotFound) {
+		return false
+	} else if err != nil {
+		l.Warn("Failed to get tool from storage", "tool", source, "error", err)
+		return false
+	}
+	defer rc.Close()
+
+	var manifest toolManifest
+	if err = json.NewDecoder(rc).Decode(&manifest); err != nil {
+		l.Warn("Failed to get tool from storage", "tool", source, "error", err)
+		return false
+	}
+	if manifest.Source != source || time.Since(manifest.Fetched) >= c.ttl || !fs.ValidPath(manifest.File) {
+		return false
+	}
+
+	dir, err := os.MkdirTemp(c.dir, "tool-")
+	if err != nil {
+		l.Warn("Failed to get tool from storage", "tool", source, "error", err)
+		return false
+	}
+	if err = objects.Pull(ctx, c.storage, "files/"+key+"/", dir, time.Time{}); err != nil {
+		_ = os.RemoveAll(dir)
+		l.Warn("Failed to get tool from storage", "tool", source, "error", err)
+		return false
+	}
+
+	if t.dir != "" {
+		_ = os.RemoveAll(t.dir)
+	}
+	t.path, t.dir, t.fetched = filepath.Join(dir, filepath.FromSlash(manifest.File)), dir, manifest.Fetched
+	l.Debug("pulled tool from storage", "tool", source)
+	return true
+}
+
+// toolKey returns the key of the tool in the storage of the server, which is the hash of its source, so that it is a valid key.
+func toolKey(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// download downloads the tool at the URL into the directory, and returns the path of the file.
+func (c *toolCache) download(ctx context.Context, source, dir string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = defaultToolFile
+	}
+	file := filepath.Join(dir, name)
+
+	f, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxToolSize+1))
+	if err != nil {
+		return "", err
+	}
+	if n > maxToolSize {
+		return "", fmt.Errorf("tool is larger than %d bytes", maxToolSize)
+	}
+	return file, f.Close()
+}
+
+// cloneTool fetches the repository of a tool like github.com/org/repo/path@ref into the directory, at the ref if there is one and
+// at the default branch otherwise, and returns the path of the file in it. If the path is a directory or there is none, then the
+// file is tool.gpt in it.
+func cloneTool(ctx context.Context, source, dir string) (string, error) {
+	ref := "HEAD"
+	if i := strings.LastIndex(source, "@"); i > strings.LastIndex(source, "/") {
+		source, ref = source[:i], source[i+1:]
+	}
+
+	parts := strings.Split(source, "/")
+	if len(parts) < 3 {
+		return "", errors.New("a tool from a repository must be like host/org/repo/path@ref")
+	}
+	repo := "https://" + strings.Join(parts[:3], "/")
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"fetch", "-q", "--depth", "1", repo, ref},
+		{"checkout", "-q", "FETCH_HEAD"},
+	} {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	file := filepath.Join(append([]string{dir}, parts[3:]...)...)
+	info, err := os.Stat(file)
+	if err == nil && info.IsDir() {
+		file = filepath.Join(file, defaultToolFile)
+		_, err = os.Stat(file)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%s is not in the repository", strings.TrimPrefix(file, dir+string(filepath.Separator)))
+	}
+	return file, err
+}
+
+// resolveFile returns the path of the file of a run: the path of an uploaded file or a registered tool of the tenant of the context
+// for its handle, the path of a remote tool that was fetched if the tool cache is enabled, and the file as it is otherwise. Remote
+// tools are checked against the policy of the client of the context before they are fetched, and local files must be in the
+// directories that the tenant of the context can use. It also returns the limits of the
+// registered tool, if the file is one. The returned status code is the status of the error.
+func (s *server) resolveFile(ctx context.Context, file string) (string, *toolLimits, int, error) {
+	if localFile(file) && !s.allowedLocalPath(ctx, file) {
+		return "", nil, http.StatusForbidden, fmt.Errorf("not allowed to run %s, which is outside of the directories that runs can use", file)
+	}
+
+	path, err := s.uploads.resolve(tenantOf(ctx), file)
+	if err != nil {
+		return "", nil, http.StatusBadRequest, err
+	}
+
+	path, limits, registered, err := s.resolveRegisteredTool(ctx, path)
+	if err != nil {
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			return "", nil, http.StatusBadRequest, err
+		}
+		return "", nil, http.StatusInternalServerError, err
+	}
+	if registered {
+		return path, limits, 0, nil
+	}
+
+	if _, ok := remoteTool(path); ok && s.tools != nil {
+		if err = s.policy(usageClient(ctx)).checkFile(path); err != nil {
+			ccontext.GetLogger(ctx).Warn("Denied run by policy", "client", usageClient(ctx), "file", path, "reason", err)
+			return "", nil, http.StatusForbidden, err
+		}
+		if path, err = s.tools.resolve(ctx, path); err != nil {
+			return "", nil, http.StatusBadRequest, err
+		}
+	}
+	return path, nil, 0, nil
+}
+
+// refreshTools fetches the remote tool of the tool query parameter again, or every remote tool the next time that it is run if
+// there is no tool parameter.
+func (s *server) refreshTools(w http.ResponseWriter, r *http.Request) {
+	if s.tools == nil {
+		writeError(w, http.StatusNotFound, errors.New("the tool cache is disabled"))
+		return
+	}
+
+	refreshed, err := s.tools.refresh(r.Context(), r.URL.Query().Get("tool"))
+	if err != nil {
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			writeError(w, http.StatusBadRequest, err)
+		} else {
+			writeError(w, http.StatusBadGateway, err)
+		}
+		return
+	}
+
+	writeResponse(w, map[string][]string{"refreshed": refreshed})
+}
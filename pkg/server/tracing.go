@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"go.opentelemetry.io/contrib/exporters/autoexport"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/thedadams/clicky-serves/pkg/server")
+
+// setupTracing configures the tracer provider with the exporter chosen by the standard OTEL_* environment variables.
+// Tracing is disabled unless OTEL_TRACES_EXPORTER is set, but the trace context of requests is always propagated to gptscript.
+// The returned function flushes any remaining spans and shuts down the exporter.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if e := os.Getenv("OTEL_TRACES_EXPORTER"); e == "" || e == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := autoexport.NewSpanExporter(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	// The attributes from the environment come last so that OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "clicky-serves")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// traceRequest is a middleware that starts a span for each request, continuing the trace of the client if there is one.
+func traceRequest(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "clicky-serves")
+}
+
+// startSpan starts a span for a call to gptscript as part of the run in the context.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("clicky_serves.run_id", ccontext.GetRunID(ctx))))
+}
+
+// endSpan ends the span, recording the error if there is one. The error is returned as is.
+func endSpan(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+// traceEnv returns the environment variables, like TRACEPARENT, that propagate the trace context to a subprocess.
+func traceEnv(ctx context.Context) []string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	env := make([]string, 0, len(carrier))
+	for k, v := range carrier {
+		env = append(env, strings.ToUpper(k)+"="+v)
+	}
+
+	return env
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/jmespath/go-jmespath"
+)
+
+const (
+	// transformTimeout is how long a jq filter can run, since filters can loop forever.
+	transformTimeout = 5 * time.Second
+	// maxTransformResults is the most results of a jq filter that are kept, since filters can produce results forever.
+	maxTransformResults = 10000
+)
+
+// outputTransform is an expression that the JSON stdout of a run is transformed with before it is returned, so that clients that
+// only need a part of a large output only get that part. Exactly one of its expressions is set. The stdout that is returned is the
+// result as JSON. The stdout of the run is kept as it is, so the run history and the result cache have all of it.
+type outputTransform struct {
+	// JMESPath is a JMESPath expression, like items[0].name.
+	JMESPath string `json:"jmespath,omitempty"`
+	// JQ is a jq filter, like .items[0].name. Filters that produce more or less than one result return their results as an array.
+	JQ string `json:"jq,omitempty"`
+}
+
+func (t *outputTransform) validate() error {
+	switch {
+	case t.JMESPath != "" && t.JQ != "":
+		return invalidField("transform", "only one of jmespath and jq can be set")
+	case t.JMESPath != "":
+		if _, err := jmespath.Compile(t.JMESPath); err != nil {
+			return invalidField("transform.jmespath", fmt.Sprintf("invalid JMESPath expression: %v", err))
+		}
+	case t.JQ != "":
+		if _, err := compileJQ(t.JQ); err != nil {
+			return invalidField("transform.jq", fmt.Sprintf("invalid jq filter: %v", err))
+		}
+	default:
+		return missingField("transform", "either jmespath or jq is required")
+	}
+	return nil
+}
+
+func compileJQ(filter string) (*gojq.Code, error) {
+	q, err := gojq.Parse(filter)
+	if err != nil {
+		return nil, err
+	}
+	return gojq.Compile(q)
+}
+
+// invalidOutput returns the error of output that couldn't be transformed, which is responded to with a 422.
+func invalidOutput(format string, args ...any) error {
+	return &requestError{code: errorCodeInvalidOutput, msg: fmt.Sprintf(format, args...)}
+}
+
+// apply returns the result of the transform of the stdout, as JSON. The error is an invalidOutput error if the stdout isn't JSON,
+// or if the expression fails on it.
+func (t *outputTransform) apply(ctx context.Context, stdout string) (string, error) {
+	var in any
+	if err := json.Unmarshal([]byte(stdout), &in); err != nil {
+		return "", invalidOutput("the stdout of the run is not valid JSON, so it can't be transformed: %v", err)
+	}
+
+	var (
+		out any
+		err error
+	)
+	if t.JMESPath != "" {
+		if out, err = jmespath.Search(t.JMESPath, in); err != nil {
+			return "", invalidOutput("failed to transform the stdout of the run with JMESPath: %v", err)
+		}
+	} else if out, err = runJQ(ctx, t.JQ, in); err != nil {
+		return "", invalidOutput("failed to transform the stdout of the run with jq: %v", err)
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return "", invalidOutput("failed to encode the transformed stdout of the run: %v", err)
+	}
+	return string(b), nil
+}
+
+// runJQ returns the result of the filter, or the array of its results if it doesn't have exactly one.
+func runJQ(ctx context.Context, filter string, in any) (any, error) {
+	code, err := compileJQ(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, transformTimeout)
+	defer cancel()
+
+	results := []any{}
+	iter := code.RunWithContext(ctx, in)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok = v.(error); ok {
+			var haltErr *gojq.HaltError
+			if errors.As(err, &haltErr) && haltErr.Value() == nil {
+				break
+			}
+			return nil, err
+		}
+		if len(results) == maxTransformResults {
+			return nil, fmt.Errorf("the filter produced more than %d results", maxTransformResults)
+		}
+		results = append(results, v)
+	}
+
+	if len(results) == 1 {
+		return results[0], nil
+	}
+	return results, nil
+}
+
+type outputTransformKey struct{}
+
+// withOutputTransform sets the transform of the stdout of the run that is returned.
+func withOutputTransform(ctx context.Context, t *outputTransform) context.Context {
+	return context.WithValue(ctx, outputTransformKey{}, t)
+}
+
+func runOutputTransform(ctx context.Context) *outputTransform {
+	t, _ := ctx.Value(outputTransformKey{}).(*outputTransform)
+	return t
+}
+
+// transformOutput returns the stdout transformed with the transform, if there is one.
+func transformOutput(ctx context.Context, t *outputTransform, stdout string) (string, error) {
+	if t == nil {
+		return stdout, nil
+	}
+	return t.apply(ctx, stdout)
+}
+
+// writeOutput writes the stdout of the run to the response, transformed with the transform of the run if it has one. Output that
+// can't be transformed is responded to with a 422.
+func writeOutput(ctx context.Context, w http.ResponseWriter, stdout string) {
+	out, err := transformOutput(ctx, runOutputTransform(ctx), stdout)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeResponse(w, outputResponse("stdout", out))
+}
+
+// transformQuery returns the transform of the jmespath or jq query parameter of the request, or nil if neither is set.
+func transformQuery(r *http.Request) (*outputTransform, error) {
+	t := &outputTransform{JMESPath: r.URL.Query().Get("jmespath"), JQ: r.URL.Query().Get("jq")}
+	if t.JMESPath == "" && t.JQ == "" {
+		return nil, nil
+	}
+	if err := t.validate(); err != nil {
+		// The fields of the errors are the query parameters, not the fields of the transform of a request.
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			reqErr.field = strings.TrimPrefix(reqErr.field, "transform.")
+		}
+		return nil, err
+	}
+	return t, nil
+}
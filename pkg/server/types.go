@@ -1,20 +1,233 @@
 package server
 
-import "github.com/gptscript-ai/go-gptscript"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gptscript-ai/go-gptscript"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+// runOptions are the options of a run that are handled by the server instead of gptscript.
+type runOptions struct {
+	// Timeout is a duration, like "30s" or "5m", after which the run is aborted.
+	Timeout string `json:"timeout,omitempty"`
+	// Env are environment variables for the gptscript process, which must be allowed by the server.
+	Env map[string]string `json:"env,omitempty"`
+	// NoCache means that the run is neither served from nor stored in the result cache.
+	NoCache bool `json:"noCache,omitempty"`
+	// CallbackURL is a URL that the outcome of the run is posted to when it ends.
+	CallbackURL string `json:"callbackURL,omitempty"`
+	// Model is the default model of the run, which must be one of the models of the server if it has any.
+	Model string `json:"model,omitempty"`
+	// Credentials are the names of credentials of the server, whose environment variables are added to the gptscript process.
+	Credentials []string `json:"credentials,omitempty"`
+	// DryRun means that the tool or file is parsed and the plan of the run is returned, without running it.
+	DryRun bool `json:"dryRun,omitempty"`
+	// Priority is the priority of the run in the run queue, which can be lower than the priority of the client, so that batch
+	// jobs can make way for interactive runs, but not higher.
+	Priority *int `json:"priority,omitempty"`
+	// Transform is an expression that the JSON stdout of the run is transformed with before it is returned. It isn't applied to
+	// streams.
+	Transform *outputTransform `json:"transform,omitempty"`
+	// OutputSchema is a JSON schema that the stdout of the run must be JSON that conforms to. A run whose stdout doesn't conform
+	// fails with what is wrong with it, unless it conforms once it is run again up to OutputSchemaRetries times.
+	OutputSchema        json.RawMessage `json:"outputSchema,omitempty"`
+	OutputSchemaRetries int             `json:"outputSchemaRetries,omitempty"`
+}
+
+func (o runOptions) validate() error {
+	if o.CallbackURL != "" {
+		if err := validateCallbackURL(o.CallbackURL); err != nil {
+			return err
+		}
+	}
+	if o.Transform != nil {
+		if err := o.Transform.validate(); err != nil {
+			return err
+		}
+	}
+	return validateOutputSchema("outputSchema", o.OutputSchema, o.OutputSchemaRetries)
+}
+
+// context returns the context of the run with the options that are carried by the context.
+func (o runOptions) context(ctx context.Context, env []string) context.Context {
+	ctx = ccontext.WithRunEnv(ctx, env)
+	if o.NoCache {
+		ctx = withoutResultCache(ctx)
+	}
+	if o.CallbackURL != "" {
+		ctx = withCallback(ctx, o.CallbackURL)
+	}
+	if o.Priority != nil {
+		ctx = withRunPriority(ctx, *o.Priority)
+	}
+	if o.Transform != nil {
+		ctx = withOutputTransform(ctx, o.Transform)
+	}
+	if len(o.OutputSchema) > 0 || o.OutputSchemaRetries > 0 {
+		// The schema was checked when the request was validated.
+		schema, _ := compileSchema(o.OutputSchema)
+		ctx = withOutputSchema(ctx, schema, o.OutputSchemaRetries)
+	}
+	return ctx
+}
+
+// requestOpts are the gptscript options that a request sets. DisableCache and Quiet are pointers, so that a request that sets them
+// to false overrides a default of true.
+type requestOpts struct {
+	DisableCache *bool  `json:"disableCache,omitempty"`
+	CacheDir     string `json:"cacheDir,omitempty"`
+	Quiet        *bool  `json:"quiet,omitempty"`
+	Chdir        string `json:"chdir,omitempty"`
+	SubTool      string `json:"subTool,omitempty"`
+}
 
 type toolRequest struct {
-	gptscript.Opts       `json:",inline"`
+	runOptions           `json:",inline"`
+	requestOpts          `json:",inline"`
 	gptscript.SimpleTool `json:",inline"`
 	gptscript.FreeForm   `json:",inline"`
 }
 
+func (t *toolRequest) validate() error {
+	if t.Content == "" && t.Instructions == "" {
+		return missingField("instructions", "either content or instructions is required")
+	}
+
+	// The model of the tool is made the model of the run, so that it is checked and routed like any other requested model.
+	if t.SimpleTool.Model != "" {
+		if t.runOptions.Model != "" && t.runOptions.Model != t.SimpleTool.Model {
+			return invalidField("model", "the model of the tool and the model of the run must be the same")
+		}
+		t.runOptions.Model, t.SimpleTool.Model = t.SimpleTool.Model, ""
+	}
+	return t.runOptions.validate()
+}
+
+// tool returns the free-form tool content if it was provided, and the simple tool otherwise.
+func (t *toolRequest) tool() fmt.Stringer {
+	if t.Content != "" {
+		return &t.FreeForm
+	}
+	return &t.SimpleTool
+}
+
+// fileRequest runs a file. A file like path#name runs the tool of the file with the name instead of its first tool, like the subTool.
 type fileRequest struct {
-	gptscript.Opts `json:",inline"`
-	File           string `json:"file"`
-	Input          string `json:"input"`
+	runOptions  `json:",inline"`
+	requestOpts `json:",inline"`
+	File        string `json:"file"`
+	Input       string `json:"input"`
+	// TemplateInput is a Go template that is rendered with the variables to make the input, instead of the input being given.
+	TemplateInput string         `json:"templateInput,omitempty"`
+	Vars          map[string]any `json:"vars,omitempty"`
+}
+
+func (f *fileRequest) validate() error {
+	if f.File == "" {
+		return missingField("file", "file is required")
+	}
+	if file, subTool, ok := splitSubTool(f.File); ok {
+		if f.SubTool != "" && !strings.EqualFold(f.SubTool, subTool) {
+			return invalidField("subTool", fmt.Sprintf("the tool %q of the file and the subTool %q must be the same", subTool, f.SubTool))
+		}
+		f.File, f.SubTool = file, subTool
+	}
+
+	// The template is rendered into the input, so that the run, its record, and the cache only ever see the input.
+	if f.TemplateInput != "" {
+		if f.Input != "" {
+			return invalidField("templateInput", "only one of input or templateInput can be given")
+		}
+
+		input, err := renderInput(f.TemplateInput, f.Vars)
+		if err != nil {
+			return invalidField("templateInput", fmt.Sprintf("failed to render template: %v", err))
+		}
+		f.Input, f.TemplateInput, f.Vars = input, "", nil
+	} else if len(f.Vars) > 0 {
+		return invalidField("vars", "vars can only be given with templateInput")
+	}
+	return f.runOptions.validate()
+}
+
+// splitSubTool splits a file like path#name into the path of the file and the name of the tool of the file to run. A # that is
+// followed by a path, or that isn't preceded by one, is part of the path of the file.
+func splitSubTool(file string) (string, string, bool) {
+	i := strings.LastIndex(file, "#")
+	if i <= 0 || i == len(file)-1 || strings.ContainsAny(file[i+1:], `/\`) {
+		return file, "", false
+	}
+	return file[:i], file[i+1:], true
+}
+
+// parseRequest is a fileRequest where the content of a file can be given as the input instead of the path of a file.
+type parseRequest fileRequest
+
+func (p *parseRequest) validate() error {
+	if p.File == "" && p.Input == "" {
+		return missingField("file", "either file or input is required")
+	}
+	return nil
 }
 
 type documentRequest struct {
-	gptscript.Opts     `json:",inline"`
+	requestOpts        `json:",inline"`
 	gptscript.Document `json:",inline"`
 }
+
+func (d *documentRequest) validate() error {
+	if len(d.Nodes) == 0 {
+		return missingField("nodes", "nodes is required")
+	}
+	return nil
+}
+
+// wsMessage is a message sent by the client over a websocket connection.
+type wsMessage struct {
+	Type string `json:"type"`
+
+	// Tool or File is set on run messages, and Events indicates whether the engine events should be streamed.
+	Tool   *toolRequest `json:"tool,omitempty"`
+	File   *fileRequest `json:"file,omitempty"`
+	Events bool         `json:"events,omitempty"`
+}
+
+func (m *wsMessage) validate() error {
+	switch m.Type {
+	case wsMessageRun:
+		if err := validateToolOrFile(m.Tool, m.File); err != nil {
+			return err
+		}
+		return rejectDryRun(toolOrFile{Tool: m.Tool, File: m.File}.options(), "runs over a websocket")
+	case wsMessageCancel:
+		return nil
+	case "":
+		return missingField("type", "type is required")
+	default:
+		return invalidField("type", fmt.Sprintf("unknown message type %q", m.Type))
+	}
+}
+
+// validateToolOrFile checks that exactly one of the tool or the file is set, and that it is valid.
+func validateToolOrFile(tool *toolRequest, file *fileRequest) error {
+	switch {
+	case (tool == nil) == (file == nil):
+		return &requestError{code: errorCodeInvalidRequest, msg: "exactly one of tool or file is required"}
+	case tool != nil:
+		return tool.validate()
+	default:
+		return file.validate()
+	}
+}
+
+// rejectDryRun returns an error if the options ask for a dry run, for the runs that can't be dry runs, which are described by what.
+func rejectDryRun(o runOptions, what string) error {
+	if o.DryRun {
+		return invalidField("dryRun", what+" can't be dry runs")
+	}
+	return nil
+}
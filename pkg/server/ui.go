@@ -0,0 +1,26 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles are the files of the web UI, a playground that runs pasted or registered tools with the HTTP API and shows their events
+// as a tree of calls.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiHandler serves the web UI at /ui/. The UI is public, like the docs, because it is only static files: the requests that it makes
+// to the API are authenticated with the API key that is entered in it.
+func uiHandler() http.HandlerFunc {
+	files, _ := fs.Sub(uiFiles, "ui")
+	fileServer := http.StripPrefix("/ui/", http.FileServer(http.FS(files)))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The type of each file is found from its extension, instead of being the JSON of the API responses.
+		w.Header().Del("Content-Type")
+		fileServer.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,236 @@
+// The playground runs tools with the HTTP API of the server that serves it. Pasted tools are uploaded as files, so that they can
+// be run with an input, and the events of each run are streamed as newline-delimited JSON and shown as a tree of calls.
+"use strict";
+
+const api = new URL("..", location.href);
+const $ = (id) => document.getElementById(id);
+
+const apiKey = $("api-key");
+apiKey.value = localStorage.getItem("clicky-serves-api-key") || "";
+apiKey.addEventListener("change", () => {
+  localStorage.setItem("clicky-serves-api-key", apiKey.value);
+  loadRegistry();
+});
+
+let run = null;
+
+function request(method, path, body, headers = {}) {
+  if (apiKey.value) {
+    headers.Authorization = "Bearer " + apiKey.value;
+  }
+  if (body && !(body instanceof FormData)) {
+    headers["Content-Type"] = "application/json";
+    body = JSON.stringify(body);
+  }
+  return fetch(new URL(path, api), {method, body, headers, signal: run?.abort.signal});
+}
+
+// failure returns the error of a response that failed, in the form of the error responses of the API.
+async function failure(resp) {
+  const text = await resp.text();
+  try {
+    const e = JSON.parse(text);
+    return `${e.error} (${e.code})`;
+  } catch {
+    return `${resp.status} ${text}`;
+  }
+}
+
+function setStatus(text, error = false) {
+  $("status").textContent = text;
+  $("status").className = error ? "error" : "muted";
+}
+
+// The source of the tool is either pasted content or a registered tool.
+for (const radio of document.querySelectorAll("input[name=source]")) {
+  radio.addEventListener("change", () => {
+    const registry = radio.value === "registry" && radio.checked;
+    $("registry").hidden = !registry;
+    $("content").hidden = registry;
+  });
+}
+
+let registered = [];
+
+async function loadRegistry() {
+  const select = $("registry-tool");
+  try {
+    const resp = await request("GET", "registry");
+    if (!resp.ok) {
+      throw new Error(await failure(resp));
+    }
+    registered = (await resp.json()).tools || [];
+  } catch (e) {
+    registered = [];
+    $("registry-description").textContent = "Failed to list the registered tools: " + e.message;
+  }
+
+  select.replaceChildren(...registered.map((t) => new Option(t.name, t.name)));
+  showDescription();
+}
+
+function showDescription() {
+  const tool = registered.find((t) => t.name === $("registry-tool").value);
+  if (tool) {
+    $("registry-description").textContent = tool.description || "";
+  } else if (!registered.length) {
+    $("registry-description").textContent ||= "No tools are registered.";
+  }
+}
+
+$("registry-tool").addEventListener("change", showDescription);
+$("registry-refresh").addEventListener("click", loadRegistry);
+loadRegistry();
+
+$("run-form").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  if (run) {
+    return;
+  }
+
+  run = {abort: new AbortController(), calls: new Map(), tokens: 0, failed: false};
+  $("calls").replaceChildren();
+  $("output").textContent = "";
+  $("stderr").textContent = "";
+  $("run").disabled = true;
+  $("cancel").disabled = false;
+
+  let upload = null;
+  try {
+    let file;
+    if (document.querySelector("input[name=source]:checked").value === "registry") {
+      file = "registry://" + $("registry-tool").value;
+    } else {
+      setStatus("Uploading…");
+      const form = new FormData();
+      form.append("file", new Blob([$("content").value]), "playground.gpt");
+      const resp = await request("POST", "files", form);
+      if (!resp.ok) {
+        throw new Error(await failure(resp));
+      }
+      upload = await resp.json();
+      file = upload.file;
+    }
+
+    setStatus("Running…");
+    const resp = await request("POST", "run-file-stream-with-events?format=ndjson", {file, input: $("input").value},
+      {Accept: "application/x-ndjson"});
+    if (!resp.ok) {
+      throw new Error(await failure(resp));
+    }
+    run.id = resp.headers.get("X-Run-ID");
+    await readEvents(resp);
+
+    const tokens = run.tokens ? `, ${run.tokens} tokens` : "";
+    setStatus((run.failed ? "Failed" : "Done") + tokens, run.failed);
+  } catch (e) {
+    setStatus(e.name === "AbortError" ? "Canceled" : e.message, true);
+  } finally {
+    // The run is done with before the upload is deleted, so that the request isn't aborted with the run.
+    run = null;
+    if (upload) {
+      request("DELETE", "files/" + encodeURIComponent(upload.id)).catch(() => {});
+    }
+    $("run").disabled = false;
+    $("cancel").disabled = true;
+  }
+});
+
+$("cancel").addEventListener("click", async () => {
+  if (!run) {
+    return;
+  }
+  if (run.id) {
+    await request("DELETE", "runs/" + encodeURIComponent(run.id)).catch(() => {});
+  }
+  run.abort.abort();
+});
+
+// readEvents reads the newline-delimited JSON events of the response as they come.
+async function readEvents(resp) {
+  const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buffered = "";
+  for (;;) {
+    const {value, done} = await reader.read();
+    if (done) {
+      break;
+    }
+    buffered += value;
+    const lines = buffered.split("\n");
+    buffered = lines.pop();
+    for (const line of lines) {
+      if (line.trim()) {
+        handleEvent(JSON.parse(line));
+      }
+    }
+  }
+}
+
+function handleEvent(e) {
+  const data = e.data || {};
+  const ctx = data.callContext || {};
+  switch (e.type) {
+    case "callStart":
+      startCall(ctx);
+      break;
+    case "callProgress":
+      if (data.content) {
+        call(ctx).content.textContent = data.content;
+      }
+      break;
+    case "callFinish":
+      setState(call(ctx), "finished", "✓");
+      break;
+    case "stdout":
+      $("output").textContent += data.stdout;
+      break;
+    case "stderr":
+      $("stderr").textContent += data.stderr;
+      break;
+    case "error":
+      run.failed = true;
+      appendError(data.err);
+      break;
+    case "usage":
+      // Each usage event has the usage of the run so far.
+      run.tokens = data.usage?.totalTokens || run.tokens;
+      break;
+  }
+}
+
+// call returns the node of the call in the tree of calls, adding it if its start was missed.
+function call(ctx) {
+  return run.calls.get(ctx.id) || startCall(ctx);
+}
+
+// startCall adds a call to the tree, under the call that made it.
+function startCall(ctx) {
+  const node = document.createElement("details");
+  node.open = true;
+  const summary = document.createElement("summary");
+  summary.textContent = ctx.tool?.name || "call " + ctx.id;
+  const state = document.createElement("span");
+  summary.append(state);
+  const content = document.createElement("pre");
+  node.append(summary, content);
+
+  const c = {node, state, content, summary};
+  run.calls.set(ctx.id, c);
+  setState(c, "running", "running");
+
+  const parent = ctx.parentID && run.calls.get(ctx.parentID);
+  (parent ? parent.node : $("calls")).append(node);
+  return c;
+}
+
+function setState(c, className, text) {
+  c.state.className = "state " + className;
+  c.state.textContent = text;
+}
+
+function appendError(message) {
+  const p = document.createElement("p");
+  p.className = "error";
+  p.textContent = message;
+  $("calls").append(p);
+}
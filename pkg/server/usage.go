@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/events"
+	"github.com/thedadams/clicky-serves/pkg/store"
+)
+
+// Quota limits the usage of each client per day and per calendar month, in UTC. A limit of 0 means no limit. A client that has
+// reached a limit can't start runs until the day or month is over, but runs that are in progress when the limit is reached
+// aren't stopped.
+type Quota struct {
+	DailyTokens   int64
+	MonthlyTokens int64
+	// DailyCost and MonthlyCost are in US dollars, as estimated from the prices of the models.
+	DailyCost   float64
+	MonthlyCost float64
+}
+
+func (q Quota) validate() error {
+	if q.DailyTokens < 0 || q.MonthlyTokens < 0 || q.DailyCost < 0 || q.MonthlyCost < 0 {
+		return errors.New("quota limits can't be negative")
+	}
+	return nil
+}
+
+// quotaError is the error of a run that isn't started because its client or the tenant of its client has reached a quota.
+type quotaError struct {
+	// tenant is whether the quota is the quota of the tenant, rather than of the client.
+	tenant bool
+	period string
+	limit  string
+	// reset is when the period of the quota ends.
+	reset time.Time
+}
+
+func (e *quotaError) Error() string {
+	if e.tenant {
+		return fmt.Sprintf("%s tenant quota of %s exceeded, try again after %s", e.period, e.limit, e.reset.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s quota of %s exceeded, try again after %s", e.period, e.limit, e.reset.Format(time.RFC3339))
+}
+
+// usageClient returns the name of the client that a run is accounted to, which is empty if authentication is disabled.
+func usageClient(ctx context.Context) string {
+	if id := ccontext.GetIdentity(ctx); id != nil {
+		return id.Name
+	}
+	return ""
+}
+
+// runModel returns the default model of a run, which is set in its environment if the run requested a model or the server
+// routes models.
+func runModel(ctx context.Context) string {
+	for _, kv := range ccontext.GetRunEnv(ctx) {
+		if model, ok := strings.CutPrefix(kv, "GPTSCRIPT_DEFAULT_MODEL="); ok {
+			return model
+		}
+	}
+	return ""
+}
+
+// quota returns the quota of the client, which is the quota of the server unless the client has one of its own.
+func (s *server) quota(client string) Quota {
+	config := s.current().config
+	if q, ok := config.ClientQuotas[client]; ok {
+		return q
+	}
+	return config.Quota
+}
+
+// checkQuota returns a quotaError if the client of the run has reached its daily or monthly quota, or if the clients of its tenant
+// have reached the quota of the tenant together.
+func (s *server) checkQuota(ctx context.Context) error {
+	client, tenant := usageClient(ctx), tenantOf(ctx)
+	q, tq := s.quota(client), s.current().config.TenantQuotas[tenant]
+	if q == (Quota{}) && tq == (Quota{}) {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	today := startOfDay(now)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	records, err := s.store.ListUsage(ctx, tenant, month)
+	if err != nil {
+		return fmt.Errorf("failed to check quota: %w", err)
+	}
+
+	var daily, monthly, tenantDaily, tenantMonthly store.Usage
+	for _, r := range records {
+		tenantMonthly.Add(r.Usage)
+		if !r.Day.Before(today) {
+			tenantDaily.Add(r.Usage)
+		}
+		if r.Client != client {
+			continue
+		}
+		monthly.Add(r.Usage)
+		if !r.Day.Before(today) {
+			daily.Add(r.Usage)
+		}
+	}
+
+	if qErr := q.check(daily, monthly, today, month); qErr != nil {
+		return qErr
+	}
+	if qErr := tq.check(tenantDaily, tenantMonthly, today, month); qErr != nil {
+		qErr.tenant = true
+		return qErr
+	}
+	return nil
+}
+
+// check returns a quotaError if the usage of the day or the month has reached the quota.
+func (q Quota) check(daily, monthly store.Usage, today, month time.Time) *quotaError {
+	tomorrow, nextMonth := today.AddDate(0, 0, 1), month.AddDate(0, 1, 0)
+	switch {
+	case q.DailyTokens > 0 && daily.TotalTokens >= q.DailyTokens:
+		return &quotaError{period: "daily", limit: fmt.Sprintf("%d tokens", q.DailyTokens), reset: tomorrow}
+	case q.DailyCost > 0 && daily.Cost >= q.DailyCost:
+		return &quotaError{period: "daily", limit: fmt.Sprintf("$%.2f", q.DailyCost), reset: tomorrow}
+	case q.MonthlyTokens > 0 && monthly.TotalTokens >= q.MonthlyTokens:
+		return &quotaError{period: "monthly", limit: fmt.Sprintf("%d tokens", q.MonthlyTokens), reset: nextMonth}
+	case q.MonthlyCost > 0 && monthly.Cost >= q.MonthlyCost:
+		return &quotaError{period: "monthly", limit: fmt.Sprintf("$%.2f", q.MonthlyCost), reset: nextMonth}
+	}
+	return nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// usageCost returns the estimated cost of the tokens of the model, from the prices of the route of the model. The model is the
+// name of the model at the provider, which is what gptscript reports. The cost is 0 if no route has the model.
+func (s *server) usageCost(model string, u store.Usage) float64 {
+	for name, route := range s.current().config.Models {
+		if route.Model == model || (route.Model == "" && name == model) {
+			return (float64(u.PromptTokens)*route.PromptPrice + float64(u.CompletionTokens)*route.CompletionPrice) / 1e6
+		}
+	}
+	return 0
+}
+
+// usageWriter adds the usage of the calls of a run to the usage of the run, as the calls finish. After each call with usage, it
+// writes a usage event with the usage of the run so far, so that clients can follow the usage of a run while it runs.
+type usageWriter struct {
+	eventWriter
+	s     *server
+	runID string
+	// model is the default model of the run, which is the model of calls whose tool doesn't name one.
+	model string
+}
+
+func (u *usageWriter) writeEvent(event any) {
+	var total *store.Usage
+	if e, ok := event.(events.Call); ok && e.Type == events.TypeCallFinish && e.Usage != nil {
+		model := u.model
+		if e.CallContext != nil && e.CallContext.Tool != nil && e.CallContext.Tool.ModelName != "" {
+			model = e.CallContext.Tool.ModelName
+		}
+
+		tokens := store.Usage{
+			PromptTokens:     e.Usage.PromptTokens,
+			CompletionTokens: e.Usage.CompletionTokens,
+			TotalTokens:      e.Usage.TotalTokens,
+		}
+		tokens.Cost = u.s.usageCost(model, tokens)
+		runUsage := u.s.runs.addUsage(u.runID, tokens)
+		total = &runUsage
+	}
+
+	u.eventWriter.writeEvent(event)
+	if total != nil {
+		u.eventWriter.writeEvent(events.Usage{Time: time.Now(), Usage: events.TokenUsage(*total)})
+	}
+}
+
+// clientUsage is the usage of a client, in total and by day.
+type clientUsage struct {
+	Client      string `json:"client"`
+	Runs        int64  `json:"runs"`
+	store.Usage `json:",inline"`
+	// Quota is the quota of the client, if it has one.
+	Quota *fileQuota          `json:"quota,omitempty"`
+	Days  []store.UsageRecord `json:"days"`
+}
+
+type usageResponse struct {
+	Since   time.Time     `json:"since"`
+	Clients []clientUsage `json:"clients"`
+}
+
+// getUsage returns the usage of the clients since the since query parameter, which is a date, a timestamp, or a duration before
+// now, and defaults to the start of the month. Usage is kept by day, so the since time is rounded down to the start of its day.
+// Admins get the usage of every client, or of the client of the client query parameter, and other callers get their own.
+func (s *server) getUsage(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := parseSince(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		since = startOfDay(t)
+	}
+
+	client, all := usageClient(r.Context()), true
+	if id := ccontext.GetIdentity(r.Context()); id != nil {
+		if sc, _ := parseScope(id.Scope); sc < scopeAdmin {
+			all = false
+		}
+	}
+	if v, ok := r.URL.Query()["client"]; ok && all {
+		client, all = v[0], false
+	}
+
+	records, err := s.store.ListUsage(r.Context(), tenantOf(r.Context()), since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get usage: %w", err))
+		return
+	}
+
+	var (
+		clients = make([]clientUsage, 0)
+		byName  = make(map[string]int)
+	)
+	for _, rec := range records {
+		if !all && rec.Client != client {
+			continue
+		}
+
+		i, ok := byName[rec.Client]
+		if !ok {
+			i = len(clients)
+			byName[rec.Client] = i
+			clients = append(clients, clientUsage{Client: rec.Client, Days: make([]store.UsageRecord, 0)})
+			if q := s.quota(rec.Client); q != (Quota{}) {
+				fq := fileQuota(q)
+				clients[i].Quota = &fq
+			}
+		}
+
+		clients[i].Runs += rec.Runs
+		clients[i].Add(rec.Usage)
+		clients[i].Days = append(clients[i].Days, rec)
+	}
+
+	writeResponse(w, usageResponse{Since: since, Clients: clients})
+}
+
+// parseSince parses the since query parameter, which is a date, an RFC 3339 timestamp, or a duration before now.
+func parseSince(v string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Time{}, invalidField("since", fmt.Sprintf("since must be a date, an RFC 3339 timestamp, or a duration: %v", err))
+	}
+	return time.Now().Add(-d), nil
+}
+
+// writeQuotaError responds that the run isn't started because its client has reached a quota, telling the client when to retry.
+func writeQuotaError(w http.ResponseWriter, err *quotaError) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(err.reset).Seconds()))))
+	writeError(w, http.StatusTooManyRequests, &requestError{code: errorCodeQuotaExceeded, msg: err.Error()})
+}
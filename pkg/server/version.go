@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/thedadams/clicky-serves/pkg/runner"
+	"github.com/thedadams/clicky-serves/pkg/version"
+)
+
+// sdkModule is the module of the gptscript SDK, whose version is reported by the version endpoint.
+const sdkModule = "github.com/gptscript-ai/go-gptscript"
+
+// versionInfo is the response of the version endpoint.
+type versionInfo struct {
+	Server string `json:"server"`
+	Go     string `json:"go"`
+	SDK    string `json:"sdk"`
+	// Backend is the name of the backend that runs are executed with.
+	Backend   string        `json:"backend"`
+	GPTScript gptscriptInfo `json:"gptscript"`
+	// Stdout is the output of gptscript --version, which was the whole response before the other versions were added.
+	Stdout string `json:"stdout"`
+}
+
+// gptscriptInfo is the gptscript that runs are executed with.
+type gptscriptInfo struct {
+	// Path is the path that the gptscript binary is resolved to, which is only known if runs are executed on the host.
+	Path string `json:"path,omitempty"`
+	// Source is where the gptscript binary came from when the server started: bin if it was configured, download if a version of
+	// it was downloaded, env if it was set in GPTSCRIPT_BIN, or path if it was found on the PATH.
+	Source  string `json:"source,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Error is why the version or path of gptscript couldn't be found.
+	Error string `json:"error,omitempty"`
+}
+
+// getVersion returns the versions of the server, the gptscript SDK, and the gptscript that runs are executed with, which is run
+// with the backend of the server to get its version. If gptscript can't be found or run, then the reason is in the response,
+// so that the other versions are still returned.
+func (s *server) getVersion(w http.ResponseWriter, r *http.Request) {
+	backend, _ := s.current().config.backendName()
+	info := versionInfo{
+		Server:  version.Get(),
+		Go:      runtime.Version(),
+		SDK:     version.Module(sdkModule),
+		Backend: backend,
+	}
+
+	if _, ok := s.backend().(runner.Host); ok {
+		path, err := runner.LookPath()
+		if err != nil {
+			info.GPTScript.Error = err.Error()
+			writeResponse(w, info)
+			return
+		}
+		info.GPTScript.Path = path
+		info.GPTScript.Source = s.gptscript.Source
+	}
+
+	ctx, cancel := s.commandContext(r.Context())
+	defer cancel()
+
+	out, err := runner.Version(ctx, runnerOptions(ctx, requestOpts{}))
+	if err != nil {
+		info.GPTScript.Error = err.Error()
+	}
+	info.GPTScript.Version = strings.TrimPrefix(strings.TrimSpace(out), "gptscript version ")
+	info.Stdout = out
+
+	writeResponse(w, info)
+}
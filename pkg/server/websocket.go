@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/events"
+)
+
+const (
+	wsMessageRun    = "run"
+	wsMessageCancel = "cancel"
+)
+
+// websocketHandler upgrades the connection to a websocket and runs a tool or file, streaming the same payloads that are sent
+// as server sent events by the streaming endpoints. The first message from the client must be a run message, and the
+// server responds with the ID of the run once it has left the run queue. After that, the client can send a cancel message on the
+// same connection while the run is in progress. There is no confirm message to answer callConfirm events with, since the
+// gptscript SDK can't send gptscript a decision, so runs aren't started with confirmation.
+func (s *server) websocketHandler(w http.ResponseWriter, r *http.Request) {
+	l := ccontext.GetLogger(r.Context())
+
+	// Browsers don't send preflight requests for websockets, so the origin is checked against the CORS configuration here.
+	// Clients that aren't browsers don't send an origin.
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "" || s.cors.OriginAllowed(r)
+	}}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded to the client with an error.
+		l.Error("failed to upgrade websocket connection", "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(s.limits().Body)
+
+	ws := newWSWriter(l, conn, ccontext.GetRequestID(r.Context()))
+	defer ws.close()
+
+	req, err := readWSMessage(conn)
+	if err != nil {
+		ws.writeError("invalid run message: " + err.Error())
+		return
+	}
+
+	if req.Type != wsMessageRun {
+		ws.writeError("the first message must be a run message")
+		return
+	}
+
+	var (
+		t     runType
+		path  string
+		opts  runOptions
+		input any
+	)
+	if req.Tool != nil {
+		t, opts, input = runTypeTool, req.Tool.runOptions, req.Tool
+	} else {
+		t, path, opts, input = runTypeFile, req.File.File, req.File.runOptions, req.File
+	}
+
+	if !allowedToolPath(ccontext.GetIdentity(r.Context()), path) {
+		ws.writeError("not allowed to run this tool")
+		return
+	}
+
+	path, limits, _, err := s.resolveFile(r.Context(), path)
+	if err != nil {
+		ws.writeError(err.Error())
+		return
+	}
+
+	if opts, err = limits.options(opts, s.current().config.DefaultModel); err != nil {
+		ws.writeError(err.Error())
+		return
+	}
+
+	timeout, err := s.runTimeout(opts.Timeout)
+	if err != nil {
+		ws.writeError(err.Error())
+		return
+	}
+	timeout = limits.runTimeout(timeout)
+
+	env, err := s.runEnv(r.Context(), opts)
+	if err != nil {
+		ws.writeError(err.Error())
+		return
+	}
+
+	if _, err = s.checkRun(r.Context(), toolOrFile{Tool: req.Tool, File: req.File}, env, path); err != nil {
+		ws.writeError(err.Error())
+		return
+	}
+
+	ctx, l, end, err := s.beginRun(limits.context(opts.context(r.Context(), env)), t, input, timeout, w, notifyQueue(func(_ *slog.Logger, _ http.ResponseWriter, event any) {
+		ws.writeEvent(event)
+	}))
+	if err != nil {
+		ws.writeError("run did not start: " + err.Error())
+		return
+	}
+
+	runID := ccontext.GetRunID(ctx)
+	ws.writeEvent(map[string]any{"runID": runID})
+
+	go s.readWSMessages(l, conn, ws, tenantOf(r.Context()), runID)
+
+	hw, stopHeartbeat := s.withHeartbeat(ws)
+	defer stopHeartbeat()
+
+	ew := s.runEventWriter(ctx, l, hw)
+
+	var out string
+	if req.Tool != nil {
+		l.Debug("executing tool", "tool", req.Tool)
+		if req.Events {
+			out, err = execToolStreamWithEvents(ctx, l, ew, req.Tool.requestOpts, req.Tool.tool())
+		} else {
+			out, err = execToolStream(ctx, l, ew, req.Tool.requestOpts, req.Tool.tool())
+		}
+	} else {
+		l.Debug("executing file", "file", req.File)
+		if req.Events {
+			out, err = execFileStreamWithEvents(ctx, l, ew, req.File.requestOpts, path, req.File.Input)
+		} else {
+			out, err = execFileStream(ctx, l, ew, req.File.requestOpts, path, req.File.Input)
+		}
+	}
+
+	end(out, err)
+}
+
+// readWSMessages reads the messages sent by the client while a run is in progress.
+// The run is canceled if the client asks for it or if the connection is closed.
+func (s *server) readWSMessages(l *slog.Logger, conn *websocket.Conn, ws *wsWriter, tenant, runID string) {
+	for {
+		msg, err := readWSMessage(conn)
+		if errors.As(err, new(*requestError)) {
+			ws.writeError("invalid message: " + err.Error())
+			continue
+		} else if err != nil {
+			l.Debug("stopped reading websocket messages", "error", err)
+			s.runs.cancel(tenant, runID)
+			return
+		}
+
+		switch msg.Type {
+		case wsMessageCancel:
+			l.Debug("run canceled by client")
+			s.runs.cancel(tenant, runID)
+			return
+		default:
+			ws.writeError("a run is already in progress")
+		}
+	}
+}
+
+// readWSMessage reads and validates the next message from the client. Errors in the message itself are *requestError values,
+// and any other error means that the connection can no longer be read from.
+func readWSMessage(conn *websocket.Conn) (*wsMessage, error) {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(wsMessage)
+	return msg, decodeRequest(r, msg)
+}
+
+// wsWriter is an eventWriter that writes events as JSON messages to a websocket connection. Envelopes without a request ID are
+// given the ID of the request that opened the connection.
+type wsWriter struct {
+	// lock ensures that only one message is written to the connection at a time.
+	lock      sync.Mutex
+	l         *slog.Logger
+	conn      *websocket.Conn
+	requestID string
+}
+
+func newWSWriter(l *slog.Logger, conn *websocket.Conn, requestID string) *wsWriter {
+	return &wsWriter{l: l, conn: conn, requestID: requestID}
+}
+
+func (ws *wsWriter) writeEvent(event any) {
+	ev, err := json.Marshal(withRequestID(event, ws.requestID))
+	if err != nil {
+		ws.l.Warn("failed to marshal event", "error", err)
+		return
+	}
+
+	ws.writeEncodedEvent("", ev)
+}
+
+// writeEncodedEvent writes the event as a message. Messages don't have IDs, so the ID is dropped.
+func (ws *wsWriter) writeEncodedEvent(_ string, ev []byte) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	if err := ws.conn.WriteMessage(websocket.TextMessage, ev); err != nil {
+		ws.l.Warn("failed to write websocket message", "error", err)
+		return
+	}
+
+	eventsWritten.WithLabelValues(transportWebsocket).Inc()
+	bytesStreamed.WithLabelValues(transportWebsocket).Add(float64(len(ev)))
+
+	ws.l.Debug("wrote websocket message", "event", string(ev))
+}
+
+func (ws *wsWriter) writeHeartbeat() {
+	ws.writeEvent(heartbeatEvent())
+}
+
+func (ws *wsWriter) writeError(msg string) {
+	ws.writeEvent(newEventEnvelope("", 0, events.Error{Time: time.Now(), Err: msg}))
+}
+
+func (ws *wsWriter) finish() {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	if err := ws.conn.WriteMessage(websocket.TextMessage, []byte("[DONE]")); err != nil {
+		ws.l.Warn("failed to write websocket message", "error", err)
+	}
+}
+
+// close sends a close message to the client so that the connection can be shut down gracefully.
+func (ws *wsWriter) close() {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	_ = ws.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
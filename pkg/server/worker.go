@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+// workerRetryInterval is how long a worker waits before asking the server for a job again after failing to reach it.
+const workerRetryInterval = 5 * time.Second
+
+// errJobDone is returned when the server tells a worker that the run of a job is done before the process of the job exits.
+var errJobDone = errors.New("the run of the job is done")
+
+// WorkerConfig configures a worker, which runs the gptscript processes of the runs of a server whose backend is workers.
+type WorkerConfig struct {
+	// Server is the URL of the server that the worker gets jobs from.
+	Server string
+	// APIKey is an API key of the server with the admin scope, which is required if the server requires authentication.
+	APIKey string
+	// Concurrency is the number of jobs that the worker runs at the same time. It defaults to 1.
+	Concurrency int
+}
+
+// StartWorker runs the jobs of the server on the host until the context is done or the worker is signaled to stop. The jobs
+// that are running when the worker stops are stopped too.
+func StartWorker(ctx context.Context, config WorkerConfig) error {
+	if config.Server == "" {
+		return errors.New("the server of the worker is required")
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer cancel()
+
+	w := &worker{
+		server: strings.TrimSuffix(config.Server, "/"),
+		apiKey: config.APIKey,
+		// The requests that stream the output of jobs last as long as the jobs, so there is no timeout.
+		client: new(http.Client),
+	}
+
+	slog.Info("Starting worker", "server", w.server, "concurrency", config.Concurrency)
+
+	wg := new(sync.WaitGroup)
+	for range config.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work(ctx)
+		}()
+	}
+	wg.Wait()
+
+	slog.Info("Worker stopped")
+	return nil
+}
+
+type worker struct {
+	server string
+	apiKey string
+	client *http.Client
+}
+
+// work claims and runs jobs, one at a time, until the context is done.
+func (w *worker) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := w.claim(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Failed to claim job", "error", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(workerRetryInterval):
+				}
+			}
+			continue
+		}
+		if job == nil {
+			continue
+		}
+
+		l := slog.With("job", job.ID)
+		l.Debug("Running job")
+		if err = w.run(ctx, job); err != nil {
+			l.Error("Failed to run job", "error", err)
+		}
+	}
+}
+
+// claim asks the server for a job, and returns nil if there is none.
+func (w *worker) claim(ctx context.Context) (*workerJob, error) {
+	resp, err := w.do(ctx, http.MethodPost, "/workers/jobs", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	job := new(workerJob)
+	if err = json.NewDecoder(resp.Body).Decode(job); err != nil {
+		return nil, fmt.Errorf("failed to decode job: %w", err)
+	}
+	return job, nil
+}
+
+// run runs the process of the job on the host and streams what it writes to the server. If the server responds before the
+// process exits, then the run of the job is done and the process is stopped.
+func (w *worker) run(ctx context.Context, job *workerJob) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	body, pw := io.Pipe()
+	frames := &frameWriter{enc: json.NewEncoder(pw)}
+
+	responded := make(chan error, 1)
+	go func() {
+		resp, err := w.do(ctx, http.MethodPost, "/workers/jobs/"+job.ID, body)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		// Whether the server is done with the job or can't be reached, nobody is reading the output of the process anymore.
+		cancel()
+		_ = body.CloseWithError(context.Canceled)
+		responded <- err
+	}()
+
+	p := runner.Process{
+		Args:   job.Args,
+		Env:    job.Env,
+		Stdin:  bytes.NewReader(job.Stdin),
+		Stdout: frames.stream(workerStreamStdout),
+		Stderr: frames.stream(workerStreamStderr),
+	}
+	if job.Events {
+		p.Events = frames.stream(workerStreamEvents)
+	}
+
+	exit := workerFrame{Exited: true}
+	wait, err := runner.Host{}.Start(ctx, p)
+	if err == nil {
+		err = wait()
+	}
+	if execErr := new(exec.ExitError); errors.As(err, &execErr) {
+		exit.ExitCode = execErr.ExitCode()
+	} else if err != nil {
+		exit.Error = err.Error()
+	}
+
+	_ = frames.write(exit)
+	_ = pw.Close()
+
+	if err = <-responded; errors.Is(err, errJobDone) {
+		return nil
+	}
+	return err
+}
+
+func (w *worker) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, w.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if w.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+w.apiKey)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusConflict {
+		_ = resp.Body.Close()
+		return nil, errJobDone
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d from server: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// frameWriter writes the frames of a job to the server, one at a time.
+type frameWriter struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func (f *frameWriter) write(frame workerFrame) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.enc.Encode(frame)
+}
+
+// stream returns a writer that writes what is written to it as frames of the stream.
+func (f *frameWriter) stream(name string) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		if err := f.write(workerFrame{Stream: name, Data: p}); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	})
+}
+
+// writerFunc is a function that is an io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+func (s writerFunc) Write(p []byte) (int, error) {
+	return s(p)
+}
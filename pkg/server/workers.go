@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+	"github.com/thedadams/clicky-serves/pkg/runner"
+)
+
+const (
+	// workerPollTimeout is how long a worker waits for a job before it is told to ask again.
+	workerPollTimeout = 30 * time.Second
+	// workerStopTimeout is how long a job waits for its worker to stop the process after its run is done, before the job is
+	// abandoned.
+	workerStopTimeout = 10 * time.Second
+)
+
+const (
+	workerStreamStdout = "stdout"
+	workerStreamStderr = "stderr"
+	workerStreamEvents = "events"
+)
+
+// workerJob is a gptscript process that is waiting for a worker to run it, or that a worker is running.
+type workerJob struct {
+	ID     string   `json:"id"`
+	Args   []string `json:"args"`
+	Env    []string `json:"env,omitempty"`
+	Stdin  []byte   `json:"stdin,omitempty"`
+	Events bool     `json:"events,omitempty"`
+
+	// ctx is done when the run of the job is, which tells the worker to stop the process.
+	ctx     context.Context
+	process runner.Process
+
+	lock     sync.Mutex
+	finished bool
+	done     chan error
+}
+
+// write writes the output of the process to the stream that it is for. Nothing is written once the job is finished, because
+// the run may no longer be reading its output.
+func (j *workerJob) write(stream string, data []byte) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.finished {
+		return nil
+	}
+
+	var w io.Writer
+	switch stream {
+	case workerStreamStdout:
+		w = j.process.Stdout
+	case workerStreamStderr:
+		w = j.process.Stderr
+	case workerStreamEvents:
+		w = j.process.Events
+	default:
+		return fmt.Errorf("unknown stream %q", stream)
+	}
+
+	if w != nil {
+		_, _ = w.Write(data)
+	}
+	return nil
+}
+
+// finish finishes the job with the error of the process, unless it is already finished.
+func (j *workerJob) finish(err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if !j.finished {
+		j.finished = true
+		j.done <- err
+	}
+}
+
+// wait waits for the job to finish. If the run of the job is done first, then the worker is given some time to stop the
+// process before the job is abandoned.
+func (j *workerJob) wait() error {
+	select {
+	case err := <-j.done:
+		return err
+	case <-j.ctx.Done():
+	}
+
+	timer := time.NewTimer(workerStopTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-j.done:
+		return err
+	case <-timer.C:
+		j.finish(j.ctx.Err())
+		return <-j.done
+	}
+}
+
+// workerFrame is part of what a worker sends back about a job: either output of the process, or how the process exited.
+type workerFrame struct {
+	Stream   string `json:"stream,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	Exited   bool   `json:"exited,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// workerQueue is the backend of a server whose runs are executed by workers. The processes of runs are queued until a worker
+// claims them, and the workers send their output back while they run them.
+type workerQueue struct {
+	pending chan *workerJob
+
+	lock    sync.Mutex
+	running map[string]*workerJob
+}
+
+func newWorkerQueue() *workerQueue {
+	return &workerQueue{
+		pending: make(chan *workerJob),
+		running: make(map[string]*workerJob),
+	}
+}
+
+func (q *workerQueue) Start(ctx context.Context, p runner.Process) (func() error, error) {
+	job := &workerJob{
+		ID:      uuid.NewString(),
+		Args:    p.Args,
+		Env:     p.Env,
+		Events:  p.Events != nil,
+		ctx:     ctx,
+		process: p,
+		done:    make(chan error, 1),
+	}
+	if p.Stdin != nil {
+		stdin, err := io.ReadAll(p.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stdin: %w", err)
+		}
+		job.Stdin = stdin
+	}
+
+	go func() {
+		select {
+		case q.pending <- job:
+		case <-ctx.Done():
+			job.finish(fmt.Errorf("no worker claimed the job: %w", ctx.Err()))
+		}
+	}()
+
+	return job.wait, nil
+}
+
+// claim waits for a job to be queued and gives it to the worker, or returns nil if there is none before the poll timeout.
+func (q *workerQueue) claim(ctx context.Context) *workerJob {
+	timer := time.NewTimer(workerPollTimeout)
+	defer timer.Stop()
+
+	select {
+	case job := <-q.pending:
+		q.lock.Lock()
+		q.running[job.ID] = job
+		q.lock.Unlock()
+		return job
+	case <-ctx.Done():
+		return nil
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (q *workerQueue) get(id string) *workerJob {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.running[id]
+}
+
+func (q *workerQueue) remove(id string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.running, id)
+}
+
+// claimJob gives the next queued job to the worker that is calling, waiting for one if there is none. If there still is none after
+// a while, then the response has a 204 status code and the worker should ask again.
+func (s *server) claimJob(w http.ResponseWriter, r *http.Request) {
+	job := s.workers.claim(r.Context())
+	if job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	b, err := json.Marshal(job)
+	if err == nil {
+		_, err = w.Write(b)
+	}
+	if err != nil {
+		// The worker won't run the job, so the run doesn't wait for it.
+		s.workers.remove(job.ID)
+		job.finish(fmt.Errorf("failed to give the job to a worker: %w", err))
+		ccontext.GetLogger(r.Context()).Error("Failed to give job to worker", "job", job.ID, "error", err)
+	}
+}
+
+// streamJob receives what the worker that claimed the job sends back about it, as a stream of newline-delimited JSON frames, while
+// the worker runs it. If the run of the job is done before the process exits, then the response is sent right away, which tells
+// the worker to stop the process.
+func (s *server) streamJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job := s.workers.get(id)
+	if job == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s not found", id))
+		return
+	}
+	defer s.workers.remove(id)
+
+	// The response is sent while the worker is still sending the request if the run is done, so that it can stop the process.
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+		ccontext.GetLogger(r.Context()).Warn("Failed to enable full duplex for worker", "error", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- receiveFrames(job, r.Body)
+	}()
+
+	select {
+	case err := <-exited:
+		job.finish(err)
+		writeResponse(w, map[string]string{"status": "ok"})
+	case <-job.ctx.Done():
+		job.finish(job.ctx.Err())
+		writeError(w, http.StatusConflict, errJobDone)
+	}
+}
+
+// receiveFrames writes the output that the worker sends to the process of the job, and returns the error of the process once it
+// exits.
+func receiveFrames(job *workerJob, body io.Reader) error {
+	dec := json.NewDecoder(body)
+	for {
+		var f workerFrame
+		if err := dec.Decode(&f); err != nil {
+			return fmt.Errorf("lost the worker of the job: %w", err)
+		}
+
+		if f.Exited {
+			switch {
+			case f.Error != "":
+				return errors.New(f.Error)
+			case f.ExitCode != 0:
+				return fmt.Errorf("gptscript exited with code %d", f.ExitCode)
+			default:
+				return nil
+			}
+		}
+
+		if err := job.write(f.Stream, f.Data); err != nil {
+			return err
+		}
+	}
+}
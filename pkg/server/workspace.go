@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	ccontext "github.com/thedadams/clicky-serves/pkg/context"
+)
+
+// newRunWorkspaces creates the directory of the workspaces of runs in the upload directory, so that backends can make them available
+// like the workspaces of sessions.
+func newRunWorkspaces(uploadDir string) (string, error) {
+	dir := filepath.Join(uploadDir, ".workspaces")
+	// The artifacts of the runs that were in progress when the server stopped were never kept, so their workspaces are removed.
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("failed to clear run workspaces: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create run workspaces: %w", err)
+	}
+	return dir, nil
+}
+
+// runWorkspace is the workspace of a run, whose files are kept as its artifacts and pushed to the storage of the server when the
+// run ends.
+type runWorkspace struct {
+	dir string
+	// since is when the run started. Only the files of the workspace of a session that changed since then are artifacts of the run,
+	// because the files from before belong to the runs before it.
+	since time.Time
+	// own is whether the workspace belongs to the run, so that it is removed once the run ends.
+	own bool
+	// session is the session of the run, if it has one.
+	session *session
+}
+
+// withRunWorkspace returns the context of the run with its workspace: the workspace of its session if it has one, which is pulled
+// from the storage of the server first, or otherwise a new workspace of its own if artifacts are kept, which is made the workspace
+// of its gptscript process. The returned workspace is nil if the run needs neither.
+func (s *server) withRunWorkspace(ctx context.Context, runID string) (context.Context, *runWorkspace, error) {
+	sess := sessionOf(ctx)
+	if sess != nil && (s.artifacts != nil || s.sessions.storage != nil) {
+		if err := s.sessions.pull(ctx, sess); err != nil {
+			return nil, nil, fmt.Errorf("failed to pull workspace of session: %w", err)
+		}
+		return ctx, &runWorkspace{dir: sess.workspace, since: time.Now(), session: sess}, nil
+	}
+	if sess != nil || s.artifacts == nil {
+		return ctx, nil, nil
+	}
+
+	workspace := filepath.Join(s.workspaces, runID)
+	if err := os.Mkdir(workspace, 0o700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create workspace of run: %w", err)
+	}
+
+	env := append(slices.Clone(ccontext.GetRunEnv(ctx)), "GPTSCRIPT_WORKSPACE="+workspace)
+	return ccontext.WithRunEnv(ctx, env), &runWorkspace{dir: workspace, since: time.Now(), own: true}, nil
+}
+
+// endRunWorkspace keeps the artifacts of the run if they are kept, pushes the workspace of its session to the storage of the server
+// if it has one, and removes the workspace if it belongs to the run.
+func (s *server) endRunWorkspace(ctx context.Context, l *slog.Logger, runID string, rw *runWorkspace) {
+	if rw == nil {
+		return
+	}
+
+	if s.artifacts != nil {
+		s.keepArtifacts(ctx, l, runID, rw)
+	}
+	if rw.session != nil {
+		if err := s.sessions.push(ctx, rw.session, rw.since); err != nil {
+			l.Error("Failed to push workspace of session", "error", err)
+		}
+	}
+	if rw.own {
+		if err := os.RemoveAll(rw.dir); err != nil {
+			l.Error("Failed to remove workspace of run", "error", err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Store that keeps runs in memory, forgetting them once they have ended more than the retention ago.
+// Schedules and tools are kept until they are deleted, and usage is kept for as long as the server runs.
+type Memory struct {
+	lock      sync.RWMutex
+	retention time.Duration
+	runs      map[string]Run
+	events    map[string][]Event
+	logs      map[string][]Log
+	schedules map[string]Schedule
+	// tools are the versions of each tool, oldest first.
+	tools map[toolKey][]Tool
+	usage map[usageKey]UsageRecord
+}
+
+type toolKey struct {
+	tenant string
+	name   string
+}
+
+type usageKey struct {
+	tenant string
+	client string
+	day    time.Time
+}
+
+func NewMemory(retention time.Duration) *Memory {
+	return &Memory{
+		retention: retention,
+		runs:      make(map[string]Run),
+		events:    make(map[string][]Event),
+		logs:      make(map[string][]Log),
+		schedules: make(map[string]Schedule),
+		tools:     make(map[toolKey][]Tool),
+		usage:     make(map[usageKey]UsageRecord),
+	}
+}
+
+func (m *Memory) SaveRun(_ context.Context, run Run) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.prune()
+	m.runs[run.ID] = run
+	return nil
+}
+
+func (m *Memory) GetRun(_ context.Context, tenant, id string) (Run, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	run, ok := m.runs[id]
+	if !ok || run.Tenant != tenant {
+		return Run{}, ErrNotFound
+	}
+	return run, nil
+}
+
+func (m *Memory) ListRuns(_ context.Context, filter Filter) ([]Run, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	runs := make([]Run, 0, len(m.runs))
+	for _, r := range m.runs {
+		if r.Tenant == filter.Tenant && (filter.State == "" || r.State == filter.State) &&
+			(filter.ScheduleID == "" || r.ScheduleID == filter.ScheduleID) && !r.StartTime.Before(filter.Since) {
+			runs = append(runs, r)
+		}
+	}
+
+	slices.SortFunc(runs, func(a, b Run) int {
+		return a.StartTime.Compare(b.StartTime)
+	})
+
+	return runs, nil
+}
+
+func (m *Memory) AddEvent(_ context.Context, runID string, event Event) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.runs[runID]; !ok {
+		return ErrNotFound
+	}
+
+	m.events[runID] = append(m.events[runID], event)
+	return nil
+}
+
+func (m *Memory) ListEvents(_ context.Context, runID string, after int64) ([]Event, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	events := m.events[runID]
+	i, _ := slices.BinarySearchFunc(events, after, func(e Event, id int64) int {
+		if e.ID <= id {
+			return -1
+		}
+		return 1
+	})
+
+	return slices.Clone(events[i:]), nil
+}
+
+func (m *Memory) AddLog(_ context.Context, runID string, log Log) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.runs[runID]; !ok {
+		return ErrNotFound
+	}
+
+	m.logs[runID] = append(m.logs[runID], log)
+	return nil
+}
+
+func (m *Memory) ListLogs(_ context.Context, runID string) ([]Log, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return slices.Clone(m.logs[runID]), nil
+}
+
+func (m *Memory) SaveSchedule(_ context.Context, schedule Schedule) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.schedules[schedule.ID] = schedule
+	return nil
+}
+
+func (m *Memory) GetSchedule(_ context.Context, tenant, id string) (Schedule, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	schedule, ok := m.schedules[id]
+	if !ok || schedule.Tenant != tenant {
+		return Schedule{}, ErrNotFound
+	}
+	return schedule, nil
+}
+
+func (m *Memory) ListSchedules(context.Context) ([]Schedule, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	schedules := make([]Schedule, 0, len(m.schedules))
+	for _, s := range m.schedules {
+		schedules = append(schedules, s)
+	}
+
+	slices.SortFunc(schedules, func(a, b Schedule) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return schedules, nil
+}
+
+func (m *Memory) DeleteSchedule(_ context.Context, tenant, id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if schedule, ok := m.schedules[id]; !ok || schedule.Tenant != tenant {
+		return ErrNotFound
+	}
+
+	delete(m.schedules, id)
+	return nil
+}
+
+func (m *Memory) AddTool(_ context.Context, tool Tool) (Tool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := toolKey{tenant: tool.Tenant, name: tool.Name}
+	tool.Version = len(m.tools[key]) + 1
+	m.tools[key] = append(m.tools[key], tool)
+	return tool, nil
+}
+
+func (m *Memory) GetTool(_ context.Context, tenant, name string, version int) (Tool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	versions := m.tools[toolKey{tenant: tenant, name: name}]
+	if version == 0 {
+		version = len(versions)
+	}
+	if version < 1 || version > len(versions) {
+		return Tool{}, ErrNotFound
+	}
+	return versions[version-1], nil
+}
+
+func (m *Memory) ListTools(_ context.Context, tenant string) ([]Tool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	tools := make([]Tool, 0, len(m.tools))
+	for key, versions := range m.tools {
+		if key.tenant == tenant {
+			tools = append(tools, versions[len(versions)-1])
+		}
+	}
+
+	slices.SortFunc(tools, func(a, b Tool) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return tools, nil
+}
+
+func (m *Memory) ListToolVersions(_ context.Context, tenant, name string) ([]Tool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	versions, ok := m.tools[toolKey{tenant: tenant, name: name}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return slices.Clone(versions), nil
+}
+
+func (m *Memory) DeleteTool(_ context.Context, tenant, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := toolKey{tenant: tenant, name: name}
+	if _, ok := m.tools[key]; !ok {
+		return ErrNotFound
+	}
+
+	delete(m.tools, key)
+	return nil
+}
+
+func (m *Memory) AddUsage(_ context.Context, tenant, client string, day time.Time, usage Usage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := usageKey{tenant: tenant, client: client, day: day.UTC()}
+	record, ok := m.usage[key]
+	if !ok {
+		record = UsageRecord{Client: client, Day: key.day}
+	}
+
+	record.Runs++
+	record.Add(usage)
+	m.usage[key] = record
+	return nil
+}
+
+func (m *Memory) ListUsage(_ context.Context, tenant string, since time.Time) ([]UsageRecord, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	records := make([]UsageRecord, 0, len(m.usage))
+	for key, r := range m.usage {
+		if key.tenant == tenant && !r.Day.Before(since) {
+			records = append(records, r)
+		}
+	}
+
+	slices.SortFunc(records, func(a, b UsageRecord) int {
+		if c := a.Day.Compare(b.Day); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Client, b.Client)
+	})
+
+	return records, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// prune removes the runs that ended more than the retention ago. The lock must be held by the caller.
+func (m *Memory) prune() {
+	for id, r := range m.runs {
+		if r.EndTime != nil && time.Since(*r.EndTime) > m.retention {
+			delete(m.runs, id)
+			delete(m.events, id)
+			delete(m.logs, id)
+		}
+	}
+}
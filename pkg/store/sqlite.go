@@ -0,0 +1,582 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id TEXT PRIMARY KEY,
+	type TEXT NOT NULL,
+	state TEXT NOT NULL,
+	error TEXT NOT NULL,
+	input BLOB,
+	output TEXT NOT NULL,
+	start_time INTEGER NOT NULL,
+	end_time INTEGER
+);
+CREATE INDEX IF NOT EXISTS runs_start_time ON runs (start_time);
+CREATE TABLE IF NOT EXISTS events (
+	run_id TEXT NOT NULL REFERENCES runs (id) ON DELETE CASCADE,
+	id INTEGER NOT NULL,
+	time INTEGER NOT NULL,
+	data BLOB NOT NULL,
+	PRIMARY KEY (run_id, id)
+);
+CREATE TABLE IF NOT EXISTS logs (
+	run_id TEXT NOT NULL REFERENCES runs (id) ON DELETE CASCADE,
+	time INTEGER NOT NULL,
+	level TEXT NOT NULL,
+	message TEXT NOT NULL,
+	attrs BLOB
+);
+CREATE INDEX IF NOT EXISTS logs_run_id ON logs (run_id);
+CREATE TABLE IF NOT EXISTS schedules (
+	id TEXT PRIMARY KEY,
+	owner TEXT NOT NULL,
+	cron TEXT NOT NULL,
+	request BLOB NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+` + sqliteToolsTable + sqliteUsageTable
+
+// sqliteToolsTable and sqliteUsageTable are the tables whose primary keys have the tenant, which are also how the tables of
+// databases from before there were tenants are rebuilt.
+const (
+	sqliteToolsTable = `
+CREATE TABLE IF NOT EXISTS tools (
+	tenant TEXT NOT NULL,
+	name TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	description TEXT NOT NULL,
+	content TEXT NOT NULL,
+	owner TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	limits BLOB,
+	PRIMARY KEY (tenant, name, version)
+);
+`
+	sqliteUsageTable = `
+CREATE TABLE IF NOT EXISTS usage (
+	tenant TEXT NOT NULL,
+	client TEXT NOT NULL,
+	day INTEGER NOT NULL,
+	runs INTEGER NOT NULL,
+	prompt_tokens INTEGER NOT NULL,
+	completion_tokens INTEGER NOT NULL,
+	total_tokens INTEGER NOT NULL,
+	cost REAL NOT NULL,
+	PRIMARY KEY (tenant, client, day)
+);
+`
+)
+
+// sqliteColumns are the columns that were added to the tables after they were first created, so databases that were created
+// before then get them when they are opened.
+var sqliteColumns = []struct {
+	table, column, definition string
+}{
+	{"runs", "schedule_id", "TEXT NOT NULL DEFAULT ''"},
+	{"runs", "client", "TEXT NOT NULL DEFAULT ''"},
+	{"runs", "usage", "BLOB"},
+	{"runs", "tenant", "TEXT NOT NULL DEFAULT ''"},
+	{"schedules", "tenant", "TEXT NOT NULL DEFAULT ''"},
+	{"tools", "limits", "BLOB"},
+}
+
+// SQLite is a Store that keeps runs in a SQLite database, so that the history survives restarts of the server.
+type SQLite struct {
+	db *sql.DB
+}
+
+// NewSQLite opens the SQLite database at the path, creating it and its tables if they don't exist.
+func NewSQLite(ctx context.Context, path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open run history database: %w", err)
+	}
+
+	// SQLite only allows one writer at a time, so a single connection avoids busy errors between the connections of the pool.
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.ExecContext(ctx, sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create run history tables: %w", err)
+	}
+
+	if err = addColumns(ctx, db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	if err = addTenant(ctx, db, "tools", sqliteToolsTable, "name, version, description, content, owner, created_at, limits"); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err = addTenant(ctx, db, "usage", sqliteUsageTable, "client, day, runs, prompt_tokens, completion_tokens, total_tokens, cost"); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &SQLite{db: db}, nil
+}
+
+// addColumns adds the columns in sqliteColumns that the tables don't have yet.
+func addColumns(ctx context.Context, db *sql.DB) error {
+	for _, c := range sqliteColumns {
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", c.table, c.column).Scan(&n); err != nil {
+			return fmt.Errorf("failed to read columns of %s: %w", c.table, err)
+		}
+		if n > 0 {
+			continue
+		}
+
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return fmt.Errorf("failed to add column %s to %s: %w", c.column, c.table, err)
+		}
+	}
+	return nil
+}
+
+// addTenant rebuilds a table of databases from before there were tenants, whose primary key doesn't have the tenant, with the
+// statement that creates it. The rows that it had, which have the columns, are kept in the default tenant.
+func addTenant(ctx context.Context, db *sql.DB, table, create, columns string) error {
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'tenant'", table).Scan(&n); err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to migrate %s: %w", table, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, stmt := range []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s_old", table, table),
+		create,
+		fmt.Sprintf("INSERT INTO %s (tenant, %s) SELECT '', %s FROM %s_old", table, columns, columns, table),
+		fmt.Sprintf("DROP TABLE %s_old", table),
+	} {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", table, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to migrate %s: %w", table, err)
+	}
+	return nil
+}
+
+func (s *SQLite) SaveRun(ctx context.Context, run Run) error {
+	var usage []byte
+	if run.Usage != nil {
+		var err error
+		if usage, err = json.Marshal(run.Usage); err != nil {
+			return fmt.Errorf("failed to marshal usage of run %s: %w", run.ID, err)
+		}
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO runs (id, type, state, error, input, output, start_time, end_time, schedule_id, client, usage, tenant) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET
+	state = excluded.state, error = excluded.error, input = excluded.input, output = excluded.output, end_time = excluded.end_time,
+	usage = excluded.usage`,
+		run.ID, run.Type, run.State, run.Error, []byte(run.Input), run.Output, run.StartTime.UnixNano(), nanos(run.EndTime), run.ScheduleID,
+		run.Client, usage, run.Tenant,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save run %s: %w", run.ID, err)
+	}
+	return nil
+}
+
+func (s *SQLite) GetRun(ctx context.Context, tenant, id string) (Run, error) {
+	runs, err := s.queryRuns(ctx, "WHERE id = ? AND tenant = ?", id, tenant)
+	if err != nil {
+		return Run{}, err
+	}
+	if len(runs) == 0 {
+		return Run{}, ErrNotFound
+	}
+	return runs[0], nil
+}
+
+func (s *SQLite) ListRuns(ctx context.Context, filter Filter) ([]Run, error) {
+	var (
+		conditions = []string{"tenant = ?"}
+		args       = []any{filter.Tenant}
+	)
+	if filter.State != "" {
+		conditions = append(conditions, "state = ?")
+		args = append(args, filter.State)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "start_time >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if filter.ScheduleID != "" {
+		conditions = append(conditions, "schedule_id = ?")
+		args = append(args, filter.ScheduleID)
+	}
+
+	return s.queryRuns(ctx, "WHERE "+strings.Join(conditions, " AND ")+" ORDER BY start_time", args...)
+}
+
+func (s *SQLite) queryRuns(ctx context.Context, clause string, args ...any) ([]Run, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, type, state, error, input, output, start_time, end_time, schedule_id, client, usage, tenant FROM runs "+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := make([]Run, 0)
+	for rows.Next() {
+		var (
+			r         Run
+			startTime int64
+			endTime   sql.NullInt64
+			usage     []byte
+		)
+		if err = rows.Scan(&r.ID, &r.Type, &r.State, &r.Error, &r.Input, &r.Output, &startTime, &endTime, &r.ScheduleID, &r.Client, &usage, &r.Tenant); err != nil {
+			return nil, fmt.Errorf("failed to read run: %w", err)
+		}
+
+		if len(usage) > 0 {
+			r.Usage = new(Usage)
+			if err = json.Unmarshal(usage, r.Usage); err != nil {
+				return nil, fmt.Errorf("failed to decode usage of run %s: %w", r.ID, err)
+			}
+		}
+
+		r.StartTime = time.Unix(0, startTime)
+		if endTime.Valid {
+			t := time.Unix(0, endTime.Int64)
+			r.EndTime = &t
+		}
+		runs = append(runs, r)
+	}
+
+	return runs, rows.Err()
+}
+
+func (s *SQLite) AddEvent(ctx context.Context, runID string, event Event) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO events (run_id, id, time, data) VALUES (?, ?, ?, ?)",
+		runID, event.ID, event.Time.UnixNano(), []byte(event.Data),
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY") {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to add event to run %s: %w", runID, err)
+	}
+	return nil
+}
+
+func (s *SQLite) ListEvents(ctx context.Context, runID string, after int64) ([]Event, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, time, data FROM events WHERE run_id = ? AND id > ? ORDER BY id", runID, after)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	for rows.Next() {
+		var (
+			e Event
+			t int64
+		)
+		if err = rows.Scan(&e.ID, &t, &e.Data); err != nil {
+			return nil, fmt.Errorf("failed to read event: %w", err)
+		}
+
+		e.Time = time.Unix(0, t)
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *SQLite) AddLog(ctx context.Context, runID string, log Log) error {
+	var attrs []byte
+	if len(log.Attrs) > 0 {
+		var err error
+		if attrs, err = json.Marshal(log.Attrs); err != nil {
+			return fmt.Errorf("failed to marshal attributes of log of run %s: %w", runID, err)
+		}
+	}
+
+	_, err := s.db.ExecContext(ctx, "INSERT INTO logs (run_id, time, level, message, attrs) VALUES (?, ?, ?, ?, ?)",
+		runID, log.Time.UnixNano(), log.Level, log.Message, attrs,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY") {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to add log to run %s: %w", runID, err)
+	}
+	return nil
+}
+
+func (s *SQLite) ListLogs(ctx context.Context, runID string) ([]Log, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT time, level, message, attrs FROM logs WHERE run_id = ? ORDER BY rowid", runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query logs: %w", err)
+	}
+	defer rows.Close()
+
+	logs := make([]Log, 0)
+	for rows.Next() {
+		var (
+			l     Log
+			t     int64
+			attrs []byte
+		)
+		if err = rows.Scan(&t, &l.Level, &l.Message, &attrs); err != nil {
+			return nil, fmt.Errorf("failed to read log: %w", err)
+		}
+		if len(attrs) > 0 {
+			if err = json.Unmarshal(attrs, &l.Attrs); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal attributes of log: %w", err)
+			}
+		}
+
+		l.Time = time.Unix(0, t)
+		logs = append(logs, l)
+	}
+
+	return logs, rows.Err()
+}
+
+func (s *SQLite) SaveSchedule(ctx context.Context, schedule Schedule) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO schedules (id, owner, tenant, cron, request, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET cron = excluded.cron, request = excluded.request, updated_at = excluded.updated_at`,
+		schedule.ID, schedule.Owner, schedule.Tenant, schedule.Cron, []byte(schedule.Request), schedule.CreatedAt.UnixNano(), schedule.UpdatedAt.UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save schedule %s: %w", schedule.ID, err)
+	}
+	return nil
+}
+
+func (s *SQLite) GetSchedule(ctx context.Context, tenant, id string) (Schedule, error) {
+	schedules, err := s.querySchedules(ctx, "WHERE id = ? AND tenant = ?", id, tenant)
+	if err != nil {
+		return Schedule{}, err
+	}
+	if len(schedules) == 0 {
+		return Schedule{}, ErrNotFound
+	}
+	return schedules[0], nil
+}
+
+func (s *SQLite) ListSchedules(ctx context.Context) ([]Schedule, error) {
+	return s.querySchedules(ctx, "ORDER BY created_at")
+}
+
+func (s *SQLite) querySchedules(ctx context.Context, clause string, args ...any) ([]Schedule, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, owner, tenant, cron, request, created_at, updated_at FROM schedules "+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedules: %w", err)
+	}
+	defer rows.Close()
+
+	schedules := make([]Schedule, 0)
+	for rows.Next() {
+		var (
+			sc                   Schedule
+			createdAt, updatedAt int64
+		)
+		if err = rows.Scan(&sc.ID, &sc.Owner, &sc.Tenant, &sc.Cron, &sc.Request, &createdAt, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read schedule: %w", err)
+		}
+
+		sc.CreatedAt = time.Unix(0, createdAt)
+		sc.UpdatedAt = time.Unix(0, updatedAt)
+		schedules = append(schedules, sc)
+	}
+
+	return schedules, rows.Err()
+}
+
+func (s *SQLite) DeleteSchedule(ctx context.Context, tenant, id string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM schedules WHERE id = ? AND tenant = ?", id, tenant)
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule %s: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) AddTool(ctx context.Context, tool Tool) (Tool, error) {
+	var (
+		limits []byte
+		err    error
+	)
+	if tool.Limits != nil {
+		if limits, err = json.Marshal(tool.Limits); err != nil {
+			return Tool{}, fmt.Errorf("failed to marshal limits of tool %s: %w", tool.Name, err)
+		}
+	}
+
+	// The version is numbered by the insert, so that versions that are added at the same time can't get the same number.
+	err = s.db.QueryRowContext(ctx, `
+INSERT INTO tools (tenant, name, version, description, content, owner, created_at, limits)
+SELECT ?, ?, COALESCE(MAX(version), 0) + 1, ?, ?, ?, ?, ? FROM tools WHERE tenant = ? AND name = ?
+RETURNING version`,
+		tool.Tenant, tool.Name, tool.Description, tool.Content, tool.Owner, tool.CreatedAt.UnixNano(), limits, tool.Tenant, tool.Name,
+	).Scan(&tool.Version)
+	if err != nil {
+		return Tool{}, fmt.Errorf("failed to add tool %s: %w", tool.Name, err)
+	}
+	return tool, nil
+}
+
+func (s *SQLite) GetTool(ctx context.Context, tenant, name string, version int) (Tool, error) {
+	var (
+		tools []Tool
+		err   error
+	)
+	if version == 0 {
+		tools, err = s.queryTools(ctx, "WHERE tenant = ? AND name = ? ORDER BY version DESC LIMIT 1", tenant, name)
+	} else {
+		tools, err = s.queryTools(ctx, "WHERE tenant = ? AND name = ? AND version = ?", tenant, name, version)
+	}
+	if err != nil {
+		return Tool{}, err
+	}
+	if len(tools) == 0 {
+		return Tool{}, ErrNotFound
+	}
+	return tools[0], nil
+}
+
+func (s *SQLite) ListTools(ctx context.Context, tenant string) ([]Tool, error) {
+	return s.queryTools(ctx, "WHERE tenant = ? AND (name, version) IN (SELECT name, MAX(version) FROM tools WHERE tenant = ? GROUP BY name) ORDER BY name",
+		tenant, tenant)
+}
+
+func (s *SQLite) ListToolVersions(ctx context.Context, tenant, name string) ([]Tool, error) {
+	tools, err := s.queryTools(ctx, "WHERE tenant = ? AND name = ? ORDER BY version", tenant, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(tools) == 0 {
+		return nil, ErrNotFound
+	}
+	return tools, nil
+}
+
+func (s *SQLite) queryTools(ctx context.Context, clause string, args ...any) ([]Tool, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT tenant, name, version, description, content, owner, created_at, limits FROM tools "+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tools: %w", err)
+	}
+	defer rows.Close()
+
+	tools := make([]Tool, 0)
+	for rows.Next() {
+		var (
+			t         Tool
+			createdAt int64
+			limits    []byte
+		)
+		if err = rows.Scan(&t.Tenant, &t.Name, &t.Version, &t.Description, &t.Content, &t.Owner, &createdAt, &limits); err != nil {
+			return nil, fmt.Errorf("failed to read tool: %w", err)
+		}
+
+		if len(limits) > 0 {
+			t.Limits = new(ToolLimits)
+			if err = json.Unmarshal(limits, t.Limits); err != nil {
+				return nil, fmt.Errorf("failed to decode limits of tool %s: %w", t.Name, err)
+			}
+		}
+
+		t.CreatedAt = time.Unix(0, createdAt)
+		tools = append(tools, t)
+	}
+
+	return tools, rows.Err()
+}
+
+func (s *SQLite) DeleteTool(ctx context.Context, tenant, name string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM tools WHERE tenant = ? AND name = ?", tenant, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete tool %s: %w", name, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) AddUsage(ctx context.Context, tenant, client string, day time.Time, usage Usage) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO usage (tenant, client, day, runs, prompt_tokens, completion_tokens, total_tokens, cost) VALUES (?, ?, ?, 1, ?, ?, ?, ?)
+ON CONFLICT (tenant, client, day) DO UPDATE SET
+	runs = runs + 1, prompt_tokens = prompt_tokens + excluded.prompt_tokens,
+	completion_tokens = completion_tokens + excluded.completion_tokens, total_tokens = total_tokens + excluded.total_tokens,
+	cost = cost + excluded.cost`,
+		tenant, client, day.UnixNano(), usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens, usage.Cost,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add usage of %s: %w", client, err)
+	}
+	return nil
+}
+
+func (s *SQLite) ListUsage(ctx context.Context, tenant string, since time.Time) ([]UsageRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT client, day, runs, prompt_tokens, completion_tokens, total_tokens, cost FROM usage WHERE tenant = ? AND day >= ? ORDER BY day, client`,
+		tenant, since.UnixNano(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	records := make([]UsageRecord, 0)
+	for rows.Next() {
+		var (
+			r   UsageRecord
+			day int64
+		)
+		if err = rows.Scan(&r.Client, &day, &r.Runs, &r.PromptTokens, &r.CompletionTokens, &r.TotalTokens, &r.Cost); err != nil {
+			return nil, fmt.Errorf("failed to read usage: %w", err)
+		}
+
+		r.Day = time.Unix(0, day).UTC()
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+func nanos(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,183 @@
+// Package store records the history of runs, so that a run can be inspected after the client that started it has gone away.
+// It also keeps the schedules that start runs, the usage of the clients that started them, and the tools that are registered to be
+// run by name.
+//
+// Everything that is kept belongs to a tenant, and is only found through the tenant that it belongs to, so that the tenants of a
+// server can't see each other's runs, usage, or tools. The empty tenant is the default tenant, which is the tenant of everything
+// when the server has no tenants.
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Run is the record of a single run of a tool or file.
+type Run struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+	// Input is the request that started the run, including its options.
+	Input json.RawMessage `json:"input,omitempty"`
+	// Output is the stdout of the run once it has ended.
+	Output    string     `json:"output,omitempty"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	// ScheduleID is the ID of the schedule that started the run, if a schedule did.
+	ScheduleID string `json:"scheduleID,omitempty"`
+	// Client is the name of the caller that started the run, or empty if authentication is disabled.
+	Client string `json:"client,omitempty"`
+	// Usage is the tokens that the run used, if its events were streamed.
+	Usage *Usage `json:"usage,omitempty"`
+	// Tenant is the tenant of the client that started the run.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Usage is a number of tokens, and their estimated cost in US dollars.
+type Usage struct {
+	PromptTokens     int64   `json:"promptTokens"`
+	CompletionTokens int64   `json:"completionTokens"`
+	TotalTokens      int64   `json:"totalTokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// Add adds the other usage to the usage.
+func (u *Usage) Add(other Usage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	u.Cost += other.Cost
+}
+
+// UsageRecord is the usage of the runs of a client that ended on a day.
+type UsageRecord struct {
+	Client string `json:"client"`
+	// Day is the start of the day, in UTC.
+	Day   time.Time `json:"day"`
+	Runs  int64     `json:"runs"`
+	Usage `json:",inline"`
+}
+
+// Event is an event that was written to the client of a run. The ID is the position of the event in the run, starting at 1.
+type Event struct {
+	ID   int64           `json:"id"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Log is a line that the server logged about a run.
+type Log struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	// Attrs are the attributes of the line, with the keys of groups joined by dots.
+	Attrs map[string]any `json:"attrs,omitempty"`
+}
+
+// Filter limits the runs that are listed. The zero value of each field matches all runs.
+type Filter struct {
+	// Tenant is the tenant of the runs. It is always matched, so the empty tenant only matches the runs of the default tenant.
+	Tenant string
+	State  string
+	// Since only matches runs that started at or after the time.
+	Since      time.Time
+	ScheduleID string
+}
+
+// Schedule runs a tool or file whenever its cron expression matches.
+type Schedule struct {
+	ID string `json:"id"`
+	// Owner is the name of the caller that created the schedule, and Tenant is its tenant.
+	Owner  string `json:"owner,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	Cron   string `json:"cron"`
+	// Request is the tool or file that is run, including its options.
+	Request   json.RawMessage `json:"request"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// Tool is a version of a tool that is registered by name, so that clients can run it without sending its content.
+type Tool struct {
+	Name string `json:"name"`
+	// Version is the number of the version, which starts at 1 and goes up by one with each new version of the tool.
+	Version     int    `json:"version"`
+	Description string `json:"description,omitempty"`
+	// Content is the gptscript text of the tool. It can define several tools, of which the first is the one that is run.
+	Content string `json:"content"`
+	// Limits are what runs of the version are held to, whatever the options of the run are.
+	Limits *ToolLimits `json:"limits,omitempty"`
+	// Owner is the name of the caller that registered the version.
+	Owner string `json:"owner,omitempty"`
+	// Tenant is the tenant that the tool is registered in. Each tenant has tools of its own, so that tenants can register tools
+	// with the same name.
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ToolLimits are the limits of the runs of a registered tool, which are set by its author because they know the safe envelope of the
+// tool better than the callers that run it.
+type ToolLimits struct {
+	// Timeout is a duration, like "30s" or "5m", that runs of the tool can't take longer than.
+	Timeout string `json:"timeout,omitempty"`
+	// MaxOutputSize is the number of bytes of output that the gptscript process of a run of the tool can write before it is killed.
+	MaxOutputSize int64 `json:"maxOutputSize,omitempty"`
+	// Models are the models that runs of the tool are allowed to use. Any model of the server is allowed if there are none.
+	Models []string `json:"models,omitempty"`
+	// OutputSchema is a JSON schema that the stdout of runs of the tool must be JSON that conforms to, as well as to the output
+	// schema of the run if it has one. OutputSchemaRetries is how many times a run whose stdout doesn't conform is run again,
+	// unless the run sets its own.
+	OutputSchema        json.RawMessage `json:"outputSchema,omitempty"`
+	OutputSchemaRetries int             `json:"outputSchemaRetries,omitempty"`
+}
+
+// Store is where the history of runs is kept.
+type Store interface {
+	// SaveRun creates the run, or replaces it if a run with the same ID exists.
+	SaveRun(ctx context.Context, run Run) error
+	// GetRun returns the run of the tenant with the given ID, or ErrNotFound.
+	GetRun(ctx context.Context, tenant, id string) (Run, error)
+	// ListRuns returns the runs of the tenant of the filter that match the filter, oldest first.
+	ListRuns(ctx context.Context, filter Filter) ([]Run, error)
+	// AddEvent adds an event to the run. The events and the logs of a run are found by the ID of the run, which must have been found
+	// through its tenant with GetRun.
+	AddEvent(ctx context.Context, runID string, event Event) error
+	// ListEvents returns the events of the run with an ID greater than after, in order.
+	ListEvents(ctx context.Context, runID string, after int64) ([]Event, error)
+	// AddLog adds a line that the server logged about the run.
+	AddLog(ctx context.Context, runID string, log Log) error
+	// ListLogs returns the lines that the server logged about the run, in order.
+	ListLogs(ctx context.Context, runID string) ([]Log, error)
+	// SaveSchedule creates the schedule, or replaces it if a schedule with the same ID exists.
+	SaveSchedule(ctx context.Context, schedule Schedule) error
+	// GetSchedule returns the schedule of the tenant with the given ID, or ErrNotFound.
+	GetSchedule(ctx context.Context, tenant, id string) (Schedule, error)
+	// ListSchedules returns the schedules of every tenant, oldest first, so that they can all be scheduled.
+	ListSchedules(ctx context.Context) ([]Schedule, error)
+	// DeleteSchedule deletes the schedule of the tenant with the given ID, or returns ErrNotFound. The runs that it started are kept.
+	DeleteSchedule(ctx context.Context, tenant, id string) error
+	// AddTool adds the tool as a new version of the tool of its tenant with its name, numbered one after its latest version, and
+	// returns it with its version.
+	AddTool(ctx context.Context, tool Tool) (Tool, error)
+	// GetTool returns the version of the tool of the tenant with the name, or its latest version if the version is 0, or
+	// ErrNotFound.
+	GetTool(ctx context.Context, tenant, name string, version int) (Tool, error)
+	// ListTools returns the latest version of every tool of the tenant, ordered by name.
+	ListTools(ctx context.Context, tenant string) ([]Tool, error)
+	// ListToolVersions returns every version of the tool of the tenant with the name, oldest first, or ErrNotFound if there are
+	// none.
+	ListToolVersions(ctx context.Context, tenant, name string) ([]Tool, error)
+	// DeleteTool deletes every version of the tool of the tenant with the name, or returns ErrNotFound.
+	DeleteTool(ctx context.Context, tenant, name string) error
+	// AddUsage adds a run with the usage to the usage of the client of the tenant on the day, which is the start of a day in UTC.
+	// The usage is kept for as long as the store exists, even once the runs are forgotten.
+	AddUsage(ctx context.Context, tenant, client string, day time.Time, usage Usage) error
+	// ListUsage returns the usage of every client of the tenant on the days at or after since, ordered by day and then by client.
+	ListUsage(ctx context.Context, tenant string, since time.Time) ([]UsageRecord, error)
+	Close() error
+}
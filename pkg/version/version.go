@@ -0,0 +1,65 @@
+// Package version reports the versions of the server and of the modules that it was built with.
+package version
+
+import (
+	"runtime/debug"
+)
+
+// Tag is the version of the server. It is set when the server is built, with
+// -ldflags "-X github.com/thedadams/clicky-serves/pkg/version.Tag=v1.2.3".
+var Tag = ""
+
+// Get returns the version of the server, which is its tag if it was built with one. Otherwise, it is the version of its module if it
+// was installed with go install, the revision that it was built from, or "dev" if none of them is known.
+func Get() string {
+	if Tag != "" {
+		return Tag
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				modified = "-dirty"
+			}
+		}
+	}
+	if revision == "" {
+		return "dev"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	return revision + modified
+}
+
+// Module returns the version of the module with the path that the server was built with, which is empty if the server doesn't
+// depend on it.
+func Module(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Path != path {
+			continue
+		}
+		if dep.Replace != nil {
+			return dep.Replace.Version
+		}
+		return dep.Version
+	}
+	return ""
+}